@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/keygen"
+)
+
+func printKeysUsage() {
+	fmt.Printf("usage:\n")
+	fmt.Printf("%s keys genkey\n", os.Args[0])
+	fmt.Printf("%s keys genpsk\n", os.Args[0])
+	fmt.Printf("%s keys pubkey < PRIVATE-KEY\n", os.Args[0])
+	fmt.Printf("%s keys vanity [-j/--jobs WORKERS] PREFIX\n", os.Args[0])
+}
+
+// keys runs the keys subcommand with args, the arguments following it,
+// and returns the exit code.
+func keys(args []string) int {
+	if len(args) == 0 {
+		printKeysUsage()
+		return ExitSetupFailed
+	}
+
+	switch args[0] {
+	case "genkey":
+		sk, err := keygen.NewPrivateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate private key:", err)
+			return ExitSetupFailed
+		}
+		fmt.Println(keygen.Encode(sk[:]))
+
+	case "genpsk":
+		psk, err := keygen.NewPresharedKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate preshared key:", err)
+			return ExitSetupFailed
+		}
+		fmt.Println(keygen.Encode(psk[:]))
+
+	case "pubkey":
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(os.Stderr, "Failed to read private key:", err)
+			return ExitSetupFailed
+		}
+		key, err := keygen.Decode(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read private key:", err)
+			return ExitSetupFailed
+		}
+		pk := keygen.PublicKey(device.NoisePrivateKey(key))
+		fmt.Println(keygen.Encode(pk[:]))
+
+	case "vanity":
+		var prefix string
+		var workers int
+		for i := 1; i < len(args); i++ {
+			switch args[i] {
+			case "-j", "--jobs":
+				if i+1 == len(args) {
+					printKeysUsage()
+					return ExitSetupFailed
+				}
+				i++
+				n, err := strconv.Atoi(args[i])
+				if err != nil || n <= 0 {
+					fmt.Fprintf(os.Stderr, "Invalid number of workers: %q\n", args[i])
+					return ExitSetupFailed
+				}
+				workers = n
+			default:
+				if prefix != "" {
+					printKeysUsage()
+					return ExitSetupFailed
+				}
+				prefix = args[i]
+			}
+		}
+		if prefix == "" {
+			printKeysUsage()
+			return ExitSetupFailed
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt)
+		defer signal.Stop(term)
+		go func() {
+			select {
+			case <-term:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		fmt.Fprintf(os.Stderr, "Searching for a public key starting with %q, about %.0f attempts expected\n", prefix, keygen.VanityAttempts(prefix))
+		sk, err := keygen.SearchVanity(ctx, prefix, workers)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to find a vanity key:", err)
+			return ExitSetupFailed
+		}
+		pk := keygen.PublicKey(sk)
+		fmt.Printf("PrivateKey = %s\n", keygen.Encode(sk[:]))
+		fmt.Printf("PublicKey = %s\n", keygen.Encode(pk[:]))
+
+	default:
+		printKeysUsage()
+		return ExitSetupFailed
+	}
+	return ExitSetupSuccess
+}
@@ -0,0 +1,569 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/config"
+	"golang.zx2c4.com/wireguard/debugvars"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/healthz"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/netops"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	ExitSetupSuccess = 0
+	ExitSetupFailed  = 1
+)
+
+const (
+	ENV_WG_TUN_FD             = "WG_TUN_FD"
+	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
+	ENV_WG_MONITOR_FD         = "WG_MONITOR_FD"
+	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+)
+
+func printUsage() {
+	fmt.Printf("usage:\n")
+	fmt.Printf("%s [-f/--foreground] [-c/--config FILE] [-m/--monitor GROUP] [--health ADDRESS] [--debug ADDRESS] INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("%s keys genkey|genpsk|pubkey|vanity ...\n", os.Args[0])
+}
+
+func warning() {
+	if runtime.GOOS != "linux" || os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1" {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "┌───────────────────────────────────────────────────┐")
+	fmt.Fprintln(os.Stderr, "│                                                   │")
+	fmt.Fprintln(os.Stderr, "│   Running this software on Linux is unnecessary,  │")
+	fmt.Fprintln(os.Stderr, "│   because the Linux kernel has built-in first     │")
+	fmt.Fprintln(os.Stderr, "│   class support for WireGuard, which will be      │")
+	fmt.Fprintln(os.Stderr, "│   faster, slicker, and better integrated. For     │")
+	fmt.Fprintln(os.Stderr, "│   information on installing the kernel module,    │")
+	fmt.Fprintln(os.Stderr, "│   please visit: <https://wireguard.com/install>.  │")
+	fmt.Fprintln(os.Stderr, "│                                                   │")
+	fmt.Fprintln(os.Stderr, "└───────────────────────────────────────────────────┘")
+}
+
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		fmt.Printf("wireguard-go v%s\n\nUserspace WireGuard daemon for %s-%s.\nInformation available at https://www.wireguard.com.\nCopyright (C) Jason A. Donenfeld <Jason@zx2c4.com>.\n", device.WireGuardGoVersion, runtime.GOOS, runtime.GOARCH)
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "keys" {
+		os.Exit(keys(os.Args[2:]))
+	}
+
+	warning()
+
+	var foreground bool
+	var interfaceName string
+	var configPath string
+	var monitorGroup string
+	var healthAddress string
+	var debugAddress string
+	for i := 1; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "-f" || arg == "--foreground":
+			foreground = true
+		case arg == "-c" || arg == "--config":
+			if i+1 == len(os.Args) {
+				printUsage()
+				return
+			}
+			i++
+			configPath = os.Args[i]
+		case strings.HasPrefix(arg, "--config="):
+			configPath = strings.TrimPrefix(arg, "--config=")
+		case arg == "-m" || arg == "--monitor":
+			if i+1 == len(os.Args) {
+				printUsage()
+				return
+			}
+			i++
+			monitorGroup = os.Args[i]
+		case strings.HasPrefix(arg, "--monitor="):
+			monitorGroup = strings.TrimPrefix(arg, "--monitor=")
+		case arg == "--health":
+			if i+1 == len(os.Args) {
+				printUsage()
+				return
+			}
+			i++
+			healthAddress = os.Args[i]
+		case strings.HasPrefix(arg, "--health="):
+			healthAddress = strings.TrimPrefix(arg, "--health=")
+		case arg == "--debug":
+			if i+1 == len(os.Args) {
+				printUsage()
+				return
+			}
+			i++
+			debugAddress = os.Args[i]
+		case strings.HasPrefix(arg, "--debug="):
+			debugAddress = strings.TrimPrefix(arg, "--debug=")
+		case interfaceName == "" && !strings.HasPrefix(arg, "-"):
+			interfaceName = arg
+		default:
+			printUsage()
+			return
+		}
+	}
+	if interfaceName == "" {
+		printUsage()
+		return
+	}
+
+	if !foreground {
+		foreground = os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1"
+	}
+
+	// load the configuration before forking, so errors reach the user
+
+	var cfg *config.Config
+	if configPath != "" {
+		var err error
+		cfg, err = config.Load(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", configPath, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	// get log level (default: info)
+
+	logLevel := func() int {
+		switch os.Getenv("LOG_LEVEL") {
+		case "debug":
+			return device.LogLevelDebug
+		case "info":
+			return device.LogLevelInfo
+		case "error":
+			return device.LogLevelError
+		case "silent":
+			return device.LogLevelSilent
+		}
+		return device.LogLevelInfo
+	}()
+
+	// get log redaction (default: keys truncated, endpoints verbatim)
+
+	var redaction device.LogRedaction
+	for _, setting := range []struct {
+		env       string
+		redaction *device.Redaction
+	}{
+		{"LOG_REDACT_KEYS", &redaction.Keys},
+		{"LOG_REDACT_ENDPOINTS", &redaction.Endpoints},
+	} {
+		if value := os.Getenv(setting.env); value != "" {
+			r, err := device.ParseRedaction(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", setting.env, err)
+				os.Exit(ExitSetupFailed)
+			}
+			*setting.redaction = r
+		}
+	}
+	redaction.Salt = []byte(os.Getenv("LOG_REDACT_SALT"))
+
+	// open TUN device (or use supplied fd)
+
+	mtu := device.DefaultMTU
+	if cfg != nil && cfg.MTU != 0 {
+		mtu = cfg.MTU
+	}
+
+	tun, err := func() (tun.Device, error) {
+		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
+		if tunFdStr == "" {
+			return tun.CreateTUN(interfaceName, mtu)
+		}
+
+		// construct tun device from supplied fd
+
+		fd, err := strconv.ParseUint(tunFdStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return tun.CreateFromFD(int(fd), mtu)
+	}()
+
+	if err == nil {
+		realInterfaceName, err2 := tun.Name()
+		if err2 == nil {
+			interfaceName = realInterfaceName
+		}
+	}
+
+	logger := device.NewLogger(
+		logLevel,
+		fmt.Sprintf("(%s) ", interfaceName),
+	)
+
+	logger.Info.Println("Starting wireguard-go version", device.WireGuardGoVersion)
+
+	logger.Debug.Println("Debug log enabled")
+
+	if err != nil {
+		logger.Error.Println("Failed to create TUN device:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	// open UAPI file (or use supplied or socket activated fd)
+
+	fileUAPI, err := func() (*os.File, error) {
+		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
+		if uapiFdStr == "" {
+			activated, err := ipc.UAPIActivated()
+			if activated != nil || err != nil {
+				return activated, err
+			}
+			return ipc.UAPIOpen(interfaceName)
+		}
+
+		// use supplied fd
+
+		fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return os.NewFile(uintptr(fd), ""), nil
+	}()
+
+	if err != nil {
+		logger.Error.Println("UAPI listen error:", err)
+		os.Exit(ExitSetupFailed)
+		return
+	}
+
+	// open the monitor socket, which members of the monitor group may use
+	// to read the configuration and statistics of the device
+
+	fileMonitor, err := func() (*os.File, error) {
+		if monitorFdStr := os.Getenv(ENV_WG_MONITOR_FD); monitorFdStr != "" {
+			fd, err := strconv.ParseUint(monitorFdStr, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			return os.NewFile(uintptr(fd), ""), nil
+		}
+		if monitorGroup == "" {
+			return nil, nil
+		}
+		gid, err := lookupGroup(monitorGroup)
+		if err != nil {
+			return nil, err
+		}
+		return ipc.UAPIOpenMonitor(interfaceName, gid)
+	}()
+
+	if err != nil {
+		logger.Error.Println("Monitor socket error:", err)
+		os.Exit(ExitSetupFailed)
+		return
+	}
+
+	// systemd supervises the process it started, which must not fork
+
+	if underSystemd() {
+		foreground = true
+	}
+
+	// daemonize the process
+
+	if !foreground {
+		env := os.Environ()
+		env = append(env, fmt.Sprintf("%s=3", ENV_WG_TUN_FD))
+		env = append(env, fmt.Sprintf("%s=4", ENV_WG_UAPI_FD))
+		env = append(env, fmt.Sprintf("%s=1", ENV_WG_PROCESS_FOREGROUND))
+		files := [3]*os.File{}
+		if os.Getenv("LOG_LEVEL") != "" && logLevel != device.LogLevelSilent {
+			files[0], _ = os.Open(os.DevNull)
+			files[1] = os.Stdout
+			files[2] = os.Stderr
+		} else {
+			files[0], _ = os.Open(os.DevNull)
+			files[1], _ = os.Open(os.DevNull)
+			files[2], _ = os.Open(os.DevNull)
+		}
+		if fileMonitor != nil {
+			env = append(env, fmt.Sprintf("%s=5", ENV_WG_MONITOR_FD))
+		}
+		attr := &os.ProcAttr{
+			Files: []*os.File{
+				files[0], // stdin
+				files[1], // stdout
+				files[2], // stderr
+				tun.File(),
+				fileUAPI,
+			},
+			Dir: ".",
+			Env: env,
+		}
+		if fileMonitor != nil {
+			attr.Files = append(attr.Files, fileMonitor)
+		}
+
+		path, err := os.Executable()
+		if err != nil {
+			logger.Error.Println("Failed to determine executable:", err)
+			os.Exit(ExitSetupFailed)
+		}
+
+		process, err := os.StartProcess(
+			path,
+			os.Args,
+			attr,
+		)
+		if err != nil {
+			logger.Error.Println("Failed to daemonize:", err)
+			os.Exit(ExitSetupFailed)
+		}
+		process.Release()
+		return
+	}
+
+	device := device.NewDeviceWithOptions(tun, logger, device.DeviceOptions{LogRedaction: redaction})
+
+	logger.Info.Println("Device started")
+
+	errs := make(chan error)
+	term := make(chan os.Signal, 1)
+
+	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
+	if err != nil {
+		logger.Error.Println("Failed to listen on uapi socket:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go device.IpcHandle(conn)
+		}
+	}()
+
+	logger.Info.Println("UAPI listener started")
+
+	var monitor net.Listener
+	if fileMonitor != nil {
+		monitor, err = ipc.UAPIListenMonitor(interfaceName, fileMonitor)
+		if err != nil {
+			logger.Error.Println("Failed to listen on monitor socket:", err)
+			uapi.Close()
+			os.Exit(ExitSetupFailed)
+		}
+		go func() {
+			for {
+				conn, err := monitor.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go device.IpcHandleMonitor(conn)
+			}
+		}()
+		logger.Info.Println("Monitor listener started")
+	}
+
+	// serve the liveness and readiness probes of orchestrators
+
+	var health net.Listener
+	if healthAddress != "" {
+		health, err = net.Listen("tcp", healthAddress)
+		if err != nil {
+			logger.Error.Println("Failed to listen for health probes:", err)
+			uapi.Close()
+			os.Exit(ExitSetupFailed)
+		}
+		go http.Serve(health, healthz.Handler(device))
+		logger.Info.Println("Health probes served on", health.Addr())
+	}
+
+	// serve the internal counters at /debug/vars
+
+	var debug net.Listener
+	if debugAddress != "" {
+		debug, err = net.Listen("tcp", debugAddress)
+		if err != nil {
+			logger.Error.Println("Failed to listen for debug vars:", err)
+			uapi.Close()
+			if health != nil {
+				health.Close()
+			}
+			os.Exit(ExitSetupFailed)
+		}
+		debugvars.Publish("wireguard", device)
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go http.Serve(debug, mux)
+		logger.Info.Println("Debug vars served on", debug.Addr())
+	}
+
+	// configure the device and the interface
+
+	var iface *netops.Interface
+	if cfg != nil {
+		iface, err = setUp(interfaceName, cfg, device, logger)
+		if err != nil {
+			logger.Error.Println("Failed to configure device:", err)
+			uapi.Close()
+			device.Close()
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Info.Println("Configuration", configPath, "applied")
+	}
+
+	// report readiness to systemd and feed its watchdog
+
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Error.Println("Failed to notify systemd:", err)
+	}
+	watchdogStop := make(chan struct{})
+	if interval := sdWatchdogInterval(); interval > 0 {
+		go sdWatchdog(device, logger, interval, watchdogStop)
+	}
+
+	// wait for program to terminate, reloading the configuration on SIGHUP
+	// and logging diagnostics on SIGUSR1
+
+	hup := make(chan os.Signal, 1)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	signal.Notify(term, os.Interrupt)
+	signal.Notify(hup, syscall.SIGHUP)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+wait:
+	for {
+		select {
+		case <-hup:
+			if configPath == "" {
+				continue
+			}
+			sdNotify("RELOADING=1")
+			reloaded, err := config.Load(configPath)
+			if err == nil {
+				if iface != nil && reloaded.Device.FirewallMark == nil {
+					reloaded.Device.FirewallMark = cfg.Device.FirewallMark
+				}
+
+				// apply only what changed, so that the sessions of
+				// unchanged peers survive
+
+				current, getErr := device.IpcGetConfig()
+				if err = getErr; err == nil {
+					err = device.IpcSetConfig(config.Diff(current, &reloaded.Device))
+				}
+			}
+			sdNotify("READY=1")
+			if err != nil {
+				logger.Error.Println("Failed to reload configuration:", err)
+				continue
+			}
+			logger.Info.Println("Configuration", configPath, "reloaded")
+		case <-usr1:
+			logger.Info.Print("Diagnostics:\n", device.Diagnostics())
+		case <-term:
+			break wait
+		case <-errs:
+			break wait
+		case <-device.Wait():
+			if err := device.Err(); err != nil {
+				logger.Error.Println("Device failed:", err)
+			}
+			break wait
+		}
+	}
+
+	// clean up
+
+	sdNotify("STOPPING=1")
+	close(watchdogStop)
+
+	if iface != nil {
+		if err := iface.Down(); err != nil {
+			logger.Error.Println("Failed to remove interface configuration:", err)
+		}
+	}
+	uapi.Close()
+	if monitor != nil {
+		monitor.Close()
+	}
+	if health != nil {
+		health.Close()
+	}
+	if debug != nil {
+		debug.Close()
+	}
+	device.Close()
+
+	logger.Info.Println("Shutting down")
+}
+
+// setUp configures the addresses, routes and DNS of the interface if cfg
+// has any, like wg-quick(8), and then the device itself.
+func setUp(interfaceName string, cfg *config.Config, dev *device.Device, logger *device.Logger) (*netops.Interface, error) {
+	if len(cfg.PreUp)+len(cfg.PostUp)+len(cfg.PreDown)+len(cfg.PostDown) > 0 {
+		logger.Info.Println("Ignoring PreUp, PostUp, PreDown and PostDown commands")
+	}
+
+	var iface *netops.Interface
+	if len(cfg.Address) > 0 || len(cfg.DNS) > 0 || len(cfg.DNSSearch) > 0 {
+		var dns netops.DNSHook = &netops.ResolvConf{}
+		if resolved, ok := resolvedHook(); ok {
+			dns = resolved
+		}
+		var err error
+		iface, err = netops.UpWithOptions(interfaceName, cfg, netops.Options{DNS: dns})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dev.IpcSetConfig(&cfg.Device); err != nil {
+		if iface != nil {
+			iface.Down()
+		}
+		return nil, err
+	}
+	return iface, nil
+}
+
+// lookupGroup returns the ID of the group called or numbered name.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
@@ -73,6 +73,24 @@ func main() {
 	}()
 	logger.Info.Println("UAPI listener started")
 
+	monitor, err := ipc.UAPIListenMonitor(interfaceName)
+	if err != nil {
+		logger.Error.Println("Failed to listen on monitor pipe:", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	go func() {
+		for {
+			conn, err := monitor.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go device.IpcHandleMonitor(conn)
+		}
+	}()
+	logger.Info.Println("Monitor listener started")
+
 	// wait for program to terminate
 
 	signal.Notify(term, os.Interrupt)
@@ -83,11 +101,15 @@ func main() {
 	case <-term:
 	case <-errs:
 	case <-device.Wait():
+		if err := device.Err(); err != nil {
+			logger.Error.Println("Device failed:", err)
+		}
 	}
 
 	// clean up
 
 	uapi.Close()
+	monitor.Close()
 	device.Close()
 
 	logger.Info.Println("Shutting down")
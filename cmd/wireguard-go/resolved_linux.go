@@ -0,0 +1,20 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"os"
+
+	"golang.zx2c4.com/wireguard/netops"
+)
+
+// resolvedHook returns the systemd-resolved DNS hook if it is running.
+func resolvedHook() (netops.DNSHook, bool) {
+	if _, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve"); err != nil {
+		return nil, false
+	}
+	return netops.Resolved{}, true
+}
@@ -0,0 +1,16 @@
+// +build !linux,!windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"golang.zx2c4.com/wireguard/netops"
+)
+
+func resolvedHook() (netops.DNSHook, bool) {
+	return nil, false
+}
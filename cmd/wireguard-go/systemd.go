@@ -0,0 +1,94 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* Integration with the systemd service manager, see sd_notify(3)
+ *
+ * Readiness, reloads and shutdown are reported to the socket in
+ * NOTIFY_SOCKET, for Type=notify services. With WatchdogSec= set,
+ * the watchdog is fed at half its interval for as long as the health
+ * check of the device passes, so that systemd restarts a device which
+ * stopped working without exiting.
+ */
+
+// underSystemd reports whether the process was started by systemd as a
+// notify service.
+func underSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// sdNotify sends state to systemd, doing nothing if not started by it.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval the watchdog must be fed in,
+// zero if it is disabled.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdWatchdog feeds the watchdog every half interval while dev is healthy,
+// until stop is closed.
+func sdWatchdog(dev *device.Device, logger *device.Logger, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		err := dev.Check()
+		if err != nil {
+			if healthy {
+				logger.Error.Println("Health check failed, no longer feeding the watchdog:", err)
+			}
+			healthy = false
+			continue
+		}
+		if !healthy {
+			logger.Info.Println("Health check passed again")
+		}
+		healthy = true
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Error.Println("Failed to feed the watchdog:", err)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package config reads and writes configuration files in the INI style
+// format of wg-quick(8), such as /etc/wireguard/wg0.conf.
+//
+// The keys understood by the device end up in a device.DeviceConfig,
+// the ones wg-quick acts on itself (Address, DNS, MTU, Table and the
+// hooks) are surfaced for the caller to apply. Seal and SaveSealed
+// encrypt configurations at rest, keeping private keys out of plaintext
+// files.
+package config
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+type Config struct {
+	// Device is applied with device.IpcSetConfig, replacing all peers.
+	Device device.DeviceConfig
+
+	Address    []net.IPNet // addresses of the interface
+	DNS        []net.IP    // DNS servers
+	DNSSearch  []string    // DNS search domains, listed among the servers in the file
+	MTU        int         // zero for the default
+	Table      string      // routing table for the allowed IPs, "off", "auto" or empty
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+}
+
+// Load reads the configuration file at path.
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Parse reads a configuration in wg-quick format from r. Section and key
+// names are case insensitive, "#" starts a comment. Errors carry the line
+// number and wrap the error values of package device.
+func Parse(r io.Reader) (*Config, error) {
+	config := &Config{}
+	config.Device.ReplacePeers = true
+
+	var peer *device.PeerConfig
+	var section string
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				config.Device.Peers = append(config.Device.Peers, device.PeerConfig{ReplaceAllowedIPs: true, ReplaceAllowedSources: true})
+				peer = &config.Device.Peers[len(config.Device.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: section %q: %w", lineNumber, section, device.ErrUnknownConfigKey)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, device.ErrMalformedLine)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		var err error
+		switch section {
+		case "interface":
+			err = config.parseInterfaceKey(key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("outside of a section: %w", device.ErrMalformedLine)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNumber, parts[0], err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, peer := range config.Device.Peers {
+		if peer.PublicKey.IsZero() {
+			return nil, fmt.Errorf("peer %d: PublicKey: %w", i+1, device.ErrInvalidKey)
+		}
+	}
+	return config, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseKey(value string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", device.ErrInvalidKey, err)
+	}
+	if len(key) != device.NoisePublicKeySize {
+		return "", fmt.Errorf("%w: %d bytes", device.ErrInvalidKey, len(key))
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// parsePrefix accepts an address with or without a prefix length,
+// the latter standing for a single address.
+func parsePrefix(value string) (net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return net.IPNet{}, fmt.Errorf("%w: %q", device.ErrInvalidAllowedIP, value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("%w: %v", device.ErrInvalidAllowedIP, err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.IPNet{IP: ip, Mask: network.Mask}, nil
+}
+
+func (config *Config) parseInterfaceKey(key, value string) error {
+	switch key {
+	case "privatekey":
+		hexKey, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		var sk device.NoisePrivateKey
+		if err := sk.FromHex(hexKey); err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidKey, err)
+		}
+		config.Device.PrivateKey = &sk
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+		}
+		listenPort := uint16(port)
+		config.Device.ListenPort = &listenPort
+	case "fwmark":
+		mark := uint64(0)
+		if value != "off" {
+			var err error
+			if mark, err = strconv.ParseUint(value, 0, 32); err != nil {
+				return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+			}
+		}
+		fwmark := uint32(mark)
+		config.Device.FirewallMark = &fwmark
+	case "relay":
+		relay, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+		}
+		config.Device.Relay = &relay
+	case "address":
+		for _, item := range splitList(value) {
+			address, err := parsePrefix(item)
+			if err != nil {
+				return err
+			}
+			config.Address = append(config.Address, address)
+		}
+	case "dns":
+		for _, item := range splitList(value) {
+			if ip := net.ParseIP(item); ip != nil {
+				config.DNS = append(config.DNS, ip)
+			} else {
+				config.DNSSearch = append(config.DNSSearch, item)
+			}
+		}
+	case "mtu":
+		mtu, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+		}
+		config.MTU = int(mtu)
+	case "table":
+		config.Table = value
+	case "preup":
+		config.PreUp = append(config.PreUp, value)
+	case "postup":
+		config.PostUp = append(config.PostUp, value)
+	case "predown":
+		config.PreDown = append(config.PreDown, value)
+	case "postdown":
+		config.PostDown = append(config.PostDown, value)
+	case "saveconfig":
+		save, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+		}
+		config.SaveConfig = save
+	default:
+		return device.ErrUnknownConfigKey
+	}
+	return nil
+}
+
+func parsePeerKey(peer *device.PeerConfig, key, value string) error {
+	switch key {
+	case "publickey":
+		hexKey, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		if err := peer.PublicKey.FromHex(hexKey); err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidKey, err)
+		}
+	case "presharedkey":
+		hexKey, err := parseKey(value)
+		if err != nil {
+			return err
+		}
+		var psk device.NoiseSymmetricKey
+		if err := psk.FromHex(hexKey); err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidKey, err)
+		}
+		peer.PresharedKey = &psk
+	case "allowedips":
+		for _, item := range splitList(value) {
+			prefix, err := parsePrefix(item)
+			if err != nil {
+				return err
+			}
+			prefix.IP = prefix.IP.Mask(prefix.Mask)
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+		}
+	case "allowedsources":
+		for _, item := range splitList(value) {
+			prefix, err := parsePrefix(item)
+			if err != nil {
+				return err
+			}
+			prefix.IP = prefix.IP.Mask(prefix.Mask)
+			peer.AllowedSources = append(peer.AllowedSources, prefix)
+		}
+	case "endpoint":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidEndpoint, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidEndpoint, err)
+		}
+		if net.ParseIP(host) == nil && !strings.Contains(host, "%") {
+			// a host name, resolved and raced by the device
+			peer.EndpointHost = value
+			return nil
+		}
+		endpoint, err := net.ResolveUDPAddr("udp", value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", device.ErrInvalidEndpoint, err)
+		}
+		peer.Endpoint = endpoint
+	case "persistentkeepalive":
+		secs := uint64(0)
+		if value != "off" {
+			var err error
+			if secs, err = strconv.ParseUint(value, 10, 16); err != nil {
+				return fmt.Errorf("%w: %v", device.ErrInvalidValue, err)
+			}
+		}
+		interval := uint16(secs)
+		peer.PersistentKeepaliveInterval = &interval
+	default:
+		return device.ErrUnknownConfigKey
+	}
+	return nil
+}
+
+func encodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func joinPrefixes(prefixes []net.IPNet) string {
+	items := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		items[i] = prefix.String()
+	}
+	return strings.Join(items, ", ")
+}
+
+// WriteTo writes config to w in wg-quick format.
+func (config *Config) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	set := func(key, value string) {
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+
+	b.WriteString("[Interface]\n")
+	if len(config.Address) > 0 {
+		set("Address", joinPrefixes(config.Address))
+	}
+	if config.Device.PrivateKey != nil {
+		set("PrivateKey", encodeKey(config.Device.PrivateKey[:]))
+	}
+	if config.Device.ListenPort != nil {
+		set("ListenPort", strconv.FormatUint(uint64(*config.Device.ListenPort), 10))
+	}
+	if config.Device.FirewallMark != nil {
+		set("FwMark", fmt.Sprintf("0x%x", *config.Device.FirewallMark))
+	}
+	if config.Device.Relay != nil {
+		set("Relay", strconv.FormatBool(*config.Device.Relay))
+	}
+	if len(config.DNS) > 0 || len(config.DNSSearch) > 0 {
+		var items []string
+		for _, ip := range config.DNS {
+			items = append(items, ip.String())
+		}
+		items = append(items, config.DNSSearch...)
+		set("DNS", strings.Join(items, ", "))
+	}
+	if config.MTU != 0 {
+		set("MTU", strconv.Itoa(config.MTU))
+	}
+	if config.Table != "" {
+		set("Table", config.Table)
+	}
+	for _, hook := range []struct {
+		key      string
+		commands []string
+	}{
+		{"PreUp", config.PreUp},
+		{"PostUp", config.PostUp},
+		{"PreDown", config.PreDown},
+		{"PostDown", config.PostDown},
+	} {
+		for _, command := range hook.commands {
+			set(hook.key, command)
+		}
+	}
+	if config.SaveConfig {
+		set("SaveConfig", "true")
+	}
+
+	for i := range config.Device.Peers {
+		b.WriteString("\n")
+		writePeer(&b, &config.Device.Peers[i])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// String returns config in wg-quick format.
+func (config *Config) String() string {
+	var b strings.Builder
+	config.WriteTo(&b)
+	return b.String()
+}
+
+// writePeer writes the [Peer] stanza of peer to b.
+func writePeer(b *strings.Builder, peer *device.PeerConfig) {
+	set := func(key, value string) {
+		fmt.Fprintf(b, "%s = %s\n", key, value)
+	}
+
+	b.WriteString("[Peer]\n")
+	set("PublicKey", encodeKey(peer.PublicKey[:]))
+	if peer.PresharedKey != nil && *peer.PresharedKey != (device.NoiseSymmetricKey{}) {
+		set("PresharedKey", encodeKey(peer.PresharedKey[:]))
+	}
+	if len(peer.AllowedIPs) > 0 {
+		set("AllowedIPs", joinPrefixes(peer.AllowedIPs))
+	}
+	if len(peer.AllowedSources) > 0 {
+		set("AllowedSources", joinPrefixes(peer.AllowedSources))
+	}
+	if peer.EndpointHost != "" {
+		set("Endpoint", peer.EndpointHost)
+	} else if peer.Endpoint != nil {
+		set("Endpoint", peer.Endpoint.String())
+	}
+	if peer.PersistentKeepaliveInterval != nil && *peer.PersistentKeepaliveInterval != 0 {
+		set("PersistentKeepalive", strconv.FormatUint(uint64(*peer.PersistentKeepaliveInterval), 10))
+	}
+}
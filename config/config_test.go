@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+const wg0 = `[Interface]
+# a comment
+Address = 10.192.122.1/24, fd00::1
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+FwMark = 0x1234
+Relay = true
+DNS = 10.192.122.53, example.com
+MTU = 1420
+PostUp = echo up
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.192.122.3/32, 10.192.124.0/24
+Endpoint = 192.95.5.67:1234
+AllowedSources = 192.95.5.0/24
+PersistentKeepalive = 25
+
+[peer]
+publickey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+allowedips = 0.0.0.0/0 # everything else
+endpoint = localhost:51820
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse(strings.NewReader(wg0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := joinPrefixes(config.Address); got != "10.192.122.1/24, fd00::1/128" {
+		t.Errorf("Address = %s", got)
+	}
+	if len(config.DNS) != 1 || config.DNS[0].String() != "10.192.122.53" || len(config.DNSSearch) != 1 || config.DNSSearch[0] != "example.com" {
+		t.Errorf("DNS = %v, search %v", config.DNS, config.DNSSearch)
+	}
+	if config.MTU != 1420 || len(config.PostUp) != 1 {
+		t.Errorf("MTU = %d, PostUp = %v", config.MTU, config.PostUp)
+	}
+	dev := config.Device
+	if dev.PrivateKey == nil || *dev.ListenPort != 51820 || *dev.FirewallMark != 0x1234 || dev.Relay == nil || !*dev.Relay || !dev.ReplacePeers {
+		t.Errorf("unexpected device config %+v", dev)
+	}
+	if len(dev.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(dev.Peers))
+	}
+	peer := dev.Peers[0]
+	if peer.Endpoint.String() != "192.95.5.67:1234" || *peer.PersistentKeepaliveInterval != 25 || joinPrefixes(peer.AllowedIPs) != "10.192.122.3/32, 10.192.124.0/24" {
+		t.Errorf("unexpected peer config %+v", peer)
+	}
+	if encodeKey(dev.Peers[1].PublicKey[:]) != "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=" {
+		t.Error("public key of second peer not parsed")
+	}
+	if joinPrefixes(peer.AllowedSources) != "192.95.5.0/24" {
+		t.Errorf("AllowedSources = %v", peer.AllowedSources)
+	}
+	if dev.Peers[1].Endpoint != nil || dev.Peers[1].EndpointHost != "localhost:51820" {
+		t.Errorf("host name endpoint parsed as %v, host %q", dev.Peers[1].Endpoint, dev.Peers[1].EndpointHost)
+	}
+
+	// writing and parsing again keeps everything
+
+	again, err := Parse(strings.NewReader(config.String()))
+	if err != nil {
+		t.Fatalf("parsing written config: %v\n%s", err, config)
+	}
+	if again.String() != config.String() {
+		t.Errorf("config did not round trip:\n%s\n%s", config, again)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		target error
+	}{
+		{"[Interface]\nPrivateKey = nope\n", device.ErrInvalidKey},
+		{"[Interface]\nListenPort = 99999\n", device.ErrInvalidValue},
+		{"[Interface]\nBogus = 1\n", device.ErrUnknownConfigKey},
+		{"[Elsewhere]\n", device.ErrUnknownConfigKey},
+		{"[Peer]\nAllowedIPs = 10.0.0.0/99\n", device.ErrInvalidAllowedIP},
+		{"[Peer]\nAllowedIPs = 10.0.0.0/8\n", device.ErrInvalidKey},
+		{"PrivateKey\n", device.ErrMalformedLine},
+	}
+	for _, test := range tests {
+		if _, err := Parse(strings.NewReader(test.config)); !errors.Is(err, test.target) {
+			t.Errorf("%q: expected %v, got %v", test.config, test.target, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	config, err := Parse(strings.NewReader(wg0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*config.Device.ListenPort = 0
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSetConfig(&config.Device); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := dev.IpcGetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied.Peers) != 2 {
+		t.Errorf("expected 2 peers, got %d", len(applied.Peers))
+	}
+}
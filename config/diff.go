@@ -0,0 +1,15 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import "golang.zx2c4.com/wireguard/device"
+
+// Diff returns the configuration which, applied with IpcSetConfig to a
+// device configured as old, configures it as new, touching only what
+// differs, see device.DiffConfig.
+func Diff(old, new *device.DeviceConfig) *device.DeviceConfig {
+	return device.DiffConfig(old, new)
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestDiff(t *testing.T) {
+	config, err := Parse(strings.NewReader(wg0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*config.Device.ListenPort = 0
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSetConfig(&config.Device); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := dev.IpcGetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := Diff(current, &config.Device).UAPI(); diff != "" {
+		t.Errorf("diff of the applied configuration:\n%s", diff)
+	}
+
+	// keep the first peer with another keepalive, replace the second
+
+	changed, err := Parse(strings.NewReader(strings.Replace(strings.Replace(wg0,
+		"PersistentKeepalive = 25", "PersistentKeepalive = 30", 1),
+		"TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=", "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA=", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*changed.Device.ListenPort = 0
+	diff := Diff(current, &changed.Device)
+	first, second, third := changed.Device.Peers[0].PublicKey, current.Peers[0].PublicKey, changed.Device.Peers[1].PublicKey
+	if second == first {
+		second = current.Peers[1].PublicKey
+	}
+	want := "public_key=" + first.ToHex() + "\nupdate_only=true\npersistent_keepalive_interval=30\n" +
+		"public_key=" + third.ToHex() + "\nendpoint_host=localhost:51820\nallowed_ip=0.0.0.0/0\n" +
+		"public_key=" + second.ToHex() + "\nremove=true\n"
+	if got := diff.UAPI(); got != want {
+		t.Errorf("diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := dev.IpcSetConfig(diff); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := dev.IpcGetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := Diff(applied, &changed.Device).UAPI(); diff != "" {
+		t.Errorf("diff after applying the diff:\n%s", diff)
+	}
+}
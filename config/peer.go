@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// FormatPeer returns the [Peer] stanza of peer, as written by
+// wg showconf, for passing a peer to other tools.
+func FormatPeer(peer *device.PeerConfig) string {
+	var b strings.Builder
+	writePeer(&b, peer)
+	return b.String()
+}
+
+// ParsePeer reads a single [Peer] stanza from r, as written by FormatPeer
+// or cut from a configuration file. The section header may be left out.
+// The peer replaces the allowed IPs and sources of an existing peer of
+// the same public key when applied.
+func ParsePeer(r io.Reader) (*device.PeerConfig, error) {
+	peer := &device.PeerConfig{ReplaceAllowedIPs: true, ReplaceAllowedSources: true}
+	var sections int
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section := strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section != "peer" {
+				return nil, fmt.Errorf("line %d: section %q: %w", lineNumber, section, device.ErrUnknownConfigKey)
+			}
+			if sections++; sections > 1 {
+				return nil, fmt.Errorf("line %d: more than one peer: %w", lineNumber, device.ErrMalformedLine)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, device.ErrMalformedLine)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if err := parsePeerKey(peer, key, strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNumber, parts[0], err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if peer.PublicKey.IsZero() {
+		return nil, fmt.Errorf("PublicKey: %w", device.ErrInvalidKey)
+	}
+	return peer, nil
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const peerStanza = `[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+AllowedIPs = 10.192.122.3/32, 10.192.124.0/24
+Endpoint = 192.95.5.67:1234
+PersistentKeepalive = 25
+`
+
+func TestPeerRoundTrip(t *testing.T) {
+	peer, err := ParsePeer(strings.NewReader(peerStanza))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.ReplaceAllowedIPs || len(peer.AllowedIPs) != 2 || peer.Endpoint == nil {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+	if formatted := FormatPeer(peer); formatted != peerStanza {
+		t.Errorf("FormatPeer =\n%s\nwant\n%s", formatted, peerStanza)
+	}
+
+	// the header is optional, a zero preshared key is left out like by wg showconf
+
+	headless := strings.TrimPrefix(peerStanza, "[Peer]\n")
+	peer, err = ParsePeer(strings.NewReader(headless))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.PresharedKey = new(device.NoiseSymmetricKey)
+	if formatted := FormatPeer(peer); strings.Contains(formatted, "PresharedKey") {
+		t.Errorf("zero preshared key written:\n%s", formatted)
+	}
+}
+
+func TestParsePeerErrors(t *testing.T) {
+	tests := []struct {
+		stanza string
+		target error
+	}{
+		{"[Interface]\nListenPort = 51820\n", device.ErrUnknownConfigKey},
+		{peerStanza + peerStanza, device.ErrMalformedLine},
+		{"AllowedIPs = 10.0.0.0/8\n", device.ErrInvalidKey},
+		{"PublicKey = nope\n", device.ErrInvalidKey},
+		{"ListenPort = 51820\n", device.ErrUnknownConfigKey},
+	}
+	for _, test := range tests {
+		if _, err := ParsePeer(strings.NewReader(test.stanza)); !errors.Is(err, test.target) {
+			t.Errorf("%q: expected %v, got %v", test.stanza, test.target, err)
+		}
+	}
+}
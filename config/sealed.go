@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Configurations encrypted at rest
+ *
+ * Seal encrypts a configuration in wg-quick format with XChaCha20-
+ * Poly1305, so that embedders need not store private keys in plaintext
+ * files. The key is derived from a passphrase with Argon2id, or taken
+ * from a keystore of the platform, such as the keychain of macOS or the
+ * credential manager of Windows, through Keystore. A sealed
+ * configuration is laid out as follows, the header authenticated along
+ * with the ciphertext:
+ *
+ *   magic "wgsealed" (8 bytes)
+ *   version 1 (1 byte)
+ *   key source, 1 for a passphrase, 2 for a keystore (1 byte)
+ *   Argon2id time, memory in KiB (4 bytes each, big endian)
+ *   Argon2id threads (1 byte)
+ *   salt (16 bytes)
+ *   nonce (24 bytes)
+ *   ciphertext
+ *
+ * The Argon2id parameters are zero for keys from a keystore.
+ */
+
+const (
+	sealedMagic      = "wgsealed"
+	sealedVersion    = 1
+	sealedSaltSize   = 16
+	sealedHeaderSize = len(sealedMagic) + 2 + 9 + sealedSaltSize + chacha20poly1305.NonceSizeX
+
+	sourcePassphrase = 1
+	sourceKeystore   = 2
+
+	// Argon2id parameters of new sealed configurations, as recommended
+	// by RFC 9106 for memory constrained environments.
+	SealTime    = 3
+	SealMemory  = 64 * 1024 // KiB
+	SealThreads = 4
+)
+
+var (
+	ErrNotSealed    = errors.New("not a sealed configuration")
+	ErrUnsealFailed = errors.New("wrong key or corrupt sealed configuration")
+)
+
+// A Keystore keeps keys in a keystore of the platform.
+type Keystore interface {
+	// Key returns the 32 byte key named name, creating and storing a
+	// random one if there is none yet.
+	Key(name string) ([]byte, error)
+}
+
+// A KeySource yields the key a configuration is sealed with, see
+// Passphrase and KeystoreKey.
+type KeySource interface {
+	source() byte
+	key(header []byte) ([]byte, error)
+}
+
+type passphrase []byte
+
+// Passphrase derives the key from passphrase with Argon2id.
+func Passphrase(s string) KeySource {
+	return passphrase(s)
+}
+
+func (passphrase) source() byte {
+	return sourcePassphrase
+}
+
+func (p passphrase) key(header []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	params := header[len(sealedMagic)+2:]
+	time := binary.BigEndian.Uint32(params[0:4])
+	memory := binary.BigEndian.Uint32(params[4:8])
+	threads := params[8]
+	salt := params[9 : 9+sealedSaltSize]
+	if time == 0 || memory == 0 || threads == 0 {
+		return nil, ErrUnsealFailed
+	}
+	return argon2.IDKey(p, salt, time, memory, threads, chacha20poly1305.KeySize), nil
+}
+
+type keystoreKey struct {
+	store Keystore
+	name  string
+}
+
+// KeystoreKey takes the key named name from store.
+func KeystoreKey(store Keystore, name string) KeySource {
+	return keystoreKey{store, name}
+}
+
+func (keystoreKey) source() byte {
+	return sourceKeystore
+}
+
+func (k keystoreKey) key(header []byte) ([]byte, error) {
+	key, err := k.store.Key(k.name)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("keystore: key of %d bytes", len(key))
+	}
+	return append([]byte(nil), key...), nil
+}
+
+// Seal returns config encrypted with the key of source.
+func (config *Config) Seal(source KeySource) ([]byte, error) {
+	header := make([]byte, sealedHeaderSize)
+	copy(header, sealedMagic)
+	header[len(sealedMagic)] = sealedVersion
+	header[len(sealedMagic)+1] = source.source()
+	params := header[len(sealedMagic)+2:]
+	if source.source() == sourcePassphrase {
+		binary.BigEndian.PutUint32(params[0:4], SealTime)
+		binary.BigEndian.PutUint32(params[4:8], SealMemory)
+		params[8] = SealThreads
+	}
+	if _, err := rand.Read(params[9:]); err != nil {
+		return nil, err
+	}
+
+	key, err := source.key(header)
+	if err != nil {
+		return nil, err
+	}
+	defer setZero(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := []byte(config.String())
+	defer setZero(plaintext)
+	nonce := header[sealedHeaderSize-chacha20poly1305.NonceSizeX:]
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// Unseal decrypts the configuration sealed with the key of source.
+func Unseal(sealed []byte, source KeySource) (*Config, error) {
+	if len(sealed) < sealedHeaderSize || !bytes.HasPrefix(sealed, []byte(sealedMagic)) {
+		return nil, ErrNotSealed
+	}
+	header := sealed[:sealedHeaderSize]
+	if version := header[len(sealedMagic)]; version != sealedVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrNotSealed, version)
+	}
+	if header[len(sealedMagic)+1] != source.source() {
+		return nil, fmt.Errorf("%w: sealed with another key source", ErrUnsealFailed)
+	}
+
+	key, err := source.key(header)
+	if err != nil {
+		return nil, err
+	}
+	defer setZero(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := header[sealedHeaderSize-chacha20poly1305.NonceSizeX:]
+	plaintext, err := aead.Open(nil, nonce, sealed[sealedHeaderSize:], header)
+	if err != nil {
+		return nil, ErrUnsealFailed
+	}
+	defer setZero(plaintext)
+	return Parse(bytes.NewReader(plaintext))
+}
+
+// LoadSealed reads the sealed configuration file at path.
+func LoadSealed(path string, source KeySource) (*Config, error) {
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Unseal(sealed, source)
+}
+
+// SaveSealed writes config sealed with the key of source to the file at
+// path, readable by its owner only, replacing the file atomically.
+func SaveSealed(path string, config *Config, source KeySource) error {
+	sealed, err := config.Seal(source)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	// TempFile creates the file readable by its owner only
+	if _, err := file.Write(sealed); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func setZero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
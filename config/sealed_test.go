@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type mapKeystore map[string][]byte
+
+func (store mapKeystore) Key(name string) ([]byte, error) {
+	if key, ok := store[name]; ok {
+		return key, nil
+	}
+	key := make([]byte, 32)
+	key[0] = byte(len(store) + 1)
+	store[name] = key
+	return key, nil
+}
+
+func TestSeal(t *testing.T) {
+	config, err := Parse(strings.NewReader(wg0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := config.Seal(Passphrase("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=") {
+		t.Error("private key in sealed configuration")
+	}
+	unsealed, err := Unseal(sealed, Passphrase("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unsealed.String() != config.String() {
+		t.Errorf("unsealed configuration\n%s\ndiffers from\n%s", unsealed, config)
+	}
+
+	if _, err := Unseal(sealed, Passphrase("battery staple")); !errors.Is(err, ErrUnsealFailed) {
+		t.Errorf("unsealing with a wrong passphrase: %v", err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Unseal(tampered, Passphrase("correct horse")); !errors.Is(err, ErrUnsealFailed) {
+		t.Errorf("unsealing a tampered configuration: %v", err)
+	}
+	if _, err := Unseal([]byte(wg0), Passphrase("correct horse")); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("unsealing a plaintext configuration: %v", err)
+	}
+
+	store := mapKeystore{}
+	sealed, err = config.Seal(KeystoreKey(store, "wg0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unseal(sealed, Passphrase("correct horse")); !errors.Is(err, ErrUnsealFailed) {
+		t.Errorf("unsealing with another key source: %v", err)
+	}
+	if _, err := Unseal(sealed, KeystoreKey(store, "wg1")); !errors.Is(err, ErrUnsealFailed) {
+		t.Errorf("unsealing with another key: %v", err)
+	}
+	if unsealed, err := Unseal(sealed, KeystoreKey(store, "wg0")); err != nil || unsealed.String() != config.String() {
+		t.Errorf("unsealing with the keystore: %v", err)
+	}
+}
+
+func TestSaveSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := Parse(strings.NewReader(wg0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wg0.conf.sealed")
+	source := KeystoreKey(mapKeystore{}, "wg0")
+	if err := SaveSealed(path, config, source); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("sealed configuration has mode %v", info.Mode())
+	}
+	loaded, err := LoadSealed(path, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.String() != config.String() {
+		t.Errorf("loaded configuration\n%s\ndiffers from\n%s", loaded, config)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in the directory", len(entries))
+	}
+}
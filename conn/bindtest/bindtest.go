@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package bindtest implements an in-memory conn.Bind for connecting
+// devices within a single process, for use in tests and benchmarks.
+package bindtest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+var errClosed = errors.New("bindtest: use of closed bind")
+
+// A ChannelBind is one end of a pair of binds created by NewChannelBinds.
+// Packets sent on one end are received by the other one, regardless
+// of the endpoint they are addressed to. Unlike UDP, sending blocks
+// while the receiving end is behind.
+type ChannelBind struct {
+	rx4  chan []byte
+	rx6  chan []byte
+	peer *ChannelBind
+
+	mu          sync.Mutex
+	closeSignal chan struct{}
+	port        uint16
+}
+
+// A ChannelEndpoint identifies a ChannelBind by its port.
+type ChannelEndpoint uint16
+
+var _ conn.Bind = (*ChannelBind)(nil)
+var _ conn.Endpoint = ChannelEndpoint(0)
+
+// NewChannelBinds returns a pair of connected binds, both closed.
+func NewChannelBinds() [2]*ChannelBind {
+	var binds [2]*ChannelBind
+	for i := range binds {
+		binds[i] = &ChannelBind{
+			rx4:         make(chan []byte, 8192),
+			rx6:         make(chan []byte, 8192),
+			closeSignal: make(chan struct{}),
+		}
+		close(binds[i].closeSignal)
+	}
+	binds[0].peer = binds[1]
+	binds[1].peer = binds[0]
+	return binds
+}
+
+func (c ChannelEndpoint) ClearSrc() {}
+
+func (c ChannelEndpoint) SrcToString() string { return "" }
+
+func (c ChannelEndpoint) DstToString() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(c)))
+}
+
+func (c ChannelEndpoint) DstToBytes() []byte { return []byte{byte(c), byte(c >> 8)} }
+
+func (c ChannelEndpoint) DstIP() net.IP { return net.IPv4(127, 0, 0, 1) }
+
+func (c ChannelEndpoint) SrcIP() net.IP { return nil }
+
+// Open (re)opens the bind and has the signature expected by
+// device.DeviceOptions.CreateBind. A zero port picks a random one.
+func (c *ChannelBind) Open(port uint16) (conn.Bind, uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closeSignal:
+	default:
+		return nil, 0, os.ErrExist
+	}
+	if port == 0 {
+		port = uint16(rand.Uint32()>>16) | 1
+	}
+	c.port = port
+	c.closeSignal = make(chan struct{})
+	return c, port, nil
+}
+
+func (c *ChannelBind) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closeSignal:
+	default:
+		close(c.closeSignal)
+	}
+	return nil
+}
+
+func (c *ChannelBind) LastMark() uint32 { return 0 }
+
+func (c *ChannelBind) SetMark(mark uint32) error { return nil }
+
+func (c *ChannelBind) closed() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeSignal
+}
+
+func (c *ChannelBind) receive(rx chan []byte, b []byte) (int, conn.Endpoint, error) {
+	select {
+	case <-c.closed():
+		return 0, nil, errClosed
+	case packet := <-rx:
+		c.peer.mu.Lock()
+		source := ChannelEndpoint(c.peer.port)
+		c.peer.mu.Unlock()
+		return copy(b, packet), source, nil
+	}
+}
+
+func (c *ChannelBind) ReceiveIPv4(b []byte) (int, conn.Endpoint, error) {
+	return c.receive(c.rx4, b)
+}
+
+func (c *ChannelBind) ReceiveIPv6(b []byte) (int, conn.Endpoint, error) {
+	return c.receive(c.rx6, b)
+}
+
+// Send delivers b to the other end of the pair, over the IPv6
+// channel if ep has an IPv6 address and over the IPv4 one otherwise.
+func (c *ChannelBind) Send(b []byte, ep conn.Endpoint) error {
+	select {
+	case <-c.closed():
+		return errClosed
+	default:
+	}
+	tx := c.peer.rx4
+	if ip := ep.DstIP(); ip != nil && ip.To4() == nil {
+		tx = c.peer.rx6
+	}
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	select {
+	case tx <- packet:
+	case <-c.closed():
+		return errClosed
+	case <-c.peer.closed():
+		// nobody is listening on the other end
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Bad networks, in-process
+ *
+ * A ShapedBind wraps a bind, real or in-memory, imposing the conditions
+ * of a bad network on the packets it sends and receives: latency with
+ * jitter, a capped rate with a bounded backlog, and random loss. Like
+ * netem, conditions apply to each direction separately and may change
+ * while packets flow. Packets are delivered in order, a packet jittered
+ * ahead waiting for those before it.
+ */
+
+// Conditions of a direction of a network.
+type Conditions struct {
+	Latency time.Duration // added to every packet
+	Jitter  time.Duration // up to which a random delay is added on top of Latency
+	Rate    int           // bytes per second carried, zero for no limit
+	Backlog time.Duration // of queueing at Rate beyond which packets are dropped, zero for DefaultBacklog
+	Loss    float64       // fraction of packets dropped at random, from 0 to 1
+}
+
+const (
+	DefaultBacklog  = time.Second
+	shapedQueueLen  = 4096 // packets waiting for delivery in each direction
+	shapedPacketLen = 65535
+)
+
+func (conditions Conditions) zero() bool {
+	return conditions == Conditions{}
+}
+
+// A shaper decides the fate of the packets of a direction.
+type shaper struct {
+	sync.Mutex
+	conditions Conditions
+	random     *rand.Rand
+	busyUntil  time.Time // when the packets admitted so far are transmitted at Rate
+	lastDue    time.Time // delivery of the last packet admitted, which later ones wait for
+	dropped    uint64    // accessed atomically
+}
+
+// admit returns when a packet of size arriving at now is delivered, or
+// false if it is dropped.
+func (s *shaper) admit(size int, now time.Time) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	conditions := s.conditions
+	if conditions.Loss > 0 && s.random.Float64() < conditions.Loss {
+		atomic.AddUint64(&s.dropped, 1)
+		return time.Time{}, false
+	}
+	due := now
+	if conditions.Rate > 0 {
+		backlog := conditions.Backlog
+		if backlog <= 0 {
+			backlog = DefaultBacklog
+		}
+		if s.busyUntil.Before(now) {
+			s.busyUntil = now
+		}
+		if s.busyUntil.Sub(now) > backlog {
+			atomic.AddUint64(&s.dropped, 1)
+			return time.Time{}, false
+		}
+		s.busyUntil = s.busyUntil.Add(time.Duration(int64(size) * int64(time.Second) / int64(conditions.Rate)))
+		due = s.busyUntil
+	}
+	due = due.Add(conditions.Latency)
+	if conditions.Jitter > 0 {
+		due = due.Add(time.Duration(s.random.Int63n(int64(conditions.Jitter) + 1)))
+	}
+	if due.Before(s.lastDue) {
+		due = s.lastDue
+	}
+	s.lastDue = due
+	return due, true
+}
+
+type shapedPacket struct {
+	data []byte
+	ep   conn.Endpoint
+	due  time.Time
+	err  error // ends the receive queue
+}
+
+// A ShapedBind imposes Conditions on the packets of a bind.
+type ShapedBind struct {
+	bind    conn.Bind
+	send    shaper
+	receive shaper
+
+	sendQueue chan shapedPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+	start4    sync.Once
+	start6    sync.Once
+	receive4  chan shapedPacket
+	receive6  chan shapedPacket
+}
+
+var _ conn.Bind = (*ShapedBind)(nil)
+
+// WrapBind returns bind with send and receive imposed on the packets it
+// sends and receives.
+func WrapBind(bind conn.Bind, send, receive Conditions) *ShapedBind {
+	seed := time.Now().UnixNano()
+	shaped := &ShapedBind{
+		bind:      bind,
+		sendQueue: make(chan shapedPacket, shapedQueueLen),
+		closed:    make(chan struct{}),
+		receive4:  make(chan shapedPacket, shapedQueueLen),
+		receive6:  make(chan shapedPacket, shapedQueueLen),
+	}
+	shaped.send.random = rand.New(rand.NewSource(seed))
+	shaped.receive.random = rand.New(rand.NewSource(seed + 1))
+	shaped.SetConditions(send, receive)
+	go shaped.routineSend()
+	return shaped
+}
+
+// WrapCreateBind returns a function with the signature expected by
+// device.DeviceOptions.CreateBind, wrapping the binds created by create,
+// or by conn.CreateBind if nil, with WrapBind.
+func WrapCreateBind(create func(uint16) (conn.Bind, uint16, error), send, receive Conditions) func(uint16) (conn.Bind, uint16, error) {
+	if create == nil {
+		create = conn.CreateBind
+	}
+	return func(port uint16) (conn.Bind, uint16, error) {
+		bind, actualPort, err := create(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		return WrapBind(bind, send, receive), actualPort, nil
+	}
+}
+
+// SetConditions changes the conditions imposed from now on.
+func (b *ShapedBind) SetConditions(send, receive Conditions) {
+	b.send.Lock()
+	b.send.conditions = send
+	b.send.Unlock()
+	b.receive.Lock()
+	b.receive.conditions = receive
+	b.receive.Unlock()
+}
+
+// Dropped returns the number of packets dropped in each direction.
+func (b *ShapedBind) Dropped() (send, receive uint64) {
+	return atomic.LoadUint64(&b.send.dropped), atomic.LoadUint64(&b.receive.dropped)
+}
+
+func (b *ShapedBind) LastMark() uint32 {
+	return b.bind.LastMark()
+}
+
+func (b *ShapedBind) SetMark(mark uint32) error {
+	return b.bind.SetMark(mark)
+}
+
+func (b *ShapedBind) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	return b.bind.Close()
+}
+
+func sleepUntil(due time.Time) {
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+/* Sending
+ */
+
+func (b *ShapedBind) Send(buff []byte, ep conn.Endpoint) error {
+	b.send.Lock()
+	zero := b.send.conditions.zero()
+	b.send.Unlock()
+	if zero {
+		return b.bind.Send(buff, ep)
+	}
+
+	due, ok := b.send.admit(len(buff), time.Now())
+	if !ok {
+		return nil
+	}
+	packet := shapedPacket{data: append([]byte(nil), buff...), ep: ep, due: due}
+	select {
+	case b.sendQueue <- packet:
+	case <-b.closed:
+	default:
+		atomic.AddUint64(&b.send.dropped, 1)
+	}
+	return nil
+}
+
+func (b *ShapedBind) routineSend() {
+	for {
+		select {
+		case <-b.closed:
+			return
+		case packet := <-b.sendQueue:
+			sleepUntil(packet.due)
+			b.bind.Send(packet.data, packet.ep)
+		}
+	}
+}
+
+/* Receiving, through a routine for each family reading ahead
+ */
+
+func (b *ShapedBind) routineReceive(receive func([]byte) (int, conn.Endpoint, error), queue chan shapedPacket) {
+	buff := make([]byte, shapedPacketLen)
+	for {
+		size, ep, err := receive(buff)
+		if err != nil {
+			select {
+			case queue <- shapedPacket{err: err}:
+			case <-b.closed:
+			}
+			return
+		}
+		due, ok := b.receive.admit(size, time.Now())
+		if !ok {
+			continue
+		}
+		packet := shapedPacket{data: append([]byte(nil), buff[:size]...), ep: ep, due: due}
+		select {
+		case queue <- packet:
+		default:
+			atomic.AddUint64(&b.receive.dropped, 1)
+		}
+	}
+}
+
+func (b *ShapedBind) next(queue chan shapedPacket, buff []byte) (int, conn.Endpoint, error) {
+	select {
+	case packet := <-queue:
+		if packet.err != nil {
+			queue <- packet // for later calls
+			return 0, nil, packet.err
+		}
+		sleepUntil(packet.due)
+		return copy(buff, packet.data), packet.ep, nil
+	case <-b.closed:
+		return 0, nil, errClosed
+	}
+}
+
+func (b *ShapedBind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, error) {
+	b.start4.Do(func() {
+		go b.routineReceive(b.bind.ReceiveIPv4, b.receive4)
+	})
+	return b.next(b.receive4, buff)
+}
+
+func (b *ShapedBind) ReceiveIPv6(buff []byte) (int, conn.Endpoint, error) {
+	b.start6.Do(func() {
+		go b.routineReceive(b.bind.ReceiveIPv6, b.receive6)
+	})
+	return b.next(b.receive6, buff)
+}
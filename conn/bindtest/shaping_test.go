@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"testing"
+	"time"
+)
+
+func newShapedPair(t *testing.T, send, receive Conditions) (*ShapedBind, *ChannelBind) {
+	binds := NewChannelBinds()
+	for _, bind := range binds {
+		if _, _, err := bind.Open(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return WrapBind(binds[0], send, receive), binds[1]
+}
+
+func TestShapedLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	shaped, other := newShapedPair(t, Conditions{Latency: latency}, Conditions{Latency: latency})
+	defer shaped.Close()
+	defer other.Close()
+
+	// sending
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := shaped.Send([]byte{byte(i)}, ChannelEndpoint(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buff := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		n, _, err := other.ReceiveIPv4(buff)
+		if err != nil || n != 1 || buff[0] != byte(i) {
+			t.Fatalf("received %v, %v", buff[:n], err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < latency || elapsed > latency*4 {
+		t.Errorf("sent with latency %v, want %v", elapsed, latency)
+	}
+
+	// receiving
+
+	start = time.Now()
+	other.Send([]byte{42}, ChannelEndpoint(1))
+	n, _, err := shaped.ReceiveIPv4(buff)
+	if err != nil || n != 1 || buff[0] != 42 {
+		t.Fatalf("received %v, %v", buff[:n], err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("received with latency %v, want %v", elapsed, latency)
+	}
+
+	// closing ends receiving
+
+	shaped.Close()
+	if _, _, err := shaped.ReceiveIPv4(buff); err == nil {
+		t.Error("received from closed bind")
+	}
+}
+
+func TestShapedLossAndRate(t *testing.T) {
+	shaped, other := newShapedPair(t, Conditions{Loss: 1}, Conditions{})
+	defer shaped.Close()
+	defer other.Close()
+
+	for i := 0; i < 10; i++ {
+		shaped.Send([]byte{byte(i)}, ChannelEndpoint(1))
+	}
+	if send, receive := shaped.Dropped(); send != 10 || receive != 0 {
+		t.Errorf("Dropped() = %d, %d, want 10, 0", send, receive)
+	}
+
+	// at 10000 bytes per second with a backlog of 100ms, about ten
+	// packets of 100 bytes fit, the others are dropped
+
+	shaped.SetConditions(Conditions{Rate: 10000, Backlog: 100 * time.Millisecond}, Conditions{})
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		shaped.Send(make([]byte, 100), ChannelEndpoint(1))
+	}
+	send, _ := shaped.Dropped()
+	delivered := 20 - int(send-10)
+	if delivered < 10 || delivered > 12 {
+		t.Errorf("%d packets delivered at rate, want 11", delivered)
+	}
+	buff := make([]byte, 128)
+	for i := 0; i < delivered; i++ {
+		if _, _, err := other.ReceiveIPv4(buff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("%d packets of 100 bytes sent at 10000 bytes per second in %v", delivered, elapsed)
+	}
+}
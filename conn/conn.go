@@ -14,8 +14,9 @@ import (
 
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
-// depending on the platform-specific implementation.
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface,
+// BufferSizer, ReceiveDropCounter, BatchSender or SegmentReceiver, depending
+// on the platform-specific implementation.
 type Bind interface {
 	// LastMark reports the last mark set for this Bind.
 	LastMark() uint32
@@ -67,6 +68,46 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// BufferSizer is implemented by Bind objects whose socket buffers can be
+// resized, sizes are in bytes and may be capped by the operating system.
+type BufferSizer interface {
+	SetReceiveBuffer(bytes int) error
+	SetSendBuffer(bytes int) error
+}
+
+// ReceiveDropCounter is implemented by Bind objects which can tell how many
+// datagrams were dropped because their receive buffers were full.
+type ReceiveDropCounter interface {
+	ReceiveDrops() (uint64, error)
+}
+
+// BatchSender is implemented by Bind objects which can hand several packets
+// for the same endpoint to the operating system at once, such as by using
+// UDP segmentation offload. Packets are sent in order.
+type BatchSender interface {
+	SendBatch(buffs [][]byte, ep Endpoint) error
+}
+
+// SegmentReceiver is implemented by Bind objects which can receive several
+// datagrams from the same sender coalesced into one, such as by using UDP
+// generic receive offload. Once EnableReceiveOffload succeeded, datagrams
+// must be read with ReceiveIPv4Segments and ReceiveIPv6Segments, which
+// report the size of the coalesced datagrams. Every segment has that size,
+// except the last which may be shorter. A segment size of zero means the
+// datagram was not coalesced.
+type SegmentReceiver interface {
+	EnableReceiveOffload() error
+	ReceiveIPv4Segments(b []byte) (n int, segment int, ep Endpoint, err error)
+	ReceiveIPv6Segments(b []byte) (n int, segment int, ep Endpoint, err error)
+}
+
+// FlowLabeler is implemented by Bind objects which can have the system
+// label the IPv6 datagrams they send with a flow label hashed from their
+// addresses and ports, so that every flow keeps a stable label.
+type FlowLabeler interface {
+	SetAutoFlowLabel(enabled bool) error
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst : the remote address of a peer ("endpoint" in uapi terminology)
@@ -133,6 +133,30 @@ func (bind *nativeBind) Close() error {
 
 func (bind *nativeBind) LastMark() uint32 { return 0 }
 
+func (bind *nativeBind) SetReceiveBuffer(bytes int) error {
+	for _, c := range [...]*net.UDPConn{bind.ipv4, bind.ipv6} {
+		if c == nil {
+			continue
+		}
+		if err := c.SetReadBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *nativeBind) SetSendBuffer(bytes int) error {
+	for _, c := range [...]*net.UDPConn{bind.ipv4, bind.ipv6} {
+		if c == nil {
+			continue
+		}
+		if err := c.SetWriteBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
 	if bind.ipv4 == nil {
 		return 0, nil, syscall.EAFNOSUPPORT
@@ -22,6 +22,14 @@ const (
 	FD_ERR = -1
 )
 
+/* Layout of the SO_MEMINFO socket option, see linux/sock_diag.h
+ */
+
+const (
+	skMeminfoDrops = 8
+	skMeminfoVars  = 9
+)
+
 type IPv4Source struct {
 	Src     [4]byte
 	Ifindex int32
@@ -63,6 +71,9 @@ type nativeBind struct {
 	sock4    int
 	sock6    int
 	lastMark uint32
+	gso      uint32 // 1 while UDP segmentation offload works, accessed atomically
+	gro4     bool   // receive offload enabled on sock4, see EnableReceiveOffload
+	gro6     bool   // receive offload enabled on sock6
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
@@ -133,6 +144,10 @@ func createBind(port uint16) (Bind, uint16, error) {
 		return nil, 0, errors.New("ipv4 and ipv6 not supported")
 	}
 
+	if supportsSegmentation(bind.sock4) || supportsSegmentation(bind.sock6) {
+		bind.gso = 1
+	}
+
 	return &bind, port, nil
 }
 
@@ -171,6 +186,70 @@ func (bind *nativeBind) SetMark(value uint32) error {
 	return nil
 }
 
+func (bind *nativeBind) SetAutoFlowLabel(enabled bool) error {
+	if bind.sock6 == FD_ERR {
+		return nil
+	}
+	value := 0
+	if enabled {
+		value = 1
+	}
+	return unix.SetsockoptInt(bind.sock6, unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL, value)
+}
+
+func (bind *nativeBind) SetReceiveBuffer(bytes int) error {
+	return bind.setBuffer(unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, bytes)
+}
+
+func (bind *nativeBind) SetSendBuffer(bytes int) error {
+	return bind.setBuffer(unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, bytes)
+}
+
+// setBuffer prefers the forcing variant of a buffer option, which is not
+// capped by the system wide maximum but requires CAP_NET_ADMIN.
+func (bind *nativeBind) setBuffer(force, opt, bytes int) error {
+	for _, fd := range [...]int{bind.sock4, bind.sock6} {
+		if fd == FD_ERR {
+			continue
+		}
+		if unix.SetsockoptInt(fd, unix.SOL_SOCKET, force, bytes) == nil {
+			continue
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *nativeBind) ReceiveDrops() (uint64, error) {
+	var drops uint64
+	for _, fd := range [...]int{bind.sock4, bind.sock6} {
+		if fd == FD_ERR {
+			continue
+		}
+		var meminfo [skMeminfoVars]uint32
+		size := uint32(unsafe.Sizeof(meminfo))
+		_, _, errno := unix.Syscall6(
+			unix.SYS_GETSOCKOPT,
+			uintptr(fd),
+			unix.SOL_SOCKET,
+			unix.SO_MEMINFO,
+			uintptr(unsafe.Pointer(&meminfo[0])),
+			uintptr(unsafe.Pointer(&size)),
+			0,
+		)
+		if errno != 0 {
+			return 0, errno
+		}
+		if size < uint32(unsafe.Sizeof(meminfo)) {
+			return 0, errors.New("kernel does not report socket drops")
+		}
+		drops += uint64(meminfo[skMeminfoDrops])
+	}
+	return drops, nil
+}
+
 func closeUnblock(fd int) error {
 	// shutdown to unblock readers and writers
 	unix.Shutdown(fd, unix.SHUT_RDWR)
@@ -224,12 +303,12 @@ func (bind *nativeBind) Send(buff []byte, end Endpoint) error {
 		if bind.sock4 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send4(bind.sock4, nend, buff)
+		return send4(bind.sock4, nend, buff, 0)
 	} else {
 		if bind.sock6 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send6(bind.sock6, nend, buff)
+		return send6(bind.sock6, nend, buff, 0)
 	}
 }
 
@@ -422,7 +501,7 @@ func create6(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func send4(sock int, end *NativeEndpoint, buff []byte) error {
+func send4(sock int, end *NativeEndpoint, buff []byte, segment uint16) error {
 
 	// construct message header
 
@@ -442,7 +521,7 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 	}
 
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	_, err := unix.SendmsgN(sock, buff, withSegmentCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], segment), end.dst4(), 0)
 	end.Unlock()
 
 	if err == nil {
@@ -455,14 +534,14 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, withSegmentCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], segment), end.dst4(), 0)
 		end.Unlock()
 	}
 
 	return err
 }
 
-func send6(sock int, end *NativeEndpoint, buff []byte) error {
+func send6(sock int, end *NativeEndpoint, buff []byte, segment uint16) error {
 
 	// construct message header
 
@@ -486,7 +565,7 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 	}
 
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	_, err := unix.SendmsgN(sock, buff, withSegmentCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], segment), end.dst6(), 0)
 	end.Unlock()
 
 	if err == nil {
@@ -499,7 +578,7 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, withSegmentCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], segment), end.dst6(), 0)
 		end.Unlock()
 	}
 
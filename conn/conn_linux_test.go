@@ -0,0 +1,39 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetAutoFlowLabel(t *testing.T) {
+	bind, _, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer bind.Close()
+	native := bind.(*nativeBind)
+	if native.sock6 == FD_ERR {
+		t.Skip("no IPv6 socket")
+	}
+
+	for _, enabled := range []bool{true, false} {
+		if err := native.SetAutoFlowLabel(enabled); err != nil {
+			t.Fatalf("SetAutoFlowLabel(%v): %v", enabled, err)
+		}
+		value, err := unix.GetsockoptInt(native.sock6, unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (value != 0) != enabled {
+			t.Errorf("IPV6_AUTOFLOWLABEL = %d after SetAutoFlowLabel(%v)", value, enabled)
+		}
+	}
+}
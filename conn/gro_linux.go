@@ -0,0 +1,122 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* UDP generic receive offload (Linux 5.0+)
+ *
+ * The kernel coalesces consecutive datagrams of a flow into one and
+ * reports their size in a UDP_GRO control message. Since that message
+ * precedes the packet info, control messages are parsed in full here.
+ * A coalesced datagram which does not fit the buffer is dropped, as
+ * its last segment would be cut short.
+ */
+
+const udpGRO = 104 // UDP_GRO, not yet in golang.org/x/sys/unix
+
+func (bind *nativeBind) EnableReceiveOffload() error {
+	var err error
+	if bind.sock4 != FD_ERR {
+		if err = unix.SetsockoptInt(bind.sock4, solUDP, udpGRO, 1); err == nil {
+			bind.gro4 = true
+		}
+	}
+	if bind.sock6 != FD_ERR {
+		if err = unix.SetsockoptInt(bind.sock6, solUDP, udpGRO, 1); err == nil {
+			bind.gro6 = true
+		}
+	}
+	if !bind.gro4 && !bind.gro6 {
+		if err == nil {
+			err = errors.New("no sockets to enable receive offload on")
+		}
+		return err
+	}
+	return nil
+}
+
+func (bind *nativeBind) ReceiveIPv4Segments(buff []byte) (int, int, Endpoint, error) {
+	if !bind.gro4 {
+		n, end, err := bind.ReceiveIPv4(buff)
+		return n, 0, end, err
+	}
+	var end NativeEndpoint
+	n, segment, err := receiveSegments(bind.sock4, buff, &end, false)
+	return n, segment, &end, err
+}
+
+func (bind *nativeBind) ReceiveIPv6Segments(buff []byte) (int, int, Endpoint, error) {
+	if !bind.gro6 {
+		n, end, err := bind.ReceiveIPv6(buff)
+		return n, 0, end, err
+	}
+	var end NativeEndpoint
+	n, segment, err := receiveSegments(bind.sock6, buff, &end, true)
+	return n, segment, &end, err
+}
+
+func receiveSegments(sock int, buff []byte, end *NativeEndpoint, isV6 bool) (int, int, error) {
+	var oob [16]uint64 // aligned for the control message headers
+	var size, oobn, flags int
+	var newDst unix.Sockaddr
+	for {
+		var err error
+		size, oobn, flags, newDst, err = unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:], 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		if flags&unix.MSG_TRUNC == 0 {
+			break
+		}
+	}
+	end.isV6 = isV6
+	switch dst := newDst.(type) {
+	case *unix.SockaddrInet4:
+		*end.dst4() = *dst
+	case *unix.SockaddrInet6:
+		*end.dst6() = *dst
+	}
+
+	// walk control messages, updating the source cache
+
+	segment := 0
+	control := (*[unsafe.Sizeof(oob)]byte)(unsafe.Pointer(&oob))[:oobn]
+	for len(control) >= unix.CmsgLen(0) {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		length := int(h.Len)
+		if length < unix.CmsgLen(0) || length > len(control) {
+			break
+		}
+		data := control[unix.CmsgLen(0):length]
+		switch {
+		case h.Level == solUDP && h.Type == udpGRO && len(data) >= 4:
+			segment = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == unix.IPPROTO_IP && h.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src4().Src = pktinfo.Spec_dst
+			end.src4().Ifindex = pktinfo.Ifindex
+		case h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			end.src6().src = pktinfo.Addr
+			end.dst6().ZoneId = pktinfo.Ifindex
+		}
+		next := unix.CmsgSpace(length - unix.CmsgLen(0))
+		if next > len(control) {
+			break
+		}
+		control = control[next:]
+	}
+
+	return size, segment, nil
+}
@@ -0,0 +1,126 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* UDP generic segmentation offload (Linux 4.18+)
+ *
+ * A run of packets of equal size, of which only the last may be
+ * shorter, is concatenated into a single datagram that the kernel
+ * splits again, saving a sendmsg call per packet.
+ */
+
+const (
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT, not yet in golang.org/x/sys/unix
+)
+
+const (
+	udpMaxSegments = 64    // UDP_MAX_SEGMENTS
+	udpMaxPayload  = 65507 // largest UDP payload over IPv4
+)
+
+var segmentBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([udpMaxPayload]byte)
+	},
+}
+
+func supportsSegmentation(sock int) bool {
+	if sock == FD_ERR {
+		return false
+	}
+	_, err := unix.GetsockoptInt(sock, solUDP, udpSegment)
+	return err == nil
+}
+
+// withSegmentCmsg appends a UDP_SEGMENT control message to oob,
+// unless segment is zero.
+func withSegmentCmsg(oob []byte, segment uint16) []byte {
+	if segment == 0 {
+		return oob
+	}
+	control := make([]byte, len(oob)+unix.CmsgSpace(2))
+	copy(control, oob)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&control[len(oob)]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&control[len(oob)+unix.CmsgLen(0)])) = segment
+	return control
+}
+
+// segmentable returns how many of the leading buffers fit into one datagram.
+func segmentable(buffs [][]byte) int {
+	size := len(buffs[0])
+	total := 0
+	for i, buff := range buffs {
+		if i == udpMaxSegments || len(buff) > size || total+len(buff) > udpMaxPayload {
+			return i
+		}
+		total += len(buff)
+		if len(buff) < size {
+			return i + 1
+		}
+	}
+	return len(buffs)
+}
+
+func (bind *nativeBind) SendBatch(buffs [][]byte, end Endpoint) error {
+	nend := end.(*NativeEndpoint)
+	sock, send := bind.sock4, send4
+	if nend.isV6 {
+		sock, send = bind.sock6, send6
+	}
+	if sock == FD_ERR {
+		return syscall.EAFNOSUPPORT
+	}
+
+	for len(buffs) > 0 {
+		n := 1
+		if atomic.LoadUint32(&bind.gso) == 1 {
+			n = segmentable(buffs)
+		}
+		if n == 1 {
+			if err := send(sock, nend, buffs[0], 0); err != nil {
+				return err
+			}
+			buffs = buffs[1:]
+			continue
+		}
+
+		datagram := segmentBuffers.Get().(*[udpMaxPayload]byte)
+		size := 0
+		for _, buff := range buffs[:n] {
+			size += copy(datagram[size:], buff)
+		}
+		err := send(sock, nend, datagram[:size], uint16(len(buffs[0])))
+		segmentBuffers.Put(datagram)
+
+		// the route may lead to a device without checksum offload,
+		// which cannot segment, so resend the packets one by one
+
+		if err == unix.EIO || err == unix.EOPNOTSUPP || err == unix.ENOPROTOOPT {
+			atomic.StoreUint32(&bind.gso, 0)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		buffs = buffs[n:]
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSegmentable(t *testing.T) {
+	sized := func(sizes ...int) [][]byte {
+		buffs := make([][]byte, len(sizes))
+		for i, size := range sizes {
+			buffs[i] = make([]byte, size)
+		}
+		return buffs
+	}
+	many := make([]int, udpMaxSegments+1)
+	for i := range many {
+		many[i] = 100
+	}
+	tests := []struct {
+		sizes []int
+		want  int
+	}{
+		{[]int{100}, 1},
+		{[]int{100, 100, 100}, 3},
+		{[]int{100, 100, 60, 100}, 3},
+		{[]int{100, 200}, 1},
+		{many, udpMaxSegments},
+		{[]int{30000, 30000, 30000}, 2},
+	}
+	for _, tt := range tests {
+		if got := segmentable(sized(tt.sizes...)); got != tt.want {
+			t.Errorf("segmentable(%v) = %d, want %d", tt.sizes, got, tt.want)
+		}
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	tx, _, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer tx.Close()
+	rx, port, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer rx.Close()
+
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffs [][]byte
+	for i := 0; i < 10; i++ {
+		size := 1000
+		if i == 9 {
+			size = 500
+		}
+		buffs = append(buffs, bytes.Repeat([]byte{byte(i)}, size))
+	}
+	if err := tx.(BatchSender).SendBatch(buffs, end); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver must see the original packets, however they were sent
+
+	buff := make([]byte, 65536)
+	for i, want := range buffs {
+		n, _, err := rx.ReceiveIPv4(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buff[:n], want) {
+			t.Fatalf("packet %d: got %d bytes of %d, want %d bytes of %d", i, n, buff[0], len(want), want[0])
+		}
+	}
+}
+
+func TestReceiveSegments(t *testing.T) {
+	tx, _, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer tx.Close()
+	rx, port, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer rx.Close()
+	receiver := rx.(SegmentReceiver)
+	if err := receiver.EnableReceiveOffload(); err != nil {
+		t.Skip("no UDP receive offload:", err)
+	}
+
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	var buffs [][]byte
+	for i := 0; i < 8; i++ {
+		buff := bytes.Repeat([]byte{byte(i)}, 1200)
+		buffs = append(buffs, buff)
+		want = append(want, buff...)
+	}
+	if err := tx.(BatchSender).SendBatch(buffs, end); err != nil {
+		t.Fatal(err)
+	}
+
+	// whether or not the datagrams were coalesced, splitting them yields the originals
+
+	var got []byte
+	buff := make([]byte, 65536)
+	for len(got) < len(want) {
+		n, segment, ep, err := receiver.ReceiveIPv4Segments(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segment == 0 {
+			segment = n
+		}
+		if segment != 1200 {
+			t.Fatalf("segment size %d, want 1200", segment)
+		}
+		if ep.SrcIP() == nil || !ep.SrcIP().Equal(ep.DstIP()) {
+			t.Errorf("source %v of local datagram differs from destination %v", ep.SrcIP(), ep.DstIP())
+		}
+		got = append(got, buff[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("received data differs from sent data")
+	}
+}
+
+func TestReceiveSegmentsTruncated(t *testing.T) {
+	tx, _, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer tx.Close()
+	other, _, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer other.Close()
+	rx, port, err := CreateBind(0)
+	if err != nil {
+		t.Skip("no UDP sockets:", err)
+	}
+	defer rx.Close()
+	receiver := rx.(SegmentReceiver)
+	if err := receiver.EnableReceiveOffload(); err != nil {
+		t.Skip("no UDP receive offload:", err)
+	}
+
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffs [][]byte
+	for i := 0; i < 8; i++ {
+		buffs = append(buffs, bytes.Repeat([]byte{byte(i)}, 1200))
+	}
+	if err := tx.(BatchSender).SendBatch(buffs, end); err != nil {
+		t.Fatal(err)
+	}
+
+	// a datagram of another flow, never coalesced with the batch
+
+	marker := bytes.Repeat([]byte{0xff}, 100)
+	if err := other.Send(marker, end); err != nil {
+		t.Fatal(err)
+	}
+
+	// reading into a buffer too small for the coalesced batch yields
+	// whole datagrams only, down to the marker
+
+	buff := make([]byte, 2000)
+	for {
+		n, segment, _, err := receiver.ReceiveIPv4Segments(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buff[:n], marker) {
+			break
+		}
+		if segment == 0 {
+			segment = n
+		}
+		if segment != 1200 || n%segment != 0 {
+			t.Fatalf("read %d bytes of %d byte segments", n, segment)
+		}
+	}
+}
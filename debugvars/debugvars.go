@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package debugvars publishes the internal counters of a device through
+// expvar, or serves them over HTTP, for quick diagnosis without further
+// dependencies.
+package debugvars
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* Internal counters as expvars
+ *
+ * Vars gathers the counters of a device into a tree of JSON objects,
+ * afresh whenever it is read:
+ *
+ *   routines, buffers, queued, timers, peers
+ *           as in device.Diagnostics, buffers being those taken from
+ *           the pools and not yet returned
+ *   handshakes
+ *           device.HandshakeStats, along with the handshakes received
+ *           from all peers, in total and within the handshake rate
+ *           window, and the number of peers handshaking anomalously
+ *   traffic, bind, drops
+ *           bytes sent and received by all peers, errors of the bind
+ *           and packets dropped by reason, see device.SetDropMonitor
+ *
+ * Publish adds them to the expvar registry, served at /debug/vars by
+ * the handler expvar installs into http.DefaultServeMux, and Handler
+ * serves them on their own. Public keys and endpoints never appear.
+ */
+
+// Vars returns the counters of dev.
+func Vars(dev *device.Device) map[string]interface{} {
+	diag := dev.Diagnostics()
+	handshakes := dev.HandshakeStats()
+	bind := dev.BindStats()
+
+	var total, recent, anomalous uint64
+	var txBytes, rxBytes uint64
+	stats, _ := dev.PeerStatsChangedSince(0)
+	for _, peer := range stats {
+		total += peer.Handshakes
+		recent += uint64(peer.RecentHandshakes)
+		if peer.HandshakeAnomaly {
+			anomalous++
+		}
+		txBytes += peer.TxBytes
+		rxBytes += peer.RxBytes
+	}
+
+	drops := make(map[string]uint64)
+	for reason, count := range dev.DropCounts() {
+		drops[reason.String()] = count
+	}
+
+	return map[string]interface{}{
+		"goroutines": diag.Goroutines,
+		"routines":   diag.Routines,
+		"buffers":    diag.Buffers,
+		"queued":     diag.Queued,
+		"timers":     diag.Timers,
+		"peers":      diag.Peers,
+		"handshakes": map[string]interface{}{
+			"under_load":           handshakes.UnderLoad,
+			"cookie_replies":       handshakes.CookieReplies,
+			"rate_limited":         handshakes.RateLimited,
+			"queue_full":           handshakes.HandshakeQueueFull,
+			"buffers_exhausted":    handshakes.BuffersExhausted,
+			"index_entries":        handshakes.IndexEntries,
+			"index_evictions":      handshakes.IndexEvictions,
+			"receive_filtered":     handshakes.ReceiveFiltered,
+			"out_of_band":          handshakes.OutOfBand,
+			"over_quota":           handshakes.OverQuota,
+			"received":             total,
+			"received_recently":    recent,
+			"recent_window_sec":    int64(device.HandshakeRateWindow.Seconds()),
+			"peers_anomalous_rate": anomalous,
+		},
+		"traffic": map[string]uint64{
+			"tx_bytes": txBytes,
+			"rx_bytes": rxBytes,
+		},
+		"bind": map[string]interface{}{
+			"send_errors":    errorCounts(bind.SendErrors),
+			"receive_errors": errorCounts(bind.ReceiveErrors),
+		},
+		"drops": drops,
+	}
+}
+
+func errorCounts(counts device.ErrorCounts) map[string]uint64 {
+	return map[string]uint64{
+		"unreachable":  counts.Unreachable,
+		"permission":   counts.Permission,
+		"no_buffers":   counts.NoBuffers,
+		"message_size": counts.MessageSize,
+		"other":        counts.Other,
+	}
+}
+
+// Publish adds the counters of dev to the expvar registry under name.
+// Like expvar.Publish, it panics if name is already registered.
+func Publish(name string, dev *device.Device) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Vars(dev)
+	}))
+}
+
+// Handler returns a handler serving the counters of dev as a JSON
+// object, like /debug/vars does with a single variable.
+func Handler(dev *device.Device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(Vars(dev))
+	})
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package debugvars
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestHandler(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+	handler := Handler(dev)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d, want 200", w.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"goroutines", "routines", "buffers", "queued", "timers", "peers", "handshakes", "traffic", "bind", "drops"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("no %s in %s", name, w.Body)
+		}
+	}
+	var queued map[string]int
+	if err := json.Unmarshal(vars["queued"], &queued); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queued["handshake"]; !ok {
+		t.Errorf("no handshake queue depth in %s", vars["queued"])
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", w.Code)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+	Publish("wireguard_test", dev)
+	v := expvar.Get("wireguard_test")
+	if v == nil {
+		t.Fatal("not published")
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(v.String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["handshakes"]; !ok {
+		t.Errorf("no handshakes in %s", v)
+	}
+}
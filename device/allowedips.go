@@ -6,7 +6,6 @@
 package device
 
 import (
-	"errors"
 	"math/bits"
 	"net"
 	"sync"
@@ -161,11 +160,20 @@ func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 }
 
 func (node *trieEntry) lookup(ip net.IP) *Peer {
+	found, _ := node.lookupPrefix(ip)
+	return found
+}
+
+// lookupPrefix returns the peer for ip and the length of the prefix it
+// was found by, -1 if there is none.
+func (node *trieEntry) lookupPrefix(ip net.IP) (*Peer, int) {
 	var found *Peer
+	ones := -1
 	size := uint(len(ip))
 	for node != nil && commonBits(node.bits, ip) >= node.cidr {
 		if node.peer != nil {
 			found = node.peer
+			ones = int(node.cidr)
 		}
 		if node.bit_at_byte == size {
 			break
@@ -173,7 +181,7 @@ func (node *trieEntry) lookup(ip net.IP) *Peer {
 		bit := node.choose(ip)
 		node = node.child[bit]
 	}
-	return found
+	return found, ones
 }
 
 func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet {
@@ -193,9 +201,17 @@ func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet
 }
 
 type AllowedIPs struct {
-	IPv4  *trieEntry
-	IPv6  *trieEntry
-	mutex sync.RWMutex
+	IPv4    *trieEntry
+	IPv6    *trieEntry
+	mutex   sync.RWMutex
+	entries int // prefixes assigned to peers
+}
+
+// Len returns the number of prefixes assigned to peers.
+func (table *AllowedIPs) Len() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.entries
 }
 
 func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
@@ -214,30 +230,44 @@ func (table *AllowedIPs) Reset() {
 
 	table.IPv4 = nil
 	table.IPv6 = nil
+	table.entries = 0
 }
 
 func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
+	table.entries -= len(table.IPv4.entriesForPeer(peer, nil)) + len(table.IPv6.entriesForPeer(peer, nil))
 	table.IPv4 = table.IPv4.removeByPeer(peer)
 	table.IPv6 = table.IPv6.removeByPeer(peer)
 }
 
-func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
+// Exclude removes the addresses of network from the allowed IPs of peer,
+// splitting its prefixes partially covered by network, see ExcludePrefixes.
+func (table *AllowedIPs) Exclude(peer *Peer, network net.IPNet) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
 
-	switch len(ip) {
-	case net.IPv6len:
-		table.IPv6 = table.IPv6.insert(ip, cidr, peer)
-	case net.IPv4len:
-		table.IPv4 = table.IPv4.insert(ip, cidr, peer)
-	default:
-		panic(errors.New("inserting unknown address type"))
+	entries := table.IPv4.entriesForPeer(peer, nil)
+	entries = table.IPv6.entriesForPeer(peer, entries)
+	table.IPv4 = table.IPv4.removeByPeer(peer)
+	table.IPv6 = table.IPv6.removeByPeer(peer)
+	remaining := ExcludePrefixes(entries, []net.IPNet{network})
+	table.entries += len(remaining) - len(entries)
+	for _, entry := range remaining {
+		ones, _ := entry.Mask.Size()
+		if len(entry.IP) == net.IPv4len {
+			table.IPv4 = table.IPv4.insert(entry.IP, uint(ones), peer)
+		} else {
+			table.IPv6 = table.IPv6.insert(entry.IP, uint(ones), peer)
+		}
 	}
 }
 
+func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
+	table.insertWithin(ip, cidr, peer, 0)
+}
+
 func (table *AllowedIPs) LookupIPv4(address []byte) *Peer {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -249,3 +279,14 @@ func (table *AllowedIPs) LookupIPv6(address []byte) *Peer {
 	defer table.mutex.RUnlock()
 	return table.IPv6.lookup(address)
 }
+
+// lookupPrefix returns the peer for an IPv4 or IPv6 address and the
+// length of the prefix it was found by, -1 if there is none.
+func (table *AllowedIPs) lookupPrefix(address []byte) (*Peer, int) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	if len(address) == net.IPv4len {
+		return table.IPv4.lookupPrefix(address)
+	}
+	return table.IPv6.lookupPrefix(address)
+}
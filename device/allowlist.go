@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* The receive allowlist filters datagrams by source address
+ *
+ * Datagrams from unexpected addresses are dropped as soon as they are
+ * received, before any parsing or crypto, sparing the CPU of public
+ * servers under scanning and floods. Datagrams are let through from the
+ * listed networks and, if learning, from the current endpoints of the
+ * peers. Unlike the allowed sources of a peer, this applies to every
+ * message, handshakes included, hence a peer roaming to an address
+ * outside the networks cannot reach the device until its endpoint is
+ * configured again.
+ */
+
+type receiveAllowlist struct {
+	sync.RWMutex
+	enabled  AtomicBool // datagrams are filtered, read without the lock
+	learning AtomicBool // endpoints of peers are tracked, read without the lock
+	networks []net.IPNet
+	learned  map[[16]byte]int   // endpoint addresses of peers, by number of peers there
+	addrs    map[*Peer][16]byte // address each peer is counted at in learned
+}
+
+func addrKey(ip net.IP) (key [16]byte, ok bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return key, false
+	}
+	copy(key[:], ip)
+	return key, true
+}
+
+// SetReceiveAllowlist drops datagrams, before any processing, unless
+// they come from networks or, if learn is set, from the endpoint of a
+// peer. No networks and learn unset disable the allowlist.
+func (device *Device) SetReceiveAllowlist(networks []net.IPNet, learn bool) {
+	allowlist := &device.allowlist
+	allowlist.Lock()
+	allowlist.networks = nil
+	for _, network := range networks {
+		network.IP = network.IP.Mask(network.Mask)
+		allowlist.networks = append(allowlist.networks, network)
+	}
+	allowlist.learned = make(map[[16]byte]int)
+	allowlist.addrs = make(map[*Peer][16]byte)
+	allowlist.learning.Set(learn)
+	allowlist.enabled.Set(learn || len(networks) > 0)
+	allowlist.Unlock()
+
+	if !learn {
+		return
+	}
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	for _, peer := range peers {
+		if tagged, ok := peer.lastEndpoint.Load().(taggedEndpoint); ok && tagged.Endpoint != nil {
+			device.learnEndpoint(peer, tagged.Endpoint)
+		}
+	}
+}
+
+// ReceiveAllowlist returns the networks and whether endpoints of peers
+// are learned, as set by SetReceiveAllowlist.
+func (device *Device) ReceiveAllowlist() ([]net.IPNet, bool) {
+	allowlist := &device.allowlist
+	allowlist.RLock()
+	defer allowlist.RUnlock()
+	return append([]net.IPNet(nil), allowlist.networks...), allowlist.learning.Get()
+}
+
+// learnEndpoint lets datagrams through from endpoint, the new endpoint
+// of peer, instead of from its previous one.
+func (device *Device) learnEndpoint(peer *Peer, endpoint conn.Endpoint) {
+	allowlist := &device.allowlist
+	if !allowlist.learning.Get() {
+		return
+	}
+	key, ok := addrKey(endpoint.DstIP())
+	if !ok {
+		return
+	}
+
+	allowlist.RLock()
+	previous, known := allowlist.addrs[peer]
+	allowlist.RUnlock()
+	if known && previous == key {
+		return
+	}
+
+	allowlist.Lock()
+	defer allowlist.Unlock()
+	if !allowlist.learning.Get() {
+		return
+	}
+	allowlist.unsafeForget(peer)
+	allowlist.addrs[peer] = key
+	allowlist.learned[key]++
+}
+
+// forgetPeer stops letting datagrams through from the endpoint of peer.
+func (device *Device) forgetPeer(peer *Peer) {
+	allowlist := &device.allowlist
+	if !allowlist.learning.Get() {
+		return
+	}
+	allowlist.Lock()
+	defer allowlist.Unlock()
+	allowlist.unsafeForget(peer)
+}
+
+func (allowlist *receiveAllowlist) unsafeForget(peer *Peer) {
+	key, ok := allowlist.addrs[peer]
+	if !ok {
+		return
+	}
+	delete(allowlist.addrs, peer)
+	if allowlist.learned[key]--; allowlist.learned[key] <= 0 {
+		delete(allowlist.learned, key)
+	}
+}
+
+// receivePermitted reports whether datagrams from endpoint pass the
+// allowlist, counting those which do not.
+func (device *Device) receivePermitted(endpoint conn.Endpoint) bool {
+	allowlist := &device.allowlist
+	if !allowlist.enabled.Get() {
+		return true
+	}
+	ip := endpoint.DstIP()
+	key, _ := addrKey(ip)
+
+	allowlist.RLock()
+	_, permitted := allowlist.learned[key]
+	for i := 0; !permitted && i < len(allowlist.networks); i++ {
+		permitted = allowlist.networks[i].Contains(ip)
+	}
+	allowlist.RUnlock()
+
+	if !permitted {
+		atomic.AddUint64(&device.stats.receiveFiltered, 1)
+	}
+	return permitted
+}
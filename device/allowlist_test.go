@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestReceiveAllowlist(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	key, err := newPrivateKey()
+	assertNil(t, err)
+	peerKey := key.publicKey().ToHex()
+	assertNil(t, dev.IpcSet("public_key="+peerKey+"\nendpoint=198.51.100.1:51820\n"))
+
+	permitted := func(addr string) bool {
+		endpoint, err := conn.CreateEndpoint(addr)
+		assertNil(t, err)
+		return dev.receivePermitted(endpoint)
+	}
+
+	// disabled, anything goes
+
+	if !permitted("203.0.113.1:1") || dev.HandshakeStats().ReceiveFiltered != 0 {
+		t.Fatal("datagram filtered without an allowlist")
+	}
+
+	// networks, and endpoints of peers once learning
+
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	dev.SetReceiveAllowlist([]net.IPNet{*network}, false)
+	if !permitted("192.0.2.7:1") || permitted("198.51.100.1:51820") || permitted("[2001:db8::1]:1") {
+		t.Error("networks not applied")
+	}
+	assertNil(t, dev.IpcSet("receive_allowlist_learn=true\n"))
+	if !permitted("192.0.2.7:1") || !permitted("198.51.100.1:51820") || permitted("203.0.113.1:1") {
+		t.Error("endpoint of peer not learned")
+	}
+
+	// roaming and removal of the peer
+
+	assertNil(t, dev.IpcSet("public_key="+peerKey+"\nendpoint=198.51.100.2:51820\n"))
+	if permitted("198.51.100.1:51820") || !permitted("198.51.100.2:51820") {
+		t.Error("new endpoint of peer not learned")
+	}
+	assertNil(t, dev.IpcSet("public_key="+peerKey+"\nremove=true\n"))
+	if permitted("198.51.100.2:51820") {
+		t.Error("endpoint of removed peer still permitted")
+	}
+	if n := dev.HandshakeStats().ReceiveFiltered; n != 5 {
+		t.Errorf("ReceiveFiltered = %d, want 5", n)
+	}
+
+	// configuration round trip
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	if len(config.ReceiveAllowlist) != 1 || config.ReceiveAllowlist[0].String() != "192.0.2.0/24" ||
+		config.ReceiveAllowlistLearn == nil || !*config.ReceiveAllowlistLearn {
+		t.Errorf("unexpected config %+v", config)
+	}
+	learn := false
+	assertNil(t, dev.IpcSetConfig(&DeviceConfig{ReplaceReceiveAllowlist: true, ReceiveAllowlistLearn: &learn}))
+	if !permitted("203.0.113.1:1") {
+		t.Error("allowlist not disabled")
+	}
+	if err := dev.IpcSet("receive_allowlist=192.0.2.1\n"); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
+
+func TestReceiveAllowlistFiltersEarly(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	port := getFreePort(t)
+	assertNil(t, dev.IpcSet("listen_port="+port+"\nreceive_allowlist=192.0.2.0/24\n"))
+	dev.Up()
+
+	sender, err := net.Dial("udp", "127.0.0.1:"+port)
+	assertNil(t, err)
+	defer sender.Close()
+	_, err = sender.Write([]byte{4, 0, 0, 0})
+	assertNil(t, err)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if dev.HandshakeStats().ReceiveFiltered == 1 {
+			if sources := dev.MalformedSources(); len(sources) != 0 {
+				t.Errorf("filtered datagram processed: %+v", sources)
+			}
+			return
+		}
+	}
+	t.Fatal("datagram not filtered")
+}
+
+func TestReceiveAllowlistLearnedPeers(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	pair[1].dev.SetReceiveAllowlist(nil, true)
+
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].addr, pair[0].addr)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet from peer filtered")
+	}
+	if n := pair[1].dev.HandshakeStats().ReceiveFiltered; n != 0 {
+		t.Errorf("ReceiveFiltered = %d, want 0", n)
+	}
+}
@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Audit log of configuration changes
+ *
+ * Every UAPI set operation, whether through the UAPI socket or IpcSet and
+ * the functions built on it, is recorded with who performed it, when,
+ * and which settings it changed from which values to which. Changes are
+ * found by comparing the configuration before and after the operation,
+ * which concurrent set operations are serialized against, so that a
+ * record holds the changes of its operation only. Private and preshared
+ * keys are redacted. The last MaxAuditRecords records are kept, see
+ * AuditLog, and every record is handed to the AuditSink of DeviceOptions
+ * as well, which may keep them for longer.
+ */
+
+// An AuditRecord records a UAPI set operation.
+type AuditRecord struct {
+	Time    time.Time
+	Actor   string // who performed the operation, see IPCClient.String, "api" for IpcSet
+	Changes []AuditChange
+	Err     error // the operation failed after applying Changes, nil if it succeeded
+}
+
+// An AuditChange records the change of a setting.
+type AuditChange struct {
+	Peer NoisePublicKey // zero for settings of the device
+	Key  string         // UAPI key of the setting
+	Old  string         // value before the change, values of multi-valued settings joined by commas, empty if unset
+	New  string         // value after the change, like Old
+}
+
+func (change AuditChange) String() string {
+	var prefix string
+	if !change.Peer.IsZero() {
+		prefix = "peer " + change.Peer.ToHex() + " "
+	}
+	return fmt.Sprintf("%s%s: %q -> %q", prefix, change.Key, change.Old, change.New)
+}
+
+// loggedChange returns change as it appears in logs, the public key of
+// its peer redacted, see SetLogRedaction.
+func (device *Device) loggedChange(change AuditChange) string {
+	if change.Peer.IsZero() {
+		return change.String()
+	}
+	key := device.redactKey(change.Peer)
+	if change.Key == "public_key" {
+		if change.Old != "" {
+			change.Old = key
+		}
+		if change.New != "" {
+			change.New = key
+		}
+	}
+	return fmt.Sprintf("peer %s %s: %q -> %q", key, change.Key, change.Old, change.New)
+}
+
+// An AuditSink keeps audit records, see DeviceOptions.AuditSink.
+type AuditSink interface {
+	// RecordAudit keeps record. It is called with set operations
+	// serialized and must not block for long.
+	RecordAudit(record AuditRecord)
+}
+
+// auditRedacted are the settings whose values are not recorded.
+var auditRedacted = map[string]bool{
+	"private_key":   true,
+	"preshared_key": true,
+}
+
+// auditIgnored are the values reported by the get operation which are
+// not settings, and change without set operations.
+var auditIgnored = map[string]bool{
+	"uapi_version":             true,
+	"capability":               true,
+	"up_since_sec":             true,
+	"protocol_version":         true,
+	"endpoint":                 true,
+	"last_handshake_time_sec":  true,
+	"last_handshake_time_nsec": true,
+	"connected_since_sec":      true,
+	"tx_bytes":                 true,
+	"rx_bytes":                 true,
+}
+
+type audit struct {
+	sync.Mutex // serializes set operations, guards records
+	sink       AuditSink
+	records    []AuditRecord
+}
+
+// AuditLog returns the last MaxAuditRecords audit records, oldest first.
+func (device *Device) AuditLog() []AuditRecord {
+	device.audit.Lock()
+	defer device.audit.Unlock()
+	return append([]AuditRecord(nil), device.audit.records...)
+}
+
+// auditedSet performs the set operation read from socket on behalf of
+// actor, recording the changes it makes.
+func (device *Device) auditedSet(socket *bufio.Reader, actor string) error {
+	return device.audited(actor, func() error {
+		return device.ipcSetOperation(socket)
+	})
+}
+
+// audited performs the set operations of apply on behalf of actor,
+// recording the changes they make.
+func (device *Device) audited(actor string, apply func() error) error {
+	device.audit.Lock()
+	defer device.audit.Unlock()
+
+	before := device.auditSnapshot()
+	err := apply()
+	changes := diffAuditSnapshots(before, device.auditSnapshot())
+	if len(changes) == 0 && err == nil {
+		return nil
+	}
+
+	record := AuditRecord{
+		Time:    time.Now(),
+		Actor:   actor,
+		Changes: changes,
+		Err:     err,
+	}
+	if len(device.audit.records) == MaxAuditRecords {
+		copy(device.audit.records, device.audit.records[1:])
+		device.audit.records = device.audit.records[:MaxAuditRecords-1]
+	}
+	device.audit.records = append(device.audit.records, record)
+	for _, change := range changes {
+		device.log.Info.Println("Audit:", actor, "changed", device.loggedChange(change))
+	}
+	if device.audit.sink != nil {
+		device.audit.sink.RecordAudit(record)
+	}
+	return err
+}
+
+// auditSnapshot holds the values of the settings of the device and its
+// peers, the latter by their public keys.
+type auditSnapshot map[NoisePublicKey]map[string][]string
+
+func (device *Device) auditSnapshot() auditSnapshot {
+	snapshot := auditSnapshot{NoisePublicKey{}: make(map[string][]string)}
+	uapiConf, err := device.ipcGet(UAPIVersion)
+	if err != nil {
+		return snapshot
+	}
+	section := snapshot[NoisePublicKey{}]
+	for _, line := range strings.Split(uapiConf, "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		if key == "public_key" {
+			var pk NoisePublicKey
+			if pk.FromHex(value) != nil {
+				continue
+			}
+			section = make(map[string][]string)
+			snapshot[pk] = section
+			continue
+		}
+		if auditIgnored[key] {
+			continue
+		}
+		if auditRedacted[key] {
+			value = redactKey(value)
+		}
+		section[key] = append(section[key], value)
+	}
+	return snapshot
+}
+
+// redactKey stands in for the hex encoded key in value, telling only
+// whether it is set.
+func redactKey(value string) string {
+	if strings.Trim(value, "0") == "" {
+		return ""
+	}
+	return "(redacted)"
+}
+
+// diffAuditSnapshots returns the changes from before to after, those of
+// the device first and then those of the peers ordered by their keys.
+func diffAuditSnapshots(before, after auditSnapshot) []AuditChange {
+	peers := make(map[NoisePublicKey]bool)
+	for pk := range before {
+		peers[pk] = true
+	}
+	for pk := range after {
+		peers[pk] = true
+	}
+	ordered := make([]NoisePublicKey, 0, len(peers))
+	for pk := range peers {
+		ordered = append(ordered, pk)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return string(ordered[i][:]) < string(ordered[j][:])
+	})
+
+	var changes []AuditChange
+	for _, pk := range ordered {
+		old, new := before[pk], after[pk]
+		if !pk.IsZero() && (old == nil || new == nil) {
+			change := AuditChange{Peer: pk, Key: "public_key"}
+			if old == nil {
+				change.New = pk.ToHex()
+			} else {
+				change.Old = pk.ToHex()
+			}
+			changes = append(changes, change)
+		}
+		keys := make(map[string]bool)
+		for key := range old {
+			keys[key] = true
+		}
+		for key := range new {
+			keys[key] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+		for _, key := range sortedKeys {
+			oldValue, newValue := joinAuditValues(old[key]), joinAuditValues(new[key])
+			if oldValue != newValue {
+				changes = append(changes, AuditChange{Peer: pk, Key: key, Old: oldValue, New: newValue})
+			}
+		}
+	}
+	return changes
+}
+
+func joinAuditValues(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
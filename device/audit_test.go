@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type auditCollector chan AuditRecord
+
+func (collector auditCollector) RecordAudit(record AuditRecord) {
+	collector <- record
+}
+
+func TestAuditLog(t *testing.T) {
+	sink := make(auditCollector, 8)
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), DeviceOptions{AuditSink: sink})
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peerKey, err := newPrivateKey()
+	assertNil(t, err)
+	pk := peerKey.publicKey()
+
+	assertNil(t, dev.IpcSet(fmt.Sprintf("private_key=%s\npublic_key=%s\npreshared_key=%s\nallowed_ip=10.0.0.0/24\nallowed_ip=10.0.1.0/24\n",
+		sk.ToHex(), pk.ToHex(), peerKey.ToHex())))
+	assertNil(t, dev.IpcSet(fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\nallowed_ip=10.0.2.0/24\n", pk.ToHex())))
+	assertNil(t, dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\n", pk.ToHex())))
+	assertNil(t, dev.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", pk.ToHex())))
+
+	records := dev.AuditLog()
+	if len(records) != 3 {
+		t.Fatalf("%d audit records, want 3 as the third operation changed nothing: %+v", len(records), records)
+	}
+	for i, record := range records {
+		if sunk := <-sink; sunk.Time != record.Time {
+			t.Errorf("record %d did not reach the sink", i)
+		}
+		if record.Actor != "api" || record.Err != nil {
+			t.Errorf("record %d by %q failed with %v", i, record.Actor, record.Err)
+		}
+		for _, change := range record.Changes {
+			if strings.Contains(change.Old+change.New, sk.ToHex()) || strings.Contains(change.Old+change.New, peerKey.ToHex()) {
+				t.Errorf("record %d discloses a key: %v", i, change)
+			}
+		}
+	}
+
+	want := [][]AuditChange{
+		{
+			{Key: "private_key", New: "(redacted)"},
+			{Peer: pk, Key: "public_key", New: pk.ToHex()},
+			{Peer: pk, Key: "allowed_ip", New: "10.0.0.0/24,10.0.1.0/24"},
+			{Peer: pk, Key: "persistent_keepalive_interval", New: "0"},
+			{Peer: pk, Key: "preshared_key", New: "(redacted)"},
+		},
+		{
+			{Peer: pk, Key: "allowed_ip", Old: "10.0.0.0/24,10.0.1.0/24", New: "10.0.2.0/24"},
+		},
+	}
+	for i, changes := range want {
+		if got, expected := fmt.Sprint(records[i].Changes), fmt.Sprint(changes); got != expected {
+			t.Errorf("record %d changes %s, want %s", i, got, expected)
+		}
+	}
+	removal := records[2].Changes
+	if len(removal) == 0 || removal[0] != (AuditChange{Peer: pk, Key: "public_key", Old: pk.ToHex()}) {
+		t.Errorf("removal recorded as %v", removal)
+	}
+}
@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/* Load balancing across peers
+ *
+ * Several peers may hold the same networks as balanced allowed IPs,
+ * making the device a simple encrypted ECMP edge. Each inner flow, told
+ * apart by its addresses, protocol and ports, goes to one of them,
+ * picked by weighted rendezvous hashing: a flow sticks to its peer, and
+ * as peers join or leave the group or change weight, only the flows
+ * they gain or lose move. Peers whose session is dead, see failover,
+ * take no flows while others are alive, peers of weight zero none.
+ *
+ * Balanced allowed IPs take part in the longest prefix match with the
+ * allowed IPs, winning ties, so that a more specific allowed IP of a
+ * single peer still takes precedence. Packets from the peers of a group
+ * are accepted from its networks.
+ */
+
+const DefaultBalanceWeight = 1
+
+// balancedNetworks is stored in the balance of a peer, which is read
+// without locks on the receive path.
+type balancedNetworks []net.IPNet
+
+type peerBalance struct {
+	weight   uint32       // accessed atomically
+	networks atomic.Value // balancedNetworks
+}
+
+// A balanceGroup holds the peers sharing a network.
+type balanceGroup struct {
+	network net.IPNet
+	ones    int
+	peers   []*Peer
+}
+
+// balanceTable is replaced as a whole on changes, and read without
+// locks on the send path.
+type balanceTable struct {
+	groups []*balanceGroup // most specific first
+}
+
+type balancer struct {
+	sync.Mutex              // serializes replacing table
+	table      atomic.Value // *balanceTable, nil if no peer is balanced
+}
+
+// BalancedAllowedIPs returns the networks peer shares with the other
+// peers balanced across for them.
+func (peer *Peer) BalancedAllowedIPs() []net.IPNet {
+	networks, _ := peer.balance.networks.Load().(balancedNetworks)
+	return append([]net.IPNet(nil), networks...)
+}
+
+// AddBalancedAllowedIP adds peer to the peers the flows to network are
+// balanced across.
+func (peer *Peer) AddBalancedAllowedIP(network net.IPNet) {
+	device := peer.device
+	device.balance.Lock()
+	defer device.balance.Unlock()
+	networks, _ := peer.balance.networks.Load().(balancedNetworks)
+	network.IP = network.IP.Mask(network.Mask)
+	device.unsafeRebalance(peer, append(append(balancedNetworks(nil), networks...), network))
+}
+
+// ClearBalancedAllowedIPs removes peer from all groups of balanced peers.
+func (peer *Peer) ClearBalancedAllowedIPs() {
+	device := peer.device
+	device.balance.Lock()
+	defer device.balance.Unlock()
+	device.unsafeRebalance(peer, nil)
+}
+
+// SetBalanceWeight sets the share of the flows peer takes relative to
+// the other peers of its groups, zero for none.
+func (peer *Peer) SetBalanceWeight(weight uint16) {
+	atomic.StoreUint32(&peer.balance.weight, uint32(weight))
+}
+
+func (peer *Peer) BalanceWeight() uint16 {
+	return uint16(atomic.LoadUint32(&peer.balance.weight))
+}
+
+// balancedFor reports whether peer is among the peers balanced across
+// for ip.
+func (peer *Peer) balancedFor(ip net.IP) bool {
+	networks, _ := peer.balance.networks.Load().(balancedNetworks)
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedRouteFor reports whether packets from ip may arrive from peer
+// through the networks it shares with other peers, the peer whose
+// allowed IPs hold ip being owner.
+func (peer *Peer) sharedRouteFor(ip net.IP, owner *Peer) bool {
+	return peer.balancedFor(ip) || peer.failedOverFrom(ip, owner)
+}
+
+// SetPeerBalance sets the balanced allowed IPs and the weight of the
+// peer with public key pk, see Peer.AddBalancedAllowedIP.
+func (device *Device) SetPeerBalance(pk NoisePublicKey, weight uint16, networks []net.IPNet) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetBalanceWeight(weight)
+	peer.ClearBalancedAllowedIPs()
+	for _, network := range networks {
+		peer.AddBalancedAllowedIP(network)
+	}
+	return nil
+}
+
+// unsafeRebalance replaces the balanced allowed IPs of peer by networks,
+// rebuilding the balance table. The balance lock must be held.
+func (device *Device) unsafeRebalance(peer *Peer, networks balancedNetworks) {
+	peer.balance.networks.Store(networks)
+
+	var groups []*balanceGroup
+	if old, _ := device.balance.table.Load().(*balanceTable); old != nil {
+		for _, group := range old.groups {
+			peers := make([]*Peer, 0, len(group.peers))
+			for _, member := range group.peers {
+				if member != peer {
+					peers = append(peers, member)
+				}
+			}
+			if len(peers) > 0 {
+				groups = append(groups, &balanceGroup{network: group.network, ones: group.ones, peers: peers})
+			}
+		}
+	}
+
+NextNetwork:
+	for _, network := range networks {
+		ones, _ := network.Mask.Size()
+		for _, group := range groups {
+			if group.ones != ones || !group.network.IP.Equal(network.IP) {
+				continue
+			}
+			for _, member := range group.peers {
+				if member == peer {
+					continue NextNetwork
+				}
+			}
+			group.peers = append(group.peers, peer)
+			continue NextNetwork
+		}
+		groups = append(groups, &balanceGroup{network: network, ones: ones, peers: []*Peer{peer}})
+	}
+
+	if len(groups) == 0 {
+		device.balance.table.Store((*balanceTable)(nil))
+		return
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].ones > groups[j].ones
+	})
+	device.balance.table.Store(&balanceTable{groups: groups})
+}
+
+// unbalance removes peer from the balance table, once it is removed.
+func (device *Device) unbalance(peer *Peer) {
+	device.balance.Lock()
+	defer device.balance.Unlock()
+	device.unsafeRebalance(peer, nil)
+}
+
+// pick returns the peer the flow of packet to dst goes to, from the most
+// specific group holding dst, nil if none does with a prefix of at least
+// ones bits or no peer of the group takes flows.
+func (table *balanceTable) pick(dst net.IP, ones int, packet []byte) *Peer {
+	for _, group := range table.groups {
+		if group.ones < ones {
+			return nil
+		}
+		if group.network.Contains(dst) {
+			return group.pick(flowHash(packet))
+		}
+	}
+	return nil
+}
+
+// pick returns the peer of the group with the highest rendezvous score
+// for flow, preferring peers whose session is alive.
+func (group *balanceGroup) pick(flow uint32) *Peer {
+	var best *Peer
+	var bestScore float64
+	bestAlive := false
+	for _, peer := range group.peers {
+		weight := atomic.LoadUint32(&peer.balance.weight)
+		if weight == 0 {
+			continue
+		}
+		alive := !peer.dead()
+		if bestAlive && !alive {
+			continue
+		}
+		score := rendezvousScore(flow, peer.handshake.remoteStatic, weight)
+		if best == nil || alive && !bestAlive || score > bestScore {
+			best, bestScore, bestAlive = peer, score, alive
+		}
+	}
+	return best
+}
+
+// rendezvousScore is the weighted score of a peer for a flow, such that
+// the share of flows of each peer scoring highest is proportional to its
+// weight.
+func rendezvousScore(flow uint32, pk NoisePublicKey, weight uint32) float64 {
+	h := flow*0x9e3779b9 ^ binary.LittleEndian.Uint32(pk[:4])
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	u := (float64(h) + 0.5) / (1 << 32)
+	return -float64(weight) / math.Log(u)
+}
+
+// route returns the peer a packet to dst read from the TUN device or
+// relayed is sent to: one of the balanced peers for dst, or the peer
+// whose allowed IPs hold it, or its backup if its session is dead.
+func (device *Device) route(packet []byte, dst net.IP) *Peer {
+	peer, ones := device.allowedips.lookupPrefix(dst)
+	if table, _ := device.balance.table.Load().(*balanceTable); table != nil {
+		if balanced := table.pick(dst, ones, packet); balanced != nil {
+			atomic.AddUint64(&balanced.stats.balancedPackets, 1)
+			return balanced
+		}
+	}
+	return device.failover(peer, dst)
+}
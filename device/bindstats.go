@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+/* Errors sending and receiving datagrams are counted by their cause, so
+ * that local firewalling, missing routes or full socket buffers show up
+ * in metrics. Send errors are counted for the peer sent to as well as
+ * for the bind of the device, receive errors only for the bind, as they
+ * cannot be told apart by peer.
+ */
+
+// ErrorCounts counts errors of the bind by their cause.
+type ErrorCounts struct {
+	Unreachable uint64 // no route to the network or host, or the address is unusable
+	Permission  uint64 // refused locally, usually by a firewall
+	NoBuffers   uint64 // socket or system buffers were exhausted
+	MessageSize uint64 // the datagram exceeded the MTU of the path
+	Other       uint64
+}
+
+// Total returns the number of errors of all causes.
+func (counts ErrorCounts) Total() uint64 {
+	return counts.Unreachable + counts.Permission + counts.NoBuffers + counts.MessageSize + counts.Other
+}
+
+const (
+	errorUnreachable = iota
+	errorPermission
+	errorNoBuffers
+	errorMessageSize
+	errorOther
+	errorClasses
+)
+
+// errorCounters are ErrorCounts accessed atomically, indexed by class.
+type errorCounters [errorClasses]uint64
+
+func errorClass(err error) int {
+	switch {
+	case unreachableError(err):
+		return errorUnreachable
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return errorPermission
+	case errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM), errors.Is(err, syscall.EAGAIN):
+		return errorNoBuffers
+	case errors.Is(err, syscall.EMSGSIZE):
+		return errorMessageSize
+	default:
+		return errorOther
+	}
+}
+
+func (counters *errorCounters) add(err error) {
+	atomic.AddUint64(&counters[errorClass(err)], 1)
+}
+
+func (counters *errorCounters) counts() ErrorCounts {
+	return ErrorCounts{
+		Unreachable: atomic.LoadUint64(&counters[errorUnreachable]),
+		Permission:  atomic.LoadUint64(&counters[errorPermission]),
+		NoBuffers:   atomic.LoadUint64(&counters[errorNoBuffers]),
+		MessageSize: atomic.LoadUint64(&counters[errorMessageSize]),
+		Other:       atomic.LoadUint64(&counters[errorOther]),
+	}
+}
+
+// BindStats counts the errors of the bind of a device, across the binds
+// opened since the device was created.
+type BindStats struct {
+	SendErrors    ErrorCounts
+	ReceiveErrors ErrorCounts // errors which ended a receive routine, after which the bind is usually reopened
+}
+
+func (device *Device) BindStats() BindStats {
+	return BindStats{
+		SendErrors:    device.stats.sendErrors.counts(),
+		ReceiveErrors: device.stats.receiveErrors.counts(),
+	}
+}
+
+// sendFailed counts the send error err of the bind.
+func (device *Device) sendFailed(err error) {
+	device.stats.sendErrors.add(err)
+}
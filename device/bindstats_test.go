@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	wrap := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", errno)}
+	}
+	tests := []struct {
+		err   error
+		class int
+	}{
+		{wrap(syscall.EHOSTUNREACH), errorUnreachable},
+		{wrap(syscall.EPERM), errorPermission},
+		{wrap(syscall.ENOBUFS), errorNoBuffers},
+		{wrap(syscall.EMSGSIZE), errorMessageSize},
+		{errors.New("bogus"), errorOther},
+	}
+	for _, test := range tests {
+		if class := errorClass(test.err); class != test.class {
+			t.Errorf("errorClass(%v) = %d, want %d", test.err, class, test.class)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	peer.RLock()
+	peer.sent(0, fmt.Errorf("sendto: %w", syscall.EPERM))
+	peer.sent(0, fmt.Errorf("sendto: %w", syscall.EPERM))
+	peer.sent(0, fmt.Errorf("sendto: %w", syscall.EMSGSIZE))
+	peer.RUnlock()
+
+	want := ErrorCounts{Permission: 2, MessageSize: 1}
+	if counts := peer.Stats().SendErrors; counts != want {
+		t.Errorf("peer send errors %+v, want %+v", counts, want)
+	}
+	if stats := dev.BindStats(); stats.SendErrors != want || stats.SendErrors.Total() != 3 {
+		t.Errorf("bind send errors %+v, want %+v", stats.SendErrors, want)
+	}
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+type bufferOptions struct {
+	receive  int
+	send     int
+	autotune bool
+}
+
+// setBufferSizes applies the configured socket buffer sizes to bind.
+// Failing to do so is not fatal, the defaults of the system still work.
+func (device *Device) setBufferSizes(bind conn.Bind) {
+	buffers := device.net.buffers
+	if buffers.receive == 0 && buffers.send == 0 {
+		return
+	}
+	sizer, ok := bind.(conn.BufferSizer)
+	if !ok {
+		device.log.Error.Println("UDP bind does not support setting buffer sizes")
+		return
+	}
+	if buffers.receive != 0 {
+		if err := sizer.SetReceiveBuffer(buffers.receive); err != nil {
+			device.log.Error.Println("Unable to set receive buffer size:", err)
+		}
+	}
+	if buffers.send != 0 {
+		if err := sizer.SetSendBuffer(buffers.send); err != nil {
+			device.log.Error.Println("Unable to set send buffer size:", err)
+		}
+	}
+}
+
+/* Doubles the receive buffer of bind whenever the system reports
+ * datagrams dropped for lack of buffer space, until closing is closed
+ *
+ * Obs. At most one instance per bind
+ */
+func (device *Device) RoutineTuneReceiveBuffer(bind conn.Bind, closing chan struct{}) {
+	defer device.trackRoutine(routineTuneBuffer)()
+
+	logDebug := device.log.Debug
+
+	defer device.net.stopping.Done()
+
+	sizer, ok := bind.(conn.BufferSizer)
+	counter, ok2 := bind.(conn.ReceiveDropCounter)
+	if !ok || !ok2 {
+		logDebug.Println("UDP bind does not support receive buffer autotuning")
+		return
+	}
+	last, err := counter.ReceiveDrops()
+	if err != nil {
+		logDebug.Println("Unable to autotune receive buffer:", err)
+		return
+	}
+
+	size := device.net.buffers.receive
+	ticker := time.NewTicker(ReceiveBufferTuneTime)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+		}
+
+		drops, err := counter.ReceiveDrops()
+		if err != nil || drops == last {
+			continue
+		}
+		last = drops
+		if size >= MaxReceiveBufferSize {
+			continue
+		}
+
+		size *= 2
+		if size < MinReceiveBufferSize {
+			size = MinReceiveBufferSize
+		}
+		if size > MaxReceiveBufferSize {
+			size = MaxReceiveBufferSize
+		}
+		if err := sizer.SetReceiveBuffer(size); err != nil {
+			device.log.Error.Println("Unable to grow receive buffer:", err)
+			return
+		}
+		logDebug.Println("Receive buffer grown to", size, "bytes after", drops, "drops")
+	}
+}
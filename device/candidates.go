@@ -0,0 +1,494 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Endpoint candidates, ICE-lite style
+ *
+ * Peers behind NATs find a path to each other by exchanging candidates,
+ * the endpoints their listen port may be reached at: the addresses of
+ * the interfaces of the host, the external endpoint of the port mapping
+ * and the server reflexive endpoints STUN servers see the listen port
+ * at. OfferCandidates gathers them and hands them to the
+ * CandidateExchange of the application, which carries them to the peer,
+ * whose application hands them to ReceiveCandidates. The receiving side
+ * offers its own candidates in turn unless it just did, and probes the
+ * candidates of the peer every ProbeInterval, for ProbeAttempts rounds.
+ * The first candidate answering becomes the endpoint of the peer. As
+ * both sides probe at once, the NATs in between open for the answers.
+ *
+ * Probes and answers are authenticated with a key derived from the
+ * static-static Diffie-Hellman result of the two peers, and name the
+ * public key of their receiver, so that only the peer itself answers,
+ * and a probe reflected to its sender is not taken for an answer. They
+ * are only accepted for peers which offered or received candidates
+ * within the last ProbeAttempts rounds, whose keys are tried in turn.
+ */
+
+// CandidateKind tells how a candidate was gathered.
+type CandidateKind int
+
+const (
+	CandidateHost      CandidateKind = iota // address of an interface of the host
+	CandidateMapped                         // external endpoint of the port mapping, see ExternalEndpoint
+	CandidateReflexive                      // endpoint a STUN server saw the listen port at
+)
+
+func (kind CandidateKind) String() string {
+	switch kind {
+	case CandidateHost:
+		return "host"
+	case CandidateMapped:
+		return "mapped"
+	case CandidateReflexive:
+		return "reflexive"
+	default:
+		return fmt.Sprintf("CandidateKind(UNKNOWN:%d)", int(kind))
+	}
+}
+
+// A Candidate is an endpoint the listen port of a device may be reached at.
+type Candidate struct {
+	Kind     CandidateKind
+	Endpoint string // host:port, the host being an address
+}
+
+// String returns the kind and the endpoint of the candidate, separated
+// by a space, as parsed by ParseCandidate.
+func (candidate Candidate) String() string {
+	return candidate.Kind.String() + " " + candidate.Endpoint
+}
+
+// ParseCandidate parses a candidate as formatted by Candidate.String.
+func ParseCandidate(s string) (Candidate, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 2 {
+		for _, kind := range []CandidateKind{CandidateHost, CandidateMapped, CandidateReflexive} {
+			if kind.String() != fields[0] {
+				continue
+			}
+			if _, err := net.ResolveUDPAddr("udp", fields[1]); err != nil || net.ParseIP(hostOf(fields[1])) == nil {
+				break
+			}
+			return Candidate{Kind: kind, Endpoint: fields[1]}, nil
+		}
+	}
+	return Candidate{}, fmt.Errorf("%w: candidate %q", ErrInvalidValue, s)
+}
+
+func hostOf(hostport string) string {
+	host, _, _ := net.SplitHostPort(hostport)
+	return host
+}
+
+// A CandidateExchange carries candidates to peers, see
+// DeviceOptions.CandidateExchange.
+type CandidateExchange interface {
+	// SendCandidates sends the candidates of the device to the peer with
+	// the public key, whose application hands them to ReceiveCandidates.
+	SendCandidates(peer NoisePublicKey, candidates []Candidate) error
+}
+
+type candidates struct {
+	exchange    CandidateExchange
+	stunServers []string
+
+	sync.Mutex
+	stun map[stunTransaction]chan *net.UDPAddr // binding requests awaiting a response
+}
+
+type candidateProbe struct {
+	sync.Mutex
+	until    time.Time                  // probes and answers are accepted until then
+	offered  time.Time                  // when candidates were last offered to the peer
+	pending  map[[16]byte]conn.Endpoint // candidates by the nonces of the probes sent to them
+	selected bool                       // a candidate answered
+	stop     chan struct{}              // closed to stop probing, nil if not probing
+}
+
+const (
+	MessageProbeType       = 0x50 // probe of a candidate, a private extension of the protocol
+	MessageProbeAnswerType = 0x51 // answer to a probe
+	MessageProbeSize       = 4 + 16 + blake2s.Size128
+	probeLabel             = "wireguard-go candidate probe"
+)
+
+/* Gathering
+ */
+
+// GatherCandidates returns the candidates of the listen port of the
+// device, asking the STUN servers of DeviceOptions.STUNServers for the
+// server reflexive ones. Unanswered STUN servers are skipped, as are
+// addresses of loopback and link-local interfaces.
+func (device *Device) GatherCandidates(ctx context.Context) ([]Candidate, error) {
+	device.net.RLock()
+	port := device.net.port
+	bound := device.net.bind != nil
+	device.net.RUnlock()
+	if !bound || port == 0 {
+		return nil, ErrNoBind
+	}
+
+	var gathered []Candidate
+	seen := make(map[string]bool)
+	add := func(kind CandidateKind, ip net.IP, port int) {
+		endpoint := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			gathered = append(gathered, Candidate{Kind: kind, Endpoint: endpoint})
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+			continue
+		}
+		add(CandidateHost, ip, int(port))
+	}
+
+	if external, ok := device.ExternalEndpoint(); ok {
+		if addr, err := net.ResolveUDPAddr("udp", external); err == nil && addr.IP != nil {
+			add(CandidateMapped, addr.IP, addr.Port)
+		}
+	}
+
+	for _, addr := range device.queryReflexive(ctx) {
+		add(CandidateReflexive, addr.IP, addr.Port)
+	}
+	return gathered, nil
+}
+
+// queryReflexive sends a binding request to every STUN server at once
+// and returns the addresses of the responses arriving within
+// STUNTimeout.
+func (device *Device) queryReflexive(ctx context.Context) []*net.UDPAddr {
+	servers := device.candidates.stunServers
+	if len(servers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, STUNTimeout)
+	defer cancel()
+
+	responses := make(chan *net.UDPAddr, len(servers))
+	var transactions []stunTransaction
+	defer func() {
+		device.candidates.Lock()
+		for _, tx := range transactions {
+			delete(device.candidates.stun, tx)
+		}
+		device.candidates.Unlock()
+	}()
+
+	for _, server := range servers {
+		endpoints, err := ResolveEndpointCandidates(ctx, server)
+		if err != nil {
+			device.log.Debug.Println("Failed to resolve STUN server", server+":", err)
+			continue
+		}
+		request, tx, err := newSTUNRequest()
+		if err != nil {
+			continue
+		}
+		device.candidates.Lock()
+		if device.candidates.stun == nil {
+			device.candidates.stun = make(map[stunTransaction]chan *net.UDPAddr)
+		}
+		device.candidates.stun[tx] = responses
+		device.candidates.Unlock()
+		transactions = append(transactions, tx)
+		if err := device.sendTo(request, endpoints[0]); err != nil {
+			device.log.Debug.Println("Failed to send binding request to STUN server", server+":", err)
+		}
+	}
+
+	var addrs []*net.UDPAddr
+	for range transactions {
+		select {
+		case addr := <-responses:
+			addrs = append(addrs, addr)
+		case <-ctx.Done():
+			return addrs
+		}
+	}
+	return addrs
+}
+
+// receiveSTUN hands the mapped address of a binding response to the
+// request awaiting it.
+func (device *Device) receiveSTUN(packet []byte) {
+	tx, addr, ok := parseSTUNResponse(packet)
+	if !ok {
+		return
+	}
+	device.candidates.Lock()
+	responses := device.candidates.stun[tx]
+	delete(device.candidates.stun, tx)
+	device.candidates.Unlock()
+	if responses != nil {
+		responses <- addr
+	}
+}
+
+// sendTo sends buffer to endpoint through the bind of the device.
+func (device *Device) sendTo(buffer []byte, endpoint conn.Endpoint) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind == nil {
+		return ErrNoBind
+	}
+	err := device.unsafeSend(device.net.bind, buffer, endpoint)
+	if err != nil {
+		device.sendFailed(err)
+	}
+	return err
+}
+
+/* Exchange
+ */
+
+// OfferCandidates gathers the candidates of the device and sends them to
+// the peer with the public key through DeviceOptions.CandidateExchange.
+func (device *Device) OfferCandidates(ctx context.Context, pk NoisePublicKey) error {
+	if device.candidates.exchange == nil {
+		return fmt.Errorf("%w: no candidate exchange", ErrUnsupported)
+	}
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	gathered, err := device.GatherCandidates(ctx)
+	if err != nil {
+		return err
+	}
+	peer.probe.Lock()
+	peer.probe.offered = time.Now()
+	peer.probe.until = time.Now().Add(ProbeInterval * ProbeAttempts)
+	peer.probe.Unlock()
+	return device.candidates.exchange.SendCandidates(pk, gathered)
+}
+
+// ReceiveCandidates probes the candidates of the peer with the public
+// key, offering the candidates of the device in return unless they were
+// offered within the last ProbeAttempts rounds. The first candidate
+// answering becomes the endpoint of the peer.
+func (device *Device) ReceiveCandidates(pk NoisePublicKey, received []Candidate) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	var endpoints []conn.Endpoint
+	for _, candidate := range received {
+		endpoint, err := conn.CreateEndpoint(candidate.Endpoint)
+		if err != nil {
+			peer.log.Debug.Println(peer, "- Skipping invalid candidate", device.redactEndpoint(candidate.Endpoint)+":", err)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%w: no valid candidates", ErrInvalidValue)
+	}
+
+	now := time.Now()
+	peer.probe.Lock()
+	if peer.probe.stop != nil {
+		close(peer.probe.stop)
+	}
+	stop := make(chan struct{})
+	peer.probe.stop = stop
+	peer.probe.pending = make(map[[16]byte]conn.Endpoint)
+	peer.probe.selected = false
+	peer.probe.until = now.Add(ProbeInterval * ProbeAttempts)
+	offer := device.candidates.exchange != nil && now.Sub(peer.probe.offered) > ProbeInterval*ProbeAttempts
+	peer.probe.Unlock()
+
+	if offer {
+		go func() {
+			if err := device.OfferCandidates(context.Background(), pk); err != nil {
+				peer.log.Error.Println(peer, "- Failed to offer candidates:", err)
+			}
+		}()
+	}
+	go peer.RoutineProbeCandidates(endpoints, stop)
+	return nil
+}
+
+// stopProbing stops probing the candidates of peer, if it does.
+func (peer *Peer) stopProbing() {
+	peer.probe.Lock()
+	if peer.probe.stop != nil {
+		close(peer.probe.stop)
+		peer.probe.stop = nil
+	}
+	peer.probe.until = time.Time{}
+	peer.probe.Unlock()
+}
+
+/* Probing
+ */
+
+// probeMAC computes the MAC of a probe or answer of msgType carrying
+// nonce to receiver.
+func (peer *Peer) probeMAC(mac *[blake2s.Size128]byte, msgType uint32, nonce []byte, receiver NoisePublicKey) {
+	peer.handshake.mutex.RLock()
+	secret := peer.handshake.precomputedStaticStatic
+	peer.handshake.mutex.RUnlock()
+
+	var key [blake2s.Size]byte
+	KDF1(&key, secret[:], []byte(probeLabel))
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], msgType)
+	h, _ := blake2s.New128(key[:])
+	h.Write(header[:])
+	h.Write(nonce)
+	h.Write(receiver[:])
+	h.Sum(mac[:0])
+}
+
+// probeMessage returns a probe or answer of msgType carrying nonce to
+// receiver, after MaxObfuscationOverhead bytes of headroom.
+func (peer *Peer) probeMessage(msgType uint32, nonce []byte, receiver NoisePublicKey) []byte {
+	datagram := make([]byte, MaxObfuscationOverhead+MessageProbeSize)
+	message := datagram[MaxObfuscationOverhead:]
+	binary.LittleEndian.PutUint32(message[:4], msgType)
+	copy(message[4:20], nonce)
+	var mac [blake2s.Size128]byte
+	peer.probeMAC(&mac, msgType, nonce, receiver)
+	copy(message[20:], mac[:])
+	return datagram
+}
+
+// probing reports whether peer accepts probes and answers.
+func (peer *Peer) probing(now time.Time) bool {
+	peer.probe.Lock()
+	defer peer.probe.Unlock()
+	return now.Before(peer.probe.until)
+}
+
+func (peer *Peer) RoutineProbeCandidates(endpoints []conn.Endpoint, stop chan struct{}) {
+	device := peer.device
+	defer device.trackRoutine(routineProbeCandidates)()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for attempt := 0; attempt < ProbeAttempts; attempt++ {
+		select {
+		case <-stop:
+			return
+		case <-device.signals.stop:
+			return
+		case <-timer.C:
+		}
+		timer.Reset(ProbeInterval)
+
+		for _, endpoint := range endpoints {
+			var nonce [16]byte
+			if _, err := rand.Read(nonce[:]); err != nil {
+				return
+			}
+			peer.probe.Lock()
+			if peer.probe.selected || peer.probe.stop != stop {
+				peer.probe.Unlock()
+				return
+			}
+			peer.probe.pending[nonce] = endpoint
+			peer.probe.Unlock()
+			if err := peer.sendTo(peer.probeMessage(MessageProbeType, nonce[:], peer.handshake.remoteStatic), endpoint); err != nil {
+				peer.log.Debug.Println(peer, "- Failed to probe candidate", peer.device.redactEndpoint(endpoint.DstToString())+":", err)
+			}
+		}
+	}
+	peer.log.Info.Println(peer, "- No candidate answered probes")
+}
+
+// receiveProbe answers a probe or takes the endpoint an answer comes
+// from as the endpoint of the peer which sent it.
+func (device *Device) receiveProbe(packet []byte, endpoint conn.Endpoint) {
+	msgType := binary.LittleEndian.Uint32(packet[:4])
+	nonce := packet[4:20]
+	var key [16]byte
+	copy(key[:], nonce)
+	device.staticIdentity.RLock()
+	local := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	now := time.Now()
+	var probing []*Peer
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		if peer.probing(now) {
+			probing = append(probing, peer)
+		}
+	}
+	device.peers.RUnlock()
+
+	var mac [blake2s.Size128]byte
+	for _, peer := range probing {
+		if msgType == MessageProbeAnswerType {
+			peer.probe.Lock()
+			_, pending := peer.probe.pending[key]
+			peer.probe.Unlock()
+			if !pending {
+				continue
+			}
+		}
+		peer.probeMAC(&mac, msgType, nonce, local)
+		if !hmac.Equal(mac[:], packet[20:]) {
+			continue
+		}
+
+		if msgType == MessageProbeType {
+			peer.sendTo(peer.probeMessage(MessageProbeAnswerType, nonce, peer.handshake.remoteStatic), endpoint)
+			return
+		}
+
+		peer.probe.Lock()
+		selected := peer.probe.selected
+		peer.probe.selected = true
+		peer.probe.Unlock()
+		if !selected {
+			peer.clearEndpointHost()
+			peer.Lock()
+			peer.endpoint = endpoint
+			peer.Unlock()
+			peer.tagEndpoint(endpoint)
+			peer.log.Info.Println(peer, "- Candidate", device.redactEndpoint(endpoint.DstToString()), "answered probes")
+			device.emitEvent(Event{Kind: EventCandidateSelected, Peer: peer.handshake.remoteStatic, Endpoint: endpoint.DstToString()})
+			// both sides select at about the same time, so only one of
+			// them initiates a handshake, lest the initiations cross
+
+			if peer.isRunning.Get() && bytes.Compare(local[:], peer.handshake.remoteStatic[:]) < 0 {
+				peer.SendKeepalive()
+			}
+		}
+		return
+	}
+}
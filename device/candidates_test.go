@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseCandidate(t *testing.T) {
+	for _, candidate := range []Candidate{
+		{CandidateHost, "192.168.1.2:51820"},
+		{CandidateMapped, "203.0.113.7:40000"},
+		{CandidateReflexive, "[2001:db8::1]:51820"},
+	} {
+		parsed, err := ParseCandidate(candidate.String())
+		if err != nil || parsed != candidate {
+			t.Errorf("ParseCandidate(%q) = %v, %v", candidate.String(), parsed, err)
+		}
+	}
+	for _, s := range []string{"", "host", "relay 192.168.1.2:51820", "host example.com:51820", "host 192.168.1.2"} {
+		if _, err := ParseCandidate(s); err == nil {
+			t.Errorf("ParseCandidate(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSTUNResponse(t *testing.T) {
+	request, tx, err := newSTUNRequest()
+	assertNil(t, err)
+	if !isSTUNMessage(request) {
+		t.Fatal("binding request not taken for a STUN message")
+	}
+
+	// success response with an XOR-MAPPED-ADDRESS of 203.0.113.7:40000
+
+	response := make([]byte, stunHeaderSize+12)
+	binary.BigEndian.PutUint16(response[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(response[2:4], 12)
+	copy(response[4:20], request[4:20])
+	attribute := response[stunHeaderSize:]
+	binary.BigEndian.PutUint16(attribute[0:2], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(attribute[2:4], 8)
+	attribute[5] = stunFamilyIPv4
+	binary.BigEndian.PutUint16(attribute[6:8], 40000^uint16(stunMagicCookie>>16))
+	for i, b := range net.IPv4(203, 0, 113, 7).To4() {
+		attribute[8+i] = b ^ response[4+i]
+	}
+
+	gotTx, addr, ok := parseSTUNResponse(response)
+	if !ok || gotTx != tx || addr.String() != "203.0.113.7:40000" {
+		t.Errorf("parseSTUNResponse = %x, %v, %v", gotTx, addr, ok)
+	}
+	if _, _, ok := parseSTUNResponse(response[:stunHeaderSize+8]); ok {
+		t.Error("parsed a truncated response")
+	}
+}
+
+// candidateServer carries candidates between devices by their public
+// keys, adding the loopback endpoint of the listen port of the sender,
+// the only one the channel binds of the test reach.
+type candidateServer struct {
+	mutex   sync.Mutex
+	devices map[NoisePublicKey]*Device
+	ports   map[*Device]uint16
+}
+
+func (server *candidateServer) SendCandidates(peer NoisePublicKey, candidates []Candidate) error {
+	server.mutex.Lock()
+	device := server.devices[peer]
+	var port uint16
+	for sender, senderPort := range server.ports {
+		if sender != device {
+			port = senderPort
+		}
+	}
+	server.mutex.Unlock()
+	if device == nil {
+		return ErrPeerNotFound
+	}
+	var sender NoisePublicKey
+	for pk := range server.devices {
+		if pk != peer {
+			sender = pk
+		}
+	}
+	loopback := Candidate{Kind: CandidateHost, Endpoint: fmt.Sprintf("127.0.0.1:%d", port)}
+	return device.ReceiveCandidates(sender, append([]Candidate{loopback}, candidates...))
+}
+
+func TestCandidateProbing(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	server := &candidateServer{
+		devices: make(map[NoisePublicKey]*Device),
+		ports:   make(map[*Device]uint16),
+	}
+	selected := make(chan Event, 2)
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	for i := range devs {
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind:        binds[i].Open,
+			CandidateExchange: server,
+		})
+		defer devs[i].Close()
+		devs[i].SetEventHandler(func(event Event) {
+			if event.Kind == EventCandidateSelected {
+				selected <- event
+			}
+		})
+		server.devices[keys[i].publicKey()] = devs[i]
+		server.ports[devs[i]] = uint16(51820 + i)
+	}
+
+	// neither peer knows the endpoint of the other
+
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other])))
+		devs[i].Up()
+	}
+
+	assertNil(t, devs[0].OfferCandidates(context.Background(), keys[1].publicKey()))
+	for range devs {
+		select {
+		case event := <-selected:
+			if event.Endpoint == "" {
+				t.Error("selected an empty endpoint")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no candidate was selected")
+		}
+	}
+
+	// a ping may cross the handshake initiated upon selection, which
+	// then completes after RekeyTimeout
+
+	for i := range devs {
+		other := 1 - i
+		tuns[i].Outbound <- tuntest.Ping(addrs[other], addrs[i])
+		select {
+		case <-tuns[other].Inbound:
+		case <-time.After(RekeyTimeout * 2):
+			t.Fatalf("packet from device %d did not transit", i+1)
+		}
+	}
+}
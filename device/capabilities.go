@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* Versioning and capabilities of the UAPI
+ *
+ * The get operation, get=1, serializes the keys of the protocol of the
+ * reference implementation only, as its clients reject unknown keys.
+ * A client asking for a later version, get=2, is answered with the
+ * keys of the extensions too, starting with uapi_version=, the version
+ * both sides speak, followed by one capability= line per extension of
+ * the configuration protocol the device understands. A client relying on an extension sends
+ * require=<capability> at the start of a set operation, which then
+ * fails instead of silently ignoring keys the device lacks. Likewise
+ * uapi_version= fails the operation on a device implementing an
+ * older version of the protocol.
+ */
+
+// UAPIVersion is the version of the configuration protocol, version 1
+// being the protocol of the reference implementation.
+const UAPIVersion = 2
+
+var uapiCapabilities = []string{
+	"require",            // require= and uapi_version= in set
+	"update_only",        // peer key, only update an existing peer
+	"expire_sessions",    // peer key, expire the sessions of a peer
+	"allowed_ip_exclude", // peer key, remove addresses from the allowed IPs
+	"endpoint_host",      // peer key, race the addresses of a host name as endpoint
+	"allowed_source",     // peer keys, restrict the networks packets of a peer arrive from
+	"expires_at",         // peer key, remove a peer once its expiry passes
+	"ephemeral",          // peer key, remove a peer once it completed no handshake for a while
+	"thresholds",         // peer keys, emit events once statistics of a peer cross thresholds
+	"quota",              // peer keys, drop the traffic of a peer or disable it once it exceeds a data quota
+	"multi_login",        // peer key, policy for a key in use on several machines
+	"disabled",           // peer key, suspend a peer keeping its configuration
+	"responder_only",     // peer key, never initiate handshakes with a peer
+	"obfuscation",        // peer key, disguise the datagrams sent to a peer
+	"failover",           // peer keys, backup allowed IPs taken over while their primary peer is dead
+	"balance",            // peer keys, allowed IPs shared by peers the flows to them are balanced across
+	"relay",              // device key, forward packets between peers
+	"relay_rule",         // device keys, restrict and reflect the packets relayed between peers
+	"receive_allowlist",  // device keys, drop datagrams from unexpected sources before any processing
+	"mss_clamp",          // device key, clamp the MSS of TCP SYN segments to the MTU of peers
+}
+
+// Capabilities returns the UAPI extensions the device supports.
+func Capabilities() []string {
+	return append([]string(nil), uapiCapabilities...)
+}
+
+// negotiatedUAPIVersion returns the version of the protocol spoken with a
+// client asking for version.
+func negotiatedUAPIVersion(version int) int {
+	if version > UAPIVersion {
+		return UAPIVersion
+	}
+	return version
+}
+
+func hasCapability(name string) bool {
+	for _, capability := range uapiCapabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
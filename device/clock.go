@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Clocks
+ *
+ * The protocol timers of a device, the ages of its sessions and
+ * handshakes, its expiries and the times of its events follow its Clock,
+ * the system clock unless set by DeviceOptions.Clock. A simulation may
+ * substitute a virtual clock to run hours of the protocol in a moment.
+ * Housekeeping beside the protocol, such as tuning buffers, probing
+ * candidates or mapping ports, and the timestamps of handshake
+ * initiations, see DeviceOptions.HandshakeClock, follow the system clock
+ * regardless.
+ */
+
+// A Clock tells the time and runs timers, like the time package does.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A ClockTimer calls a function once it expires, see time.AfterFunc.
+type ClockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func (device *Device) now() time.Time {
+	return device.clock.Now()
+}
+
+func (device *Device) since(t time.Time) time.Duration {
+	return device.clock.Now().Sub(t)
+}
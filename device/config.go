@@ -0,0 +1,551 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Typed counterparts of the UAPI set and get operations
+ *
+ * Optional values are pointers, a nil pointer leaves
+ * the corresponding setting of the device untouched.
+ */
+
+type DeviceConfig struct {
+	PrivateKey        *NoisePrivateKey
+	ListenPort        *uint16
+	FirewallMark      *uint32
+	Relay             *bool // forward packets between peers, see Device.SetRelay
+	ReplaceRelayRules bool
+	RelayRules        []RelayRule // pairs of peers packets are relayed between, any if none
+	MSSClamp          *bool       // clamp the MSS of TCP SYN segments, see Device.SetMSSClamping
+	ReplacePeers      bool
+	Peers             []PeerConfig
+
+	ReplaceReceiveAllowlist bool
+	ReceiveAllowlist        []net.IPNet // networks datagrams are received from, see Device.SetReceiveAllowlist
+	ReceiveAllowlistLearn   *bool       // datagrams are also received from the endpoints of peers
+
+	// only populated by IpcGetConfig, ignored by IpcSetConfig
+
+	UAPIVersion  int
+	Capabilities []string
+	UpSince      time.Time // zero while the device is down
+}
+
+type PeerConfig struct {
+	PublicKey                   NoisePublicKey
+	Remove                      bool
+	UpdateOnly                  bool
+	ExpireSessions              bool
+	PresharedKey                *NoiseSymmetricKey
+	Endpoint                    *net.UDPAddr
+	EndpointHost                string         // host:port raced as endpoint, see ResolveEndpointCandidates
+	PersistentKeepaliveInterval *uint16        // seconds
+	ExpiresAt                   *time.Time     // zero time for none, see Peer.SetExpiry
+	Ephemeral                   *time.Duration // in seconds, zero for a permanent peer, see Peer.SetEphemeral
+	ThresholdNoHandshake        *time.Duration // in seconds, zero for none, see Peer.SetThresholds
+	ThresholdRxBytes            *uint64        // zero for none, see Peer.SetThresholds
+	ThresholdTxBytes            *uint64        // zero for none, see Peer.SetThresholds
+	QuotaTxBytes                *uint64        // zero for no limit, see Peer.SetQuota
+	QuotaRxBytes                *uint64        // zero for no limit, see Peer.SetQuota
+	QuotaPeriod                 *time.Duration // in seconds, zero for never, see Peer.SetQuota
+	QuotaAction                 *QuotaAction
+	MultiLoginPolicy            *MultiLoginPolicy
+	Disabled                    *bool   // see Peer.Disable
+	ResponderOnly               *bool   // see Peer.SetResponderOnly
+	Obfuscation                 *string // see Peer.SetObfuscation, empty for none
+	ReplaceAllowedIPs           bool
+	AllowedIPs                  []net.IPNet
+	ExcludedAllowedIPs          []net.IPNet // removed from the allowed IPs after adding AllowedIPs
+	ReplaceAllowedSources       bool
+	AllowedSources              []net.IPNet // networks packets of the peer may arrive from, anywhere if none
+	FailoverPriority            *uint16     // see Peer.SetFailoverPriority
+	ReplaceBackupAllowedIPs     bool
+	BackupAllowedIPs            []net.IPNet // networks the peer is a backup gateway for, see Peer.AddBackupAllowedIP
+	BalanceWeight               *uint16     // see Peer.SetBalanceWeight
+	ReplaceBalancedAllowedIPs   bool
+	BalancedAllowedIPs          []net.IPNet // networks whose flows are balanced across peers, see Peer.AddBalancedAllowedIP
+
+	// only populated by IpcGetConfig, ignored by IpcSetConfig
+
+	LastHandshakeTime time.Time
+	ConnectedSince    time.Time // zero without a session, see PeerStats.ConnectedSince
+	ProbedMTU         int       // zero if not probed, see Device.ProbePeerMTU
+	TxBytes           uint64
+	RxBytes           uint64
+}
+
+// IpcSetConfig applies config as a single UAPI set operation.
+func (device *Device) IpcSetConfig(config *DeviceConfig) error {
+	return device.IpcSet(config.UAPI())
+}
+
+// IpcGetConfig returns the current configuration of the device,
+// including the extensions of the protocol.
+func (device *Device) IpcGetConfig() (*DeviceConfig, error) {
+	uapiConf, err := device.ipcGetContext(context.Background(), UAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceConfig(uapiConf)
+}
+
+// AggregateAllowedIPs replaces the allowed IPs of every peer in config
+// by the shortest list of prefixes covering them, see AggregatePrefixes.
+func (config *DeviceConfig) AggregateAllowedIPs() {
+	for i := range config.Peers {
+		config.Peers[i].AllowedIPs = AggregatePrefixes(config.Peers[i].AllowedIPs)
+	}
+}
+
+// UAPI returns config as the lines of a UAPI set operation.
+func (config *DeviceConfig) UAPI() string {
+	var b strings.Builder
+	set := func(key, value string) {
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+
+	if config.PrivateKey != nil {
+		set("private_key", config.PrivateKey.ToHex())
+	}
+	if config.ListenPort != nil {
+		set("listen_port", strconv.FormatUint(uint64(*config.ListenPort), 10))
+	}
+	if config.FirewallMark != nil {
+		set("fwmark", strconv.FormatUint(uint64(*config.FirewallMark), 10))
+	}
+	if config.Relay != nil {
+		set("relay", strconv.FormatBool(*config.Relay))
+	}
+	if config.ReplacePeers {
+		set("replace_peers", "true")
+	}
+	if config.ReplaceRelayRules {
+		set("replace_relay_rules", "true")
+	}
+	for _, rule := range config.RelayRules {
+		set("relay_rule", rule.String())
+	}
+	if config.MSSClamp != nil {
+		set("mss_clamp", strconv.FormatBool(*config.MSSClamp))
+	}
+	if config.ReplaceReceiveAllowlist {
+		set("replace_receive_allowlist", "true")
+	}
+	for _, network := range config.ReceiveAllowlist {
+		set("receive_allowlist", network.String())
+	}
+	if config.ReceiveAllowlistLearn != nil {
+		set("receive_allowlist_learn", strconv.FormatBool(*config.ReceiveAllowlistLearn))
+	}
+
+	for _, peer := range config.Peers {
+		set("public_key", peer.PublicKey.ToHex())
+		if peer.Remove {
+			set("remove", "true")
+			continue
+		}
+		if peer.UpdateOnly {
+			set("update_only", "true")
+		}
+		if peer.ExpireSessions {
+			set("expire_sessions", "true")
+		}
+		if peer.PresharedKey != nil {
+			set("preshared_key", peer.PresharedKey.ToHex())
+		}
+		if peer.Endpoint != nil {
+			set("endpoint", peer.Endpoint.String())
+		}
+		if peer.EndpointHost != "" {
+			set("endpoint_host", peer.EndpointHost)
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			set("persistent_keepalive_interval", strconv.FormatUint(uint64(*peer.PersistentKeepaliveInterval), 10))
+		}
+		if peer.ExpiresAt != nil {
+			secs := int64(0)
+			if !peer.ExpiresAt.IsZero() {
+				secs = peer.ExpiresAt.Unix()
+			}
+			set("expires_at", strconv.FormatInt(secs, 10))
+		}
+		if peer.Ephemeral != nil {
+			set("ephemeral", strconv.FormatInt(int64(*peer.Ephemeral/time.Second), 10))
+		}
+		if peer.ThresholdNoHandshake != nil {
+			set("threshold_no_handshake", strconv.FormatInt(int64(*peer.ThresholdNoHandshake/time.Second), 10))
+		}
+		if peer.ThresholdRxBytes != nil {
+			set("threshold_rx_bytes", strconv.FormatUint(*peer.ThresholdRxBytes, 10))
+		}
+		if peer.ThresholdTxBytes != nil {
+			set("threshold_tx_bytes", strconv.FormatUint(*peer.ThresholdTxBytes, 10))
+		}
+		if peer.QuotaTxBytes != nil {
+			set("quota_tx_bytes", strconv.FormatUint(*peer.QuotaTxBytes, 10))
+		}
+		if peer.QuotaRxBytes != nil {
+			set("quota_rx_bytes", strconv.FormatUint(*peer.QuotaRxBytes, 10))
+		}
+		if peer.QuotaPeriod != nil {
+			set("quota_period", strconv.FormatInt(int64(*peer.QuotaPeriod/time.Second), 10))
+		}
+		if peer.QuotaAction != nil {
+			set("quota_action", peer.QuotaAction.String())
+		}
+		if peer.MultiLoginPolicy != nil {
+			set("multi_login", peer.MultiLoginPolicy.String())
+		}
+		if peer.Disabled != nil {
+			set("disabled", strconv.FormatBool(*peer.Disabled))
+		}
+		if peer.ResponderOnly != nil {
+			set("responder_only", strconv.FormatBool(*peer.ResponderOnly))
+		}
+		if peer.Obfuscation != nil {
+			if *peer.Obfuscation == "" {
+				set("obfuscation", "none")
+			} else {
+				set("obfuscation", *peer.Obfuscation)
+			}
+		}
+		if peer.ReplaceAllowedIPs {
+			set("replace_allowed_ips", "true")
+		}
+		for _, ip := range peer.AllowedIPs {
+			set("allowed_ip", ip.String())
+		}
+		for _, ip := range peer.ExcludedAllowedIPs {
+			set("allowed_ip_exclude", ip.String())
+		}
+		if peer.ReplaceAllowedSources {
+			set("replace_allowed_sources", "true")
+		}
+		for _, network := range peer.AllowedSources {
+			set("allowed_source", network.String())
+		}
+		if peer.FailoverPriority != nil {
+			set("failover_priority", strconv.FormatUint(uint64(*peer.FailoverPriority), 10))
+		}
+		if peer.ReplaceBackupAllowedIPs {
+			set("replace_backup_allowed_ips", "true")
+		}
+		for _, network := range peer.BackupAllowedIPs {
+			set("backup_allowed_ip", network.String())
+		}
+		if peer.BalanceWeight != nil {
+			set("balance_weight", strconv.FormatUint(uint64(*peer.BalanceWeight), 10))
+		}
+		if peer.ReplaceBalancedAllowedIPs {
+			set("replace_balanced_allowed_ips", "true")
+		}
+		for _, network := range peer.BalancedAllowedIPs {
+			set("balanced_allowed_ip", network.String())
+		}
+	}
+
+	return b.String()
+}
+
+func parseDeviceConfig(uapiConf string) (*DeviceConfig, error) {
+	config := &DeviceConfig{}
+	var peer *PeerConfig
+	var handshakeSec, handshakeNsec int64
+
+	finishPeer := func() {
+		if peer == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			peer.LastHandshakeTime = time.Unix(handshakeSec, handshakeNsec)
+		}
+		config.Peers = append(config.Peers, *peer)
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	for i, line := range strings.Split(uapiConf, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: %w", i+1, ErrMalformedLine)
+		}
+		key, value := parts[0], parts[1]
+
+		err := func() error {
+			if peer == nil {
+				switch key {
+				case "uapi_version":
+					version, err := strconv.Atoi(value)
+					config.UAPIVersion = version
+					return err
+				case "capability":
+					config.Capabilities = append(config.Capabilities, value)
+					return nil
+				case "private_key":
+					var sk NoisePrivateKey
+					if err := sk.FromMaybeZeroHex(value); err != nil {
+						return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+					}
+					config.PrivateKey = &sk
+					return nil
+				case "listen_port":
+					port, err := strconv.ParseUint(value, 10, 16)
+					if err != nil {
+						return err
+					}
+					listenPort := uint16(port)
+					config.ListenPort = &listenPort
+					return nil
+				case "fwmark":
+					mark, err := strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						return err
+					}
+					fwmark := uint32(mark)
+					config.FirewallMark = &fwmark
+					return nil
+				case "relay":
+					relay, err := strconv.ParseBool(value)
+					config.Relay = &relay
+					return err
+				case "relay_rule":
+					rule, err := ParseRelayRule(value)
+					config.RelayRules = append(config.RelayRules, rule)
+					return err
+				case "mss_clamp":
+					clamp, err := strconv.ParseBool(value)
+					config.MSSClamp = &clamp
+					return err
+				case "receive_allowlist":
+					_, network, err := net.ParseCIDR(value)
+					if err != nil {
+						return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+					}
+					config.ReceiveAllowlist = append(config.ReceiveAllowlist, *network)
+					return nil
+				case "receive_allowlist_learn":
+					learn, err := strconv.ParseBool(value)
+					config.ReceiveAllowlistLearn = &learn
+					return err
+				case "up_since_sec":
+					secs, err := strconv.ParseInt(value, 10, 64)
+					config.UpSince = time.Unix(secs, 0)
+					return err
+				}
+			}
+
+			switch key {
+			case "public_key":
+				finishPeer()
+				peer = &PeerConfig{}
+				if err := peer.PublicKey.FromHex(value); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+				}
+				return nil
+			}
+
+			if peer == nil {
+				return ErrUnknownConfigKey
+			}
+
+			switch key {
+			case "preshared_key":
+				var psk NoiseSymmetricKey
+				if err := psk.FromHex(value); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+				}
+				peer.PresharedKey = &psk
+			case "protocol_version":
+				if value != "1" {
+					return fmt.Errorf("%w: %q", ErrInvalidValue, value)
+				}
+			case "endpoint":
+				endpoint, err := net.ResolveUDPAddr("udp", value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+				}
+				peer.Endpoint = endpoint
+			case "endpoint_host":
+				peer.EndpointHost = value
+			case "last_handshake_time_sec":
+				sec, err := strconv.ParseInt(value, 10, 64)
+				handshakeSec = sec
+				return err
+			case "last_handshake_time_nsec":
+				nsec, err := strconv.ParseInt(value, 10, 64)
+				handshakeNsec = nsec
+				return err
+			case "connected_since_sec":
+				secs, err := strconv.ParseInt(value, 10, 64)
+				peer.ConnectedSince = time.Unix(secs, 0)
+				return err
+			case "probed_mtu":
+				mtu, err := strconv.Atoi(value)
+				peer.ProbedMTU = mtu
+				return err
+			case "tx_bytes":
+				bytes, err := strconv.ParseUint(value, 10, 64)
+				peer.TxBytes = bytes
+				return err
+			case "rx_bytes":
+				bytes, err := strconv.ParseUint(value, 10, 64)
+				peer.RxBytes = bytes
+				return err
+			case "persistent_keepalive_interval":
+				secs, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return err
+				}
+				interval := uint16(secs)
+				peer.PersistentKeepaliveInterval = &interval
+			case "allowed_ip":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+				}
+				peer.AllowedIPs = append(peer.AllowedIPs, *network)
+			case "allowed_ip_exclude":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+				}
+				peer.ExcludedAllowedIPs = append(peer.ExcludedAllowedIPs, *network)
+			case "expires_at":
+				secs, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return err
+				}
+				expiry := time.Unix(secs, 0)
+				peer.ExpiresAt = &expiry
+			case "ephemeral":
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return err
+				}
+				timeout := time.Duration(secs) * time.Second
+				peer.Ephemeral = &timeout
+			case "threshold_no_handshake":
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return err
+				}
+				limit := time.Duration(secs) * time.Second
+				peer.ThresholdNoHandshake = &limit
+			case "threshold_rx_bytes", "threshold_tx_bytes":
+				limit, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return err
+				}
+				if key == "threshold_rx_bytes" {
+					peer.ThresholdRxBytes = &limit
+				} else {
+					peer.ThresholdTxBytes = &limit
+				}
+			case "quota_tx_bytes", "quota_rx_bytes":
+				limit, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return err
+				}
+				if key == "quota_tx_bytes" {
+					peer.QuotaTxBytes = &limit
+				} else {
+					peer.QuotaRxBytes = &limit
+				}
+			case "quota_period":
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return err
+				}
+				period := time.Duration(secs) * time.Second
+				peer.QuotaPeriod = &period
+			case "quota_action":
+				action, err := ParseQuotaAction(value)
+				if err != nil {
+					return err
+				}
+				peer.QuotaAction = &action
+			case "multi_login":
+				policy, err := ParseMultiLoginPolicy(value)
+				if err != nil {
+					return err
+				}
+				peer.MultiLoginPolicy = &policy
+			case "disabled":
+				disabled, err := strconv.ParseBool(value)
+				if err != nil {
+					return err
+				}
+				peer.Disabled = &disabled
+			case "responder_only":
+				responderOnly, err := strconv.ParseBool(value)
+				if err != nil {
+					return err
+				}
+				peer.ResponderOnly = &responderOnly
+			case "obfuscation":
+				name := value
+				if name == "none" {
+					name = ""
+				}
+				peer.Obfuscation = &name
+			case "allowed_source":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+				}
+				peer.AllowedSources = append(peer.AllowedSources, *network)
+			case "failover_priority":
+				value, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return err
+				}
+				priority := uint16(value)
+				peer.FailoverPriority = &priority
+			case "backup_allowed_ip":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+				}
+				peer.BackupAllowedIPs = append(peer.BackupAllowedIPs, *network)
+			case "balance_weight":
+				value, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return err
+				}
+				weight := uint16(value)
+				peer.BalanceWeight = &weight
+			case "balanced_allowed_ip":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+				}
+				peer.BalancedAllowedIPs = append(peer.BalancedAllowedIPs, *network)
+			default:
+				return ErrUnknownConfigKey
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", i+1, key, err)
+		}
+	}
+	finishPeer()
+
+	return config, nil
+}
@@ -30,12 +30,57 @@ const (
 	MinMessageSize = MessageKeepaliveSize                  // minimum size of transport message (keepalive)
 	MaxMessageSize = MaxSegmentSize                        // maximum size of transport message
 	MaxContentSize = MaxSegmentSize - MessageTransportSize // maximum size of transport message content
+
+	maxSentContentSize = (MaxContentSize - MaxObfuscationOverhead) &^ (PaddingMultiple - 1) // maximum size of content sent, padded, after the headroom
 )
 
 /* Implementation constants */
 
 const (
-	UnderLoadQueueSize = QueueHandshakeSize / 8
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadQueueDivisor = 8                      // the device is under load once 1/8 of the handshake queue is filled
+	UnderLoadAfterTime    = time.Second            // how long does the device remain under load after detected
+	MaxPeers              = 1 << 16                // maximum number of configured peers
+	IndexTableSize        = MaxPeers * 4           // default capacity of the index table, a handshake and three sessions per peer
+	IndexTableShards      = 64                     // independently locked parts of the index table
+	DropMonitorSize       = 128                    // dropped packets recorded by the drop monitor
+	DropSnippetSize       = 64                     // bytes of the header recorded per dropped packet
+	MalformedWindow       = time.Minute            // period over which the malformed packets of a source are counted
+	MalformedThreshold    = 10                     // malformed packets within MalformedWindow reported with EventMalformedPackets
+	MaxMalformedSources   = 1024                   // source addresses malformed packets are counted for
+	QueueEventSize        = 256                    // maximum number of undelivered events
+	PeerDrainTimeout      = time.Second * 5        // how long a removed peer may take to send its queued packets
+	RebindAfterSendErrors = 32                     // consecutive send errors after which the bind is reopened
+	RebindBackoffMin      = time.Millisecond * 100 // delay before the first attempt to reopen a failed bind
+	RebindBackoffMax      = time.Second * 30       // maximum delay between attempts to reopen a failed bind
+	MinReceiveBufferSize  = 1 << 20                // receive buffer size set by the first autotuning step
+	MaxReceiveBufferSize  = 32 << 20               // receive buffer size autotuning does not go beyond
+	ReceiveBufferTuneTime = time.Second            // how often autotuning checks for receive drops
+	SendBatchSize         = 64                     // maximum number of packets for a peer sent at once
+	MaxFlowPorts          = 64                     // maximum number of additional source ports for inner flows
+	NAT64DiscoveryTimeout = time.Second * 5        // how long to wait for DNS64 to answer
+	EncryptionQuantum     = 8                      // packets of a peer encrypted per turn
+	StatsSampleInterval   = time.Second * 10       // granularity of the throughput history of peers
+	ThresholdInterval     = time.Second            // how often the thresholds of peers are checked
+	StrictRekeyAfterTime  = time.Second * 60       // RekeyAfterTime of the strict security profile
+	StrictRejectAfterTime = time.Second * 90       // RejectAfterTime of the strict security profile
+	MaxStatsHistory       = time.Hour * 24         // longest throughput history kept
+	DiscoveryPort         = 51821                  // UDP port of LAN announcements, see DiscoveryGroup
+	DiscoveryInterval     = time.Second * 10       // how often the device announces itself on the LAN
+	DiscoveryExpiry       = DiscoveryInterval * 3  // how long a candidate peer is kept after its last announcement
+	MaxDiscoveredPeers    = 256                    // maximum number of candidate peers kept
+	PortMapTimeout        = time.Second * 10       // how long to try mapping the listen port at once
+	PortMapRetryInterval  = time.Minute * 5        // delay before mapping the listen port again after failing
+	PortUnmapTimeout      = time.Second * 2        // how long closing the device waits for the mapping to be removed
+	EndpointRaceDelay     = time.Millisecond * 250 // delay between handshake initiations to successive endpoint candidates
+	EndpointRaceInterval  = time.Minute * 5        // how long the endpoint which won a race is kept before racing again
+	ResolveTimeout        = time.Second * 5        // how long to wait for an endpoint host to resolve
+	HandshakeRateWindow   = time.Minute * 5        // period over which the handshakes of a peer are counted
+	AnomalousHandshakes   = 12                     // handshakes within HandshakeRateWindow flagging a peer as anomalous
+	MultiLoginWindow      = time.Second * 10       // period within which session switches along with endpoints are counted
+	MultiLoginSwitches    = 3                      // switches within MultiLoginWindow taken as the key being used on several machines
+	MultiLoginBlockTime   = time.Minute * 2        // how long handshakes are refused after rejecting a multi-login
+	ProbeInterval         = time.Millisecond * 200 // delay between rounds of probes to the endpoint candidates of a peer
+	ProbeAttempts         = 25                     // rounds of probes before giving up on the candidates of a peer
+	STUNTimeout           = time.Second * 3        // how long to wait for STUN servers to answer binding requests
+	MaxAuditRecords       = 256                    // audit records of configuration changes kept, see AuditLog
 )
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+/* In-tunnel control channel
+ *
+ * Cooperating devices exchange metadata, such as their MTU, endpoint
+ * candidates or stats, as control messages inside the tunnel, where
+ * they are encrypted and authenticated like any other transport
+ * packet. The content of a control message starts with a version nibble
+ * no IP packet has, so that it never reaches the TUN device, and
+ * implementations unaware of the channel drop it as a packet of an
+ * unknown IP version:
+ *
+ *   version 0xc, reserved 0x0 (1 byte)
+ *   type (1 byte), see ControlType
+ *   payload length (2 bytes, big endian)
+ *   payload
+ *
+ * Control messages are staged with high priority, and wait for a
+ * session like other packets. The device answers MTU probes itself,
+ * see ProbePeerMTU, and delivers the other messages in order to the
+ * handler set by SetControlHandler, dropping them without one.
+ */
+
+const (
+	controlVersion    = 0xc
+	controlHeaderSize = 4
+
+	MaxControlPayloadSize = maxSentContentSize - controlHeaderSize
+)
+
+// ControlType tells what a control message carries. Except for the
+// MTU probes, which the device handles itself, the encodings of the
+// types below are conventions for cooperating devices.
+type ControlType uint8
+
+const (
+	ControlMTU         ControlType = iota + 1 // MTU of the TUN device of the sender, 2 bytes big endian
+	ControlCandidates                         // endpoint candidates of the sender, one per line, see ParseCandidate
+	ControlStats                              // stats of the sender, key=value lines like the UAPI
+	ControlMTUProbe                           // probe identifier, 4 bytes big endian, padded to the size probed
+	ControlMTUProbeAck                        // identifier of the probe acknowledged
+	ControlApplication ControlType = 0x80     // first of the types left to applications
+)
+
+func (t ControlType) String() string {
+	switch t {
+	case ControlMTU:
+		return "mtu"
+	case ControlCandidates:
+		return "candidates"
+	case ControlStats:
+		return "stats"
+	case ControlMTUProbe:
+		return "mtu-probe"
+	case ControlMTUProbeAck:
+		return "mtu-probe-ack"
+	default:
+		if t >= ControlApplication {
+			return fmt.Sprintf("application-%d", int(t-ControlApplication))
+		}
+		return fmt.Sprintf("ControlType(UNKNOWN:%d)", int(t))
+	}
+}
+
+// A ControlMessage is a control message received from a peer.
+type ControlMessage struct {
+	Peer    NoisePublicKey
+	Type    ControlType
+	Payload []byte
+}
+
+// ControlHandler is called with every control message received. It is
+// called on the receive path of the peer, in the order the messages
+// were sent, and must hand any lengthy work off to another goroutine.
+type ControlHandler func(message ControlMessage)
+
+// SetControlHandler sets the handler of the control messages received,
+// nil to drop them, the default.
+func (device *Device) SetControlHandler(handler ControlHandler) {
+	device.controlHandler.Store(handler)
+}
+
+// SendControl sends a control message to the peer with public key pk,
+// initiating a handshake if there is no session.
+func (device *Device) SendControl(pk NoisePublicKey, t ControlType, payload []byte) error {
+	if len(payload) > MaxControlPayloadSize {
+		return fmt.Errorf("%w: control payload of %d bytes exceeds %d", ErrInvalidValue, len(payload), MaxControlPayloadSize)
+	}
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+
+	elem := device.NewOutboundElement()
+	offset := MaxObfuscationOverhead + MessageTransportHeaderSize
+	elem.packet = elem.buffer[offset : offset+controlHeaderSize+len(payload)]
+	elem.packet[0] = controlVersion << 4
+	elem.packet[1] = byte(t)
+	binary.BigEndian.PutUint16(elem.packet[2:], uint16(len(payload)))
+	copy(elem.packet[controlHeaderSize:], payload)
+	elem.high = true
+
+	peer.queue.RLock()
+	defer peer.queue.RUnlock()
+	if !peer.isRunning.Get() {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return fmt.Errorf("%w: peer not running", ErrNotReady)
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	peer.addToNonceQueue(elem)
+	atomic.AddUint64(&peer.stats.controlSent, 1)
+	return nil
+}
+
+// receiveControl hands the control message in packet, received from
+// peer, to the control handler.
+func (peer *Peer) receiveControl(packet []byte) {
+	device := peer.device
+	if len(packet) < controlHeaderSize || packet[0] != controlVersion<<4 {
+		peer.log.Debug.Println(peer, "- Received malformed control message")
+		return
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	if length > len(packet)-controlHeaderSize {
+		peer.log.Debug.Println(peer, "- Received truncated control message")
+		return
+	}
+	atomic.AddUint64(&peer.stats.controlReceived, 1)
+
+	payload := packet[controlHeaderSize : controlHeaderSize+length]
+	switch ControlType(packet[1]) {
+	case ControlMTUProbe:
+		peer.receiveMTUProbe(payload)
+		return
+	case ControlMTUProbeAck:
+		peer.receiveMTUProbeAck(payload)
+		return
+	}
+
+	handler, _ := device.controlHandler.Load().(ControlHandler)
+	if handler == nil {
+		return
+	}
+	handler(ControlMessage{
+		Peer:    peer.handshake.remoteStatic,
+		Type:    ControlType(packet[1]),
+		Payload: append([]byte(nil), payload...),
+	})
+}
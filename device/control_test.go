@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestControlMessages(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	received := make(chan ControlMessage, 2)
+	pair[1].dev.SetControlHandler(func(message ControlMessage) {
+		received <- message
+	})
+
+	pk := pair[1].key.publicKey()
+	assertNil(t, pair[0].dev.SendControl(pk, ControlMTU, []byte{0x05, 0xa0}))
+	assertNil(t, pair[0].dev.SendControl(pk, ControlApplication+1, []byte("hello")))
+	for _, want := range []ControlMessage{
+		{pair[0].key.publicKey(), ControlMTU, []byte{0x05, 0xa0}},
+		{pair[0].key.publicKey(), ControlApplication + 1, []byte("hello")},
+	} {
+		select {
+		case got := <-received:
+			if got.Peer != want.Peer || got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("received %s message %q, want %s message %q", got.Type, got.Payload, want.Type, want.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s message not received", want.Type)
+		}
+	}
+	select {
+	case packet := <-pair[1].tun.Inbound:
+		t.Errorf("control message written to the TUN device: %x", packet)
+	default:
+	}
+	if stats := pair[1].dev.LookupPeer(pair[0].key.publicKey()).Stats(); stats.ControlReceived != 2 {
+		t.Errorf("%d control messages received, want 2", stats.ControlReceived)
+	}
+
+	if err := pair[0].dev.SendControl(pk, ControlStats, make([]byte, MaxControlPayloadSize+1)); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("oversized payload: expected ErrInvalidValue, got %v", err)
+	}
+	var unknown NoisePublicKey
+	if err := pair[0].dev.SendControl(unknown, ControlStats, nil); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Data-plane-only mode, see DeviceOptions.DataPlaneOnly
+ *
+ * The device performs no Noise handshakes: handshake messages received
+ * are dropped, and the session keys of peers are computed by a control
+ * plane of the application and installed with InstallSessionKeys. Where
+ * the device would initiate a handshake, as a session ages or packets
+ * wait for one, it emits EventSessionKeysNeeded instead, no more often
+ * than every RekeyTimeout for a peer. Sessions are subject to the usual
+ * limits, so that the control plane must install new keys before
+ * RejectAfterTime passes or RejectAfterMessages are sent with a session.
+ */
+
+// SessionKeys are the keys of a session with a peer, as derived by a
+// handshake.
+type SessionKeys struct {
+	Send        NoiseSymmetricKey // encrypts the packets sent to the peer
+	Receive     NoiseSymmetricKey // decrypts the packets received from the peer
+	LocalIndex  uint32            // receiver index the peer sends with, chosen at random if zero
+	RemoteIndex uint32            // receiver index of the peer, sent with every packet
+}
+
+// DataPlaneOnly reports whether the device takes session keys from
+// InstallSessionKeys instead of performing handshakes.
+func (device *Device) DataPlaneOnly() bool {
+	return device.dataPlaneOnly
+}
+
+// InstallSessionKeys makes keys the current session with the peer with
+// public key pk, keeping the session it replaces for the packets still
+// on their way, and returns the local index of the session. It fails
+// with ErrUnsupported unless the device is data-plane-only.
+func (device *Device) InstallSessionKeys(pk NoisePublicKey, keys SessionKeys) (uint32, error) {
+	if !device.dataPlaneOnly {
+		return 0, ErrUnsupported
+	}
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return 0, ErrPeerNotFound
+	}
+
+	keypair := new(Keypair)
+	keypair.send, _ = chacha20poly1305.New(keys.Send[:])
+	keypair.receive, _ = chacha20poly1305.New(keys.Receive[:])
+	keypair.created = device.now()
+	keypair.replayFilter.Reset()
+	keypair.isInitiator = true
+	keypair.remoteIndex = keys.RemoteIndex
+
+	entry := IndexTableEntry{peer: peer, keypair: keypair}
+	if keys.LocalIndex == 0 {
+		for {
+			index, err := randUint32()
+			if err != nil {
+				return 0, err
+			}
+			if index == 0 {
+				continue
+			}
+			err = device.indexTable.insert(index, entry)
+			if err == nil {
+				keypair.localIndex = index
+				break
+			}
+			if err != errIndexInUse {
+				return 0, err
+			}
+		}
+	} else if err := device.indexTable.insert(keys.LocalIndex, entry); err == nil {
+		keypair.localIndex = keys.LocalIndex
+	} else if err == errIndexInUse {
+		return 0, fmt.Errorf("%w: local index %d in use", ErrInvalidValue, keys.LocalIndex)
+	} else {
+		return 0, err
+	}
+
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	device.DeleteKeypair(keypairs.previous)
+	if next := keypairs.loadNext(); next != nil {
+		keypairs.storeNext(nil)
+		device.DeleteKeypair(next)
+	}
+	keypairs.previous = keypairs.current
+	keypairs.current = keypair
+	keypairs.Unlock()
+
+	peer.log.Debug.Println(peer, "- Installed session keys with local index", keypair.localIndex)
+
+	peer.timersSessionDerived()
+	peer.timersHandshakeComplete()
+	peer.signalNewKeypair()
+	return keypair.localIndex, nil
+}
+
+// RemoveSessionKeys removes the session with local index localIndex
+// from the peer with public key pk.
+func (device *Device) RemoveSessionKeys(pk NoisePublicKey, localIndex uint32) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	defer keypairs.Unlock()
+
+	switch {
+	case keypairs.current != nil && keypairs.current.localIndex == localIndex:
+		device.DeleteKeypair(keypairs.current)
+		keypairs.current = nil
+	case keypairs.previous != nil && keypairs.previous.localIndex == localIndex:
+		device.DeleteKeypair(keypairs.previous)
+		keypairs.previous = nil
+	default:
+		next := keypairs.loadNext()
+		if next == nil || next.localIndex != localIndex {
+			return fmt.Errorf("%w: no session with local index %d", ErrInvalidValue, localIndex)
+		}
+		keypairs.storeNext(nil)
+		device.DeleteKeypair(next)
+	}
+	return nil
+}
+
+// requestSessionKeys asks the control plane for new session keys with
+// peer in place of initiating a handshake.
+func (peer *Peer) requestSessionKeys() {
+	peer.log.Debug.Println(peer, "- Requesting session keys")
+	peer.device.emitEvent(Event{Kind: EventSessionKeysNeeded, Peer: peer.handshake.remoteStatic})
+}
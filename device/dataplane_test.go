@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestDataPlaneOnly(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	events := make(chan Event, 10)
+	for i := range devs {
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind:    binds[i].Open,
+			DataPlaneOnly: true,
+		})
+		defer devs[i].Close()
+	}
+	devs[0].SetEventHandler(func(event Event) {
+		if event.Kind == EventSessionKeysNeeded {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+	})
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other], 51820+other)))
+		devs[i].Up()
+	}
+	pks := [2]NoisePublicKey{keys[0].publicKey(), keys[1].publicKey()}
+
+	// packets wait for keys the control plane is asked for
+
+	tuns[0].Outbound <- tuntest.Ping(addrs[1], addrs[0])
+	select {
+	case event := <-events:
+		if event.Peer != pks[1] {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session keys requested")
+	}
+	if devs[1].LookupPeer(pks[0]).keypairs.Current() != nil {
+		t.Error("session begun without installed keys")
+	}
+
+	var a, b NoiseSymmetricKey
+	a[0], b[0] = 1, 2
+	index, err := devs[1].InstallSessionKeys(pks[0], SessionKeys{Send: b, Receive: a, LocalIndex: 7, RemoteIndex: 9})
+	assertNil(t, err)
+	if index != 7 {
+		t.Errorf("local index %d, want 7", index)
+	}
+	index, err = devs[0].InstallSessionKeys(pks[1], SessionKeys{Send: a, Receive: b, RemoteIndex: 7})
+	assertNil(t, err)
+	if _, err := devs[1].InstallSessionKeys(pks[0], SessionKeys{LocalIndex: 7}); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("installing keys with index in use: %v", err)
+	}
+
+	select {
+	case <-tuns[1].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("staged packet not delivered with installed keys")
+	}
+
+	// the responder sends with the index the initiator chose
+
+	devs[1].RemoveSessionKeys(pks[0], 7)
+	_, err = devs[1].InstallSessionKeys(pks[0], SessionKeys{Send: b, Receive: a, LocalIndex: 9, RemoteIndex: index})
+	assertNil(t, err)
+	tuns[1].Outbound <- tuntest.Ping(addrs[0], addrs[1])
+	select {
+	case <-tuns[0].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not delivered with reinstalled keys")
+	}
+
+	if err := devs[0].RemoveSessionKeys(pks[1], index+1); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("removing unknown session: %v", err)
+	}
+	assertNil(t, devs[0].RemoveSessionKeys(pks[1], index))
+	if devs[0].LookupPeer(pks[1]).keypairs.Current() != nil {
+		t.Error("session left after removal")
+	}
+
+	regular := randDevice(t)
+	defer regular.Close()
+	if _, err := regular.InstallSessionKeys(pks[0], SessionKeys{}); err != ErrUnsupported {
+		t.Errorf("installing keys on a regular device: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Data quotas of peers, for guest networks and billing
+ *
+ * A peer with a quota may send and receive so many bytes, counted like
+ * tx_bytes and rx_bytes from when the quota is set. Once it exceeds
+ * either, EventQuotaExceeded is emitted and, depending on the action of
+ * the quota, the data packets to and from the peer are dropped, or the
+ * peer is disabled, see Peer.Disable. The bytes counted are reset every
+ * period of the quota, or by ResetQuota, lifting the consequences and
+ * emitting EventQuotaReset if the quota was exceeded. While the peer
+ * has no quota, counting costs a pair of atomic loads per packet.
+ */
+
+type QuotaAction int
+
+const (
+	QuotaDrop    = QuotaAction(iota) // drop the data packets to and from the peer
+	QuotaDisable                     // disable the peer, see Peer.Disable
+)
+
+func (action QuotaAction) String() string {
+	switch action {
+	case QuotaDrop:
+		return "drop"
+	case QuotaDisable:
+		return "disable"
+	default:
+		return fmt.Sprintf("QuotaAction(UNKNOWN:%d)", int(action))
+	}
+}
+
+// ParseQuotaAction parses the UAPI name of a quota action.
+func ParseQuotaAction(s string) (QuotaAction, error) {
+	switch s {
+	case "drop":
+		return QuotaDrop, nil
+	case "disable":
+		return QuotaDisable, nil
+	default:
+		return QuotaDrop, fmt.Errorf("%w: quota action %q", ErrInvalidValue, s)
+	}
+}
+
+// DataQuota limits the bytes a peer sends and receives.
+type DataQuota struct {
+	TxBytes uint64        // most bytes sent to the peer, zero for no limit
+	RxBytes uint64        // most bytes received from the peer, zero for no limit
+	Period  time.Duration // how often the bytes counted are reset, zero for never
+	Action  QuotaAction   // what happens once the quota is exceeded
+}
+
+type peerQuota struct {
+	sync.Mutex
+	quota          DataQuota
+	exceeded       AtomicBool // read without taking the lock
+	disabledByThis bool       // the peer was disabled as it exceeded the quota
+	timer          ClockTimer // resets the bytes counted every period
+}
+
+// SetQuota replaces the quota of peer, keeping the bytes counted so far
+// and the consequences of exceeding the quota if it still is. The zero
+// quota removes it.
+func (peer *Peer) SetQuota(quota DataQuota) {
+	peer.quota.Lock()
+	if peer.quota.timer != nil && peer.quota.quota.Period != quota.Period {
+		peer.quota.timer.Stop()
+		peer.quota.timer = nil
+	}
+	peer.quota.quota = quota
+	atomic.StoreUint64(&peer.stats.quotaTxLimit, quota.TxBytes)
+	atomic.StoreUint64(&peer.stats.quotaRxLimit, quota.RxBytes)
+	if quota == (DataQuota{}) {
+		atomic.StoreUint64(&peer.stats.quotaTxBytes, 0)
+		atomic.StoreUint64(&peer.stats.quotaRxBytes, 0)
+	}
+	if quota.Period > 0 && peer.quota.timer == nil {
+		peer.quota.timer = peer.device.clock.AfterFunc(quota.Period, func() {
+			peer.device.renewQuota(peer)
+		})
+	}
+	_, over := peer.unsafeOverQuota()
+	peer.quota.Unlock()
+
+	if over {
+		peer.device.exceedQuota(peer)
+	} else {
+		peer.device.liftQuota(peer)
+	}
+}
+
+// Quota returns the quota of peer.
+func (peer *Peer) Quota() DataQuota {
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+	return peer.quota.quota
+}
+
+// QuotaExceeded reports whether peer exceeded its quota.
+func (peer *Peer) QuotaExceeded() bool {
+	return peer.quota.exceeded.Get()
+}
+
+// ResetQuota resets the bytes counted against the quota of peer.
+func (peer *Peer) ResetQuota() {
+	atomic.StoreUint64(&peer.stats.quotaTxBytes, 0)
+	atomic.StoreUint64(&peer.stats.quotaRxBytes, 0)
+	peer.device.liftQuota(peer)
+}
+
+func (peer *Peer) stopQuota() {
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+	if peer.quota.timer != nil {
+		peer.quota.timer.Stop()
+		peer.quota.timer = nil
+	}
+}
+
+// SetPeerQuota sets the quota of the peer with public key pk, see
+// Peer.SetQuota.
+func (device *Device) SetPeerQuota(pk NoisePublicKey, quota DataQuota) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetQuota(quota)
+	return nil
+}
+
+// ResetPeerQuota resets the bytes counted against the quota of the peer
+// with public key pk, see Peer.ResetQuota.
+func (device *Device) ResetPeerQuota(pk NoisePublicKey) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.ResetQuota()
+	return nil
+}
+
+// accountQuota counts tx bytes sent and rx bytes received against the
+// quota of peer.
+func (peer *Peer) accountQuota(tx, rx uint64) {
+	txLimit := atomic.LoadUint64(&peer.stats.quotaTxLimit)
+	rxLimit := atomic.LoadUint64(&peer.stats.quotaRxLimit)
+	if txLimit == 0 && rxLimit == 0 {
+		return
+	}
+	txUsed := atomic.AddUint64(&peer.stats.quotaTxBytes, tx)
+	rxUsed := atomic.AddUint64(&peer.stats.quotaRxBytes, rx)
+	if (txLimit != 0 && txUsed > txLimit || rxLimit != 0 && rxUsed > rxLimit) && !peer.quota.exceeded.Get() {
+		// disabling the peer waits for its routines, this one among them
+		go peer.device.exceedQuota(peer)
+	}
+}
+
+// unsafeOverQuota returns which limit of its quota peer exceeds, if any.
+// The quota lock must be held.
+func (peer *Peer) unsafeOverQuota() (ThresholdKind, bool) {
+	quota := peer.quota.quota
+	if quota.TxBytes != 0 && atomic.LoadUint64(&peer.stats.quotaTxBytes) > quota.TxBytes {
+		return ThresholdTxBytes, true
+	}
+	if quota.RxBytes != 0 && atomic.LoadUint64(&peer.stats.quotaRxBytes) > quota.RxBytes {
+		return ThresholdRxBytes, true
+	}
+	return 0, false
+}
+
+// exceedQuota enforces the quota of peer once it is exceeded.
+func (device *Device) exceedQuota(peer *Peer) {
+	peer.quota.Lock()
+	kind, over := peer.unsafeOverQuota()
+	if !over || peer.quota.exceeded.Get() {
+		peer.quota.Unlock()
+		return
+	}
+	peer.quota.exceeded.Set(true)
+	disable := peer.quota.quota.Action == QuotaDisable && !peer.Disabled()
+	peer.quota.disabledByThis = disable
+	peer.quota.Unlock()
+
+	device.log.Info.Println(peer, "- Exceeded quota of", kind)
+	if disable {
+		peer.Disable()
+	}
+	device.emitEvent(Event{Kind: EventQuotaExceeded, Peer: peer.handshake.remoteStatic, Threshold: kind})
+}
+
+// liftQuota lifts the consequences of exceeding the quota of peer once
+// it no longer is.
+func (device *Device) liftQuota(peer *Peer) {
+	peer.quota.Lock()
+	if _, over := peer.unsafeOverQuota(); over || !peer.quota.exceeded.Get() {
+		peer.quota.Unlock()
+		return
+	}
+	peer.quota.exceeded.Set(false)
+	enable := peer.quota.disabledByThis
+	peer.quota.disabledByThis = false
+	peer.quota.Unlock()
+
+	device.log.Info.Println(peer, "- Quota reset")
+	if enable {
+		peer.Enable()
+	}
+	device.emitEvent(Event{Kind: EventQuotaReset, Peer: peer.handshake.remoteStatic})
+}
+
+// renewQuota resets the bytes counted against the quota of peer as its
+// period ends, and schedules the next reset.
+func (device *Device) renewQuota(peer *Peer) {
+	peer.quota.Lock()
+	if peer.quota.timer == nil {
+		peer.quota.Unlock()
+		return
+	}
+	peer.quota.timer.Reset(peer.quota.quota.Period)
+	peer.quota.Unlock()
+	peer.ResetQuota()
+}
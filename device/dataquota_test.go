@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerQuota(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	next := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return Event{}
+		}
+	}
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nquota_rx_bytes=1000\nquota_action=disable\n"))
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	peerConfig := config.Peers[0]
+	if limit := peerConfig.QuotaRxBytes; limit == nil || *limit != 1000 {
+		t.Errorf("rx quota reported as %v, want 1000", limit)
+	}
+	if action := peerConfig.QuotaAction; action == nil || *action != QuotaDisable {
+		t.Errorf("quota action reported as %v, want disable", action)
+	}
+	if peerConfig.QuotaTxBytes != nil || peerConfig.QuotaPeriod != nil {
+		t.Errorf("unset quota reported as %v and %v", peerConfig.QuotaTxBytes, peerConfig.QuotaPeriod)
+	}
+
+	// exceeding the quota disables the peer until it is reset
+
+	peer := dev.LookupPeer(pk)
+	peer.accountQuota(0, 600)
+	if peer.QuotaExceeded() {
+		t.Fatal("quota exceeded early")
+	}
+	peer.accountQuota(5000, 600)
+	if event := next(); event.Kind != EventQuotaExceeded || event.Peer != pk || event.Threshold != ThresholdRxBytes {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !peer.QuotaExceeded() || !peer.Disabled() {
+		t.Errorf("exceeded %v, disabled %v", peer.QuotaExceeded(), peer.Disabled())
+	}
+	if stats := peer.Stats(); stats.QuotaRxBytes != 1200 || stats.QuotaTxBytes != 5000 || !stats.QuotaExceeded {
+		t.Errorf("stats %+v", stats)
+	}
+
+	assertNil(t, dev.ResetPeerQuota(pk))
+	if event := next(); event.Kind != EventQuotaReset || event.Peer != pk {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if peer.QuotaExceeded() || peer.Disabled() {
+		t.Errorf("after reset exceeded %v, disabled %v", peer.QuotaExceeded(), peer.Disabled())
+	}
+
+	// a peer disabled by the administrator stays disabled
+
+	peer.Disable()
+	peer.accountQuota(0, 2000)
+	if event := next(); event.Kind != EventQuotaExceeded {
+		t.Errorf("unexpected event %+v", event)
+	}
+	assertNil(t, dev.ResetPeerQuota(pk))
+	if event := next(); event.Kind != EventQuotaReset {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !peer.Disabled() {
+		t.Error("reset enabled a peer disabled by the administrator")
+	}
+	peer.Enable()
+
+	// dropping traffic lasts until the period ends
+
+	assertNil(t, dev.SetPeerQuota(pk, DataQuota{TxBytes: 100, Period: 200 * time.Millisecond}))
+	peer.accountQuota(101, 0)
+	if event := next(); event.Kind != EventQuotaExceeded || event.Threshold != ThresholdTxBytes {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if peer.Disabled() {
+		t.Error("dropping quota disabled the peer")
+	}
+	if event := next(); event.Kind != EventQuotaReset {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if stats := peer.Stats(); stats.QuotaTxBytes != 0 || stats.QuotaExceeded {
+		t.Errorf("stats after the period %+v", stats)
+	}
+
+	if err := dev.SetPeerQuota(NoisePublicKey{1}, DataQuota{TxBytes: 1}); err != ErrPeerNotFound {
+		t.Errorf("setting quota of unknown peer: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+/* Deterministic handshakes
+ *
+ * Handshakes take their ephemeral keys and timestamps from the handshake
+ * source of the device, chosen once at construction. It draws from the
+ * random source and the handshake clock, so no two handshakes produce
+ * the same messages. To compare them against test vectors, tests may
+ * construct a device with deterministicHandshakes instead. The option is
+ * deliberately unexported: a device outside of tests never runs with
+ * predictable ephemeral keys.
+ */
+
+type handshakeInputs interface {
+	ephemeral() (NoisePrivateKey, error)
+	timestamp() tai64n.Timestamp
+}
+
+type randomHandshakes struct {
+	clock *tai64n.Clock
+}
+
+func (source randomHandshakes) ephemeral() (NoisePrivateKey, error) {
+	return newPrivateKey()
+}
+
+func (source randomHandshakes) timestamp() tai64n.Timestamp {
+	return source.clock.Now()
+}
+
+// deterministicHandshakes hands out its ephemeral keys in order, random
+// ones once they are used up, and always the same timestamp.
+type deterministicHandshakes struct {
+	sync.Mutex
+	ephemerals []NoisePrivateKey
+	stamp      tai64n.Timestamp
+}
+
+func (source *deterministicHandshakes) ephemeral() (NoisePrivateKey, error) {
+	source.Lock()
+	defer source.Unlock()
+	if len(source.ephemerals) == 0 {
+		return newPrivateKey()
+	}
+	sk := source.ephemerals[0]
+	source.ephemerals = source.ephemerals[1:]
+	sk.clamp()
+	return sk, nil
+}
+
+func (source *deterministicHandshakes) timestamp() tai64n.Timestamp {
+	return source.stamp
+}
@@ -6,22 +6,43 @@
 package device
 
 import (
+	"fmt"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ratelimiter"
 	"golang.zx2c4.com/wireguard/rwcancel"
+	"golang.zx2c4.com/wireguard/tai64n"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
 type Device struct {
+
+	// accessed atomically, placed first to be 64-bit aligned, see Peer.stats
+
+	stats struct {
+		cookieReplies      uint64 // handshake messages answered with a cookie reply
+		rateLimited        uint64 // handshake messages dropped by the ratelimiter
+		handshakeQueueFull uint64 // handshake messages dropped because the queue was full
+		buffersExhausted   uint64 // transport messages dropped for lack of message buffers
+		receiveFiltered    uint64 // datagrams dropped by the receive allowlist
+		handshakesOOB      uint64 // handshake messages delivered out of band
+		overQuota          uint64 // handshake messages dropped beyond Limits.HandshakesPerSecond
+		sendErrors         errorCounters
+		receiveErrors      errorCounters // errors which ended a receive routine
+		upSinceNano        int64         // when the device last came up, zero while it is down
+	}
+
 	isUp     AtomicBool // device is (going) up
 	isClosed AtomicBool // device is closed? (acting as guard)
+	relay    AtomicBool // packets between peers are forwarded, see SetRelay
 	log      *Logger
 
 	// synchronized resources (locks acquired in order)
@@ -39,20 +60,39 @@ type Device struct {
 		stopping sync.WaitGroup
 		sync.RWMutex
 		bind          conn.Bind // bind interface
+		createBind    func(port uint16) (conn.Bind, uint16, error)
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
+		sendErrors    uint32 // consecutive send errors, accessed atomically
+		rebinding     AtomicBool
+		closingBind   AtomicBool // the bind is being closed on purpose, its errors are expected
+		buffers       bufferOptions
+		closing       chan struct{} // closed when the bind is closed, stops its tuning
+		offload       bool          // coalesced datagrams are received from bind
+		flowPorts     PortRange     // additional source ports for inner flows
+		flowBinds     []conn.Bind   // binds of the flow ports, nil where opening failed
+		flowLabels    bool          // outer IPv6 flow labels are generated, see DeviceOptions
 	}
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
+		privateKey *NoisePrivateKey // allocated from secrets
 		publicKey  NoisePublicKey
 	}
 
+	secrets secretArena // holding key material
+
+	/* keyMap is guarded by the mutex and used by the control plane,
+	 * lookup mirrors it for the data plane, which must never wait
+	 * for a bulk configuration change to release the mutex
+	 */
+
 	peers struct {
 		sync.RWMutex
 		keyMap map[NoisePublicKey]*Peer
+		lookup sync.Map // NoisePublicKey -> *Peer
+		count  int32    // len(keyMap), accessed atomically
 	}
 
 	// unprotected / "self-synchronising resources"
@@ -60,23 +100,74 @@ type Device struct {
 	allowedips    AllowedIPs
 	indexTable    IndexTable
 	cookieChecker CookieChecker
+	quietUntil    atomic.Value // time.Time, see Quiesce
+	classifier    atomic.Value // PacketClassifier, see SetPacketClassifier
+	drops         dropMonitor
+
+	malformedSources malformedSources
+	allowlist        receiveAllowlist
+
+	relayRules     atomic.Value // *relayRules, nil if there are none, see SetRelayRules
+	relayRulesLock sync.Mutex   // serializes replacing relayRules
+
+	mssClamping AtomicBool // the MSS of TCP SYN segments is clamped, see SetMSSClamping
+
+	logRedaction atomic.Value // *LogRedaction, see SetLogRedaction
+
+	failoverThreshold atomic.Value    // time.Duration, see SetFailoverThreshold
+	balance           balancer        // peers sharing balanced allowed IPs
+	backups           failoverBackups // peers holding backup allowed IPs
+	controlHandler    atomic.Value    // ControlHandler, see SetControlHandler
+	datagramCapture   atomic.Value    // DatagramCapture, see SetDatagramCapture
+
+	handshakeClock  *tai64n.Clock
+	clock           Clock           // set by DeviceOptions, fixed thereafter
+	handshakeInputs handshakeInputs // ephemeral keys and timestamps of handshakes
+	work            int32           // work in progress, accessed atomically, see Working
+	nat64           nat64
+	historySize     int // throughput samples kept per peer, see DeviceOptions.StatsHistory
+	discovery       discovery
+	portMapping     portMapping
+
+	handshakeTransport HandshakeTransport // nil unless set by DeviceOptions
+	ipcAuthorizer      IPCAuthorizer      // nil unless set by DeviceOptions
+	tracer             Tracer             // nil unless set by DeviceOptions
+	audit              audit
+	candidates         candidates
+	quota              quota
+	profile            SecurityProfile // set by DeviceOptions, fixed thereafter
+	mtuProbing         bool            // peers are probed as sessions begin, see DeviceOptions.MTUProbing
+	dataPlaneOnly      bool            // session keys are installed instead of handshaken, see DeviceOptions.DataPlaneOnly
+
+	statsGeneration struct {
+		sync.Mutex
+		last uint64 // last generation assigned to the stats of a peer, see PeerStatsChangedSince
+	}
 
 	rate struct {
 		underLoadUntil atomic.Value
+		underLoad      AtomicBool // last reported state, see EventUnderLoad
 		limiter        ratelimiter.Ratelimiter
 	}
 
 	pool struct {
-		messageBufferPool        *sync.Pool
-		messageBufferReuseChan   chan *[MaxMessageSize]byte
-		inboundElementPool       *sync.Pool
-		inboundElementReuseChan  chan *QueueInboundElement
-		outboundElementPool      *sync.Pool
-		outboundElementReuseChan chan *QueueOutboundElement
+		messageBufferPool      *sync.Pool
+		messageBufferReuseChan chan *[MaxMessageSize]byte
+		elementPool            *sync.Pool       // elements of both directions
+		elementFreelist        *elementFreelist // instead of elementPool if preallocated
+	}
+
+	diagnostics diagnostics
+
+	queueSizes struct {
+		outbound     int
+		inbound      int
+		handshake    int
+		preallocated int // buffers per pool, zero if the pools grow without bound
 	}
 
 	queue struct {
-		encryption chan *QueueOutboundElement
+		encryption encryptionQueue
 		decryption chan *QueueInboundElement
 		handshake  chan QueueHandshakeElement
 	}
@@ -85,6 +176,18 @@ type Device struct {
 		stop chan struct{}
 	}
 
+	closeErr struct {
+		sync.Mutex
+		err error // the failure which closed the device, see Err
+	}
+
+	events struct {
+		sync.RWMutex
+		handler   func(Event)
+		exhausted func(NoisePublicKey)
+		queue     chan Event
+	}
+
 	tun struct {
 		device tun.Device
 		mtu    int32
@@ -97,15 +200,52 @@ type Device struct {
  * Must hold device.peers.Mutex
  */
 func unsafeRemovePeer(device *Device, peer *Peer, key NoisePublicKey) {
+	device.unsafeUnlinkPeer(peer, key)
+	device.teardownPeer(peer)
+}
 
-	// stop routing and processing of packets
-
+// unsafeUnlinkPeer removes peer from the routing table and the peer map,
+// so that it is handed no more packets.
+//
+// Must hold device.peers.Mutex
+func (device *Device) unsafeUnlinkPeer(peer *Peer, key NoisePublicKey) {
 	device.allowedips.RemoveByPeer(peer)
+	device.unbalance(peer)
+	device.unbackup(peer)
+	device.unsafeDeletePeerKey(key)
+}
+
+// teardownPeer stops the routines and timers of the unlinked peer and
+// zeroes its key material, every removal of a peer ending here.
+func (device *Device) teardownPeer(peer *Peer) {
 	peer.Stop()
+	peer.stopExpiry()
+	peer.stopEphemeral()
+	peer.stopThresholds()
+	peer.stopQuota()
+	peer.stopProbing()
+	peer.zeroSecrets()
+	device.forgetPeer(peer)
+}
+
+/* Mutations of the peer map, caller must hold the peers lock for writing
+ */
 
-	// remove from peer map
+func (device *Device) unsafeStorePeerKey(key NoisePublicKey, peer *Peer) {
+	device.peers.keyMap[key] = peer
+	device.peers.lookup.Store(key, peer)
+	atomic.StoreInt32(&device.peers.count, int32(len(device.peers.keyMap)))
+}
 
+func (device *Device) unsafeDeletePeerKey(key NoisePublicKey) {
 	delete(device.peers.keyMap, key)
+	device.peers.lookup.Delete(key)
+	atomic.StoreInt32(&device.peers.count, int32(len(device.peers.keyMap)))
+}
+
+// PeerCount returns the number of configured peers without taking the peers lock.
+func (device *Device) PeerCount() int {
+	return int(atomic.LoadInt32(&device.peers.count))
 }
 
 func deviceUpdateState(device *Device) {
@@ -135,6 +275,7 @@ func deviceUpdateState(device *Device) {
 		if err := device.BindUpdate(); err != nil {
 			device.log.Error.Printf("Unable to update bind: %v\n", err)
 			device.isUp.Set(false)
+			device.closeWithError(fmt.Errorf("%w: %v", ErrNoBind, err))
 			break
 		}
 		device.peers.RLock()
@@ -145,8 +286,10 @@ func deviceUpdateState(device *Device) {
 			}
 		}
 		device.peers.RUnlock()
+		atomic.StoreInt64(&device.stats.upSinceNano, device.now().UnixNano())
 
 	case false:
+		atomic.StoreInt64(&device.stats.upSinceNano, 0)
 		device.BindClose()
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
@@ -184,11 +327,25 @@ func (device *Device) Down() {
 }
 
 func (device *Device) IsUnderLoad() bool {
+	underLoad := device.isUnderLoad()
+	if device.rate.underLoad.Swap(underLoad) != underLoad {
+		if underLoad {
+			device.log.Info.Println("Device under load, requiring cookies for handshakes")
+			device.emitEvent(Event{Kind: EventUnderLoad})
+		} else {
+			device.log.Info.Println("Device no longer under load")
+			device.emitEvent(Event{Kind: EventLoadNormal})
+		}
+	}
+	return underLoad
+}
+
+func (device *Device) isUnderLoad() bool {
 
 	// check if currently under load
 
 	now := time.Now()
-	underLoad := len(device.queue.handshake) >= UnderLoadQueueSize
+	underLoad := len(device.queue.handshake) >= device.queueSizes.handshake/UnderLoadQueueDivisor
 	if underLoad {
 		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime))
 		return true
@@ -200,13 +357,62 @@ func (device *Device) IsUnderLoad() bool {
 	return until.After(now)
 }
 
+// HandshakeStats is a snapshot of the handshake related counters of a device,
+// which tell a flood of handshakes from an attacker apart from a flash crowd.
+type HandshakeStats struct {
+	UnderLoad          bool   // handshakes currently require a valid cookie
+	CookieReplies      uint64 // handshake messages answered with a cookie reply
+	RateLimited        uint64 // handshake messages dropped by the ratelimiter
+	HandshakeQueueFull uint64 // handshake messages dropped because the queue was full
+	BuffersExhausted   uint64 // transport messages dropped for lack of buffers, handshakes are still received
+	IndexEntries       int    // receiver indices of handshakes and sessions in use
+	IndexEvictions     uint64 // handshake receiver indices evicted as the index table was full
+	ReceiveFiltered    uint64 // datagrams from sources outside the receive allowlist, see SetReceiveAllowlist
+	OutOfBand          uint64 // handshake messages delivered out of band, see DeliverHandshake
+	OverQuota          uint64 // handshake messages dropped beyond Limits.HandshakesPerSecond
+}
+
+func (device *Device) HandshakeStats() HandshakeStats {
+	return HandshakeStats{
+		UnderLoad:          device.IsUnderLoad(),
+		CookieReplies:      atomic.LoadUint64(&device.stats.cookieReplies),
+		RateLimited:        atomic.LoadUint64(&device.stats.rateLimited),
+		HandshakeQueueFull: atomic.LoadUint64(&device.stats.handshakeQueueFull),
+		BuffersExhausted:   atomic.LoadUint64(&device.stats.buffersExhausted),
+		IndexEntries:       device.indexTable.Len(),
+		IndexEvictions:     device.indexTable.Evictions(),
+		ReceiveFiltered:    atomic.LoadUint64(&device.stats.receiveFiltered),
+		OutOfBand:          atomic.LoadUint64(&device.stats.handshakesOOB),
+		OverQuota:          atomic.LoadUint64(&device.stats.overQuota),
+	}
+}
+
+// UpSince returns when the device last came up, zero while it is down.
+func (device *Device) UpSince() time.Time {
+	if nano := atomic.LoadInt64(&device.stats.upSinceNano); nano != 0 {
+		return time.Unix(0, nano)
+	}
+	return time.Time{}
+}
+
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
+	return device.setPrivateKey(sk, false)
+}
+
+// RotatePrivateKey changes the private key like SetPrivateKey, but keeps
+// established sessions usable until they expire naturally instead of
+// invalidating them. Handshakes from then on use the new key.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey) error {
+	return device.setPrivateKey(sk, true)
+}
+
+func (device *Device) setPrivateKey(sk NoisePrivateKey, keepSessions bool) error {
 	// lock required resources
 
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	if sk.Equals(*device.staticIdentity.privateKey) {
 		return nil
 	}
 
@@ -230,7 +436,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// update key material
 
-	device.staticIdentity.privateKey = sk
+	*device.staticIdentity.privateKey = sk
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
 
@@ -247,19 +453,165 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 		peer.handshake.mutex.RUnlock()
 	}
 	for _, peer := range expiredPeers {
-		peer.ExpireCurrentKeypairs()
+		if keepSessions {
+			peer.AbandonHandshake()
+		} else {
+			peer.ExpireCurrentKeypairs()
+		}
 	}
 
 	return nil
 }
 
+// DeviceOptions holds the optional settings of NewDeviceWithOptions,
+// the zero value selects the defaults used by NewDevice.
+type DeviceOptions struct {
+	// CreateBind opens the UDP bind of the device on the given port,
+	// returning the port actually bound to. Defaults to conn.CreateBind.
+	CreateBind func(port uint16) (conn.Bind, uint16, error)
+
+	// HandshakeClock produces the timestamps of handshake initiations,
+	// see tai64n.Clock. Defaults to a clock private to the device.
+	HandshakeClock *tai64n.Clock
+
+	// Clock runs the protocol timers of the device, such as a virtual
+	// clock of a simulation. Defaults to the system clock.
+	Clock Clock
+
+	// ReceiveBufferSize and SendBufferSize set the socket buffer sizes
+	// of the UDP bind in bytes, zero keeps the defaults of the system.
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// AutotuneReceiveBuffer grows the receive buffer of the UDP bind,
+	// up to MaxReceiveBufferSize, while the system reports drops.
+	AutotuneReceiveBuffer bool
+
+	// FlowPorts are additional source ports, at most MaxFlowPorts, which
+	// outgoing transport packets are spread across by a hash of the inner
+	// flow, so that ECMP routing in the underlay may use several paths.
+	// Handshakes keep using the listen port. Disabled if First is zero.
+	FlowPorts PortRange
+
+	// IPv6FlowLabels has the system label the outer IPv6 packets with a
+	// flow label hashed from their addresses and ports, stable for each
+	// peer and, combined with FlowPorts, for each inner flow, so that
+	// routers balancing or classifying by flow label keep flows together.
+	IPv6FlowLabels bool
+
+	// NAT64Prefix maps IPv4 endpoints to IPv6 once they turn out to be
+	// unreachable, see SynthesizeNAT64. If DiscoverNAT64 is set, the
+	// prefix is also looked up via DNS64 whenever the bind is opened.
+	NAT64Prefix   net.IPNet
+	DiscoverNAT64 bool
+
+	// StatsHistory is how far back the throughput of every peer is
+	// sampled every StatsSampleInterval, see Peer.StatsHistory. It is
+	// capped at MaxStatsHistory, zero disables sampling.
+	StatsHistory time.Duration
+
+	// LANDiscovery announces the public key and listen port of the device
+	// to DiscoveryGroup and collects the announcements of other devices,
+	// see DiscoveredPeers.
+	LANDiscovery bool
+
+	// PortMapper, if not nil, maps the listen port on the local gateway,
+	// see ExternalEndpoint.
+	PortMapper PortMapper
+
+	// HandshakeTransport, if not nil, carries handshake messages out of
+	// band in addition to UDP, see DeliverHandshake.
+	HandshakeTransport HandshakeTransport
+
+	// IPCAuthorizer, if not nil, decides which IPC operations clients
+	// may perform, see AuthorizeIPC.
+	IPCAuthorizer IPCAuthorizer
+
+	// Tracer, if not nil, traces handshakes and configuration
+	// operations as spans, see Tracer.
+	Tracer Tracer
+
+	// DataPlaneOnly keeps the device from performing handshakes, its
+	// session keys being installed by the application instead, see
+	// InstallSessionKeys.
+	DataPlaneOnly bool
+
+	// AuditSink, if not nil, keeps the audit records of configuration
+	// changes, see AuditLog.
+	AuditSink AuditSink
+
+	// CandidateExchange, if not nil, carries the endpoint candidates of
+	// the device to peers, see OfferCandidates.
+	CandidateExchange CandidateExchange
+
+	// STUNServers are the host:port endpoints of the STUN servers asked
+	// for the server reflexive candidates of the device.
+	STUNServers []string
+
+	// QueueOutboundSize, QueueInboundSize and QueueHandshakeSize set the
+	// capacity of the queues of the device and its peers, zero selects
+	// the default of the platform, the constant of the same name.
+	QueueOutboundSize  int
+	QueueInboundSize   int
+	QueueHandshakeSize int
+
+	// PreallocatedBuffers is the number of buffers allocated up front for
+	// every pool, which never grows beyond it. Zero selects the default
+	// of the platform, PreallocatedBuffersPerPool, while a negative value
+	// disables preallocation and lets the pools grow without bound.
+	PreallocatedBuffers int
+
+	// LockMemory locks the memory holding the private key and the
+	// static, ephemeral and preshared keys of handshakes, so that it is
+	// never swapped out. It requires privileges or a sufficient
+	// RLIMIT_MEMLOCK, failing to lock is logged, see MemoryLocked.
+	LockMemory bool
+
+	// MTUProbing probes the largest packet size delivered to every peer
+	// whenever a session begins after it had none, see ProbePeerMTU.
+	MTUProbing bool
+
+	// LogRedaction controls how public keys and endpoints appear in the
+	// logs of the device, see SetLogRedaction.
+	LogRedaction LogRedaction
+
+	// SecurityProfile selects the session lifetimes of the device.
+	SecurityProfile SecurityProfile
+
+	// Limits are the resource quotas of the device, see SetLimits. The
+	// zero value limits only the peers, to MaxPeers.
+	Limits Limits
+
+	// IndexTableSize bounds the number of receiver indices of handshakes
+	// and sessions. Once it is reached, the least recently used pending
+	// handshake is evicted; sessions are never evicted, new handshakes
+	// failing instead. Zero selects IndexTableSize, enough for every peer.
+	IndexTableSize int
+
+	// handshakeInputs replaces the random ephemeral keys and the
+	// timestamps of handshakes, for test vectors only.
+	handshakeInputs handshakeInputs
+}
+
 func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
+	return NewDeviceWithOptions(tunDevice, logger, DeviceOptions{})
+}
+
+func NewDeviceWithOptions(tunDevice tun.Device, logger *Logger, opts DeviceOptions) *Device {
 	device := new(Device)
 
 	device.isUp.Set(false)
 	device.isClosed.Set(false)
 
 	device.log = logger
+	if err := device.SetLogRedaction(opts.LogRedaction); err != nil {
+		logger.Error.Println("Invalid log redaction:", err)
+	}
+	device.clock = opts.Clock
+	if device.clock == nil {
+		device.clock = systemClock{}
+	}
+	device.dataPlaneOnly = opts.DataPlaneOnly
 
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
@@ -273,17 +625,20 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 
 	device.rate.limiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
+	device.quietUntil.Store(time.Time{})
 
-	device.indexTable.Init()
+	device.indexTable.Init(opts.IndexTableSize)
 	device.allowedips.Reset()
 
+	device.setQueueSizes(opts)
 	device.PopulatePools()
 
 	// create queues
 
-	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
-	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
-	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.queue.handshake = make(chan QueueHandshakeElement, device.queueSizes.handshake)
+	device.queue.encryption.init()
+	device.queue.decryption = make(chan *QueueInboundElement, device.queueSizes.inbound)
+	device.events.queue = make(chan Event, QueueEventSize)
 
 	// prepare signals
 
@@ -293,6 +648,31 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 
 	device.net.port = 0
 	device.net.bind = nil
+	device.net.createBind = opts.CreateBind
+	device.net.buffers = bufferOptions{
+		receive:  opts.ReceiveBufferSize,
+		send:     opts.SendBufferSize,
+		autotune: opts.AutotuneReceiveBuffer,
+	}
+	if opts.FlowPorts.count() > 0 {
+		device.net.flowPorts = opts.FlowPorts
+		if device.net.flowPorts.count() > MaxFlowPorts {
+			device.net.flowPorts.Last = device.net.flowPorts.First + MaxFlowPorts - 1
+		}
+	}
+	device.net.flowLabels = opts.IPv6FlowLabels
+	if validNAT64Prefix(opts.NAT64Prefix) {
+		device.nat64.prefix = opts.NAT64Prefix
+	}
+	device.nat64.discover = opts.DiscoverNAT64
+	device.handshakeClock = opts.HandshakeClock
+	if device.handshakeClock == nil {
+		device.handshakeClock = new(tai64n.Clock)
+	}
+	device.handshakeInputs = opts.handshakeInputs
+	if device.handshakeInputs == nil {
+		device.handshakeInputs = randomHandshakes{device.handshakeClock}
+	}
 
 	// start workers
 
@@ -307,21 +687,80 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 		go device.RoutineHandshake()
 	}
 
-	device.state.starting.Add(2)
-	device.state.stopping.Add(2)
+	device.state.starting.Add(3)
+	device.state.stopping.Add(3)
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutineEventDispatcher()
+
+	if opts.StatsHistory > 0 {
+		history := opts.StatsHistory
+		if history > MaxStatsHistory {
+			history = MaxStatsHistory
+		}
+		device.historySize = int((history + StatsSampleInterval - 1) / StatsSampleInterval)
+		device.state.starting.Add(1)
+		device.state.stopping.Add(1)
+		go device.RoutineSampleStats()
+	}
+
+	if opts.LANDiscovery {
+		device.discovery.announce = make(chan struct{}, 1)
+		device.state.starting.Add(1)
+		device.state.stopping.Add(1)
+		go device.RoutineLANDiscovery()
+	}
+
+	device.handshakeTransport = opts.HandshakeTransport
+	device.ipcAuthorizer = opts.IPCAuthorizer
+	device.tracer = opts.Tracer
+	device.audit.sink = opts.AuditSink
+	device.candidates.exchange = opts.CandidateExchange
+	device.candidates.stunServers = opts.STUNServers
+	device.SetLimits(opts.Limits)
+	device.profile = opts.SecurityProfile
+	device.mtuProbing = opts.MTUProbing
+	device.secrets.lock = opts.LockMemory
+	device.secrets.locked = opts.LockMemory
+	device.staticIdentity.privateKey = device.allocPrivateKey()
+
+	if opts.PortMapper != nil {
+		device.portMapping.update = make(chan struct{}, 1)
+		device.portMapping.mapper = opts.PortMapper
+		device.state.starting.Add(1)
+		device.state.stopping.Add(1)
+		go device.RoutinePortMapping()
+	}
 
 	device.state.starting.Wait()
 
 	return device
 }
 
-func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
-	device.peers.RLock()
-	defer device.peers.RUnlock()
+func (device *Device) setQueueSizes(opts DeviceOptions) {
+	sizeOr := func(size, def int) int {
+		if size > 0 {
+			return size
+		}
+		return def
+	}
+	device.queueSizes.outbound = sizeOr(opts.QueueOutboundSize, QueueOutboundSize)
+	device.queueSizes.inbound = sizeOr(opts.QueueInboundSize, QueueInboundSize)
+	device.queueSizes.handshake = sizeOr(opts.QueueHandshakeSize, QueueHandshakeSize)
+	switch {
+	case opts.PreallocatedBuffers > 0:
+		device.queueSizes.preallocated = opts.PreallocatedBuffers
+	case opts.PreallocatedBuffers == 0:
+		device.queueSizes.preallocated = PreallocatedBuffersPerPool
+	}
+}
 
-	return device.peers.keyMap[pk]
+func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
+	peer, ok := device.peers.lookup.Load(pk)
+	if !ok {
+		return nil
+	}
+	return peer.(*Peer)
 }
 
 func (device *Device) RemovePeer(key NoisePublicKey) {
@@ -335,6 +774,45 @@ func (device *Device) RemovePeer(key NoisePublicKey) {
 	}
 }
 
+type RemovePeerOptions struct {
+	Drain bool   // send queued packets and a final keepalive before stopping the peer
+	Done  func() // called once the routines and timers of the peer are gone
+}
+
+// RemovePeerWithOptions removes a peer like RemovePeer. With opts.Drain the
+// peer is unrouted and removed from the configuration immediately, but is
+// only stopped in the background once its queues are empty, or after
+// PeerDrainTimeout.
+func (device *Device) RemovePeerWithOptions(key NoisePublicKey, opts RemovePeerOptions) error {
+	device.peers.Lock()
+	peer, ok := device.peers.keyMap[key]
+	if !ok {
+		device.peers.Unlock()
+		return ErrPeerNotFound
+	}
+
+	if !opts.Drain {
+		unsafeRemovePeer(device, peer, key)
+		device.peers.Unlock()
+		if opts.Done != nil {
+			opts.Done()
+		}
+		return nil
+	}
+
+	device.unsafeUnlinkPeer(peer, key)
+	device.peers.Unlock()
+
+	go func() {
+		peer.drain(PeerDrainTimeout)
+		device.teardownPeer(peer)
+		if opts.Done != nil {
+			opts.Done()
+		}
+	}()
+	return nil
+}
+
 func (device *Device) RemoveAllPeers() {
 	device.peers.Lock()
 	defer device.peers.Unlock()
@@ -342,8 +820,6 @@ func (device *Device) RemoveAllPeers() {
 	for key, peer := range device.peers.keyMap {
 		unsafeRemovePeer(device, peer, key)
 	}
-
-	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 }
 
 func (device *Device) FlushPacketQueues() {
@@ -352,17 +828,18 @@ func (device *Device) FlushPacketQueues() {
 		case elem, ok := <-device.queue.decryption:
 			if ok {
 				elem.Drop()
+				device.PutMessageBuffer(elem.buffer)
+				device.releaseInboundElement(elem)
 			}
-		case elem, ok := <-device.queue.encryption:
+		case _, ok := <-device.queue.handshake:
 			if ok {
-				elem.Drop()
+				device.doneWork()
 			}
-		case <-device.queue.handshake:
 		default:
+			device.queue.encryption.flush()
 			return
 		}
 	}
-
 }
 
 func (device *Device) Close() {
@@ -381,12 +858,20 @@ func (device *Device) Close() {
 	device.BindClose()
 
 	device.isUp.Set(false)
+	atomic.StoreInt64(&device.stats.upSinceNano, 0)
 
 	close(device.signals.stop)
+	device.queue.encryption.close()
 	device.state.stopping.Wait()
 
 	device.RemoveAllPeers()
 
+	device.staticIdentity.Lock()
+	privateKey := device.staticIdentity.privateKey
+	device.staticIdentity.privateKey = new(NoisePrivateKey)
+	device.staticIdentity.Unlock()
+	device.secrets.release(unsafe.Pointer(privateKey))
+
 	device.FlushPacketQueues()
 
 	device.rate.limiter.Close()
@@ -395,10 +880,35 @@ func (device *Device) Close() {
 	device.log.Info.Println("Interface closed")
 }
 
-func (device *Device) Wait() chan struct{} {
+// Wait returns a channel which is closed once the device is closed,
+// either by Close or because of a failure reported by Err.
+func (device *Device) Wait() <-chan struct{} {
 	return device.signals.stop
 }
 
+// Err returns the failure which closed the device, such as the TUN
+// device going away or the UDP bind failing when bringing the device up.
+// It returns nil while the device is running and after a regular Close.
+func (device *Device) Err() error {
+	device.closeErr.Lock()
+	defer device.closeErr.Unlock()
+	return device.closeErr.err
+}
+
+/* Records err as the reason for closing the device and closes it
+ *
+ * Obs. Closing happens asynchronously, since the callers are
+ * routines or state changes which Close itself waits for
+ */
+func (device *Device) closeWithError(err error) {
+	device.closeErr.Lock()
+	if device.closeErr.err == nil && !device.isClosed.Get() {
+		device.closeErr.err = err
+	}
+	device.closeErr.Unlock()
+	go device.Close()
+}
+
 func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	if device.isClosed.Get() {
 		return
@@ -407,7 +917,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(device.rejectAfterTime()).Before(device.now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -419,13 +929,22 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 func unsafeCloseBind(device *Device) error {
 	var err error
 	netc := &device.net
+	netc.closingBind.Set(true)
+	defer netc.closingBind.Set(false)
 	if netc.netlinkCancel != nil {
 		netc.netlinkCancel.Cancel()
 	}
+	if netc.closing != nil {
+		close(netc.closing)
+		netc.closing = nil
+	}
 	if netc.bind != nil {
 		err = netc.bind.Close()
 		netc.bind = nil
 	}
+	if flowErr := device.unsafeCloseFlowBinds(); err == nil {
+		err = flowErr
+	}
 	netc.stopping.Wait()
 	return err
 }
@@ -454,6 +973,13 @@ func (device *Device) BindSetMark(mark uint32) error {
 		if err := device.net.bind.SetMark(mark); err != nil {
 			return err
 		}
+		for _, bind := range device.net.flowBinds {
+			if bind != nil {
+				if err := bind.SetMark(mark); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	// clear cached source addresses
@@ -490,20 +1016,29 @@ func (device *Device) BindUpdate() error {
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = conn.CreateBind(netc.port)
-		if err != nil {
-			netc.bind = nil
-			netc.port = 0
-			return err
+		createBind := conn.CreateBind
+		if netc.createBind != nil {
+			createBind = netc.createBind
 		}
-		netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+		netc.bind, netc.port, err = createBind(netc.port)
 		if err != nil {
-			netc.bind.Close()
 			netc.bind = nil
 			netc.port = 0
 			return err
 		}
 
+		// the route listener only understands endpoints of the native bind
+
+		if netc.createBind == nil {
+			netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+			if err != nil {
+				netc.bind.Close()
+				netc.bind = nil
+				netc.port = 0
+				return err
+			}
+		}
+
 		// set fwmark
 
 		if netc.fwmark != 0 {
@@ -513,6 +1048,18 @@ func (device *Device) BindUpdate() error {
 			}
 		}
 
+		// size socket buffers
+
+		device.setBufferSizes(netc.bind)
+		device.setFlowLabels(netc.bind)
+
+		// receive coalesced datagrams if possible
+
+		netc.offload = false
+		if receiver, ok := netc.bind.(conn.SegmentReceiver); ok {
+			netc.offload = receiver.EnableReceiveOffload() == nil
+		}
+
 		// clear cached source addresses
 
 		device.peers.RLock()
@@ -533,6 +1080,27 @@ func (device *Device) BindUpdate() error {
 		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
 		device.net.starting.Wait()
 
+		// send inner flows from their own source ports
+
+		device.unsafeOpenFlowBinds(createBind)
+
+		// the network may have changed, look for its NAT64 prefix
+
+		if device.nat64.discover {
+			go device.discoverNAT64()
+		}
+
+		// let the LAN and the gateway know of the new port right away
+
+		device.discovery.trigger()
+		device.portMapping.trigger()
+
+		if netc.buffers.autotune {
+			netc.closing = make(chan struct{})
+			device.net.stopping.Add(1)
+			go device.RoutineTuneReceiveBuffer(netc.bind, netc.closing)
+		}
+
 		device.log.Debug.Println("UDP bind has been updated")
 	}
 
@@ -8,12 +8,18 @@ package device
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -26,6 +32,11 @@ func getFreePort(t *testing.T) string {
 	return fmt.Sprintf("%d", l.LocalAddr().(*net.UDPAddr).Port)
 }
 
+func TestDeviceAlignment(t *testing.T) {
+	var d Device
+	checkAlignment(t, "Device.stats", unsafe.Offsetof(d.stats))
+}
+
 func TestTwoDevicePing(t *testing.T) {
 	port1 := getFreePort(t)
 	port2 := getFreePort(t)
@@ -93,6 +104,26 @@ endpoint=127.0.0.1:{{PORT1}}`
 			t.Error("return ping did not transit")
 		}
 	})
+
+	t.Run("ping burst", func(t *testing.T) {
+		const count = 64
+		msgs := make([][]byte, count)
+		for i := range msgs {
+			msgs[i] = tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+			msgs[i][4] = byte(i) // vary the IP ID field to tell packets apart
+			tun1.Outbound <- msgs[i]
+		}
+		for i := range msgs {
+			select {
+			case msgRecv := <-tun2.Inbound:
+				if !bytes.Equal(msgs[i], msgRecv) {
+					t.Fatalf("packet %d of burst did not transit correctly", i)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("packet %d of burst did not transit", i)
+			}
+		}
+	})
 }
 
 func assertNil(t *testing.T, err error) {
@@ -107,7 +138,7 @@ func assertEqual(t *testing.T, a, b []byte) {
 	}
 }
 
-func randDevice(t *testing.T) *Device {
+func randDevice(t testing.TB) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
 		t.Fatal(err)
@@ -118,3 +149,238 @@ func randDevice(t *testing.T) *Device {
 	device.SetPrivateKey(sk)
 	return device
 }
+
+func TestWaitReportsTUNFailure(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	tun.TUN().Close()
+	select {
+	case <-dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("device still running after its TUN went away")
+	}
+	if err := dev.Err(); err == nil || !strings.Contains(err.Error(), "TUN") {
+		t.Errorf("Err() = %v, want TUN failure", err)
+	}
+}
+
+func TestWaitAfterClose(t *testing.T) {
+	dev := randDevice(t)
+	dev.Close()
+	select {
+	case <-dev.Wait():
+	default:
+		t.Fatal("Wait channel still open after Close")
+	}
+	if err := dev.Err(); err != nil {
+		t.Errorf("Err() = %v after Close, want nil", err)
+	}
+}
+
+func TestWaitReportsBindFailure(t *testing.T) {
+	bindErr := errors.New("no sockets left")
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			return nil, 0, bindErr
+		},
+	})
+	defer dev.Close()
+
+	dev.Up()
+	select {
+	case <-dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("device still running without a bind")
+	}
+	if err := dev.Err(); !errors.Is(err, ErrNoBind) {
+		t.Errorf("Err() = %v, want ErrNoBind", err)
+	}
+}
+
+// sizedBind records buffer sizes and reports a new drop on every query.
+type sizedBind struct {
+	*failingBind
+	sync.Mutex
+	receive, send int
+	drops         uint64
+}
+
+func (b *sizedBind) SetReceiveBuffer(bytes int) error {
+	b.Lock()
+	defer b.Unlock()
+	b.receive = bytes
+	return nil
+}
+
+func (b *sizedBind) SetSendBuffer(bytes int) error {
+	b.Lock()
+	defer b.Unlock()
+	b.send = bytes
+	return nil
+}
+
+func (b *sizedBind) ReceiveDrops() (uint64, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.drops++
+	return b.drops, nil
+}
+
+func TestBufferSizes(t *testing.T) {
+	bind := &sizedBind{failingBind: newFailingBind()}
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			return bind, port, nil
+		},
+		ReceiveBufferSize:     256 << 10,
+		SendBufferSize:        128 << 10,
+		AutotuneReceiveBuffer: true,
+	})
+	defer dev.Close()
+	dev.Up()
+
+	bind.Lock()
+	receive, send := bind.receive, bind.send
+	bind.Unlock()
+	if receive != 256<<10 || send != 128<<10 {
+		t.Fatalf("buffer sizes %d/%d, want %d/%d", receive, send, 256<<10, 128<<10)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		bind.Lock()
+		receive = bind.receive
+		bind.Unlock()
+		if receive == MinReceiveBufferSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("receive buffer not grown after drops, size %d", receive)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestQueueSizes(t *testing.T) {
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		QueueOutboundSize:   16,
+		QueueInboundSize:    32,
+		QueueHandshakeSize:  64,
+		PreallocatedBuffers: 8,
+	})
+	defer dev.Close()
+
+	if size := cap(dev.queue.handshake); size != 64 {
+		t.Errorf("handshake queue size %d, want 64", size)
+	}
+	if size := cap(dev.queue.decryption); size != 32 {
+		t.Errorf("decryption queue size %d, want 32", size)
+	}
+	if size := cap(dev.pool.messageBufferReuseChan); size != 8 {
+		t.Errorf("preallocated message buffers %d, want 8", size)
+	}
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.Start()
+	if size := cap(peer.queue.nonce); size != 16 {
+		t.Errorf("nonce queue size %d, want 16", size)
+	}
+	if size := peer.queue.inbound.cap(); size != 32 {
+		t.Errorf("inbound queue size %d, want 32", size)
+	}
+	if err := peer.SetStagedQueue(17, StagedDropOldest); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("SetStagedQueue(17) = %v, want ErrInvalidValue", err)
+	}
+
+	defaults := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		PreallocatedBuffers: -1,
+	})
+	defer defaults.Close()
+	if size := cap(defaults.queue.handshake); size != QueueHandshakeSize {
+		t.Errorf("default handshake queue size %d, want %d", size, QueueHandshakeSize)
+	}
+	if defaults.pool.messageBufferPool == nil {
+		t.Error("pools preallocated although disabled")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dev := randDevice(t)
+	dev.Up()
+	if err := dev.Check(); err != nil {
+		t.Fatalf("Check() = %v on a running device", err)
+	}
+	dev.Close()
+	if err := dev.Check(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("Check() = %v after Close, want ErrDeviceClosed", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	if err := dev.Ready(); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Ready() = %v on a device down, want ErrNotReady", err)
+	}
+	dev.Up()
+	if err := dev.Ready(); err != nil {
+		t.Fatalf("Ready() = %v on a device up", err)
+	}
+
+	// a peer failing to complete handshakes makes the device not ready,
+	// until a handshake with any peer completes
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 3)
+	if err := dev.Ready(); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Ready() = %v with a failing peer, want ErrNotReady", err)
+	}
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	if err := dev.Ready(); err != nil {
+		t.Fatalf("Ready() = %v after a handshake", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	dev := randDevice(t)
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	_, err = dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	dev.Up()
+
+	diag := dev.Diagnostics()
+	if diag.Routines["encryption"] != runtime.NumCPU() || diag.Routines["read_from_tun"] != 1 {
+		t.Errorf("unexpected routines %v", diag.Routines)
+	}
+	if diag.Routines["sequential_sender"] != 1 || diag.Peers["total"] != 1 || diag.Peers["running"] != 1 {
+		t.Errorf("unexpected peers %v, routines %v", diag.Peers, diag.Routines)
+	}
+	if !strings.Contains(diag.String(), "\nroutine_nonce=1\n") {
+		t.Errorf("unexpected dump:\n%s", diag)
+	}
+
+	// some routines notice the device closing only shortly afterwards
+
+	dev.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		left := 0
+		diag = dev.Diagnostics()
+		for _, count := range diag.Routines {
+			left += count
+		}
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routines left after closing: %v", diag.Routines)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* Introspection for debugging leaks in production
+ *
+ * The device counts its running routines by kind and the buffers taken
+ * from its pools, which together with queue lengths, pending timers and
+ * peer states make up Diagnostics, along with the next firings of the
+ * timers of each peer. The same is served by the UAPI operation
+ * diagnostics=1 as key=value lines, like get=1, the timers of a peer
+ * following its public_key as the milliseconds until they fire.
+ */
+
+type routineKind int
+
+const (
+	routineReadFromTUN routineKind = iota
+	routineTUNEvents
+	routineReceive
+	routineEncryption
+	routineDecryption
+	routineHandshake
+	routineNonce
+	routineSequentialSender
+	routineSequentialReceiver
+	routineEvents
+	routineSampleStats
+	routineLANDiscovery
+	routinePortMapping
+	routineRebind
+	routineTuneBuffer
+	routineRouteListener
+	routineProbeCandidates
+	routineKinds
+)
+
+var routineNames = [routineKinds]string{
+	routineReadFromTUN:        "read_from_tun",
+	routineTUNEvents:          "tun_events",
+	routineReceive:            "receive_incoming",
+	routineEncryption:         "encryption",
+	routineDecryption:         "decryption",
+	routineHandshake:          "handshake",
+	routineNonce:              "nonce",
+	routineSequentialSender:   "sequential_sender",
+	routineSequentialReceiver: "sequential_receiver",
+	routineEvents:             "event_dispatcher",
+	routineSampleStats:        "sample_stats",
+	routineLANDiscovery:       "lan_discovery",
+	routinePortMapping:        "port_mapping",
+	routineRebind:             "rebind",
+	routineTuneBuffer:         "tune_receive_buffer",
+	routineRouteListener:      "route_listener",
+	routineProbeCandidates:    "probe_candidates",
+}
+
+type diagnostics struct {
+	routines         [routineKinds]int32
+	messageBuffers   int32 // taken from the pools and not yet returned
+	inboundElements  int32
+	outboundElements int32
+}
+
+// trackRoutine counts a running routine of kind, returning the function
+// the routine defers to stop counting it.
+func (device *Device) trackRoutine(kind routineKind) func() {
+	atomic.AddInt32(&device.diagnostics.routines[kind], 1)
+	return func() {
+		atomic.AddInt32(&device.diagnostics.routines[kind], -1)
+	}
+}
+
+// Diagnostics is a snapshot of the resources held by a device.
+type Diagnostics struct {
+	Goroutines int            // of the whole process
+	Routines   map[string]int // goroutines of the device by routine
+	Buffers    map[string]int // taken from each pool and not yet returned
+	Queued     map[string]int // elements waiting in the queues of the device and its peers
+	Timers     map[string]int // pending timers of all peers
+	Peers      map[string]int // peers by state, "total" counting all of them
+
+	Time       time.Time                     // when the snapshot was taken, by the clock of the device
+	PeerTimers map[NoisePublicKey]PeerTimers // next firings of the timers of each peer
+}
+
+// Diagnostics returns the resources currently held by the device.
+func (device *Device) Diagnostics() Diagnostics {
+	diag := Diagnostics{
+		Goroutines: runtime.NumGoroutine(),
+		Routines:   make(map[string]int),
+		Buffers: map[string]int{
+			"message":          int(atomic.LoadInt32(&device.diagnostics.messageBuffers)),
+			"inbound_element":  int(atomic.LoadInt32(&device.diagnostics.inboundElements)),
+			"outbound_element": int(atomic.LoadInt32(&device.diagnostics.outboundElements)),
+		},
+		Queued: map[string]int{
+			"decryption": len(device.queue.decryption),
+			"handshake":  len(device.queue.handshake),
+			"encryption": 0,
+			"nonce":      0,
+			"priority":   0,
+			"outbound":   0,
+			"inbound":    0,
+		},
+		Timers: map[string]int{
+			"retransmit_handshake": 0,
+			"send_keepalive":       0,
+			"new_handshake":        0,
+			"zero_key_material":    0,
+			"persistent_keepalive": 0,
+		},
+		Peers: map[string]int{
+			"total":        0,
+			"running":      0,
+			"with_session": 0,
+			"handshaking":  0,
+		},
+		Time:       device.now(),
+		PeerTimers: make(map[NoisePublicKey]PeerTimers),
+	}
+	for kind, name := range routineNames {
+		diag.Routines[name] = int(atomic.LoadInt32(&device.diagnostics.routines[kind]))
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		diag.Peers["total"]++
+		if peer.isRunning.Get() {
+			diag.Peers["running"]++
+		}
+		peer.keypairs.RLock()
+		if peer.keypairs.current != nil {
+			diag.Peers["with_session"]++
+		}
+		peer.keypairs.RUnlock()
+		if peer.timers.retransmitHandshake.IsPending() {
+			diag.Peers["handshaking"]++
+		}
+
+		diag.PeerTimers[peer.handshake.remoteStatic] = peer.Timers()
+
+		diag.Queued["encryption"] += len(peer.encryption.queue)
+		diag.Queued["nonce"] += len(peer.queue.nonce)
+		diag.Queued["priority"] += len(peer.queue.priority)
+		diag.Queued["outbound"] += peer.queue.outbound.len()
+		diag.Queued["inbound"] += peer.queue.inbound.len()
+
+		for name, timer := range map[string]*Timer{
+			"retransmit_handshake": peer.timers.retransmitHandshake,
+			"send_keepalive":       peer.timers.sendKeepalive,
+			"new_handshake":        peer.timers.newHandshake,
+			"zero_key_material":    peer.timers.zeroKeyMaterial,
+			"persistent_keepalive": peer.timers.persistentKeepalive,
+		} {
+			if timer.IsPending() {
+				diag.Timers[name]++
+			}
+		}
+	}
+	return diag
+}
+
+// WriteTo writes diag as sorted key=value lines, such as routine_nonce=2.
+func (diag Diagnostics) WriteTo(w io.Writer) (int64, error) {
+	lines := []string{fmt.Sprintf("goroutines=%d", diag.Goroutines)}
+	for _, group := range []struct {
+		prefix string
+		counts map[string]int
+	}{
+		{"routine_", diag.Routines},
+		{"buffers_", diag.Buffers},
+		{"queued_", diag.Queued},
+		{"timer_", diag.Timers},
+		{"peers_", diag.Peers},
+	} {
+		var keys []string
+		for key := range group.counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%s%s=%d", group.prefix, key, group.counts[key]))
+		}
+	}
+
+	var peers []string
+	timersByPeer := make(map[string]PeerTimers)
+	for pk, timers := range diag.PeerTimers {
+		key := pk.ToHex()
+		peers = append(peers, key)
+		timersByPeer[key] = timers
+	}
+	sort.Strings(peers)
+	for _, key := range peers {
+		timers := timersByPeer[key]
+		lines = append(lines, "public_key="+key)
+		for _, next := range []struct {
+			name string
+			at   time.Time
+		}{
+			{"retransmit_handshake", timers.RetransmitHandshake},
+			{"keepalive", timers.Keepalive},
+			{"new_handshake", timers.NewHandshake},
+			{"zero_key_material", timers.ZeroKeyMaterial},
+			{"persistent_keepalive", timers.PersistentKeepalive},
+			{"rekey", timers.Rekey},
+			{"session_expiry", timers.SessionExpiry},
+			{"quiet_until", timers.QuietUntil},
+		} {
+			if !next.at.IsZero() {
+				lines = append(lines, fmt.Sprintf("next_%s_ms=%d", next.name, next.at.Sub(diag.Time).Milliseconds()))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("handshake_attempts=%d", timers.HandshakeAttempts))
+	}
+	n, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return int64(n), err
+}
+
+func (diag Diagnostics) String() string {
+	var b strings.Builder
+	diag.WriteTo(&b)
+	return b.String()
+}
@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* Peers may be disabled for a temporary administrative suspension. A
+ * disabled peer keeps its configuration, allowed IPs included, but is
+ * stopped: its sessions are dropped, packets to and from it are dropped
+ * and handshakes with it are neither sent nor answered until it is
+ * enabled again.
+ */
+
+// Disable suspends peer, see Device.DisablePeer.
+func (peer *Peer) Disable() {
+	if peer.disabled.Swap(true) {
+		return
+	}
+	peer.Stop()
+	peer.log.Info.Println(peer, "- Disabled")
+}
+
+// Enable lifts the suspension of peer, starting it if the device is up.
+func (peer *Peer) Enable() {
+	if !peer.disabled.Swap(false) {
+		return
+	}
+	peer.log.Info.Println(peer, "- Enabled")
+	if peer.device.isUp.Get() {
+		peer.Start()
+	}
+}
+
+// Disabled reports whether peer is suspended.
+func (peer *Peer) Disabled() bool {
+	return peer.disabled.Get()
+}
+
+// DisablePeer suspends the peer with public key pk, keeping its
+// configuration but dropping its traffic and handshakes.
+func (device *Device) DisablePeer(pk NoisePublicKey) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.Disable()
+	return nil
+}
+
+// EnablePeer lifts the suspension of the peer with public key pk.
+func (device *Device) EnablePeer(pk NoisePublicKey) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.Enable()
+	return nil
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestDisablePeer(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	pk := pair[1].key.publicKey()
+	assertNil(t, pair[0].dev.IpcSet("public_key="+pk.ToHex()+"\nupdate_only=true\ndisabled=true\n"))
+
+	config, err := pair[0].dev.IpcGetConfig()
+	assertNil(t, err)
+	if peer := config.Peers[0]; peer.Disabled == nil || !*peer.Disabled || len(peer.AllowedIPs) != 1 {
+		t.Errorf("disabled peer reported as %+v", peer)
+	}
+
+	// no traffic in either direction, nor handshakes
+
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].addr, pair[0].addr)
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].addr, pair[1].addr)
+	select {
+	case <-pair[1].tun.Inbound:
+		t.Fatal("packet sent to disabled peer")
+	case <-pair[0].tun.Inbound:
+		t.Fatal("packet received from disabled peer")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if pair[0].dev.LookupPeer(pk).keypairs.Current() != nil {
+		t.Error("disabled peer has a session")
+	}
+
+	// enabling restores the peer as configured
+
+	assertNil(t, pair[0].dev.EnablePeer(pk))
+	if pair[0].dev.LookupPeer(pk).Disabled() {
+		t.Fatal("peer still disabled")
+	}
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].addr, pair[0].addr)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not sent to enabled peer")
+	}
+
+	var unknown NoisePrivateKey
+	if err := pair[0].dev.DisablePeer(unknown.publicKey()); err != ErrPeerNotFound {
+		t.Errorf("disabling unknown peer: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* LAN discovery
+ *
+ * Devices announce their public key and listen port to an IPv4
+ * multicast group every DiscoveryInterval. Announcements of peers
+ * which are not configured yet are collected as candidates, each
+ * reported by EventPeerDiscovered, for the application to approve.
+ *
+ * Announcements are not authenticated: anyone on the LAN may announce
+ * any public key. Approving a candidate only sets its endpoint though,
+ * a handshake with the key still has to succeed before data flows.
+ */
+
+// DiscoveryGroup is the multicast group announcements are sent to.
+var DiscoveryGroup = net.IPv4(239, 255, 51, 82)
+
+var discoveryMagic = [4]byte{'W', 'G', 'L', 'D'}
+
+const discoveryMessageSize = 4 + NoisePublicKeySize + 2
+
+// DiscoveredPeer is a candidate peer which announced itself on the LAN.
+type DiscoveredPeer struct {
+	PublicKey NoisePublicKey
+	Endpoint  string    // announced listen port at the source address of the announcement
+	LastSeen  time.Time // time of the latest announcement
+}
+
+type discovery struct {
+	sync.Mutex
+	candidates map[NoisePublicKey]DiscoveredPeer
+	announce   chan struct{} // nil unless DeviceOptions.LANDiscovery is set
+}
+
+// trigger makes the device announce itself without waiting for the
+// next DiscoveryInterval.
+func (discovery *discovery) trigger() {
+	if discovery.announce == nil {
+		return
+	}
+	select {
+	case discovery.announce <- struct{}{}:
+	default:
+	}
+}
+
+func discoveryMessage(pk NoisePublicKey, port uint16) []byte {
+	msg := make([]byte, discoveryMessageSize)
+	copy(msg, discoveryMagic[:])
+	copy(msg[4:], pk[:])
+	binary.BigEndian.PutUint16(msg[4+NoisePublicKeySize:], port)
+	return msg
+}
+
+// announce sends an announcement once the device has a key and a port.
+func (device *Device) announce(sock *net.UDPConn) {
+	device.staticIdentity.RLock()
+	pk := device.staticIdentity.publicKey
+	isZero := device.staticIdentity.privateKey.IsZero()
+	device.staticIdentity.RUnlock()
+
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	if isZero || port == 0 {
+		return
+	}
+	group := &net.UDPAddr{IP: DiscoveryGroup, Port: DiscoveryPort}
+	if _, err := sock.WriteToUDP(discoveryMessage(pk, port), group); err != nil {
+		device.log.Debug.Println("Failed to send LAN announcement:", err)
+	}
+}
+
+// receiveAnnouncement records the sender of msg as a candidate, unless
+// it is the device itself or a configured peer.
+func (device *Device) receiveAnnouncement(msg []byte, from *net.UDPAddr, now time.Time) {
+	if len(msg) != discoveryMessageSize || !bytes.Equal(msg[:4], discoveryMagic[:]) {
+		return
+	}
+	var pk NoisePublicKey
+	copy(pk[:], msg[4:])
+	port := binary.BigEndian.Uint16(msg[4+NoisePublicKeySize:])
+	if port == 0 || pk.IsZero() {
+		return
+	}
+
+	device.staticIdentity.RLock()
+	self := pk.Equals(device.staticIdentity.publicKey)
+	device.staticIdentity.RUnlock()
+	if self || device.LookupPeer(pk) != nil {
+		return
+	}
+
+	endpoint := net.JoinHostPort(from.IP.String(), strconv.Itoa(int(port)))
+
+	device.discovery.Lock()
+	if device.discovery.candidates == nil {
+		device.discovery.candidates = make(map[NoisePublicKey]DiscoveredPeer)
+	}
+	previous, known := device.discovery.candidates[pk]
+	if !known && len(device.discovery.candidates) >= MaxDiscoveredPeers {
+		device.unsafeExpireCandidates(now)
+		if len(device.discovery.candidates) >= MaxDiscoveredPeers {
+			device.discovery.Unlock()
+			return
+		}
+	}
+	device.discovery.candidates[pk] = DiscoveredPeer{
+		PublicKey: pk,
+		Endpoint:  endpoint,
+		LastSeen:  now,
+	}
+	device.discovery.Unlock()
+
+	if !known || previous.Endpoint != endpoint {
+		device.log.Info.Println("Discovered peer", device.redactKey(pk), "on LAN at", device.redactEndpoint(endpoint))
+		device.emitEvent(Event{Kind: EventPeerDiscovered, Time: now, Peer: pk, Endpoint: endpoint})
+	}
+}
+
+func (device *Device) unsafeExpireCandidates(now time.Time) {
+	for pk, candidate := range device.discovery.candidates {
+		if now.Sub(candidate.LastSeen) > DiscoveryExpiry {
+			delete(device.discovery.candidates, pk)
+		}
+	}
+}
+
+// DiscoveredPeers returns the candidates which announced themselves
+// within DiscoveryExpiry and are not configured.
+func (device *Device) DiscoveredPeers() []DiscoveredPeer {
+	device.discovery.Lock()
+	defer device.discovery.Unlock()
+
+	device.unsafeExpireCandidates(time.Now())
+	peers := make([]DiscoveredPeer, 0, len(device.discovery.candidates))
+	for pk, candidate := range device.discovery.candidates {
+		if device.LookupPeer(pk) == nil {
+			peers = append(peers, candidate)
+		}
+	}
+	return peers
+}
+
+// ApproveDiscoveredPeer adds the candidate identified by pk as a peer
+// with the endpoint it announced. Its allowed IPs are up to the caller.
+func (device *Device) ApproveDiscoveredPeer(pk NoisePublicKey) (*Peer, error) {
+	device.discovery.Lock()
+	candidate, ok := device.discovery.candidates[pk]
+	if ok && time.Since(candidate.LastSeen) > DiscoveryExpiry {
+		ok = false
+	}
+	delete(device.discovery.candidates, pk)
+	device.discovery.Unlock()
+	if !ok {
+		return nil, ErrPeerNotFound
+	}
+
+	endpoint, err := conn.CreateEndpoint(candidate.Endpoint)
+	if err != nil {
+		return nil, ErrInvalidEndpoint
+	}
+	peer, err := device.NewPeer(pk)
+	if err != nil {
+		return nil, err
+	}
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+	peer.tagEndpoint(endpoint)
+	return peer, nil
+}
+
+/* Announces the device and collects candidate peers on the LAN
+ *
+ * Obs. Only runs if DeviceOptions.LANDiscovery is set
+ */
+func (device *Device) RoutineLANDiscovery() {
+	defer device.trackRoutine(routineLANDiscovery)()
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: LAN discovery - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: LAN discovery - started")
+	device.state.starting.Done()
+
+	sock, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: DiscoveryGroup, Port: DiscoveryPort})
+	if err != nil {
+		device.log.Error.Println("Failed to join LAN discovery group:", err)
+		return
+	}
+
+	// the group socket does not loop back, devices on this host listen too
+
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		sock.Close()
+		device.log.Error.Println("Failed to open LAN discovery socket:", err)
+		return
+	}
+	defer sender.Close()
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		var buff [discoveryMessageSize + 1]byte
+		for {
+			n, from, err := sock.ReadFromUDP(buff[:])
+			if err != nil {
+				return
+			}
+			device.receiveAnnouncement(buff[:n], from, time.Now())
+		}
+	}()
+
+	ticker := time.NewTicker(DiscoveryInterval)
+	defer ticker.Stop()
+
+	device.announce(sender)
+	for {
+		select {
+		case <-device.signals.stop:
+			sock.Close()
+			<-received
+			return
+		case <-ticker.C:
+			device.announce(sender)
+		case <-device.discovery.announce:
+			device.announce(sender)
+		}
+	}
+}
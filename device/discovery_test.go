@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLANDiscoveryCandidates(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: DiscoveryPort}
+	now := time.Now()
+
+	// own and malformed announcements are ignored
+
+	dev.receiveAnnouncement(discoveryMessage(dev.staticIdentity.publicKey, 51820), from, now)
+	dev.receiveAnnouncement(discoveryMessage(pk, 51820)[1:], from, now)
+	if peers := dev.DiscoveredPeers(); len(peers) != 0 {
+		t.Fatalf("unexpected candidates %+v", peers)
+	}
+
+	dev.receiveAnnouncement(discoveryMessage(pk, 51820), from, now)
+	dev.receiveAnnouncement(discoveryMessage(pk, 51820), from, now.Add(time.Second))
+	select {
+	case event := <-events:
+		if event.Kind != EventPeerDiscovered || !event.Peer.Equals(pk) || event.Endpoint != "192.0.2.7:51820" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("repeated announcement reported: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	peers := dev.DiscoveredPeers()
+	if len(peers) != 1 || !peers[0].PublicKey.Equals(pk) {
+		t.Fatalf("unexpected candidates %+v", peers)
+	}
+
+	peer, err := dev.ApproveDiscoveredPeer(pk)
+	assertNil(t, err)
+	peer.RLock()
+	endpoint := peer.endpoint.DstToString()
+	peer.RUnlock()
+	if endpoint != "192.0.2.7:51820" {
+		t.Errorf("endpoint of approved peer is %s", endpoint)
+	}
+	if peers := dev.DiscoveredPeers(); len(peers) != 0 {
+		t.Errorf("approved peer still a candidate: %+v", peers)
+	}
+
+	// configured peers are no candidates
+
+	dev.receiveAnnouncement(discoveryMessage(pk, 51820), from, now)
+	if _, err := dev.ApproveDiscoveredPeer(pk); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* The drop monitor diagnoses silent blackholes
+ *
+ * Once enabled, every packet dropped along the pipeline is counted by
+ * reason, and one in every so many per reason is recorded along with
+ * the start of its header, the inner IP header for packets read from
+ * the TUN device or decrypted, the message header otherwise. Records
+ * are kept in a ring of DropMonitorSize. While disabled, dropping a
+ * packet costs a single atomic load.
+ */
+
+type DropReason int
+
+const (
+	DropNoRoute          DropReason = iota // no peer has the destination in its allowed IPs
+	DropNoSession                          // transport message for an unknown or expired session
+	DropInvalidMAC                         // handshake message with an invalid mac1
+	DropReplay                             // transport message counter seen before or too old
+	DropDecryption                         // transport message failing authentication
+	DropDisallowedSource                   // inner source address outside the allowed IPs of the peer
+	DropQueueFull                          // a queue along the pipeline was full
+	DropFiltered                           // datagram from a source outside the receive allowlist
+	DropOverQuota                          // packet to or from a peer which exceeded its quota, see Peer.SetQuota
+	dropReasons
+)
+
+var dropReasonNames = [dropReasons]string{
+	DropNoRoute:          "no_route",
+	DropNoSession:        "no_session",
+	DropInvalidMAC:       "invalid_mac",
+	DropReplay:           "replay",
+	DropDecryption:       "decryption",
+	DropDisallowedSource: "disallowed_source",
+	DropQueueFull:        "queue_full",
+	DropFiltered:         "filtered",
+	DropOverQuota:        "over_quota",
+}
+
+func (reason DropReason) String() string {
+	if reason < 0 || reason >= dropReasons {
+		return fmt.Sprintf("DropReason(UNKNOWN:%d)", int(reason))
+	}
+	return dropReasonNames[reason]
+}
+
+// DroppedPacket is the record of a packet dropped by the device.
+type DroppedPacket struct {
+	Time   time.Time
+	Reason DropReason
+	Peer   NoisePublicKey // zero if the packet could not be attributed to a peer
+	Header []byte         // up to DropSnippetSize bytes from the start of the packet
+}
+
+type dropMonitor struct {
+	sync.Mutex
+	sampleEvery uint32 // records one in every sampleEvery drops per reason, zero while disabled, accessed atomically
+	counts      [dropReasons]uint64
+	records     []DroppedPacket // ring of at most DropMonitorSize
+	next        int             // where the next record goes once the ring is full
+}
+
+// SetDropMonitor records one in every sampleEvery packets dropped for
+// each reason, counting them all. Zero disables the monitor, keeping
+// what it recorded.
+func (device *Device) SetDropMonitor(sampleEvery int) error {
+	if sampleEvery < 0 {
+		return fmt.Errorf("%w: drop monitor sampling %d", ErrInvalidValue, sampleEvery)
+	}
+	atomic.StoreUint32(&device.drops.sampleEvery, uint32(sampleEvery))
+	return nil
+}
+
+// DroppedPackets returns the recorded drops, oldest first.
+func (device *Device) DroppedPackets() []DroppedPacket {
+	drops := &device.drops
+	drops.Lock()
+	defer drops.Unlock()
+	records := make([]DroppedPacket, 0, len(drops.records))
+	records = append(records, drops.records[drops.next:]...)
+	return append(records, drops.records[:drops.next]...)
+}
+
+// DropCounts returns the number of packets dropped for each reason
+// while the monitor was enabled.
+func (device *Device) DropCounts() map[DropReason]uint64 {
+	drops := &device.drops
+	drops.Lock()
+	defer drops.Unlock()
+	counts := make(map[DropReason]uint64, dropReasons)
+	for reason, count := range drops.counts {
+		counts[DropReason(reason)] = count
+	}
+	return counts
+}
+
+// dropped tells the monitor packet was dropped for reason, peer being
+// nil if unknown.
+func (device *Device) dropped(reason DropReason, peer *Peer, packet []byte) {
+	sampleEvery := uint64(atomic.LoadUint32(&device.drops.sampleEvery))
+	if sampleEvery == 0 {
+		return
+	}
+
+	drops := &device.drops
+	drops.Lock()
+	defer drops.Unlock()
+
+	drops.counts[reason]++
+	if (drops.counts[reason]-1)%sampleEvery != 0 {
+		return
+	}
+	if len(packet) > DropSnippetSize {
+		packet = packet[:DropSnippetSize]
+	}
+	record := DroppedPacket{
+		Time:   time.Now(),
+		Reason: reason,
+		Header: append([]byte(nil), packet...),
+	}
+	if peer != nil {
+		record.Peer = peer.handshake.remoteStatic
+	}
+	if len(drops.records) < DropMonitorSize {
+		drops.records = append(drops.records, record)
+		return
+	}
+	drops.records[drops.next] = record
+	drops.next = (drops.next + 1) % DropMonitorSize
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDropMonitorSampling(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	dev.dropped(DropReplay, nil, []byte{1})
+	if len(dev.DroppedPackets()) != 0 || dev.DropCounts()[DropReplay] != 0 {
+		t.Fatal("drop recorded while the monitor is disabled")
+	}
+
+	assertNil(t, dev.SetDropMonitor(3))
+	for i := 0; i < DropMonitorSize*3+6; i++ {
+		dev.dropped(DropReplay, nil, []byte{byte(i)})
+	}
+	dev.dropped(DropNoRoute, nil, make([]byte, DropSnippetSize*2))
+
+	if counts := dev.DropCounts(); counts[DropReplay] != DropMonitorSize*3+6 || counts[DropNoRoute] != 1 {
+		t.Errorf("DropCounts() = %v", counts)
+	}
+	records := dev.DroppedPackets()
+	if len(records) != DropMonitorSize {
+		t.Fatalf("%d drops recorded, want %d", len(records), DropMonitorSize)
+	}
+
+	// the oldest records were overwritten, one in three replays was kept
+
+	if first := records[0]; first.Reason != DropReplay || first.Header[0] != byte(9) {
+		t.Errorf("oldest record %v %v, want replay of packet 9", first.Reason, first.Header)
+	}
+	if last := records[len(records)-1]; last.Reason != DropNoRoute || len(last.Header) != DropSnippetSize {
+		t.Errorf("newest record %v with %d bytes, want no route with %d", last.Reason, len(last.Header), DropSnippetSize)
+	}
+
+	if err := dev.SetDropMonitor(-1); err == nil {
+		t.Error("negative sampling accepted")
+	}
+}
+
+func TestDropMonitor(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	assertNil(t, pair[0].dev.SetDropMonitor(1))
+	assertNil(t, pair[1].dev.SetDropMonitor(1))
+
+	// a packet nobody routes and one from outside the allowed IPs
+
+	unrouted := udpPacket(net.IPv4(10, 0, 0, 1), pair[0].addr, 128)
+	spoofed := udpPacket(pair[1].addr, net.IPv4(10, 0, 0, 2), 128)
+	pair[0].tun.Outbound <- unrouted
+	pair[0].tun.Outbound <- spoofed
+
+	expect := func(dev *Device, reason DropReason, peer NoisePublicKey, packet []byte) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, record := range dev.DroppedPackets() {
+				if record.Reason == reason {
+					if record.Peer != peer || !bytes.Equal(record.Header, packet[:DropSnippetSize]) {
+						t.Errorf("%v drop recorded as %+v", reason, record)
+					}
+					return
+				}
+			}
+		}
+		t.Fatalf("%v drop not recorded", reason)
+	}
+	expect(pair[0].dev, DropNoRoute, NoisePublicKey{}, unrouted)
+	expect(pair[1].dev, DropDisallowedSource, pair[0].key.publicKey(), spoofed)
+}
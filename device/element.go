@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Per-packet state
+ *
+ * Every transport packet in flight, received or sent, is carried by a
+ * QueueElement taken from a single pool of the device. The fields read
+ * by the workers and the sequential routines for every packet come
+ * first, so that they share the first cache line of the element, and
+ * the fields only one direction uses follow.
+ *
+ * With preallocated pools, the free elements are chained through the
+ * elements themselves, so that taking and returning one touches no
+ * memory but the element and the head of the list.
+ */
+
+type QueueElement struct {
+	dropped  int32
+	done     int32                 // released by the worker or abandoned by the consumer, see orderedRing
+	keypair  *Keypair              // keypair of the transport message
+	buffer   *[MaxMessageSize]byte // holding the packet data
+	packet   []byte                // slice of "buffer" (always!)
+	nonce    uint64                // counter of the transport message
+	peer     *Peer                 // related peer, outbound
+	endpoint conn.Endpoint         // source, inbound
+	flow     uint16                // flow port to send from, zero for the listen port, outbound
+	high     bool                  // staged in the priority queue, see PacketPriority, outbound
+	ring     *orderedRing          // queued to, see orderedRing
+	next     *QueueElement         // in the free list
+	working  bool                  // counted as work until put back, outbound, see Device.Working
+}
+
+// The element types of each direction are the same, keeping the pool
+// and the memory layout shared.
+type (
+	QueueInboundElement  = QueueElement
+	QueueOutboundElement = QueueElement
+)
+
+func (elem *QueueElement) Drop() {
+	atomic.StoreInt32(&elem.dropped, AtomicTrue)
+}
+
+func (elem *QueueElement) IsDropped() bool {
+	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
+}
+
+// reset readies an element taken from the pool to carry buffer.
+func (elem *QueueElement) reset(buffer *[MaxMessageSize]byte) {
+	*elem = QueueElement{buffer: buffer}
+}
+
+// An elementFreelist holds preallocated elements, chained through
+// their next field. Taking an element waits for one to be returned if
+// the list is empty.
+type elementFreelist struct {
+	mutex    sync.Mutex
+	returned sync.Cond
+	head     *QueueElement
+	waiting  int // routines waiting in get
+}
+
+func newElementFreelist(count int) *elementFreelist {
+	list := &elementFreelist{}
+	list.returned.L = &list.mutex
+	elems := make([]QueueElement, count)
+	for i := range elems {
+		list.head, elems[i].next = &elems[i], list.head
+	}
+	return list
+}
+
+func (list *elementFreelist) get() *QueueElement {
+	list.mutex.Lock()
+	for list.head == nil {
+		list.waiting++
+		list.returned.Wait()
+		list.waiting--
+	}
+	elem := list.head
+	list.head = elem.next
+	list.mutex.Unlock()
+	elem.next = nil
+	return elem
+}
+
+func (list *elementFreelist) put(elem *QueueElement) {
+	list.mutex.Lock()
+	elem.next = list.head
+	list.head = elem
+	if list.waiting > 0 {
+		list.returned.Signal()
+	}
+	list.mutex.Unlock()
+}
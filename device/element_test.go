@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestElementLayout(t *testing.T) {
+	var elem QueueElement
+	if end := unsafe.Offsetof(elem.nonce) + unsafe.Sizeof(elem.nonce); end > 64 {
+		t.Errorf("fields used by every packet end at byte %d, past the first cache line", end)
+	}
+}
+
+func TestElementFreelist(t *testing.T) {
+	list := newElementFreelist(2)
+	a, b := list.get(), list.get()
+	if a == b || a == nil || b == nil {
+		t.Fatalf("got elements %p and %p", a, b)
+	}
+
+	// an empty list waits for an element to be returned
+
+	taken := make(chan *QueueElement)
+	go func() {
+		taken <- list.get()
+	}()
+	select {
+	case <-taken:
+		t.Fatal("took an element from an empty list")
+	default:
+	}
+	list.put(a)
+	if elem := <-taken; elem != a {
+		t.Errorf("took %p, want the returned %p", elem, a)
+	}
+}
+
+func benchmarkElements(b *testing.B, preallocated int) {
+	device := &Device{}
+	device.queueSizes.preallocated = preallocated
+	device.PopulatePools()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			device.PutOutboundElement(device.newOutboundElement(nil))
+		}
+	})
+}
+
+func BenchmarkElementPool(b *testing.B) {
+	benchmarkElements(b, 0)
+}
+
+func BenchmarkElementFreelist(b *testing.B) {
+	benchmarkElements(b, 1024)
+}
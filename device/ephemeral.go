@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Ephemeral peers, for clients provisioned for a short while, such as
+ * the laptops on a conference network or CI runners, which are never
+ * removed explicitly. An ephemeral peer is removed once it completed no
+ * handshake for its timeout, counted from the last handshake or from
+ * when it was made ephemeral, emitting EventPeerInactive.
+ */
+
+type peerEphemeral struct {
+	sync.Mutex
+	timeout time.Duration // zero if the peer is not ephemeral
+	since   time.Time     // when the peer was made ephemeral
+	timer   ClockTimer
+}
+
+// SetEphemeral makes the device remove peer once it completed no
+// handshake for timeout. A zero timeout makes the peer permanent.
+func (peer *Peer) SetEphemeral(timeout time.Duration) {
+	peer.ephemeral.Lock()
+	defer peer.ephemeral.Unlock()
+
+	if peer.ephemeral.timer != nil {
+		peer.ephemeral.timer.Stop()
+		peer.ephemeral.timer = nil
+	}
+	peer.ephemeral.timeout = timeout
+	peer.ephemeral.since = peer.device.now()
+	if timeout > 0 {
+		peer.ephemeral.timer = peer.device.clock.AfterFunc(timeout, func() {
+			peer.device.collectEphemeral(peer)
+		})
+	}
+}
+
+// Ephemeral returns the timeout after which peer is removed without a
+// handshake, zero if it is permanent.
+func (peer *Peer) Ephemeral() time.Duration {
+	peer.ephemeral.Lock()
+	defer peer.ephemeral.Unlock()
+	return peer.ephemeral.timeout
+}
+
+// unsafeInactiveFor returns how long the ephemeral peer completed no
+// handshake for. The ephemeral lock must be held.
+func (peer *Peer) unsafeInactiveFor() time.Duration {
+	last := peer.ephemeral.since
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 && time.Unix(0, nano).After(last) {
+		last = time.Unix(0, nano)
+	}
+	return peer.device.since(last)
+}
+
+func (peer *Peer) stopEphemeral() {
+	peer.ephemeral.Lock()
+	defer peer.ephemeral.Unlock()
+	if peer.ephemeral.timer != nil {
+		peer.ephemeral.timer.Stop()
+		peer.ephemeral.timer = nil
+	}
+}
+
+// SetPeerEphemeral sets the timeout of the peer with public key pk, see
+// Peer.SetEphemeral.
+func (device *Device) SetPeerEphemeral(pk NoisePublicKey, timeout time.Duration) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetEphemeral(timeout)
+	return nil
+}
+
+// collectEphemeral removes peer if it is inactive for its timeout, and
+// otherwise checks again once it would be.
+func (device *Device) collectEphemeral(peer *Peer) {
+	key := peer.handshake.remoteStatic
+
+	device.peers.Lock()
+	if device.peers.keyMap[key] != peer {
+		device.peers.Unlock()
+		return
+	}
+	peer.ephemeral.Lock()
+	timeout := peer.ephemeral.timeout
+	if timeout == 0 || peer.ephemeral.timer == nil {
+		peer.ephemeral.Unlock()
+		device.peers.Unlock()
+		return
+	}
+	if inactive := peer.unsafeInactiveFor(); inactive < timeout {
+		peer.ephemeral.timer.Reset(timeout - inactive)
+		peer.ephemeral.Unlock()
+		device.peers.Unlock()
+		return
+	}
+	peer.ephemeral.Unlock()
+	unsafeRemovePeer(device, peer, key)
+	device.peers.Unlock()
+
+	device.log.Info.Println(peer, "- Inactive for", timeout, "and removed")
+	device.emitEvent(Event{Kind: EventPeerInactive, Peer: key})
+}
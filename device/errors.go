@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "errors"
+
+/* Errors returned by device and IPC operations
+ *
+ * Errors from the UAPI set operation are *IPCLineError values,
+ * which wrap an *IPCError carrying the UAPI errno, which in turn
+ * wraps one of the values below. Use errors.Is to branch on them.
+ */
+
+var (
+	ErrDeviceClosed     = errors.New("device closed")
+	ErrTooManyPeers     = errors.New("too many peers")
+	ErrTooManyAllowedIP = errors.New("too many allowed ips")
+	ErrPeerExists       = errors.New("adding existing peer")
+	ErrPeerNotFound     = errors.New("peer not found")
+	ErrNoBind           = errors.New("no bind")
+	ErrNoEndpoint       = errors.New("no known endpoint for peer")
+	ErrPortInUse        = errors.New("unable to bind listen port")
+	ErrMalformedLine    = errors.New("malformed configuration line")
+	ErrUnknownConfigKey = errors.New("unknown configuration key")
+	ErrInvalidValue     = errors.New("invalid value")
+	ErrInvalidKey       = errors.New("invalid key")
+	ErrInvalidEndpoint  = errors.New("invalid endpoint")
+	ErrInvalidAllowedIP = errors.New("invalid allowed ip")
+	ErrUnsupported      = errors.New("unsupported by this device")
+	ErrUnhealthy        = errors.New("device unhealthy")
+	ErrNotReady         = errors.New("device not ready")
+	ErrQueueFull        = errors.New("queue full")
+	ErrIndexTableFull   = errors.New("index table full")
+	ErrReadOnly         = errors.New("operation not permitted on monitor socket")
+	ErrPermissionDenied = errors.New("permission denied")
+)
@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EventHandshakeRetransmit        = EventKind(iota + 1) // a handshake initiation was retransmitted
+	EventHandshakeAttemptsExhausted                       // no handshake completed within RekeyAttemptTime
+	EventBindFailed                                       // the UDP bind failed persistently and is being reopened
+	EventBindRestored                                     // a failed UDP bind was reopened
+	EventUnderLoad                                        // handshakes require cookies from now on, see HandshakeStats
+	EventLoadNormal                                       // handshakes no longer require cookies
+	EventPeerDiscovered                                   // a candidate peer announced itself on the LAN, see DiscoveredPeers
+	EventPortMapped                                       // the gateway maps a new external endpoint to the listen port
+	EventPeerExpired                                      // a peer was removed as its expiry passed, see Peer.SetExpiry
+	EventHandshakeAnomaly                                 // a peer handshakes abnormally often, see PeerStats.HandshakeAnomaly
+	EventMultiLogin                                       // the key of a peer is in use on several machines, see MultiLoginPolicy
+	EventMalformedPackets                                 // an address sent many malformed packets, see MalformedSources
+	EventCandidateSelected                                // a probed candidate answered and became the endpoint of a peer, see ReceiveCandidates
+	EventPeerInactive                                     // an ephemeral peer was removed as it completed no handshake for its timeout, see Peer.SetEphemeral
+	EventThresholdCrossed                                 // a threshold on the statistics of a peer was crossed, see Peer.SetThresholds
+	EventThresholdCleared                                 // a crossed threshold no longer is
+	EventSessionKeysNeeded                                // a peer needs new session keys in data-plane-only mode, see InstallSessionKeys
+	EventQuotaExceeded                                    // a peer exceeded its data quota, see Peer.SetQuota
+	EventQuotaReset                                       // the quota a peer exceeded was reset
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case EventHandshakeRetransmit:
+		return "EventHandshakeRetransmit"
+	case EventHandshakeAttemptsExhausted:
+		return "EventHandshakeAttemptsExhausted"
+	case EventBindFailed:
+		return "EventBindFailed"
+	case EventBindRestored:
+		return "EventBindRestored"
+	case EventUnderLoad:
+		return "EventUnderLoad"
+	case EventLoadNormal:
+		return "EventLoadNormal"
+	case EventPeerDiscovered:
+		return "EventPeerDiscovered"
+	case EventPortMapped:
+		return "EventPortMapped"
+	case EventPeerExpired:
+		return "EventPeerExpired"
+	case EventHandshakeAnomaly:
+		return "EventHandshakeAnomaly"
+	case EventMultiLogin:
+		return "EventMultiLogin"
+	case EventMalformedPackets:
+		return "EventMalformedPackets"
+	case EventCandidateSelected:
+		return "EventCandidateSelected"
+	case EventPeerInactive:
+		return "EventPeerInactive"
+	case EventThresholdCrossed:
+		return "EventThresholdCrossed"
+	case EventThresholdCleared:
+		return "EventThresholdCleared"
+	case EventSessionKeysNeeded:
+		return "EventSessionKeysNeeded"
+	case EventQuotaExceeded:
+		return "EventQuotaExceeded"
+	case EventQuotaReset:
+		return "EventQuotaReset"
+	default:
+		return fmt.Sprintf("EventKind(UNKNOWN:%d)", int(kind))
+	}
+}
+
+// An Event describes something noteworthy that happened on the device,
+// usually related to a single peer.
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Peer     NoisePublicKey // zero for device-wide events
+	Attempts uint32         // number of handshake initiations or bind reopenings attempted so far
+	Err      error          // cause of EventBindFailed
+	Endpoint string         // announced endpoint of EventPeerDiscovered, external one of EventPortMapped, latest one of EventMultiLogin, source address of EventMalformedPackets, selected one of EventCandidateSelected
+	Packets  uint64         // malformed packets received from Endpoint within MalformedWindow
+
+	Threshold ThresholdKind // threshold of EventThresholdCrossed and EventThresholdCleared, limit exceeded of EventQuotaExceeded
+}
+
+// SetEventHandler registers a function which is called for every event
+// emitted by the device. Events are delivered sequentially from a dedicated
+// goroutine, so the handler may safely call back into the device; events
+// are dropped if the handler falls too far behind. A nil handler disables
+// event delivery.
+func (device *Device) SetEventHandler(handler func(Event)) {
+	device.events.Lock()
+	defer device.events.Unlock()
+	device.events.handler = handler
+}
+
+// SetHandshakeExhaustedHandler registers a function which is called with the
+// public key of a peer whenever it completed no handshake within
+// RekeyAttemptTime, so that supervising software can mark the peer
+// unreachable. Unlike events, these calls are never dropped: each one runs
+// in its own goroutine, so the handler may safely call back into the device.
+// A nil handler disables the calls.
+func (device *Device) SetHandshakeExhaustedHandler(handler func(NoisePublicKey)) {
+	device.events.Lock()
+	defer device.events.Unlock()
+	device.events.exhausted = handler
+}
+
+func (device *Device) handshakeExhausted(peer *Peer) {
+	device.events.RLock()
+	handler := device.events.exhausted
+	device.events.RUnlock()
+	if handler != nil {
+		go handler(peer.handshake.remoteStatic)
+	}
+}
+
+func (device *Device) emitEvent(event Event) {
+	device.events.RLock()
+	enabled := device.events.handler != nil
+	device.events.RUnlock()
+	if !enabled {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = device.now()
+	}
+	select {
+	case device.events.queue <- event:
+	default:
+		device.log.Debug.Println("Event queue full, dropping", event.Kind)
+	}
+}
+
+/* Delivers events to the registered handler
+ *
+ * Obs. Single instance per device
+ */
+func (device *Device) RoutineEventDispatcher() {
+	defer device.trackRoutine(routineEvents)()
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: event dispatcher - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: event dispatcher - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+
+		case event := <-device.events.queue:
+			device.events.RLock()
+			handler := device.events.handler
+			device.events.RUnlock()
+			if handler != nil {
+				handler(event)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestHandshakeRetransmitEvents(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	assertNil(t, err)
+
+	nextEvent := func() Event {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return Event{}
+	}
+
+	expiredRetransmitHandshake(peer)
+	event := nextEvent()
+	if event.Kind != EventHandshakeRetransmit || event.Attempts != 2 || !event.Peer.Equals(pk) {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+	expiredRetransmitHandshake(peer)
+	event = nextEvent()
+	if event.Kind != EventHandshakeAttemptsExhausted {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	stats, ok := dev.PeerStats(pk)
+	if !ok {
+		t.Fatal("peer not found")
+	}
+	if stats.HandshakeRetransmits != 1 || stats.HandshakeAttemptsExhausted != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandshakeExhaustedHandler(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	// a handler too slow for the event queue still sees every exhaustion
+	block := make(chan struct{})
+	defer close(block)
+	dev.SetEventHandler(func(Event) { <-block })
+	exhausted := make(chan NoisePublicKey)
+	dev.SetHandshakeExhaustedHandler(func(pk NoisePublicKey) {
+		exhausted <- pk
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	assertNil(t, err)
+
+	rounds := 2 * QueueEventSize
+	for i := 0; i < rounds; i++ {
+		atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+		expiredRetransmitHandshake(peer)
+	}
+	for i := 0; i < rounds; i++ {
+		select {
+		case got := <-exhausted:
+			if !got.Equals(pk) {
+				t.Fatalf("handler called for %v, want %v", got, pk)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler called %d times, want %d", i, rounds)
+		}
+	}
+}
+
+func TestQuiesceSuppressesRetransmits(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	dev.Quiesce(time.Hour)
+	expiredRetransmitHandshake(peer)
+	if stats := peer.Stats(); stats.HandshakeRetransmits != 0 {
+		t.Errorf("handshake retransmitted while quiet: %+v", stats)
+	}
+
+	dev.Quiesce(0)
+	expiredRetransmitHandshake(peer)
+	if stats := peer.Stats(); stats.HandshakeRetransmits != 1 {
+		t.Errorf("handshake not retransmitted after quiet period: %+v", stats)
+	}
+}
+
+// failingBind receives nothing until fail is closed, after which
+// receiving reports the socket as gone. Sending fails with sendErr.
+type failingBind struct {
+	fail      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	sendErr   error
+}
+
+func newFailingBind() *failingBind {
+	return &failingBind{fail: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (b *failingBind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, error) {
+	select {
+	case <-b.fail:
+		return 0, nil, syscall.EBADF
+	case <-b.closed:
+		return 0, nil, errors.New("bind closed")
+	}
+}
+
+func (b *failingBind) ReceiveIPv6(buff []byte) (int, conn.Endpoint, error) {
+	return 0, nil, syscall.EAFNOSUPPORT
+}
+
+func (b *failingBind) Send(buff []byte, ep conn.Endpoint) error { return b.sendErr }
+func (b *failingBind) SetMark(mark uint32) error                { return nil }
+func (b *failingBind) LastMark() uint32                         { return 0 }
+
+func (b *failingBind) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+func TestRebindAfterReceiveError(t *testing.T) {
+	var binds []*failingBind
+	var mu sync.Mutex
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			bind := newFailingBind()
+			binds = append(binds, bind)
+			return bind, port, nil
+		},
+	})
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	dev.Up()
+
+	mu.Lock()
+	close(binds[0].fail)
+	mu.Unlock()
+
+	for _, want := range []EventKind{EventBindFailed, EventBindRestored} {
+		select {
+		case event := <-events:
+			if event.Kind != want {
+				t.Fatalf("got event %+v, want %v", event, want)
+			}
+			if want == EventBindFailed && !errors.Is(event.Err, syscall.EBADF) {
+				t.Errorf("EventBindFailed caused by %v, want EBADF", event.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(binds) != 2 {
+		t.Errorf("opened %d binds, want 2", len(binds))
+	}
+	if dev.Bind() != binds[len(binds)-1] {
+		t.Error("device does not use the reopened bind")
+	}
+}
+
+func TestNoRebindAfterTransientSendErrors(t *testing.T) {
+	var binds int32
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			atomic.AddInt32(&binds, 1)
+			bind := newFailingBind()
+			bind.sendErr = syscall.EMSGSIZE
+			return bind, port, nil
+		},
+	})
+	defer dev.Close()
+	dev.Up()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev.IpcSet("public_key="+sk.publicKey().ToHex()+"\nendpoint=192.0.2.1:51820\n"))
+	peer := dev.LookupPeer(sk.publicKey())
+
+	for i := 0; i < 2*RebindAfterSendErrors; i++ {
+		if err := peer.SendBuffer(make([]byte, 32)); !errors.Is(err, syscall.EMSGSIZE) {
+			t.Fatalf("send failed with %v, want EMSGSIZE", err)
+		}
+	}
+	if dev.net.rebinding.Get() || atomic.LoadUint32(&dev.net.sendErrors) != 0 || atomic.LoadInt32(&binds) != 1 {
+		t.Errorf("EMSGSIZE counted towards reopening the bind")
+	}
+
+	for _, err := range []error{syscall.EBADF, syscall.ENETDOWN, syscall.EADDRNOTAVAIL} {
+		if !bindErrorIsPersistent(err) {
+			t.Errorf("%v not taken for a dead socket", err)
+		}
+	}
+	for _, err := range []error{syscall.EMSGSIZE, syscall.EPERM, syscall.EHOSTUNREACH, syscall.EAFNOSUPPORT} {
+		if bindErrorIsPersistent(err) {
+			t.Errorf("%v taken for a dead socket", err)
+		}
+	}
+}
+
+func TestUnderLoadEvents(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	expect := func(kind EventKind) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Kind != kind {
+				t.Errorf("got event %v, want %v", event.Kind, kind)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", kind)
+		}
+	}
+
+	dev.rate.underLoadUntil.Store(time.Now().Add(time.Hour))
+	if !dev.HandshakeStats().UnderLoad {
+		t.Error("device not under load")
+	}
+	expect(EventUnderLoad)
+
+	dev.rate.underLoadUntil.Store(time.Time{})
+	if dev.HandshakeStats().UnderLoad {
+		t.Error("device still under load")
+	}
+	expect(EventLoadNormal)
+
+	if dev.addToHandshakeQueue(make(chan QueueHandshakeElement), QueueHandshakeElement{}) {
+		t.Fatal("handshake queued without room")
+	}
+	if stats := dev.HandshakeStats(); stats.HandshakeQueueFull != 1 || stats.CookieReplies != 0 || stats.RateLimited != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandshakeMessageCopied(t *testing.T) {
+	// a bare device, without handshake workers picking up the message
+
+	dev := &Device{log: NewLogger(LogLevelSilent, "")}
+	dev.queue.handshake = make(chan QueueHandshakeElement, 1)
+
+	buffer := new([MaxMessageSize]byte)
+	binary.LittleEndian.PutUint32(buffer[:4], MessageCookieReplyType)
+	buffer[MessageCookieReplySize-1] = 0x42
+	if dev.receiveDatagram(buffer, MessageCookieReplySize, nil) {
+		t.Fatal("handshake message kept the receive buffer")
+	}
+	buffer[MessageCookieReplySize-1] = 0
+
+	elem := <-dev.queue.handshake
+	if elem.msgType != MessageCookieReplyType || elem.size != MessageCookieReplySize || elem.buffer[MessageCookieReplySize-1] != 0x42 {
+		t.Errorf("handshake message not copied: %+v", elem)
+	}
+}
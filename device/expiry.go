@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* Peers may be given an expiry, for guest access and short-lived
+ * credentials. From then on handshakes with the peer are refused,
+ * and the peer is removed, emitting EventPeerExpired.
+ */
+
+type peerExpiry struct {
+	sync.Mutex
+	at    time.Time // zero if the peer does not expire
+	timer ClockTimer
+}
+
+// SetExpiry makes the device refuse handshakes with peer from at on and
+// remove it. A zero time lifts the expiry.
+func (peer *Peer) SetExpiry(at time.Time) {
+	peer.expiry.Lock()
+	defer peer.expiry.Unlock()
+
+	if peer.expiry.timer != nil {
+		peer.expiry.timer.Stop()
+		peer.expiry.timer = nil
+	}
+	peer.expiry.at = at
+	if !at.IsZero() {
+		peer.expiry.timer = peer.device.clock.AfterFunc(at.Sub(peer.device.now()), func() {
+			peer.device.expirePeer(peer)
+		})
+	}
+}
+
+// Expiry returns when peer expires, zero if it does not.
+func (peer *Peer) Expiry() time.Time {
+	peer.expiry.Lock()
+	defer peer.expiry.Unlock()
+	return peer.expiry.at
+}
+
+func (peer *Peer) expired() bool {
+	peer.expiry.Lock()
+	defer peer.expiry.Unlock()
+	return !peer.expiry.at.IsZero() && !peer.device.now().Before(peer.expiry.at)
+}
+
+func (peer *Peer) stopExpiry() {
+	peer.expiry.Lock()
+	defer peer.expiry.Unlock()
+	if peer.expiry.timer != nil {
+		peer.expiry.timer.Stop()
+		peer.expiry.timer = nil
+	}
+}
+
+// SetPeerExpiry sets the expiry of the peer with public key pk, see
+// Peer.SetExpiry.
+func (device *Device) SetPeerExpiry(pk NoisePublicKey, at time.Time) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetExpiry(at)
+	return nil
+}
+
+func (device *Device) expirePeer(peer *Peer) {
+	key := peer.handshake.remoteStatic
+
+	device.peers.Lock()
+	if device.peers.keyMap[key] != peer || !peer.expired() {
+		device.peers.Unlock()
+		return
+	}
+	unsafeRemovePeer(device, peer, key)
+	device.peers.Unlock()
+
+	device.log.Info.Println(peer, "- Expired and removed")
+	device.emitEvent(Event{Kind: EventPeerExpired, Peer: key})
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerExpiry(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nexpires_at="+strconv.FormatInt(expiry.Unix(), 10)+"\n"))
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	if at := config.Peers[0].ExpiresAt; at == nil || !at.Equal(expiry) {
+		t.Errorf("expiry reported as %v, want %v", at, expiry)
+	}
+	peer := dev.LookupPeer(pk)
+	if peer.expired() {
+		t.Error("peer expired an hour early")
+	}
+
+	assertNil(t, dev.SetPeerExpiry(pk, time.Now().Add(50*time.Millisecond)))
+	select {
+	case event := <-events:
+		if event.Kind != EventPeerExpired || event.Peer != pk {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the peer to expire")
+	}
+	if dev.LookupPeer(pk) != nil {
+		t.Error("expired peer not removed")
+	}
+	if err := dev.SetPeerExpiry(pk, time.Time{}); err != ErrPeerNotFound {
+		t.Errorf("setting expiry of removed peer: %v", err)
+	}
+}
+
+func TestPeerEphemeral(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nephemeral=3600\n"))
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	if timeout := config.Peers[0].Ephemeral; timeout == nil || *timeout != time.Hour {
+		t.Errorf("ephemeral timeout reported as %v, want %v", timeout, time.Hour)
+	}
+
+	// a handshake postpones the removal
+
+	peer := dev.LookupPeer(pk)
+	assertNil(t, dev.SetPeerEphemeral(pk, 200*time.Millisecond))
+	time.Sleep(150 * time.Millisecond)
+	handshake := time.Now()
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, handshake.UnixNano())
+	select {
+	case event := <-events:
+		if event.Kind != EventPeerInactive || event.Peer != pk {
+			t.Errorf("unexpected event %+v", event)
+		}
+		if since := time.Since(handshake); since < 200*time.Millisecond {
+			t.Errorf("peer removed %v after a handshake, want at least 200ms", since)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the peer to be removed")
+	}
+	if dev.LookupPeer(pk) != nil {
+		t.Error("inactive peer not removed")
+	}
+}
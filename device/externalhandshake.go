@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+/* Handshakes out of band
+ *
+ * Behind NATs dropping datagrams from a source until they have sent
+ * something to it, two peers may fail to complete a handshake over UDP.
+ * With a HandshakeTransport, handshake messages are carried by a channel
+ * of the application as well, such as a signaling server, and sent over
+ * UDP to the endpoint of the peer if it has one. The datagrams sent
+ * while the handshake completes out of band open the NATs on the way,
+ * so that the transport data which follows flows over UDP.
+ *
+ * Messages received out of band are handed to DeliverHandshake. As they
+ * have no source address, they neither set the endpoint of the peer nor
+ * are they subject to its allowed sources, and cookies and rate limits
+ * under load do not apply to them: the channel is trusted to only carry
+ * the messages of peers.
+ */
+
+// A HandshakeTransport carries handshake messages out of band, see
+// DeviceOptions.HandshakeTransport.
+type HandshakeTransport interface {
+	// SendHandshake sends message to the peer with the public key, whose
+	// application hands it to its device with DeliverHandshake. It must
+	// not block for long, and may keep message.
+	SendHandshake(peer NoisePublicKey, message []byte) error
+}
+
+// DeliverHandshake processes a handshake message received out of band.
+func (device *Device) DeliverHandshake(message []byte) error {
+	if device.isClosed.Get() {
+		return ErrDeviceClosed
+	}
+	if device.dataPlaneOnly {
+		return ErrUnsupported
+	}
+	if len(message) < 4 {
+		return fmt.Errorf("%w: handshake message of %d bytes", ErrInvalidValue, len(message))
+	}
+	msgType := binary.LittleEndian.Uint32(message[:4])
+	switch {
+	case msgType == MessageInitiationType && len(message) == MessageInitiationSize:
+	case msgType == MessageResponseType && len(message) == MessageResponseSize:
+	default:
+		return fmt.Errorf("%w: handshake message of type %d and %d bytes", ErrInvalidValue, msgType, len(message))
+	}
+
+	elem := QueueHandshakeElement{
+		msgType: msgType,
+		size:    len(message),
+	}
+	copy(elem.buffer[:], message)
+	if !device.addToHandshakeQueue(device.queue.handshake, elem) {
+		return ErrQueueFull
+	}
+	atomic.AddUint64(&device.stats.handshakesOOB, 1)
+	return nil
+}
+
+// sendHandshake sends the handshake message following
+// MaxObfuscationOverhead bytes of datagram out of band, if the device has
+// a HandshakeTransport, and over UDP with send. Failing to send it over
+// UDP then only matters if it was not sent out of band either.
+func (peer *Peer) sendHandshake(datagram []byte, send func([]byte) error) error {
+	transport := peer.device.handshakeTransport
+	if transport == nil {
+		return send(datagram)
+	}
+	err := transport.SendHandshake(peer.handshake.remoteStatic, append([]byte(nil), datagram[MaxObfuscationOverhead:]...))
+	if err != nil {
+		peer.log.Debug.Println(peer, "- Failed to send handshake message out of band:", err)
+	}
+	if udpErr := send(datagram); err != nil {
+		return udpErr
+	}
+	return nil
+}
+
+// handshakeSource describes where the message of elem came from, as
+// it appears in logs.
+func (device *Device) handshakeSource(elem *QueueHandshakeElement) string {
+	if elem.endpoint == nil {
+		return "out of band"
+	}
+	return device.redactEndpoint(elem.endpoint.DstToString())
+}
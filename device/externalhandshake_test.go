@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// signalingServer carries handshake messages between devices by their
+// public keys.
+type signalingServer struct {
+	mutex   sync.Mutex
+	devices map[NoisePublicKey]*Device
+}
+
+func (server *signalingServer) SendHandshake(peer NoisePublicKey, message []byte) error {
+	server.mutex.Lock()
+	device := server.devices[peer]
+	server.mutex.Unlock()
+	if device == nil {
+		return ErrPeerNotFound
+	}
+	return device.DeliverHandshake(message)
+}
+
+// handshakeDroppingBind drops the handshake messages it sends, like a
+// NAT dropping the first datagrams towards a peer.
+type handshakeDroppingBind struct {
+	conn.Bind
+}
+
+func (bind handshakeDroppingBind) Send(buff []byte, ep conn.Endpoint) error {
+	if buff[0] == MessageInitiationType || buff[0] == MessageResponseType {
+		return nil
+	}
+	return bind.Bind.Send(buff, ep)
+}
+
+func TestHandshakeOutOfBand(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	server := &signalingServer{devices: make(map[NoisePublicKey]*Device)}
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	for i := range devs {
+		i := i
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+				bind, actualPort, err := binds[i].Open(port)
+				return handshakeDroppingBind{bind}, actualPort, err
+			},
+			HandshakeTransport: server,
+		})
+		defer devs[i].Close()
+		server.devices[keys[i].publicKey()] = devs[i]
+	}
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other], 51820+other)))
+		devs[i].Up()
+	}
+
+	// the handshake completes out of band, the data flows over UDP
+
+	for i := range devs {
+		other := 1 - i
+		tuns[i].Outbound <- tuntest.Ping(addrs[other], addrs[i])
+		select {
+		case <-tuns[other].Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet from device %d did not transit", i+1)
+		}
+	}
+	for i, dev := range devs {
+		if stats := dev.HandshakeStats(); stats.OutOfBand == 0 {
+			t.Errorf("device %d received no handshake messages out of band", i+1)
+		}
+	}
+
+	if err := devs[0].DeliverHandshake(make([]byte, MessageTransportSize)); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("delivered a transport message out of band with %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Failover to backup peers
+ *
+ * Redundant gateways for the same networks are peers holding those
+ * networks as backup allowed IPs, next to the primary peer holding them
+ * as allowed IPs. Packets go to the primary while its session is alive.
+ * Once it has been trying to complete a handshake for longer than the
+ * failover threshold without success, or is disabled, its packets go to
+ * the first backup for the most specific network holding their
+ * destination by failover priority, lower first, whose session is alive
+ * in turn, and keep going to that backup while it stays alive.
+ * Meanwhile the primary is offered a handshake every RekeyTimeout, and
+ * traffic fails back to it as soon as one completes.
+ *
+ * Packets from a backup are accepted from its backup allowed IPs while
+ * the primary for their source is dead, so that the replies routed
+ * through it are not dropped.
+ */
+
+const DefaultFailoverThreshold = 3 * RekeyTimeout
+
+// backupNetworks is stored in the failover of a peer, which is read
+// without locks on the receive path.
+type backupNetworks []net.IPNet
+
+type peerFailover struct {
+	priority uint32       // lower is preferred, accessed atomically
+	offered  int64        // when the peer was last offered a handshake as it failed over, accessed atomically
+	networks atomic.Value // backupNetworks
+}
+
+// A failoverGroup holds the backups for a network.
+type failoverGroup struct {
+	network net.IPNet
+	ones    int
+	peers   []*Peer      // by failover priority, then public key
+	backup  atomic.Value // *Peer taken over by last
+}
+
+// failoverTable is replaced as a whole on changes, and read without
+// locks on the send path.
+type failoverTable struct {
+	groups []*failoverGroup // most specific first
+}
+
+type failoverBackups struct {
+	sync.Mutex              // serializes replacing table
+	table      atomic.Value // *failoverTable, nil if no peer is a backup
+}
+
+// BackupAllowedIPs returns the networks peer is a backup gateway for.
+func (peer *Peer) BackupAllowedIPs() []net.IPNet {
+	networks, _ := peer.failover.networks.Load().(backupNetworks)
+	return append([]net.IPNet(nil), networks...)
+}
+
+// AddBackupAllowedIP makes peer a backup gateway for network, taking
+// over the packets to it while the primary peer for it is dead.
+func (peer *Peer) AddBackupAllowedIP(network net.IPNet) {
+	device := peer.device
+	device.backups.Lock()
+	defer device.backups.Unlock()
+	networks, _ := peer.failover.networks.Load().(backupNetworks)
+	network.IP = network.IP.Mask(network.Mask)
+	device.unsafeRebackup(peer, append(append(backupNetworks(nil), networks...), network))
+}
+
+// ClearBackupAllowedIPs stops peer from being a backup gateway.
+func (peer *Peer) ClearBackupAllowedIPs() {
+	device := peer.device
+	device.backups.Lock()
+	defer device.backups.Unlock()
+	device.unsafeRebackup(peer, nil)
+}
+
+// SetFailoverPriority ranks peer among the backups for the same
+// networks, the lowest priority taking over first.
+func (peer *Peer) SetFailoverPriority(priority uint16) {
+	device := peer.device
+	device.backups.Lock()
+	defer device.backups.Unlock()
+	atomic.StoreUint32(&peer.failover.priority, uint32(priority))
+	networks, _ := peer.failover.networks.Load().(backupNetworks)
+	device.unsafeRebackup(peer, networks)
+}
+
+func (peer *Peer) FailoverPriority() uint16 {
+	return uint16(atomic.LoadUint32(&peer.failover.priority))
+}
+
+// backupFor reports whether peer is a backup gateway for ip.
+func (peer *Peer) backupFor(ip net.IP) bool {
+	networks, _ := peer.failover.networks.Load().(backupNetworks)
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsafeRebackup replaces the backup allowed IPs of peer by networks,
+// rebuilding the failover table. The backups lock must be held.
+func (device *Device) unsafeRebackup(peer *Peer, networks backupNetworks) {
+	peer.failover.networks.Store(networks)
+
+	var groups []*failoverGroup
+	if old, _ := device.backups.table.Load().(*failoverTable); old != nil {
+		for _, group := range old.groups {
+			peers := make([]*Peer, 0, len(group.peers))
+			for _, member := range group.peers {
+				if member != peer {
+					peers = append(peers, member)
+				}
+			}
+			if len(peers) > 0 {
+				groups = append(groups, &failoverGroup{network: group.network, ones: group.ones, peers: peers})
+			}
+		}
+	}
+
+NextNetwork:
+	for _, network := range networks {
+		ones, _ := network.Mask.Size()
+		for _, group := range groups {
+			if group.ones != ones || !group.network.IP.Equal(network.IP) {
+				continue
+			}
+			for _, member := range group.peers {
+				if member == peer {
+					continue NextNetwork
+				}
+			}
+			group.peers = append(group.peers, peer)
+			continue NextNetwork
+		}
+		groups = append(groups, &failoverGroup{network: network, ones: ones, peers: []*Peer{peer}})
+	}
+
+	if len(groups) == 0 {
+		device.backups.table.Store((*failoverTable)(nil))
+		return
+	}
+	for _, group := range groups {
+		peers := group.peers
+		sort.Slice(peers, func(i, j int) bool {
+			pi, pj := peers[i].FailoverPriority(), peers[j].FailoverPriority()
+			return pi < pj || pi == pj && bytes.Compare(peers[i].handshake.remoteStatic[:], peers[j].handshake.remoteStatic[:]) < 0
+		})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].ones > groups[j].ones
+	})
+	device.backups.table.Store(&failoverTable{groups: groups})
+}
+
+// unbackup removes peer from the failover table, once it is removed.
+func (device *Device) unbackup(peer *Peer) {
+	device.backups.Lock()
+	defer device.backups.Unlock()
+	device.unsafeRebackup(peer, nil)
+}
+
+// pick returns the backup alive the packets to dst routed to primary go
+// to, from the most specific group holding dst that has one, nil if
+// there is none.
+func (table *failoverTable) pick(primary *Peer, dst net.IP) *Peer {
+	for _, group := range table.groups {
+		if !group.network.Contains(dst) {
+			continue
+		}
+		if backup := group.pick(primary); backup != nil {
+			return backup
+		}
+	}
+	return nil
+}
+
+// pick returns the backup of the group taken over by last if it is still
+// alive, or else the first alive by failover priority.
+func (group *failoverGroup) pick(primary *Peer) *Peer {
+	if backup, _ := group.backup.Load().(*Peer); backup != nil && backup != primary && !backup.dead() {
+		return backup
+	}
+	for _, candidate := range group.peers {
+		if candidate != primary && !candidate.dead() {
+			group.backup.Store(candidate)
+			return candidate
+		}
+	}
+	return nil
+}
+
+// SetFailoverThreshold sets for how long a peer tries to complete a
+// handshake before its packets fail over to a backup, zero for
+// DefaultFailoverThreshold.
+func (device *Device) SetFailoverThreshold(threshold time.Duration) {
+	if threshold <= 0 {
+		threshold = DefaultFailoverThreshold
+	}
+	device.failoverThreshold.Store(threshold)
+}
+
+func (device *Device) FailoverThreshold() time.Duration {
+	threshold, _ := device.failoverThreshold.Load().(time.Duration)
+	if threshold == 0 {
+		return DefaultFailoverThreshold
+	}
+	return threshold
+}
+
+// SetPeerFailover sets the backup allowed IPs and the failover priority
+// of the peer with public key pk, see Peer.AddBackupAllowedIP.
+func (device *Device) SetPeerFailover(pk NoisePublicKey, priority uint16, networks []net.IPNet) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.ClearBackupAllowedIPs()
+	for _, network := range networks {
+		peer.AddBackupAllowedIP(network)
+	}
+	peer.SetFailoverPriority(priority)
+	return nil
+}
+
+// dead reports whether the session of peer is dead: it is disabled, or
+// has been trying to complete a handshake for longer than the failover
+// threshold without a usable session.
+func (peer *Peer) dead() bool {
+	if peer.disabled.Get() {
+		return true
+	}
+	nano := atomic.LoadInt64(&peer.stats.handshakePendingSinceNano)
+	if nano == 0 || peer.device.since(time.Unix(0, nano)) < peer.device.FailoverThreshold() {
+		return false
+	}
+	keypair := peer.keypairs.Current()
+	return keypair == nil || peer.device.since(keypair.created) >= peer.device.rejectAfterTime()
+}
+
+// failover returns the peer the packets to dst routed to peer are sent
+// to, a backup alive if the session of peer is dead.
+func (device *Device) failover(peer *Peer, dst net.IP) *Peer {
+	if peer == nil || !peer.dead() {
+		return peer
+	}
+	table, _ := device.backups.table.Load().(*failoverTable)
+	if table == nil {
+		return peer
+	}
+	backup := table.pick(peer, dst)
+	if backup == nil {
+		return peer
+	}
+	peer.offerHandshake()
+	atomic.AddUint64(&peer.stats.failedOver, 1)
+	return backup
+}
+
+// offerHandshake keeps offering peer, whose packets fail over, a
+// handshake every RekeyTimeout, to fail back once it answers.
+func (peer *Peer) offerHandshake() {
+	now := peer.device.now().UnixNano()
+	offered := atomic.LoadInt64(&peer.failover.offered)
+	if now-offered < int64(RekeyTimeout) || !atomic.CompareAndSwapInt64(&peer.failover.offered, offered, now) {
+		return
+	}
+	peer.SendHandshakeInitiation(false)
+}
+
+// failedOverFrom reports whether packets from ip may arrive from peer as
+// a backup gateway, the primary peer for ip being owner.
+func (peer *Peer) failedOverFrom(ip net.IP, owner *Peer) bool {
+	return owner != nil && owner != peer && owner.dead() && peer.backupFor(ip)
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFailoverBackups(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	var peers [3]*Peer
+	for i := range peers {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peers[i], err = dev.NewPeer(sk.publicKey())
+		assertNil(t, err)
+	}
+	primary, backup1, backup0 := peers[0], peers[1], peers[2]
+	assertNil(t, dev.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=10.0.0.0/24\n", primary.handshake.remoteStatic.ToHex())))
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	assertNil(t, dev.SetPeerFailover(backup1.handshake.remoteStatic, 1, []net.IPNet{*network}))
+	assertNil(t, dev.SetPeerFailover(backup0.handshake.remoteStatic, 0, []net.IPNet{*network}))
+
+	dst := net.IPv4(10, 0, 0, 1).To4()
+	if peer := dev.route(nil, dst); peer != primary {
+		t.Fatal("packet failed over from a live primary")
+	}
+	if backup1.sharedRouteFor(dst, primary) {
+		t.Error("packet from a backup accepted while the primary is alive")
+	}
+
+	// the first backup by priority takes over, sticking while alive
+
+	primary.disabled.Set(true)
+	if peer := dev.route(nil, dst); peer != backup0 {
+		t.Fatal("packet did not fail over to the preferred backup")
+	}
+	if !backup0.sharedRouteFor(dst, primary) {
+		t.Error("packet from the backup refused while failed over")
+	}
+	backup0.disabled.Set(true)
+	if peer := dev.route(nil, dst); peer != backup1 {
+		t.Fatal("packet did not fail over to the next backup")
+	}
+	backup0.disabled.Set(false)
+	if peer := dev.route(nil, dst); peer != backup1 {
+		t.Error("packet moved off a live backup")
+	}
+
+	// the primary is offered a handshake at most every RekeyTimeout
+
+	offered := atomic.LoadInt64(&primary.failover.offered)
+	if offered == 0 {
+		t.Fatal("primary not offered a handshake")
+	}
+	dev.route(nil, dst)
+	if atomic.LoadInt64(&primary.failover.offered) != offered {
+		t.Error("primary offered a handshake again within RekeyTimeout")
+	}
+	if stats := primary.Stats(); stats.FailedOver != 4 {
+		t.Errorf("%d packets failed over, want 4", stats.FailedOver)
+	}
+
+	// removed backups and networks are forgotten
+
+	dev.RemovePeer(backup1.handshake.remoteStatic)
+	if peer := dev.route(nil, dst); peer != backup0 {
+		t.Error("packet not failed over to the remaining backup")
+	}
+	backup0.ClearBackupAllowedIPs()
+	if peer := dev.route(nil, dst); peer != primary {
+		t.Error("packet failed over without backups")
+	}
+	if backup0.sharedRouteFor(dst, primary) {
+		t.Error("packet accepted from a former backup")
+	}
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/* Encryption work is queued per peer and handed to the encryption
+ * workers round-robin, at most EncryptionQuantum elements per turn.
+ * A peer sending at full speed thus gets its share of the workers,
+ * but cannot fill a shared queue and starve the other peers.
+ */
+
+type encryptionQueue struct {
+	sync.Mutex
+	cond   *sync.Cond
+	ready  []*Peer // peers with queued elements, in the order of their turns
+	closed bool
+}
+
+func (queue *encryptionQueue) init() {
+	queue.cond = sync.NewCond(&queue.Mutex)
+	queue.ready = nil
+	queue.closed = false
+}
+
+// enqueue adds elem to the encryption queue of peer, which is scheduled
+// for a turn unless it already has one. It returns false if the queue
+// of peer is full.
+func (queue *encryptionQueue) enqueue(peer *Peer, elem *QueueOutboundElement) bool {
+	select {
+	case peer.encryption.queue <- elem:
+	default:
+		return false
+	}
+	queue.Lock()
+	if !peer.encryption.scheduled {
+		peer.encryption.scheduled = true
+		queue.ready = append(queue.ready, peer)
+		queue.cond.Signal()
+	}
+	queue.Unlock()
+	return true
+}
+
+// next waits for the peer whose turn it is and appends up to
+// EncryptionQuantum of its elements to batch. It returns false
+// once the queue is closed.
+func (queue *encryptionQueue) next(batch []*QueueOutboundElement) ([]*QueueOutboundElement, bool) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for len(queue.ready) == 0 && !queue.closed {
+		queue.cond.Wait()
+	}
+	if queue.closed {
+		return batch, false
+	}
+
+	peer := queue.ready[0]
+	queue.ready[0] = nil
+	queue.ready = queue.ready[1:]
+	atomic.AddUint64(&peer.stats.encryptionTurns, 1)
+
+fill:
+	for len(batch) < EncryptionQuantum {
+		select {
+		case elem := <-peer.encryption.queue:
+			batch = append(batch, elem)
+			atomic.AddUint64(&peer.stats.encryptedPackets, 1)
+		default:
+			break fill
+		}
+	}
+
+	// enqueue checks scheduled under the lock, elements it adds meanwhile are not missed
+
+	if len(peer.encryption.queue) > 0 {
+		queue.ready = append(queue.ready, peer)
+	} else {
+		peer.encryption.scheduled = false
+	}
+	if len(queue.ready) > 0 {
+		queue.cond.Signal()
+	}
+	return batch, true
+}
+
+// close wakes up and stops all workers waiting in next.
+func (queue *encryptionQueue) close() {
+	queue.Lock()
+	queue.closed = true
+	queue.cond.Broadcast()
+	queue.Unlock()
+}
+
+// flush drops the elements of all scheduled peers.
+func (queue *encryptionQueue) flush() {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for _, peer := range queue.ready {
+		peer.encryption.scheduled = false
+		for len(peer.encryption.queue) > 0 {
+			elem := <-peer.encryption.queue
+			elem.Drop()
+			peer.device.PutMessageBuffer(elem.buffer)
+			peer.device.releaseOutboundElement(elem)
+		}
+	}
+	queue.ready = nil
+}
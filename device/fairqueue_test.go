@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestEncryptionQueueRoundRobin(t *testing.T) {
+	var queue encryptionQueue
+	queue.init()
+
+	newPeer := func() *Peer {
+		peer := new(Peer)
+		peer.encryption.queue = make(chan *QueueOutboundElement, QueueOutboundSize)
+		return peer
+	}
+	bulk, light := newPeer(), newPeer()
+
+	for i := 0; i < 10*EncryptionQuantum; i++ {
+		if !queue.enqueue(bulk, &QueueOutboundElement{peer: bulk}) {
+			t.Fatal("enqueue failed")
+		}
+	}
+	for i := 0; i < EncryptionQuantum+1; i++ {
+		queue.enqueue(light, &QueueOutboundElement{peer: light})
+	}
+
+	// turns alternate while both peers have elements queued
+
+	want := []*Peer{bulk, light, bulk, light, bulk, bulk}
+	for turn, peer := range want {
+		batch, ok := queue.next(nil)
+		if !ok || len(batch) == 0 {
+			t.Fatalf("turn %d: no elements", turn)
+		}
+		for _, elem := range batch {
+			if elem.peer != peer {
+				t.Fatalf("turn %d: element of wrong peer", turn)
+			}
+		}
+	}
+	if turns := light.stats.encryptionTurns; turns != 2 {
+		t.Errorf("light peer had %d turns, want 2", turns)
+	}
+	if packets := light.stats.encryptedPackets; packets != EncryptionQuantum+1 {
+		t.Errorf("light peer had %d packets encrypted, want %d", packets, EncryptionQuantum+1)
+	}
+	if light.encryption.scheduled {
+		t.Error("light peer scheduled with an empty queue")
+	}
+
+	queue.close()
+	if _, ok := queue.next(nil); ok {
+		t.Error("next succeeded on closed queue")
+	}
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Outgoing transport packets may be sent from additional source ports,
+ * chosen by a hash of the flow they encapsulate. Routers balancing
+ * the underlay by the outer 5-tuple (ECMP, bonded links) then spread
+ * the tunnel across their paths, while every inner flow still takes
+ * a single path and stays in order. Handshakes, cookie replies and
+ * keepalives always leave from the listen port.
+ */
+
+// PortRange is an inclusive range of UDP ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) count() int {
+	if r.First == 0 || r.Last < r.First {
+		return 0
+	}
+	return int(r.Last-r.First) + 1
+}
+
+// flowHash hashes the addresses and protocol of an IP packet, plus the
+// ports of unfragmented TCP and UDP packets, with 32-bit FNV-1a.
+func flowHash(packet []byte) uint32 {
+	hash := uint32(2166136261)
+	mix := func(b []byte) {
+		for _, c := range b {
+			hash ^= uint32(c)
+			hash *= 16777619
+		}
+	}
+
+	var proto byte
+	var ports []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return 0
+		}
+		proto = packet[9]
+		mix(packet[12:20])
+		headerLen := int(packet[0]&0x0f) << 2
+		fragmented := packet[6]&0x3f != 0 || packet[7] != 0
+		if !fragmented && len(packet) >= headerLen+4 {
+			ports = packet[headerLen : headerLen+4]
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return 0
+		}
+		proto = packet[6]
+		mix(packet[8:40])
+		if len(packet) >= ipv6.HeaderLen+4 {
+			ports = packet[ipv6.HeaderLen : ipv6.HeaderLen+4]
+		}
+	default:
+		return 0
+	}
+
+	mix([]byte{proto})
+	if proto == protocolTCP || proto == protocolUDP {
+		mix(ports)
+	}
+	return hash
+}
+
+// flowPort picks the source port for a packet read from the TUN device,
+// as an index into the flow ports, where zero stands for the listen port.
+func (device *Device) flowPort(packet []byte) uint16 {
+	count := device.net.flowPorts.count()
+	if count == 0 {
+		return 0
+	}
+	return uint16(flowHash(packet) % uint32(count+1))
+}
+
+// setFlowLabels enables outer IPv6 flow labels on bind if configured.
+// Failing to do so is not fatal, packets are then sent unlabeled or
+// labeled according to the defaults of the system.
+func (device *Device) setFlowLabels(bind conn.Bind) {
+	if !device.net.flowLabels {
+		return
+	}
+	labeler, ok := bind.(conn.FlowLabeler)
+	if !ok {
+		device.log.Error.Println("UDP bind does not support IPv6 flow labels")
+		return
+	}
+	if err := labeler.SetAutoFlowLabel(true); err != nil {
+		device.log.Error.Println("Unable to enable IPv6 flow labels:", err)
+	}
+}
+
+// unsafeOpenFlowBinds opens a bind on each of the flow ports and starts
+// receiving from it, peers roam to whichever port they heard from last.
+// A port which cannot be opened falls back to the listen port.
+func (device *Device) unsafeOpenFlowBinds(createBind func(port uint16) (conn.Bind, uint16, error)) {
+	netc := &device.net
+	count := netc.flowPorts.count()
+	if count == 0 {
+		return
+	}
+	netc.flowBinds = make([]conn.Bind, count)
+	for i := range netc.flowBinds {
+		port := netc.flowPorts.First + uint16(i)
+		if port == netc.port {
+			continue
+		}
+		bind, _, err := createBind(port)
+		if err != nil {
+			device.log.Error.Println("Unable to open flow port", port, "-", err)
+			continue
+		}
+		if netc.fwmark != 0 {
+			if err := bind.SetMark(netc.fwmark); err != nil {
+				device.log.Error.Println("Unable to set fwmark on flow port", port, "-", err)
+			}
+		}
+		device.setBufferSizes(bind)
+		device.setFlowLabels(bind)
+		if receiver, ok := bind.(conn.SegmentReceiver); ok && netc.offload {
+			receiver.EnableReceiveOffload()
+		}
+		netc.flowBinds[i] = bind
+
+		netc.starting.Add(2)
+		netc.stopping.Add(2)
+		go device.RoutineReceiveIncoming(ipv4.Version, bind)
+		go device.RoutineReceiveIncoming(ipv6.Version, bind)
+		netc.starting.Wait()
+	}
+}
+
+func (device *Device) unsafeCloseFlowBinds() error {
+	var err error
+	for _, bind := range device.net.flowBinds {
+		if bind == nil {
+			continue
+		}
+		if closeErr := bind.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	device.net.flowBinds = nil
+	return err
+}
+
+// unsafeFlowBind returns the bind sending from flow port index flow,
+// falling back to the bind of the listen port.
+func (device *Device) unsafeFlowBind(flow uint16) conn.Bind {
+	if flow > 0 && int(flow) <= len(device.net.flowBinds) {
+		if bind := device.net.flowBinds[flow-1]; bind != nil {
+			return bind
+		}
+	}
+	return device.net.bind
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// flowPacket returns a UDP packet between the given ports.
+func flowPacket(dst, src net.IP, srcPort, dstPort uint16) []byte {
+	packet := udpPacket(dst, src, 64)
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	return packet
+}
+
+func TestFlowHash(t *testing.T) {
+	src, dst := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+
+	a := flowPacket(dst, src, 1000, 53)
+	b := flowPacket(dst, src, 1000, 53)
+	b[4] = 0x42 // another IP ID, same flow
+	if flowHash(a) != flowHash(b) {
+		t.Error("packets of one flow hash differently")
+	}
+	if flowHash(a) == flowHash(flowPacket(dst, src, 1001, 53)) {
+		t.Error("source port does not contribute to hash")
+	}
+
+	// later fragments carry no ports and must not leave the flow of the first
+	fragment := flowPacket(dst, src, 1000, 53)
+	fragment[6] = 0x20 // more fragments
+	later := flowPacket(dst, src, 7, 7)
+	later[7] = 0x10
+	if flowHash(fragment) != flowHash(later) {
+		t.Error("fragments of one packet hash differently")
+	}
+
+	if flowHash([]byte{0x45, 0}) != 0 {
+		t.Error("truncated packet hashed")
+	}
+}
+
+func TestFlowPorts(t *testing.T) {
+	port1, _ := strconv.Atoi(getFreePort(t))
+	port2, _ := strconv.Atoi(getFreePort(t))
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDeviceWithOptions(tun1.TUN(), NewLogger(LogLevelError, "dev1: "), DeviceOptions{
+		FlowPorts: PortRange{First: uint16(port1) + 1, Last: uint16(port1) + 4},
+	})
+	dev1.Up()
+	defer dev1.Close()
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port={{PORT1}}
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:{{PORT2}}`
+	cfg1 = strings.ReplaceAll(cfg1, "{{PORT1}}", strconv.Itoa(port1))
+	cfg1 = strings.ReplaceAll(cfg1, "{{PORT2}}", strconv.Itoa(port2))
+	if err := dev1.IpcSet(cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port={{PORT2}}
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+allowed_ip=1.0.0.1/32`
+	cfg2 = strings.ReplaceAll(cfg2, "{{PORT2}}", strconv.Itoa(port2))
+	if err := dev2.IpcSet(cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	var pk1 NoisePublicKey
+	if err := pk1.FromHex("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427"); err != nil {
+		t.Fatal(err)
+	}
+	peer1 := dev2.LookupPeer(pk1)
+
+	// dev2 roams to the source port of the latest packet of dev1
+
+	ports := make(map[string]bool)
+	src, dst := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	for i := 0; i < 32; i++ {
+		tun1.Outbound <- flowPacket(dst, src, uint16(10000+i), 53)
+		select {
+		case <-tun2.Inbound:
+		case <-time.After(time.Second):
+			t.Fatalf("packet of flow %d did not transit", i)
+		}
+		peer1.RLock()
+		ports[peer1.endpoint.DstToString()] = true
+		peer1.RUnlock()
+	}
+	if len(ports) < 2 {
+		t.Errorf("all flows sent from %v", ports)
+	}
+}
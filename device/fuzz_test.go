@@ -0,0 +1,224 @@
+// +build go1.18
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+/* Fuzz targets for everything parsed off the wire or the UAPI socket
+ *
+ * Run with e.g. go test -fuzz=FuzzHandshakeInitiation ./device
+ * Without -fuzz only the seed corpus is exercised.
+ */
+
+type fuzzPair struct {
+	dev1, dev2   *Device
+	peer1, peer2 *Peer // peer1 is dev1 as seen by dev2, peer2 is dev2 as seen by dev1
+}
+
+func newFuzzPair(f *testing.F) *fuzzPair {
+	p := &fuzzPair{dev1: randDevice(f), dev2: randDevice(f)}
+	f.Cleanup(p.dev1.Close)
+	f.Cleanup(p.dev2.Close)
+	var err error
+	p.peer1, err = p.dev2.NewPeer(p.dev1.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		f.Fatal(err)
+	}
+	p.peer2, err = p.dev1.NewPeer(p.dev2.staticIdentity.privateKey.publicKey())
+	if err != nil {
+		f.Fatal(err)
+	}
+	return p
+}
+
+func marshalWithMacs(f *testing.F, peer *Peer, msg interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, msg); err != nil {
+		f.Fatal(err)
+	}
+	packet := buf.Bytes()
+	peer.cookieGenerator.AddMacs(packet)
+	return packet
+}
+
+// consumeHandshakePacket mirrors RoutineReceiveIncoming and RoutineHandshake
+// up to the point where they would reply or touch the network.
+func consumeHandshakePacket(device *Device, packet []byte) {
+	if len(packet) < MinMessageSize {
+		return
+	}
+	switch binary.LittleEndian.Uint32(packet[:4]) {
+	case MessageInitiationType:
+		if len(packet) != MessageInitiationSize || !device.cookieChecker.CheckMAC1(packet) {
+			return
+		}
+		var msg MessageInitiation
+		if binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg) != nil {
+			return
+		}
+		device.ConsumeMessageInitiation(&msg)
+
+	case MessageResponseType:
+		if len(packet) != MessageResponseSize || !device.cookieChecker.CheckMAC1(packet) {
+			return
+		}
+		var msg MessageResponse
+		if binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg) != nil {
+			return
+		}
+		if peer := device.ConsumeMessageResponse(&msg); peer != nil {
+			peer.BeginSymmetricSession()
+		}
+
+	case MessageCookieReplyType:
+		if len(packet) != MessageCookieReplySize {
+			return
+		}
+		var reply MessageCookieReply
+		if binary.Read(bytes.NewReader(packet), binary.LittleEndian, &reply) != nil {
+			return
+		}
+		if entry := device.indexTable.Lookup(reply.Receiver); entry.peer != nil {
+			entry.peer.cookieGenerator.ConsumeReply(&reply)
+		}
+	}
+}
+
+// consumeTransportPacket mirrors the transport path of RoutineReceiveIncoming,
+// RoutineDecryption and RoutineSequentialReceiver.
+func consumeTransportPacket(device *Device, packet []byte) []byte {
+	if len(packet) < MessageTransportSize || binary.LittleEndian.Uint32(packet[:4]) != MessageTransportType {
+		return nil
+	}
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	keypair := device.indexTable.Lookup(receiver).keypair
+	if keypair == nil {
+		return nil
+	}
+	var nonce [12]byte
+	copy(nonce[4:], packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	content := append([]byte(nil), packet[MessageTransportOffsetContent:]...)
+	plaintext, err := keypair.receive.Open(content[:0], nonce[:], content, nil)
+	if err != nil {
+		return nil
+	}
+	counter := binary.LittleEndian.Uint64(nonce[4:])
+	if !keypair.replayFilter.ValidateCounter(counter, RejectAfterMessages) {
+		return nil
+	}
+	return plaintext
+}
+
+func FuzzHandshakeInitiation(f *testing.F) {
+	p := newFuzzPair(f)
+	msg, err := p.dev1.CreateMessageInitiation(p.peer2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(marshalWithMacs(f, p.peer2, msg))
+	f.Add(make([]byte, MessageInitiationSize))
+	f.Add([]byte{MessageInitiationType, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		consumeHandshakePacket(p.dev2, packet)
+	})
+}
+
+func FuzzHandshakeResponse(f *testing.F) {
+	p := newFuzzPair(f)
+	initiation, err := p.dev1.CreateMessageInitiation(p.peer2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	if p.dev2.ConsumeMessageInitiation(initiation) == nil {
+		f.Fatal("seed initiation was not consumed")
+	}
+	msg, err := p.dev2.CreateMessageResponse(p.peer1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(marshalWithMacs(f, p.peer1, msg))
+	f.Add(make([]byte, MessageResponseSize))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		consumeHandshakePacket(p.dev1, packet)
+	})
+}
+
+func FuzzCookieReply(f *testing.F) {
+	p := newFuzzPair(f)
+	msg, err := p.dev1.CreateMessageInitiation(p.peer2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	initiation := marshalWithMacs(f, p.peer2, msg)
+	reply, err := p.dev2.cookieChecker.CreateReply(initiation, msg.Sender, []byte{127, 0, 0, 1, 0xca, 0x6c})
+	if err != nil {
+		f.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, reply)
+	f.Add(buf.Bytes())
+	f.Add(make([]byte, MessageCookieReplySize))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		consumeHandshakePacket(p.dev1, packet)
+	})
+}
+
+func FuzzTransportHeader(f *testing.F) {
+	p := newFuzzPair(f)
+	initiation, err := p.dev1.CreateMessageInitiation(p.peer2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	p.dev2.ConsumeMessageInitiation(initiation)
+	response, err := p.dev2.CreateMessageResponse(p.peer1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	p.dev1.ConsumeMessageResponse(response)
+	if p.peer1.BeginSymmetricSession() != nil || p.peer2.BeginSymmetricSession() != nil {
+		f.Fatal("failed to derive keypairs")
+	}
+	sender := p.peer2.keypairs.current
+
+	for counter, payload := range [][]byte{nil, []byte("wireguard fuzz seed")} {
+		packet := make([]byte, MessageTransportHeaderSize)
+		binary.LittleEndian.PutUint32(packet[:4], MessageTransportType)
+		binary.LittleEndian.PutUint32(packet[MessageTransportOffsetReceiver:], sender.remoteIndex)
+		binary.LittleEndian.PutUint64(packet[MessageTransportOffsetCounter:], uint64(counter))
+		var nonce [12]byte
+		copy(nonce[4:], packet[MessageTransportOffsetCounter:])
+		f.Add(sender.send.Seal(packet, nonce[:], payload, nil))
+	}
+	f.Add(make([]byte, MessageTransportSize))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		consumeTransportPacket(p.dev2, packet)
+	})
+}
+
+func FuzzIpcSet(f *testing.F) {
+	dev := randDevice(f)
+	f.Cleanup(dev.Close)
+
+	f.Add("private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58\nlisten_port=0\nfwmark=0\nreplace_peers=true\n")
+	f.Add("public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nprotocol_version=1\nreplace_allowed_ips=true\nallowed_ip=1.0.0.2/32\nallowed_ip=fd00::/64\nendpoint=[::1]:51820\npersistent_keepalive_interval=25\n")
+	f.Add("public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nupdate_only=true\nremove=true\n")
+	f.Add("=\n==\nlisten_port=65536\n")
+
+	f.Fuzz(func(t *testing.T, uapiConf string) {
+		dev.IpcSet(uapiConf)
+		parseDeviceConfig(uapiConf)
+	})
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* A peer normally handshakes about once every RekeyAfterTime. One
+ * handshaking far more often suffers from a broken link or, commonly,
+ * has its key in use on several machines, which keep replacing each
+ * other's sessions. Such a peer is flagged as anomalous once it reaches
+ * AnomalousHandshakes handshakes within HandshakeRateWindow.
+ */
+
+type handshakeRate struct {
+	sync.Mutex
+	recent  []time.Time // latest handshakes within HandshakeRateWindow, oldest first
+	anomaly bool        // as of the latest handshake
+}
+
+// prune drops the handshakes which left the window, caller holds the lock.
+func (rate *handshakeRate) prune(now time.Time) {
+	i := 0
+	for i < len(rate.recent) && now.Sub(rate.recent[i]) >= HandshakeRateWindow {
+		i++
+	}
+	rate.recent = rate.recent[i:]
+}
+
+// countHandshake records a handshake with peer, emitting
+// EventHandshakeAnomaly when the peer becomes anomalous.
+func (peer *Peer) countHandshake() {
+	atomic.AddUint64(&peer.stats.handshakes, 1)
+
+	now := peer.device.now()
+	peer.handshakeRate.Lock()
+	peer.handshakeRate.prune(now)
+	if len(peer.handshakeRate.recent) >= AnomalousHandshakes {
+		peer.handshakeRate.recent = peer.handshakeRate.recent[1:]
+	}
+	peer.handshakeRate.recent = append(peer.handshakeRate.recent, now)
+	wasAnomaly := peer.handshakeRate.anomaly
+	peer.handshakeRate.anomaly = len(peer.handshakeRate.recent) >= AnomalousHandshakes
+	anomaly := peer.handshakeRate.anomaly
+	peer.handshakeRate.Unlock()
+
+	if anomaly && !wasAnomaly {
+		peer.log.Info.Println(peer, "- Handshaking abnormally often, is its key in use on several machines?")
+		peer.device.emitEvent(Event{Kind: EventHandshakeAnomaly, Peer: peer.handshake.remoteStatic})
+	}
+}
+
+// recentHandshakes returns the number of handshakes within
+// HandshakeRateWindow, up to AnomalousHandshakes, and whether that
+// makes the peer anomalous.
+func (peer *Peer) recentHandshakes() (int, bool) {
+	peer.handshakeRate.Lock()
+	defer peer.handshakeRate.Unlock()
+	peer.handshakeRate.prune(peer.device.now())
+	count := len(peer.handshakeRate.recent)
+	return count, count >= AnomalousHandshakes
+}
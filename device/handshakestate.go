@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeState summarizes the handshake of a peer for diagnostics.
+type HandshakeState int
+
+const (
+	HandshakeNone             = HandshakeState(iota) // no handshake has completed yet and none is in progress
+	HandshakeInitiationSent                          // an initiation was sent, awaiting the response
+	HandshakeResponseReceived                        // a session was derived, awaiting its confirmation by the peer
+	HandshakeEstablished                             // a session is usable for sending
+	HandshakeExpired                                 // the last session expired and no handshake is in progress
+)
+
+func (state HandshakeState) String() string {
+	switch state {
+	case HandshakeNone:
+		return "none"
+	case HandshakeInitiationSent:
+		return "initiation-sent"
+	case HandshakeResponseReceived:
+		return "response-received"
+	case HandshakeEstablished:
+		return "established"
+	case HandshakeExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("HandshakeState(%d)", int(state))
+	}
+}
+
+// HandshakeStatus is a snapshot of the handshake of a peer.
+type HandshakeStatus struct {
+	State HandshakeState
+
+	// Since is when the peer entered State, for HandshakeInitiationSent
+	// when the latest initiation was sent. Zero for HandshakeNone.
+	Since time.Time
+
+	// NextRetry is when the initiation is sent again unless a response
+	// arrives, zero if no retransmission is scheduled.
+	NextRetry time.Time
+}
+
+// HandshakeStatus returns the state of the handshake with peer.
+func (peer *Peer) HandshakeStatus() HandshakeStatus {
+	var status HandshakeStatus
+
+	if peer.timers.retransmitHandshake != nil {
+		if deadline, pending := peer.timers.retransmitHandshake.Deadline(); pending {
+			status.NextRetry = deadline
+		}
+	}
+
+	peer.keypairs.RLock()
+	current, next := peer.keypairs.current, peer.keypairs.loadNext()
+	peer.keypairs.RUnlock()
+
+	if current != nil && peer.device.since(current.created) < peer.device.rejectAfterTime() {
+		status.State = HandshakeEstablished
+		status.Since = current.created
+		return status
+	}
+	if next != nil {
+		status.State = HandshakeResponseReceived
+		status.Since = next.created
+		return status
+	}
+
+	peer.handshake.mutex.RLock()
+	state, lastSent := peer.handshake.state, peer.handshake.lastSentHandshake
+	peer.handshake.mutex.RUnlock()
+
+	if state == handshakeInitiationCreated {
+		status.State = HandshakeInitiationSent
+		status.Since = lastSent
+		return status
+	}
+	if current != nil {
+		status.State = HandshakeExpired
+		status.Since = current.created.Add(peer.device.rejectAfterTime())
+		return status
+	}
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+		status.State = HandshakeExpired
+		status.Since = time.Unix(0, nano).Add(peer.device.rejectAfterTime())
+	}
+	return status
+}
+
+// PeerHandshakeState returns the state of the handshake with the peer
+// identified by pk, for building connection status displays.
+func (device *Device) PeerHandshakeState(pk NoisePublicKey) (HandshakeStatus, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return HandshakeStatus{}, ErrPeerNotFound
+	}
+	return peer.HandshakeStatus(), nil
+}
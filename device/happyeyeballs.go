@@ -0,0 +1,247 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Happy Eyeballs (RFC 8305) for endpoints given as a host name
+ *
+ * When the host resolves to several addresses, handshake initiations
+ * are raced across them, alternating address families and starting
+ * with IPv6, each EndpointRaceDelay after the previous one. The first
+ * candidate answering becomes the endpoint. Once EndpointRaceInterval
+ * has passed, the host is resolved again and the next initiation
+ * starts a new race.
+ */
+
+type endpointRace struct {
+	sync.Mutex
+	host       string          // host:port the candidates are resolved from, empty if none
+	candidates []conn.Endpoint // in the order initiations are sent to them
+	racing     bool            // no candidate has answered since the race started
+	won        time.Time       // when the endpoint won the last race
+	resolving  bool
+}
+
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr // variable for tests
+
+// orderCandidates interleaves the IPv6 and IPv4 addresses of ips,
+// starting with IPv6, see RFC 8305, section 4.
+func orderCandidates(ips []net.IP) []net.IP {
+	var ip6, ip4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for len(ip6) > 0 || len(ip4) > 0 {
+		if len(ip6) > 0 {
+			ordered = append(ordered, ip6[0])
+			ip6 = ip6[1:]
+		}
+		if len(ip4) > 0 {
+			ordered = append(ordered, ip4[0])
+			ip4 = ip4[1:]
+		}
+	}
+	return ordered
+}
+
+// ResolveEndpointCandidates resolves hostport, a host name or address
+// and a port, to the endpoints raced for a peer, in the order they are
+// tried.
+func ResolveEndpointCandidates(ctx context.Context, hostport string) ([]conn.Endpoint, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	var candidates []conn.Endpoint
+	for _, ip := range orderCandidates(ips) {
+		endpoint, err := conn.CreateEndpoint(net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, endpoint)
+	}
+	if len(candidates) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return candidates, nil
+}
+
+// setEndpointHost makes candidates, resolved from host, the candidates
+// of the endpoint of peer, racing them unless there is only one. The
+// caller holds the peer lock.
+func (peer *Peer) setEndpointHost(host string, candidates []conn.Endpoint) {
+	peer.endpoint = candidates[0]
+	peer.race.Lock()
+	peer.race.host = host
+	peer.race.candidates = candidates
+	peer.race.racing = len(candidates) > 1
+	peer.race.won = time.Now()
+	peer.race.Unlock()
+}
+
+// clearEndpointHost stops racing after the endpoint was set to an address.
+func (peer *Peer) clearEndpointHost() {
+	peer.race.Lock()
+	peer.race.host = ""
+	peer.race.candidates = nil
+	peer.race.racing = false
+	peer.race.Unlock()
+}
+
+// EndpointHost returns the host name the endpoint of peer is resolved
+// from, empty if the endpoint was given as an address.
+func (peer *Peer) EndpointHost() string {
+	peer.race.Lock()
+	defer peer.race.Unlock()
+	return peer.race.host
+}
+
+// raceCandidates returns the candidates the next handshake initiation is
+// raced across, nil unless a race is on. It starts a new race once the
+// current endpoint has been kept for EndpointRaceInterval.
+func (peer *Peer) raceCandidates() []conn.Endpoint {
+	peer.race.Lock()
+	defer peer.race.Unlock()
+
+	if peer.race.host == "" {
+		return nil
+	}
+	if !peer.race.racing && time.Since(peer.race.won) >= EndpointRaceInterval && !peer.race.resolving {
+		peer.race.resolving = true
+		go peer.reresolveEndpointHost(peer.race.host)
+	}
+	if !peer.race.racing {
+		return nil
+	}
+	return append([]conn.Endpoint(nil), peer.race.candidates...)
+}
+
+func (peer *Peer) reresolveEndpointHost(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	candidates, err := ResolveEndpointCandidates(ctx, host)
+	cancel()
+
+	peer.race.Lock()
+	peer.race.resolving = false
+	if err != nil || peer.race.host != host {
+		if err != nil {
+			peer.log.Debug.Println(peer, "- Failed to resolve endpoint", peer.device.redactEndpoint(host)+":", err)
+		}
+		peer.race.won = time.Now() // try again after another interval
+		peer.race.Unlock()
+		return
+	}
+	peer.race.candidates = candidates
+	peer.race.racing = len(candidates) > 1
+	peer.race.won = time.Now()
+	peer.race.Unlock()
+
+	if len(candidates) == 1 {
+		peer.Lock()
+		peer.endpoint = candidates[0]
+		peer.Unlock()
+		peer.tagEndpoint(candidates[0])
+	}
+}
+
+// stillRacing reports whether no candidate has answered yet.
+func (peer *Peer) stillRacing() bool {
+	peer.race.Lock()
+	defer peer.race.Unlock()
+	return peer.race.racing
+}
+
+// sendTo sends the message following MaxObfuscationOverhead bytes of
+// datagram to endpoint rather than to the endpoint of peer.
+func (peer *Peer) sendTo(datagram []byte, endpoint conn.Endpoint) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.net.bind == nil {
+		return ErrNoBind
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	datagram = peer.obfuscate(datagram, MaxObfuscationOverhead)
+	err := peer.device.unsafeSend(peer.device.net.bind, datagram, endpoint)
+	peer.sent(len(datagram), err)
+	return err
+}
+
+// sendHandshakeRace sends the initiation packet to the first candidate
+// and, while none answers, to the others one by one.
+func (peer *Peer) sendHandshakeRace(datagram []byte, candidates []conn.Endpoint) error {
+	err := peer.sendTo(datagram, candidates[0])
+
+	datagram = append([]byte(nil), datagram...)
+	go func() {
+		for _, candidate := range candidates[1:] {
+			time.Sleep(EndpointRaceDelay)
+			if !peer.isRunning.Get() || !peer.stillRacing() {
+				return
+			}
+			peer.log.Debug.Println(peer, "- Racing handshake initiation to", peer.device.redactEndpoint(candidate.DstToString()))
+			if err := peer.sendTo(datagram, candidate); err != nil {
+				peer.log.Debug.Println(peer, "- Failed to send handshake initiation to", peer.device.redactEndpoint(candidate.DstToString())+":", err)
+			}
+		}
+	}()
+	return err
+}
+
+// endpointAnswered ends a race when a handshake response arrives from
+// endpoint, which becomes the endpoint of peer even if roaming is disabled.
+func (peer *Peer) endpointAnswered(endpoint conn.Endpoint) {
+	peer.race.Lock()
+	racing := peer.race.racing
+	peer.race.racing = false
+	if racing {
+		peer.race.won = time.Now()
+	}
+	peer.race.Unlock()
+	if !racing {
+		return
+	}
+
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.Unlock()
+	peer.tagEndpoint(endpoint)
+	peer.log.Info.Println(peer, "- Endpoint race won by", peer.device.redactEndpoint(endpoint.DstToString()))
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestOrderCandidates(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	var ordered []string
+	for _, ip := range orderCandidates(ips) {
+		ordered = append(ordered, ip.String())
+	}
+	if got := strings.Join(ordered, " "); got != "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3" {
+		t.Errorf("candidates ordered as %s", got)
+	}
+}
+
+func TestEndpointRace(t *testing.T) {
+	previous := lookupIPAddr
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host != "peer.example" {
+			return nil, &net.DNSError{Err: "not found", Name: host, IsNotFound: true}
+		}
+		// the IPv6 candidate is tried first and never answers
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+	defer func() { lookupIPAddr = previous }()
+
+	port1 := getFreePort(t)
+	port2 := getFreePort(t)
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	assertNil(t, dev1.IpcSet(`private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=`+port1+`
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+allowed_ip=1.0.0.2/32
+endpoint_host=peer.example:`+port2+`
+`))
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	assertNil(t, dev2.IpcSet(`private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=`+port2+`
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+allowed_ip=1.0.0.1/32
+endpoint=127.0.0.1:`+port1+`
+`))
+
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"))
+	peer := dev1.LookupPeer(pk)
+	if !peer.stillRacing() {
+		t.Fatal("no race for a host with two addresses")
+	}
+
+	msg := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- msg
+	select {
+	case received := <-tun2.Inbound:
+		if !bytes.Equal(msg, received) {
+			t.Error("ping did not transit correctly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	if peer.stillRacing() {
+		t.Error("race not over after the handshake")
+	}
+	peer.RLock()
+	endpoint := peer.endpoint.DstToString()
+	peer.RUnlock()
+	if endpoint != "127.0.0.1:"+port2 {
+		t.Errorf("race won by %s", endpoint)
+	}
+
+	config, err := dev1.IpcGetConfig()
+	assertNil(t, err)
+	if host := config.Peers[0].EndpointHost; host != "peer.example:"+port2 {
+		t.Errorf("endpoint host reported as %q", host)
+	}
+	assertNil(t, dev1.IpcSet("public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nendpoint=127.0.0.1:"+port2+"\n"))
+	if host := peer.EndpointHost(); host != "" {
+		t.Errorf("endpoint host %q kept after setting an address", host)
+	}
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/* Health checks for supervisors, such as the systemd watchdog
+ *
+ * A device is healthy while it is open and the routines it cannot do
+ * without are running: those reading from the TUN device and working
+ * the queues, and, while the device is up, those receiving from the
+ * bind. A routine which died leaves the device unable to pass packets
+ * without closing it, which only a restart recovers from.
+ *
+ * A device is ready while it is healthy and able to pass packets: it is
+ * up, so is its TUN device, and its bind is open. A device whose peers
+ * are all failing to complete handshakes is not ready either, while one
+ * which did not try yet, such as a server waiting for its clients, is.
+ * Orchestrators take a device which is not ready out of service for a
+ * while, one which is not healthy they restart.
+ */
+
+var essentialRoutines = []routineKind{
+	routineReadFromTUN,
+	routineTUNEvents,
+	routineEncryption,
+	routineDecryption,
+	routineHandshake,
+	routineEvents,
+}
+
+// Check returns nil if the device is healthy, otherwise why it is not,
+// wrapping the failure reported by Err, ErrDeviceClosed or ErrUnhealthy.
+func (device *Device) Check() error {
+	if device.isClosed.Get() {
+		if err := device.Err(); err != nil {
+			return err
+		}
+		return ErrDeviceClosed
+	}
+
+	for _, kind := range essentialRoutines {
+		if atomic.LoadInt32(&device.diagnostics.routines[kind]) == 0 {
+			return fmt.Errorf("%w: %s routine not running", ErrUnhealthy, routineNames[kind])
+		}
+	}
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.isUp.Get() && device.net.bind != nil && !device.net.rebinding.Get() {
+		if atomic.LoadInt32(&device.diagnostics.routines[routineReceive]) == 0 {
+			return fmt.Errorf("%w: %s routine not running", ErrUnhealthy, routineNames[routineReceive])
+		}
+	}
+	return nil
+}
+
+// Ready returns nil if the device is ready to pass packets, otherwise why
+// it is not, wrapping ErrNotReady or the failure reported by Check.
+func (device *Device) Ready() error {
+	if err := device.Check(); err != nil {
+		return err
+	}
+	if !device.isUp.Get() {
+		return fmt.Errorf("%w: device down", ErrNotReady)
+	}
+
+	device.net.RLock()
+	bound, rebinding := device.net.bind != nil, device.net.rebinding.Get()
+	device.net.RUnlock()
+	if !bound {
+		return fmt.Errorf("%w: bind not open", ErrNotReady)
+	}
+	if rebinding {
+		return fmt.Errorf("%w: bind reopening", ErrNotReady)
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	var failing bool
+	for _, peer := range device.peers.keyMap {
+		if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 && device.since(time.Unix(0, nano)) < device.rejectAfterTime() {
+			return nil
+		}
+		if atomic.LoadUint32(&peer.timers.handshakeAttempts) > 0 {
+			failing = true
+		}
+	}
+	if failing {
+		return fmt.Errorf("%w: no handshake completed within %v", ErrNotReady, device.rejectAfterTime())
+	}
+	return nil
+}
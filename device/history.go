@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThroughputSample is the average throughput of a peer over the
+// StatsSampleInterval ending at Time.
+type ThroughputSample struct {
+	Time             time.Time
+	TxBytesPerSecond uint64
+	RxBytesPerSecond uint64
+}
+
+// statsHistory is a ring buffer of the throughput samples of a peer.
+type statsHistory struct {
+	sync.Mutex
+	samples  []ThroughputSample
+	next     int // index of the oldest sample once the ring is full
+	lastTx   uint64
+	lastRx   uint64
+	lastTime time.Time
+}
+
+func (history *statsHistory) add(now time.Time, tx, rx uint64, size int) {
+	history.Lock()
+	defer history.Unlock()
+
+	if !history.lastTime.IsZero() && now.After(history.lastTime) {
+		elapsed := uint64(now.Sub(history.lastTime))
+		sample := ThroughputSample{
+			Time:             now,
+			TxBytesPerSecond: (tx - history.lastTx) * uint64(time.Second) / elapsed,
+			RxBytesPerSecond: (rx - history.lastRx) * uint64(time.Second) / elapsed,
+		}
+		if len(history.samples) < size {
+			history.samples = append(history.samples, sample)
+		} else {
+			history.samples[history.next] = sample
+			history.next = (history.next + 1) % size
+		}
+	}
+	history.lastTx, history.lastRx, history.lastTime = tx, rx, now
+}
+
+// StatsHistory returns the throughput samples recorded for peer, oldest
+// first. It is empty unless DeviceOptions.StatsHistory is set.
+func (peer *Peer) StatsHistory() []ThroughputSample {
+	peer.history.Lock()
+	defer peer.history.Unlock()
+
+	samples := make([]ThroughputSample, 0, len(peer.history.samples))
+	samples = append(samples, peer.history.samples[peer.history.next:]...)
+	samples = append(samples, peer.history.samples[:peer.history.next]...)
+	return samples
+}
+
+// PeerStatsHistory returns the throughput samples of the peer identified by pk.
+func (device *Device) PeerStatsHistory(pk NoisePublicKey) ([]ThroughputSample, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return nil, ErrPeerNotFound
+	}
+	return peer.StatsHistory(), nil
+}
+
+// sampleStats records a throughput sample for every peer.
+func (device *Device) sampleStats(now time.Time) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		tx := atomic.LoadUint64(&peer.stats.txBytes)
+		rx := atomic.LoadUint64(&peer.stats.rxBytes)
+		peer.history.add(now, tx, rx, device.historySize)
+	}
+}
+
+/* Samples the throughput of all peers every StatsSampleInterval
+ *
+ * Obs. Only runs if DeviceOptions.StatsHistory is set
+ */
+func (device *Device) RoutineSampleStats() {
+	defer device.trackRoutine(routineSampleStats)()
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: stats sampler - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: stats sampler - started")
+	device.state.starting.Done()
+
+	ticker := time.NewTicker(StatsSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case now := <-ticker.C:
+			device.sampleStats(now)
+		}
+	}
+}
@@ -8,20 +8,52 @@ package device
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/* The index table is sharded by the low bits of the index, each shard
+ * with a lock of its own, so that handshakes and receive routines on
+ * different CPUs rarely contend. Indices are drawn from crypto/rand,
+ * hence remote parties cannot steer them into one shard.
+ *
+ * The table is bounded as a whole, so that initiations, each of which
+ * takes an index until the handshake completes or is abandoned, cannot
+ * grow it without limit. Once it is full, the least recently used
+ * pending handshake is evicted to make room and counted. Keypairs are
+ * never evicted, as that would silently break an established session;
+ * if only keypairs remain, the new entry is refused. Lookups stamp
+ * entries without taking the write lock, so eviction scans the shards
+ * for the oldest stamp, which only happens at capacity.
+ */
+
 type IndexTableEntry struct {
 	peer      *Peer
 	handshake *Handshake
 	keypair   *Keypair
 }
 
-type IndexTable struct {
+type indexTableSlot struct {
+	used  int64 // nano seconds since epoch of the last lookup, accessed atomically
+	entry IndexTableEntry
+}
+
+type indexTableShard struct {
 	sync.RWMutex
-	table map[uint32]IndexTableEntry
+	table     map[uint32]*indexTableSlot
+	evictions uint64 // guarded by the write lock
+}
+
+type IndexTable struct {
+	shards   [IndexTableShards]indexTableShard
+	capacity int64
+	entries  int64 // reserved by insert before adding to a shard, accessed atomically
 }
 
+var errIndexInUse = errors.New("index in use")
+
 func randUint32() (uint32, error) {
 	var integer [4]byte
 	_, err := rand.Read(integer[:])
@@ -29,30 +61,192 @@ func randUint32() (uint32, error) {
 	return binary.LittleEndian.Uint32(integer[:]), err
 }
 
-func (table *IndexTable) Init() {
-	table.Lock()
-	defer table.Unlock()
-	table.table = make(map[uint32]IndexTableEntry)
+// Init empties the table, which holds at most capacity entries, or
+// IndexTableSize if capacity is not positive.
+func (table *IndexTable) Init(capacity int) {
+	if capacity <= 0 {
+		capacity = IndexTableSize
+	}
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		shard.table = make(map[uint32]*indexTableSlot)
+		shard.evictions = 0
+		shard.Unlock()
+	}
+	atomic.StoreInt64(&table.entries, 0)
+	table.capacity = int64(capacity)
 }
 
-func (table *IndexTable) Delete(index uint32) {
-	table.Lock()
-	defer table.Unlock()
-	delete(table.table, index)
+func (table *IndexTable) shard(index uint32) *indexTableShard {
+	return &table.shards[index%IndexTableShards]
 }
 
-func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
-	table.Lock()
-	defer table.Unlock()
-	entry, ok := table.table[index]
-	if !ok {
+// Len returns the number of entries in the table.
+func (table *IndexTable) Len() int {
+	n := 0
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.RLock()
+		n += len(shard.table)
+		shard.RUnlock()
+	}
+	return n
+}
+
+// Evictions returns the number of entries evicted to make room.
+func (table *IndexTable) Evictions() uint64 {
+	var n uint64
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.RLock()
+		n += shard.evictions
+		shard.RUnlock()
+	}
+	return n
+}
+
+// reserve claims room for one entry, failing if the table is full.
+func (table *IndexTable) reserve() bool {
+	for {
+		n := atomic.LoadInt64(&table.entries)
+		if n >= table.capacity {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&table.entries, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (table *IndexTable) release() {
+	atomic.AddInt64(&table.entries, -1)
+}
+
+// evictHandshake removes the least recently used entry of a pending
+// handshake, reporting false if there is none.
+func (table *IndexTable) evictHandshake() bool {
+	for {
+		var oldest *indexTableSlot
+		var oldestIndex uint32
+		var oldestUsed int64
+		for i := range table.shards {
+			shard := &table.shards[i]
+			shard.RLock()
+			for index, slot := range shard.table {
+				if slot.entry.handshake == nil {
+					continue
+				}
+				used := atomic.LoadInt64(&slot.used)
+				if oldest == nil || used < oldestUsed {
+					oldest, oldestIndex, oldestUsed = slot, index, used
+				}
+			}
+			shard.RUnlock()
+		}
+		if oldest == nil {
+			return false
+		}
+
+		// the entry may have been deleted or swapped for a keypair since
+
+		shard := table.shard(oldestIndex)
+		shard.Lock()
+		slot, ok := shard.table[oldestIndex]
+		evicted := ok && slot == oldest && slot.entry.handshake != nil
+		if evicted {
+			delete(shard.table, oldestIndex)
+			shard.evictions++
+			table.release()
+		}
+		shard.Unlock()
+		if evicted {
+			return true
+		}
+	}
+}
+
+// remove deletes index if matches accepts its entry.
+func (table *IndexTable) remove(index uint32, matches func(*IndexTableEntry) bool) {
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	slot, ok := shard.table[index]
+	if !ok || !matches(&slot.entry) {
 		return
 	}
-	table.table[index] = IndexTableEntry{
-		peer:      entry.peer,
+	delete(shard.table, index)
+	table.release()
+}
+
+// DeleteHandshake removes index if it still belongs to handshake, so
+// that a stale index cannot remove an entry it was since reused for.
+func (table *IndexTable) DeleteHandshake(index uint32, handshake *Handshake) {
+	table.remove(index, func(entry *IndexTableEntry) bool {
+		return entry.handshake == handshake
+	})
+}
+
+// DeleteKeypair removes index if it still belongs to keypair.
+func (table *IndexTable) DeleteKeypair(index uint32, keypair *Keypair) {
+	table.remove(index, func(entry *IndexTableEntry) bool {
+		return entry.keypair == keypair
+	})
+}
+
+// SwapIndexForKeypair hands the index of a completed handshake over to
+// its keypair, reporting false if the index no longer belongs to the
+// handshake, for instance because it was evicted.
+func (table *IndexTable) SwapIndexForKeypair(index uint32, handshake *Handshake, keypair *Keypair) bool {
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	slot, ok := shard.table[index]
+	if !ok || slot.entry.handshake != handshake {
+		return false
+	}
+	slot.entry = IndexTableEntry{
+		peer:      slot.entry.peer,
 		keypair:   keypair,
 		handshake: nil,
 	}
+	return true
+}
+
+// insert adds entry under index, evicting a pending handshake to make
+// room. It fails with errIndexInUse if index is already used and with
+// ErrIndexTableFull if nothing can be evicted.
+func (table *IndexTable) insert(index uint32, entry IndexTableEntry) error {
+	shard := table.shard(index)
+
+	// check if index used
+
+	shard.RLock()
+	_, ok := shard.table[index]
+	shard.RUnlock()
+	if ok {
+		return errIndexInUse
+	}
+
+	for !table.reserve() {
+		if !table.evictHandshake() {
+			return ErrIndexTableFull
+		}
+	}
+
+	// check again while locked
+
+	shard.Lock()
+	defer shard.Unlock()
+	if _, found := shard.table[index]; found {
+		table.release()
+		return errIndexInUse
+	}
+	shard.table[index] = &indexTableSlot{
+		used:  time.Now().UnixNano(),
+		entry: entry,
+	}
+	return nil
 }
 
 func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake) (uint32, error) {
@@ -64,35 +258,28 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 			return index, err
 		}
 
-		// check if index used
-
-		table.RLock()
-		_, ok := table.table[index]
-		table.RUnlock()
-		if ok {
-			continue
-		}
-
-		// check again while locked
-
-		table.Lock()
-		_, found := table.table[index]
-		if found {
-			table.Unlock()
-			continue
-		}
-		table.table[index] = IndexTableEntry{
+		err = table.insert(index, IndexTableEntry{
 			peer:      peer,
 			handshake: handshake,
 			keypair:   nil,
+		})
+		if err != errIndexInUse {
+			return index, err
 		}
-		table.Unlock()
-		return index, nil
 	}
 }
 
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
-	table.RLock()
-	defer table.RUnlock()
-	return table.table[id]
+	shard := table.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	slot, ok := shard.table[id]
+	if !ok {
+		return IndexTableEntry{}
+	}
+	// stamp coarsely, sparing receive routines from contending on the slot
+	if now := time.Now().UnixNano(); now-atomic.LoadInt64(&slot.used) > int64(time.Second) {
+		atomic.StoreInt64(&slot.used, now)
+	}
+	return slot.entry
 }
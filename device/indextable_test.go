@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndexTableEviction(t *testing.T) {
+	var table IndexTable
+	table.Init(3)
+
+	// the indices fall into different shards, sharing one capacity
+
+	handshakes := make([]Handshake, 5)
+	indices := make([]uint32, len(handshakes))
+	add := func(i int) error {
+		indices[i] = uint32(i)
+		return table.insert(indices[i], IndexTableEntry{handshake: &handshakes[i]})
+	}
+	present := func(i int) bool {
+		return table.Lookup(indices[i]).handshake == &handshakes[i]
+	}
+	age := func(i int, d time.Duration) {
+		table.shard(indices[i]).table[indices[i]].used -= int64(d)
+	}
+
+	// the oldest handshake makes room
+
+	assertNil(t, add(0))
+	assertNil(t, add(1))
+	assertNil(t, add(2))
+	age(0, time.Minute)
+	assertNil(t, add(3))
+	if present(0) || !present(1) || !present(2) || !present(3) {
+		t.Fatal("oldest handshake not evicted")
+	}
+	if err := table.insert(indices[3], IndexTableEntry{}); err != errIndexInUse {
+		t.Errorf("inserting index twice: %v", err)
+	}
+
+	// keypairs are never evicted
+
+	keypairs := []*Keypair{new(Keypair), new(Keypair)}
+	if !table.SwapIndexForKeypair(indices[1], &handshakes[1], keypairs[0]) ||
+		!table.SwapIndexForKeypair(indices[2], &handshakes[2], keypairs[1]) {
+		t.Fatal("swap failed")
+	}
+	age(1, time.Minute*2)
+	age(2, time.Minute*2)
+	assertNil(t, add(4))
+	if present(3) || !present(4) {
+		t.Error("handshake not evicted")
+	}
+	if table.Lookup(indices[1]).keypair != keypairs[0] || table.Lookup(indices[2]).keypair != keypairs[1] {
+		t.Fatal("keypair evicted")
+	}
+	table.SwapIndexForKeypair(indices[4], &handshakes[4], new(Keypair))
+	if _, err := table.NewIndexForHandshake(nil, &handshakes[0]); err != ErrIndexTableFull {
+		t.Errorf("inserting into table of keypairs: %v", err)
+	}
+
+	// stale owners leave entries alone
+
+	if table.SwapIndexForKeypair(indices[3], &handshakes[3], new(Keypair)) {
+		t.Error("evicted handshake swapped")
+	}
+	table.DeleteHandshake(indices[1], &handshakes[1])
+	table.DeleteKeypair(indices[2], keypairs[0])
+	if table.Lookup(indices[1]).keypair != keypairs[0] || table.Lookup(indices[2]).keypair != keypairs[1] {
+		t.Error("entry deleted by stale owner")
+	}
+	table.DeleteKeypair(indices[1], keypairs[0])
+	if table.Lookup(indices[1]).peer != nil || table.Lookup(indices[1]).keypair != nil {
+		t.Error("entry not deleted by owner")
+	}
+	index, err := table.NewIndexForHandshake(nil, &handshakes[0])
+	assertNil(t, err)
+	if table.Lookup(index).handshake != &handshakes[0] {
+		t.Error("new index missing")
+	}
+
+	if n := table.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if n := table.Evictions(); n != 2 {
+		t.Errorf("Evictions() = %d, want 2", n)
+	}
+}
+
+func BenchmarkIndexTableLookup(b *testing.B) {
+	var table IndexTable
+	table.Init(0)
+
+	var handshake Handshake
+	indices := make([]uint32, 1024)
+	for i := range indices {
+		var err error
+		indices[i], err = table.NewIndexForHandshake(nil, &handshake)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			table.Lookup(indices[i%len(indices)])
+			if i%64 == 0 {
+				table.SwapIndexForKeypair(indices[i%len(indices)], &handshake, nil)
+			}
+			i++
+		}
+	})
+}
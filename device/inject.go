@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Injection and capture of datagrams
+ *
+ * Relay daemons and tests exchange the encrypted datagrams of a device
+ * without a network in between: InjectDatagram processes a datagram as
+ * if the bind had received it, filters and all, and the capture set by
+ * SetDatagramCapture takes the datagrams the device sends, handshake
+ * messages, cookie replies and probes included, in place of the bind.
+ * The bind is still needed for the device to come up, a bind that
+ * neither sends nor receives will do.
+ */
+
+// DatagramCapture is called with every datagram the device sends, on
+// the goroutine sending it, and must not block for long. It must copy
+// datagram to keep it.
+type DatagramCapture func(datagram []byte, endpoint conn.Endpoint)
+
+// SetDatagramCapture hands the datagrams the device sends to capture
+// instead of the bind, nil sends them through the bind, the default.
+func (device *Device) SetDatagramCapture(capture DatagramCapture) {
+	device.datagramCapture.Store(capture)
+}
+
+func (device *Device) capture() DatagramCapture {
+	capture, _ := device.datagramCapture.Load().(DatagramCapture)
+	return capture
+}
+
+// unsafeSend sends buffer to endpoint through bind, unless the capture
+// takes it. Caller must hold the net lock for reading.
+func (device *Device) unsafeSend(bind conn.Bind, buffer []byte, endpoint conn.Endpoint) error {
+	if capture := device.capture(); capture != nil {
+		capture(buffer, endpoint)
+		return nil
+	}
+	return bind.Send(buffer, endpoint)
+}
+
+// InjectDatagram processes datagram as if the bind had received it from
+// endpoint.
+func (device *Device) InjectDatagram(datagram []byte, endpoint conn.Endpoint) error {
+	if device.isClosed.Get() {
+		return ErrDeviceClosed
+	}
+	if len(datagram) > MaxMessageSize {
+		return fmt.Errorf("%w: datagram of %d bytes exceeds %d", ErrInvalidValue, len(datagram), MaxMessageSize)
+	}
+	if !device.receivePermitted(endpoint) {
+		device.dropped(DropFiltered, nil, datagram)
+		return nil
+	}
+
+	buffer, ok := device.tryGetMessageBuffer()
+	if !ok {
+		return ErrQueueFull
+	}
+	size := copy(buffer[:], datagram)
+	if size = device.unwrapDatagram(buffer, size); size < MinMessageSize {
+		device.malformed(MalformedTruncated, endpoint)
+		device.PutMessageBuffer(buffer)
+		return nil
+	}
+	if !device.receiveDatagram(buffer, size, endpoint) {
+		device.PutMessageBuffer(buffer)
+	}
+	return nil
+}
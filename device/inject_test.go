@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestInjectAndCapture(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	for i := range devs {
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind: binds[i].Open,
+		})
+		defer devs[i].Close()
+	}
+
+	// the datagrams captured from one device are injected into the
+	// other by a relay, as if sent from the listen port of the former
+
+	type datagram struct {
+		to     int
+		packet []byte
+	}
+	relay := make(chan datagram, 100)
+	var captured [2]uint64
+	for i := range devs {
+		i := i
+		devs[i].SetDatagramCapture(func(packet []byte, endpoint conn.Endpoint) {
+			atomic.AddUint64(&captured[i], 1)
+			select {
+			case relay <- datagram{1 - i, append([]byte(nil), packet...)}:
+			default:
+			}
+		})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case d := <-relay:
+				devs[d.to].InjectDatagram(d.packet, bindtest.ChannelEndpoint(51820+1-d.to))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other], 51820+other)))
+		devs[i].Up()
+	}
+
+	tuns[0].Outbound <- tuntest.Ping(addrs[1], addrs[0])
+	select {
+	case <-tuns[1].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not delivered through the relay")
+	}
+	tuns[1].Outbound <- tuntest.Ping(addrs[0], addrs[1])
+	select {
+	case <-tuns[0].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not delivered through the relay")
+	}
+
+	// initiation and data, response and data
+	if atomic.LoadUint64(&captured[0]) < 2 || atomic.LoadUint64(&captured[1]) < 2 {
+		t.Errorf("captured %d and %d datagrams", atomic.LoadUint64(&captured[0]), atomic.LoadUint64(&captured[1]))
+	}
+
+	if err := devs[0].InjectDatagram(make([]byte, MaxMessageSize+1), bindtest.ChannelEndpoint(51821)); err == nil {
+		t.Error("oversized datagram injected")
+	}
+}
@@ -6,6 +6,7 @@
 package device
 
 import (
+	"encoding/binary"
 	"net"
 )
 
@@ -20,3 +21,91 @@ const (
 	IPv6offsetSrc           = 8
 	IPv6offsetDst           = IPv6offsetSrc + net.IPv6len
 )
+
+const (
+	ipv4offsetFragment = 6
+	ipv4offsetProtocol = 9
+	ipv4offsetChecksum = 10
+	ipv6offsetNext     = 6
+)
+
+const (
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// transportChecksum returns the offset of the checksum of the TCP, UDP
+// or ICMPv6 header following the IP header of packet, which covers the
+// addresses in the IP header, or -1 if there is none, such as in
+// fragments and for other protocols.
+func transportChecksum(packet []byte) (offset int, protocol byte) {
+	var header int
+	switch packet[0] >> 4 {
+	case 4:
+		if binary.BigEndian.Uint16(packet[ipv4offsetFragment:])&0x1fff != 0 {
+			return -1, 0
+		}
+		protocol = packet[ipv4offsetProtocol]
+		header = int(packet[0]&0x0f) * 4
+	case 6:
+		protocol = packet[ipv6offsetNext]
+		header = 40
+	}
+	switch protocol {
+	case protocolTCP:
+		offset = header + 16
+	case protocolUDP:
+		offset = header + 6
+	case protocolICMPv6:
+		offset = header + 2
+	default:
+		return -1, protocol
+	}
+	if offset+2 > len(packet) {
+		return -1, protocol
+	}
+	return offset, protocol
+}
+
+// checksumAdjust updates the internet checksum sum for the data old
+// replaced by new, of the same even length, see RFC 1624.
+func checksumAdjust(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return ^uint16(acc)
+}
+
+// rewriteAddress replaces addr, the source or destination address in
+// the header of packet, by to, of the same length, updating the
+// checksums covering it.
+func rewriteAddress(packet []byte, addr []byte, to net.IP) {
+	old := append([]byte(nil), addr...)
+	copy(addr, to)
+
+	if packet[0]>>4 == 4 {
+		field := packet[ipv4offsetChecksum:]
+		binary.BigEndian.PutUint16(field, checksumAdjust(binary.BigEndian.Uint16(field), old, addr))
+	}
+
+	offset, protocol := transportChecksum(packet)
+	if offset < 0 {
+		return
+	}
+	field := packet[offset:]
+	sum := binary.BigEndian.Uint16(field)
+	if protocol == protocolUDP && sum == 0 {
+		return // UDP over IPv4 without checksum
+	}
+	sum = checksumAdjust(sum, old, addr)
+	if protocol == protocolUDP && sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(field, sum)
+}
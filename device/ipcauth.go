@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Authorization of IPC operations
+ *
+ * Whoever may connect to the UAPI socket may configure the device. On
+ * systems with several users, an IPCAuthorizer set by DeviceOptions
+ * decides which clients may perform which operations, so that some may
+ * view the configuration and statistics and others change them as well.
+ * UAPI sockets identify their clients by the credentials of the process
+ * which connected; other transports of the UAPI, such as HTTP servers,
+ * identify theirs by a token and call AuthorizeIPC before performing an
+ * operation.
+ */
+
+// IPCOperation is an operation of the UAPI.
+type IPCOperation int
+
+const (
+	IPCGet         IPCOperation = iota // reading the configuration and statistics, get=1 or get=<version>
+	IPCSet                             // changing the configuration, set=1
+	IPCDiagnostics                     // reading the diagnostics, diagnostics=1
+)
+
+func (op IPCOperation) String() string {
+	switch op {
+	case IPCGet:
+		return "get"
+	case IPCSet:
+		return "set"
+	case IPCDiagnostics:
+		return "diagnostics"
+	default:
+		return fmt.Sprintf("IPCOperation(UNKNOWN:%d)", int(op))
+	}
+}
+
+var ipcOperations = map[string]IPCOperation{
+	"get=1\n":         IPCGet,
+	"set=1\n":         IPCSet,
+	"diagnostics=1\n": IPCDiagnostics,
+}
+
+// parseIPCOperation returns the operation requested by the first line
+// of a UAPI exchange and the version of the protocol asked for, which
+// is 1 unless the line is get= with a later version, see UAPIVersion.
+func parseIPCOperation(line string) (IPCOperation, int, bool) {
+	if operation, ok := ipcOperations[line]; ok {
+		return operation, 1, true
+	}
+	if strings.HasPrefix(line, "get=") && strings.HasSuffix(line, "\n") {
+		version, err := strconv.Atoi(line[len("get=") : len(line)-1])
+		if err == nil && version > 1 {
+			return IPCGet, version, true
+		}
+	}
+	return 0, 0, false
+}
+
+// An IPCClient is the client of an IPC operation.
+type IPCClient struct {
+	Credentials ipc.Credentials // of the process connected to a UAPI socket, not Known otherwise
+	Token       string          // presented by the client of an HTTP transport, empty otherwise
+	Monitor     bool            // connected to a monitor socket, see IpcHandleMonitor
+}
+
+// An IPCAuthorizer decides which IPC operations clients may perform, see
+// DeviceOptions.IPCAuthorizer.
+type IPCAuthorizer interface {
+	// AuthorizeIPC returns an error if client may not perform op.
+	AuthorizeIPC(client IPCClient, op IPCOperation) error
+}
+
+// AuthorizeIPC returns an error if client may not perform op:
+// ErrReadOnly if it changes the configuration through a monitor socket,
+// or one wrapping ErrPermissionDenied if the IPCAuthorizer of the device
+// refuses it. Without an IPCAuthorizer, clients are allowed everything.
+func (device *Device) AuthorizeIPC(client IPCClient, op IPCOperation) error {
+	if client.Monitor && op == IPCSet {
+		return ErrReadOnly
+	}
+	if device.ipcAuthorizer == nil {
+		return nil
+	}
+	if err := device.ipcAuthorizer.AuthorizeIPC(client, op); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrPermissionDenied, op, err)
+	}
+	return nil
+}
+
+// String describes client by its credentials, as far as they are known,
+// or its token.
+func (client IPCClient) String() string {
+	var parts []string
+	if credentials := client.Credentials; credentials.Known {
+		if credentials.UID >= 0 {
+			parts = append(parts, fmt.Sprintf("uid=%d", credentials.UID))
+		}
+		if credentials.GID >= 0 {
+			parts = append(parts, fmt.Sprintf("gid=%d", credentials.GID))
+		}
+		if credentials.PID >= 0 {
+			parts = append(parts, fmt.Sprintf("pid=%d", credentials.PID))
+		}
+	}
+	if client.Token != "" {
+		parts = append(parts, "token")
+	}
+	if len(parts) == 0 {
+		return "unknown client"
+	}
+	return strings.Join(parts, " ")
+}
+
+// connClient returns the client connected to socket.
+func (device *Device) connClient(socket net.Conn, monitor bool) IPCClient {
+	credentials, err := ipc.PeerCredentials(socket)
+	if err != nil {
+		device.log.Debug.Println("UAPI: Failed to get peer credentials:", err)
+	}
+	return IPCClient{Credentials: credentials, Monitor: monitor}
+}
+
+// IPCPolicy is an IPCAuthorizer allowing clients by their user or group
+// IDs or tokens. User and group IDs count only if the credentials of the
+// client are Known, so that a client identified by a token alone is never
+// taken for root. Clients with the user ID 0 are allowed everything.
+type IPCPolicy struct {
+	ConfigureUIDs   []int    // users allowed every operation
+	ConfigureGIDs   []int    // groups allowed every operation
+	ConfigureTokens []string // tokens allowing every operation
+	ViewUIDs        []int    // users allowed get and diagnostics
+	ViewGIDs        []int    // groups allowed get and diagnostics
+	ViewTokens      []string // tokens allowing get and diagnostics
+}
+
+func (policy *IPCPolicy) AuthorizeIPC(client IPCClient, op IPCOperation) error {
+	if client.Credentials.Known && client.Credentials.UID == 0 {
+		return nil
+	}
+	if policy.matches(client, policy.ConfigureUIDs, policy.ConfigureGIDs, policy.ConfigureTokens) {
+		return nil
+	}
+	if op != IPCSet && policy.matches(client, policy.ViewUIDs, policy.ViewGIDs, policy.ViewTokens) {
+		return nil
+	}
+	return fmt.Errorf("client %v not allowed", client)
+}
+
+func (policy *IPCPolicy) matches(client IPCClient, uids, gids []int, tokens []string) bool {
+	if credentials := client.Credentials; credentials.Known {
+		for _, uid := range uids {
+			if uid >= 0 && uid == credentials.UID {
+				return true
+			}
+		}
+		for _, gid := range gids {
+			if gid >= 0 && gid == credentials.GID {
+				return true
+			}
+		}
+	}
+	if client.Token != "" {
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(client.Token)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
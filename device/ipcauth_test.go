@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestIPCPolicy(t *testing.T) {
+	policy := &IPCPolicy{
+		ConfigureGIDs: []int{100},
+		ViewUIDs:      []int{1000},
+		ViewTokens:    []string{"secret"},
+	}
+	user := func(uid, gid int) IPCClient {
+		return IPCClient{Credentials: ipc.Credentials{PID: -1, UID: uid, GID: gid, Known: true}}
+	}
+	token := IPCClient{Credentials: ipc.UnknownCredentials, Token: "secret"}
+	for _, test := range []struct {
+		client  IPCClient
+		op      IPCOperation
+		allowed bool
+	}{
+		{user(0, 0), IPCSet, true},
+		{user(1001, 100), IPCSet, true},
+		{user(1000, 1000), IPCGet, true},
+		{user(1000, 1000), IPCDiagnostics, true},
+		{user(1000, 1000), IPCSet, false},
+		{user(1001, 1001), IPCGet, false},
+		{token, IPCGet, true},
+		{token, IPCSet, false},
+		{IPCClient{Credentials: ipc.UnknownCredentials, Token: "guess"}, IPCGet, false},
+		{IPCClient{Credentials: ipc.UnknownCredentials}, IPCGet, false},
+		{IPCClient{Token: "guess"}, IPCSet, false},
+		{IPCClient{Credentials: ipc.Credentials{UID: 1000, GID: 100}}, IPCSet, false},
+	} {
+		if err := policy.AuthorizeIPC(test.client, test.op); (err == nil) != test.allowed {
+			t.Errorf("%+v %s: allowed=%v, want %v", test.client, test.op, err == nil, test.allowed)
+		}
+	}
+}
+
+// recordingAuthorizer allows gets only, recording the clients asking.
+type recordingAuthorizer struct {
+	clients chan IPCClient
+}
+
+func (authorizer recordingAuthorizer) AuthorizeIPC(client IPCClient, op IPCOperation) error {
+	authorizer.clients <- client
+	if op != IPCGet {
+		return errors.New("gets only")
+	}
+	return nil
+}
+
+func TestIPCAuthorizer(t *testing.T) {
+	authorizer := recordingAuthorizer{clients: make(chan IPCClient, 2)}
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), DeviceOptions{IPCAuthorizer: authorizer})
+	defer dev.Close()
+
+	dir, err := ioutil.TempDir("", "wireguard-ipc")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "wg0.sock"))
+	if err != nil {
+		t.Skip("unix sockets unavailable:", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+
+	request := func(op string) string {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+		fmt.Fprint(conn, op)
+		var reply strings.Builder
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() && scanner.Text() != "" {
+			reply.WriteString(scanner.Text() + "\n")
+		}
+		return reply.String()
+	}
+
+	if reply := request("get=1\n\n"); !strings.HasSuffix(reply, "errno=0\n") {
+		t.Errorf("get replied %q", reply)
+	}
+	client := <-authorizer.clients
+	if runtime.GOOS == "linux" && (!client.Credentials.Known || client.Credentials.UID != os.Getuid() || client.Credentials.PID != os.Getpid()) {
+		t.Errorf("client credentials %+v, want uid %d and pid %d", client.Credentials, os.Getuid(), os.Getpid())
+	}
+
+	reply := request("set=1\nlisten_port=4242\n\n")
+	if want := fmt.Sprintf("errno=%d\n", ipc.IpcErrorPermission); reply != want {
+		t.Errorf("set replied %q, want %q", reply, want)
+	}
+	<-authorizer.clients
+
+	if err := dev.AuthorizeIPC(IPCClient{Credentials: ipc.UnknownCredentials}, IPCSet); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("AuthorizeIPC of set = %v", err)
+	}
+	if err := dev.AuthorizeIPC(IPCClient{Monitor: true}, IPCSet); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("AuthorizeIPC of set through monitor = %v", err)
+	}
+}
@@ -56,6 +56,6 @@ func (kp *Keypairs) Current() *Keypair {
 
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
-		device.indexTable.Delete(key.localIndex)
+		device.indexTable.DeleteKeypair(key.localIndex, key)
 	}
 }
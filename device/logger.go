@@ -57,3 +57,45 @@ func NewLogger(level int, prepend string) *Logger {
 	)
 	return logger
 }
+
+// newPeerLogger returns a copy of logger, which a peer may later
+// redirect to its own log level without affecting the device.
+func newPeerLogger(logger *Logger) *Logger {
+	derive := func(l *log.Logger) *log.Logger {
+		return log.New(l.Writer(), l.Prefix(), l.Flags())
+	}
+	return &Logger{
+		Debug: derive(logger.Debug),
+		Info:  derive(logger.Info),
+		Error: derive(logger.Error),
+	}
+}
+
+// setLevel points the writers of logger, which was created by newPeerLogger
+// from parent, at the output of parent according to level. A negative level
+// restores the writers of parent. A silent parent keeps logger silent.
+func (logger *Logger) setLevel(parent *Logger, level int) {
+	if level < 0 {
+		logger.Debug.SetOutput(parent.Debug.Writer())
+		logger.Info.SetOutput(parent.Info.Writer())
+		logger.Error.SetOutput(parent.Error.Writer())
+		return
+	}
+
+	var output io.Writer = ioutil.Discard
+	for _, l := range []*log.Logger{parent.Debug, parent.Info, parent.Error} {
+		if w := l.Writer(); w != ioutil.Discard {
+			output = w
+			break
+		}
+	}
+	enabled := func(minimum int) io.Writer {
+		if level >= minimum {
+			return output
+		}
+		return ioutil.Discard
+	}
+	logger.Debug.SetOutput(enabled(LogLevelDebug))
+	logger.Info.SetOutput(enabled(LogLevelInfo))
+	logger.Error.SetOutput(enabled(LogLevelError))
+}
@@ -0,0 +1,455 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type loopbackDevice struct {
+	dev  *Device
+	tun  *tuntest.ChannelTUN
+	addr net.IP
+	key  NoisePrivateKey
+}
+
+// newLoopbackPair returns two devices connected to each other through
+// a pair of in-memory binds, with a session established. The caller
+// closes the devices.
+func newLoopbackPair(tb testing.TB) [2]loopbackDevice {
+	return newLoopbackPairWithOptions(tb, DeviceOptions{})
+}
+
+// newLoopbackPairWithOptions is newLoopbackPair, creating the devices
+// with opts.
+func newLoopbackPairWithOptions(tb testing.TB, opts DeviceOptions) [2]loopbackDevice {
+	binds := bindtest.NewChannelBinds()
+	var pair [2]loopbackDevice
+	for i := range pair {
+		var err error
+		pair[i].key, err = newPrivateKey()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pair[i].tun = tuntest.NewChannelTUN()
+		pair[i].addr = net.IPv4(1, 0, 0, byte(i+1))
+		opts.CreateBind = binds[i].Open
+		pair[i].dev = NewDeviceWithOptions(pair[i].tun.TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), opts)
+	}
+	for i := range pair {
+		other := 1 - i
+		err := pair[i].dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\nreplace_peers=true\npublic_key=%s\nprotocol_version=1\nreplace_allowed_ips=true\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			pair[i].key.ToHex(), 51820+i, pair[other].key.publicKey().ToHex(), pair[other].addr, 51820+other))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pair[i].dev.Up()
+	}
+
+	// push a first packet through to complete the handshake
+
+	ping := tuntest.Ping(pair[1].addr, pair[0].addr)
+	pair[0].tun.Outbound <- ping
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("handshake did not complete")
+	}
+	return pair
+}
+
+// udpPacket returns an IPv4 packet of the given total length.
+func udpPacket(dst, src net.IP, length int) []byte {
+	packet := make([]byte, length)
+	packet[0] = 0x45 // version 4, 20 byte header
+	binary.BigEndian.PutUint16(packet[2:], uint16(length))
+	packet[8] = 64 // TTL
+	packet[9] = 17 // UDP
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	return packet
+}
+
+func TestLoopbackPing(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	packet := udpPacket(pair[0].addr, pair[1].addr, 128)
+	pair[1].tun.Outbound <- packet
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet did not transit")
+	}
+}
+
+func TestRemovePeerDrain(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	pk := pair[1].key.publicKey()
+	before, _ := pair[1].dev.PeerStats(pair[0].key.publicKey())
+	peer := pair[0].dev.LookupPeer(pk)
+	assertNil(t, pair[0].dev.SetPeerExpiry(pk, time.Now().Add(time.Hour)))
+
+	done := make(chan struct{})
+	err := pair[0].dev.RemovePeerWithOptions(pk, RemovePeerOptions{
+		Drain: true,
+		Done:  func() { close(done) },
+	})
+	assertNil(t, err)
+	if pair[0].dev.LookupPeer(pk) != nil {
+		t.Error("peer still configured after removal")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * PeerDrainTimeout):
+		t.Fatal("completion callback was not called")
+	}
+	peer.expiry.Lock()
+	if peer.expiry.timer != nil {
+		t.Error("expiry timer left running after draining")
+	}
+	peer.expiry.Unlock()
+
+	// the final keepalive must have arrived on the other end
+
+	for deadline := time.Now().Add(time.Second); ; {
+		after, _ := pair[1].dev.PeerStats(pair[0].key.publicKey())
+		if after.RxBytes > before.RxBytes {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("final keepalive was not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := pair[0].dev.RemovePeerWithOptions(pk, RemovePeerOptions{}); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
+
+func TestRotatePrivateKeyKeepsSession(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	peer := pair[0].dev.LookupPeer(pair[1].key.publicKey())
+	peer.keypairs.RLock()
+	keypair := peer.keypairs.current
+	peer.keypairs.RUnlock()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, pair[0].dev.RotatePrivateKey(sk))
+
+	// the other end still knows only the old key, so this
+	// only makes it through on the established session
+
+	pair[0].tun.Outbound <- udpPacket(pair[1].addr, pair[0].addr, 128)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet did not transit after key rotation")
+	}
+
+	peer.keypairs.RLock()
+	current := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current != keypair {
+		t.Error("session was replaced by key rotation")
+	}
+}
+
+func TestExpirePeerSessions(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	peer := pair[0].dev.LookupPeer(pair[1].key.publicKey())
+	peer.keypairs.RLock()
+	keypair := peer.keypairs.current
+	peer.keypairs.RUnlock()
+
+	// initiations closer together than HandshakeInitationRate are dropped as a flood
+
+	time.Sleep(2 * HandshakeInitationRate)
+	err := pair[0].dev.IpcSet("public_key=" + pair[1].key.publicKey().ToHex() + "\nexpire_sessions=true\n")
+	assertNil(t, err)
+
+	// a fresh session is negotiated right away
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		peer.keypairs.RLock()
+		current := peer.keypairs.current
+		peer.keypairs.RUnlock()
+		if current != nil && current != keypair {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session was not replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pair[0].tun.Outbound <- udpPacket(pair[1].addr, pair[0].addr, 128)
+	select {
+	case <-pair[1].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet did not transit after expiring sessions")
+	}
+
+	var unknown NoisePublicKey
+	if err := pair[0].dev.ExpirePeerSessions(unknown); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
+
+// freeBuffers returns the number of preallocated buffers and elements
+// of device not in use.
+func freeBuffers(device *Device) (buffers, elems int) {
+	list := device.pool.elementFreelist
+	list.mutex.Lock()
+	for elem := list.head; elem != nil; elem = elem.next {
+		elems++
+	}
+	list.mutex.Unlock()
+	return len(device.pool.messageBufferReuseChan), elems
+}
+
+func TestStopPeersUnderLoad(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	pair := newLoopbackPairWithOptions(t, DeviceOptions{PreallocatedBuffers: 64})
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	// the routines reading from the TUN devices hold on to their
+	// buffers, hence the pools are compared to their size once idle
+
+	var idle [2][2]int
+	for i := range pair {
+		pair[i].dev.Down()
+		idle[i][0], idle[i][1] = freeBuffers(pair[i].dev)
+		pair[i].dev.Up()
+	}
+
+	// the sequential receivers block writing to the TUN devices, hence
+	// these are read until the devices are closed
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range pair {
+		packet := udpPacket(pair[1-i].addr, pair[i].addr, 1280)
+		tun := pair[i].tun
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case tun.Outbound <- packet:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		go func() {
+			for {
+				select {
+				case <-tun.Inbound:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// stop the peers while packets are being encrypted and decrypted
+
+	for round := 0; round < 20; round++ {
+		time.Sleep(5 * time.Millisecond)
+		pair[round%2].dev.Down()
+		pair[round%2].dev.Up()
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := range pair {
+		pair[i].dev.Down()
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			buffers, elems := freeBuffers(pair[i].dev)
+			if buffers == idle[i][0] && elems == idle[i][1] {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("device %d has %d free buffers and %d free elements, want %d and %d",
+					i, buffers, elems, idle[i][0], idle[i][1])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func benchmarkLoopback(b *testing.B, size int) {
+	pair := newLoopbackPair(b)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	packet := udpPacket(pair[1].addr, pair[0].addr, size)
+
+	// the device queues drop packets when they overflow, so bound the number
+	// of packets in flight well below their size rather than measuring losses
+
+	window := make(chan struct{}, 256)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			window <- struct{}{}
+			pair[0].tun.Outbound <- packet
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		select {
+		case <-pair[1].tun.Inbound:
+			<-window
+		case <-time.After(5 * time.Second):
+			b.Fatalf("packet %d of %d did not transit", i, b.N)
+		}
+	}
+
+	elapsed := time.Since(start).Seconds()
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/elapsed, "pkts/s")
+	b.ReportMetric(float64(b.N*size*8)/elapsed/1e9, "Gbps")
+}
+
+func BenchmarkLoopback(b *testing.B) {
+	for _, size := range []int{64, 512, 1420} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			benchmarkLoopback(b, size)
+		})
+	}
+}
+
+func TestPeerHandshakeState(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	for i := range pair {
+		status, err := pair[i].dev.PeerHandshakeState(pair[1-i].key.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != HandshakeEstablished || time.Since(status.Since) > 5*time.Second || !status.NextRetry.IsZero() {
+			t.Errorf("dev%d: unexpected status %+v", i+1, status)
+		}
+	}
+
+	var unknown NoisePublicKey
+	if _, err := pair[0].dev.PeerHandshakeState(unknown); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+
+	// a peer which never answers
+
+	binds := bindtest.NewChannelBinds()
+	dev := NewDeviceWithOptions(tuntest.NewChannelTUN().TUN(), NewLogger(LogLevelError, ""), DeviceOptions{
+		CreateBind: binds[0].Open,
+	})
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=51820\npublic_key=%s\nendpoint=127.0.0.1:51821\n",
+		pair[0].key.ToHex(), sk.publicKey().ToHex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.Up()
+
+	peer := dev.LookupPeer(sk.publicKey())
+	if status := peer.HandshakeStatus(); status.State != HandshakeNone || !status.Since.IsZero() {
+		t.Errorf("unexpected status before handshake %+v", status)
+	}
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		t.Fatal(err)
+	}
+	status := peer.HandshakeStatus()
+	if status.State != HandshakeInitiationSent || time.Since(status.Since) > time.Second || !status.NextRetry.After(time.Now()) {
+		t.Errorf("unexpected status after initiation %+v", status)
+	}
+}
+
+func TestPeerTimers(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	dev, pk := pair[0].dev, pair[1].key.publicKey()
+
+	timers, err := dev.PeerTimers(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(timers.SessionExpiry); until <= RejectAfterTime-5*time.Second || until > RejectAfterTime {
+		t.Errorf("session expires in %v, want about %v", until, RejectAfterTime)
+	}
+	if !timers.Rekey.IsZero() && timers.SessionExpiry.Sub(timers.Rekey) != RejectAfterTime-RekeyAfterTime {
+		t.Errorf("rekey at %v with the session expiring at %v", timers.Rekey, timers.SessionExpiry)
+	}
+	if timers.ZeroKeyMaterial.IsZero() || !timers.PersistentKeepalive.IsZero() || !timers.QuietUntil.IsZero() {
+		t.Errorf("unexpected timers %+v", timers)
+	}
+
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\npersistent_keepalive_interval=25\n"))
+	dev.Quiesce(time.Minute)
+
+	// the timer is armed once the first keepalive went out
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		timers, err = dev.PeerTimers(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !timers.PersistentKeepalive.IsZero() || time.Now().After(deadline) {
+			break
+		}
+	}
+	if until := time.Until(timers.PersistentKeepalive); until <= 0 || until > 25*time.Second {
+		t.Errorf("persistent keepalive in %v, want within 25s", until)
+	}
+	if until := time.Until(timers.QuietUntil); until <= 0 || until > time.Minute {
+		t.Errorf("quiet for %v, want within a minute", until)
+	}
+
+	diag := dev.Diagnostics().String()
+	if !strings.Contains(diag, "\npublic_key="+pk.ToHex()+"\n") || !strings.Contains(diag, "\nnext_persistent_keepalive_ms=") {
+		t.Errorf("timers missing from the dump:\n%s", diag)
+	}
+
+	var unknown NoisePublicKey
+	if _, err := dev.PeerTimers(unknown); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Malformed packets are counted per source address
+ *
+ * Datagrams too short for any message, messages or inner packets whose
+ * length does not add up, and messages failing authentication are
+ * counted by the address they came from, for up to MaxMalformedSources
+ * addresses, the least recently seen one making room. A source sending
+ * MalformedThreshold of them within MalformedWindow is reported with
+ * EventMalformedPackets, once per window, for external banning systems
+ * in the manner of fail2ban.
+ */
+
+type MalformedKind int
+
+const (
+	MalformedTruncated  MalformedKind = iota // datagram shorter than any message
+	MalformedBadLength                       // message or inner packet of invalid length
+	MalformedFailedAuth                      // message failing authentication, by its MAC or encryption
+	malformedKinds
+)
+
+func (kind MalformedKind) String() string {
+	switch kind {
+	case MalformedTruncated:
+		return "truncated"
+	case MalformedBadLength:
+		return "bad_length"
+	case MalformedFailedAuth:
+		return "failed_auth"
+	default:
+		return fmt.Sprintf("MalformedKind(UNKNOWN:%d)", int(kind))
+	}
+}
+
+// MalformedSource counts the malformed packets from an address.
+type MalformedSource struct {
+	Addr       net.IP
+	Truncated  uint64
+	BadLength  uint64
+	FailedAuth uint64
+	LastSeen   time.Time
+}
+
+type malformedSource struct {
+	counts      [malformedKinds]uint64
+	lastSeen    time.Time
+	windowStart time.Time
+	inWindow    int // malformed packets since windowStart
+	reported    bool
+}
+
+type malformedSources struct {
+	sync.Mutex
+	sources map[[16]byte]*malformedSource
+}
+
+// malformed counts a malformed packet of kind received from endpoint.
+func (device *Device) malformed(kind MalformedKind, endpoint conn.Endpoint) {
+	ip := endpoint.DstIP().To16()
+	if ip == nil {
+		return
+	}
+	var key [16]byte
+	copy(key[:], ip)
+	now := time.Now()
+
+	table := &device.malformedSources
+	table.Lock()
+	if table.sources == nil {
+		table.sources = make(map[[16]byte]*malformedSource)
+	}
+	source, ok := table.sources[key]
+	if !ok {
+		if len(table.sources) >= MaxMalformedSources {
+			table.unsafeEvict()
+		}
+		source = &malformedSource{windowStart: now}
+		table.sources[key] = source
+	}
+	source.counts[kind]++
+	source.lastSeen = now
+	if now.Sub(source.windowStart) >= MalformedWindow {
+		source.windowStart = now
+		source.inWindow = 0
+		source.reported = false
+	}
+	source.inWindow++
+	report := !source.reported && source.inWindow >= MalformedThreshold
+	source.reported = source.reported || report
+	count := source.inWindow
+	table.Unlock()
+
+	if report {
+		device.log.Info.Println("Malformed packets from", device.redactEndpoint(endpoint.DstToString()), "- latest", kind)
+		device.emitEvent(Event{Kind: EventMalformedPackets, Endpoint: net.IP(key[:]).String(), Packets: uint64(count)})
+	}
+}
+
+// unsafeEvict removes the least recently seen source.
+func (table *malformedSources) unsafeEvict() {
+	var oldest [16]byte
+	var oldestSeen time.Time
+	found := false
+	for key, source := range table.sources {
+		if !found || source.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen, found = key, source.lastSeen, true
+		}
+	}
+	delete(table.sources, oldest)
+}
+
+// MalformedSources returns the counters of the addresses malformed
+// packets were received from.
+func (device *Device) MalformedSources() []MalformedSource {
+	table := &device.malformedSources
+	table.Lock()
+	defer table.Unlock()
+	sources := make([]MalformedSource, 0, len(table.sources))
+	for key, source := range table.sources {
+		addr := net.IP(append([]byte(nil), key[:]...))
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4
+		}
+		sources = append(sources, MalformedSource{
+			Addr:       addr,
+			Truncated:  source.counts[MalformedTruncated],
+			BadLength:  source.counts[MalformedBadLength],
+			FailedAuth: source.counts[MalformedFailedAuth],
+			LastSeen:   source.lastSeen,
+		})
+	}
+	return sources
+}
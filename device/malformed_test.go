@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestMalformedSources(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		if event.Kind == EventMalformedPackets {
+			events <- event
+		}
+	})
+
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	for i := 0; i < MalformedThreshold*2; i++ {
+		kind := MalformedBadLength
+		if i == 0 {
+			kind = MalformedFailedAuth
+		}
+		dev.malformed(kind, endpoint)
+	}
+
+	select {
+	case event := <-events:
+		if event.Endpoint != "192.0.2.1" || event.Packets != MalformedThreshold {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("malformed packets not reported")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("source reported twice within MalformedWindow: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sources := dev.MalformedSources()
+	if len(sources) != 1 || !sources[0].Addr.Equal(net.IPv4(192, 0, 2, 1)) ||
+		sources[0].BadLength != MalformedThreshold*2-1 || sources[0].FailedAuth != 1 || sources[0].Truncated != 0 {
+		t.Errorf("MalformedSources() = %+v", sources)
+	}
+}
+
+func TestMalformedTruncated(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	port := getFreePort(t)
+	assertNil(t, dev.IpcSet("listen_port="+port+"\n"))
+	dev.Up()
+
+	sender, err := net.Dial("udp", "127.0.0.1:"+port)
+	assertNil(t, err)
+	defer sender.Close()
+	_, err = sender.Write([]byte{4, 0, 0, 0})
+	assertNil(t, err)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sources := dev.MalformedSources(); len(sources) == 1 {
+			if sources[0].Truncated != 1 || !sources[0].Addr.Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Errorf("MalformedSources() = %+v", sources)
+			}
+			return
+		}
+	}
+	t.Fatal("truncated datagram not counted")
+}
@@ -0,0 +1,12 @@
+// +build !linux,!freebsd,!openbsd,!netbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+func allocLockedPages(size int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
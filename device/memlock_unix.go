@@ -0,0 +1,26 @@
+// +build linux freebsd openbsd netbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// allocLockedPages maps size bytes of anonymous memory, locked so that
+// it is never swapped out.
+func allocLockedPages(size int) ([]byte, error) {
+	pages, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(pages); err != nil {
+		unix.Munmap(pages)
+		return nil, err
+	}
+	return pages, nil
+}
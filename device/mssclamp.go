@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* TCP MSS clamping
+ *
+ * TCP connections through the tunnel negotiate their segment size from
+ * the MTU of the endpoints, which may exceed the MTU of the tunnel when
+ * they are on other hosts the device routes for. Where path MTU
+ * discovery is broken, their large segments are then lost. Setups with
+ * iptables rewrite the MSS option of SYN segments to fit the tunnel,
+ * SetMSSClamping does the same for those without, such as containers
+ * or netstack: the MSS of the SYN segments read from the TUN device
+ * or received from a peer is lowered to fit the MTU of the peer, see
+ * Peer.MTU, which takes probing into account.
+ */
+
+const tcpOptionMSS = 2
+
+// SetMSSClamping sets whether the MSS of TCP SYN segments to and from
+// peers is lowered to fit the MTU of the peer.
+func (device *Device) SetMSSClamping(enabled bool) {
+	device.mssClamping.Set(enabled)
+}
+
+// MSSClamping reports whether the MSS of TCP SYN segments is clamped.
+func (device *Device) MSSClamping() bool {
+	return device.mssClamping.Get()
+}
+
+// clampMSS lowers the MSS of packet to fit mtu if packet is a TCP SYN
+// segment, updating its checksum, and reports whether it did.
+func clampMSS(packet []byte, mtu int) bool {
+	var header int
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[ipv4offsetProtocol] != protocolTCP {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[ipv4offsetFragment:])&0x1fff != 0 {
+			return false
+		}
+		header = int(packet[0]&0x0f) * 4
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen || packet[ipv6offsetNext] != protocolTCP {
+			return false
+		}
+		header = ipv6.HeaderLen
+	default:
+		return false
+	}
+
+	const tcpFlagSYN = 0x02
+	tcp := packet[header:]
+	if len(tcp) < 20 || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return false
+	}
+	max := mtu - header - 20
+	if max <= 0 {
+		return false
+	}
+
+	options := tcp[20:dataOffset]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0: // end of options
+			return false
+		case 1: // no operation
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return false
+		}
+		if options[i] == tcpOptionMSS && options[i+1] == 4 {
+			field := options[i+2 : i+4]
+			if int(binary.BigEndian.Uint16(field)) <= max {
+				return false
+			}
+
+			// the option may be at an odd offset, adjust the checksum for
+			// the aligned words around it
+
+			start := 20 + i + 2
+			aligned := start &^ 1
+			end := (start + 3) &^ 1
+			old := append([]byte(nil), tcp[aligned:end]...)
+			binary.BigEndian.PutUint16(field, uint16(max))
+			sum := binary.BigEndian.Uint16(tcp[16:])
+			binary.BigEndian.PutUint16(tcp[16:], checksumAdjust(sum, old, tcp[aligned:end]))
+			return true
+		}
+		i += int(options[i+1])
+	}
+	return false
+}
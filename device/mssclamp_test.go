@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// tcpSegment returns a TCP segment from src to dst with flags and
+// options, its checksum set.
+func tcpSegment(src, dst net.IP, flags byte, options []byte) []byte {
+	var packet []byte
+	tcp := make([]byte, 20+len(options))
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = flags
+	copy(tcp[20:], options)
+	pseudo := append(append([]byte(nil), src...), dst...)
+	pseudo = append(pseudo, 0, protocolTCP, byte(len(tcp)>>8), byte(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], sum(tcp, uint32(^sum(pseudo, 0))))
+
+	if ip4 := src.To4(); ip4 != nil {
+		packet = make([]byte, 20)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[ipv4offsetProtocol] = protocolTCP
+		copy(packet[IPv4offsetSrc:], ip4)
+		copy(packet[IPv4offsetDst:], dst.To4())
+	} else {
+		packet = make([]byte, 40)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[ipv6offsetNext] = protocolTCP
+		copy(packet[IPv6offsetSrc:], src)
+		copy(packet[IPv6offsetDst:], dst)
+	}
+	return append(packet, tcp...)
+}
+
+func TestClampMSS(t *testing.T) {
+	const syn, ack = 0x02, 0x10
+	mss := func(value uint16) []byte {
+		return []byte{tcpOptionMSS, 4, byte(value >> 8), byte(value)}
+	}
+	v4 := [2]net.IP{net.IPv4(192, 168, 4, 1).To4(), net.IPv4(192, 168, 4, 2).To4()}
+	v6 := [2]net.IP{net.ParseIP("fd00::1"), net.ParseIP("fd00::2")}
+
+	for _, test := range []struct {
+		name    string
+		addrs   [2]net.IP
+		flags   byte
+		options []byte
+		mtu     int
+		clamped bool
+		mss     uint16
+	}{
+		{"ipv4", v4, syn, mss(1460), 1420, true, 1380},
+		{"ipv6", v6, syn, mss(1440), 1420, true, 1360},
+		{"syn-ack", v4, syn | ack, mss(1460), 1420, true, 1380},
+		{"odd offset", v4, syn, append(append([]byte{1}, mss(1460)...), 0, 0, 0), 1420, true, 1380},
+		{"small enough", v4, syn, mss(1200), 1420, false, 1200},
+		{"not syn", v4, ack, mss(1460), 1420, false, 1460},
+		{"no mss", v4, syn, []byte{1, 1, 1, 0}, 1420, false, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			packet := tcpSegment(test.addrs[0], test.addrs[1], test.flags, test.options)
+			header := 20
+			if test.addrs[0].To4() == nil {
+				header = 40
+			}
+			if clamped := clampMSS(packet, test.mtu); clamped != test.clamped {
+				t.Fatalf("clamped = %v, want %v", clamped, test.clamped)
+			}
+
+			tcp := packet[header:]
+			for i := 20; i+4 <= len(tcp); i++ {
+				if tcp[i] == tcpOptionMSS && tcp[i+1] == 4 {
+					if got := binary.BigEndian.Uint16(tcp[i+2:]); got != test.mss {
+						t.Errorf("MSS = %d, want %d", got, test.mss)
+					}
+					break
+				}
+			}
+			pseudo := append(append([]byte(nil), test.addrs[0]...), test.addrs[1]...)
+			pseudo = append(pseudo, 0, protocolTCP, byte(len(tcp)>>8), byte(len(tcp)))
+			if got := sum(tcp, uint32(^sum(pseudo, 0))); got != 0 {
+				t.Errorf("invalid TCP checksum, sums to %#x", got)
+			}
+		})
+	}
+}
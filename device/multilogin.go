@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Same-key multi-login detection
+ *
+ * Machines sharing a private key keep replacing each other's sessions,
+ * the previous session remaining valid next to the current one. Their
+ * transport packets thus arrive under two sessions from two endpoints,
+ * interleaved. Switching sessions along with endpoints is counted, and
+ * MultiLoginSwitches of them within MultiLoginWindow are taken as the
+ * key being used on several machines. A rekey keeps the endpoint and
+ * roaming keeps the session, so neither counts.
+ */
+
+type MultiLoginPolicy int32
+
+const (
+	MultiLoginAllow        MultiLoginPolicy = iota // accept the packets of every session, the default
+	MultiLoginPreferLatest                         // drop the packets of sessions older than the latest one
+	MultiLoginReject                               // drop all sessions and refuse handshakes for MultiLoginBlockTime
+)
+
+func (policy MultiLoginPolicy) String() string {
+	switch policy {
+	case MultiLoginAllow:
+		return "allow"
+	case MultiLoginPreferLatest:
+		return "prefer_latest"
+	case MultiLoginReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("MultiLoginPolicy(UNKNOWN:%d)", int(policy))
+	}
+}
+
+// ParseMultiLoginPolicy parses the UAPI name of a policy, as returned
+// by MultiLoginPolicy.String.
+func ParseMultiLoginPolicy(s string) (MultiLoginPolicy, error) {
+	for _, policy := range []MultiLoginPolicy{MultiLoginAllow, MultiLoginPreferLatest, MultiLoginReject} {
+		if policy.String() == s {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: multi-login policy %q", ErrInvalidValue, s)
+}
+
+type multiLogin struct {
+	sync.Mutex
+	policy       int32    // MultiLoginPolicy, accessed atomically
+	keypair      *Keypair // session of the latest transport packet
+	endpoint     string   // where the session of the latest packet was first seen from
+	latest       *Keypair // most recently created session seen
+	switches     int      // session switches along with endpoints within MultiLoginWindow
+	lastSwitch   time.Time
+	detected     bool
+	blockedUntil time.Time // handshakes are refused until then, see MultiLoginReject
+}
+
+// SetMultiLoginPolicy sets what happens to the sessions of peer once its
+// key is found in use on several machines.
+func (peer *Peer) SetMultiLoginPolicy(policy MultiLoginPolicy) error {
+	if policy < MultiLoginAllow || policy > MultiLoginReject {
+		return fmt.Errorf("%w: multi-login policy %d", ErrInvalidValue, policy)
+	}
+	atomic.StoreInt32(&peer.multiLogin.policy, int32(policy))
+	return nil
+}
+
+// MultiLoginPolicy returns the policy set by SetMultiLoginPolicy.
+func (peer *Peer) MultiLoginPolicy() MultiLoginPolicy {
+	return MultiLoginPolicy(atomic.LoadInt32(&peer.multiLogin.policy))
+}
+
+func (device *Device) SetPeerMultiLoginPolicy(pk NoisePublicKey, policy MultiLoginPolicy) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	return peer.SetMultiLoginPolicy(policy)
+}
+
+// multiLoginBlocked reports whether handshakes with peer are refused
+// after its key was found in use on several machines.
+func (peer *Peer) multiLoginBlocked() bool {
+	peer.multiLogin.Lock()
+	defer peer.multiLogin.Unlock()
+	return peer.device.now().Before(peer.multiLogin.blockedUntil)
+}
+
+// acceptSession watches the sessions transport packets of peer arrive
+// under for multi-login, reporting whether the packet from endpoint,
+// authenticated with keypair, is accepted according to the policy.
+func (peer *Peer) acceptSession(keypair *Keypair, endpoint conn.Endpoint) bool {
+	ml := &peer.multiLogin
+	ml.Lock()
+
+	if ml.latest == nil || keypair.created.After(ml.latest.created) {
+		ml.latest = keypair
+	}
+
+	now := peer.device.now()
+	if ml.detected && now.Sub(ml.lastSwitch) >= MultiLoginWindow {
+		ml.detected = false
+		ml.switches = 0
+	}
+	if now.Before(ml.blockedUntil) {
+		ml.Unlock()
+		return false
+	}
+
+	detected := false
+	if keypair != ml.keypair {
+		source := endpoint.DstToString()
+		if ml.keypair != nil && source != ml.endpoint {
+			if now.Sub(ml.lastSwitch) >= MultiLoginWindow {
+				ml.switches = 0
+			}
+			ml.switches++
+			ml.lastSwitch = now
+			detected = !ml.detected && ml.switches >= MultiLoginSwitches
+			ml.detected = ml.detected || detected
+		}
+		ml.keypair = keypair
+		ml.endpoint = source
+	}
+
+	policy := peer.MultiLoginPolicy()
+	accept, reject := true, false
+	switch {
+	case !ml.detected || policy == MultiLoginAllow:
+	case policy == MultiLoginPreferLatest:
+		accept = keypair == ml.latest
+	case policy == MultiLoginReject:
+		ml.blockedUntil = now.Add(MultiLoginBlockTime)
+		ml.keypair = nil
+		ml.latest = nil
+		ml.switches = 0
+		ml.detected = false
+		accept, reject = false, true
+	}
+	ml.Unlock()
+
+	if detected {
+		atomic.AddUint64(&peer.stats.multiLogins, 1)
+		peer.log.Error.Println(peer, "- Key in use on several machines, latest endpoint", peer.device.redactEndpoint(endpoint.DstToString())+", applying policy", policy)
+		peer.device.emitEvent(Event{Kind: EventMultiLogin, Peer: peer.handshake.remoteStatic, Endpoint: endpoint.DstToString()})
+	}
+	if reject {
+		peer.ZeroAndFlushAll()
+	}
+	return accept
+}
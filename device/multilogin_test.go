@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// testClock is a Clock standing still unless advanced, with timers
+// running on the system clock.
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func (clock *testClock) advance(d time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestMultiLogin(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	endpoint1, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	endpoint2, err := conn.CreateEndpoint("198.51.100.1:51820")
+	assertNil(t, err)
+	older := &Keypair{created: time.Now().Add(-time.Second)}
+	newer := &Keypair{created: time.Now()}
+
+	// a rekey keeps the endpoint, roaming keeps the session
+
+	for _, packet := range []struct {
+		keypair  *Keypair
+		endpoint conn.Endpoint
+	}{{older, endpoint1}, {older, endpoint2}, {newer, endpoint2}, {older, endpoint2}, {newer, endpoint2}} {
+		if !peer.acceptSession(packet.keypair, packet.endpoint) {
+			t.Fatal("packet dropped without multi-login")
+		}
+	}
+	if stats := peer.Stats(); stats.MultiLogins != 0 {
+		t.Fatalf("multi-login detected after rekey and roaming")
+	}
+
+	// interleaving sessions from two endpoints are detected
+
+	assertNil(t, peer.SetMultiLoginPolicy(MultiLoginPreferLatest))
+	for i := 0; i < MultiLoginSwitches; i++ {
+		peer.acceptSession(older, endpoint1)
+		peer.acceptSession(newer, endpoint2)
+	}
+	if stats := peer.Stats(); stats.MultiLogins != 1 {
+		t.Errorf("%d multi-logins detected", stats.MultiLogins)
+	}
+	select {
+	case event := <-events:
+		if event.Kind != EventMultiLogin || event.Peer != sk.publicKey() {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	if peer.acceptSession(older, endpoint1) || !peer.acceptSession(newer, endpoint2) {
+		t.Error("prefer-latest policy did not prefer the latest session")
+	}
+
+	assertNil(t, peer.SetMultiLoginPolicy(MultiLoginReject))
+	if peer.acceptSession(newer, endpoint2) || !peer.multiLoginBlocked() {
+		t.Error("reject policy did not block the peer")
+	}
+	if err := peer.SetMultiLoginPolicy(MultiLoginReject + 1); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
+
+func TestMultiLoginBlockFollowsClock(t *testing.T) {
+	clock := &testClock{now: time.Unix(1e9, 0)}
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{Clock: clock})
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	assertNil(t, peer.SetMultiLoginPolicy(MultiLoginReject))
+
+	endpoint1, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	endpoint2, err := conn.CreateEndpoint("198.51.100.1:51820")
+	assertNil(t, err)
+	older := &Keypair{created: clock.Now().Add(-time.Second)}
+	newer := &Keypair{created: clock.Now()}
+	for i := 0; i < MultiLoginSwitches; i++ {
+		peer.acceptSession(older, endpoint1)
+		peer.acceptSession(newer, endpoint2)
+	}
+	if !peer.multiLoginBlocked() {
+		t.Fatal("reject policy did not block the peer")
+	}
+
+	clock.advance(MultiLoginBlockTime - time.Second)
+	if !peer.multiLoginBlocked() {
+		t.Error("peer unblocked before MultiLoginBlockTime passed on the device clock")
+	}
+	clock.advance(time.Second)
+	if peer.multiLoginBlocked() {
+		t.Error("peer still blocked after MultiLoginBlockTime passed on the device clock")
+	}
+}
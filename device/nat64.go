@@ -0,0 +1,212 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* On IPv6-only networks (mobile carriers running NAT64 or 464XLAT),
+ * IPv4 endpoints cannot be reached directly. Once sending to an IPv4
+ * endpoint fails as unreachable and a NAT64 prefix is known, either
+ * configured or discovered through DNS64 (RFC 7050), the endpoint is
+ * replaced by the IPv6 address the prefix maps it to (RFC 6052).
+ */
+
+type nat64 struct {
+	sync.RWMutex
+	prefix   net.IPNet // zero if unknown
+	discover bool
+}
+
+// wellKnownIPv4Only are the addresses of ipv4only.arpa, see RFC 7050.
+var wellKnownIPv4Only = []net.IP{
+	net.IPv4(192, 0, 0, 170).To4(),
+	net.IPv4(192, 0, 0, 171).To4(),
+}
+
+// nat64PrefixLengths are the prefix lengths permitted by RFC 6052,
+// in the order they are tried when discovering the prefix.
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// validNAT64Prefix reports whether prefix is an IPv6 prefix of a length
+// permitted by RFC 6052.
+func validNAT64Prefix(prefix net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 || prefix.IP.To16() == nil || prefix.IP.To4() != nil {
+		return false
+	}
+	for _, length := range nat64PrefixLengths {
+		if ones == length {
+			return true
+		}
+	}
+	return false
+}
+
+// SynthesizeNAT64 returns the IPv6 address prefix maps the IPv4 address
+// ip to, see RFC 6052. It returns nil if either argument is invalid.
+func SynthesizeNAT64(prefix net.IPNet, ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil || !validNAT64Prefix(prefix) {
+		return nil
+	}
+	ones, _ := prefix.Mask.Size()
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, prefix.IP.To16().Mask(prefix.Mask))
+	i := ones / 8
+	for _, b := range ip4 {
+		if i == 8 {
+			i++ // bits 64 to 71 are reserved
+		}
+		synthesized[i] = b
+		i++
+	}
+	return synthesized
+}
+
+// extractNAT64 is the inverse of SynthesizeNAT64 for prefix length ones.
+func extractNAT64(ip net.IP, ones int) net.IP {
+	extracted := make(net.IP, net.IPv4len)
+	i := ones / 8
+	for j := range extracted {
+		if i == 8 {
+			i++
+		}
+		extracted[j] = ip[i]
+		i++
+	}
+	return extracted
+}
+
+// nat64PrefixFrom finds the NAT64 prefix in the addresses ipv4only.arpa
+// resolved to, returning false if there is none.
+func nat64PrefixFrom(addrs []net.IP) (net.IPNet, bool) {
+	for _, addr := range addrs {
+		if addr.To4() != nil || len(addr) != net.IPv6len {
+			continue
+		}
+		for _, ones := range nat64PrefixLengths {
+			extracted := extractNAT64(addr, ones)
+			for _, known := range wellKnownIPv4Only {
+				if extracted.Equal(known) {
+					mask := net.CIDRMask(ones, 128)
+					return net.IPNet{IP: addr.Mask(mask), Mask: mask}, true
+				}
+			}
+		}
+	}
+	return net.IPNet{}, false
+}
+
+// DiscoverNAT64Prefix queries DNS64 for the NAT64 prefix of the network,
+// see RFC 7050.
+func DiscoverNAT64Prefix(ctx context.Context) (net.IPNet, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, "ipv4only.arpa")
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	prefix, ok := nat64PrefixFrom(ips)
+	if !ok {
+		return net.IPNet{}, errors.New("no NAT64 prefix")
+	}
+	return prefix, nil
+}
+
+// NAT64Prefix returns the NAT64 prefix in use, false if there is none.
+func (device *Device) NAT64Prefix() (net.IPNet, bool) {
+	device.nat64.RLock()
+	defer device.nat64.RUnlock()
+	return device.nat64.prefix, device.nat64.prefix.IP != nil
+}
+
+// SetNAT64Prefix sets the prefix IPv4 endpoints are mapped into once they
+// turn out to be unreachable, a zero prefix disables the mapping.
+func (device *Device) SetNAT64Prefix(prefix net.IPNet) error {
+	if prefix.IP != nil && !validNAT64Prefix(prefix) {
+		return ErrInvalidValue
+	}
+	device.nat64.Lock()
+	device.nat64.prefix = prefix
+	device.nat64.Unlock()
+	return nil
+}
+
+// discoverNAT64 refreshes the NAT64 prefix from DNS64, keeping the
+// previous one if discovery fails.
+func (device *Device) discoverNAT64() {
+	ctx, cancel := context.WithTimeout(context.Background(), NAT64DiscoveryTimeout)
+	defer cancel()
+	prefix, err := DiscoverNAT64Prefix(ctx)
+	if err != nil {
+		device.log.Debug.Println("NAT64 prefix not discovered:", err)
+		return
+	}
+	device.log.Info.Println("Discovered NAT64 prefix", prefix.String())
+	device.SetNAT64Prefix(prefix)
+}
+
+func unreachableError(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+// sendFailed maps the IPv4 endpoint of peer into the NAT64 prefix after
+// sending to it failed with err. Callers hold the peer lock for reading,
+// so the endpoint is replaced asynchronously.
+func (peer *Peer) sendFailed(err error) {
+	if !unreachableError(err) || peer.endpoint == nil {
+		return
+	}
+	if _, ok := peer.device.NAT64Prefix(); !ok {
+		return
+	}
+	if peer.endpoint.DstIP().To4() == nil || peer.nat64Pending.Swap(true) {
+		return
+	}
+	go peer.synthesizeNAT64Endpoint(peer.endpoint)
+}
+
+func (peer *Peer) synthesizeNAT64Endpoint(failed conn.Endpoint) {
+	defer peer.nat64Pending.Set(false)
+
+	prefix, ok := peer.device.NAT64Prefix()
+	if !ok {
+		return
+	}
+	ip := SynthesizeNAT64(prefix, failed.DstIP())
+	_, port, err := net.SplitHostPort(failed.DstToString())
+	if ip == nil || err != nil {
+		return
+	}
+	endpoint, err := conn.CreateEndpoint(net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		peer.log.Error.Println(peer, "- Failed to create NAT64 endpoint:", err)
+		return
+	}
+
+	peer.Lock()
+	if peer.endpoint != failed {
+		peer.Unlock()
+		return
+	}
+	peer.endpoint = endpoint
+	peer.Unlock()
+	peer.tagEndpoint(endpoint)
+	peer.log.Info.Println(peer, "- IPv4 endpoint unreachable, using NAT64 address", peer.device.redactEndpoint(endpoint.DstToString()))
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSynthesizeNAT64(t *testing.T) {
+	// examples of RFC 6052, section 2.4
+	tests := []struct {
+		prefix, synthesized string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	ip := net.IPv4(192, 0, 2, 33)
+	for _, test := range tests {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		assertNil(t, err)
+		synthesized := SynthesizeNAT64(*prefix, ip)
+		if synthesized.String() != test.synthesized {
+			t.Errorf("%s: synthesized %v, want %s", test.prefix, synthesized, test.synthesized)
+		}
+		ones, _ := prefix.Mask.Size()
+		if extracted := extractNAT64(synthesized, ones); !extracted.Equal(ip) {
+			t.Errorf("%s: extracted %v", test.prefix, extracted)
+		}
+		found, ok := nat64PrefixFrom([]net.IP{SynthesizeNAT64(*prefix, wellKnownIPv4Only[0])})
+		if !ok || found.String() != prefix.String() {
+			t.Errorf("%s: discovered %v", test.prefix, found.String())
+		}
+	}
+
+	_, invalid, _ := net.ParseCIDR("2001:db8::/33")
+	if SynthesizeNAT64(*invalid, ip) != nil {
+		t.Error("synthesized address with invalid prefix length")
+	}
+}
+
+func TestNAT64Endpoint(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	err = dev.IpcSet("public_key=" + sk.publicKey().ToHex() + "\nendpoint=192.0.2.33:51820\n")
+	assertNil(t, err)
+	peer := dev.LookupPeer(sk.publicKey())
+
+	endpoint := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+
+	// without a prefix, the endpoint is left alone
+
+	peer.RLock()
+	peer.sent(0, syscall.ENETUNREACH)
+	peer.RUnlock()
+	time.Sleep(10 * time.Millisecond)
+	if endpoint() != "192.0.2.33:51820" {
+		t.Fatalf("endpoint changed to %s without NAT64 prefix", endpoint())
+	}
+
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	assertNil(t, dev.SetNAT64Prefix(*prefix))
+	peer.RLock()
+	peer.sent(0, syscall.ENETUNREACH)
+	peer.RUnlock()
+	for deadline := time.Now().Add(5 * time.Second); endpoint() != "[64:ff9b::c000:221]:51820"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoint %s not mapped into NAT64 prefix", endpoint())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
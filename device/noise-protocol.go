@@ -117,22 +117,27 @@ type MessageCookieReply struct {
 }
 
 type Handshake struct {
+	*handshakeSecrets         // allocated from the secrets of the device, see secretArena
 	state                     handshakeState
 	mutex                     sync.RWMutex
-	hash                      [blake2s.Size]byte       // hash value
-	chainKey                  [blake2s.Size]byte       // chain key
-	presharedKey              NoiseSymmetricKey        // psk
-	localEphemeral            NoisePrivateKey          // ephemeral secret key
-	localIndex                uint32                   // used to clear hash-table
-	remoteIndex               uint32                   // index for sending
-	remoteStatic              NoisePublicKey           // long term key
-	remoteEphemeral           NoisePublicKey           // ephemeral public key
-	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
+	localIndex                uint32         // used to clear hash-table
+	remoteIndex               uint32         // index for sending
+	remoteStatic              NoisePublicKey // long term key
+	remoteEphemeral           NoisePublicKey // ephemeral public key
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
 }
 
+// handshakeSecrets holds the key material of a handshake.
+type handshakeSecrets struct {
+	hash                    [blake2s.Size]byte       // hash value
+	chainKey                [blake2s.Size]byte       // chain key
+	presharedKey            NoiseSymmetricKey        // psk
+	localEphemeral          NoisePrivateKey          // ephemeral secret key
+	precomputedStaticStatic [NoisePublicKeySize]byte // precomputed shared secret
+}
+
 var (
 	InitialChainKey [blake2s.Size]byte
 	InitialHash     [blake2s.Size]byte
@@ -189,7 +194,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	var err error
 	handshake.hash = InitialHash
 	handshake.chainKey = InitialChainKey
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = device.handshakeInputs.ephemeral()
 	if err != nil {
 		return nil, err
 	}
@@ -210,12 +215,14 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		return nil, errZeroECDHResult
 	}
 	var key [chacha20poly1305.KeySize]byte
+	defer setZero(key[:])
 	KDF2(
 		&handshake.chainKey,
 		&key,
 		handshake.chainKey[:],
 		ss[:],
 	)
+	setZero(ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	aead.Seal(msg.Static[:0], ZeroNonce[:], device.staticIdentity.publicKey[:], handshake.hash[:])
 	handshake.mixHash(msg.Static[:])
@@ -230,12 +237,12 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
+	timestamp := device.handshakeInputs.timestamp()
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
 	// assign index
-	device.indexTable.Delete(handshake.localIndex)
+	device.indexTable.DeleteHandshake(handshake.localIndex, handshake)
 	msg.Sender, err = device.indexTable.NewIndexForHandshake(peer, handshake)
 	if err != nil {
 		return nil, err
@@ -248,13 +255,23 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, _ := device.consumeMessageInitiation(msg, nil)
+	return peer
+}
+
+// consumeMessageInitiation is ConsumeMessageInitiation, except that once
+// msg is authenticated, accept may refuse it for the peer, returning an
+// error along with the peer and leaving its handshake state untouched.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, accept func(*Peer) error) (*Peer, error) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
+	defer setZero(hash[:])
+	defer setZero(chainKey[:])
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, nil
 	}
 
 	device.staticIdentity.RLock()
@@ -268,15 +285,17 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	var err error
 	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
+	defer setZero(key[:])
 	ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
 	if isZero(ss[:]) {
-		return nil
+		return nil, nil
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	setZero(ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
@@ -284,7 +303,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	peer := device.LookupPeer(peerPK)
 	if peer == nil {
-		return nil
+		return nil, nil
 	}
 
 	handshake := &peer.handshake
@@ -297,7 +316,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	KDF2(
 		&chainKey,
@@ -309,22 +328,28 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	flood := device.since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
-		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
-		return nil
+		peer.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
+		return nil, nil
 	}
 	if flood {
-		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
-		return nil
+		peer.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
+		return nil, nil
+	}
+
+	if accept != nil {
+		if err := accept(peer); err != nil {
+			return peer, err
+		}
 	}
 
 	// update handshake state
@@ -338,7 +363,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
-	now := time.Now()
+	now := device.now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
@@ -346,10 +371,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	handshake.mutex.Unlock()
 
-	setZero(hash[:])
-	setZero(chainKey[:])
-
-	return peer
+	return peer, nil
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -364,7 +386,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	// assign index
 
 	var err error
-	device.indexTable.Delete(handshake.localIndex)
+	device.indexTable.DeleteHandshake(handshake.localIndex, handshake)
 	handshake.localIndex, err = device.indexTable.NewIndexForHandshake(peer, handshake)
 	if err != nil {
 		return nil, err
@@ -377,7 +399,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	// create ephemeral key
 
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = device.handshakeInputs.ephemeral()
 	if err != nil {
 		return nil, err
 	}
@@ -390,12 +412,15 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		handshake.mixKey(ss[:])
 		ss = handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
 		handshake.mixKey(ss[:])
+		setZero(ss[:])
 	}()
 
 	// add preshared key
 
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
+	defer setZero(tau[:])
+	defer setZero(key[:])
 
 	KDF3(
 		&handshake.chainKey,
@@ -419,8 +444,16 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
+	peer, _ := device.consumeMessageResponse(msg, nil)
+	return peer
+}
+
+// consumeMessageResponse is ConsumeMessageResponse, except that once msg
+// is authenticated, accept may refuse it for the peer, returning an
+// error along with the peer and leaving its handshake state untouched.
+func (device *Device) consumeMessageResponse(msg *MessageResponse, accept func(*Peer) error) (*Peer, error) {
 	if msg.Type != MessageResponseType {
-		return nil
+		return nil, nil
 	}
 
 	// lookup handshake by receiver
@@ -428,13 +461,15 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	lookup := device.indexTable.Lookup(msg.Receiver)
 	handshake := lookup.handshake
 	if handshake == nil {
-		return nil
+		return nil, nil
 	}
 
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
+	defer setZero(hash[:])
+	defer setZero(chainKey[:])
 
 	ok := func() bool {
 
@@ -473,6 +508,8 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 		var tau [blake2s.Size]byte
 		var key [chacha20poly1305.KeySize]byte
+		defer setZero(tau[:])
+		defer setZero(key[:])
 		KDF3(
 			&chainKey,
 			&tau,
@@ -494,7 +531,12 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	}()
 
 	if !ok {
-		return nil
+		return nil, nil
+	}
+	if accept != nil {
+		if err := accept(lookup.peer); err != nil {
+			return lookup.peer, err
+		}
 	}
 
 	// update handshake state
@@ -508,10 +550,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 	handshake.mutex.Unlock()
 
-	setZero(hash[:])
-	setZero(chainKey[:])
-
-	return lookup.peer
+	return lookup.peer, nil
 }
 
 /* Derives a new keypair from the current handshake state
@@ -565,7 +604,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
 	keypair.sendNonce = 0
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
@@ -574,8 +613,11 @@ func (peer *Peer) BeginSymmetricSession() error {
 
 	// remap index
 
-	device.indexTable.SwapIndexForKeypair(handshake.localIndex, keypair)
+	swapped := device.indexTable.SwapIndexForKeypair(handshake.localIndex, handshake, keypair)
 	handshake.localIndex = 0
+	if !swapped {
+		return errors.New("handshake index evicted before the session began")
+	}
 
 	// rotate key pairs
 
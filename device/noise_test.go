@@ -8,7 +8,11 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.zx2c4.com/wireguard/tai64n"
 )
 
 func TestCurveWrappers(t *testing.T) {
@@ -142,3 +146,136 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestRefusedHandshakeLeavesState(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	handshakeElement := func(msg interface{}) *QueueHandshakeElement {
+		elem := new(QueueHandshakeElement)
+		writer := bytes.NewBuffer(elem.buffer[:0])
+		assertNil(t, binary.Write(writer, binary.LittleEndian, msg))
+		elem.packet = writer.Bytes()
+		return elem
+	}
+
+	// a refused initiation is not taken for a replay once accepted
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	peer1.disabled.Set(true)
+	if err := dev2.receiveInitiation(handshakeElement(msg1)); err != errPeerDisabled {
+		t.Fatalf("initiation of disabled peer refused with %v", err)
+	}
+	if peer1.handshake.state != handshakeZeroed || peer1.handshake.lastTimestamp != (tai64n.Timestamp{}) {
+		t.Error("refused initiation changed the handshake state")
+	}
+	peer1.disabled.Set(false)
+	if dev2.ConsumeMessageInitiation(msg1) != peer1 {
+		t.Fatal("initiation rejected after it was refused")
+	}
+
+	// a refused response leaves the initiation to complete
+
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	peer2.disabled.Set(true)
+	if err := dev1.receiveResponse(handshakeElement(msg2)); err != errPeerDisabled {
+		t.Fatalf("response of disabled peer refused with %v", err)
+	}
+	if peer2.handshake.state != handshakeInitiationCreated {
+		t.Error("refused response changed the handshake state")
+	}
+	peer2.disabled.Set(false)
+	if dev1.ConsumeMessageResponse(msg2) != peer2 {
+		t.Fatal("response rejected after it was refused")
+	}
+}
+
+// TestNoiseVectors runs a handshake with the keys of the X25519 test
+// vector of RFC 7748, section 6.1, as both static and ephemeral keys,
+// checking the public keys sent and the static shared secret against
+// the values published there.
+func TestNoiseVectors(t *testing.T) {
+	const (
+		alicePrivate = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+		alicePublic  = "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+		bobPrivate   = "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"
+		bobPublic    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+		sharedSecret = "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"
+	)
+	var alice, bob NoisePrivateKey
+	assertNil(t, alice.FromHex(alicePrivate))
+	assertNil(t, bob.FromHex(bobPrivate))
+
+	var timestamp tai64n.Timestamp
+	copy(timestamp[:], []byte{0x40, 0, 0, 0, 0x5f, 0x5e, 0x10, 0, 0, 0, 0, 0})
+	newDevice := func(name string, ephemeral NoisePrivateKey) *Device {
+		return NewDeviceWithOptions(newDummyTUN(name), NewLogger(LogLevelError, ""), DeviceOptions{
+			handshakeInputs: &deterministicHandshakes{
+				ephemerals: []NoisePrivateKey{ephemeral},
+				stamp:      timestamp,
+			},
+		})
+	}
+	dev1 := newDevice("dummy1", bob)
+	dev2 := newDevice("dummy2", alice)
+	defer dev1.Close()
+	defer dev2.Close()
+	assertNil(t, dev1.SetPrivateKey(alice))
+	assertNil(t, dev2.SetPrivateKey(bob))
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.publicKey)
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.publicKey)
+	assertNil(t, err)
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) != peer1 {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) != peer2 {
+		t.Fatal("handshake failed at response message")
+	}
+
+	for _, vector := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"initiator static", dev1.staticIdentity.publicKey[:], alicePublic},
+		{"responder static", dev2.staticIdentity.publicKey[:], bobPublic},
+		{"initiation ephemeral", msg1.Ephemeral[:], bobPublic},
+		{"response ephemeral", msg2.Ephemeral[:], alicePublic},
+		{"initiator static secret", peer2.handshake.precomputedStaticStatic[:], sharedSecret},
+		{"responder static secret", peer1.handshake.precomputedStaticStatic[:], sharedSecret},
+	} {
+		if got := hex.EncodeToString(vector.got); got != vector.want {
+			t.Errorf("%s = %s, want %s", vector.name, got, vector.want)
+		}
+	}
+	if peer1.handshake.lastTimestamp != timestamp {
+		t.Errorf("initiation timestamp = %x, want %x", peer1.handshake.lastTimestamp, timestamp)
+	}
+
+	// the handshake states agree, and so do the sessions derived from them
+
+	if peer1.handshake.chainKey != peer2.handshake.chainKey || peer1.handshake.hash != peer2.handshake.hash {
+		t.Fatal("handshake states differ")
+	}
+	assertNil(t, peer2.BeginSymmetricSession())
+	assertNil(t, peer1.BeginSymmetricSession())
+	var nonce [chacha20poly1305.NonceSize]byte
+	data := peer2.keypairs.current.send.Seal(nil, nonce[:], []byte("wireguard"), nil)
+	out, err := peer1.keypairs.loadNext().receive.Open(nil, nonce[:], data, nil)
+	assertNil(t, err)
+	assertEqual(t, out, []byte("wireguard"))
+}
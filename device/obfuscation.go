@@ -0,0 +1,207 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/* Obfuscation of datagrams
+ *
+ * On networks blocking or throttling anything recognizable as WireGuard,
+ * the datagrams sent to a peer may be disguised by an Obfuscation chosen
+ * per peer. Obfuscations are recognized on receipt before the peer is
+ * known, so that a datagram which does not start like a message of the
+ * protocol is unwrapped by the first registered obfuscation claiming it,
+ * whether or not any peer uses it. Both sides of a tunnel must choose
+ * the same obfuscation, which only hides the look of the datagrams, not
+ * their sizes or timing, and adds nothing to their security.
+ */
+
+// MaxObfuscationOverhead is the most bytes an Obfuscation may add in
+// front of a message. The device builds the messages it sends after as
+// much headroom, so that they are disguised in place.
+const MaxObfuscationOverhead = 16
+
+// An Obfuscation disguises datagrams.
+type Obfuscation interface {
+	// Name under which the obfuscation is chosen, see RegisterObfuscation.
+	Name() string
+
+	// Overhead returns the number of bytes, at most MaxObfuscationOverhead,
+	// which Wrap adds in front of every message.
+	Overhead() int
+
+	// Wrap disguises the message following the first Overhead bytes of
+	// datagram by filling them in, leaving the message untouched, as it
+	// may be wrapped again to be sent elsewhere.
+	Wrap(datagram []byte)
+
+	// Unwrap returns the packet disguised in datagram, which is a slice
+	// of it, or false if datagram is not disguised by this obfuscation.
+	Unwrap(datagram []byte) ([]byte, bool)
+}
+
+var obfuscations = struct {
+	sync.RWMutex
+	registered []Obfuscation
+}{
+	registered: []Obfuscation{TLSMimic},
+}
+
+// RegisterObfuscation makes obfuscation available to peers, replacing an
+// obfuscation registered under the same name.
+func RegisterObfuscation(obfuscation Obfuscation) {
+	obfuscations.Lock()
+	defer obfuscations.Unlock()
+	for i, registered := range obfuscations.registered {
+		if registered.Name() == obfuscation.Name() {
+			obfuscations.registered[i] = obfuscation
+			return
+		}
+	}
+	obfuscations.registered = append(obfuscations.registered, obfuscation)
+}
+
+// LookupObfuscation returns the registered obfuscation called name.
+func LookupObfuscation(name string) (Obfuscation, error) {
+	obfuscations.RLock()
+	defer obfuscations.RUnlock()
+	for _, registered := range obfuscations.registered {
+		if registered.Name() == name {
+			return registered, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: obfuscation %q", ErrInvalidValue, name)
+}
+
+// SetObfuscation disguises the datagrams sent to peer with the
+// registered obfuscation called name, or stops disguising them if name
+// is empty.
+func (peer *Peer) SetObfuscation(name string) error {
+	var obfuscation Obfuscation
+	overhead := 0
+	if name != "" {
+		var err error
+		if obfuscation, err = LookupObfuscation(name); err != nil {
+			return err
+		}
+		if overhead = obfuscation.Overhead(); overhead < 0 || overhead > MaxObfuscationOverhead {
+			return fmt.Errorf("%w: obfuscation %q adds %d bytes", ErrInvalidValue, name, overhead)
+		}
+	}
+	peer.Lock()
+	peer.obfuscation = obfuscation
+	atomic.StoreInt32(&peer.obfuscationOverhead, int32(overhead))
+	peer.Unlock()
+	return nil
+}
+
+// Obfuscation returns the name of the obfuscation of the datagrams sent
+// to peer, empty if they are not disguised.
+func (peer *Peer) Obfuscation() string {
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.obfuscation == nil {
+		return ""
+	}
+	return peer.obfuscation.Name()
+}
+
+// obfuscate disguises the message following headroom bytes of datagram
+// by the obfuscation of peer, returning the datagram to send. The message
+// is disguised in place if the headroom suffices, otherwise a copy is;
+// caller must hold the peer lock for reading.
+func (peer *Peer) obfuscate(datagram []byte, headroom int) []byte {
+	if peer.obfuscation == nil {
+		return datagram[headroom:]
+	}
+	overhead := peer.obfuscation.Overhead()
+	if headroom < overhead {
+		message := datagram[headroom:]
+		datagram = make([]byte, overhead+len(message))
+		copy(datagram[overhead:], message)
+		headroom = overhead
+	}
+	datagram = datagram[headroom-overhead:]
+	peer.obfuscation.Wrap(datagram)
+	return datagram
+}
+
+// unwrapDatagram moves the packet disguised in the datagram of size held
+// in buffer to its start, returning its size.
+func (device *Device) unwrapDatagram(buffer *[MaxMessageSize]byte, size int) int {
+	if size >= 4 {
+		switch binary.LittleEndian.Uint32(buffer[:4]) {
+		case MessageInitiationType, MessageResponseType, MessageCookieReplyType, MessageTransportType:
+			return size
+		}
+	}
+	obfuscations.RLock()
+	defer obfuscations.RUnlock()
+	for _, obfuscation := range obfuscations.registered {
+		if packet, ok := obfuscation.Unwrap(buffer[:size]); ok {
+			return copy(buffer[:], packet)
+		}
+	}
+	return size
+}
+
+/* TLS mimicry
+ *
+ * TLSMimic frames every datagram as a TLS 1.2 record, handshake messages
+ * as records of the handshake protocol and transport messages as records
+ * of application data, so that the tunnel superficially resembles TLS,
+ * best together with endpoints on port 443.
+ */
+
+// TLSMimic is the obfuscation called "tls-mimic".
+var TLSMimic Obfuscation = tlsMimic{}
+
+const (
+	tlsRecordHeaderSize      = 5
+	tlsRecordHandshake       = 0x16
+	tlsRecordApplicationData = 0x17
+	tlsVersionMajor          = 3
+	tlsVersionMinor          = 3 // TLS 1.2, which TLS 1.3 records claim as well
+)
+
+type tlsMimic struct{}
+
+func (tlsMimic) Name() string {
+	return "tls-mimic"
+}
+
+func (tlsMimic) Overhead() int {
+	return tlsRecordHeaderSize
+}
+
+func (tlsMimic) Wrap(datagram []byte) {
+	packet := datagram[tlsRecordHeaderSize:]
+	contentType := byte(tlsRecordApplicationData)
+	if len(packet) >= 4 && binary.LittleEndian.Uint32(packet[:4]) != MessageTransportType {
+		contentType = tlsRecordHandshake
+	}
+	datagram[0] = contentType
+	datagram[1] = tlsVersionMajor
+	datagram[2] = tlsVersionMinor
+	binary.BigEndian.PutUint16(datagram[3:tlsRecordHeaderSize], uint16(len(packet)))
+}
+
+func (tlsMimic) Unwrap(datagram []byte) ([]byte, bool) {
+	if len(datagram) < tlsRecordHeaderSize {
+		return nil, false
+	}
+	if datagram[0] != tlsRecordHandshake && datagram[0] != tlsRecordApplicationData ||
+		datagram[1] != tlsVersionMajor || datagram[2] != tlsVersionMinor ||
+		int(binary.BigEndian.Uint16(datagram[3:tlsRecordHeaderSize])) != len(datagram)-tlsRecordHeaderSize {
+		return nil, false
+	}
+	return datagram[tlsRecordHeaderSize:], true
+}
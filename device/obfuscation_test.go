@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTLSMimic(t *testing.T) {
+	for _, msgType := range []byte{MessageInitiationType, MessageTransportType} {
+		datagram := make([]byte, tlsRecordHeaderSize+64)
+		message := datagram[tlsRecordHeaderSize:]
+		message[0] = msgType
+		message[63] = 0xff
+		original := append([]byte(nil), message...)
+
+		TLSMimic.Wrap(datagram)
+		if !bytes.Equal(message, original) {
+			t.Errorf("message changed to %x", message)
+		}
+		want := byte(tlsRecordHandshake)
+		if msgType == MessageTransportType {
+			want = tlsRecordApplicationData
+		}
+		if datagram[0] != want {
+			t.Errorf("message of type %d wrapped in record of type %#x", msgType, datagram[0])
+		}
+		unwrapped, ok := TLSMimic.Unwrap(datagram)
+		if !ok || !bytes.Equal(unwrapped, original) {
+			t.Errorf("unwrapped %x, %v", unwrapped, ok)
+		}
+		if _, ok := TLSMimic.Unwrap(original); ok {
+			t.Error("unwrapped a plain message")
+		}
+		if _, ok := TLSMimic.Unwrap(datagram[:len(datagram)-1]); ok {
+			t.Error("unwrapped a truncated record")
+		}
+	}
+}
+
+func TestObfuscateInPlace(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	assertNil(t, peer.SetObfuscation(TLSMimic.Name()))
+
+	datagram := make([]byte, MaxObfuscationOverhead+MessageKeepaliveSize)
+	message := datagram[MaxObfuscationOverhead:]
+	message[0] = MessageTransportType
+	original := append([]byte(nil), message...)
+	peer.RLock()
+	wrapped := peer.obfuscate(datagram, MaxObfuscationOverhead)
+	peer.RUnlock()
+	if &wrapped[tlsRecordHeaderSize] != &message[0] || len(wrapped) != tlsRecordHeaderSize+len(message) {
+		t.Error("message not wrapped in place")
+	}
+	if !bytes.Equal(message, original) {
+		t.Errorf("message changed to %x", message)
+	}
+
+	// without headroom, a copy is wrapped
+
+	peer.RLock()
+	wrapped = peer.obfuscate(original, 0)
+	peer.RUnlock()
+	if len(wrapped) != tlsRecordHeaderSize+len(original) || original[0] != MessageTransportType {
+		t.Errorf("wrapped %x, leaving %x", wrapped, original)
+	}
+
+	// the record header is left out of the MTU of the peer
+
+	atomic.StoreInt32(&dev.tun.mtu, 1420)
+	mtu := peer.MTU()
+	assertNil(t, peer.SetObfuscation(""))
+	if plain := peer.MTU(); mtu != plain-tlsRecordHeaderSize {
+		t.Errorf("MTU %d obfuscated, %d plain", mtu, plain)
+	}
+}
+
+// sniffedBind records the first byte of the datagrams it sends.
+type sniffedBind struct {
+	conn.Bind
+	mutex sync.Mutex
+	first map[byte]int
+}
+
+func (bind *sniffedBind) Send(buff []byte, ep conn.Endpoint) error {
+	bind.mutex.Lock()
+	bind.first[buff[0]]++
+	bind.mutex.Unlock()
+	return bind.Bind.Send(buff, ep)
+}
+
+func TestObfuscatedLoopback(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	var sniffed [2]*sniffedBind
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	for i := range devs {
+		i := i
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+				bind, actualPort, err := binds[i].Open(port)
+				sniffed[i] = &sniffedBind{Bind: bind, first: make(map[byte]int)}
+				return sniffed[i], actualPort, err
+			},
+		})
+		defer devs[i].Close()
+	}
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\nobfuscation=tls-mimic\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other], 51820+other)))
+		devs[i].Up()
+	}
+
+	tuns[0].Outbound <- tuntest.Ping(addrs[1], addrs[0])
+	select {
+	case <-tuns[1].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet did not transit")
+	}
+	for i, bind := range sniffed {
+		bind.mutex.Lock()
+		for first, count := range bind.first {
+			if first != tlsRecordHandshake && first != tlsRecordApplicationData {
+				t.Errorf("device %d sent %d datagrams starting with %#x", i+1, count, first)
+			}
+		}
+		bind.mutex.Unlock()
+	}
+
+	// the obfuscation is configured and reported per peer
+
+	config, err := devs[0].ipcGet(UAPIVersion)
+	assertNil(t, err)
+	if !strings.Contains(config, "obfuscation=tls-mimic\n") {
+		t.Errorf("obfuscation missing from %q", config)
+	}
+	assertNil(t, devs[0].IpcSet(fmt.Sprintf("public_key=%s\nobfuscation=none\n", keys[1].publicKey().ToHex())))
+	if name := devs[0].LookupPeer(keys[1].publicKey()).Obfuscation(); name != "" {
+		t.Errorf("obfuscation %q after setting none", name)
+	}
+	err = devs[0].IpcSet(fmt.Sprintf("public_key=%s\nobfuscation=rot13\n", keys[1].publicKey().ToHex()))
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("unknown obfuscation set with %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Optional pacing of the packets sent to a peer
+ *
+ * A token bucket filled at the configured rate spreads bursts of
+ * encrypted packets out in time, so they do not overflow shallow
+ * buffers along the path. WireGuard has no feedback about the path,
+ * the rate is expected to come from an estimate made by the caller.
+ */
+
+type pacer struct {
+	sync.Mutex
+	enabled AtomicBool
+	rate    float64 // bytes per second
+	burst   float64 // bytes which may be sent back to back
+	tokens  float64
+	updated time.Time
+}
+
+func (p *pacer) set(rate, burst uint64) {
+	p.Lock()
+	defer p.Unlock()
+	p.rate = float64(rate)
+	p.burst = float64(burst)
+	if p.burst < MaxMessageSize {
+		p.burst = MaxMessageSize
+	}
+	p.tokens = p.burst
+	p.updated = time.Time{}
+	p.enabled.Set(rate != 0)
+}
+
+// delay takes size bytes from the bucket, returning how long to wait
+// before sending them.
+func (p *pacer) delay(size int, now time.Time) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	if p.rate == 0 {
+		return 0
+	}
+	if !p.updated.IsZero() {
+		p.tokens += now.Sub(p.updated).Seconds() * p.rate
+		if p.tokens > p.burst {
+			p.tokens = p.burst
+		}
+	}
+	p.updated = now
+	p.tokens -= float64(size)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.rate * float64(time.Second))
+}
+
+// SetPacing limits the rate at which packets are sent to peer to rate bytes
+// per second, of which burst bytes may be sent back to back. A rate of zero
+// disables pacing, which is the default.
+func (peer *Peer) SetPacing(rate, burst uint64) {
+	peer.pacer.set(rate, burst)
+}
+
+func (device *Device) SetPeerPacing(pk NoisePublicKey, rate, burst uint64) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetPacing(rate, burst)
+	return nil
+}
+
+// sendPaced sends the messages following MaxObfuscationOverhead bytes of
+// buffers from flow port flow like sendBuffers, waiting in between as far
+// as pacing requires. Buffers not sent yet when the peer stops are dropped.
+func (peer *Peer) sendPaced(buffers [][]byte, flow uint16) error {
+	if !peer.pacer.enabled.Get() {
+		return peer.sendBuffers(buffers, MaxObfuscationOverhead, flow)
+	}
+
+	start := 0
+	for i, buffer := range buffers {
+		delay := peer.pacer.delay(len(buffer)-MaxObfuscationOverhead, time.Now())
+		if delay <= 0 {
+			continue
+		}
+		if i > start {
+			if err := peer.sendBuffers(buffers[start:i], MaxObfuscationOverhead, flow); err != nil {
+				return err
+			}
+			start = i
+		}
+		atomic.AddUint64(&peer.stats.pacedPackets, 1)
+		atomic.AddUint64(&peer.stats.pacingDelayNano, uint64(delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-peer.routines.stop:
+			timer.Stop()
+			return nil
+		}
+	}
+	return peer.sendBuffers(buffers[start:], MaxObfuscationOverhead, flow)
+}
@@ -6,8 +6,7 @@
 package device
 
 import (
-	"encoding/base64"
-	"errors"
+	"bytes"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -22,13 +21,32 @@ const (
 
 type Peer struct {
 	isRunning                   AtomicBool
-	sync.RWMutex                // Mostly protects endpoint, but is generally taken whenever we modify peer
+	disabled                    AtomicBool // suspended, see Disable
+	responderOnly               AtomicBool // never initiates handshakes, see SetResponderOnly
+	sync.RWMutex                           // Mostly protects endpoint, but is generally taken whenever we modify peer
 	keypairs                    Keypairs
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    conn.Endpoint
 	persistentKeepaliveInterval uint16
 	disableRoaming              bool
+	obfuscation                 Obfuscation  // disguising the datagrams sent, nil for none
+	obfuscationOverhead         int32        // bytes the obfuscation adds, read without taking the peer lock
+	log                         *Logger      // peer scoped logger, see SetPeerLogLevel
+	lastEndpoint                atomic.Value // taggedEndpoint, read without taking the peer lock
+	nat64Pending                AtomicBool   // endpoint is being mapped into the NAT64 prefix
+	race                        endpointRace // candidates for the endpoint resolved from a host name
+	allowedSources              atomic.Value // allowedSources, read without taking the peer lock
+	expiry                      peerExpiry
+	ephemeral                   peerEphemeral
+	thresholds                  peerThresholds
+	quota                       peerQuota
+	handshakeRate               handshakeRate
+	multiLogin                  multiLogin
+	probe                       candidateProbe // probing of the endpoint candidates of the peer, see ReceiveCandidates
+	failover                    peerFailover   // backup allowed IPs, see AddBackupAllowedIP
+	balance                     peerBalance    // balanced allowed IPs, see AddBalancedAllowedIP
+	mtu                         peerMTU        // see ProbePeerMTU
 
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
@@ -36,9 +54,52 @@ type Peer struct {
 	// atomically-accessed fields up front, so that they can share in
 	// this alignment before smaller fields throw it off.
 	stats struct {
-		txBytes           uint64 // bytes send to peer (endpoint)
-		rxBytes           uint64 // bytes received from peer
-		lastHandshakeNano int64  // nano seconds since epoch
+		txBytes                    uint64 // bytes send to peer (endpoint)
+		rxBytes                    uint64 // bytes received from peer
+		lastHandshakeNano          int64  // nano seconds since epoch
+		connectedSinceNano         int64  // first handshake since the peer last had no session, zero if it has none
+		handshakePendingSinceNano  int64  // first initiation since the last completed handshake, zero if none is pending
+		handshakeRetransmits       uint64 // handshake initiations sent because of a timeout
+		handshakeAttemptsExhausted uint64 // times we gave up on completing a handshake
+		stagedDropped              uint64 // packets dropped from the nonce queue, see SetStagedQueue
+		pacedPackets               uint64 // packets held back by pacing, see SetPacing
+		pacingDelayNano            uint64 // total time packets were held back by pacing
+		encryptionTurns            uint64 // turns taken in the encryption queue
+		encryptedPackets           uint64 // packets handed to the encryption workers
+		encryptionDropped          uint64 // packets dropped as the encryption queue of the peer was full
+		sourceRejected             uint64 // packets dropped as they arrived from outside the allowed sources
+		handshakes                 uint64 // handshake initiations and responses consumed
+		multiLogins                uint64 // times the key was found in use on several machines
+		relayedPackets             uint64 // packets forwarded to other peers, see SetRelay
+		relayDenied                uint64 // packets for other peers dropped by the relay rules
+		priorityPackets            uint64 // packets staged with high priority
+		failedOver                 uint64 // packets sent to a backup as the session was dead
+		balancedPackets            uint64 // packets sent to the peer picked among balanced peers
+		controlSent                uint64 // control messages staged for the peer
+		controlReceived            uint64 // control messages received from the peer
+		quotaTxBytes               uint64 // bytes sent counted against the quota, see SetQuota
+		quotaRxBytes               uint64 // bytes received counted against the quota
+		quotaTxLimit               uint64 // TxBytes of the quota, zero for no limit
+		quotaRxLimit               uint64 // RxBytes of the quota, zero for no limit
+		sendErrors                 errorCounters
+	}
+
+	staged struct {
+		limit  int32 // maximum number of packets in the nonce queue
+		policy int32 // StagedDropPolicy
+	}
+
+	pacer   pacer
+	history statsHistory
+
+	statsGeneration struct {
+		last       PeerStats // values when generation was assigned
+		generation uint64
+	} // guarded by the statsGeneration lock of the device
+
+	encryption struct {
+		queue     chan *QueueOutboundElement // awaiting encryption, see encryptionQueue
+		scheduled bool                       // has a turn, guarded by the encryption queue
 	}
 
 	timers struct {
@@ -60,9 +121,11 @@ type Peer struct {
 	queue struct {
 		sync.RWMutex
 		nonce                           chan *QueueOutboundElement // nonce / pre-handshake queue
-		outbound                        chan *QueueOutboundElement // sequential ordering of work
-		inbound                         chan *QueueInboundElement  // sequential ordering of work
+		priority                        chan *QueueOutboundElement // served before nonce, see PacketPriority
+		outbound                        *orderedRing               // sequential ordering of work
+		inbound                         *orderedRing               // sequential ordering of work
 		packetInNonceQueueIsAwaitingKey AtomicBool
+		nonceWorker                     workWaiter // see RoutineNonce
 	}
 
 	routines struct {
@@ -77,7 +140,7 @@ type Peer struct {
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	if device.isClosed.Get() {
-		return nil, errors.New("device closed")
+		return nil, ErrDeviceClosed
 	}
 
 	// lock resources
@@ -90,8 +153,8 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	// check if over limit
 
-	if len(device.peers.keyMap) >= MaxPeers {
-		return nil, errors.New("too many peers")
+	if limit := device.peerLimit(); len(device.peers.keyMap) >= limit {
+		return nil, fmt.Errorf("%w: limit of %d reached", ErrTooManyPeers, limit)
 	}
 
 	// create peer
@@ -102,19 +165,24 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
+	peer.log = newPeerLogger(device.log)
 	peer.isRunning.Set(false)
+	peer.staged.limit = int32(device.queueSizes.outbound)
+	peer.balance.weight = DefaultBalanceWeight
+	peer.encryption.queue = make(chan *QueueOutboundElement, peer.device.queueSizes.outbound)
 
 	// map public key
 
 	_, ok := device.peers.keyMap[pk]
 	if ok {
-		return nil, errors.New("adding existing peer")
+		return nil, ErrPeerExists
 	}
 
 	// pre-compute DH
 
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
+	handshake.handshakeSecrets = device.allocHandshakeSecrets()
 	handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
@@ -125,7 +193,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	// add
 
-	device.peers.keyMap[pk] = peer
+	device.unsafeStorePeerKey(pk, peer)
 
 	// start peer
 
@@ -137,34 +205,283 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	return peer.sendDatagram(buffer, 0)
+}
+
+// sendDatagram sends the message following headroom bytes of datagram
+// like SendBuffer, see obfuscate.
+func (peer *Peer) sendDatagram(datagram []byte, headroom int) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
 	if peer.device.net.bind == nil {
-		return errors.New("no bind")
+		return ErrNoBind
 	}
 
 	peer.RLock()
 	defer peer.RUnlock()
 
 	if peer.endpoint == nil {
-		return errors.New("no known endpoint for peer")
+		return ErrNoEndpoint
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
-	if err == nil {
-		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	datagram = peer.obfuscate(datagram, headroom)
+	err := peer.device.unsafeSend(peer.device.net.bind, datagram, peer.endpoint)
+	peer.sent(len(datagram), err)
+	return err
+}
+
+// SendBuffers sends buffers in order like SendBuffer, handing them
+// to the bind at once if it is a conn.BatchSender.
+func (peer *Peer) SendBuffers(buffers [][]byte) error {
+	return peer.sendBuffers(buffers, 0, 0)
+}
+
+// sendBuffers sends the messages following headroom bytes of buffers
+// from flow port flow like SendBuffers, replacing buffers by the
+// datagrams sent, see obfuscate.
+func (peer *Peer) sendBuffers(buffers [][]byte, headroom int, flow uint16) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	bind := peer.device.unsafeFlowBind(flow)
+	if bind == nil {
+		return ErrNoBind
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.endpoint == nil {
+		return ErrNoEndpoint
 	}
+
+	for i := range buffers {
+		buffers[i] = peer.obfuscate(buffers[i], headroom)
+	}
+
+	var err error
+	size := 0
+	if batcher, ok := bind.(conn.BatchSender); ok && len(buffers) > 1 && peer.device.capture() == nil {
+		err = batcher.SendBatch(buffers, peer.endpoint)
+		if err == nil {
+			for _, buffer := range buffers {
+				size += len(buffer)
+			}
+		}
+	} else {
+		for _, buffer := range buffers {
+			if err = peer.device.unsafeSend(bind, buffer, peer.endpoint); err != nil {
+				break
+			}
+			size += len(buffer)
+		}
+	}
+	peer.sent(size, err)
 	return err
 }
 
+// sent accounts for size bytes sent to the peer before err occurred,
+// caller must hold the net lock and the peer lock for reading.
+func (peer *Peer) sent(size int, err error) {
+	atomic.AddUint64(&peer.stats.txBytes, uint64(size))
+	peer.accountQuota(uint64(size), 0)
+	if err == nil {
+		atomic.StoreUint32(&peer.device.net.sendErrors, 0)
+	} else {
+		peer.stats.sendErrors.add(err)
+		peer.device.sendFailed(err)
+		peer.sendFailed(err)
+		if bindErrorIsPersistent(err) && atomic.AddUint32(&peer.device.net.sendErrors, 1) >= RebindAfterSendErrors {
+			peer.device.bindFailed(peer.device.net.bind, err)
+		}
+	}
+}
+
+// PeerStats is a snapshot of the counters kept for a peer.
+type PeerStats struct {
+	TxBytes                    uint64
+	RxBytes                    uint64
+	LastHandshake              time.Time // zero if no handshake has completed
+	ConnectedSince             time.Time // first handshake of the current continuous session, zero if there is none
+	HandshakeRetransmits       uint64
+	HandshakeAttemptsExhausted uint64
+	StagedPacketsDropped       uint64
+	PacedPackets               uint64
+	PacingDelay                time.Duration
+	EncryptionTurns            uint64 // turns taken in the encryption workers, which serve peers round-robin
+	EncryptedPackets           uint64
+	EncryptionDropped          uint64      // packets dropped as the encryption queue of the peer was full
+	SourceRejected             uint64      // packets dropped as they arrived from outside the allowed sources
+	Handshakes                 uint64      // handshake initiations and responses received from the peer
+	RecentHandshakes           int         // handshakes within HandshakeRateWindow, up to AnomalousHandshakes
+	HandshakeAnomaly           bool        // the peer handshakes abnormally often, see EventHandshakeAnomaly
+	MultiLogins                uint64      // times the key was found in use on several machines, see MultiLoginPolicy
+	RelayedPackets             uint64      // packets from the peer forwarded to other peers, see Device.SetRelay
+	RelayDenied                uint64      // packets from the peer for other peers dropped by the relay rules
+	PriorityPackets            uint64      // packets to the peer staged with high priority, see Device.SetPacketClassifier
+	FailedOver                 uint64      // packets to the peer sent to a backup as its session was dead, see Peer.AddBackupAllowedIP
+	BalancedPackets            uint64      // packets sent to the peer picked among balanced peers, see Peer.AddBalancedAllowedIP
+	ControlSent                uint64      // control messages sent to the peer, see Device.SendControl
+	ControlReceived            uint64      // control messages received from the peer, see Device.SetControlHandler
+	QuotaTxBytes               uint64      // bytes sent to the peer counted against its quota, see Peer.SetQuota
+	QuotaRxBytes               uint64      // bytes received from the peer counted against its quota
+	QuotaExceeded              bool        // the peer exceeded its quota, see EventQuotaExceeded
+	SendErrors                 ErrorCounts // errors sending to the peer by their cause
+	Generation                 uint64      // changes whenever the other values do, see Device.PeerStatsChangedSince
+}
+
+func (peer *Peer) Stats() PeerStats {
+	peer.device.statsGeneration.Lock()
+	defer peer.device.statsGeneration.Unlock()
+	return peer.unsafeStats()
+}
+
+// unsafeStats returns the stats of peer, assigning a new generation if
+// they changed. The statsGeneration lock of the device must be held.
+func (peer *Peer) unsafeStats() PeerStats {
+	stats := PeerStats{
+		TxBytes:                    atomic.LoadUint64(&peer.stats.txBytes),
+		RxBytes:                    atomic.LoadUint64(&peer.stats.rxBytes),
+		HandshakeRetransmits:       atomic.LoadUint64(&peer.stats.handshakeRetransmits),
+		HandshakeAttemptsExhausted: atomic.LoadUint64(&peer.stats.handshakeAttemptsExhausted),
+		StagedPacketsDropped:       atomic.LoadUint64(&peer.stats.stagedDropped),
+		PacedPackets:               atomic.LoadUint64(&peer.stats.pacedPackets),
+		PacingDelay:                time.Duration(atomic.LoadUint64(&peer.stats.pacingDelayNano)),
+		EncryptionTurns:            atomic.LoadUint64(&peer.stats.encryptionTurns),
+		EncryptedPackets:           atomic.LoadUint64(&peer.stats.encryptedPackets),
+		EncryptionDropped:          atomic.LoadUint64(&peer.stats.encryptionDropped),
+		SourceRejected:             atomic.LoadUint64(&peer.stats.sourceRejected),
+		Handshakes:                 atomic.LoadUint64(&peer.stats.handshakes),
+		MultiLogins:                atomic.LoadUint64(&peer.stats.multiLogins),
+		RelayedPackets:             atomic.LoadUint64(&peer.stats.relayedPackets),
+		RelayDenied:                atomic.LoadUint64(&peer.stats.relayDenied),
+		PriorityPackets:            atomic.LoadUint64(&peer.stats.priorityPackets),
+		FailedOver:                 atomic.LoadUint64(&peer.stats.failedOver),
+		BalancedPackets:            atomic.LoadUint64(&peer.stats.balancedPackets),
+		ControlSent:                atomic.LoadUint64(&peer.stats.controlSent),
+		ControlReceived:            atomic.LoadUint64(&peer.stats.controlReceived),
+		QuotaTxBytes:               atomic.LoadUint64(&peer.stats.quotaTxBytes),
+		QuotaRxBytes:               atomic.LoadUint64(&peer.stats.quotaRxBytes),
+		QuotaExceeded:              peer.quota.exceeded.Get(),
+		SendErrors:                 peer.stats.sendErrors.counts(),
+	}
+	stats.RecentHandshakes, stats.HandshakeAnomaly = peer.recentHandshakes()
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+		stats.LastHandshake = time.Unix(0, nano)
+	}
+	if nano := atomic.LoadInt64(&peer.stats.connectedSinceNano); nano != 0 {
+		stats.ConnectedSince = time.Unix(0, nano)
+	}
+
+	// the generation is assigned when a change is observed rather than
+	// when it happens, keeping the data path free of shared counters
+
+	if stats != peer.statsGeneration.last || peer.statsGeneration.generation == 0 {
+		peer.statsGeneration.last = stats
+		peer.device.statsGeneration.last++
+		peer.statsGeneration.generation = peer.device.statsGeneration.last
+	}
+	stats.Generation = peer.statsGeneration.generation
+	return stats
+}
+
+func (device *Device) PeerStats(pk NoisePublicKey) (PeerStats, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return PeerStats{}, false
+	}
+	return peer.Stats(), true
+}
+
+// PeerStatsChangedSince returns the stats of the peers which changed
+// after generation, by their public keys, along with the generation to
+// pass next time. Polling with zero returns the stats of every peer.
+// Removed peers are not reported.
+func (device *Device) PeerStatsChangedSince(generation uint64) (map[NoisePublicKey]PeerStats, uint64) {
+	changed := make(map[NoisePublicKey]PeerStats)
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	device.statsGeneration.Lock()
+	defer device.statsGeneration.Unlock()
+	for key, peer := range device.peers.keyMap {
+		if stats := peer.unsafeStats(); stats.Generation > generation {
+			changed[key] = stats
+		}
+	}
+	return changed, device.statsGeneration.last
+}
+
+// taggedEndpoint wraps the endpoint stored in Peer.lastEndpoint,
+// since an atomic.Value requires a consistent concrete type.
+type taggedEndpoint struct {
+	conn.Endpoint
+}
+
+func (peer *Peer) tagEndpoint(endpoint conn.Endpoint) {
+	peer.lastEndpoint.Store(taggedEndpoint{endpoint})
+	if peer.device != nil && endpoint != nil {
+		peer.device.learnEndpoint(peer, endpoint)
+	}
+}
+
+// String returns the abbreviated public key of the peer and, once known,
+// its endpoint, which is how the peer is identified in log lines.
 func (peer *Peer) String() string {
-	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
-	abbreviatedKey := "invalid"
-	if len(base64Key) == 44 {
-		abbreviatedKey = base64Key[0:4] + "…" + base64Key[39:43]
+	key := peer.device.redactKey(peer.handshake.remoteStatic)
+	if tagged, ok := peer.lastEndpoint.Load().(taggedEndpoint); ok && tagged.Endpoint != nil {
+		return fmt.Sprintf("peer(%s, %s)", key, peer.device.redactEndpoint(tagged.DstToString()))
+	}
+	return fmt.Sprintf("peer(%s)", key)
+}
+
+// SetLogLevel overrides the log level of lines logged on behalf of peer.
+// A negative level restores the log level of the device.
+func (peer *Peer) SetLogLevel(level int) {
+	peer.log.setLevel(peer.device.log, level)
+}
+
+func (device *Device) SetPeerLogLevel(pk NoisePublicKey, level int) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
 	}
-	return fmt.Sprintf("peer(%s)", abbreviatedKey)
+	peer.SetLogLevel(level)
+	return nil
+}
+
+// StagedDropPolicy selects which packet is dropped when a packet
+// is staged for a peer whose nonce queue is full.
+type StagedDropPolicy int32
+
+const (
+	StagedDropOldest StagedDropPolicy = iota // drop the longest staged packet, the default
+	StagedDropNewest                         // drop the packet being staged
+)
+
+// SetStagedQueue limits the number of packets staged for peer while it
+// waits for a handshake to complete. The limit must be between 1 and
+// the outbound queue size of the device, see DeviceOptions.QueueOutboundSize,
+// lowering it drops the excess on the next staged packet.
+func (peer *Peer) SetStagedQueue(limit int, policy StagedDropPolicy) error {
+	if limit < 1 || limit > peer.device.queueSizes.outbound {
+		return fmt.Errorf("%w: staged queue limit %d", ErrInvalidValue, limit)
+	}
+	if policy != StagedDropOldest && policy != StagedDropNewest {
+		return fmt.Errorf("%w: staged drop policy %d", ErrInvalidValue, policy)
+	}
+	atomic.StoreInt32(&peer.staged.limit, int32(limit))
+	atomic.StoreInt32(&peer.staged.policy, int32(policy))
+	return nil
+}
+
+func (device *Device) SetPeerStagedQueue(pk NoisePublicKey, limit int, policy StagedDropPolicy) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	return peer.SetStagedQueue(limit, policy)
 }
 
 func (peer *Peer) Start() {
@@ -180,12 +497,11 @@ func (peer *Peer) Start() {
 	peer.routines.Lock()
 	defer peer.routines.Unlock()
 
-	if peer.isRunning.Get() {
+	if peer.isRunning.Get() || peer.disabled.Get() {
 		return
 	}
 
-	device := peer.device
-	device.log.Debug.Println(peer, "- Starting...")
+	peer.log.Debug.Println(peer, "- Starting...")
 
 	// reset routine state
 
@@ -197,13 +513,14 @@ func (peer *Peer) Start() {
 
 	// prepare queues
 	peer.queue.Lock()
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
-	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
+	peer.queue.nonce = make(chan *QueueOutboundElement, peer.device.queueSizes.outbound)
+	peer.queue.priority = make(chan *QueueOutboundElement, peer.device.queueSizes.outbound)
+	peer.queue.outbound = newOrderedRing(peer.device.queueSizes.outbound)
+	peer.queue.inbound = newOrderedRing(peer.device.queueSizes.inbound)
 	peer.queue.Unlock()
 
 	peer.timersInit()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	peer.signals.newKeypairArrived = make(chan struct{}, 1)
 	peer.signals.flushNonceQueue = make(chan struct{}, 1)
 
@@ -236,20 +553,50 @@ func (peer *Peer) ZeroAndFlushAll() {
 
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	device.indexTable.Delete(handshake.localIndex)
+	device.indexTable.DeleteHandshake(handshake.localIndex, handshake)
 	handshake.Clear()
 	handshake.mutex.Unlock()
 
+	atomic.StoreInt64(&peer.stats.connectedSinceNano, 0)
+
 	peer.FlushNonceQueue()
 }
 
-func (peer *Peer) ExpireCurrentKeypairs() {
+// ExpireSessions zeroes all keypairs and handshake state of the peer,
+// dropping the packets waiting for a session, and starts a new handshake.
+func (peer *Peer) ExpireSessions() {
+	peer.ZeroAndFlushAll()
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.mutex.Unlock()
+	if peer.isRunning.Get() && peer.device.isUp.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+}
+
+func (device *Device) ExpirePeerSessions(pk NoisePublicKey) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.log.Info.Println(peer, "- Expiring all sessions")
+	peer.ExpireSessions()
+	return nil
+}
+
+/* Discards a partially completed handshake, leaving the keypairs alone
+ */
+func (peer *Peer) AbandonHandshake() {
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	peer.device.indexTable.Delete(handshake.localIndex)
+	peer.device.indexTable.DeleteHandshake(handshake.localIndex, handshake)
 	handshake.Clear()
+	handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	handshake.mutex.Unlock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+}
+
+func (peer *Peer) ExpireCurrentKeypairs() {
+	peer.AbandonHandshake()
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
@@ -275,7 +622,7 @@ func (peer *Peer) Stop() {
 	peer.routines.Lock()
 	defer peer.routines.Unlock()
 
-	peer.device.log.Debug.Println(peer, "- Stopping...")
+	peer.log.Debug.Println(peer, "- Stopping...")
 
 	peer.timersStop()
 
@@ -288,13 +635,44 @@ func (peer *Peer) Stop() {
 
 	peer.queue.Lock()
 	close(peer.queue.nonce)
-	close(peer.queue.outbound)
-	close(peer.queue.inbound)
+	close(peer.queue.priority)
+	peer.queue.outbound.close()
+	peer.queue.inbound.close()
 	peer.queue.Unlock()
 
+	// free the elements the sequential routines left, or abandon them
+	// to the workers still encrypting or decrypting them
+
+	peer.queue.outbound.flush(peer.device.freeOutboundElement)
+	peer.queue.inbound.flush(peer.device.freeInboundElement)
+
 	peer.ZeroAndFlushAll()
 }
 
+/* Sends a keepalive and waits for the outbound queues to empty,
+ * for at most timeout
+ *
+ * An element travels from the nonce queue to the outbound queue
+ * without being visible in either, hence the queues must be seen
+ * empty twice in a row and the keepalive must have been sent.
+ */
+func (peer *Peer) drain(timeout time.Duration) {
+	txBytes := atomic.LoadUint64(&peer.stats.txBytes)
+	keepalive := peer.SendKeepalive()
+	idle := false
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		empty := len(peer.queue.nonce) == 0 && len(peer.queue.priority) == 0 && peer.queue.outbound.len() == 0 &&
+			!peer.queue.packetInNonceQueueIsAwaitingKey.Get()
+		sent := !keepalive || atomic.LoadUint64(&peer.stats.txBytes) != txBytes
+		if empty && sent && idle {
+			return
+		}
+		idle = empty && sent
+		time.Sleep(time.Millisecond * 10)
+	}
+	peer.log.Debug.Println(peer, "- Gave up waiting for queues to drain")
+}
+
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.disableRoaming {
 		return
@@ -302,4 +680,11 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.Lock()
 	peer.endpoint = endpoint
 	peer.Unlock()
+
+	// tagging takes an allocation, so only do it once the peer moved
+
+	if tagged, ok := peer.lastEndpoint.Load().(taggedEndpoint); !ok || tagged.Endpoint == nil ||
+		!bytes.Equal(tagged.DstToBytes(), endpoint.DstToBytes()) {
+		peer.tagEndpoint(endpoint)
+	}
 }
@@ -6,9 +6,19 @@
 package device
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
+
+	"golang.zx2c4.com/wireguard/conn"
 )
 
 func checkAlignment(t *testing.T, name string, offset uintptr) {
@@ -41,3 +51,443 @@ func TestPeerAlignment(t *testing.T) {
 	checkAlignment(t, "Peer.stats", unsafe.Offsetof(p.stats))
 	checkAlignment(t, "Peer.isRunning", unsafe.Offsetof(p.isRunning))
 }
+
+func TestPeerLogLevel(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	var buf bytes.Buffer
+	dev.log.Error = log.New(&buf, "", 0)
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	assertNil(t, err)
+
+	peer.log.Debug.Println("hidden")
+	assertNil(t, dev.SetPeerLogLevel(pk, LogLevelDebug))
+	peer.log.Debug.Println("shown")
+	dev.SetPeerLogLevel(pk, -1)
+	peer.log.Debug.Println("hidden again")
+
+	if got := buf.String(); !strings.Contains(got, "shown") || strings.Contains(got, "hidden") {
+		t.Errorf("unexpected peer log output %q", got)
+	}
+	if strings.Contains(peer.String(), ",") {
+		t.Errorf("peer without endpoint has endpoint in name %q", peer)
+	}
+}
+
+func TestPeerLogLevelSilentDevice(t *testing.T) {
+	dev := NewDevice(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	assertNil(t, err)
+
+	assertNil(t, dev.SetPeerLogLevel(pk, LogLevelDebug))
+	for _, l := range []*log.Logger{peer.log.Debug, peer.log.Info, peer.log.Error} {
+		if l.Writer() != ioutil.Discard {
+			t.Errorf("peer of a silent device logs to %v", l.Writer())
+		}
+	}
+}
+
+func TestSetEndpointFromPacketTagsMoves(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	tagged := func() conn.Endpoint {
+		return peer.lastEndpoint.Load().(taggedEndpoint).Endpoint
+	}
+	first, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	peer.SetEndpointFromPacket(first)
+	if tagged() != first {
+		t.Fatal("first endpoint not tagged")
+	}
+
+	// a packet from the same address leaves the tag alone
+
+	same, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	peer.SetEndpointFromPacket(same)
+	if tagged() != first {
+		t.Error("endpoint tagged again without moving")
+	}
+
+	moved, err := conn.CreateEndpoint("192.0.2.2:51820")
+	assertNil(t, err)
+	peer.SetEndpointFromPacket(moved)
+	if tagged() != moved {
+		t.Error("new endpoint not tagged")
+	}
+}
+
+func TestLookupPeerDuringChurn(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	stable := sk.publicKey()
+	_, err = dev.NewPeer(stable)
+	assertNil(t, err)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sk, err := newPrivateKey()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := dev.NewPeer(sk.publicKey()); err != nil {
+				t.Error(err)
+				return
+			}
+			dev.RemovePeer(sk.publicKey())
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		if dev.LookupPeer(stable) == nil {
+			t.Fatal("stable peer not found during churn")
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := dev.PeerCount(); n != 1 {
+		t.Errorf("PeerCount() = %d, want 1", n)
+	}
+	dev.RemoveAllPeers()
+	if dev.LookupPeer(stable) != nil || dev.PeerCount() != 0 {
+		t.Error("peer still visible after RemoveAllPeers")
+	}
+}
+
+func BenchmarkLookupPeerDuringChurn(b *testing.B) {
+	dev := randDevice(b)
+	defer dev.Close()
+
+	keys := make([]NoisePublicKey, 1024)
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys[i] = sk.publicKey()
+		if _, err := dev.NewPeer(keys[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// hold the peers lock the way a bulk configuration change does
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			dev.peers.Lock()
+			for range dev.peers.keyMap {
+			}
+			dev.peers.Unlock()
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if dev.LookupPeer(keys[i%len(keys)]) == nil {
+				b.Error("peer not found")
+				return
+			}
+			i++
+		}
+	})
+}
+
+func TestExpireSessionsDuringHandshakeStatus(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	// run under the race detector, this catches writes to the handshake
+	// bypassing its mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			peer.ExpireSessions()
+			peer.AbandonHandshake()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		peer.HandshakeStatus()
+	}
+}
+
+func TestStagedQueuePolicy(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+
+	if err := peer.SetStagedQueue(0, StagedDropOldest); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("SetStagedQueue(0) = %v, want ErrInvalidValue", err)
+	}
+
+	stage := func(n int) {
+		for i := 0; i < n; i++ {
+			elem := dev.NewOutboundElement()
+			elem.buffer[0] = byte(i)
+			peer.addToNonceQueue(elem)
+		}
+	}
+	first := func() byte {
+		elem := <-peer.queue.nonce
+		defer dev.PutOutboundElement(elem)
+		defer dev.PutMessageBuffer(elem.buffer)
+		return elem.buffer[0]
+	}
+
+	assertNil(t, peer.SetStagedQueue(2, StagedDropOldest))
+	stage(5)
+	if n := len(peer.queue.nonce); n != 2 {
+		t.Fatalf("staged %d packets, want 2", n)
+	}
+	if b := first(); b != 3 {
+		t.Errorf("drop oldest kept packet %d first, want 3", b)
+	}
+	first()
+
+	assertNil(t, dev.SetPeerStagedQueue(sk.publicKey(), 2, StagedDropNewest))
+	stage(5)
+	if b := first(); b != 0 {
+		t.Errorf("drop newest kept packet %d first, want 0", b)
+	}
+	first()
+
+	if dropped := peer.Stats().StagedPacketsDropped; dropped != 6 {
+		t.Errorf("StagedPacketsDropped = %d, want 6", dropped)
+	}
+}
+
+func TestPacerDelay(t *testing.T) {
+	var p pacer
+	now := time.Now()
+	if d := p.delay(MaxMessageSize, now); d != 0 {
+		t.Errorf("disabled pacer delayed by %v", d)
+	}
+
+	p.set(1000000, 2*MaxMessageSize)
+	for i := 0; i < 2; i++ {
+		if d := p.delay(MaxMessageSize, now); d != 0 {
+			t.Errorf("packet %d within burst delayed by %v", i, d)
+		}
+	}
+	if d := p.delay(1000, now); d != time.Millisecond {
+		t.Errorf("packet beyond burst delayed by %v, want 1ms", d)
+	}
+	if d := p.delay(1000, now.Add(time.Millisecond)); d != time.Millisecond {
+		t.Errorf("next packet delayed by %v, want 1ms", d)
+	}
+	if d := p.delay(1000, now.Add(time.Second)); d != 0 {
+		t.Errorf("packet after idle second delayed by %v", d)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), DeviceOptions{
+		StatsHistory: 3 * StatsSampleInterval,
+	})
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	start := time.Now()
+	for i := 0; i <= 5; i++ {
+		atomic.StoreUint64(&peer.stats.txBytes, uint64(i*i)*10000)
+		dev.sampleStats(start.Add(time.Duration(i) * StatsSampleInterval))
+	}
+
+	// samples 3 to 5 remain, oldest first
+
+	history, err := dev.PeerStatsHistory(sk.publicKey())
+	assertNil(t, err)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(history))
+	}
+	for i, sample := range history {
+		n := uint64(i + 3)
+		want := (n*n - (n-1)*(n-1)) * 10000 / uint64(StatsSampleInterval/time.Second)
+		if sample.TxBytesPerSecond != want || sample.RxBytesPerSecond != 0 {
+			t.Errorf("sample %d: %+v, want %d bytes/s sent", i, sample, want)
+		}
+		if !sample.Time.Equal(start.Add(time.Duration(n) * StatsSampleInterval)) {
+			t.Errorf("sample %d taken at %v", i, sample.Time)
+		}
+	}
+}
+
+func TestHandshakeAnomaly(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	for i := 0; i < AnomalousHandshakes-1; i++ {
+		peer.countHandshake()
+	}
+	if stats := peer.Stats(); stats.HandshakeAnomaly || stats.RecentHandshakes != AnomalousHandshakes-1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for i := 0; i < 3; i++ {
+		peer.countHandshake()
+	}
+	stats := peer.Stats()
+	if !stats.HandshakeAnomaly || stats.Handshakes != AnomalousHandshakes+2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	select {
+	case event := <-events:
+		if event.Kind != EventHandshakeAnomaly || event.Peer != sk.publicKey() {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("anomaly reported again: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the flag clears once the handshakes leave the window
+
+	peer.handshakeRate.Lock()
+	for i := range peer.handshakeRate.recent {
+		peer.handshakeRate.recent[i] = peer.handshakeRate.recent[i].Add(-HandshakeRateWindow)
+	}
+	peer.handshakeRate.Unlock()
+	if stats := peer.Stats(); stats.HandshakeAnomaly || stats.RecentHandshakes != 0 {
+		t.Errorf("unexpected stats %+v after the window", stats)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	start := time.Now()
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	upSince := pair[0].dev.UpSince()
+	if upSince.Before(start) || upSince.After(time.Now()) {
+		t.Fatalf("UpSince() = %v, want between %v and now", upSince, start)
+	}
+	peer := pair[0].dev.LookupPeer(pair[1].key.publicKey())
+	connected := peer.Stats().ConnectedSince
+	if connected.Before(upSince) {
+		t.Fatalf("ConnectedSince = %v, want after %v", connected, upSince)
+	}
+	config, err := pair[0].dev.IpcGetConfig()
+	assertNil(t, err)
+	if config.UpSince.Unix() != upSince.Unix() || config.Peers[0].ConnectedSince.Unix() != connected.Unix() {
+		t.Errorf("IpcGetConfig() reports up since %v, connected since %v", config.UpSince, config.Peers[0].ConnectedSince)
+	}
+
+	// a new handshake continues the session
+
+	peer.timersHandshakeComplete()
+	if stats := peer.Stats(); !stats.ConnectedSince.Equal(connected) || stats.LastHandshake.Before(connected) {
+		t.Errorf("ConnectedSince = %v, LastHandshake = %v after rekeying, want %v and no earlier", stats.ConnectedSince, stats.LastHandshake, connected)
+	}
+
+	// losing all sessions ends it
+
+	peer.ZeroAndFlushAll()
+	if stats := peer.Stats(); !stats.ConnectedSince.IsZero() {
+		t.Errorf("ConnectedSince = %v without a session", stats.ConnectedSince)
+	}
+
+	pair[0].dev.Down()
+	if upSince := pair[0].dev.UpSince(); !upSince.IsZero() {
+		t.Errorf("UpSince() = %v while down", upSince)
+	}
+}
+
+func TestPeerStatsChangedSince(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	var peers [3]*Peer
+	for i := range peers {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peers[i], err = dev.NewPeer(sk.publicKey())
+		assertNil(t, err)
+	}
+
+	changed, generation := dev.PeerStatsChangedSince(0)
+	if len(changed) != len(peers) {
+		t.Fatalf("%d peers reported initially, want %d", len(changed), len(peers))
+	}
+	if changed, _ := dev.PeerStatsChangedSince(generation); len(changed) != 0 {
+		t.Errorf("%d peers reported without changes", len(changed))
+	}
+
+	atomic.AddUint64(&peers[1].stats.rxBytes, 100)
+	changed, next := dev.PeerStatsChangedSince(generation)
+	stats, ok := changed[peers[1].handshake.remoteStatic]
+	if len(changed) != 1 || !ok || stats.RxBytes != 100 || next <= generation {
+		t.Errorf("after a change: %d peers reported, %+v, generation %d after %d", len(changed), stats, next, generation)
+	}
+	if changed, _ := dev.PeerStatsChangedSince(next); len(changed) != 0 {
+		t.Errorf("change reported twice")
+	}
+}
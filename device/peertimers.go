@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PeerTimers is a snapshot of what the timers of a peer do next, for
+// answering why nothing is happening. Times are zero while the timer is
+// not scheduled, and follow the clock of the device.
+type PeerTimers struct {
+	RetransmitHandshake time.Time // the initiation is sent again unless a response arrives
+	Keepalive           time.Time // a keepalive answers the data received unless data is sent first
+	NewHandshake        time.Time // a handshake is initiated as the data sent went unanswered
+	ZeroKeyMaterial     time.Time // the keys of all sessions are erased
+	PersistentKeepalive time.Time // a keepalive is sent, see persistent_keepalive_interval
+
+	Rekey         time.Time // the current session is renewed by the next packet sent, zero if the peer renews it
+	SessionExpiry time.Time // the current session is no longer used
+
+	HandshakeAttempts uint32    // initiations sent without a response since the last handshake
+	QuietUntil        time.Time // keepalives and retransmissions wait until then, see Device.Quiesce
+}
+
+// Timers returns when the timers of peer fire next.
+func (peer *Peer) Timers() PeerTimers {
+	device := peer.device
+	var timers PeerTimers
+
+	if peer.timers.retransmitHandshake != nil {
+		for _, t := range []struct {
+			timer *Timer
+			next  *time.Time
+		}{
+			{peer.timers.retransmitHandshake, &timers.RetransmitHandshake},
+			{peer.timers.sendKeepalive, &timers.Keepalive},
+			{peer.timers.newHandshake, &timers.NewHandshake},
+			{peer.timers.zeroKeyMaterial, &timers.ZeroKeyMaterial},
+			{peer.timers.persistentKeepalive, &timers.PersistentKeepalive},
+		} {
+			if deadline, pending := t.timer.Deadline(); pending {
+				*t.next = deadline
+			}
+		}
+	}
+
+	peer.keypairs.RLock()
+	current := peer.keypairs.current
+	peer.keypairs.RUnlock()
+	if current != nil {
+		if device.rekeys(current) {
+			timers.Rekey = current.created.Add(device.rekeyAfterTime())
+		}
+		timers.SessionExpiry = current.created.Add(device.rejectAfterTime())
+	}
+
+	timers.HandshakeAttempts = atomic.LoadUint32(&peer.timers.handshakeAttempts)
+	if until := device.quietUntil.Load().(time.Time); until.After(device.now()) {
+		timers.QuietUntil = until
+	}
+	return timers
+}
+
+// PeerTimers returns when the timers of the peer identified by pk fire
+// next, see Peer.Timers.
+func (device *Device) PeerTimers(pk NoisePublicKey) (PeerTimers, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return PeerTimers{}, ErrPeerNotFound
+	}
+	return peer.Timers(), nil
+}
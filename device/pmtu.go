@@ -0,0 +1,221 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* MTU probing
+ *
+ * Cooperating devices find the largest packet the tunnel delivers to
+ * each peer, rather than relying on a hand-tuned MTU. A probe is a
+ * control message padded to the size tried, which the peer answers
+ * with a small acknowledgement. Sizes between MinProbedMTU and the MTU
+ * of the TUN device are binary searched, in steps of PaddingMultiple; a
+ * size is not deliverable once MTUProbeAttempts probes of it went
+ * unanswered for MTUProbeTimeout each. If not even MinProbedMTU is
+ * answered, the peer is taken not to cooperate and keeps the MTU of
+ * the TUN device.
+ *
+ * The size found becomes the MTU of the peer, which packets to it are
+ * not padded beyond. With DeviceOptions.MTUProbing, peers are probed
+ * whenever a session begins after they had none, ProbePeerMTU probes
+ * on demand.
+ */
+
+const (
+	MinProbedMTU     = 1280
+	MTUProbeTimeout  = time.Second
+	MTUProbeAttempts = 3
+)
+
+type peerMTU struct {
+	probed int32 // largest size delivered, zero if not probed, accessed atomically
+
+	probing sync.Mutex // held while probing
+	prober  workWaiter // the probing routine, blocked on acknowledgements
+
+	sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan struct{} // closed once the probe with the identifier is acknowledged
+}
+
+// ProbedMTU returns the largest packet size found to be delivered to
+// peer, zero if it was not probed or does not cooperate.
+func (peer *Peer) ProbedMTU() int {
+	return int(atomic.LoadInt32(&peer.mtu.probed))
+}
+
+// MTU returns the largest packet size sent to peer: the MTU of the TUN
+// device, less what the obfuscation of the peer adds, or the probed MTU
+// of the peer if it is smaller.
+func (peer *Peer) MTU() int {
+	return int(peer.effectiveMTU(atomic.LoadInt32(&peer.device.tun.mtu)))
+}
+
+func (peer *Peer) effectiveMTU(mtu int32) int32 {
+	if mtu > 0 {
+		mtu -= atomic.LoadInt32(&peer.obfuscationOverhead)
+	}
+	if probed := atomic.LoadInt32(&peer.mtu.probed); probed != 0 && probed < mtu {
+		return probed
+	}
+	return mtu
+}
+
+// ProbePeerMTU probes the largest packet size delivered to the peer
+// with public key pk, waiting for the result, which becomes the MTU of
+// the peer. A probe of the peer already running is waited for first.
+func (device *Device) ProbePeerMTU(pk NoisePublicKey) (int, error) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return 0, ErrPeerNotFound
+	}
+	device.addWork()
+	defer device.doneWork()
+	return peer.probeMTU()
+}
+
+func (peer *Peer) probeMTU() (int, error) {
+	peer.mtu.probing.Lock()
+	defer peer.mtu.probing.Unlock()
+
+	hi := int(atomic.LoadInt32(&peer.device.tun.mtu))
+	lo := MinProbedMTU
+	if hi < lo {
+		lo = hi
+	}
+	if ok, err := peer.probeSize(lo); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("%w: no answer to MTU probes from %v", ErrUnsupported, peer)
+	}
+	if ok, err := peer.probeSize(hi); err != nil {
+		return 0, err
+	} else if ok {
+		lo = hi
+	}
+	for hi-lo > PaddingMultiple {
+		mid := (lo + hi) / 2 &^ (PaddingMultiple - 1)
+		if mid <= lo {
+			break
+		}
+		ok, err := peer.probeSize(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if int32(lo) != atomic.SwapInt32(&peer.mtu.probed, int32(lo)) {
+		peer.log.Info.Println(peer, "- Probed MTU of", lo)
+	}
+	return lo, nil
+}
+
+// probeSize reports whether a packet of size reaches peer, trying up
+// to MTUProbeAttempts times.
+func (peer *Peer) probeSize(size int) (bool, error) {
+	device := peer.device
+	payload := make([]byte, size-controlHeaderSize)
+	for attempt := 0; attempt < MTUProbeAttempts; attempt++ {
+		acked := make(chan struct{})
+		peer.mtu.Lock()
+		if peer.mtu.pending == nil {
+			peer.mtu.pending = make(map[uint32]chan struct{})
+		}
+		peer.mtu.nextID++
+		id := peer.mtu.nextID
+		peer.mtu.pending[id] = acked
+		peer.mtu.Unlock()
+
+		expired := make(chan struct{})
+		timer := device.clock.AfterFunc(MTUProbeTimeout, func() {
+			close(expired)
+			peer.mtu.prober.wake(device, wakeOnProbe)
+		})
+		binary.BigEndian.PutUint32(payload, id)
+		err := device.SendControl(peer.handshake.remoteStatic, ControlMTUProbe, payload)
+		if err == nil {
+			peer.mtu.prober.wait(device, wakeOnProbe, func() bool {
+				select {
+				case <-acked:
+				case <-expired:
+				default:
+					return false
+				}
+				return true
+			})
+			select {
+			case <-acked:
+			case <-expired:
+			}
+			peer.mtu.prober.resume(device)
+		}
+		timer.Stop()
+
+		peer.mtu.Lock()
+		delete(peer.mtu.pending, id)
+		peer.mtu.Unlock()
+
+		if err != nil {
+			return false, err
+		}
+		select {
+		case <-acked:
+			return true, nil
+		default:
+		}
+	}
+	return false, nil
+}
+
+// receiveMTUProbe answers a probe received from peer.
+func (peer *Peer) receiveMTUProbe(payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	peer.device.SendControl(peer.handshake.remoteStatic, ControlMTUProbeAck, payload[:4])
+}
+
+// receiveMTUProbeAck notes the acknowledgement of a probe sent to peer.
+func (peer *Peer) receiveMTUProbeAck(payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(payload)
+	peer.mtu.Lock()
+	if acked, ok := peer.mtu.pending[id]; ok {
+		close(acked)
+		delete(peer.mtu.pending, id)
+		peer.mtu.prober.wake(peer.device, wakeOnProbe)
+	}
+	peer.mtu.Unlock()
+}
+
+// startMTUProbing probes peer in the background if the device probes
+// the MTU of its peers, see DeviceOptions.MTUProbing.
+func (peer *Peer) startMTUProbing() {
+	if !peer.device.mtuProbing {
+		return
+	}
+	peer.device.addWork()
+	go func() {
+		defer peer.device.doneWork()
+		if _, err := peer.probeMTU(); err != nil {
+			peer.log.Debug.Println(peer, "- MTU probing failed:", err)
+		}
+	}()
+}
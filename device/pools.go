@@ -5,85 +5,135 @@
 
 package device
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 func (device *Device) PopulatePools() {
-	if PreallocatedBuffersPerPool == 0 {
+	if device.queueSizes.preallocated == 0 {
 		device.pool.messageBufferPool = &sync.Pool{
 			New: func() interface{} {
 				return new([MaxMessageSize]byte)
 			},
 		}
-		device.pool.inboundElementPool = &sync.Pool{
+		device.pool.elementPool = &sync.Pool{
 			New: func() interface{} {
-				return new(QueueInboundElement)
-			},
-		}
-		device.pool.outboundElementPool = &sync.Pool{
-			New: func() interface{} {
-				return new(QueueOutboundElement)
+				return new(QueueElement)
 			},
 		}
 	} else {
-		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
+		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, device.queueSizes.preallocated)
+		for i := 0; i < device.queueSizes.preallocated; i += 1 {
 			device.pool.messageBufferReuseChan <- new([MaxMessageSize]byte)
 		}
-		device.pool.inboundElementReuseChan = make(chan *QueueInboundElement, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
-			device.pool.inboundElementReuseChan <- new(QueueInboundElement)
-		}
-		device.pool.outboundElementReuseChan = make(chan *QueueOutboundElement, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
-			device.pool.outboundElementReuseChan <- new(QueueOutboundElement)
-		}
+		// an element each for the packets received and the packets sent
+		device.pool.elementFreelist = newElementFreelist(2 * device.queueSizes.preallocated)
 	}
 }
 
 func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
-	if PreallocatedBuffersPerPool == 0 {
+	atomic.AddInt32(&device.diagnostics.messageBuffers, 1)
+	if device.queueSizes.preallocated == 0 {
 		return device.pool.messageBufferPool.Get().(*[MaxMessageSize]byte)
 	} else {
 		return <-device.pool.messageBufferReuseChan
 	}
 }
 
+// tryGetMessageBuffer is GetMessageBuffer, but fails instead of waiting
+// if all preallocated buffers are in use.
+func (device *Device) tryGetMessageBuffer() (*[MaxMessageSize]byte, bool) {
+	if device.queueSizes.preallocated == 0 {
+		atomic.AddInt32(&device.diagnostics.messageBuffers, 1)
+		return device.pool.messageBufferPool.Get().(*[MaxMessageSize]byte), true
+	}
+	select {
+	case buffer := <-device.pool.messageBufferReuseChan:
+		atomic.AddInt32(&device.diagnostics.messageBuffers, 1)
+		return buffer, true
+	default:
+		return nil, false
+	}
+}
+
 func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
-	if PreallocatedBuffersPerPool == 0 {
+	atomic.AddInt32(&device.diagnostics.messageBuffers, -1)
+	if device.queueSizes.preallocated == 0 {
 		device.pool.messageBufferPool.Put(msg)
 	} else {
 		device.pool.messageBufferReuseChan <- msg
 	}
 }
 
-func (device *Device) GetInboundElement() *QueueInboundElement {
-	if PreallocatedBuffersPerPool == 0 {
-		return device.pool.inboundElementPool.Get().(*QueueInboundElement)
+func (device *Device) getElement() *QueueElement {
+	if device.queueSizes.preallocated == 0 {
+		return device.pool.elementPool.Get().(*QueueElement)
 	} else {
-		return <-device.pool.inboundElementReuseChan
+		return device.pool.elementFreelist.get()
 	}
 }
 
-func (device *Device) PutInboundElement(msg *QueueInboundElement) {
-	if PreallocatedBuffersPerPool == 0 {
-		device.pool.inboundElementPool.Put(msg)
+func (device *Device) putElement(elem *QueueElement) {
+	if device.queueSizes.preallocated == 0 {
+		device.pool.elementPool.Put(elem)
 	} else {
-		device.pool.inboundElementReuseChan <- msg
+		device.pool.elementFreelist.put(elem)
 	}
 }
 
+func (device *Device) GetInboundElement() *QueueInboundElement {
+	atomic.AddInt32(&device.diagnostics.inboundElements, 1)
+	device.addWork()
+	return device.getElement()
+}
+
+func (device *Device) PutInboundElement(elem *QueueInboundElement) {
+	atomic.AddInt32(&device.diagnostics.inboundElements, -1)
+	device.doneWork()
+	device.putElement(elem)
+}
+
 func (device *Device) GetOutboundElement() *QueueOutboundElement {
-	if PreallocatedBuffersPerPool == 0 {
-		return device.pool.outboundElementPool.Get().(*QueueOutboundElement)
-	} else {
-		return <-device.pool.outboundElementReuseChan
+	atomic.AddInt32(&device.diagnostics.outboundElements, 1)
+	return device.getElement()
+}
+
+func (device *Device) PutOutboundElement(elem *QueueOutboundElement) {
+	atomic.AddInt32(&device.diagnostics.outboundElements, -1)
+	if elem.working {
+		elem.working = false
+		device.doneWork()
 	}
+	device.putElement(elem)
 }
 
-func (device *Device) PutOutboundElement(msg *QueueOutboundElement) {
-	if PreallocatedBuffersPerPool == 0 {
-		device.pool.outboundElementPool.Put(msg)
-	} else {
-		device.pool.outboundElementReuseChan <- msg
+// freeInboundElement returns elem, and its buffer unless dropped, to the
+// pools.
+func (device *Device) freeInboundElement(elem *QueueInboundElement) {
+	if !elem.IsDropped() {
+		device.PutMessageBuffer(elem.buffer)
+	}
+	device.PutInboundElement(elem)
+}
+
+func (device *Device) freeOutboundElement(elem *QueueOutboundElement) {
+	if !elem.IsDropped() {
+		device.PutMessageBuffer(elem.buffer)
+	}
+	device.PutOutboundElement(elem)
+}
+
+// releaseInboundElement releases elem to the sequential receiver, or
+// frees it if the receiver stopped, see orderedRing.
+func (device *Device) releaseInboundElement(elem *QueueInboundElement) {
+	if !elem.release() {
+		device.freeInboundElement(elem)
+	}
+}
+
+func (device *Device) releaseOutboundElement(elem *QueueOutboundElement) {
+	if !elem.release() {
+		device.freeOutboundElement(elem)
 	}
 }
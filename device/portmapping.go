@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/* Port mapping
+ *
+ * The listen port is mapped on the local gateway whenever the bind
+ * is opened, and the mapping is renewed halfway through its lifetime.
+ * The external endpoint it yields is reported by EventPortMapped and
+ * ExternalEndpoint.
+ */
+
+// A PortMapper maps the listen port of the device on the local gateway,
+// such as the portmap.Mapper speaking PCP, NAT-PMP and UPnP IGD.
+type PortMapper interface {
+	// MapPort maps port, replacing the mapping of any other port, and
+	// returns the external endpoint, empty if unknown, and how long the
+	// mapping lasts unless renewed by calling MapPort again.
+	MapPort(ctx context.Context, port uint16) (external string, lifetime time.Duration, err error)
+
+	// UnmapPort removes the mapping.
+	UnmapPort(ctx context.Context) error
+}
+
+type portMapping struct {
+	sync.Mutex
+	mapper   PortMapper
+	external string
+	mapped   bool
+	update   chan struct{} // nil unless DeviceOptions.PortMapper is set
+}
+
+// trigger makes the device map its listen port anew.
+func (pm *portMapping) trigger() {
+	if pm.update == nil {
+		return
+	}
+	select {
+	case pm.update <- struct{}{}:
+	default:
+	}
+}
+
+// ExternalEndpoint returns the endpoint the gateway maps to the listen
+// port of the device, false if there is none, see DeviceOptions.PortMapper.
+func (device *Device) ExternalEndpoint() (string, bool) {
+	device.portMapping.Lock()
+	defer device.portMapping.Unlock()
+	return device.portMapping.external, device.portMapping.external != ""
+}
+
+func (device *Device) unmapPort() {
+	device.portMapping.Lock()
+	mapped := device.portMapping.mapped
+	device.portMapping.mapped = false
+	device.portMapping.external = ""
+	device.portMapping.Unlock()
+	if !mapped {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PortUnmapTimeout)
+	defer cancel()
+	if err := device.portMapping.mapper.UnmapPort(ctx); err != nil {
+		device.log.Debug.Println("Failed to remove port mapping:", err)
+	}
+}
+
+// mapPort maps or renews the mapping of the listen port and returns
+// when to do so next.
+func (device *Device) mapPort() time.Duration {
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+
+	if port == 0 {
+		device.unmapPort()
+		return PortMapRetryInterval
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PortMapTimeout)
+	external, lifetime, err := device.portMapping.mapper.MapPort(ctx, port)
+	cancel()
+
+	device.portMapping.Lock()
+	previous := device.portMapping.external
+	device.portMapping.mapped = err == nil
+	device.portMapping.external = external
+	device.portMapping.Unlock()
+
+	if err != nil {
+		device.log.Debug.Println("Failed to map listen port:", err)
+		return PortMapRetryInterval
+	}
+	if external != previous {
+		device.log.Info.Println("Listen port mapped to", device.redactEndpoint(external))
+		device.emitEvent(Event{Kind: EventPortMapped, Endpoint: external})
+	}
+	if lifetime/2 < PortMapRetryInterval {
+		return PortMapRetryInterval
+	}
+	return lifetime / 2
+}
+
+/* Maps the listen port on the gateway and keeps the mapping alive
+ *
+ * Obs. Only runs if DeviceOptions.PortMapper is set
+ */
+func (device *Device) RoutinePortMapping() {
+	defer device.trackRoutine(routinePortMapping)()
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: port mapping - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: port mapping - started")
+	device.state.starting.Done()
+
+	timer := time.NewTimer(PortMapRetryInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			device.unmapPort()
+			return
+		case <-device.portMapping.update:
+		case <-timer.C:
+		}
+		next := device.mapPort()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePortMapper struct {
+	sync.Mutex
+	mapped   []uint16
+	unmapped int
+}
+
+func (mapper *fakePortMapper) MapPort(ctx context.Context, port uint16) (string, time.Duration, error) {
+	mapper.Lock()
+	defer mapper.Unlock()
+	mapper.mapped = append(mapper.mapped, port)
+	return "203.0.113.7:" + strconv.Itoa(int(port)+1), time.Hour, nil
+}
+
+func (mapper *fakePortMapper) UnmapPort(ctx context.Context) error {
+	mapper.Lock()
+	defer mapper.Unlock()
+	mapper.unmapped++
+	return nil
+}
+
+func TestPortMapping(t *testing.T) {
+	mapper := &fakePortMapper{}
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelError, ""), DeviceOptions{PortMapper: mapper})
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	if _, ok := dev.ExternalEndpoint(); ok {
+		t.Error("external endpoint reported before mapping")
+	}
+	dev.Up()
+
+	var event Event
+	select {
+	case event = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	dev.net.RLock()
+	expected := "203.0.113.7:" + strconv.Itoa(int(dev.net.port)+1)
+	dev.net.RUnlock()
+	if event.Kind != EventPortMapped || event.Endpoint != expected {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if external, ok := dev.ExternalEndpoint(); !ok || external != expected {
+		t.Errorf("external endpoint %q, expected %q", external, expected)
+	}
+
+	dev.Close()
+	mapper.Lock()
+	defer mapper.Unlock()
+	if len(mapper.mapped) != 1 || mapper.unmapped != 1 {
+		t.Errorf("mapped %v, unmapped %d times", mapper.mapped, mapper.unmapped)
+	}
+}
@@ -0,0 +1,153 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+/* Route math on sets of allowed IPs
+ *
+ * Both helpers treat their input as the set of addresses covered,
+ * so that duplicates and overlapping prefixes are permitted.
+ * Within the allowed IPs of a single peer they never change which
+ * peer an address is routed to.
+ */
+
+// prefix is a network in canonical form, with a 4 byte IPv4 address.
+type prefix struct {
+	ip   net.IP
+	ones int
+}
+
+func toPrefix(network net.IPNet) (prefix, bool) {
+	ip := network.IP
+	if ip4 := ip.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	ones, bits := network.Mask.Size()
+	if bits != len(ip)*8 {
+		return prefix{}, false
+	}
+	return prefix{ip: ip.Mask(network.Mask), ones: ones}, true
+}
+
+func (p prefix) network() net.IPNet {
+	return net.IPNet{IP: p.ip, Mask: net.CIDRMask(p.ones, len(p.ip)*8)}
+}
+
+func (p prefix) bit(i int) byte {
+	return (p.ip[i/8] >> (7 - uint(i%8))) & 1
+}
+
+func (p prefix) contains(other prefix) bool {
+	return len(p.ip) == len(other.ip) && p.ones <= other.ones &&
+		other.ip.Mask(net.CIDRMask(p.ones, len(p.ip)*8)).Equal(p.ip)
+}
+
+// half returns one of the two prefixes one bit longer than p.
+func (p prefix) half(bit byte) prefix {
+	ip := make(net.IP, len(p.ip))
+	copy(ip, p.ip)
+	ip[p.ones/8] |= bit << (7 - uint(p.ones%8))
+	return prefix{ip: ip, ones: p.ones + 1}
+}
+
+// sibling reports whether p and next together form their parent prefix.
+func (p prefix) sibling(next prefix) bool {
+	if p.ones == 0 || p.ones != next.ones || len(p.ip) != len(next.ip) {
+		return false
+	}
+	parent := prefix{ip: p.ip, ones: p.ones - 1}
+	return p.bit(p.ones-1) == 0 && parent.contains(next)
+}
+
+// AggregatePrefixes returns the shortest list of prefixes covering the
+// same addresses as networks, IPv4 before IPv6, each in ascending order.
+// Prefixes contained in another one are dropped and adjacent halves of
+// a prefix are merged, so two adjacent /25s become a /24. Networks with
+// a non-canonical mask are skipped.
+func AggregatePrefixes(networks []net.IPNet) []net.IPNet {
+	prefixes := make([]prefix, 0, len(networks))
+	for _, network := range networks {
+		if p, ok := toPrefix(network); ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if len(a.ip) != len(b.ip) {
+			return len(a.ip) < len(b.ip)
+		}
+		if c := bytes.Compare(a.ip, b.ip); c != 0 {
+			return c < 0
+		}
+		return a.ones < b.ones
+	})
+
+	// sorted, a prefix can only be covered by the last one kept
+
+	var stack []prefix
+	for _, p := range prefixes {
+		if len(stack) > 0 && stack[len(stack)-1].contains(p) {
+			continue
+		}
+		stack = append(stack, p)
+		for n := len(stack); n > 1 && stack[n-2].sibling(stack[n-1]); n = len(stack) {
+			stack = append(stack[:n-2], prefix{ip: stack[n-2].ip, ones: stack[n-2].ones - 1})
+		}
+	}
+
+	result := make([]net.IPNet, len(stack))
+	for i, p := range stack {
+		result[i] = p.network()
+	}
+	return result
+}
+
+// ExcludePrefixes returns prefixes covering the addresses of networks
+// which are not covered by exclude. A network partially covered by an
+// exclusion is split into the largest prefixes around it, so excluding
+// 10.0.0.0/9 from 10.0.0.0/8 leaves 10.128.0.0/9. Networks with a
+// non-canonical mask are skipped.
+func ExcludePrefixes(networks []net.IPNet, exclude []net.IPNet) []net.IPNet {
+	prefixes := make([]prefix, 0, len(networks))
+	for _, network := range networks {
+		if p, ok := toPrefix(network); ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	for _, network := range exclude {
+		e, ok := toPrefix(network)
+		if !ok {
+			continue
+		}
+		remaining := prefixes[:0:0]
+		for _, p := range prefixes {
+			switch {
+			case e.contains(p):
+			case p.contains(e):
+				for p.ones < e.ones {
+					bit := e.bit(p.ones)
+					remaining = append(remaining, p.half(1-bit))
+					p = p.half(bit)
+				}
+			default:
+				remaining = append(remaining, p)
+			}
+		}
+		prefixes = remaining
+	}
+
+	result := make([]net.IPNet, len(prefixes))
+	for i, p := range prefixes {
+		result[i] = p.network()
+	}
+	return result
+}
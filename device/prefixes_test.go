@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func parsePrefixes(t *testing.T, cidrs ...string) []net.IPNet {
+	networks := make([]net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks[i] = *network
+	}
+	return networks
+}
+
+func prefixStrings(networks []net.IPNet) []string {
+	strings := make([]string, len(networks))
+	for i, network := range networks {
+		strings[i] = network.String()
+	}
+	return strings
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		in, out []string
+	}{
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, []string{"10.0.0.0/24"}},
+		{[]string{"10.0.1.0/24", "10.0.0.0/24", "10.0.2.0/23"}, []string{"10.0.0.0/22"}},
+		{[]string{"10.0.0.0/8", "10.1.0.0/16", "10.0.0.0/8"}, []string{"10.0.0.0/8"}},
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{[]string{"fd00::/65", "fd00::8000:0:0:0/65", "0.0.0.0/1", "128.0.0.0/1"}, []string{"0.0.0.0/0", "fd00::/64"}},
+	}
+	for _, test := range tests {
+		got := prefixStrings(AggregatePrefixes(parsePrefixes(t, test.in...)))
+		if !reflect.DeepEqual(got, test.out) {
+			t.Errorf("AggregatePrefixes(%v) = %v, want %v", test.in, got, test.out)
+		}
+	}
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	tests := []struct {
+		in, exclude, out []string
+	}{
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.0/9"}, []string{"10.128.0.0/9"}},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, []string{}},
+		{[]string{"10.0.0.0/24"}, []string{"192.168.0.0/16"}, []string{"10.0.0.0/24"}},
+		{[]string{"0.0.0.0/0"}, []string{"128.0.0.0/2"}, []string{"0.0.0.0/1", "192.0.0.0/2"}},
+		{[]string{"10.0.0.0/30"}, []string{"10.0.0.1/32", "10.0.0.2/32"}, []string{"10.0.0.0/32", "10.0.0.3/32"}},
+	}
+	for _, test := range tests {
+		got := ExcludePrefixes(parsePrefixes(t, test.in...), parsePrefixes(t, test.exclude...))
+		if got := prefixStrings(AggregatePrefixes(got)); !reflect.DeepEqual(got, test.out) {
+			t.Errorf("ExcludePrefixes(%v, %v) = %v, want %v", test.in, test.exclude, got, test.out)
+		}
+	}
+}
+
+func TestIpcAllowedIPExclude(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	err = dev.IpcSet("public_key=" + sk.publicKey().ToHex() + "\nallowed_ip=0.0.0.0/0\nallowed_ip_exclude=192.168.0.0/16\n")
+	assertNil(t, err)
+
+	peer := dev.LookupPeer(sk.publicKey())
+	if dev.allowedips.LookupIPv4(net.IPv4(192, 168, 1, 1).To4()) != nil {
+		t.Error("excluded address still routed to peer")
+	}
+	for _, ip := range []net.IP{net.IPv4(192, 167, 1, 1), net.IPv4(192, 169, 1, 1), net.IPv4(8, 8, 8, 8)} {
+		if dev.allowedips.LookupIPv4(ip.To4()) != peer {
+			t.Errorf("%v not routed to peer", ip)
+		}
+	}
+	if entries := dev.allowedips.EntriesForPeer(peer); len(entries) != 16 {
+		t.Errorf("expected 16 covering prefixes, got %v", entries)
+	}
+}
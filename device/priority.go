@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Application-priority traffic
+ *
+ * The embedding application may classify the packets read from the TUN
+ * device, for instance by their DSCP, marking some inner flows as high
+ * priority. Those are staged in a queue of their own, which the nonce
+ * routine of the peer serves before the regular one, so that they skip
+ * ahead of bulk traffic waiting for a session or for encryption. Packets
+ * of one flow have the same priority and thus stay in order.
+ */
+
+type PacketPriority int
+
+const (
+	PriorityNormal PacketPriority = iota // the default
+	PriorityHigh                         // sent ahead of packets of normal priority
+)
+
+func (priority PacketPriority) String() string {
+	switch priority {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("PacketPriority(UNKNOWN:%d)", int(priority))
+	}
+}
+
+// PacketClassifier returns the priority of an IP packet read from the
+// TUN device or relayed between peers. It may be called concurrently
+// and must not retain or modify the packet.
+type PacketClassifier func(packet []byte) PacketPriority
+
+// DSCPClassifier returns a classifier giving high priority to the IPv4
+// and IPv6 packets marked with any of the DSCP values high, such as 46
+// for expedited forwarding.
+func DSCPClassifier(high ...uint8) PacketClassifier {
+	var classes [64]bool
+	for _, dscp := range high {
+		classes[dscp&0x3f] = true
+	}
+	return func(packet []byte) PacketPriority {
+		var dscp byte
+		switch packet[0] >> 4 {
+		case ipv4.Version:
+			dscp = packet[1] >> 2
+		case ipv6.Version:
+			dscp = (packet[0]&0x0f)<<2 | packet[1]>>6
+		default:
+			return PriorityNormal
+		}
+		if classes[dscp] {
+			return PriorityHigh
+		}
+		return PriorityNormal
+	}
+}
+
+// SetPacketClassifier sets how the packets read from the TUN device are
+// prioritized. A nil classifier, the default, gives all of them normal
+// priority.
+func (device *Device) SetPacketClassifier(classify PacketClassifier) {
+	device.classifier.Store(classify)
+}
+
+// priority returns the priority of packet, as given by the classifier.
+func (device *Device) priority(packet []byte) PacketPriority {
+	classify, _ := device.classifier.Load().(PacketClassifier)
+	if classify == nil {
+		return PriorityNormal
+	}
+	return classify(packet)
+}
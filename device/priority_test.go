@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestDSCPClassifier(t *testing.T) {
+	classify := DSCPClassifier(46)
+
+	packet := tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))
+	if priority := classify(packet); priority != PriorityNormal {
+		t.Errorf("unmarked IPv4 packet classified %v", priority)
+	}
+	packet[1] = 46 << 2
+	if priority := classify(packet); priority != PriorityHigh {
+		t.Errorf("IPv4 packet marked EF classified %v", priority)
+	}
+
+	packet = make([]byte, 40)
+	packet[0] = 6<<4 | 46>>2
+	packet[1] = (46 & 3) << 6
+	if priority := classify(packet); priority != PriorityHigh {
+		t.Errorf("IPv6 packet marked EF classified %v", priority)
+	}
+	packet[0] = 6<<4 | 34>>2
+	packet[1] = (34 & 3) << 6
+	if priority := classify(packet); priority != PriorityNormal {
+		t.Errorf("IPv6 packet marked AF41 classified %v", priority)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+	peer.queue.priority = make(chan *QueueOutboundElement, QueueOutboundSize)
+
+	dev.SetPacketClassifier(func(packet []byte) PacketPriority {
+		if packet[0] == 1 {
+			return PriorityHigh
+		}
+		return PriorityNormal
+	})
+	for i := 0; i < 4; i++ {
+		elem := dev.NewOutboundElement()
+		elem.buffer[0] = byte(i % 2)
+		elem.high = dev.priority(elem.buffer[:1]) == PriorityHigh
+		peer.addToNonceQueue(elem)
+	}
+	if len(peer.queue.nonce) != 2 || len(peer.queue.priority) != 2 {
+		t.Errorf("staged %d packets of normal and %d of high priority, want 2 and 2", len(peer.queue.nonce), len(peer.queue.priority))
+	}
+	if n := peer.Stats().PriorityPackets; n != 2 {
+		t.Errorf("PriorityPackets = %d, want 2", n)
+	}
+
+	dev.SetPacketClassifier(nil)
+	if priority := dev.priority([]byte{1}); priority != PriorityNormal {
+		t.Errorf("packet classified %v without a classifier", priority)
+	}
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+/* Security profiles
+ *
+ * The default profile follows the timers of the protocol. The strict
+ * profile is for environments where keys should live as briefly as
+ * possible: sessions are renewed after StrictRekeyAfterTime and
+ * rejected after StrictRejectAfterTime, by both sides rather than only
+ * the initiator, so that peers on the default profile, which rekey
+ * later, do not outlive the shorter session. It stays compatible with
+ * the protocol, as either side may initiate a handshake at any time.
+ */
+
+// SecurityProfile selects the session lifetimes of a device, see
+// DeviceOptions.SecurityProfile.
+type SecurityProfile int
+
+const (
+	SecurityDefault SecurityProfile = iota // timers of the protocol
+	SecurityStrict                         // shorter sessions, renewed by both sides
+)
+
+func (profile SecurityProfile) String() string {
+	switch profile {
+	case SecurityDefault:
+		return "default"
+	case SecurityStrict:
+		return "strict"
+	default:
+		return fmt.Sprintf("SecurityProfile(UNKNOWN:%d)", int(profile))
+	}
+}
+
+// SecurityProfile returns the security profile of the device.
+func (device *Device) SecurityProfile() SecurityProfile {
+	return device.profile
+}
+
+func (device *Device) rekeyAfterTime() time.Duration {
+	if device.profile == SecurityStrict {
+		return StrictRekeyAfterTime
+	}
+	return RekeyAfterTime
+}
+
+func (device *Device) rejectAfterTime() time.Duration {
+	if device.profile == SecurityStrict {
+		return StrictRejectAfterTime
+	}
+	return RejectAfterTime
+}
+
+// rekeys reports whether the device renews keypair once it ages, which
+// only its initiator does in the default profile.
+func (device *Device) rekeys(keypair *Keypair) bool {
+	return keypair.isInitiator || device.profile == SecurityStrict
+}
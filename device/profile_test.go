@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestSecurityProfile(t *testing.T) {
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		SecurityProfile: SecurityStrict,
+	})
+	defer dev.Close()
+	if dev.rejectAfterTime() != StrictRejectAfterTime || dev.rekeyAfterTime() != StrictRekeyAfterTime {
+		t.Errorf("strict profile rekeys after %v and rejects after %v", dev.rekeyAfterTime(), dev.rejectAfterTime())
+	}
+	if !dev.rekeys(&Keypair{isInitiator: false}) {
+		t.Error("responder does not rekey in the strict profile")
+	}
+
+	// secrets are zeroed as the peer is removed while the device is down
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	psk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev.IpcSet("private_key="+sk.ToHex()+"\n"))
+	peerKey, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev.IpcSet("public_key="+peerKey.publicKey().ToHex()+"\npreshared_key="+psk.ToHex()+"\n"))
+	peer := dev.LookupPeer(peerKey.publicKey())
+	if isZero(peer.handshake.precomputedStaticStatic[:]) {
+		t.Fatal("no precomputed secret to zero")
+	}
+	dev.RemovePeer(peerKey.publicKey())
+	if !isZero(peer.handshake.presharedKey[:]) || !isZero(peer.handshake.precomputedStaticStatic[:]) {
+		t.Error("secrets of the removed peer not zeroed")
+	}
+
+	defaults := randDevice(t)
+	defer defaults.Close()
+	if defaults.SecurityProfile() != SecurityDefault || defaults.rekeys(&Keypair{isInitiator: false}) {
+		t.Error("responder rekeys in the default profile")
+	}
+}
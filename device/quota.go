@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Resource quotas
+ *
+ * Concentrators configured by automation are protected from runaway
+ * state by limits on the peers, the allowed IPs of all peers, and the
+ * handshakes processed per second. Adding a peer or allowed IP beyond
+ * its limit fails with ErrTooManyPeers or ErrTooManyAllowedIP, leaving
+ * the state as it is; handshake messages beyond their rate are dropped
+ * and counted, see HandshakeStats.OverQuota. Lowering a limit below the
+ * current state removes nothing, it only refuses additions.
+ */
+
+// Limits are the resource quotas of a device, see DeviceOptions.Limits.
+type Limits struct {
+	Peers               int // peers configured at once, zero or more than MaxPeers for MaxPeers
+	AllowedIPs          int // allowed IPs of all peers together, zero for no limit
+	HandshakesPerSecond int // handshake messages processed per second, zero for no limit
+}
+
+type quota struct {
+	sync.Mutex
+	limits Limits
+	tokens float64   // handshakes allowed before the bucket runs dry
+	last   time.Time // when tokens was last refilled
+}
+
+// SetLimits replaces the resource quotas of the device.
+func (device *Device) SetLimits(limits Limits) {
+	device.quota.Lock()
+	defer device.quota.Unlock()
+	device.quota.limits = limits
+	device.quota.tokens = float64(limits.HandshakesPerSecond)
+	device.quota.last = device.now()
+}
+
+// Limits returns the resource quotas of the device.
+func (device *Device) Limits() Limits {
+	device.quota.Lock()
+	defer device.quota.Unlock()
+	return device.quota.limits
+}
+
+func (device *Device) peerLimit() int {
+	limit := device.Limits().Peers
+	if limit <= 0 || limit > MaxPeers {
+		return MaxPeers
+	}
+	return limit
+}
+
+// allowHandshake takes a token from the handshake bucket, which holds a
+// second worth of handshakes, reporting whether there was one.
+func (device *Device) allowHandshake() bool {
+	device.quota.Lock()
+	defer device.quota.Unlock()
+
+	rate := float64(device.quota.limits.HandshakesPerSecond)
+	if rate <= 0 {
+		return true
+	}
+	now := device.now()
+	device.quota.tokens += now.Sub(device.quota.last).Seconds() * rate
+	device.quota.last = now
+	if device.quota.tokens > rate {
+		device.quota.tokens = rate
+	}
+	if device.quota.tokens < 1 {
+		return false
+	}
+	device.quota.tokens--
+	return true
+}
+
+// insertWithin inserts ip/cidr for peer like Insert, unless it adds an
+// entry beyond limit entries, zero for no limit.
+func (table *AllowedIPs) insertWithin(ip net.IP, cidr uint, peer *Peer, limit int) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var root **trieEntry
+	switch len(ip) {
+	case net.IPv6len:
+		root = &table.IPv6
+	case net.IPv4len:
+		root = &table.IPv4
+	default:
+		panic(errors.New("inserting unknown address type"))
+	}
+	existing := (*root).find(ip, cidr)
+	if existing == nil && limit > 0 && table.entries >= limit {
+		return false
+	}
+	*root = (*root).insert(ip, cidr, peer)
+	if existing == nil {
+		table.entries++
+	}
+	return true
+}
+
+// find returns the entry of exactly ip/cidr, nil if there is none.
+func (node *trieEntry) find(ip net.IP, cidr uint) *trieEntry {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.cidr == cidr {
+			if node.peer == nil {
+				return nil
+			}
+			return node
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return nil
+}
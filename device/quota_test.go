@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestLimits(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	dev.SetLimits(Limits{Peers: 2, AllowedIPs: 3})
+
+	var peers []string
+	for i := 0; i < 3; i++ {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peers = append(peers, "public_key="+sk.publicKey().ToHex()+"\n")
+	}
+
+	assertNil(t, dev.IpcSet(peers[0]+"allowed_ip=10.0.0.1/32\nallowed_ip=10.0.0.2/32\n"+peers[1]+"allowed_ip=10.0.0.3/32\n"))
+	err := dev.IpcSet(peers[2])
+	var status *IPCError
+	if !errors.Is(err, ErrTooManyPeers) || !errors.As(err, &status) || status.ErrorCode() != ipc.IpcErrorQuota {
+		t.Errorf("adding a peer beyond the limit: %v", err)
+	}
+
+	// reassigning an allowed IP adds no entry
+
+	assertNil(t, dev.IpcSet(peers[1]+"allowed_ip=10.0.0.1/32\n"))
+	err = dev.IpcSet(peers[1] + "allowed_ip=10.0.0.4/32\n")
+	if !errors.Is(err, ErrTooManyAllowedIP) || !errors.As(err, &status) || status.ErrorCode() != ipc.IpcErrorQuota {
+		t.Errorf("adding an allowed ip beyond the limit: %v", err)
+	}
+	if n := dev.allowedips.Len(); n != 3 {
+		t.Errorf("%d allowed ips, want 3", n)
+	}
+
+	// removing a peer frees its quota
+
+	assertNil(t, dev.IpcSet(peers[0]+"remove=true\n"+peers[2]+"allowed_ip=10.0.0.4/32\n"))
+	if n := dev.allowedips.Len(); n != 3 {
+		t.Errorf("%d allowed ips after replacing a peer, want 3", n)
+	}
+}
+
+func TestHandshakeQuota(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	if !dev.allowHandshake() {
+		t.Fatal("handshake refused without a limit")
+	}
+
+	dev.SetLimits(Limits{HandshakesPerSecond: 5})
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if dev.allowHandshake() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("%d handshakes allowed at once, want 5", allowed)
+	}
+}
+
+func TestHandshakeQuotaFollowsClock(t *testing.T) {
+	clock := &testClock{now: time.Unix(1e9, 0)}
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{Clock: clock})
+	defer dev.Close()
+
+	dev.SetLimits(Limits{HandshakesPerSecond: 5})
+	for i := 0; i < 5; i++ {
+		dev.allowHandshake()
+	}
+	if dev.allowHandshake() {
+		t.Fatal("handshake allowed beyond the bucket")
+	}
+	clock.advance(time.Second / 5)
+	if !dev.allowHandshake() {
+		t.Error("bucket not refilled as the device clock advanced")
+	}
+	if dev.allowHandshake() {
+		t.Error("bucket refilled beyond the time passed on the device clock")
+	}
+}
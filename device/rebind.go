@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Sockets become unusable when the interface they are bound to disappears,
+ * e.g. when a USB NIC is unplugged. Rather than leaving the device without
+ * a working bind, failing binds are reopened with exponential backoff.
+ */
+
+// deadSocketErrors are the errors of sockets which stay unusable, as the
+// socket or the interface it is bound to is gone. Other errors, such as
+// EMSGSIZE, EPERM from a firewall or EHOSTUNREACH for a single peer, are
+// not fixed by reopening the bind, which would interrupt every peer.
+var deadSocketErrors = []error{
+	syscall.EBADF,
+	syscall.ENOTSOCK,
+	syscall.ENETDOWN,
+	syscall.ENODEV,
+	syscall.ENXIO,
+	syscall.EADDRNOTAVAIL,
+}
+
+// bindErrorIsPersistent reports whether err may be fixed by reopening the
+// bind.
+func bindErrorIsPersistent(err error) bool {
+	for _, dead := range deadSocketErrors {
+		if errors.Is(err, dead) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindFailed schedules reopening bind after it failed with err.
+// It must not block, since callers may hold the net lock for reading.
+func (device *Device) bindFailed(bind conn.Bind, err error) {
+	if device.isClosed.Get() || !device.isUp.Get() || device.net.rebinding.Swap(true) {
+		return
+	}
+	go device.RoutineRebind(bind, err)
+}
+
+/* Reopens a failed bind until it succeeds, or until the bind
+ * is replaced or closed by a configuration or state change
+ *
+ * Obs. At most one instance per device
+ */
+func (device *Device) RoutineRebind(bind conn.Bind, cause error) {
+	defer device.trackRoutine(routineRebind)()
+
+	logDebug := device.log.Debug
+	logError := device.log.Error
+
+	defer device.net.rebinding.Set(false)
+
+	// errors are expected while a bind is being closed on purpose
+
+	if device.Bind() != bind {
+		return
+	}
+
+	logError.Println("UDP bind failed, reopening:", cause)
+	device.emitEvent(Event{Kind: EventBindFailed, Err: cause})
+
+	backoff := RebindBackoffMin
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for attempts := uint32(1); ; attempts++ {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-timer.C:
+		}
+
+		if !device.isUp.Get() || device.Bind() != bind {
+			return
+		}
+
+		err := device.BindUpdate()
+		if err == nil {
+			atomic.StoreUint32(&device.net.sendErrors, 0)
+			logDebug.Println("UDP bind reopened after", attempts, "attempts")
+			device.emitEvent(Event{Kind: EventBindRestored, Attempts: attempts})
+			return
+		}
+		logError.Println("Unable to reopen UDP bind:", err)
+
+		// a failed BindUpdate leaves no bind behind, retry as long as nobody else opened one
+
+		bind = nil
+		backoff *= 2
+		if backoff > RebindBackoffMax {
+			backoff = RebindBackoffMax
+		}
+		timer.Reset(backoff)
+	}
+}
@@ -7,12 +7,11 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"net"
 	"strconv"
-	"sync"
 	"sync/atomic"
-	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
@@ -20,53 +19,42 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+/* Handshake messages are copied out of the receive buffer into the
+ * element, so that handshakes never wait for buffers of the message
+ * pool, which bulk data may have exhausted.
+ */
 type QueueHandshakeElement struct {
 	msgType  uint32
-	packet   []byte
-	endpoint conn.Endpoint
-	buffer   *[MaxMessageSize]byte
-}
-
-type QueueInboundElement struct {
-	dropped int32
-	sync.Mutex
-	buffer   *[MaxMessageSize]byte
-	packet   []byte
-	counter  uint64
-	keypair  *Keypair
+	size     int
 	endpoint conn.Endpoint
+	buffer   [MessageInitiationSize]byte // large enough for any handshake message
+	packet   []byte                      // slice of "buffer", set by the handshake worker
 }
 
-func (elem *QueueInboundElement) Drop() {
-	atomic.StoreInt32(&elem.dropped, AtomicTrue)
-}
-
-func (elem *QueueInboundElement) IsDropped() bool {
-	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
-}
-
-func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueInboundElement, decryptionQueue chan *QueueInboundElement, element *QueueInboundElement) bool {
+func (device *Device) addToInboundAndDecryptionQueues(inboundQueue *orderedRing, decryptionQueue chan *QueueInboundElement, element *QueueInboundElement) bool {
+	if !inboundQueue.push(element) {
+		device.PutInboundElement(element)
+		return false
+	}
 	select {
-	case inboundQueue <- element:
-		select {
-		case decryptionQueue <- element:
-			return true
-		default:
-			element.Drop()
-			element.Unlock()
-			return false
-		}
+	case decryptionQueue <- element:
+		return true
 	default:
-		device.PutInboundElement(element)
+		element.Drop()
+		device.releaseInboundElement(element)
 		return false
 	}
 }
 
 func (device *Device) addToHandshakeQueue(queue chan QueueHandshakeElement, element QueueHandshakeElement) bool {
+	device.addWork()
 	select {
 	case queue <- element:
 		return true
 	default:
+		device.doneWork()
+		atomic.AddUint64(&device.stats.handshakeQueueFull, 1)
+		device.dropped(DropQueueFull, nil, element.buffer[:element.size])
 		return false
 	}
 }
@@ -80,7 +68,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && peer.device.rekeys(keypair) && peer.device.since(keypair.created) > (peer.device.rejectAfterTime()-KeepaliveTimeout-RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake.Set(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -92,6 +80,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * IPv4 and IPv6 (separately)
  */
 func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
+	defer device.trackRoutine(routineReceive)()
 
 	logDebug := device.log.Debug
 	defer func() {
@@ -102,130 +91,249 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - started")
 	device.net.starting.Done()
 
+	// coalesced datagrams are only delivered once offload was enabled
+
+	receiver, offload := bind.(conn.SegmentReceiver)
+	offload = offload && device.net.offload
+
+	/* Once the preallocated message buffers are exhausted, datagrams
+	 * are received into a reserved buffer of the routine instead of
+	 * waiting for one. Data received into it is dropped, handshake
+	 * messages are still processed, so that keys can be renewed.
+	 */
+
+	var reserve *[MaxMessageSize]byte
+	if device.queueSizes.preallocated != 0 {
+		reserve = new([MaxMessageSize]byte)
+	}
+	nextBuffer := func() *[MaxMessageSize]byte {
+		if buffer, ok := device.tryGetMessageBuffer(); ok {
+			return buffer
+		}
+		return reserve
+	}
+	receive := func(buffer *[MaxMessageSize]byte, size int, endpoint conn.Endpoint) bool {
+		if size = device.unwrapDatagram(buffer, size); size < MinMessageSize {
+			device.malformed(MalformedTruncated, endpoint)
+			return false
+		}
+		if buffer == reserve && binary.LittleEndian.Uint32(buffer[:4]) == MessageTransportType {
+			atomic.AddUint64(&device.stats.buffersExhausted, 1)
+			return false
+		}
+		return device.receiveDatagram(buffer, size, endpoint)
+	}
+
 	// receive datagrams until conn is closed
 
-	buffer := device.GetMessageBuffer()
+	buffer := nextBuffer()
+	var segments []*[MaxMessageSize]byte
 
 	var (
 		err      error
 		size     int
+		segment  int
 		endpoint conn.Endpoint
 	)
 
 	for {
+		if buffer == reserve {
+			buffer = nextBuffer()
+		}
 
 		// read next datagram
 
-		switch IP {
-		case ipv4.Version:
+		switch {
+		case IP == ipv4.Version && offload:
+			size, segment, endpoint, err = receiver.ReceiveIPv4Segments(buffer[:])
+		case IP == ipv6.Version && offload:
+			size, segment, endpoint, err = receiver.ReceiveIPv6Segments(buffer[:])
+		case IP == ipv4.Version:
 			size, endpoint, err = bind.ReceiveIPv4(buffer[:])
-		case ipv6.Version:
+		case IP == ipv6.Version:
 			size, endpoint, err = bind.ReceiveIPv6(buffer[:])
 		default:
 			panic("invalid IP version")
 		}
 
 		if err != nil {
-			device.PutMessageBuffer(buffer)
+			if buffer != reserve {
+				device.PutMessageBuffer(buffer)
+			}
+			if !device.net.closingBind.Get() {
+				device.stats.receiveErrors.add(err)
+			}
+			if bindErrorIsPersistent(err) {
+				device.bindFailed(bind, err)
+			}
 			return
 		}
 
-		if size < MinMessageSize {
+		if !device.receivePermitted(endpoint) {
+			device.dropped(DropFiltered, nil, buffer[:size])
 			continue
 		}
 
-		// check size of packet
+		if segment < MinMessageSize || segment >= size {
+			if size < MinMessageSize {
+				device.malformed(MalformedTruncated, endpoint)
+			} else if receive(buffer, size, endpoint) {
+				buffer = nextBuffer()
+			}
+			continue
+		}
+
+		// split coalesced datagrams, copying out the trailing
+		// segments before the first one is handed on
+
+		segments = segments[:0]
+		for offset := segment; offset < size; offset += segment {
+			next := nextBuffer()
+			if next == reserve {
+				atomic.AddUint64(&device.stats.buffersExhausted, uint64((size-offset+segment-1)/segment))
+				break
+			}
+			copy(next[:segment], buffer[offset:size])
+			segments = append(segments, next)
+		}
+		if receive(buffer, segment, endpoint) {
+			buffer = nextBuffer()
+		}
+		for i, next := range segments {
+			length := size - (i+1)*segment
+			if length > segment {
+				length = segment
+			}
+			if length < MinMessageSize {
+				device.malformed(MalformedTruncated, endpoint)
+				device.PutMessageBuffer(next)
+			} else if !receive(next, length, endpoint) {
+				device.PutMessageBuffer(next)
+			}
+		}
+	}
+}
+
+/* Hands a single received message to the decryption
+ * or handshake queue, returning whether buffer was taken,
+ * which it never is for handshake messages
+ */
+func (device *Device) receiveDatagram(buffer *[MaxMessageSize]byte, size int, endpoint conn.Endpoint) bool {
+	logDebug := device.log.Debug
 
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+	// check size of packet
 
-		var okay bool
+	packet := buffer[:size]
+	msgType := binary.LittleEndian.Uint32(packet[:4])
 
-		switch msgType {
+	var okay bool
 
-		// check if transport
+	switch msgType {
 
-		case MessageTransportType:
+	// check if transport
 
-			// check size
+	case MessageTransportType:
 
-			if len(packet) < MessageTransportSize {
-				continue
-			}
+		// check size
 
-			// lookup key pair
+		if len(packet) < MessageTransportSize {
+			device.malformed(MalformedBadLength, endpoint)
+			return false
+		}
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+		// lookup key pair
 
-			// check keypair expiry
+		receiver := binary.LittleEndian.Uint32(
+			packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+		)
+		value := device.indexTable.Lookup(receiver)
+		keypair := value.keypair
+		if keypair == nil {
+			device.dropped(DropNoSession, nil, packet)
+			return false
+		}
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+		// check keypair expiry
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.dropped = AtomicFalse
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-
-			peer.queue.RLock()
-			if peer.isRunning.Get() {
-				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
-					buffer = device.GetMessageBuffer()
-				}
+		if keypair.created.Add(device.rejectAfterTime()).Before(device.now()) {
+			device.dropped(DropNoSession, value.peer, packet)
+			return false
+		}
+
+		peer := value.peer
+		if !peer.sourceAllowed(endpoint) {
+			return false
+		}
+
+		// create work element
+		elem := device.GetInboundElement()
+		elem.reset(buffer)
+		elem.packet = packet
+		elem.keypair = keypair
+		elem.endpoint = endpoint
+
+		// add to decryption queues
+
+		consumed := false
+		peer.queue.RLock()
+		if peer.isRunning.Get() {
+			consumed = device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem)
+			if !consumed {
+				device.dropped(DropQueueFull, peer, packet)
 			}
-			peer.queue.RUnlock()
+		}
+		peer.queue.RUnlock()
+		return consumed
 
-			continue
+	// otherwise it is a fixed size & handshake related packet
 
-		// otherwise it is a fixed size & handshake related packet
+	case MessageInitiationType:
+		okay = len(packet) == MessageInitiationSize
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+	case MessageResponseType:
+		okay = len(packet) == MessageResponseSize
 
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+	case MessageCookieReplyType:
+		okay = len(packet) == MessageCookieReplySize
 
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	// probes of endpoint candidates are answered right away
 
-		default:
-			logDebug.Println("Received message with unknown type")
-		}
-
-		if okay {
-			if (device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-				},
-			)) {
-				buffer = device.GetMessageBuffer()
-			}
+	case MessageProbeType, MessageProbeAnswerType:
+		if len(packet) != MessageProbeSize {
+			device.malformed(MalformedBadLength, endpoint)
+			return false
 		}
+		device.receiveProbe(packet, endpoint)
+		return false
+
+	default:
+		if isSTUNMessage(packet) {
+			device.receiveSTUN(packet)
+			return false
+		}
+		logDebug.Println("Received message with unknown type")
+	}
+
+	if !okay {
+		device.malformed(MalformedBadLength, endpoint)
+		return false
+	}
+	if device.dataPlaneOnly {
+		logDebug.Println("Dropping handshake message in data-plane-only mode")
+		return false
 	}
+	elem := QueueHandshakeElement{
+		msgType:  msgType,
+		size:     len(packet),
+		endpoint: endpoint,
+	}
+	copy(elem.buffer[:], packet)
+	device.addToHandshakeQueue(device.queue.handshake, elem)
+	return false
 }
 
 func (device *Device) RoutineDecryption() {
+	defer device.trackRoutine(routineDecryption)()
 
 	var nonce [chacha20poly1305.NonceSize]byte
 
@@ -248,9 +356,10 @@ func (device *Device) RoutineDecryption() {
 				return
 			}
 
-			// check if dropped
+			// check if abandoned by a stopped receiver
 
-			if elem.IsDropped() {
+			if elem.abandoned() {
+				device.freeInboundElement(elem)
 				continue
 			}
 
@@ -274,7 +383,8 @@ func (device *Device) RoutineDecryption() {
 			// decrypt and release to consumer
 
 			var err error
-			elem.counter = binary.LittleEndian.Uint64(counter)
+			header := elem.packet[:MessageTransportOffsetContent]
+			elem.nonce = binary.LittleEndian.Uint64(counter)
 			elem.packet, err = elem.keypair.receive.Open(
 				content[:0],
 				nonce[:],
@@ -282,10 +392,12 @@ func (device *Device) RoutineDecryption() {
 				nil,
 			)
 			if err != nil {
+				device.dropped(DropDecryption, device.indexTable.Lookup(elem.keypair.localIndex).peer, header)
+				device.malformed(MalformedFailedAuth, elem.endpoint)
 				elem.Drop()
 				device.PutMessageBuffer(elem.buffer)
 			}
-			elem.Unlock()
+			device.releaseInboundElement(elem)
 		}
 	}
 }
@@ -293,29 +405,30 @@ func (device *Device) RoutineDecryption() {
 /* Handles incoming packets related to handshake
  */
 func (device *Device) RoutineHandshake() {
+	defer device.trackRoutine(routineHandshake)()
 
-	logInfo := device.log.Info
 	logError := device.log.Error
 	logDebug := device.log.Debug
 
 	var elem QueueHandshakeElement
 	var ok bool
+	var working bool // elem counts as work, see Device.Working
 
 	defer func() {
+		if working {
+			device.doneWork()
+		}
 		logDebug.Println("Routine: handshake worker - stopped")
 		device.state.stopping.Done()
-		if elem.buffer != nil {
-			device.PutMessageBuffer(elem.buffer)
-		}
 	}()
 
 	logDebug.Println("Routine: handshake worker - started")
 	device.state.starting.Done()
 
 	for {
-		if elem.buffer != nil {
-			device.PutMessageBuffer(elem.buffer)
-			elem.buffer = nil
+		if working {
+			device.doneWork()
+			working = false
 		}
 
 		select {
@@ -327,6 +440,8 @@ func (device *Device) RoutineHandshake() {
 		if !ok {
 			return
 		}
+		working = true
+		elem.packet = elem.buffer[:elem.size]
 
 		// handle cookie fields and ratelimiting
 
@@ -355,7 +470,7 @@ func (device *Device) RoutineHandshake() {
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				logDebug.Println("Receiving cookie response from ", elem.endpoint.DstToString())
+				logDebug.Println("Receiving cookie response from ", device.redactEndpoint(elem.endpoint.DstToString()))
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
 					logDebug.Println("Could not decrypt invalid cookie response")
 				}
@@ -369,12 +484,17 @@ func (device *Device) RoutineHandshake() {
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
 				logDebug.Println("Received packet with invalid mac1")
+				device.dropped(DropInvalidMAC, nil, elem.packet)
+				if elem.endpoint != nil {
+					device.malformed(MalformedFailedAuth, elem.endpoint)
+				}
 				continue
 			}
 
-			// endpoints destination address is the source of the datagram
+			// endpoints destination address is the source of the datagram,
+			// messages delivered out of band have none
 
-			if device.IsUnderLoad() {
+			if elem.endpoint != nil && device.IsUnderLoad() {
 
 				// verify MAC2 field
 
@@ -386,10 +506,18 @@ func (device *Device) RoutineHandshake() {
 				// check ratelimiter
 
 				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+					atomic.AddUint64(&device.stats.rateLimited, 1)
 					continue
 				}
 			}
 
+			// check quota of the device
+
+			if !device.allowHandshake() {
+				atomic.AddUint64(&device.stats.overQuota, 1)
+				continue
+			}
+
 		default:
 			logError.Println("Invalid packet ended up in the handshake queue")
 			continue
@@ -399,104 +527,184 @@ func (device *Device) RoutineHandshake() {
 
 		switch elem.msgType {
 		case MessageInitiationType:
+			device.receiveInitiation(&elem)
+		case MessageResponseType:
+			device.receiveResponse(&elem)
+		}
+	}
+}
 
-			// unmarshal
-
-			var msg MessageInitiation
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				logError.Println("Failed to decode initiation message")
-				continue
-			}
+// receiveInitiation consumes the handshake initiation of elem and
+// answers it, returning why it was refused, if so.
+func (device *Device) receiveInitiation(elem *QueueHandshakeElement) (err error) {
+	_, span := device.startSpan(context.Background(), SpanHandshakeInitiation)
+	span.SetAttribute(AttributeSource, device.handshakeSource(elem))
+	defer func() {
+		span.End(err)
+	}()
 
-			// consume initiation
+	// unmarshal
 
-			peer := device.ConsumeMessageInitiation(&msg)
-			if peer == nil {
-				logInfo.Println(
-					"Received invalid initiation message from",
-					elem.endpoint.DstToString(),
-				)
-				continue
-			}
+	var msg MessageInitiation
+	reader := bytes.NewReader(elem.packet)
+	err = binary.Read(reader, binary.LittleEndian, &msg)
+	if err != nil {
+		device.log.Error.Println("Failed to decode initiation message")
+		return err
+	}
 
-			// update timers
+	// consume initiation
+
+	peer, err := device.consumeMessageInitiation(&msg, func(peer *Peer) error {
+		return peer.refuseHandshake(elem, "initiation")
+	})
+	if peer == nil {
+		device.log.Info.Println(
+			"Received invalid initiation message from",
+			device.handshakeSource(elem),
+		)
+		return errInvalidHandshake
+	}
+	span.SetAttribute(AttributePeer, device.redactKey(peer.handshake.remoteStatic))
+	if err != nil {
+		return err
+	}
+	peer.countHandshake()
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketReceived()
+	// update timers
 
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
 
-			logDebug.Println(peer, "- Received handshake initiation")
-			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+	// update endpoint
+	if elem.endpoint != nil {
+		peer.SetEndpointFromPacket(elem.endpoint)
+	}
 
-			peer.SendHandshakeResponse()
+	peer.log.Debug.Println(peer, "- Received handshake initiation", "from", device.handshakeSource(elem))
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
 
-		case MessageResponseType:
+	return peer.SendHandshakeResponse()
+}
 
-			// unmarshal
+// refuseHandshake returns why the authenticated handshake message of
+// kind in elem is refused for peer, nil if it is not, so that a refused
+// message leaves the handshake state untouched.
+func (peer *Peer) refuseHandshake(elem *QueueHandshakeElement, kind string) error {
+	if elem.endpoint != nil && !peer.sourceAllowed(elem.endpoint) {
+		peer.log.Debug.Println(peer, "- Dropped handshake", kind, "from disallowed source", peer.device.redactEndpoint(elem.endpoint.DstToString()))
+		return errDisallowedSource
+	}
+	if peer.expired() {
+		peer.log.Debug.Println(peer, "- Refused handshake", kind, "of expired peer")
+		return errPeerExpired
+	}
+	if peer.disabled.Get() {
+		peer.log.Debug.Println(peer, "- Refused handshake", kind, "of disabled peer")
+		return errPeerDisabled
+	}
+	if peer.multiLoginBlocked() {
+		peer.log.Debug.Println(peer, "- Refused handshake", kind, "while rejecting multi-login")
+		return errMultiLoginBlocked
+	}
+	return nil
+}
 
-			var msg MessageResponse
-			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				logError.Println("Failed to decode response message")
-				continue
-			}
+// receiveResponse consumes the handshake response of elem, completing
+// the handshake, and returns why it was refused, if so.
+func (device *Device) receiveResponse(elem *QueueHandshakeElement) (err error) {
+	_, span := device.startSpan(context.Background(), SpanHandshakeResponse)
+	span.SetAttribute(AttributeSource, device.handshakeSource(elem))
+	defer func() {
+		span.End(err)
+	}()
 
-			// consume response
+	// unmarshal
 
-			peer := device.ConsumeMessageResponse(&msg)
-			if peer == nil {
-				logInfo.Println(
-					"Received invalid response message from",
-					elem.endpoint.DstToString(),
-				)
-				continue
-			}
+	var msg MessageResponse
+	reader := bytes.NewReader(elem.packet)
+	err = binary.Read(reader, binary.LittleEndian, &msg)
+	if err != nil {
+		device.log.Error.Println("Failed to decode response message")
+		return err
+	}
 
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+	// consume response
+
+	peer, err := device.consumeMessageResponse(&msg, func(peer *Peer) error {
+		return peer.refuseHandshake(elem, "response")
+	})
+	if peer == nil {
+		device.log.Info.Println(
+			"Received invalid response message from",
+			device.handshakeSource(elem),
+		)
+		return errInvalidHandshake
+	}
+	span.SetAttribute(AttributePeer, device.redactKey(peer.handshake.remoteStatic))
+	if err != nil {
+		return err
+	}
+	peer.countHandshake()
 
-			logDebug.Println(peer, "- Received handshake response")
-			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+	// update endpoint
+	if elem.endpoint != nil {
+		peer.SetEndpointFromPacket(elem.endpoint)
+		peer.endpointAnswered(elem.endpoint)
+	}
 
-			// update timers
+	peer.log.Debug.Println(peer, "- Received handshake response", "from", device.handshakeSource(elem))
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketReceived()
+	// update timers
 
-			// derive keypair
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
 
-			err = peer.BeginSymmetricSession()
+	// derive keypair
 
-			if err != nil {
-				logError.Println(peer, "- Failed to derive keypair:", err)
-				continue
-			}
+	err = peer.BeginSymmetricSession()
 
-			peer.timersSessionDerived()
-			peer.timersHandshakeComplete()
-			peer.SendKeepalive()
-			select {
-			case peer.signals.newKeypairArrived <- struct{}{}:
-			default:
-			}
-		}
+	if err != nil {
+		peer.log.Error.Println(peer, "- Failed to derive keypair:", err)
+		return err
 	}
+
+	peer.timersSessionDerived()
+	peer.timersHandshakeComplete()
+	peer.SendKeepalive()
+	peer.signalNewKeypair()
+	return nil
 }
 
 func (peer *Peer) RoutineSequentialReceiver() {
+	defer peer.device.trackRoutine(routineSequentialReceiver)()
 
 	device := peer.device
-	logInfo := device.log.Info
-	logError := device.log.Error
-	logDebug := device.log.Debug
+	logInfo := peer.log.Info
+	logError := peer.log.Error
+	logDebug := peer.log.Debug
 
 	var elem *QueueInboundElement
 
+	// packets awaiting a batched write to the TUN device
+
+	batchSize := device.tun.device.BatchSize()
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	pending := make([]*QueueInboundElement, 0, batchSize)
+	buffs := make([][]byte, 0, batchSize)
+
+	release := func() {
+		for _, elem := range pending {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutInboundElement(elem)
+		}
+		pending = pending[:0]
+		buffs = buffs[:0]
+	}
+
 	defer func() {
 		logDebug.Println(peer, "- Routine: sequential receiver - stopped")
 		peer.routines.stopping.Done()
@@ -506,6 +714,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			}
 			device.PutInboundElement(elem)
 		}
+		release()
 	}()
 
 	logDebug.Println(peer, "- Routine: sequential receiver - started")
@@ -521,19 +730,29 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			elem = nil
 		}
 
-		var elemOk bool
-		select {
-		case <-peer.routines.stop:
-			return
-		case elem, elemOk = <-peer.queue.inbound:
-			if !elemOk {
-				return
+		// write to tun device once there is nothing more to batch
+
+		if len(pending) > 0 && (len(pending) == batchSize || peer.queue.inbound.len() == 0) {
+			_, err := device.tun.device.WritePackets(buffs, MessageTransportOffsetContent)
+			if peer.queue.inbound.len() == 0 {
+				err := device.tun.device.Flush()
+				if err != nil {
+					logError.Printf("Unable to flush packets: %v", err)
+				}
+			}
+			if err != nil && !device.isClosed.Get() {
+				logError.Println("Failed to write packet to TUN device:", err)
 			}
+			release()
 		}
 
 		// wait for decryption
 
-		elem.Lock()
+		var elemOk bool
+		elem, elemOk = peer.queue.inbound.next(peer.routines.stop)
+		if !elemOk {
+			return
+		}
 
 		if elem.IsDropped() {
 			continue
@@ -541,7 +760,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 		// check for replay
 
-		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+		if !elem.keypair.replayFilter.ValidateCounter(elem.nonce, RejectAfterMessages) {
+			device.dropped(DropReplay, peer, elem.packet)
+			continue
+		}
+
+		if !peer.acceptSession(elem.keypair, elem.endpoint) {
 			continue
 		}
 
@@ -551,16 +775,14 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		// check if using new keypair
 		if peer.ReceivedWithKeypair(elem.keypair) {
 			peer.timersHandshakeComplete()
-			select {
-			case peer.signals.newKeypairArrived <- struct{}{}:
-			default:
-			}
+			peer.signalNewKeypair()
 		}
 
 		peer.keepKeyFreshReceiving()
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketReceived()
 		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+		peer.accountQuota(0, uint64(len(elem.packet)+MinMessageSize))
 
 		// check for keepalive
 
@@ -568,6 +790,10 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			logDebug.Println(peer, "- Receiving keepalive packet")
 			continue
 		}
+		if peer.quota.exceeded.Get() {
+			device.dropped(DropOverQuota, peer, elem.packet)
+			continue
+		}
 		peer.timersDataReceived()
 
 		// verify source and strip padding
@@ -578,12 +804,14 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.malformed(MalformedBadLength, elem.endpoint)
 				continue
 			}
 
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
 			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+				device.malformed(MalformedBadLength, elem.endpoint)
 				continue
 			}
 
@@ -592,11 +820,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// verify IPv4 source
 
 			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
-			if device.allowedips.LookupIPv4(src) != peer {
+			if owner := device.allowedips.LookupIPv4(src); owner != peer && !peer.sharedRouteFor(src, owner) {
 				logInfo.Println(
 					"IPv4 packet with disallowed source address from",
 					peer,
 				)
+				device.dropped(DropDisallowedSource, peer, elem.packet)
 				continue
 			}
 
@@ -605,6 +834,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.malformed(MalformedBadLength, elem.endpoint)
 				continue
 			}
 
@@ -612,6 +842,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			length := binary.BigEndian.Uint16(field)
 			length += ipv6.HeaderLen
 			if int(length) > len(elem.packet) {
+				device.malformed(MalformedBadLength, elem.endpoint)
 				continue
 			}
 
@@ -620,31 +851,39 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// verify IPv6 source
 
 			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
-			if device.allowedips.LookupIPv6(src) != peer {
+			if owner := device.allowedips.LookupIPv6(src); owner != peer && !peer.sharedRouteFor(src, owner) {
 				logInfo.Println(
 					"IPv6 packet with disallowed source address from",
 					peer,
 				)
+				device.dropped(DropDisallowedSource, peer, elem.packet)
 				continue
 			}
 
+		case controlVersion:
+			peer.receiveControl(elem.packet)
+			continue
+
 		default:
 			logInfo.Println("Packet with invalid IP version from", peer)
 			continue
 		}
 
-		// write to tun device
-
-		offset := MessageTransportOffsetContent
-		_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
-		if len(peer.queue.inbound) == 0 {
-			err = device.tun.device.Flush()
-			if err != nil {
-				peer.device.log.Error.Printf("Unable to flush packets: %v", err)
-			}
+		if device.mssClamping.Get() {
+			clampMSS(elem.packet, peer.MTU())
 		}
-		if err != nil && !device.isClosed.Get() {
-			logError.Println("Failed to write packet to TUN device:", err)
+
+		// forward to another peer in relay mode
+
+		if peer.relay(elem) {
+			continue
 		}
+
+		// queue for batched write to tun device
+
+		offset := MessageTransportOffsetContent
+		buffs = append(buffs, elem.buffer[:offset+len(elem.packet)])
+		pending = append(pending, elem)
+		elem = nil
 	}
 }
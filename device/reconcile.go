@@ -0,0 +1,348 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Reconciliation
+ *
+ * Controllers managing devices declaratively hold the configuration a
+ * device should have, and apply it over and over. Applying it with
+ * replace_peers would remove and add back every peer, dropping their
+ * sessions, so ApplyConfig applies only the difference between the
+ * configuration of the device and the desired one, which DiffConfig
+ * works out, and does nothing once the device is configured as desired.
+ */
+
+// ReconcileOptions modify how ApplyConfig reconciles a device.
+type ReconcileOptions struct {
+	KeepUnlistedPeers bool // keep the peers missing from the desired configuration rather than removing them
+	DryRun            bool // work out the changes without applying them
+}
+
+// ApplyConfig configures the device as desired, applying only the
+// changes DiffConfig works out against its current configuration, which
+// it returns. The configuration cannot change in between, as ApplyConfig
+// is serialized with UAPI set operations.
+func (device *Device) ApplyConfig(desired *DeviceConfig, opts ReconcileOptions) (*DeviceConfig, error) {
+	var diff *DeviceConfig
+	err := device.audited("api", func() error {
+		current, err := device.IpcGetConfig()
+		if err != nil {
+			return err
+		}
+		diff = diffConfig(current, desired, !opts.KeepUnlistedPeers)
+		if opts.DryRun {
+			return nil
+		}
+		return device.ipcSetOperation(bufio.NewReader(strings.NewReader(diff.UAPI())))
+	})
+	return diff, err
+}
+
+// DiffConfig returns the configuration which, applied with IpcSetConfig to a
+// device configured as old, configures it as new, touching only what
+// differs: peers missing from new are removed, peers missing from old
+// are added, and of the other peers only the settings which changed are
+// set, so that their sessions survive. Lists, such as allowed IPs, are
+// replaced as a whole if they differ as sets. Settings which are nil in
+// new are left as they are, as is the endpoint of a peer which new has
+// none for, since devices learn the endpoints of roaming peers, and the
+// listen port if new asks for any port with zero.
+//
+// The old configuration is usually the one returned by IpcGetConfig, and
+// the Replace flags of both are ignored.
+func DiffConfig(old, new *DeviceConfig) *DeviceConfig {
+	return diffConfig(old, new, true)
+}
+
+func diffConfig(old, new *DeviceConfig, removeUnlisted bool) *DeviceConfig {
+	diff := &DeviceConfig{}
+
+	if new.PrivateKey != nil && (old.PrivateKey == nil || !old.PrivateKey.Equals(*new.PrivateKey)) {
+		diff.PrivateKey = new.PrivateKey
+	}
+	if new.ListenPort != nil && *new.ListenPort != 0 && configUint16(old.ListenPort) != *new.ListenPort {
+		diff.ListenPort = new.ListenPort
+	}
+	if new.FirewallMark != nil && (old.FirewallMark == nil && *new.FirewallMark != 0 ||
+		old.FirewallMark != nil && *old.FirewallMark != *new.FirewallMark) {
+		diff.FirewallMark = new.FirewallMark
+	}
+	if new.Relay != nil && configBool(old.Relay) != *new.Relay {
+		diff.Relay = new.Relay
+	}
+	if !sameStrings(relayRuleNames(old.RelayRules), relayRuleNames(new.RelayRules)) {
+		diff.ReplaceRelayRules = true
+		diff.RelayRules = new.RelayRules
+	}
+	if new.MSSClamp != nil && configBool(old.MSSClamp) != *new.MSSClamp {
+		diff.MSSClamp = new.MSSClamp
+	}
+	if !samePrefixes(old.ReceiveAllowlist, new.ReceiveAllowlist) {
+		diff.ReplaceReceiveAllowlist = true
+		diff.ReceiveAllowlist = new.ReceiveAllowlist
+	}
+	if new.ReceiveAllowlistLearn != nil && configBool(old.ReceiveAllowlistLearn) != *new.ReceiveAllowlistLearn {
+		diff.ReceiveAllowlistLearn = new.ReceiveAllowlistLearn
+	}
+
+	oldPeers := make(map[NoisePublicKey]*PeerConfig, len(old.Peers))
+	for i := range old.Peers {
+		oldPeers[old.Peers[i].PublicKey] = &old.Peers[i]
+	}
+	newPeers := make(map[NoisePublicKey]bool, len(new.Peers))
+	for i := range new.Peers {
+		peer := &new.Peers[i]
+		newPeers[peer.PublicKey] = true
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		if !ok {
+			added := *peer
+			added.Remove, added.UpdateOnly = false, false
+			added.ReplaceAllowedIPs, added.ReplaceAllowedSources = false, false
+			added.ReplaceBackupAllowedIPs, added.ReplaceBalancedAllowedIPs = false, false
+			diff.Peers = append(diff.Peers, added)
+			continue
+		}
+		if changed, ok := diffPeer(oldPeer, peer); ok {
+			diff.Peers = append(diff.Peers, changed)
+		}
+	}
+	for _, peer := range old.Peers {
+		if removeUnlisted && !newPeers[peer.PublicKey] {
+			diff.Peers = append(diff.Peers, PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	return diff
+}
+
+// diffPeer returns the settings of new differing from those of old,
+// false if none do.
+func diffPeer(old, new *PeerConfig) (PeerConfig, bool) {
+	diff := PeerConfig{PublicKey: new.PublicKey, UpdateOnly: true}
+	changed := false
+
+	if new.PresharedKey != nil && configPresharedKey(old.PresharedKey) != *new.PresharedKey {
+		diff.PresharedKey = new.PresharedKey
+		changed = true
+	}
+	if new.Endpoint != nil && (old.Endpoint == nil || old.Endpoint.String() != new.Endpoint.String()) {
+		diff.Endpoint = new.Endpoint
+		changed = true
+	}
+	if new.EndpointHost != "" && old.EndpointHost != new.EndpointHost {
+		diff.EndpointHost = new.EndpointHost
+		changed = true
+	}
+	if new.PersistentKeepaliveInterval != nil && configUint16(old.PersistentKeepaliveInterval) != *new.PersistentKeepaliveInterval {
+		diff.PersistentKeepaliveInterval = new.PersistentKeepaliveInterval
+		changed = true
+	}
+	if new.ExpiresAt != nil && configExpiry(old.ExpiresAt) != configExpiry(new.ExpiresAt) {
+		diff.ExpiresAt = new.ExpiresAt
+		changed = true
+	}
+	if new.Ephemeral != nil && configEphemeral(old.Ephemeral) != configEphemeral(new.Ephemeral) {
+		diff.Ephemeral = new.Ephemeral
+		changed = true
+	}
+	if new.ThresholdNoHandshake != nil && configSeconds(old.ThresholdNoHandshake) != configSeconds(new.ThresholdNoHandshake) {
+		diff.ThresholdNoHandshake = new.ThresholdNoHandshake
+		changed = true
+	}
+	if new.ThresholdRxBytes != nil && configUint64(old.ThresholdRxBytes) != *new.ThresholdRxBytes {
+		diff.ThresholdRxBytes = new.ThresholdRxBytes
+		changed = true
+	}
+	if new.ThresholdTxBytes != nil && configUint64(old.ThresholdTxBytes) != *new.ThresholdTxBytes {
+		diff.ThresholdTxBytes = new.ThresholdTxBytes
+		changed = true
+	}
+	if new.QuotaTxBytes != nil && configUint64(old.QuotaTxBytes) != *new.QuotaTxBytes {
+		diff.QuotaTxBytes = new.QuotaTxBytes
+		changed = true
+	}
+	if new.QuotaRxBytes != nil && configUint64(old.QuotaRxBytes) != *new.QuotaRxBytes {
+		diff.QuotaRxBytes = new.QuotaRxBytes
+		changed = true
+	}
+	if new.QuotaPeriod != nil && configSeconds(old.QuotaPeriod) != configSeconds(new.QuotaPeriod) {
+		diff.QuotaPeriod = new.QuotaPeriod
+		changed = true
+	}
+	if new.QuotaAction != nil && (old.QuotaAction == nil && *new.QuotaAction != QuotaDrop ||
+		old.QuotaAction != nil && *old.QuotaAction != *new.QuotaAction) {
+		diff.QuotaAction = new.QuotaAction
+		changed = true
+	}
+	if new.MultiLoginPolicy != nil && (old.MultiLoginPolicy == nil && *new.MultiLoginPolicy != MultiLoginAllow ||
+		old.MultiLoginPolicy != nil && *old.MultiLoginPolicy != *new.MultiLoginPolicy) {
+		diff.MultiLoginPolicy = new.MultiLoginPolicy
+		changed = true
+	}
+	if new.Disabled != nil && configBool(old.Disabled) != *new.Disabled {
+		diff.Disabled = new.Disabled
+		changed = true
+	}
+	if new.ResponderOnly != nil && configBool(old.ResponderOnly) != *new.ResponderOnly {
+		diff.ResponderOnly = new.ResponderOnly
+		changed = true
+	}
+	if new.Obfuscation != nil && (old.Obfuscation == nil && *new.Obfuscation != "" ||
+		old.Obfuscation != nil && *old.Obfuscation != *new.Obfuscation) {
+		diff.Obfuscation = new.Obfuscation
+		changed = true
+	}
+
+	// the allowed IPs resulting from exclusions are not worked out, so
+	// they are set whenever there are any
+
+	if len(new.ExcludedAllowedIPs) > 0 || !samePrefixes(old.AllowedIPs, new.AllowedIPs) {
+		diff.ReplaceAllowedIPs = true
+		diff.AllowedIPs = new.AllowedIPs
+		diff.ExcludedAllowedIPs = new.ExcludedAllowedIPs
+		changed = true
+	}
+	if !samePrefixes(old.AllowedSources, new.AllowedSources) {
+		diff.ReplaceAllowedSources = true
+		diff.AllowedSources = new.AllowedSources
+		changed = true
+	}
+	if new.FailoverPriority != nil && configUint16(old.FailoverPriority) != *new.FailoverPriority {
+		diff.FailoverPriority = new.FailoverPriority
+		changed = true
+	}
+	if !samePrefixes(old.BackupAllowedIPs, new.BackupAllowedIPs) {
+		diff.ReplaceBackupAllowedIPs = true
+		diff.BackupAllowedIPs = new.BackupAllowedIPs
+		changed = true
+	}
+	if new.BalanceWeight != nil && configBalanceWeight(old.BalanceWeight) != *new.BalanceWeight {
+		diff.BalanceWeight = new.BalanceWeight
+		changed = true
+	}
+	if !samePrefixes(old.BalancedAllowedIPs, new.BalancedAllowedIPs) {
+		diff.ReplaceBalancedAllowedIPs = true
+		diff.BalancedAllowedIPs = new.BalancedAllowedIPs
+		changed = true
+	}
+	if new.ExpireSessions {
+		diff.ExpireSessions = true
+		changed = true
+	}
+	return diff, changed
+}
+
+func configBool(value *bool) bool {
+	return value != nil && *value
+}
+
+func configBalanceWeight(value *uint16) uint16 {
+	if value == nil {
+		return DefaultBalanceWeight
+	}
+	return *value
+}
+
+func configPresharedKey(value *NoiseSymmetricKey) NoiseSymmetricKey {
+	if value == nil {
+		return NoiseSymmetricKey{}
+	}
+	return *value
+}
+
+func configUint16(value *uint16) uint16 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+func configUint64(value *uint64) uint64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// configSeconds returns the duration in seconds, as set by the UAPI,
+// zero for none.
+func configSeconds(value *time.Duration) int64 {
+	if value == nil {
+		return 0
+	}
+	return int64(*value / time.Second)
+}
+
+// configExpiry returns the expiry at in seconds, as set by the UAPI,
+// zero for none.
+func configExpiry(at *time.Time) int64 {
+	if at == nil || at.IsZero() {
+		return 0
+	}
+	return at.Unix()
+}
+
+// configEphemeral returns the ephemeral timeout in seconds, as set by
+// the UAPI, zero for a permanent peer.
+func configEphemeral(timeout *time.Duration) int64 {
+	if timeout == nil {
+		return 0
+	}
+	return int64(*timeout / time.Second)
+}
+
+func relayRuleNames(rules []RelayRule) []string {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.String()
+	}
+	return names
+}
+
+// samePrefixes reports whether a and b hold the same networks.
+func samePrefixes(a, b []net.IPNet) bool {
+	canonical := func(prefixes []net.IPNet) []string {
+		names := make([]string, len(prefixes))
+		for i, prefix := range prefixes {
+			names[i] = (&net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}).String()
+		}
+		return names
+	}
+	return sameStrings(canonical(a), canonical(b))
+}
+
+// sameStrings reports whether a and b hold the same strings, regardless
+// of their order and duplicates.
+func sameStrings(a, b []string) bool {
+	set := func(values []string) []string {
+		sorted := append([]string(nil), values...)
+		sort.Strings(sorted)
+		unique := sorted[:0]
+		for _, s := range sorted {
+			if len(unique) == 0 || s != unique[len(unique)-1] {
+				unique = append(unique, s)
+			}
+		}
+		return unique
+	}
+	a, b = set(a), set(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	dev := pair[0].dev
+	pk := pair[1].key.publicKey()
+	session := dev.LookupPeer(pk).keypairs.Current()
+	if session == nil {
+		t.Fatal("no session established")
+	}
+
+	other, err := newPrivateKey()
+	assertNil(t, err)
+	keepalive := uint16(25)
+	_, network, _ := net.ParseCIDR("1.0.0.2/32")
+	_, otherNetwork, _ := net.ParseCIDR("10.0.0.0/8")
+	desired := &DeviceConfig{
+		Peers: []PeerConfig{
+			{PublicKey: pk, PersistentKeepaliveInterval: &keepalive, AllowedIPs: []net.IPNet{*network}},
+			{PublicKey: other.publicKey(), AllowedIPs: []net.IPNet{*otherNetwork}},
+		},
+	}
+
+	diff, err := dev.ApplyConfig(desired, ReconcileOptions{DryRun: true})
+	assertNil(t, err)
+	if len(diff.Peers) != 2 || dev.LookupPeer(other.publicKey()) != nil {
+		t.Fatalf("dry run applied %q", diff.UAPI())
+	}
+
+	diff, err = dev.ApplyConfig(desired, ReconcileOptions{})
+	assertNil(t, err)
+	want := "public_key=" + pk.ToHex() + "\nupdate_only=true\npersistent_keepalive_interval=25\n" +
+		"public_key=" + other.publicKey().ToHex() + "\nallowed_ip=10.0.0.0/8\n"
+	if got := diff.UAPI(); got != want {
+		t.Errorf("applied:\n%s\nwant:\n%s", got, want)
+	}
+	if dev.LookupPeer(pk).keypairs.Current() != session {
+		t.Error("the session of the unchanged peer was dropped")
+	}
+
+	diff, err = dev.ApplyConfig(desired, ReconcileOptions{})
+	assertNil(t, err)
+	if got := diff.UAPI(); got != "" {
+		t.Errorf("reapplying applied:\n%s", got)
+	}
+
+	// peers missing from the desired configuration are removed, unless
+	// they are to be kept
+
+	only := &DeviceConfig{Peers: desired.Peers[1:]}
+	_, err = dev.ApplyConfig(only, ReconcileOptions{KeepUnlistedPeers: true})
+	assertNil(t, err)
+	if dev.LookupPeer(pk) == nil {
+		t.Error("unlisted peer removed")
+	}
+	_, err = dev.ApplyConfig(only, ReconcileOptions{})
+	assertNil(t, err)
+	if dev.LookupPeer(pk) != nil {
+		t.Error("unlisted peer kept")
+	}
+
+	if records := dev.AuditLog(); len(records) == 0 || records[len(records)-1].Changes[0].Key != "public_key" {
+		t.Errorf("reconciliation not audited: %v", records)
+	}
+}
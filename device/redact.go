@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+/* Redaction of logs
+ *
+ * Operators shipping logs off-box may keep public keys and endpoints,
+ * which tell who talks to whom and from where, out of them. Each is
+ * logged verbatim, truncated or hashed, independently of the other:
+ *
+ *   truncated keys keep their first and last four characters, as
+ *   peers have always been logged, truncated endpoints only their /24
+ *   or /48 network and no port
+ *
+ *   hashed keys and endpoints are replaced by a keyed hash, so that
+ *   lines about the same one still correlate, yet the small space of
+ *   addresses cannot be searched for the original without the salt
+ *
+ * Every line naming a peer, through its String method, or an endpoint
+ * goes through the redaction set by SetLogRedaction.
+ */
+
+type Redaction int
+
+const (
+	RedactDefault  Redaction = iota // keys truncated, endpoints verbatim
+	RedactVerbatim                  // logged as is
+	RedactTruncate                  // logged in part
+	RedactHash                      // logged as a keyed hash
+)
+
+func (r Redaction) String() string {
+	switch r {
+	case RedactDefault:
+		return "default"
+	case RedactVerbatim:
+		return "verbatim"
+	case RedactTruncate:
+		return "truncate"
+	case RedactHash:
+		return "hash"
+	default:
+		return fmt.Sprintf("Redaction(UNKNOWN:%d)", int(r))
+	}
+}
+
+// ParseRedaction parses the name of a redaction, as returned by its
+// String method.
+func ParseRedaction(s string) (Redaction, error) {
+	for r := RedactDefault; r <= RedactHash; r++ {
+		if r.String() == s {
+			return r, nil
+		}
+	}
+	return RedactDefault, fmt.Errorf("%w: redaction %q", ErrInvalidValue, s)
+}
+
+// LogRedaction controls how public keys and endpoints appear in logs.
+type LogRedaction struct {
+	Keys      Redaction
+	Endpoints Redaction
+
+	// Salt keys the hashes, so that they correlate across restarts
+	// sharing it. Random for every device if empty.
+	Salt []byte
+}
+
+// SetLogRedaction sets how public keys and endpoints appear in the
+// lines the device logs from now on.
+func (device *Device) SetLogRedaction(redaction LogRedaction) error {
+	for _, r := range []Redaction{redaction.Keys, redaction.Endpoints} {
+		if r < RedactDefault || r > RedactHash {
+			return fmt.Errorf("%w: redaction %v", ErrInvalidValue, r)
+		}
+	}
+	if len(redaction.Salt) == 0 {
+		redaction.Salt = make([]byte, blake2s.Size)
+		if _, err := rand.Read(redaction.Salt); err != nil {
+			return err
+		}
+	} else if len(redaction.Salt) > blake2s.Size {
+		salt := blake2s.Sum256(redaction.Salt)
+		redaction.Salt = salt[:]
+	} else {
+		redaction.Salt = append([]byte(nil), redaction.Salt...)
+	}
+	device.logRedaction.Store(&redaction)
+	return nil
+}
+
+// LogRedaction returns the redaction set by SetLogRedaction, without
+// the salt.
+func (device *Device) LogRedaction() LogRedaction {
+	redaction, _ := device.logRedaction.Load().(*LogRedaction)
+	if redaction == nil {
+		return LogRedaction{}
+	}
+	return LogRedaction{Keys: redaction.Keys, Endpoints: redaction.Endpoints}
+}
+
+// redactKey returns pk as it appears in logs.
+func (device *Device) redactKey(pk NoisePublicKey) string {
+	redaction, _ := device.logRedaction.Load().(*LogRedaction)
+	r := RedactDefault
+	if redaction != nil {
+		r = redaction.Keys
+	}
+	switch r {
+	case RedactVerbatim:
+		return base64.StdEncoding.EncodeToString(pk[:])
+	case RedactHash:
+		return redactedHash(redaction.Salt, pk[:])
+	default:
+		base64Key := base64.StdEncoding.EncodeToString(pk[:])
+		return base64Key[0:4] + "…" + base64Key[39:43]
+	}
+}
+
+// redactEndpoint returns endpoint, a host:port or a bare host, as it
+// appears in logs.
+func (device *Device) redactEndpoint(endpoint string) string {
+	redaction, _ := device.logRedaction.Load().(*LogRedaction)
+	r := RedactDefault
+	if redaction != nil {
+		r = redaction.Endpoints
+	}
+	switch r {
+	case RedactTruncate:
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			host = endpoint
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			network := net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}
+			if ip4 := ip.To4(); ip4 != nil {
+				network = net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+			}
+			return network.String()
+		}
+		if len(host) > 4 {
+			return host[:4] + "…"
+		}
+		return host
+	case RedactHash:
+		return redactedHash(redaction.Salt, []byte(endpoint))
+	default:
+		return endpoint
+	}
+}
+
+func redactedHash(salt, data []byte) string {
+	mac, _ := blake2s.New128(salt)
+	mac.Write(data)
+	return "#" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	var pk NoisePublicKey
+	for i := range pk {
+		pk[i] = byte(i)
+	}
+	full := base64.StdEncoding.EncodeToString(pk[:])
+	truncated := full[:4] + "…" + full[39:43]
+
+	device := new(Device)
+	if got := device.redactKey(pk); got != truncated {
+		t.Errorf("default key = %q, want %q", got, truncated)
+	}
+	if got := device.redactEndpoint("192.0.2.1:51820"); got != "192.0.2.1:51820" {
+		t.Errorf("default endpoint = %q", got)
+	}
+
+	assertNil(t, device.SetLogRedaction(LogRedaction{Keys: RedactVerbatim, Endpoints: RedactTruncate}))
+	if got := device.redactKey(pk); got != full {
+		t.Errorf("verbatim key = %q, want %q", got, full)
+	}
+	for endpoint, want := range map[string]string{
+		"192.0.2.1:51820":         "192.0.2.0/24",
+		"[2001:db8:1:2::1]:51820": "2001:db8:1::/48",
+		"2001:db8:1:2::1":         "2001:db8:1::/48",
+		"vpn.example.com:51820":   "vpn.…",
+		"vpn:51820":               "vpn",
+	} {
+		if got := device.redactEndpoint(endpoint); got != want {
+			t.Errorf("truncated endpoint %q = %q, want %q", endpoint, got, want)
+		}
+	}
+
+	assertNil(t, device.SetLogRedaction(LogRedaction{Keys: RedactHash, Endpoints: RedactHash, Salt: []byte("salt")}))
+	key, endpoint := device.redactKey(pk), device.redactEndpoint("192.0.2.1:51820")
+	if !strings.HasPrefix(key, "#") || strings.Contains(key, full[:4]) {
+		t.Errorf("hashed key = %q", key)
+	}
+	if !strings.HasPrefix(endpoint, "#") || strings.Contains(endpoint, "192") {
+		t.Errorf("hashed endpoint = %q", endpoint)
+	}
+	if got := device.redactEndpoint("192.0.2.2:51820"); got == endpoint {
+		t.Errorf("distinct endpoints hash alike: %q", got)
+	}
+
+	// hashes correlate across devices sharing the salt only
+
+	other := new(Device)
+	assertNil(t, other.SetLogRedaction(LogRedaction{Keys: RedactHash, Salt: []byte("salt")}))
+	if got := other.redactKey(pk); got != key {
+		t.Errorf("key hashed with the same salt = %q, want %q", got, key)
+	}
+	assertNil(t, other.SetLogRedaction(LogRedaction{Keys: RedactHash}))
+	if got := other.redactKey(pk); got == key {
+		t.Errorf("key hashed with a random salt = %q, same as with the set salt", got)
+	}
+	if got := other.LogRedaction(); got.Keys != RedactHash || got.Salt != nil {
+		t.Errorf("LogRedaction() = %+v", got)
+	}
+
+	if err := device.SetLogRedaction(LogRedaction{Keys: RedactHash + 1}); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("invalid redaction: %v", err)
+	}
+	for r := RedactDefault; r <= RedactHash; r++ {
+		if parsed, err := ParseRedaction(r.String()); err != nil || parsed != r {
+			t.Errorf("ParseRedaction(%q) = %v, %v", r.String(), parsed, err)
+		}
+	}
+	if _, err := ParseRedaction("scramble"); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("ParseRedaction(scramble): %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Relay mode turns the device into a hub between its peers
+ *
+ * A packet from one peer destined to the allowed IPs of another is
+ * encrypted again for the other peer right away, in the buffer it was
+ * decrypted in, rather than written to the TUN device only to be read
+ * back after routing by the kernel. Packets are forwarded unchanged,
+ * the TTL is left alone as on a switch, unless relay rules reflect
+ * their addresses, see SetRelayRules. Packets for addresses of no peer
+ * still go to the TUN device.
+ */
+
+// SetRelay enables or disables forwarding packets between peers.
+func (device *Device) SetRelay(enabled bool) {
+	device.relay.Set(enabled)
+}
+
+// Relay reports whether packets are forwarded between peers.
+func (device *Device) Relay() bool {
+	return device.relay.Get()
+}
+
+// relay forwards elem, a packet received from peer, to the peer owning
+// its destination address, reporting whether it took the packet, which
+// is dropped if the relay rules deny it. Once forwarded, the message
+// buffer of elem belongs to the forwarded packet, and elem is marked
+// dropped, so that the buffer is not returned to the pool.
+func (peer *Peer) relay(elem *QueueInboundElement) bool {
+	device := peer.device
+	if !device.relay.Get() {
+		return false
+	}
+
+	var src, dst []byte
+	lookup := device.allowedips.LookupIPv4
+	switch elem.packet[0] >> 4 {
+	case ipv4.Version:
+		src = elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		dst = elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+	case ipv6.Version:
+		src = elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		dst = elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		lookup = device.allowedips.LookupIPv6
+	default:
+		return false
+	}
+
+	rules, _ := device.relayRules.Load().(*relayRules)
+	var reflectedDst net.IP
+	var reflected *relayPair
+	if rules != nil {
+		reflectedDst, reflected = rules.reflectedDestination(peer, dst)
+	}
+	var target *Peer
+	if reflected != nil {
+		target = lookup(reflectedDst)
+		if target == nil || target.handshake.remoteStatic != reflected.rule.B {
+			return false
+		}
+	} else {
+		target = device.route(elem.packet, dst)
+	}
+	if target == nil || target == peer {
+		return false
+	}
+	if target.quota.exceeded.Get() {
+		device.dropped(DropOverQuota, target, elem.packet)
+		return true
+	}
+	if len(elem.packet) > maxSentContentSize {
+		return true
+	}
+
+	// enforce the relay rules, reflecting addresses
+
+	if rules != nil {
+		direction, ok := rules.directions[[2]NoisePublicKey{peer.handshake.remoteStatic, target.handshake.remoteStatic}]
+		if !ok {
+			atomic.AddUint64(&peer.stats.relayDenied, 1)
+			return true
+		}
+		pair := direction.pair
+		if reflected != nil {
+			rewriteAddress(elem.packet, dst, reflectedDst)
+		} else if reflect := pair.rule.Reflect; reflect != nil && !direction.toB && len(src) == len(reflect.Real.IP) && reflect.Real.Contains(src) {
+			rewriteAddress(elem.packet, src, mapNetwork(src, reflect.Real, reflect.Virtual))
+		}
+		counters := pair.counters[:2]
+		if !direction.toB {
+			counters = pair.counters[2:]
+		}
+		atomic.AddUint64(&counters[0], 1)
+		atomic.AddUint64(&counters[1], uint64(len(elem.packet)))
+	}
+
+	if device.mssClamping.Get() {
+		clampMSS(elem.packet, target.MTU())
+	}
+
+	// the content of outbound messages starts after the headroom for
+	// obfuscation, further into the buffer than that of inbound messages
+
+	offset := MaxObfuscationOverhead + MessageTransportHeaderSize
+	out := device.newOutboundElement(elem.buffer)
+	out.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], elem.packet)]
+	out.flow = device.flowPort(out.packet)
+	out.high = device.priority(out.packet) == PriorityHigh
+	elem.Drop()
+	atomic.AddUint64(&peer.stats.relayedPackets, 1)
+
+	target.queue.RLock()
+	if target.isRunning.Get() {
+		if target.queue.packetInNonceQueueIsAwaitingKey.Get() {
+			target.SendHandshakeInitiation(false)
+		}
+		target.addToNonceQueue(out)
+		out = nil
+	}
+	target.queue.RUnlock()
+
+	if out != nil {
+		device.PutMessageBuffer(out.buffer)
+		device.PutOutboundElement(out)
+	}
+	return true
+}
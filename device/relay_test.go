@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type relayNode struct {
+	dev  *Device
+	tun  *tuntest.ChannelTUN
+	key  NoisePrivateKey
+	port string
+	addr net.IP
+}
+
+// newRelayHub returns a hub at 10.0.0.1 in relay mode and spokes at
+// 10.0.0.2 onwards, reaching 10.0.0.0/8 through the hub. The caller
+// closes the devices.
+func newRelayHub(t *testing.T, spokes int) (*relayNode, []*relayNode) {
+	nodes := make([]*relayNode, spokes+1)
+	for i := range nodes {
+		n := &relayNode{port: getFreePort(t), addr: net.IPv4(10, 0, 0, byte(i+1))}
+		var err error
+		n.key, err = newPrivateKey()
+		assertNil(t, err)
+		n.tun = tuntest.NewChannelTUN()
+		n.dev = NewDevice(n.tun.TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i)))
+		nodes[i] = n
+	}
+	peerConfig := func(n *relayNode, allowed string) string {
+		return fmt.Sprintf("public_key=%s\nprotocol_version=1\nallowed_ip=%s\nendpoint=127.0.0.1:%s\n", n.key.publicKey().ToHex(), allowed, n.port)
+	}
+	hub := nodes[0]
+	config := fmt.Sprintf("private_key=%s\nlisten_port=%s\nrelay=true\n", hub.key.ToHex(), hub.port)
+	for _, n := range nodes[1:] {
+		config += peerConfig(n, n.addr.String()+"/32")
+		assertNil(t, n.dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%s\n", n.key.ToHex(), n.port)+peerConfig(hub, "10.0.0.0/8")))
+	}
+	assertNil(t, hub.dev.IpcSet(config))
+	for _, n := range nodes {
+		n.dev.Up()
+	}
+	return hub, nodes[1:]
+}
+
+func TestRelay(t *testing.T) {
+	hub, spokes := newRelayHub(t, 2)
+	a, b := spokes[0], spokes[1]
+	defer hub.dev.Close()
+	defer a.dev.Close()
+	defer b.dev.Close()
+
+	if !hub.dev.Relay() {
+		t.Fatal("relay mode not enabled by UAPI")
+	}
+
+	// packets from a to b are forwarded by the hub, never reaching its TUN device
+
+	for i := 0; i < 3; i++ {
+		ping := tuntest.Ping(b.addr, a.addr)
+		a.tun.Outbound <- ping
+		select {
+		case received := <-b.tun.Inbound:
+			if !bytes.Equal(received, ping) {
+				t.Fatalf("relayed packet %d modified", i)
+			}
+		case received := <-hub.tun.Inbound:
+			t.Fatalf("packet %d for another peer written to the TUN device of the hub: %x", i, received)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not relayed", i)
+		}
+	}
+	if stats, _ := hub.dev.PeerStats(a.key.publicKey()); stats.RelayedPackets != 3 {
+		t.Errorf("RelayedPackets = %d, want 3", stats.RelayedPackets)
+	}
+
+	// packets for the hub itself still go to its TUN device
+
+	ping := tuntest.Ping(hub.addr, a.addr)
+	a.tun.Outbound <- ping
+	select {
+	case received := <-hub.tun.Inbound:
+		if !bytes.Equal(received, ping) {
+			t.Fatal("packet for the hub modified")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet for the hub not received")
+	}
+
+	// without relay mode, packets for other peers go to the TUN device
+
+	hub.dev.SetRelay(false)
+	ping = tuntest.Ping(b.addr, a.addr)
+	a.tun.Outbound <- ping
+	select {
+	case <-hub.tun.Inbound:
+	case <-b.tun.Inbound:
+		t.Fatal("packet relayed with relay mode disabled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not received by the hub")
+	}
+}
+
+// sum is the internet checksum of b, which is zero across a header
+// including a valid checksum.
+func sum(b []byte, initial uint32) uint16 {
+	acc := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		acc += uint32(b[len(b)-1]) << 8
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return ^uint16(acc)
+}
+
+// ping returns tuntest.Ping with a valid IPv4 header checksum, which
+// rewriting addresses keeps valid.
+func ping(dst, src net.IP) []byte {
+	packet := tuntest.Ping(dst, src)
+	binary.BigEndian.PutUint16(packet[ipv4offsetChecksum:], 0)
+	binary.BigEndian.PutUint16(packet[ipv4offsetChecksum:], sum(packet[:20], 0))
+	return packet
+}
+
+func TestRewriteAddress(t *testing.T) {
+	// pseudoSum sums the pseudo header the transport checksum covers
+	pseudoSum := func(src, dst net.IP, protocol byte, length int) uint32 {
+		pseudo := append(append([]byte(nil), src...), dst...)
+		pseudo = append(pseudo, 0, protocol, byte(length>>8), byte(length))
+		return uint32(^sum(pseudo, 0))
+	}
+
+	for _, test := range []struct {
+		name     string
+		header   int
+		protocol byte
+		src, dst net.IP
+	}{
+		{"udp4", 20, protocolUDP, net.IPv4(10, 1, 0, 3).To4(), net.IPv4(10, 0, 0, 2).To4()},
+		{"tcp6", 40, protocolTCP, net.ParseIP("fd00:1::3"), net.ParseIP("fd00::2")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			transport := make([]byte, 25)
+			if test.protocol == protocolTCP {
+				transport[12] = 5 << 4 // data offset
+			} else {
+				binary.BigEndian.PutUint16(transport[4:], uint16(len(transport)))
+			}
+			copy(transport[20:], "hello")
+
+			packet := make([]byte, test.header, test.header+len(transport))
+			src, dst := IPv4offsetSrc, IPv4offsetDst
+			if test.header == 20 {
+				packet[0] = 0x45
+				binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(test.header+len(transport)))
+				packet[ipv4offsetProtocol] = test.protocol
+			} else {
+				packet[0] = 6 << 4
+				binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(len(transport)))
+				packet[ipv6offsetNext] = test.protocol
+				src, dst = IPv6offsetSrc, IPv6offsetDst
+			}
+			copy(packet[src:], test.src)
+			copy(packet[dst:], test.dst)
+			if test.header == 20 {
+				binary.BigEndian.PutUint16(packet[ipv4offsetChecksum:], sum(packet, 0))
+			}
+			packet = append(packet, transport...)
+			offset, _ := transportChecksum(packet)
+			binary.BigEndian.PutUint16(packet[offset:], sum(packet[test.header:], pseudoSum(test.src, test.dst, test.protocol, len(transport))))
+
+			mapped := mapNetwork(test.src, net.IPNet{IP: test.src, Mask: net.CIDRMask(len(test.src)*8-8, len(test.src)*8)},
+				net.IPNet{IP: test.dst, Mask: net.CIDRMask(len(test.src)*8-8, len(test.src)*8)})
+			rewriteAddress(packet, packet[src:src+len(test.src)], mapped)
+
+			if !net.IP(packet[src : src+len(mapped)]).Equal(mapped) {
+				t.Fatalf("source %v, want %v", net.IP(packet[src:src+len(mapped)]), mapped)
+			}
+			if test.header == 20 && sum(packet[:test.header], 0) != 0 {
+				t.Error("invalid IPv4 header checksum after rewriting")
+			}
+			if sum(packet[test.header:], pseudoSum(mapped, test.dst, test.protocol, len(transport))) != 0 {
+				t.Error("invalid transport checksum after rewriting")
+			}
+		})
+	}
+}
+
+func TestRelayRules(t *testing.T) {
+	hub, spokes := newRelayHub(t, 3)
+	a, b, c := spokes[0], spokes[1], spokes[2]
+	defer hub.dev.Close()
+	defer a.dev.Close()
+	defer b.dev.Close()
+	defer c.dev.Close()
+
+	// a reaches b as 10.1.0.3, c may not reach b at all
+
+	_, virtual, _ := net.ParseCIDR("10.1.0.0/24")
+	_, real, _ := net.ParseCIDR("10.0.0.0/24")
+	assertNil(t, hub.dev.IpcSet(fmt.Sprintf("relay_rule=%s,%s,%s,%s\n", a.key.publicKey().ToHex(), b.key.publicKey().ToHex(), virtual, real)))
+	if rules := hub.dev.RelayRules(); len(rules) != 1 || rules[0].Reflect == nil || rules[0].Reflect.Virtual.String() != "10.1.0.0/24" {
+		t.Fatalf("RelayRules() = %v", rules)
+	}
+
+	config, err := hub.dev.IpcGetConfig()
+	assertNil(t, err)
+	if len(config.RelayRules) != 1 || config.RelayRules[0].String() != hub.dev.RelayRules()[0].String() {
+		t.Fatalf("IpcGetConfig() relay rules %v", config.RelayRules)
+	}
+
+	expect := func(to *relayNode, src, dst net.IP) {
+		t.Helper()
+		select {
+		case packet := <-to.tun.Inbound:
+			if !bytes.Equal(packet, ping(dst, src)) {
+				t.Fatalf("received %v -> %v, want %v -> %v", net.IP(packet[IPv4offsetSrc:IPv4offsetDst]), net.IP(packet[IPv4offsetDst:IPv4offsetDst+4]), src, dst)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no packet %v -> %v", src, dst)
+		}
+	}
+	reflected := net.IPv4(10, 1, 0, 3)
+	a.tun.Outbound <- ping(reflected, a.addr)
+	expect(b, a.addr, b.addr)
+	b.tun.Outbound <- ping(a.addr, b.addr)
+	expect(a, reflected, a.addr)
+
+	c.tun.Outbound <- ping(b.addr, c.addr)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if stats, _ := hub.dev.PeerStats(c.key.publicKey()); stats.RelayDenied == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("packet from c to b not denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-b.tun.Inbound:
+		t.Fatal("packet from c relayed to b")
+	case <-hub.tun.Inbound:
+		t.Fatal("denied packet written to the TUN device of the hub")
+	default:
+	}
+
+	stats := hub.dev.RelayStats()
+	if len(stats) != 1 || stats[0].PacketsToB != 1 || stats[0].PacketsToA != 1 || stats[0].BytesToB == 0 {
+		t.Errorf("RelayStats() = %+v", stats)
+	}
+
+	// replacing the rules keeps the counters
+
+	assertNil(t, hub.dev.SetRelayRules(append(hub.dev.RelayRules(), RelayRule{A: c.key.publicKey(), B: b.key.publicKey()})))
+	if stats := hub.dev.RelayStats(); len(stats) != 2 || stats[0].PacketsToB != 1 {
+		t.Errorf("RelayStats() = %+v after adding a rule", stats)
+	}
+	c.tun.Outbound <- ping(b.addr, c.addr)
+	expect(b, c.addr, b.addr)
+
+	if _, err := ParseRelayRule(a.key.publicKey().ToHex() + "," + a.key.publicKey().ToHex()); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("rule between a peer and itself parsed, error %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+/* Relay rules enforce the traffic policy between spokes of a hub
+ *
+ * Without rules, packets are relayed between any two peers. Once rules
+ * are set, only packets between pairs of peers with a rule are, those
+ * between other pairs being dropped and counted as RelayDenied. A rule
+ * may reflect the network of one peer to the other under different
+ * addresses, as 1:1 NAT, so that spokes whose networks overlap can
+ * still reach each other through the hub.
+ */
+
+// RelayReflection makes the addresses in Real, the network of the
+// second peer of a rule, reachable by the first peer as the addresses
+// with the same host part in Virtual.
+type RelayReflection struct {
+	Virtual net.IPNet
+	Real    net.IPNet
+}
+
+// RelayRule allows packets to be relayed between peers A and B, both ways.
+type RelayRule struct {
+	A, B    NoisePublicKey
+	Reflect *RelayReflection // nil if the addresses are kept
+}
+
+// RelayPairStats counts the packets relayed between the peers of a rule.
+type RelayPairStats struct {
+	A, B       NoisePublicKey
+	PacketsToB uint64
+	BytesToB   uint64
+	PacketsToA uint64
+	BytesToA   uint64
+}
+
+type relayPair struct {
+	counters [4]uint64 // packets and bytes to B, then to A, accessed atomically
+	rule     RelayRule
+}
+
+type relayDirection struct {
+	pair *relayPair
+	toB  bool
+}
+
+// relayRules is stored in Device.relayRules, which is read without
+// locks on the receive path, and replaced as a whole.
+type relayRules struct {
+	pairs       []*relayPair
+	directions  map[[2]NoisePublicKey]relayDirection // by sender and target
+	reflections map[NoisePublicKey][]*relayPair      // rules reflecting addresses, by A
+}
+
+// String returns rule in the format of the UAPI key relay_rule,
+// the public keys of the peers followed by the networks reflected.
+func (rule RelayRule) String() string {
+	s := rule.A.ToHex() + "," + rule.B.ToHex()
+	if rule.Reflect != nil {
+		s += "," + rule.Reflect.Virtual.String() + "," + rule.Reflect.Real.String()
+	}
+	return s
+}
+
+func (rule RelayRule) validate() error {
+	if rule.A.Equals(rule.B) {
+		return fmt.Errorf("%w: relay rule between a peer and itself", ErrInvalidValue)
+	}
+	if reflect := rule.Reflect; reflect != nil {
+		virtualOnes, virtualBits := reflect.Virtual.Mask.Size()
+		realOnes, realBits := reflect.Real.Mask.Size()
+		if virtualBits == 0 || virtualOnes != realOnes || virtualBits != realBits ||
+			len(reflect.Virtual.IP) != len(reflect.Virtual.Mask) || len(reflect.Real.IP) != len(reflect.Real.Mask) {
+			return fmt.Errorf("%w: reflection of %v as %v", ErrInvalidValue, reflect.Real.String(), reflect.Virtual.String())
+		}
+	}
+	return nil
+}
+
+// ParseRelayRule parses a rule in the format of RelayRule.String.
+func ParseRelayRule(s string) (RelayRule, error) {
+	var rule RelayRule
+	fields := strings.Split(s, ",")
+	if len(fields) != 2 && len(fields) != 4 {
+		return rule, fmt.Errorf("%w: relay rule %q", ErrInvalidValue, s)
+	}
+	if err := rule.A.FromHex(fields[0]); err != nil {
+		return rule, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if err := rule.B.FromHex(fields[1]); err != nil {
+		return rule, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(fields) == 4 {
+		rule.Reflect = new(RelayReflection)
+		for i, network := range []*net.IPNet{&rule.Reflect.Virtual, &rule.Reflect.Real} {
+			_, parsed, err := net.ParseCIDR(fields[2+i])
+			if err != nil {
+				return rule, fmt.Errorf("%w: %v", ErrInvalidAllowedIP, err)
+			}
+			if ip4 := parsed.IP.To4(); ip4 != nil {
+				parsed.IP = ip4
+			}
+			*network = *parsed
+		}
+	}
+	return rule, rule.validate()
+}
+
+// SetRelayRules replaces the rules packets are relayed between peers by,
+// relaying between any two peers if there are none. The counters of
+// pairs with a rule before and after are kept.
+func (device *Device) SetRelayRules(rules []RelayRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	device.relayRulesLock.Lock()
+	defer device.relayRulesLock.Unlock()
+
+	old, _ := device.relayRules.Load().(*relayRules)
+	if len(rules) == 0 {
+		device.relayRules.Store((*relayRules)(nil))
+		return nil
+	}
+
+	set := &relayRules{
+		directions:  make(map[[2]NoisePublicKey]relayDirection),
+		reflections: make(map[NoisePublicKey][]*relayPair),
+	}
+	for _, rule := range rules {
+		pair := &relayPair{rule: rule}
+		if old != nil {
+			if previous, ok := old.directions[[2]NoisePublicKey{rule.A, rule.B}]; ok && previous.toB {
+				for i := range pair.counters {
+					pair.counters[i] = atomic.LoadUint64(&previous.pair.counters[i])
+				}
+			}
+		}
+		set.pairs = append(set.pairs, pair)
+		set.directions[[2]NoisePublicKey{rule.A, rule.B}] = relayDirection{pair, true}
+		set.directions[[2]NoisePublicKey{rule.B, rule.A}] = relayDirection{pair, false}
+		if rule.Reflect != nil {
+			set.reflections[rule.A] = append(set.reflections[rule.A], pair)
+		}
+	}
+	device.relayRules.Store(set)
+	return nil
+}
+
+// RelayRules returns the rules set by SetRelayRules.
+func (device *Device) RelayRules() []RelayRule {
+	set, _ := device.relayRules.Load().(*relayRules)
+	if set == nil {
+		return nil
+	}
+	rules := make([]RelayRule, 0, len(set.pairs))
+	for _, pair := range set.pairs {
+		rules = append(rules, pair.rule)
+	}
+	return rules
+}
+
+// RelayStats returns the counters of the pairs of peers with a rule.
+func (device *Device) RelayStats() []RelayPairStats {
+	set, _ := device.relayRules.Load().(*relayRules)
+	if set == nil {
+		return nil
+	}
+	stats := make([]RelayPairStats, 0, len(set.pairs))
+	for _, pair := range set.pairs {
+		stats = append(stats, RelayPairStats{
+			A:          pair.rule.A,
+			B:          pair.rule.B,
+			PacketsToB: atomic.LoadUint64(&pair.counters[0]),
+			BytesToB:   atomic.LoadUint64(&pair.counters[1]),
+			PacketsToA: atomic.LoadUint64(&pair.counters[2]),
+			BytesToA:   atomic.LoadUint64(&pair.counters[3]),
+		})
+	}
+	return stats
+}
+
+// mapNetwork returns the address in to with the host part of ip in from.
+func mapNetwork(ip net.IP, from, to net.IPNet) net.IP {
+	mapped := make(net.IP, len(to.IP))
+	for i := range mapped {
+		mapped[i] = to.IP[i]&to.Mask[i] | ip[i]&^from.Mask[i]
+	}
+	return mapped
+}
+
+// reflectedDestination returns the address dst, sent to by peer, is
+// reflected to by a rule, nil if none applies.
+func (set *relayRules) reflectedDestination(peer *Peer, dst net.IP) (net.IP, *relayPair) {
+	for _, pair := range set.reflections[peer.handshake.remoteStatic] {
+		if len(dst) == len(pair.rule.Reflect.Virtual.IP) && pair.rule.Reflect.Virtual.Contains(dst) {
+			return mapNetwork(dst, pair.rule.Reflect.Virtual, pair.rule.Reflect.Real), pair
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+/* Responder-only peers are never sent a handshake initiation, for
+ * servers which must not dial out through restrictive egress policies,
+ * or to keep both sides of a pair from initiating at once. The peer
+ * itself has to initiate: packets to it wait for a session it started,
+ * and sessions expire unless it renews them, as the strict profile or
+ * outgoing traffic on its side make it do.
+ */
+
+// SetResponderOnly keeps the device from initiating handshakes with
+// peer, or lets it again.
+func (peer *Peer) SetResponderOnly(responderOnly bool) {
+	if peer.responderOnly.Swap(responderOnly) == responderOnly {
+		return
+	}
+	if responderOnly {
+		peer.log.Info.Println(peer, "- Only responding to handshakes")
+		if peer.timersActive() {
+			peer.timers.retransmitHandshake.Del()
+		}
+		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	} else {
+		peer.log.Info.Println(peer, "- Initiating handshakes again")
+	}
+}
+
+// ResponderOnly reports whether the device never initiates handshakes
+// with peer.
+func (peer *Peer) ResponderOnly() bool {
+	return peer.responderOnly.Get()
+}
+
+// SetPeerResponderOnly sets whether the device initiates handshakes
+// with the peer with public key pk, see Peer.SetResponderOnly.
+func (device *Device) SetPeerResponderOnly(pk NoisePublicKey, responderOnly bool) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetResponderOnly(responderOnly)
+	return nil
+}
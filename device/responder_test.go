@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestResponderOnly(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+
+	pk := pair[1].key.publicKey()
+	assertNil(t, pair[0].dev.IpcSet("public_key="+pk.ToHex()+"\nupdate_only=true\nresponder_only=true\n"))
+	config, err := pair[0].dev.IpcGetConfig()
+	assertNil(t, err)
+	if peer := config.Peers[0]; peer.ResponderOnly == nil || !*peer.ResponderOnly {
+		t.Errorf("responder-only peer reported as %+v", peer)
+	}
+
+	// without sessions, the device waits for the peer to initiate
+
+	peer := pair[0].dev.LookupPeer(pk)
+	peer.ZeroAndFlushAll()
+	assertNil(t, peer.SendHandshakeInitiation(false))
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].addr, pair[0].addr)
+	select {
+	case <-pair[1].tun.Inbound:
+		t.Fatal("packet sent without a session")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if status := peer.HandshakeStatus(); status.State == HandshakeInitiationSent {
+		t.Fatalf("handshake initiated with a responder-only peer: %+v", status)
+	}
+
+	// once the peer initiated, traffic flows both ways
+
+	remote := pair[1].dev.LookupPeer(pair[0].key.publicKey())
+	remote.ExpireSessions()
+	for deadline := time.Now().Add(5 * time.Second); remote.keypairs.Current() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("peer did not complete its handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, dir := range [][2]int{{1, 0}, {0, 1}} {
+		from, to := pair[dir[0]], pair[dir[1]]
+		from.tun.Outbound <- tuntest.Ping(to.addr, from.addr)
+		select {
+		case <-to.tun.Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ping %d not received", i)
+		}
+	}
+
+	var unknown NoisePublicKey
+	if err := pair[0].dev.SetPeerResponderOnly(unknown, false); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
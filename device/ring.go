@@ -0,0 +1,199 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/* Handoff to the sequential routines
+ *
+ * The elements of a peer are queued in order to a ring, which its
+ * sequential sender or receiver consumes, while the parallel workers
+ * encrypt or decrypt them out of order. The consumer takes the element
+ * at the head of the ring once its worker released it, and otherwise
+ * parks until the worker, or a routine queuing an element, wakes it.
+ * Neither releasing nor taking an element takes a lock, and a consumer
+ * is only woken if it parked, so that a busy pipeline synchronizes
+ * through a few atomic operations per packet.
+ *
+ * Routines queuing elements serialize on a mutex, as the inbound ring
+ * of a peer is fed by the receive routines of every bind.
+ *
+ * Once its consumer stopped, the elements left in a ring are flushed:
+ * those released are returned to the pools right away, and the others
+ * are abandoned to their workers, which return them once done. Either
+ * the worker releases an element or the flush abandons it, never both,
+ * so that every element finds its way back to the pools.
+ */
+
+// states of QueueElement.done
+const (
+	elementPending   = int32(iota) // being encrypted or decrypted
+	elementReleased                // handed to the consumer
+	elementAbandoned               // left to the worker by a stopped consumer
+)
+
+type orderedRing struct {
+	mutex    sync.Mutex // held by routines queuing elements
+	slots    []*QueueElement
+	mask     uint64
+	capacity uint64
+	head     uint64 // next slot taken by the consumer, accessed atomically
+	tail     uint64 // next slot filled, accessed atomically
+	closed   int32  // accessed atomically
+	parked   int32  // whether the consumer waits for a wake up, accessed atomically
+	wake     chan struct{}
+}
+
+func newOrderedRing(capacity int) *orderedRing {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+	return &orderedRing{
+		slots:    make([]*QueueElement, size),
+		mask:     uint64(size - 1),
+		capacity: uint64(capacity),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// len returns the number of elements in the ring.
+func (ring *orderedRing) len() int {
+	head := atomic.LoadUint64(&ring.head)
+	return int(atomic.LoadUint64(&ring.tail) - head)
+}
+
+func (ring *orderedRing) cap() int {
+	return int(ring.capacity)
+}
+
+// push queues elem, unreleased, failing if the ring is full or closed.
+func (ring *orderedRing) push(elem *QueueElement) bool {
+	ring.mutex.Lock()
+	tail := atomic.LoadUint64(&ring.tail)
+	if atomic.LoadInt32(&ring.closed) == AtomicTrue || tail-atomic.LoadUint64(&ring.head) >= ring.capacity {
+		ring.mutex.Unlock()
+		return false
+	}
+	elem.ring = ring
+	ring.slots[tail&ring.mask] = elem
+	atomic.StoreUint64(&ring.tail, tail+1)
+	ring.mutex.Unlock()
+	ring.unpark()
+	return true
+}
+
+// close ends the consumption of the ring once it is empty.
+func (ring *orderedRing) close() {
+	ring.mutex.Lock()
+	atomic.StoreInt32(&ring.closed, AtomicTrue)
+	ring.mutex.Unlock()
+	ring.unpark()
+}
+
+func (ring *orderedRing) unpark() {
+	if atomic.LoadInt32(&ring.parked) == AtomicTrue && atomic.CompareAndSwapInt32(&ring.parked, AtomicTrue, AtomicFalse) {
+		select {
+		case ring.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ready returns the element at the head if it is released, and whether
+// the consumer should stop waiting.
+func (ring *orderedRing) ready() (*QueueElement, bool) {
+	head := atomic.LoadUint64(&ring.head)
+	if head == atomic.LoadUint64(&ring.tail) {
+		return nil, atomic.LoadInt32(&ring.closed) == AtomicTrue
+	}
+	elem := ring.slots[head&ring.mask]
+	if atomic.LoadInt32(&elem.done) == elementPending {
+		return nil, false
+	}
+	ring.slots[head&ring.mask] = nil
+	atomic.StoreUint64(&ring.head, head+1)
+	return elem, true
+}
+
+// next returns the element at the head once released, or false if the
+// ring is closed and empty or stop is closed.
+//
+// Obs. Only called by the single consumer of the ring.
+func (ring *orderedRing) next(stop <-chan struct{}) (*QueueElement, bool) {
+	for {
+		elem, done := ring.ready()
+		if done {
+			return elem, elem != nil
+		}
+
+		// park, looking again after announcing it to not miss a wake up
+
+		atomic.StoreInt32(&ring.parked, AtomicTrue)
+		elem, done = ring.ready()
+		if done {
+			atomic.StoreInt32(&ring.parked, AtomicFalse)
+			return elem, elem != nil
+		}
+		select {
+		case <-ring.wake:
+		case <-stop:
+			return nil, false
+		}
+	}
+}
+
+// take returns the element at the head, released or not, or nil if the
+// ring is empty, for flushing it.
+//
+// Obs. Only called by the single consumer of the ring.
+func (ring *orderedRing) take() *QueueElement {
+	head := atomic.LoadUint64(&ring.head)
+	if head == atomic.LoadUint64(&ring.tail) {
+		return nil
+	}
+	elem := ring.slots[head&ring.mask]
+	ring.slots[head&ring.mask] = nil
+	atomic.StoreUint64(&ring.head, head+1)
+	return elem
+}
+
+// flush empties the ring once closed and its consumer stopped, handing
+// the released elements to free and abandoning the others.
+func (ring *orderedRing) flush(free func(*QueueElement)) {
+	for elem := ring.take(); elem != nil; elem = ring.take() {
+		if !elem.abandon() {
+			free(elem)
+		}
+	}
+}
+
+// release hands elem, done with by its worker, to the consumer of its
+// ring, failing if the consumer abandoned it: elem is then the
+// worker's to free.
+func (elem *QueueElement) release() bool {
+	ring := elem.ring // as the consumer may reuse elem once it is done
+	if !atomic.CompareAndSwapInt32(&elem.done, elementPending, elementReleased) {
+		return false
+	}
+	ring.unpark()
+	return true
+}
+
+// abandon leaves elem to its worker, failing if it was released
+// already: elem is then the caller's to free.
+func (elem *QueueElement) abandon() bool {
+	return atomic.CompareAndSwapInt32(&elem.done, elementPending, elementAbandoned)
+}
+
+// abandoned returns whether the consumer of elem stopped, so that its
+// worker can skip it.
+func (elem *QueueElement) abandoned() bool {
+	return atomic.LoadInt32(&elem.done) == elementAbandoned
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderedRing(t *testing.T) {
+	ring := newOrderedRing(3)
+	if ring.cap() != 3 || len(ring.slots) != 4 {
+		t.Fatalf("ring of capacity %d has %d slots", ring.cap(), len(ring.slots))
+	}
+	stop := make(chan struct{})
+
+	elems := make([]QueueElement, 4)
+	for i := range elems[:3] {
+		if !ring.push(&elems[i]) {
+			t.Fatalf("failed to push element %d", i)
+		}
+	}
+	if ring.push(&elems[3]) {
+		t.Error("pushed to a full ring")
+	}
+
+	// elements are taken in order, once released
+
+	taken := make(chan *QueueElement)
+	go func() {
+		for {
+			elem, ok := ring.next(stop)
+			if !ok {
+				close(taken)
+				return
+			}
+			taken <- elem
+		}
+	}()
+	elems[2].release()
+	elems[1].release()
+	select {
+	case elem := <-taken:
+		t.Fatalf("took %p before the head was released", elem)
+	case <-time.After(10 * time.Millisecond):
+	}
+	elems[0].release()
+	for i := range elems[:3] {
+		if elem := <-taken; elem != &elems[i] {
+			t.Fatalf("took %p, want element %d", elem, i)
+		}
+	}
+
+	// pushing wakes the consumer, and closing ends it once empty
+
+	elems[3].done = AtomicTrue
+	if !ring.push(&elems[3]) {
+		t.Fatal("failed to push to a drained ring")
+	}
+	if elem := <-taken; elem != &elems[3] {
+		t.Fatalf("took %p, want element 3", elem)
+	}
+	ring.close()
+	if _, ok := <-taken; ok {
+		t.Error("took an element from a closed ring")
+	}
+	if ring.push(&QueueElement{}) {
+		t.Error("pushed to a closed ring")
+	}
+}
+
+func TestOrderedRingConcurrent(t *testing.T) {
+	const count = 10000
+	ring := newOrderedRing(64)
+	work := make(chan *QueueElement, 64)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for elem := range work {
+				if rand.Intn(8) == 0 {
+					time.Sleep(time.Microsecond)
+				}
+				elem.release()
+			}
+		}()
+	}
+	go func() {
+		for i := uint64(0); i < count; {
+			elem := &QueueElement{nonce: i}
+			if !ring.push(elem) {
+				time.Sleep(time.Microsecond)
+				continue
+			}
+			work <- elem
+			i++
+		}
+		close(work)
+	}()
+
+	stop := make(chan struct{})
+	timeout := time.AfterFunc(10*time.Second, func() {
+		close(stop)
+	})
+	defer timeout.Stop()
+	for i := uint64(0); i < count; i++ {
+		elem, ok := ring.next(stop)
+		if !ok {
+			t.Fatalf("stopped waiting for element %d", i)
+		}
+		if elem.nonce != i {
+			t.Fatalf("took element %d, want %d", elem.nonce, i)
+		}
+	}
+}
+
+func BenchmarkOrderedRing(b *testing.B) {
+	ring := newOrderedRing(1024)
+	work := make(chan *QueueElement, 1024)
+	elems := make([]QueueElement, 2048)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for elem := range work {
+				elem.release()
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < b.N; i++ {
+			elem := &elems[i%len(elems)]
+			atomic.StoreInt32(&elem.done, AtomicFalse)
+			for !ring.push(elem) {
+				time.Sleep(time.Microsecond)
+			}
+			work <- elem
+		}
+		close(work)
+	}()
+	stop := make(chan struct{})
+	for i := 0; i < b.N; i++ {
+		ring.next(stop)
+	}
+}
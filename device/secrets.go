@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"unsafe"
+)
+
+/* Key material is zeroed as soon as it is no longer needed: the
+ * intermediate keys of handshakes once a message is created or
+ * consumed, the handshake state once a session is derived, the
+ * sessions, preshared key and precomputed secrets of a peer once it is
+ * removed, and the private key once the device is closed.
+ *
+ * The private key and the handshake secrets of every peer live in
+ * slots of a secretArena, pages of the device set apart for them, which
+ * are locked into memory with DeviceOptions.LockMemory so that they are
+ * never swapped out. The session keys inside the AEAD instances of the
+ * keypairs cannot be placed there and are left to the garbage
+ * collector, as are the copies the runtime makes when it grows stacks.
+ */
+
+// secretSlotSize is the size of the slots of a secretArena, large
+// enough for the secrets of a handshake or a private key.
+const secretSlotSize = unsafe.Sizeof(handshakeSecrets{})
+
+// secretPagesSize is the size of the pages a secretArena grows by.
+const secretPagesSize = 4096
+
+// A secretArena hands out slots holding key material from pages of its
+// own. Freed slots are zeroed and reused, never returned to the
+// runtime, so that key material is never copied by the allocator.
+type secretArena struct {
+	sync.Mutex
+	lock   bool             // pages are locked into memory, see DeviceOptions.LockMemory
+	locked bool             // all pages are locked
+	pages  [][]byte         // never released, as slots may be referenced until freed
+	free   []unsafe.Pointer // zeroed slots
+	inUse  int
+}
+
+// grow adds pages of slots to the free slots, falling back to unlocked
+// pages if they cannot be locked.
+func (arena *secretArena) grow() error {
+	var err error
+	var pages []byte
+	if arena.lock {
+		pages, err = allocLockedPages(secretPagesSize)
+		if err != nil {
+			arena.locked = false
+		}
+	}
+	if pages == nil {
+		pages = make([]byte, secretPagesSize)
+	}
+	arena.pages = append(arena.pages, pages)
+	for offset := uintptr(0); offset+secretSlotSize <= uintptr(len(pages)); offset += secretSlotSize {
+		arena.free = append(arena.free, unsafe.Pointer(&pages[offset]))
+	}
+	return err
+}
+
+// alloc returns a zeroed slot, failing only to lock it into memory.
+func (arena *secretArena) alloc() (unsafe.Pointer, error) {
+	arena.Lock()
+	defer arena.Unlock()
+	var err error
+	if len(arena.free) == 0 {
+		err = arena.grow()
+	}
+	slot := arena.free[len(arena.free)-1]
+	arena.free = arena.free[:len(arena.free)-1]
+	arena.inUse++
+	return slot, err
+}
+
+// release zeroes slot and frees it, ignoring pointers not allocated
+// from the arena.
+func (arena *secretArena) release(slot unsafe.Pointer) {
+	arena.Lock()
+	defer arena.Unlock()
+	if !arena.owns(slot) {
+		return
+	}
+	setZero((*[secretSlotSize]byte)(slot)[:])
+	arena.free = append(arena.free, slot)
+	arena.inUse--
+}
+
+func (arena *secretArena) owns(slot unsafe.Pointer) bool {
+	for _, pages := range arena.pages {
+		start := uintptr(unsafe.Pointer(&pages[0]))
+		if uintptr(slot) >= start && uintptr(slot) < start+uintptr(len(pages)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocSecret returns a zeroed slot of the secrets of the device.
+func (device *Device) allocSecret() unsafe.Pointer {
+	slot, err := device.secrets.alloc()
+	if err != nil {
+		device.log.Error.Println("Unable to lock memory holding key material:", err)
+	}
+	return slot
+}
+
+func (device *Device) allocHandshakeSecrets() *handshakeSecrets {
+	return (*handshakeSecrets)(device.allocSecret())
+}
+
+func (device *Device) allocPrivateKey() *NoisePrivateKey {
+	return (*NoisePrivateKey)(device.allocSecret())
+}
+
+// MemoryLocked reports whether the memory holding key material is
+// locked as requested by DeviceOptions.LockMemory.
+func (device *Device) MemoryLocked() bool {
+	device.secrets.Lock()
+	defer device.secrets.Unlock()
+	return device.secrets.locked
+}
+
+// zeroSecrets zeroes the keys of the removed peer, beyond the sessions
+// zeroed by stopping it, whether or not it was running. The slot of its
+// handshake secrets is freed, and replaced by memory of its own for
+// whatever still handshakes with the peer.
+func (peer *Peer) zeroSecrets() {
+	peer.ZeroAndFlushAll()
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+	secrets := handshake.handshakeSecrets
+	handshake.handshakeSecrets = new(handshakeSecrets)
+	handshake.mutex.Unlock()
+	peer.device.secrets.release(unsafe.Pointer(secrets))
+}
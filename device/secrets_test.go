@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// unzeroedSecrets returns the names of the secrets of peer which hold
+// key material.
+func unzeroedSecrets(peer *Peer) []string {
+	handshake := &peer.handshake
+	handshake.mutex.RLock()
+	defer handshake.mutex.RUnlock()
+	var names []string
+	for name, secret := range map[string][]byte{
+		"preshared key":             handshake.presharedKey[:],
+		"precomputed static-static": handshake.precomputedStaticStatic[:],
+		"local ephemeral":           handshake.localEphemeral[:],
+		"chain key":                 handshake.chainKey[:],
+		"hash":                      handshake.hash[:],
+	} {
+		if !isZero(secret) {
+			names = append(names, name)
+		}
+	}
+	peer.keypairs.RLock()
+	if peer.keypairs.previous != nil || peer.keypairs.current != nil || peer.keypairs.loadNext() != nil {
+		names = append(names, "keypairs")
+	}
+	peer.keypairs.RUnlock()
+	return names
+}
+
+// checkFreedSecrets fails t if a freed slot of the secrets of device
+// holds anything but zeroes, as it would if a slot was not zeroed when
+// freed or was written to after, and returns the number of slots in
+// use.
+func checkFreedSecrets(t *testing.T, device *Device) int {
+	t.Helper()
+	arena := &device.secrets
+	arena.Lock()
+	defer arena.Unlock()
+	for _, slot := range arena.free {
+		if !isZero((*[secretSlotSize]byte)(slot)[:]) {
+			t.Errorf("freed slot %p holds key material", slot)
+		}
+	}
+	return arena.inUse
+}
+
+func TestSecretsZeroed(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[1].dev.Close()
+	dev := pair[0].dev
+
+	psk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := pair[1].key.publicKey()
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nupdate_only=true\npreshared_key="+psk.ToHex()+"\n"))
+	peer := dev.LookupPeer(pk)
+	if len(unzeroedSecrets(peer)) == 0 {
+		t.Fatal("no secrets to zero")
+	}
+
+	if inUse := checkFreedSecrets(t, dev); inUse != 2 {
+		t.Errorf("%d slots in use, want 2 for the private key and the peer", inUse)
+	}
+
+	dev.RemovePeer(pk)
+	if names := unzeroedSecrets(peer); len(names) != 0 {
+		t.Errorf("secrets of the removed peer left: %v", names)
+	}
+	if inUse := checkFreedSecrets(t, dev); inUse != 1 {
+		t.Errorf("%d slots in use after removing the peer, want 1", inUse)
+	}
+
+	dev.Close()
+	if !isZero(dev.staticIdentity.privateKey[:]) {
+		t.Error("private key left after closing the device")
+	}
+	if inUse := checkFreedSecrets(t, dev); inUse != 0 {
+		t.Errorf("%d slots in use after closing the device", inUse)
+	}
+}
+
+func TestSecretsZeroedDraining(t *testing.T) {
+	pair := newLoopbackPair(t)
+	defer pair[0].dev.Close()
+	defer pair[1].dev.Close()
+	dev := pair[0].dev
+
+	pk := pair[1].key.publicKey()
+	peer := dev.LookupPeer(pk)
+	done := make(chan struct{})
+	assertNil(t, dev.RemovePeerWithOptions(pk, RemovePeerOptions{
+		Drain: true,
+		Done:  func() { close(done) },
+	}))
+	select {
+	case <-done:
+	case <-time.After(2 * PeerDrainTimeout):
+		t.Fatal("completion callback was not called")
+	}
+	if names := unzeroedSecrets(peer); len(names) != 0 {
+		t.Errorf("secrets of the drained peer left: %v", names)
+	}
+	if inUse := checkFreedSecrets(t, dev); inUse != 1 {
+		t.Errorf("%d slots in use after draining the peer, want 1", inUse)
+	}
+}
+
+func TestLockMemory(t *testing.T) {
+	dev := NewDeviceWithOptions(newDummyTUN("dummy"), NewLogger(LogLevelSilent, ""), DeviceOptions{
+		LockMemory: true,
+	})
+	defer dev.Close()
+	if !dev.MemoryLocked() {
+		t.Skip("memory cannot be locked")
+	}
+
+	// the arena grows beyond its first pages, locking them as well
+
+	for i := 0; i < 2*secretPagesSize/int(secretSlotSize); i++ {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		peer, err := dev.NewPeer(sk.publicKey())
+		assertNil(t, err)
+		if !dev.secrets.owns(unsafe.Pointer(peer.handshake.handshakeSecrets)) {
+			t.Fatalf("secrets of peer %d not allocated from the arena", i)
+		}
+	}
+	if !dev.MemoryLocked() || len(dev.secrets.pages) < 2 {
+		t.Errorf("%d pages allocated, locked: %v", len(dev.secrets.pages), dev.MemoryLocked())
+	}
+}
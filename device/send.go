@@ -7,11 +7,11 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"net"
-	"sync"
 	"sync/atomic"
-	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
@@ -42,65 +42,74 @@ import (
  * (to allow the construction of transport messages in-place)
  */
 
-type QueueOutboundElement struct {
-	dropped int32
-	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+func (device *Device) NewOutboundElement() *QueueOutboundElement {
+	return device.newOutboundElement(device.GetMessageBuffer())
 }
 
-func (device *Device) NewOutboundElement() *QueueOutboundElement {
+// newOutboundElement is NewOutboundElement with a message buffer taken
+// from the pool already.
+func (device *Device) newOutboundElement(buffer *[MaxMessageSize]byte) *QueueOutboundElement {
 	elem := device.GetOutboundElement()
-	elem.dropped = AtomicFalse
-	elem.buffer = device.GetMessageBuffer()
-	elem.Mutex = sync.Mutex{}
-	elem.nonce = 0
-	elem.keypair = nil
-	elem.peer = nil
+	elem.reset(buffer)
 	return elem
 }
 
-func (elem *QueueOutboundElement) Drop() {
-	atomic.StoreInt32(&elem.dropped, AtomicTrue)
-}
-
-func (elem *QueueOutboundElement) IsDropped() bool {
-	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
-}
-
-func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundElement, device *Device) {
+/* Stages element in the nonce queue of peer, or its priority queue,
+ * making room according to the staging limit and drop policy of the peer
+ *
+ * Obs. Only called by the TUN reader, so the queue can only
+ * shrink between checking its length and sending to it
+ */
+func (peer *Peer) addToNonceQueue(element *QueueOutboundElement) {
+	device := peer.device
+	queue := peer.queue.nonce
+	if element.high {
+		queue = peer.queue.priority
+		atomic.AddUint64(&peer.stats.priorityPackets, 1)
+	}
+	limit := int(atomic.LoadInt32(&peer.staged.limit))
 	for {
-		select {
-		case queue <- element:
-			return
-		default:
+		if len(queue) < limit {
 			select {
-			case old := <-queue:
-				device.PutMessageBuffer(old.buffer)
-				device.PutOutboundElement(old)
+			case queue <- element:
+				peer.queue.nonceWorker.wake(device, wakeOnPacket)
+				return
 			default:
 			}
 		}
-	}
-}
-
-func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement, encryptionQueue chan *QueueOutboundElement, element *QueueOutboundElement) {
-	select {
-	case outboundQueue <- element:
-		select {
-		case encryptionQueue <- element:
+		if StagedDropPolicy(atomic.LoadInt32(&peer.staged.policy)) == StagedDropNewest {
+			device.dropped(DropQueueFull, peer, element.packet)
+			device.PutMessageBuffer(element.buffer)
+			device.PutOutboundElement(element)
+			atomic.AddUint64(&peer.stats.stagedDropped, 1)
 			return
+		}
+		select {
+		case old := <-queue:
+			device.dropped(DropQueueFull, peer, old.packet)
+			device.PutMessageBuffer(old.buffer)
+			device.PutOutboundElement(old)
+			atomic.AddUint64(&peer.stats.stagedDropped, 1)
 		default:
-			element.Drop()
-			element.peer.device.PutMessageBuffer(element.buffer)
-			element.Unlock()
 		}
-	default:
-		element.peer.device.PutMessageBuffer(element.buffer)
-		element.peer.device.PutOutboundElement(element)
+	}
+}
+
+func (peer *Peer) addToOutboundAndEncryptionQueues(elem *QueueOutboundElement) {
+	device := peer.device
+	elem.working = true
+	device.addWork()
+	if !peer.queue.outbound.push(elem) {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return
+	}
+	if !device.queue.encryption.enqueue(peer, elem) {
+		atomic.AddUint64(&peer.stats.encryptionDropped, 1)
+		device.dropped(DropQueueFull, peer, elem.packet)
+		elem.Drop()
+		device.PutMessageBuffer(elem.buffer)
+		device.releaseOutboundElement(elem)
 	}
 }
 
@@ -109,14 +118,15 @@ func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement,
 func (peer *Peer) SendKeepalive() bool {
 	peer.queue.RLock()
 	defer peer.queue.RUnlock()
-	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
+	if len(peer.queue.nonce) != 0 || len(peer.queue.priority) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
 		return false
 	}
 	elem := peer.device.NewOutboundElement()
 	elem.packet = nil
 	select {
 	case peer.queue.nonce <- elem:
-		peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
+		peer.queue.nonceWorker.wake(peer.device, wakeOnPacket)
+		peer.log.Debug.Println(peer, "- Sending keepalive packet")
 		return true
 	default:
 		peer.device.PutMessageBuffer(elem.buffer)
@@ -125,46 +135,67 @@ func (peer *Peer) SendKeepalive() bool {
 	}
 }
 
-func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+func (peer *Peer) SendHandshakeInitiation(isRetry bool) (err error) {
 	if !isRetry {
 		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	}
 
+	if peer.expired() || peer.multiLoginBlocked() || peer.disabled.Get() || peer.responderOnly.Get() {
+		return nil
+	}
+
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Debug.Println(peer, "- Sending handshake initiation")
+	if peer.device.dataPlaneOnly {
+		peer.requestSessionKeys()
+		return nil
+	}
+
+	_, span := peer.device.startSpan(context.Background(), SpanHandshakeInitiate)
+	span.SetAttribute(AttributePeer, peer.device.redactKey(peer.handshake.remoteStatic))
+	span.SetAttribute(AttributeRetry, isRetry)
+	defer func() {
+		span.End(err)
+	}()
+
+	peer.log.Debug.Println(peer, "- Sending handshake initiation")
 
 	msg, err := peer.device.CreateMessageInitiation(peer)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to create initiation message:", err)
+		peer.log.Error.Println(peer, "- Failed to create initiation message:", err)
 		return err
 	}
 
-	var buff [MessageInitiationSize]byte
-	writer := bytes.NewBuffer(buff[:0])
+	var buff [MaxObfuscationOverhead + MessageInitiationSize]byte
+	writer := bytes.NewBuffer(buff[MaxObfuscationOverhead:MaxObfuscationOverhead])
 	binary.Write(writer, binary.LittleEndian, msg)
-	packet := writer.Bytes()
-	peer.cookieGenerator.AddMacs(packet)
+	peer.cookieGenerator.AddMacs(writer.Bytes())
 
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	send := peer.sendHandshakeDatagram
+	if candidates := peer.raceCandidates(); candidates != nil {
+		send = func(datagram []byte) error {
+			return peer.sendHandshakeRace(datagram, candidates)
+		}
+	}
+	err = peer.sendHandshake(buff[:], send)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to send handshake initiation", err)
+		peer.log.Error.Println(peer, "- Failed to send handshake initiation", err)
 	}
 	peer.timersHandshakeInitiated()
 
@@ -173,26 +204,25 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
-	peer.device.log.Debug.Println(peer, "- Sending handshake response")
+	peer.log.Debug.Println(peer, "- Sending handshake response")
 
 	response, err := peer.device.CreateMessageResponse(peer)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to create response message:", err)
+		peer.log.Error.Println(peer, "- Failed to create response message:", err)
 		return err
 	}
 
-	var buff [MessageResponseSize]byte
-	writer := bytes.NewBuffer(buff[:0])
+	var buff [MaxObfuscationOverhead + MessageResponseSize]byte
+	writer := bytes.NewBuffer(buff[MaxObfuscationOverhead:MaxObfuscationOverhead])
 	binary.Write(writer, binary.LittleEndian, response)
-	packet := writer.Bytes()
-	peer.cookieGenerator.AddMacs(packet)
+	peer.cookieGenerator.AddMacs(writer.Bytes())
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to derive keypair:", err)
+		peer.log.Error.Println(peer, "- Failed to derive keypair:", err)
 		return err
 	}
 
@@ -200,16 +230,22 @@ func (peer *Peer) SendHandshakeResponse() error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	err = peer.sendHandshake(buff[:], peer.sendHandshakeDatagram)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to send handshake response", err)
+		peer.log.Error.Println(peer, "- Failed to send handshake response", err)
 	}
 	return err
 }
 
+// sendHandshakeDatagram sends the handshake message following
+// MaxObfuscationOverhead bytes of datagram to the endpoint of peer.
+func (peer *Peer) sendHandshakeDatagram(datagram []byte) error {
+	return peer.sendDatagram(datagram, MaxObfuscationOverhead)
+}
+
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
 
-	device.log.Debug.Println("Sending cookie response for denied handshake message for", initiatingElem.endpoint.DstToString())
+	device.log.Debug.Println("Sending cookie response for denied handshake message for", device.redactEndpoint(initiatingElem.endpoint.DstToString()))
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
@@ -221,7 +257,10 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	if err := device.unsafeSend(device.net.bind, writer.Bytes(), initiatingElem.endpoint); err != nil {
+		device.sendFailed(err)
+	}
+	atomic.AddUint64(&device.stats.cookieReplies, 1)
 	return nil
 }
 
@@ -231,17 +270,18 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := atomic.LoadUint64(&keypair.sendNonce)
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (peer.device.rekeys(keypair) && peer.device.since(keypair.created) > peer.device.rekeyAfterTime()) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
 
-/* Reads packets from the TUN and inserts
+/* Reads batches of packets from the TUN and inserts
  * into nonce queue for peer
  *
  * Obs. Single instance per TUN device
  */
 func (device *Device) RoutineReadFromTUN() {
+	defer device.trackRoutine(routineReadFromTUN)()
 
 	logDebug := device.log.Debug
 	logError := device.log.Error
@@ -254,73 +294,101 @@ func (device *Device) RoutineReadFromTUN() {
 	logDebug.Println("Routine: TUN reader - started")
 	device.state.starting.Done()
 
-	var elem *QueueOutboundElement
+	batchSize := device.tun.device.BatchSize()
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	elems := make([]*QueueOutboundElement, batchSize)
+	buffs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+
+	defer func() {
+		for _, elem := range elems {
+			if elem != nil {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+		}
+	}()
 
 	for {
-		if elem != nil {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+		for i := range elems {
+			if elems[i] == nil {
+				elems[i] = device.NewOutboundElement()
+				buffs[i] = elems[i].buffer[:]
+			}
 		}
-		elem = device.NewOutboundElement()
 
-		// read packet
+		// read packets
 
-		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		offset := MaxObfuscationOverhead + MessageTransportHeaderSize
+		count, err := device.tun.device.ReadPackets(buffs, sizes, offset)
 
 		if err != nil {
 			if !device.isClosed.Get() {
 				logError.Println("Failed to read packet from TUN device:", err)
-				device.Close()
+				device.closeWithError(fmt.Errorf("reading from TUN: %w", err))
 			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
-			continue
-		}
+		for i := 0; i < count; i++ {
+			size := sizes[i]
+			if size == 0 || size > maxSentContentSize {
+				continue
+			}
 
-		elem.packet = elem.buffer[offset : offset+size]
+			elem := elems[i]
+			elem.packet = elem.buffer[offset : offset+size]
 
-		// lookup peer
+			// lookup peer
 
-		var peer *Peer
-		switch elem.packet[0] >> 4 {
-		case ipv4.Version:
-			if len(elem.packet) < ipv4.HeaderLen {
-				continue
+			var peer *Peer
+			switch elem.packet[0] >> 4 {
+			case ipv4.Version:
+				if len(elem.packet) < ipv4.HeaderLen {
+					continue
+				}
+				dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+				peer = device.route(elem.packet, dst)
+
+			case ipv6.Version:
+				if len(elem.packet) < ipv6.HeaderLen {
+					continue
+				}
+				dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+				peer = device.route(elem.packet, dst)
+
+			default:
+				logDebug.Println("Received packet with unknown IP version")
 			}
-			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
-			peer = device.allowedips.LookupIPv4(dst)
 
-		case ipv6.Version:
-			if len(elem.packet) < ipv6.HeaderLen {
+			if peer == nil {
+				device.dropped(DropNoRoute, nil, elem.packet)
 				continue
 			}
-			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
-			peer = device.allowedips.LookupIPv6(dst)
-
-		default:
-			logDebug.Println("Received packet with unknown IP version")
-		}
-
-		if peer == nil {
-			continue
-		}
+			if peer.quota.exceeded.Get() {
+				device.dropped(DropOverQuota, peer, elem.packet)
+				continue
+			}
+			if device.mssClamping.Get() {
+				clampMSS(elem.packet, peer.MTU())
+			}
+			elem.flow = device.flowPort(elem.packet)
+			elem.high = device.priority(elem.packet) == PriorityHigh
 
-		// insert into nonce/pre-handshake queue
+			// insert into nonce/pre-handshake queue
 
-		peer.queue.RLock()
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
-				peer.SendHandshakeInitiation(false)
+			peer.queue.RLock()
+			if peer.isRunning.Get() {
+				if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+					peer.SendHandshakeInitiation(false)
+				}
+				peer.addToNonceQueue(elem)
+				elems[i] = nil
 			}
-			addToNonceQueue(peer.queue.nonce, elem, device)
-			elem = nil
+			peer.queue.RUnlock()
 		}
-		peer.queue.RUnlock()
 	}
 }
 
@@ -329,6 +397,16 @@ func (peer *Peer) FlushNonceQueue() {
 	case peer.signals.flushNonceQueue <- struct{}{}:
 	default:
 	}
+	peer.queue.nonceWorker.wake(peer.device, wakeOnFlush)
+}
+
+// signalNewKeypair wakes the nonce worker if it awaits a keypair.
+func (peer *Peer) signalNewKeypair() {
+	select {
+	case peer.signals.newKeypairArrived <- struct{}{}:
+	default:
+	}
+	peer.queue.nonceWorker.wake(peer.device, wakeOnKeypair)
 }
 
 /* Queues packets when there is no handshake.
@@ -338,14 +416,19 @@ func (peer *Peer) FlushNonceQueue() {
  * Obs. A single instance per peer
  */
 func (peer *Peer) RoutineNonce() {
+	defer peer.device.trackRoutine(routineNonce)()
+
 	var keypair *Keypair
 
 	device := peer.device
-	logDebug := device.log.Debug
+	logDebug := peer.log.Debug
 
 	flush := func() {
 		for {
 			select {
+			case elem := <-peer.queue.priority:
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
 			case elem := <-peer.queue.nonce:
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
@@ -355,8 +438,14 @@ func (peer *Peer) RoutineNonce() {
 		}
 	}
 
+	// the worker counts as work unless blocked, see workWaiter
+
+	waiter := &peer.queue.nonceWorker
+	device.addWork()
+
 	defer func() {
 		flush()
+		device.doneWork()
 		logDebug.Println(peer, "- Routine: nonce worker - stopped")
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 		peer.routines.stopping.Done()
@@ -369,86 +458,102 @@ func (peer *Peer) RoutineNonce() {
 	NextPacket:
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
+		var elem *QueueOutboundElement
 		select {
-		case <-peer.routines.stop:
-			return
-
-		case <-peer.signals.flushNonceQueue:
-			flush()
-			goto NextPacket
+		case elem = <-peer.queue.priority:
+		default:
+			waiter.wait(device, wakeOnPacket|wakeOnFlush, func() bool {
+				return len(peer.queue.priority) != 0 || len(peer.queue.nonce) != 0 || len(peer.signals.flushNonceQueue) != 0
+			})
+			select {
+			case <-peer.routines.stop:
+				waiter.resume(device)
+				return
 
-		case elem, ok := <-peer.queue.nonce:
+			case <-peer.signals.flushNonceQueue:
+				waiter.resume(device)
+				flush()
+				goto NextPacket
 
-			if !ok {
-				return
+			case elem = <-peer.queue.priority:
+			case elem = <-peer.queue.nonce:
 			}
+			waiter.resume(device)
+		}
+		if elem == nil {
+			return // queues closed
+		}
 
-			// make sure to always pick the newest key
+		// make sure to always pick the newest key
 
-			for {
+		for {
 
-				// check validity of newest key pair
+			// check validity of newest key pair
 
-				keypair = peer.keypairs.Current()
-				if keypair != nil && keypair.sendNonce < RejectAfterMessages {
-					if time.Since(keypair.created) < RejectAfterTime {
-						break
-					}
+			keypair = peer.keypairs.Current()
+			if keypair != nil && keypair.sendNonce < RejectAfterMessages {
+				if device.since(keypair.created) < device.rejectAfterTime() {
+					break
 				}
-				peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
+			}
+			peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
 
-				// no suitable key pair, request for new handshake
+			// no suitable key pair, request for new handshake
 
-				select {
-				case <-peer.signals.newKeypairArrived:
-				default:
-				}
+			select {
+			case <-peer.signals.newKeypairArrived:
+			default:
+			}
 
-				peer.SendHandshakeInitiation(false)
+			peer.SendHandshakeInitiation(false)
 
-				// wait for key to be established
+			// wait for key to be established
 
-				logDebug.Println(peer, "- Awaiting keypair")
+			logDebug.Println(peer, "- Awaiting keypair")
 
-				select {
-				case <-peer.signals.newKeypairArrived:
-					logDebug.Println(peer, "- Obtained awaited keypair")
+			waiter.wait(device, wakeOnKeypair|wakeOnFlush, func() bool {
+				return len(peer.signals.newKeypairArrived) != 0 || len(peer.signals.flushNonceQueue) != 0
+			})
+			select {
+			case <-peer.signals.newKeypairArrived:
+				waiter.resume(device)
+				logDebug.Println(peer, "- Obtained awaited keypair")
 
-				case <-peer.signals.flushNonceQueue:
-					device.PutMessageBuffer(elem.buffer)
-					device.PutOutboundElement(elem)
-					flush()
-					goto NextPacket
+			case <-peer.signals.flushNonceQueue:
+				waiter.resume(device)
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				flush()
+				goto NextPacket
 
-				case <-peer.routines.stop:
-					device.PutMessageBuffer(elem.buffer)
-					device.PutOutboundElement(elem)
-					return
-				}
+			case <-peer.routines.stop:
+				waiter.resume(device)
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				return
 			}
-			peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
+		}
+		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
-			// populate work element
+		// populate work element
 
-			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+		elem.peer = peer
+		elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
 
-			// double check in case of race condition added by future code
+		// double check in case of race condition added by future code
 
-			if elem.nonce >= RejectAfterMessages {
-				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
-				device.PutMessageBuffer(elem.buffer)
-				device.PutOutboundElement(elem)
-				goto NextPacket
-			}
+		if elem.nonce >= RejectAfterMessages {
+			atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			goto NextPacket
+		}
 
-			elem.keypair = keypair
-			elem.dropped = AtomicFalse
-			elem.Lock()
+		elem.keypair = keypair
+		elem.dropped = AtomicFalse
 
-			// add to parallel and sequential queue
-			addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption, elem)
-		}
+		// add to parallel and sequential queue
+		peer.addToOutboundAndEncryptionQueues(elem)
 	}
 }
 
@@ -467,31 +572,20 @@ func calculatePaddingSize(packetSize, mtu int) int {
 	return paddedSize - lastUnit
 }
 
-/* Encrypts the elements in the queue
- * and marks them for sequential consumption (by releasing the mutex)
+/* Encrypts the elements handed out by the encryption queue,
+ * taking turns between peers, and marks them for sequential
+ * consumption (by releasing the mutex)
  *
  * Obs. One instance per core
  */
 func (device *Device) RoutineEncryption() {
+	defer device.trackRoutine(routineEncryption)()
 
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	logDebug := device.log.Debug
 
 	defer func() {
-		for {
-			select {
-			case elem, ok := <-device.queue.encryption:
-				if ok && !elem.IsDropped() {
-					elem.Drop()
-					device.PutMessageBuffer(elem.buffer)
-					elem.Unlock()
-				}
-			default:
-				goto out
-			}
-		}
-	out:
 		logDebug.Println("Routine: encryption worker - stopped")
 		device.state.stopping.Done()
 	}()
@@ -499,29 +593,30 @@ func (device *Device) RoutineEncryption() {
 	logDebug.Println("Routine: encryption worker - started")
 	device.state.starting.Done()
 
+	batch := make([]*QueueOutboundElement, 0, EncryptionQuantum)
+
 	for {
 
-		// fetch next element
+		// fetch elements of the next peer
 
-		select {
-		case <-device.signals.stop:
+		var ok bool
+		batch, ok = device.queue.encryption.next(batch[:0])
+		if !ok {
 			return
+		}
 
-		case elem, ok := <-device.queue.encryption:
-
-			if !ok {
-				return
-			}
+		for _, elem := range batch {
 
-			// check if dropped
+			// check if abandoned by a stopped sender
 
-			if elem.IsDropped() {
+			if elem.abandoned() {
+				device.freeOutboundElement(elem)
 				continue
 			}
 
 			// populate header fields
 
-			header := elem.buffer[:MessageTransportHeaderSize]
+			header := elem.buffer[MaxObfuscationOverhead : MaxObfuscationOverhead+MessageTransportHeaderSize]
 
 			fieldType := header[0:4]
 			fieldReceiver := header[4:8]
@@ -533,7 +628,7 @@ func (device *Device) RoutineEncryption() {
 
 			// pad content to multiple of 16
 
-			paddingSize := calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&device.tun.mtu)))
+			paddingSize := calculatePaddingSize(len(elem.packet), int(elem.peer.effectiveMTU(atomic.LoadInt32(&device.tun.mtu))))
 			for i := 0; i < paddingSize; i++ {
 				elem.packet = append(elem.packet, 0)
 			}
@@ -547,7 +642,7 @@ func (device *Device) RoutineEncryption() {
 				elem.packet,
 				nil,
 			)
-			elem.Unlock()
+			device.releaseOutboundElement(elem)
 		}
 	}
 }
@@ -558,28 +653,29 @@ func (device *Device) RoutineEncryption() {
  * The routine terminates then the outbound queue is closed.
  */
 func (peer *Peer) RoutineSequentialSender() {
+	defer peer.device.trackRoutine(routineSequentialSender)()
 
 	device := peer.device
 
-	logDebug := device.log.Debug
-	logError := device.log.Error
+	logDebug := peer.log.Debug
+	logError := peer.log.Error
 
-	defer func() {
-		for {
-			select {
-			case elem, ok := <-peer.queue.outbound:
-				if ok {
-					if !elem.IsDropped() {
-						device.PutMessageBuffer(elem.buffer)
-						elem.Drop()
-					}
-					device.PutOutboundElement(elem)
-				}
-			default:
-				goto out
-			}
+	// packets awaiting a batched send to the bind
+
+	pending := make([]*QueueOutboundElement, 0, SendBatchSize)
+	buffs := make([][]byte, 0, SendBatchSize)
+
+	release := func() {
+		for _, elem := range pending {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
 		}
-	out:
+		pending = pending[:0]
+		buffs = buffs[:0]
+	}
+
+	defer func() {
+		release()
 		logDebug.Println(peer, "- Routine: sequential sender - stopped")
 		peer.routines.stopping.Done()
 	}()
@@ -589,40 +685,52 @@ func (peer *Peer) RoutineSequentialSender() {
 	peer.routines.starting.Done()
 
 	for {
-		select {
-
-		case <-peer.routines.stop:
-			return
 
-		case elem, ok := <-peer.queue.outbound:
+		// send to the bind once there is nothing more to batch
 
-			if !ok {
-				return
+		if len(pending) > 0 && (len(pending) == SendBatchSize || peer.queue.outbound.len() == 0) {
+			dataSent := false
+			for _, elem := range pending {
+				dataSent = dataSent || len(elem.packet) != MessageKeepaliveSize
 			}
-
-			elem.Lock()
-			if elem.IsDropped() {
-				device.PutOutboundElement(elem)
-				continue
+			var err error
+			for start, end := 0, 1; end <= len(pending); end++ {
+				if end < len(pending) && pending[end].flow == pending[start].flow {
+					continue
+				}
+				if err = peer.sendPaced(buffs[start:end], pending[start].flow); err != nil {
+					break
+				}
+				start = end
 			}
-
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketSent()
-
-			// send message and return buffer to pool
-
-			err := peer.SendBuffer(elem.packet)
-			if len(elem.packet) != MessageKeepaliveSize {
+			if dataSent {
 				peer.timersDataSent()
 			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+			release()
 			if err != nil {
 				logError.Println(peer, "- Failed to send data packet", err)
-				continue
+			} else {
+				peer.keepKeyFreshSending()
 			}
+		}
+
+		// wait for encryption
 
-			peer.keepKeyFreshSending()
+		elem, ok := peer.queue.outbound.next(peer.routines.stop)
+		if !ok {
+			return
+		}
+		if elem.IsDropped() {
+			device.PutOutboundElement(elem)
+			continue
 		}
+
+		peer.timersAnyAuthenticatedPacketTraversal()
+		peer.timersAnyAuthenticatedPacketSent()
+
+		// queue for batched send, with the headroom for obfuscation
+
+		buffs = append(buffs, elem.buffer[:MaxObfuscationOverhead+len(elem.packet)])
+		pending = append(pending, elem)
 	}
 }
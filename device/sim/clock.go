@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package sim
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// A Clock is a virtual device.Clock, which stands still until the
+// network it belongs to runs. Timers due at the same time fire in the
+// order they were set.
+type Clock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	seq     uint64
+	timers  map[*timer]struct{} // pending timers
+	running int32               // callbacks of fired timers still running, accessed atomically
+}
+
+type timer struct {
+	clock *Clock
+	f     func()
+	when  time.Time
+	seq   uint64 // orders timers due at the same time
+}
+
+var _ device.Clock = (*Clock)(nil)
+
+func newClock(start time.Time) *Clock {
+	return &Clock{
+		now:    start,
+		timers: make(map[*timer]struct{}),
+	}
+}
+
+func (clock *Clock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *Clock) AfterFunc(d time.Duration, f func()) device.ClockTimer {
+	t := &timer{clock: clock, f: f}
+	t.Reset(d)
+	return t
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, pending := t.clock.timers[t]
+	if d < 0 {
+		d = 0
+	}
+	t.when = t.clock.now.Add(d)
+	t.clock.seq++
+	t.seq = t.clock.seq
+	t.clock.timers[t] = struct{}{}
+	return pending
+}
+
+// fireNext moves the clock to the first timer due by limit and fires
+// it, reporting whether there was one. Otherwise the clock moves to
+// limit. Like time.AfterFunc, the callback runs in its own goroutine.
+func (clock *Clock) fireNext(limit time.Time) bool {
+	clock.mutex.Lock()
+	var next *timer
+	for t := range clock.timers {
+		if t.when.After(limit) {
+			continue
+		}
+		if next == nil || t.when.Before(next.when) || (t.when.Equal(next.when) && t.seq < next.seq) {
+			next = t
+		}
+	}
+	if next == nil {
+		if limit.After(clock.now) {
+			clock.now = limit
+		}
+		clock.mutex.Unlock()
+		return false
+	}
+	delete(clock.timers, next)
+	if next.when.After(clock.now) {
+		clock.now = next.when
+	}
+	atomic.AddInt32(&clock.running, 1)
+	clock.mutex.Unlock()
+
+	go func() {
+		defer atomic.AddInt32(&clock.running, -1)
+		next.f()
+	}()
+	return true
+}
+
+// busy reports whether callbacks of fired timers are still running.
+func (clock *Clock) busy() bool {
+	return atomic.LoadInt32(&clock.running) != 0
+}
@@ -0,0 +1,511 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package sim runs devices over an in-memory network on a virtual clock,
+// so that the behavior of a mesh over minutes or hours of protocol time,
+// with links failing and endpoints moving, is tested in moments.
+package sim
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+/* Simulated networks
+ *
+ * Every node of a Network runs a device whose bind sends to the other
+ * nodes in memory, and whose timers follow the virtual clock of the
+ * network, see device.Clock. Time only passes in Run, which fires the
+ * timers and delivers the packets in flight in order of their virtual
+ * time. After each step it waits for the devices to settle: for the
+ * callbacks of the timers fired to return, for the packets handed to
+ * binds and TUN devices to be taken up, and for the devices to finish
+ * the work they caused, see device.Device.Working. As the devices only
+ * wake up on the packets and timers of the network, nothing happens from
+ * then on until the next step, so that no step depends on how fast the
+ * real clock runs.
+ *
+ * Nodes only reach each other once Connect made them peers. Links carry
+ * packets after their latency unless they are down, see SetLink, and a
+ * node may move to another endpoint, roaming like a mobile client.
+ * Scripted events are scheduled with At to run at a virtual time.
+ */
+
+const (
+	bindPort     = 51820
+	bindQueueLen = 1024
+)
+
+var errClosed = errors.New("sim: use of closed bind")
+
+type Config struct {
+	Latency  time.Duration // of every link unless set by SetLink
+	Start    time.Time     // virtual time the simulation starts at, zero for the current time
+	LogLevel int           // log level of the devices
+}
+
+// A Link between two nodes.
+type Link struct {
+	Latency time.Duration
+	Down    bool // drops all packets
+	MTU     int  // largest datagram carried, the UDP payload, zero for any
+}
+
+type linkKey struct {
+	a, b *Node
+}
+
+type Network struct {
+	config   Config
+	clock    *Clock
+	inflight int64 // packets handed to binds and TUN devices and not taken up yet, accessed atomically
+
+	mutex     sync.Mutex
+	nodes     []*Node
+	endpoints map[string]*Node // by the address of their bind
+	links     map[linkKey]Link
+}
+
+// A Node is a device on the network.
+type Node struct {
+	Name    string
+	Device  *device.Device
+	Address net.IP // of the node within the tunnel
+
+	network  *Network
+	index    int
+	private  device.NoisePrivateKey
+	public   device.NoisePublicKey
+	tun      *tuntest.ChannelTUN
+	reader   tunReader
+	bind     *bind
+	endpoint string // address of the bind, guarded by the network mutex
+	received uint64 // packets delivered to the TUN device, accessed atomically
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+}
+
+func NewNetwork(config Config) *Network {
+	if config.Start.IsZero() {
+		config.Start = time.Now()
+	}
+	return &Network{
+		config:    config,
+		clock:     newClock(config.Start),
+		endpoints: make(map[string]*Node),
+		links:     make(map[linkKey]Link),
+	}
+}
+
+// Clock returns the virtual clock of the network.
+func (network *Network) Clock() *Clock {
+	return network.clock
+}
+
+// Now returns the virtual time of the network.
+func (network *Network) Now() time.Time {
+	return network.clock.Now()
+}
+
+// AddNode adds a device to the network, up and without peers.
+func (network *Network) AddNode(name string) (*Node, error) {
+	network.mutex.Lock()
+	index := len(network.nodes) + 1
+	if index > 0xfffe {
+		network.mutex.Unlock()
+		return nil, errors.New("sim: too many nodes")
+	}
+	node := &Node{
+		Name:     name,
+		Address:  net.IPv4(10, 0, byte(index>>8), byte(index)),
+		network:  network,
+		index:    index,
+		tun:      tuntest.NewChannelTUN(),
+		endpoint: net.JoinHostPort(net.IPv4(172, 16, byte(index>>8), byte(index)).String(), strconv.Itoa(bindPort)),
+		stop:     make(chan struct{}),
+	}
+	node.reader.node = node
+	node.reader.Device = node.tun.TUN()
+	node.bind = newBind(node)
+	network.nodes = append(network.nodes, node)
+	network.endpoints[node.endpoint] = node
+	network.mutex.Unlock()
+
+	if _, err := rand.Read(node.private[:]); err != nil {
+		return nil, err
+	}
+	node.private[0] &= 248
+	node.private[31] = (node.private[31] & 127) | 64
+	curve25519.ScalarBaseMult((*[32]byte)(&node.public), (*[32]byte)(&node.private))
+
+	node.Device = device.NewDeviceWithOptions(&node.reader, device.NewLogger(network.config.LogLevel, name+": "), device.DeviceOptions{
+		CreateBind: node.bind.open,
+		Clock:      network.clock,
+	})
+	node.stopped.Add(1)
+	go node.drain()
+	if err := node.Device.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=%d\n", node.private.ToHex(), bindPort)); err != nil {
+		return nil, err
+	}
+	node.Device.Up()
+	return node, nil
+}
+
+// Connect makes a and b peers of each other, at their current endpoints.
+func (network *Network) Connect(a, b *Node) error {
+	if err := a.Device.IpcSet(a.peerConfig(b)); err != nil {
+		return err
+	}
+	return b.Device.IpcSet(b.peerConfig(a))
+}
+
+// Mesh connects every pair of nodes.
+func (network *Network) Mesh(nodes ...*Node) error {
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			if err := network.Connect(a, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (node *Node) peerConfig(peer *Node) string {
+	return fmt.Sprintf("public_key=%s\nendpoint=%s\nreplace_allowed_ips=true\nallowed_ip=%s/32\n",
+		peer.public.ToHex(), peer.Endpoint(), peer.Address)
+}
+
+func (network *Network) key(a, b *Node) linkKey {
+	if a.index > b.index {
+		a, b = b, a
+	}
+	return linkKey{a, b}
+}
+
+// SetLink sets the conditions of the link between a and b, in both
+// directions. Packets in flight are not affected.
+func (network *Network) SetLink(a, b *Node, link Link) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.links[network.key(a, b)] = link
+}
+
+// Link returns the conditions of the link between a and b.
+func (network *Network) Link(a, b *Node) Link {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if link, ok := network.links[network.key(a, b)]; ok {
+		return link
+	}
+	return Link{Latency: network.config.Latency}
+}
+
+// At runs f once the virtual clock reaches after from now.
+func (network *Network) At(after time.Duration, f func()) {
+	network.clock.AfterFunc(after, f)
+}
+
+// Run advances the virtual clock by d, firing the timers of the devices
+// and delivering the packets due on the way.
+func (network *Network) Run(d time.Duration) {
+	limit := network.clock.Now().Add(d)
+	network.settle()
+	for network.clock.fireNext(limit) {
+		network.settle()
+	}
+}
+
+// settle waits for the devices to be idle, yielding to them meanwhile.
+//
+// Obs. Run is not safe for concurrent use.
+func (network *Network) settle() {
+	for network.busy() {
+		runtime.Gosched()
+	}
+}
+
+// busy reports whether work remains before time may pass. Work only
+// flows from the timers to the packets taken up and on to the devices,
+// each counting it before the one before stops, so looking in that
+// order sees work handed on meanwhile.
+func (network *Network) busy() bool {
+	if network.clock.busy() || atomic.LoadInt64(&network.inflight) != 0 {
+		return true
+	}
+	network.mutex.Lock()
+	nodes := network.nodes
+	network.mutex.Unlock()
+	for _, node := range nodes {
+		if node.Device.Working() {
+			return true
+		}
+	}
+	return false
+}
+
+// handed counts n packets handed to a bind or TUN device, or, if n is
+// negative, taken up.
+func (network *Network) handed(n int64) {
+	atomic.AddInt64(&network.inflight, n)
+}
+
+// Close closes the devices of all nodes.
+func (network *Network) Close() {
+	network.mutex.Lock()
+	nodes := network.nodes
+	network.mutex.Unlock()
+	for _, node := range nodes {
+		node.Device.Close()
+		close(node.stop)
+		node.stopped.Wait()
+	}
+}
+
+// send carries packet from node to the node at endpoint, if any.
+func (network *Network) send(from *Node, endpoint string, packet []byte) {
+	network.mutex.Lock()
+	to := network.endpoints[endpoint]
+	source := from.endpoint
+	network.mutex.Unlock()
+	if to == nil || to == from {
+		return
+	}
+	link := network.Link(from, to)
+	if link.Down || link.MTU > 0 && len(packet) > link.MTU {
+		return
+	}
+	network.clock.AfterFunc(link.Latency, func() {
+		to.bind.deliver(packet, source)
+	})
+}
+
+// PublicKey returns the public key of the device of node.
+func (node *Node) PublicKey() device.NoisePublicKey {
+	return node.public
+}
+
+// Endpoint returns the address the node sends from and receives on.
+func (node *Node) Endpoint() string {
+	node.network.mutex.Lock()
+	defer node.network.mutex.Unlock()
+	return node.endpoint
+}
+
+// Move moves node to another endpoint, of the form ip:port. Its peers
+// only learn about it once it sends to them.
+func (node *Node) Move(endpoint string) error {
+	node.network.mutex.Lock()
+	defer node.network.mutex.Unlock()
+	if other, ok := node.network.endpoints[endpoint]; ok && other != node {
+		return fmt.Errorf("sim: endpoint %s taken by %s", endpoint, other.Name)
+	}
+	delete(node.network.endpoints, node.endpoint)
+	node.endpoint = endpoint
+	node.network.endpoints[endpoint] = node
+	return nil
+}
+
+// Ping sends an ICMP echo request from node to the tunnel address of
+// peer, which counts it as received once it arrives.
+func (node *Node) Ping(peer *Node) {
+	node.PingAddress(peer.Address)
+}
+
+// PingAddress sends an ICMP echo request from node to address, which
+// the node it is routed to counts as received.
+func (node *Node) PingAddress(address net.IP) {
+	node.Send(tuntest.Ping(address, node.Address))
+}
+
+// Send sends packet from node as its TUN device would.
+func (node *Node) Send(packet []byte) {
+	node.network.handed(1)
+	select {
+	case node.tun.Outbound <- packet:
+	case <-node.stop:
+		node.network.handed(-1)
+	}
+}
+
+// Received returns the number of packets delivered to the TUN device
+// of node.
+func (node *Node) Received() int {
+	return int(atomic.LoadUint64(&node.received))
+}
+
+func (node *Node) drain() {
+	defer node.stopped.Done()
+	for {
+		select {
+		case _, ok := <-node.tun.Inbound:
+			if !ok {
+				return
+			}
+		case <-node.stop:
+			return
+		}
+	}
+}
+
+// A tunReader is the TUN device of a node, accounting for the packets
+// it hands to the device and counting those it receives.
+type tunReader struct {
+	tun.Device
+	node *Node
+	held int64 // packets read and still being routed by the device, accessed atomically
+}
+
+// ReadPackets holds the packets read until the device reads again, by
+// then having handed them on.
+func (t *tunReader) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	t.node.network.handed(-atomic.SwapInt64(&t.held, 0))
+	n, err := t.Device.ReadPackets(buffs, sizes, offset)
+	atomic.AddInt64(&t.held, int64(n))
+	return n, err
+}
+
+func (t *tunReader) WritePackets(buffs [][]byte, offset int) (int, error) {
+	n, err := t.Device.WritePackets(buffs, offset)
+	atomic.AddUint64(&t.node.received, uint64(n))
+	return n, err
+}
+
+type packet struct {
+	data   []byte
+	source string
+}
+
+// A bind carries the packets of a node over the network.
+type bind struct {
+	node *Node
+
+	mutex  sync.Mutex
+	rx     chan packet
+	closed chan struct{} // closed while the bind is not open
+	held   int64         // packets received and still being handled by the device, accessed atomically
+}
+
+var _ conn.Bind = (*bind)(nil)
+
+func newBind(node *Node) *bind {
+	b := &bind{node: node, closed: make(chan struct{})}
+	close(b.closed)
+	return b
+}
+
+// open has the signature of device.DeviceOptions.CreateBind, binding
+// the endpoint of the node regardless of port.
+func (b *bind) open(port uint16) (conn.Bind, uint16, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.unsafeDrain()
+	b.rx = make(chan packet, bindQueueLen)
+	b.closed = make(chan struct{})
+	return b, bindPort, nil
+}
+
+func (b *bind) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	b.unsafeDrain()
+	return nil
+}
+
+// unsafeDrain drops the packets queued for receiving.
+func (b *bind) unsafeDrain() {
+	for {
+		select {
+		case <-b.rx:
+			b.node.network.handed(-1)
+		default:
+			return
+		}
+	}
+}
+
+func (b *bind) LastMark() uint32 { return 0 }
+
+func (b *bind) SetMark(mark uint32) error { return nil }
+
+func (b *bind) state() (chan packet, chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rx, b.closed
+}
+
+// ReceiveIPv4 holds the packet received until the device receives
+// again, by then having handed it on.
+func (b *bind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, error) {
+	b.node.network.handed(-atomic.SwapInt64(&b.held, 0))
+	rx, closed := b.state()
+	select {
+	case <-closed:
+		return 0, nil, errClosed
+	case p := <-rx:
+		atomic.AddInt64(&b.held, 1)
+		ep, err := conn.CreateEndpoint(p.source)
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(buff, p.data), ep, nil
+	}
+}
+
+// ReceiveIPv6 blocks until the bind closes, the network is IPv4 only.
+func (b *bind) ReceiveIPv6(buff []byte) (int, conn.Endpoint, error) {
+	_, closed := b.state()
+	<-closed
+	return 0, nil, errClosed
+}
+
+func (b *bind) Send(buff []byte, ep conn.Endpoint) error {
+	_, closed := b.state()
+	select {
+	case <-closed:
+		return errClosed
+	default:
+	}
+	data := make([]byte, len(buff))
+	copy(data, buff)
+	b.node.network.send(b.node, ep.DstToString(), data)
+	return nil
+}
+
+// deliver queues a packet for receiving, dropping it like UDP if the
+// bind is closed or behind.
+func (b *bind) deliver(data []byte, source string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+		return
+	default:
+	}
+	select {
+	case b.rx <- packet{data, source}:
+		b.node.network.handed(1)
+	default:
+	}
+}
@@ -0,0 +1,284 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package sim
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func newNetwork(t *testing.T, names ...string) (*Network, []*Node) {
+	network := NewNetwork(Config{
+		Latency:  20 * time.Millisecond,
+		Start:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		LogLevel: device.LogLevelError,
+	})
+	var nodes []*Node
+	for _, name := range names {
+		node, err := network.AddNode(name)
+		if err != nil {
+			network.Close()
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	if err := network.Mesh(nodes...); err != nil {
+		network.Close()
+		t.Fatal(err)
+	}
+	return network, nodes
+}
+
+// endpoint returns the endpoint node has for peer.
+func endpoint(t *testing.T, node, peer *Node) string {
+	config, err := node.Device.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "public_key=" + peer.PublicKey().ToHex()
+	current := false
+	for scanner := bufio.NewScanner(strings.NewReader(config)); scanner.Scan(); {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "public_key=") {
+			current = line == key
+		} else if current && strings.HasPrefix(line, "endpoint=") {
+			return strings.TrimPrefix(line, "endpoint=")
+		}
+	}
+	return ""
+}
+
+func TestPing(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b", "c")
+	defer network.Close()
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	start := network.Now()
+	a.Ping(b)
+	a.Ping(c)
+	network.Run(time.Second)
+	if b.Received() != 1 || c.Received() != 1 {
+		t.Errorf("pings received by b %d and c %d, want 1", b.Received(), c.Received())
+	}
+	if elapsed := network.Now().Sub(start); elapsed != time.Second {
+		t.Errorf("virtual clock advanced by %v, want 1s", elapsed)
+	}
+}
+
+func TestRekeyInVirtualTime(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b")
+	defer network.Close()
+	a, b := nodes[0], nodes[1]
+	if err := a.Device.IpcSet("public_key=" + b.PublicKey().ToHex() + "\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Ping(b)
+	network.Run(time.Second)
+	first := a.Device.LookupPeer(b.PublicKey()).Stats().LastHandshake
+	if first.IsZero() {
+		t.Fatal("no handshake")
+	}
+
+	// keepalives keep the session in use until it is renewed
+	network.Run(device.RekeyAfterTime + time.Minute)
+	last := a.Device.LookupPeer(b.PublicKey()).Stats().LastHandshake
+	if last.Sub(first) < device.RekeyAfterTime {
+		t.Errorf("session of %v last renewed at %v", first, last)
+	}
+	a.Ping(b)
+	network.Run(time.Second)
+	if b.Received() != 2 {
+		t.Errorf("b received %d pings, want 2", b.Received())
+	}
+}
+
+func TestLinkDown(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b")
+	defer network.Close()
+	a, b := nodes[0], nodes[1]
+
+	network.SetLink(a, b, Link{Down: true})
+	network.At(30*time.Second, func() {
+		network.SetLink(a, b, Link{Latency: time.Millisecond})
+	})
+	a.Ping(b)
+	network.Run(10 * time.Second)
+	if b.Received() != 0 {
+		t.Fatal("ping crossed a link which is down")
+	}
+
+	// the handshake is retried until the link comes back, delivering the
+	// staged ping
+	network.Run(time.Minute)
+	if b.Received() != 1 {
+		t.Errorf("b received %d pings after the link came back, want 1", b.Received())
+	}
+}
+
+func TestRoaming(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b")
+	defer network.Close()
+	a, b := nodes[0], nodes[1]
+
+	a.Ping(b)
+	network.Run(time.Second)
+	if err := a.Move("192.0.2.1:4242"); err != nil {
+		t.Fatal(err)
+	}
+	a.Ping(b)
+	network.Run(time.Second)
+	if got := endpoint(t, b, a); got != "192.0.2.1:4242" {
+		t.Errorf("b has a at %s, want 192.0.2.1:4242", got)
+	}
+	b.Ping(a)
+	network.Run(time.Second)
+	if a.Received() != 1 || b.Received() != 2 {
+		t.Errorf("a received %d pings and b %d, want 1 and 2", a.Received(), b.Received())
+	}
+}
+
+func TestFailover(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "primary", "backup")
+	defer network.Close()
+	a, primary, backup := nodes[0], nodes[1], nodes[2]
+	dst := net.IPv4(10, 9, 0, 1)
+	if err := a.Device.IpcSet("public_key=" + primary.PublicKey().ToHex() + "\nallowed_ip=10.9.0.0/24\n" +
+		"public_key=" + backup.PublicKey().ToHex() + "\nbackup_allowed_ip=10.9.0.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backup takes over once the primary has been trying to
+	// handshake for the failover threshold, since the first ping, which
+	// the primary holds as the one sent a millisecond before
+
+	network.SetLink(a, primary, Link{Down: true})
+	start := network.Now()
+	a.PingAddress(dst)
+	network.Run(device.DefaultFailoverThreshold - time.Millisecond)
+	a.PingAddress(dst)
+	network.Run(time.Millisecond)
+	if primary.Received() != 0 || backup.Received() != 0 {
+		t.Fatalf("pings received by the primary %d and the backup %d, want none", primary.Received(), backup.Received())
+	}
+	if elapsed := network.Now().Sub(start); elapsed != device.DefaultFailoverThreshold {
+		t.Fatalf("virtual clock advanced by %v, want %v", elapsed, device.DefaultFailoverThreshold)
+	}
+	a.PingAddress(dst)
+	network.Run(time.Second)
+	if backup.Received() != 1 {
+		t.Fatalf("backup received %d pings once the primary was dead, want 1", backup.Received())
+	}
+
+	// replies through the backup come from its backup allowed IPs
+
+	backup.Send(tuntest.Ping(a.Address, dst))
+	network.Run(time.Second)
+	if a.Received() != 1 {
+		t.Errorf("a received %d replies through the backup, want 1", a.Received())
+	}
+
+	// the primary completes a handshake once reachable, taking over again
+	// along with the pings it held
+
+	network.SetLink(a, primary, Link{Latency: time.Millisecond})
+	network.Run(device.RekeyTimeout + time.Second)
+	a.PingAddress(dst)
+	network.Run(time.Second)
+	if primary.Received() != 3 || backup.Received() != 1 {
+		t.Errorf("pings received by the primary %d and the backup %d after failing back, want 3 and 1", primary.Received(), backup.Received())
+	}
+	if stats := a.Device.LookupPeer(primary.PublicKey()).Stats(); stats.FailedOver != 1 {
+		t.Errorf("%d packets of the primary failed over, want 1", stats.FailedOver)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b", "c")
+	defer network.Close()
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	if err := a.Device.IpcSet("public_key=" + b.PublicKey().ToHex() + "\nbalanced_allowed_ip=10.9.0.0/24\n" +
+		"public_key=" + c.PublicKey().ToHex() + "\nbalanced_allowed_ip=10.9.0.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+	pingAll := func() {
+		for i := 1; i <= 64; i++ {
+			a.PingAddress(net.IPv4(10, 9, 0, byte(i)))
+		}
+		network.Run(time.Second)
+	}
+
+	pingAll()
+	first := b.Received()
+	if first+c.Received() != 64 || first == 0 || c.Received() == 0 {
+		t.Fatalf("flows received by b %d and c %d, want 64 spread across both", first, c.Received())
+	}
+
+	// every flow sticks to its peer
+
+	pingAll()
+	if b.Received() != 2*first || c.Received() != 2*(64-first) {
+		t.Errorf("flows received by b %d and c %d, want %d and %d", b.Received(), c.Received(), 2*first, 2*(64-first))
+	}
+
+	// a peer of weight zero takes no flows
+
+	if err := a.Device.IpcSet("public_key=" + c.PublicKey().ToHex() + "\nbalance_weight=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	pingAll()
+	if b.Received() != 2*first+64 {
+		t.Errorf("b received %d flows once c had weight zero, want %d", b.Received(), 2*first+64)
+	}
+}
+
+func TestProbeMTU(t *testing.T) {
+	network, nodes := newNetwork(t, "a", "b")
+	defer network.Close()
+	a, b := nodes[0], nodes[1]
+
+	// transport messages add 32 bytes to the packets they carry
+	network.SetLink(a, b, Link{Latency: 20 * time.Millisecond, MTU: 1400})
+	type result struct {
+		mtu int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		mtu, err := a.Device.ProbePeerMTU(b.PublicKey())
+		done <- result{mtu, err}
+	}()
+	// the probe initiates a handshake, so the device accounts for it from then on
+	for {
+		status, _ := a.Device.PeerHandshakeState(b.PublicKey())
+		if status.State != device.HandshakeNone {
+			break
+		}
+		runtime.Gosched()
+	}
+	network.Run(time.Minute)
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.mtu != 1360 {
+			t.Errorf("probed MTU %d, want 1360", r.mtu)
+		}
+	default:
+		t.Fatal("probing did not finish")
+	}
+	if mtu := a.Device.LookupPeer(b.PublicKey()).MTU(); mtu != 1360 {
+		t.Errorf("MTU of the peer %d, want 1360", mtu)
+	}
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Allowed sources restrict the networks handshakes and transport
+ * packets of a peer may arrive from. Packets from elsewhere are
+ * dropped even though they authenticate, as defense in depth against
+ * a leaked key being used from an unexpected network. A peer without
+ * allowed sources accepts packets from anywhere.
+ */
+
+// allowedSources is stored in Peer.allowedSources, which is read
+// without locks on the receive path.
+type allowedSources []net.IPNet
+
+// AllowedSources returns the networks packets of peer may arrive from,
+// none if they may arrive from anywhere.
+func (peer *Peer) AllowedSources() []net.IPNet {
+	sources, _ := peer.allowedSources.Load().(allowedSources)
+	return append([]net.IPNet(nil), sources...)
+}
+
+// AddAllowedSource permits packets of peer to arrive from network.
+func (peer *Peer) AddAllowedSource(network net.IPNet) {
+	sources, _ := peer.allowedSources.Load().(allowedSources)
+	network.IP = network.IP.Mask(network.Mask)
+	peer.allowedSources.Store(append(append(allowedSources(nil), sources...), network))
+}
+
+// ClearAllowedSources lifts the restriction of the networks packets of
+// peer may arrive from.
+func (peer *Peer) ClearAllowedSources() {
+	peer.allowedSources.Store(allowedSources(nil))
+}
+
+// sourceAllowed reports whether packets of peer may arrive from endpoint,
+// counting the ones which may not.
+func (peer *Peer) sourceAllowed(endpoint conn.Endpoint) bool {
+	sources, _ := peer.allowedSources.Load().(allowedSources)
+	if len(sources) == 0 {
+		return true
+	}
+	ip := endpoint.DstIP()
+	for _, network := range sources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	atomic.AddUint64(&peer.stats.sourceRejected, 1)
+	return false
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestAllowedSources(t *testing.T) {
+	port1 := getFreePort(t)
+	port2 := getFreePort(t)
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	assertNil(t, dev1.IpcSet(`private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=`+port1+`
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:`+port2+`
+`))
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	assertNil(t, dev2.IpcSet(`private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=`+port2+`
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+allowed_ip=1.0.0.1/32
+allowed_source=192.0.2.0/24
+allowed_source=2001:db8::/32
+`))
+
+	var pk NoisePublicKey
+	assertNil(t, pk.FromHex("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427"))
+	peer := dev2.LookupPeer(pk)
+
+	config, err := dev2.IpcGetConfig()
+	assertNil(t, err)
+	if sources := config.Peers[0].AllowedSources; len(sources) != 2 || sources[0].String() != "192.0.2.0/24" {
+		t.Errorf("allowed sources reported as %v", sources)
+	}
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- ping
+	select {
+	case <-tun2.Inbound:
+		t.Fatal("ping from a disallowed source transited")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if peer.Stats().SourceRejected == 0 {
+		t.Error("rejected handshake not counted")
+	}
+
+	assertNil(t, dev2.IpcSet("public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\nreplace_allowed_sources=true\nallowed_source=127.0.0.0/8\n"))
+	if sources := peer.AllowedSources(); len(sources) != 1 {
+		t.Errorf("allowed sources %v after replacing them", sources)
+	}
+
+	// start over rather than waiting for the initiation to be retransmitted
+
+	var pk1 NoisePublicKey
+	assertNil(t, pk1.FromHex("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"))
+	assertNil(t, dev1.ExpirePeerSessions(pk1))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if stats, _ := dev1.PeerStats(pk1); !stats.LastHandshake.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake from an allowed source")
+		}
+	}
+	tun1.Outbound <- ping
+	select {
+	case <-tun2.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping from an allowed source did not transit")
+	}
+}
@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package stress runs many devices with many peers against each other while
+// continuously reconfiguring them, and reports goroutines left behind once
+// every device has been closed again.
+package stress
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// maxRetainedHeap bounds how much the heap may grow across a run,
+// a leaked message buffer pool easily exceeds it.
+const maxRetainedHeap = 16 << 20
+
+type Config struct {
+	Devices        int           // number of devices, all peered with each other
+	PeersPerDevice int           // total peers per device, the ones beyond the mesh have no endpoint listening
+	Duration       time.Duration // how long to keep churning
+	LogLevel       int           // log level of the devices
+	Seed           int64         // seed of the churn schedule
+}
+
+type Result struct {
+	Operations     int // configuration changes applied
+	PingsSent      int
+	PingsDelivered int
+}
+
+type keyPair struct {
+	private device.NoisePrivateKey
+	public  device.NoisePublicKey
+}
+
+func newKeyPair() (keyPair, error) {
+	var kp keyPair
+	if _, err := rand.Read(kp.private[:]); err != nil {
+		return kp, err
+	}
+	kp.private[0] &= 248
+	kp.private[31] = (kp.private[31] & 127) | 64
+	curve25519.ScalarBaseMult((*[32]byte)(&kp.public), (*[32]byte)(&kp.private))
+	return kp, nil
+}
+
+type node struct {
+	dev     *device.Device
+	tun     *tuntest.ChannelTUN
+	key     keyPair
+	port    int
+	addr    net.IP
+	phantom []keyPair // peers that are never reachable
+}
+
+func freePort() (int, error) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+func (n *node) meshPeer(other *node) string {
+	return fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+		other.key.public.ToHex(), other.addr, other.port)
+}
+
+func phantomPeer(kp keyPair, port int) string {
+	return fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d\npersistent_keepalive_interval=1\n",
+		kp.public.ToHex(), port)
+}
+
+// Run builds the mesh described by config, churns it for config.Duration
+// and tears it down again. An error is returned if a configuration change
+// fails or if goroutines are still running after teardown.
+func Run(config Config) (Result, error) {
+	var result Result
+	if config.Devices < 2 {
+		return result, fmt.Errorf("need at least 2 devices, have %d", config.Devices)
+	}
+	if config.PeersPerDevice < config.Devices-1 {
+		config.PeersPerDevice = config.Devices - 1
+	}
+	rng := mrand.New(mrand.NewSource(config.Seed))
+	baseline := runtime.NumGoroutine()
+	var baselineMem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&baselineMem)
+
+	nodes := make([]*node, config.Devices)
+	for i := range nodes {
+		kp, err := newKeyPair()
+		if err != nil {
+			return result, err
+		}
+		port, err := freePort()
+		if err != nil {
+			return result, err
+		}
+		n := &node{
+			tun:  tuntest.NewChannelTUN(),
+			key:  kp,
+			port: port,
+			addr: net.IPv4(10, 0, byte(i>>8), byte(i)+1),
+		}
+		n.dev = device.NewDevice(n.tun.TUN(), device.NewLogger(config.LogLevel, fmt.Sprintf("stress%d: ", i)))
+		nodes[i] = n
+	}
+
+	var drain sync.WaitGroup
+	var delivered int64
+	stopDrain := make(chan struct{})
+	for _, n := range nodes {
+		drain.Add(1)
+		go func(n *node) {
+			defer drain.Done()
+			for {
+				select {
+				case <-n.tun.Inbound:
+					atomic.AddInt64(&delivered, 1)
+				case <-stopDrain:
+					return
+				}
+			}
+		}(n)
+	}
+
+	err := func() error {
+		for _, n := range nodes {
+			var b strings.Builder
+			fmt.Fprintf(&b, "private_key=%s\nlisten_port=%d\nreplace_peers=true\n", n.key.private.ToHex(), n.port)
+			for _, other := range nodes {
+				if other != n {
+					b.WriteString(n.meshPeer(other))
+				}
+			}
+			for len(n.phantom) < config.PeersPerDevice-(config.Devices-1) {
+				kp, err := newKeyPair()
+				if err != nil {
+					return err
+				}
+				n.phantom = append(n.phantom, kp)
+				b.WriteString(phantomPeer(kp, 1+rng.Intn(65535)))
+			}
+			if err := n.dev.IpcSet(b.String()); err != nil {
+				return err
+			}
+			n.dev.Up()
+		}
+
+		deadline := time.Now().Add(config.Duration)
+		for time.Now().Before(deadline) {
+			n := nodes[rng.Intn(len(nodes))]
+			switch op := rng.Intn(6); {
+			case op == 0 && len(n.phantom) > 0:
+				// replace a phantom peer by one with a fresh key
+				i := rng.Intn(len(n.phantom))
+				kp, err := newKeyPair()
+				if err != nil {
+					return err
+				}
+				conf := fmt.Sprintf("public_key=%s\nremove=true\n", n.phantom[i].public.ToHex()) + phantomPeer(kp, 1+rng.Intn(65535))
+				if err := n.dev.IpcSet(conf); err != nil {
+					return fmt.Errorf("replacing peer: %v", err)
+				}
+				n.phantom[i] = kp
+			case op == 1 && len(n.phantom) > 0:
+				// move a phantom peer somewhere else
+				kp := n.phantom[rng.Intn(len(n.phantom))]
+				if err := n.dev.IpcSet(phantomPeer(kp, 1+rng.Intn(65535))); err != nil {
+					return fmt.Errorf("moving peer: %v", err)
+				}
+			case op == 2:
+				// re-add a mesh peer from scratch, dropping its sessions
+				other := nodes[rng.Intn(len(nodes))]
+				if other == n {
+					continue
+				}
+				conf := fmt.Sprintf("public_key=%s\nremove=true\n", other.key.public.ToHex()) + n.meshPeer(other)
+				if err := n.dev.IpcSet(conf); err != nil {
+					return fmt.Errorf("re-adding peer: %v", err)
+				}
+			case op == 3 && rng.Intn(10) == 0:
+				n.dev.Down()
+				n.dev.Up()
+			default:
+				other := nodes[rng.Intn(len(nodes))]
+				if other == n {
+					continue
+				}
+				select {
+				case n.tun.Outbound <- tuntest.Ping(other.addr, n.addr):
+					result.PingsSent++
+				case <-time.After(100 * time.Millisecond):
+				}
+				continue
+			}
+			result.Operations++
+		}
+		return nil
+	}()
+
+	for _, n := range nodes {
+		n.dev.Close()
+	}
+	close(stopDrain)
+	drain.Wait()
+	result.PingsDelivered = int(delivered)
+	if err != nil {
+		return result, err
+	}
+
+	// give stopped routines a moment to unwind before calling them leaked
+
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > baseline; {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			return result, fmt.Errorf("%d goroutines leaked (baseline %d):\n%s", runtime.NumGoroutine()-baseline, baseline, buf)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// closed devices must not keep their buffers reachable
+
+	nodes = nil
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	if mem.HeapAlloc > baselineMem.HeapAlloc+maxRetainedHeap {
+		return result, fmt.Errorf("heap grew from %d to %d bytes after teardown", baselineMem.HeapAlloc, mem.HeapAlloc)
+	}
+	return result, nil
+}
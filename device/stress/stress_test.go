@@ -0,0 +1,42 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package stress
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+var long = flag.Bool("long", false, "run the long soak test")
+
+func TestChurn(t *testing.T) {
+	config := Config{
+		Devices:        3,
+		PeersPerDevice: 8,
+		Duration:       time.Second,
+		LogLevel:       device.LogLevelSilent,
+		Seed:           1,
+	}
+	if *long {
+		config.Devices = 8
+		config.PeersPerDevice = 200
+		config.Duration = 10 * time.Minute
+		config.LogLevel = device.LogLevelError
+		config.Seed = time.Now().UnixNano()
+	}
+	t.Logf("config %+v", config)
+	result, err := Run(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("result %+v", result)
+	if result.PingsDelivered == 0 {
+		t.Error("no ping made it through the mesh")
+	}
+}
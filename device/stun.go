@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+)
+
+/* STUN binding requests (RFC 5389)
+ *
+ * Just enough of STUN to learn the server reflexive address of the
+ * listen port: binding requests without attributes are sent through the
+ * bind of the device, and the mapped address of the success responses,
+ * which arrive on the listen port among the messages of peers, is read.
+ * STUN messages are told apart from WireGuard messages by their magic
+ * cookie.
+ */
+
+const (
+	stunHeaderSize       = 20
+	stunMagicCookie      = 0x2112a442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+	stunFamilyIPv4       = 0x01
+	stunFamilyIPv6       = 0x02
+)
+
+type stunTransaction [12]byte
+
+// newSTUNRequest returns a binding request and its transaction ID.
+func newSTUNRequest() ([]byte, stunTransaction, error) {
+	var tx stunTransaction
+	if _, err := rand.Read(tx[:]); err != nil {
+		return nil, tx, err
+	}
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], tx[:])
+	return request, tx, nil
+}
+
+// isSTUNMessage reports whether packet is a STUN message.
+func isSTUNMessage(packet []byte) bool {
+	return len(packet) >= stunHeaderSize &&
+		packet[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(packet[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(packet[2:4])) == len(packet)-stunHeaderSize
+}
+
+// parseSTUNResponse returns the transaction ID and mapped address of a
+// binding success response, false if packet is anything else.
+func parseSTUNResponse(packet []byte) (stunTransaction, *net.UDPAddr, bool) {
+	var tx stunTransaction
+	if !isSTUNMessage(packet) || binary.BigEndian.Uint16(packet[0:2]) != stunBindingSuccess {
+		return tx, nil, false
+	}
+	copy(tx[:], packet[8:20])
+
+	var mapped *net.UDPAddr
+	attributes := packet[stunHeaderSize:]
+	for len(attributes) >= 4 {
+		kind := binary.BigEndian.Uint16(attributes[0:2])
+		length := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+length > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+length]
+		switch kind {
+		case stunXorMappedAddress:
+			if addr := parseSTUNAddress(value, packet[4:20]); addr != nil {
+				return tx, addr, true
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+		attributes = attributes[4+(length+3)&^3:]
+	}
+	return tx, mapped, mapped != nil
+}
+
+// parseSTUNAddress parses an address attribute, XORed with the magic
+// cookie and transaction ID in xor unless it is nil.
+func parseSTUNAddress(value []byte, xor []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = net.IPv4len
+	case stunFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) != 4+size {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, size)
+	copy(ip, value[4:])
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
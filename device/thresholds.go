@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Thresholds on the statistics of peers, for simple alerting without a
+ * polling loop in every consumer. While a peer has thresholds, they are
+ * checked every ThresholdInterval, emitting EventThresholdCrossed
+ * once a threshold is crossed and EventThresholdCleared once it no
+ * longer is, such as when a handshake completes after the peer went
+ * without one for too long. The time without a handshake is counted from
+ * the last handshake, or from when the thresholds were set.
+ */
+
+type ThresholdKind int
+
+const (
+	ThresholdNoHandshake = ThresholdKind(iota + 1) // no handshake completed for Thresholds.NoHandshake
+	ThresholdRxBytes                               // more than Thresholds.RxBytes received from the peer
+	ThresholdTxBytes                               // more than Thresholds.TxBytes sent to the peer
+)
+
+func (kind ThresholdKind) String() string {
+	switch kind {
+	case ThresholdNoHandshake:
+		return "ThresholdNoHandshake"
+	case ThresholdRxBytes:
+		return "ThresholdRxBytes"
+	case ThresholdTxBytes:
+		return "ThresholdTxBytes"
+	default:
+		return fmt.Sprintf("ThresholdKind(UNKNOWN:%d)", int(kind))
+	}
+}
+
+// Thresholds are the limits on the statistics of a peer, zero values
+// setting none.
+type Thresholds struct {
+	NoHandshake time.Duration // longest time without a completed handshake
+	RxBytes     uint64        // most bytes received from the peer
+	TxBytes     uint64        // most bytes sent to the peer
+}
+
+func (thresholds Thresholds) isZero() bool {
+	return thresholds == Thresholds{}
+}
+
+type peerThresholds struct {
+	sync.Mutex
+	limits  Thresholds
+	since   time.Time              // when the thresholds were set
+	crossed map[ThresholdKind]bool // thresholds crossed as of the last check
+	timer   ClockTimer
+}
+
+// SetThresholds replaces the thresholds of peer, forgetting which were
+// crossed. Zero thresholds stop checking the peer.
+func (peer *Peer) SetThresholds(thresholds Thresholds) {
+	peer.thresholds.Lock()
+	defer peer.thresholds.Unlock()
+
+	if peer.thresholds.timer != nil {
+		peer.thresholds.timer.Stop()
+		peer.thresholds.timer = nil
+	}
+	peer.thresholds.limits = thresholds
+	peer.thresholds.since = peer.device.now()
+	peer.thresholds.crossed = nil
+	if !thresholds.isZero() {
+		peer.thresholds.timer = peer.device.clock.AfterFunc(ThresholdInterval, func() {
+			peer.device.checkThresholds(peer)
+		})
+	}
+}
+
+// Thresholds returns the thresholds of peer.
+func (peer *Peer) Thresholds() Thresholds {
+	peer.thresholds.Lock()
+	defer peer.thresholds.Unlock()
+	return peer.thresholds.limits
+}
+
+// CrossedThresholds returns the thresholds of peer crossed as of the
+// last check.
+func (peer *Peer) CrossedThresholds() []ThresholdKind {
+	peer.thresholds.Lock()
+	defer peer.thresholds.Unlock()
+	var kinds []ThresholdKind
+	for _, kind := range []ThresholdKind{ThresholdNoHandshake, ThresholdRxBytes, ThresholdTxBytes} {
+		if peer.thresholds.crossed[kind] {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+func (peer *Peer) stopThresholds() {
+	peer.thresholds.Lock()
+	defer peer.thresholds.Unlock()
+	if peer.thresholds.timer != nil {
+		peer.thresholds.timer.Stop()
+		peer.thresholds.timer = nil
+	}
+}
+
+// SetPeerThresholds sets the thresholds of the peer with public key pk,
+// see Peer.SetThresholds.
+func (device *Device) SetPeerThresholds(pk NoisePublicKey, thresholds Thresholds) error {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.SetThresholds(thresholds)
+	return nil
+}
+
+// unsafeCrossedThresholds returns which thresholds of peer are crossed
+// now. The thresholds lock must be held.
+func (peer *Peer) unsafeCrossedThresholds() map[ThresholdKind]bool {
+	limits := peer.thresholds.limits
+	crossed := make(map[ThresholdKind]bool)
+	if limits.NoHandshake > 0 {
+		last := peer.thresholds.since
+		if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 && time.Unix(0, nano).After(last) {
+			last = time.Unix(0, nano)
+		}
+		crossed[ThresholdNoHandshake] = peer.device.since(last) >= limits.NoHandshake
+	}
+	if limits.RxBytes > 0 {
+		crossed[ThresholdRxBytes] = atomic.LoadUint64(&peer.stats.rxBytes) > limits.RxBytes
+	}
+	if limits.TxBytes > 0 {
+		crossed[ThresholdTxBytes] = atomic.LoadUint64(&peer.stats.txBytes) > limits.TxBytes
+	}
+	return crossed
+}
+
+// checkThresholds emits an event for every threshold of peer crossed or
+// cleared since the last check, and checks again after
+// ThresholdInterval.
+func (device *Device) checkThresholds(peer *Peer) {
+	peer.thresholds.Lock()
+	if peer.thresholds.timer == nil {
+		peer.thresholds.Unlock()
+		return
+	}
+	crossed := peer.unsafeCrossedThresholds()
+	var events []Event
+	for _, kind := range []ThresholdKind{ThresholdNoHandshake, ThresholdRxBytes, ThresholdTxBytes} {
+		if crossed[kind] == peer.thresholds.crossed[kind] {
+			continue
+		}
+		event := Event{Kind: EventThresholdCleared, Peer: peer.handshake.remoteStatic, Threshold: kind}
+		if crossed[kind] {
+			event.Kind = EventThresholdCrossed
+		}
+		events = append(events, event)
+	}
+	peer.thresholds.crossed = crossed
+	peer.thresholds.timer.Reset(ThresholdInterval)
+	peer.thresholds.Unlock()
+
+	for _, event := range events {
+		if event.Kind == EventThresholdCrossed {
+			device.log.Info.Println(peer, "- Crossed threshold", event.Threshold)
+		} else {
+			device.log.Debug.Println(peer, "- Cleared threshold", event.Threshold)
+		}
+		device.emitEvent(event)
+	}
+}
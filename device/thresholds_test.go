@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerThresholds(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	events := make(chan Event, 10)
+	dev.SetEventHandler(func(event Event) {
+		events <- event
+	})
+	next := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return Event{}
+		}
+	}
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	pk := sk.publicKey()
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nthreshold_no_handshake=180\nthreshold_rx_bytes=1000\n"))
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	peerConfig := config.Peers[0]
+	if limit := peerConfig.ThresholdNoHandshake; limit == nil || *limit != 3*time.Minute {
+		t.Errorf("no handshake threshold reported as %v, want %v", limit, 3*time.Minute)
+	}
+	if limit := peerConfig.ThresholdRxBytes; limit == nil || *limit != 1000 {
+		t.Errorf("rx bytes threshold reported as %v, want 1000", limit)
+	}
+	if peerConfig.ThresholdTxBytes != nil {
+		t.Errorf("tx bytes threshold reported as %v, want none", *peerConfig.ThresholdTxBytes)
+	}
+
+	// exceeding the quota crosses the threshold once
+
+	peer := dev.LookupPeer(pk)
+	atomic.StoreUint64(&peer.stats.rxBytes, 1001)
+	if event := next(); event.Kind != EventThresholdCrossed || event.Peer != pk || event.Threshold != ThresholdRxBytes {
+		t.Errorf("unexpected event %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(2 * ThresholdInterval):
+	}
+	if crossed := peer.CrossedThresholds(); len(crossed) != 1 || crossed[0] != ThresholdRxBytes {
+		t.Errorf("crossed thresholds %v", crossed)
+	}
+
+	// a handshake clears the threshold on the time without one
+
+	assertNil(t, dev.SetPeerThresholds(pk, Thresholds{NoHandshake: time.Millisecond}))
+	if event := next(); event.Kind != EventThresholdCrossed || event.Threshold != ThresholdNoHandshake {
+		t.Errorf("unexpected event %+v", event)
+	}
+	assertNil(t, dev.SetPeerThresholds(pk, Thresholds{NoHandshake: time.Hour}))
+	peer.thresholds.Lock()
+	peer.thresholds.crossed = map[ThresholdKind]bool{ThresholdNoHandshake: true}
+	peer.thresholds.Unlock()
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	if event := next(); event.Kind != EventThresholdCleared || event.Threshold != ThresholdNoHandshake {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	assertNil(t, dev.IpcSet("public_key="+pk.ToHex()+"\nthreshold_no_handshake=0\n"))
+	if thresholds := peer.Thresholds(); !thresholds.isZero() {
+		t.Errorf("thresholds %+v left after clearing", thresholds)
+	}
+	if err := dev.SetPeerThresholds(NoisePublicKey{1}, Thresholds{RxBytes: 1}); err != ErrPeerNotFound {
+		t.Errorf("setting thresholds of unknown peer: %v", err)
+	}
+}
@@ -19,15 +19,17 @@ import (
  */
 
 type Timer struct {
-	*time.Timer
+	ClockTimer
 	modifyingLock sync.RWMutex
 	runningLock   sync.Mutex
 	isPending     bool
+	deadline      time.Time // when a pending timer fires
+	now           func() time.Time
 }
 
 func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
-	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
+	timer := &Timer{now: peer.device.now}
+	timer.ClockTimer = peer.device.clock.AfterFunc(time.Hour, func() {
 		timer.runningLock.Lock()
 
 		timer.modifyingLock.Lock()
@@ -49,6 +51,7 @@ func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
 func (timer *Timer) Mod(d time.Duration) {
 	timer.modifyingLock.Lock()
 	timer.isPending = true
+	timer.deadline = timer.now().Add(d)
 	timer.Reset(d)
 	timer.modifyingLock.Unlock()
 }
@@ -73,13 +76,75 @@ func (timer *Timer) IsPending() bool {
 	return timer.isPending
 }
 
+// Deadline returns when the timer fires, false if it is not pending.
+func (timer *Timer) Deadline() (time.Time, bool) {
+	timer.modifyingLock.RLock()
+	defer timer.modifyingLock.RUnlock()
+	return timer.deadline, timer.isPending
+}
+
 func (peer *Peer) timersActive() bool {
-	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && len(peer.device.peers.keyMap) > 0
+	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && peer.device.PeerCount() > 0
+}
+
+// Quiesce suspends keepalives and handshake retransmissions of all peers
+// for duration, e.g. while the host sleeps. Configuration and sessions are
+// left alone, and handshakes caused by outgoing traffic still take place.
+// Suppressed timers fire once the quiet period is over. Calling Quiesce
+// again replaces the quiet period, a zero duration ends it.
+func (device *Device) Quiesce(duration time.Duration) {
+	device.quietUntil.Store(device.now().Add(duration))
+	if duration > 0 {
+		device.log.Debug.Println("Suspending keepalives and handshake retries for", duration)
+		return
+	}
+
+	device.log.Debug.Println("Resuming keepalives and handshake retries")
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if !peer.timersActive() {
+			continue
+		}
+		if peer.timers.retransmitHandshake.IsPending() {
+			peer.timers.retransmitHandshake.Mod(0)
+		}
+		if peer.timers.persistentKeepalive.IsPending() {
+			peer.timers.persistentKeepalive.Mod(0)
+		}
+	}
+}
+
+func (device *Device) quietRemaining() time.Duration {
+	return device.quietUntil.Load().(time.Time).Sub(device.now())
+}
+
+/* Reschedules timer to the end of the quiet period, if there is one
+ */
+func (peer *Peer) timersPostponeIfQuiet(timer *Timer) bool {
+	remaining := peer.device.quietRemaining()
+	if remaining <= 0 {
+		return false
+	}
+	if peer.timersActive() {
+		timer.Mod(remaining)
+	}
+	return true
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
+	if peer.timersPostponeIfQuiet(peer.timers.retransmitHandshake) {
+		return
+	}
 	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+		peer.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+		atomic.AddUint64(&peer.stats.handshakeAttemptsExhausted, 1)
+		peer.device.emitEvent(Event{
+			Kind:     EventHandshakeAttemptsExhausted,
+			Peer:     peer.handshake.remoteStatic,
+			Attempts: MaxTimerHandshakes + 2,
+		})
+		peer.device.handshakeExhausted(peer)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -94,11 +159,17 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(peer.device.rejectAfterTime() * 3)
 		}
 	} else {
-		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		attempts := atomic.AddUint32(&peer.timers.handshakeAttempts, 1) + 1
+		peer.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), attempts)
+		atomic.AddUint64(&peer.stats.handshakeRetransmits, 1)
+		peer.device.emitEvent(Event{
+			Kind:     EventHandshakeRetransmit,
+			Peer:     peer.handshake.remoteStatic,
+			Attempts: attempts,
+		})
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
@@ -112,6 +183,9 @@ func expiredRetransmitHandshake(peer *Peer) {
 }
 
 func expiredSendKeepalive(peer *Peer) {
+	if peer.device.quietRemaining() > 0 {
+		return
+	}
 	peer.SendKeepalive()
 	if peer.timers.needAnotherKeepalive.Get() {
 		peer.timers.needAnotherKeepalive.Set(false)
@@ -122,7 +196,10 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	if peer.timersPostponeIfQuiet(peer.timers.newHandshake) {
+		return
+	}
+	peer.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
 	if peer.endpoint != nil {
@@ -134,11 +211,14 @@ func expiredNewHandshake(peer *Peer) {
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Debug.Printf("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.log.Debug.Printf("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((peer.device.rejectAfterTime() * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
+	if peer.timersPostponeIfQuiet(peer.timers.persistentKeepalive) {
+		return
+	}
 	if peer.persistentKeepaliveInterval > 0 {
 		peer.SendKeepalive()
 	}
@@ -181,6 +261,7 @@ func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
 	}
+	atomic.CompareAndSwapInt64(&peer.stats.handshakePendingSinceNano, 0, peer.device.now().UnixNano())
 }
 
 /* Should be called after a handshake response message is received and processed or when getting key confirmation via the first data message. */
@@ -190,13 +271,18 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
-	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	now := peer.device.now().UnixNano()
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, now)
+	atomic.StoreInt64(&peer.stats.handshakePendingSinceNano, 0)
+	if atomic.CompareAndSwapInt64(&peer.stats.connectedSinceNano, 0, now) {
+		peer.startMTUProbing()
+	}
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.device.rejectAfterTime() * 3)
 	}
 }
 
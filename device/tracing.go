@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"context"
+	"errors"
+)
+
+/* Tracing
+ *
+ * Handshakes and configuration operations are traced as spans, so that
+ * operators can correlate the events of the tunnel with the traces of
+ * their applications. The device depends on no tracing library: the
+ * Tracer set by DeviceOptions.Tracer adapts one, such as OpenTelemetry,
+ * see the module golang.zx2c4.com/wireguard/otel. Without a Tracer,
+ * nothing is traced.
+ *
+ * Handshake spans are roots, as no application context leads to them.
+ * Configuration operations started through IpcSetContext and
+ * IpcGetContext are children of the span of their context.
+ *
+ * Public keys and endpoints in attributes are redacted like in logs,
+ * see SetLogRedaction.
+ */
+
+// A Tracer starts spans, as children of the span of ctx if any.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is an operation being traced.
+type Span interface {
+	// SetAttribute annotates the span, value being a string, an int64
+	// or a bool.
+	SetAttribute(key string, value interface{})
+
+	// End ends the span, which failed with err unless it is nil.
+	End(err error)
+}
+
+// Names of the spans traced.
+const (
+	SpanHandshakeInitiate   = "wireguard.handshake.initiate"   // sending a handshake initiation
+	SpanHandshakeInitiation = "wireguard.handshake.initiation" // consuming a handshake initiation, answering it
+	SpanHandshakeResponse   = "wireguard.handshake.response"   // consuming a handshake response, completing the handshake
+	SpanIPCSet              = "wireguard.ipc.set"
+	SpanIPCGet              = "wireguard.ipc.get"
+)
+
+// Keys of the attributes of spans.
+const (
+	AttributePeer   = "wireguard.peer"   // public key of the peer
+	AttributeSource = "wireguard.source" // endpoint a handshake message came from, "out of band" if none
+	AttributeRetry  = "wireguard.retry"  // handshake initiation retried after a timeout
+	AttributeActor  = "wireguard.actor"  // client of a set operation, as in audit records
+	AttributePeers  = "wireguard.peers"  // number of peers, after a configuration operation
+)
+
+// Reasons handshake messages are refused, with which their spans end.
+var (
+	errInvalidHandshake  = errors.New("invalid handshake message")
+	errDisallowedSource  = errors.New("disallowed source")
+	errPeerExpired       = errors.New("peer expired")
+	errPeerDisabled      = errors.New("peer disabled")
+	errMultiLoginBlocked = errors.New("rejecting multi-login")
+)
+
+type noSpan struct{}
+
+func (noSpan) SetAttribute(string, interface{}) {}
+func (noSpan) End(error)                        {}
+
+// startSpan starts the span name with the tracer of the device.
+func (device *Device) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if device.tracer == nil {
+		return ctx, noSpan{}
+	}
+	return device.tracer.Start(ctx, name)
+}
+
+// tracedSet performs the set operation read from socket on behalf of
+// actor, see auditedSet, traced as a child of the span of ctx.
+func (device *Device) tracedSet(ctx context.Context, socket *bufio.Reader, actor string) error {
+	return device.tracedIPC(ctx, SpanIPCSet, actor, func() error {
+		return device.auditedSet(socket, actor)
+	})
+}
+
+// tracedGet performs the get operation of the given version writing to
+// socket, see ipcGetOperation, traced as a child of the span of ctx.
+func (device *Device) tracedGet(ctx context.Context, socket *bufio.Writer, secrets bool, version int) error {
+	return device.tracedIPC(ctx, SpanIPCGet, "", func() error {
+		return device.ipcGetOperation(socket, secrets, version)
+	})
+}
+
+// tracedIPC performs operation, traced as the span name, on behalf of
+// actor if not empty.
+func (device *Device) tracedIPC(ctx context.Context, name, actor string, operation func() error) error {
+	_, span := device.startSpan(ctx, name)
+	if actor != "" {
+		span.SetAttribute(AttributeActor, actor)
+	}
+	err := operation()
+	span.SetAttribute(AttributePeers, int64(device.PeerCount()))
+	span.End(err)
+	return err
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type recordedSpan struct {
+	tracer     *recordingTracer
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	err        error
+}
+
+func (span *recordedSpan) SetAttribute(key string, value interface{}) {
+	span.tracer.Lock()
+	defer span.tracer.Unlock()
+	span.attributes[key] = value
+}
+
+func (span *recordedSpan) End(err error) {
+	span.tracer.Lock()
+	defer span.tracer.Unlock()
+	span.err = err
+	span.tracer.ended = append(span.tracer.ended, span)
+}
+
+type spanKey struct{}
+
+// recordingTracer records the spans ended.
+type recordingTracer struct {
+	sync.Mutex
+	ended []*recordedSpan
+}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{tracer: tracer, name: name, attributes: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(string); ok {
+		span.parent = parent
+	}
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (tracer *recordingTracer) spans(name string) []recordedSpan {
+	tracer.Lock()
+	defer tracer.Unlock()
+	var spans []recordedSpan
+	for _, span := range tracer.ended {
+		if span.name == name {
+			spans = append(spans, *span)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	var tracers [2]recordingTracer
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	var keys [2]NoisePrivateKey
+	addrs := [2]net.IP{net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)}
+	for i := range devs {
+		var err error
+		keys[i], err = newPrivateKey()
+		assertNil(t, err)
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDeviceWithOptions(tuns[i].TUN(), NewLogger(LogLevelError, fmt.Sprintf("dev%d: ", i+1)), DeviceOptions{
+			CreateBind: binds[i].Open,
+			Tracer:     &tracers[i],
+		})
+		defer devs[i].Close()
+	}
+	for i := range devs {
+		other := 1 - i
+		assertNil(t, devs[i].IpcSetContext(context.WithValue(context.Background(), spanKey{}, "application"), fmt.Sprintf("private_key=%s\nlisten_port=%d\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			keys[i].ToHex(), 51820+i, keys[other].publicKey().ToHex(), addrs[other], 51820+other)))
+		devs[i].Up()
+	}
+
+	tuns[0].Outbound <- tuntest.Ping(addrs[1], addrs[0])
+	select {
+	case <-tuns[1].Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake did not complete")
+	}
+
+	sets := tracers[0].spans(SpanIPCSet)
+	if len(sets) != 1 || sets[0].parent != "application" || sets[0].attributes[AttributeActor] != "api" ||
+		sets[0].attributes[AttributePeers] != int64(1) || sets[0].err != nil {
+		t.Errorf("set spans = %+v", sets)
+	}
+
+	// the initiator sends the initiation and consumes the response, the
+	// responder consumes the initiation, the spans ending once done
+
+	peerKeys := [2]string{devs[0].redactKey(keys[1].publicKey()), devs[1].redactKey(keys[0].publicKey())}
+	for i, expected := range []struct {
+		tracer int
+		name   string
+	}{
+		{0, SpanHandshakeInitiate},
+		{1, SpanHandshakeInitiation},
+		{0, SpanHandshakeResponse},
+	} {
+		var spans []recordedSpan
+		for start := time.Now(); len(spans) == 0 && time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			spans = tracers[expected.tracer].spans(expected.name)
+		}
+		if len(spans) == 0 {
+			t.Fatalf("%d: no %s span", i, expected.name)
+		}
+		span := spans[0]
+		if span.attributes[AttributePeer] != peerKeys[expected.tracer] || span.err != nil || span.parent != "" {
+			t.Errorf("%d: %s span = %+v", i, expected.name, span)
+		}
+		if expected.name != SpanHandshakeInitiate && span.attributes[AttributeSource] != "127.0.0.1:"+fmt.Sprint(51821-expected.tracer) {
+			t.Errorf("%d: %s span has source %v", i, expected.name, span.attributes[AttributeSource])
+		}
+	}
+
+	if _, err := devs[1].IpcGet(); err != nil {
+		t.Fatal(err)
+	}
+	if gets := tracers[1].spans(SpanIPCGet); len(gets) != 1 || gets[0].parent != "" || gets[0].err != nil {
+		t.Errorf("get spans = %+v", gets)
+	}
+}
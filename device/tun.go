@@ -14,6 +14,8 @@ import (
 const DefaultMTU = 1420
 
 func (device *Device) RoutineTUNEventReader() {
+	defer device.trackRoutine(routineTUNEvents)()
+
 	setUp := false
 	logDebug := device.log.Debug
 	logInfo := device.log.Info
@@ -31,6 +31,7 @@ type dummyTUN struct {
 
 func (d *dummyTUN) Events() chan tun.Event { return d.events }
 func (*dummyTUN) File() *os.File           { return nil }
+func (*dummyTUN) BatchSize() int           { return 1 }
 func (*dummyTUN) Flush() error             { return nil }
 func (d *dummyTUN) MTU() (int, error)      { return d.mtu, nil }
 func (d *dummyTUN) Name() (string, error)  { return d.name, nil }
@@ -54,3 +55,21 @@ func (d *dummyTUN) Write(b []byte, offset int) (int, error) {
 	d.packets <- b[offset:]
 	return len(b), nil
 }
+
+func (d *dummyTUN) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := d.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func (d *dummyTUN) WritePackets(buffs [][]byte, offset int) (int, error) {
+	for i, buff := range buffs {
+		if _, err := d.Write(buff, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(buffs), nil
+}
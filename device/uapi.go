@@ -7,6 +7,7 @@ package device
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -21,22 +22,110 @@ import (
 )
 
 type IPCError struct {
-	int64
+	code int64 // UAPI errno
+	err  error // cause, usually wrapping one of the Err* values
 }
 
 func (s IPCError) Error() string {
-	return fmt.Sprintf("IPC error: %d", s.int64)
+	if s.err == nil {
+		return fmt.Sprintf("IPC error: %d", s.code)
+	}
+	return fmt.Sprintf("IPC error %d: %v", s.code, s.err)
 }
 
 func (s IPCError) ErrorCode() int64 {
-	return s.int64
+	return s.code
+}
+
+func (s IPCError) Unwrap() error {
+	return s.err
+}
+
+func ipcErrorf(code int64, format string, args ...interface{}) *IPCError {
+	return &IPCError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// IPCLineError annotates the IPCError caused by a configuration
+// line passed to IpcSetOperation with the number of that line.
+type IPCLineError struct {
+	Line int
+	Err  *IPCError
+}
+
+func (s *IPCLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", s.Line, s.Err)
+}
+
+func (s *IPCLineError) Unwrap() error {
+	return s.Err
+}
+
+// IpcGet returns the current configuration of the device
+// in the format of the UAPI get operation, get=1.
+func (device *Device) IpcGet() (string, error) {
+	return device.IpcGetContext(context.Background())
+}
+
+// IpcGetContext is IpcGet, traced as a child of the span of ctx, see
+// Tracer.
+func (device *Device) IpcGetContext(ctx context.Context) (string, error) {
+	return device.ipcGetContext(ctx, 1)
+}
+
+// ipcGetContext is IpcGetContext for the given version of the protocol.
+func (device *Device) ipcGetContext(ctx context.Context, version int) (string, error) {
+	var uapiConf string
+	err := device.tracedIPC(ctx, SpanIPCGet, "", func() (err error) {
+		uapiConf, err = device.ipcGet(version)
+		return err
+	})
+	return uapiConf, err
+}
+
+// ipcGet returns the configuration of the device like IpcGet, for the
+// given version of the protocol and without tracing, for internal use.
+func (device *Device) ipcGet(version int) (string, error) {
+	var buf strings.Builder
+	writer := bufio.NewWriter(&buf)
+	if err := device.ipcGetOperation(writer, true, version); err != nil {
+		return "", err
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// IpcSet applies a configuration in the format of the UAPI set operation.
+func (device *Device) IpcSet(uapiConf string) error {
+	return device.IpcSetContext(context.Background(), uapiConf)
+}
+
+// IpcSetContext is IpcSet, traced as a child of the span of ctx, see
+// Tracer.
+func (device *Device) IpcSetContext(ctx context.Context, uapiConf string) error {
+	return device.tracedSet(ctx, bufio.NewReader(strings.NewReader(uapiConf)), "api")
 }
 
 func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
+	return device.tracedGet(context.Background(), socket, true, 1)
+}
+
+// ipcGetOperation serializes the configuration of the device, leaving
+// out the private and preshared keys unless secrets is set. The keys
+// extending the protocol are only sent if the client asked for a later
+// version than 1, as clients of the reference protocol, such as wg(8),
+// reject keys they do not know.
+func (device *Device) ipcGetOperation(socket *bufio.Writer, secrets bool, version int) error {
 	lines := make([]string, 0, 100)
 	send := func(line string) {
 		lines = append(lines, line)
 	}
+	extend := func(line string) {
+		if version > 1 {
+			send(line)
+		}
+	}
 
 	func() {
 
@@ -51,9 +140,16 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 		device.peers.RLock()
 		defer device.peers.RUnlock()
 
+		// advertise protocol extensions
+
+		extend(fmt.Sprintf("uapi_version=%d", negotiatedUAPIVersion(version)))
+		for _, capability := range uapiCapabilities {
+			extend("capability=" + capability)
+		}
+
 		// serialize device related values
 
-		if !device.staticIdentity.privateKey.IsZero() {
+		if secrets && !device.staticIdentity.privateKey.IsZero() {
 			send("private_key=" + device.staticIdentity.privateKey.ToHex())
 		}
 
@@ -65,6 +161,28 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
 		}
 
+		if device.relay.Get() {
+			extend("relay=true")
+		}
+		for _, rule := range device.RelayRules() {
+			extend("relay_rule=" + rule.String())
+		}
+		if device.mssClamping.Get() {
+			extend("mss_clamp=true")
+		}
+
+		networks, learn := device.ReceiveAllowlist()
+		for _, network := range networks {
+			extend("receive_allowlist=" + network.String())
+		}
+		if learn {
+			extend("receive_allowlist_learn=true")
+		}
+
+		if upSince := device.UpSince(); !upSince.IsZero() {
+			extend(fmt.Sprintf("up_since_sec=%d", upSince.Unix()))
+		}
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -72,11 +190,16 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			defer peer.RUnlock()
 
 			send("public_key=" + peer.handshake.remoteStatic.ToHex())
-			send("preshared_key=" + peer.handshake.presharedKey.ToHex())
+			if secrets {
+				send("preshared_key=" + peer.handshake.presharedKey.ToHex())
+			}
 			send("protocol_version=1")
 			if peer.endpoint != nil {
 				send("endpoint=" + peer.endpoint.DstToString())
 			}
+			if host := peer.EndpointHost(); host != "" {
+				extend("endpoint_host=" + host)
+			}
 
 			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
 			secs := nano / time.Second.Nanoseconds()
@@ -84,13 +207,75 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 
 			send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
 			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
+			if nano := atomic.LoadInt64(&peer.stats.connectedSinceNano); nano != 0 {
+				extend(fmt.Sprintf("connected_since_sec=%d", nano/time.Second.Nanoseconds()))
+			}
 			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
 			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
 			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			if mtu := peer.ProbedMTU(); mtu != 0 {
+				extend(fmt.Sprintf("probed_mtu=%d", mtu))
+			}
+			if expiry := peer.Expiry(); !expiry.IsZero() {
+				extend(fmt.Sprintf("expires_at=%d", expiry.Unix()))
+			}
+			if timeout := peer.Ephemeral(); timeout != 0 {
+				extend(fmt.Sprintf("ephemeral=%d", int64(timeout/time.Second)))
+			}
+			thresholds := peer.Thresholds()
+			if thresholds.NoHandshake != 0 {
+				extend(fmt.Sprintf("threshold_no_handshake=%d", int64(thresholds.NoHandshake/time.Second)))
+			}
+			if thresholds.RxBytes != 0 {
+				extend(fmt.Sprintf("threshold_rx_bytes=%d", thresholds.RxBytes))
+			}
+			if thresholds.TxBytes != 0 {
+				extend(fmt.Sprintf("threshold_tx_bytes=%d", thresholds.TxBytes))
+			}
+			quota := peer.Quota()
+			if quota.TxBytes != 0 {
+				extend(fmt.Sprintf("quota_tx_bytes=%d", quota.TxBytes))
+			}
+			if quota.RxBytes != 0 {
+				extend(fmt.Sprintf("quota_rx_bytes=%d", quota.RxBytes))
+			}
+			if quota.Period != 0 {
+				extend(fmt.Sprintf("quota_period=%d", int64(quota.Period/time.Second)))
+			}
+			if quota.Action != QuotaDrop {
+				extend("quota_action=" + quota.Action.String())
+			}
+			if policy := peer.MultiLoginPolicy(); policy != MultiLoginAllow {
+				extend("multi_login=" + policy.String())
+			}
+			if peer.Disabled() {
+				extend("disabled=true")
+			}
+			if peer.ResponderOnly() {
+				extend("responder_only=true")
+			}
+			if peer.obfuscation != nil {
+				extend("obfuscation=" + peer.obfuscation.Name())
+			}
 
 			for _, ip := range device.allowedips.EntriesForPeer(peer) {
 				send("allowed_ip=" + ip.String())
 			}
+			for _, network := range peer.AllowedSources() {
+				extend("allowed_source=" + network.String())
+			}
+			if priority := peer.FailoverPriority(); priority != 0 {
+				extend(fmt.Sprintf("failover_priority=%d", priority))
+			}
+			for _, network := range peer.BackupAllowedIPs() {
+				extend("backup_allowed_ip=" + network.String())
+			}
+			if weight := peer.BalanceWeight(); weight != DefaultBalanceWeight {
+				extend(fmt.Sprintf("balance_weight=%d", weight))
+			}
+			for _, network := range peer.BalancedAllowedIPs() {
+				extend("balanced_allowed_ip=" + network.String())
+			}
 
 		}
 	}()
@@ -100,7 +285,7 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 	for _, line := range lines {
 		_, err := socket.WriteString(line + "\n")
 		if err != nil {
-			return &IPCError{ipc.IpcErrorIO}
+			return &IPCError{code: ipc.IpcErrorIO, err: err}
 		}
 	}
 
@@ -108,12 +293,23 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 }
 
 func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
+	return device.tracedSet(context.Background(), socket, "api")
+}
+
+func (device *Device) ipcSetOperation(socket *bufio.Reader) (err error) {
 	scanner := bufio.NewScanner(socket)
 	logError := device.log.Error
 	logDebug := device.log.Debug
 
 	var peer *Peer
 
+	lineNumber := 0
+	defer func() {
+		if status, ok := err.(*IPCError); ok {
+			err = &IPCLineError{Line: lineNumber, Err: status}
+		}
+	}()
+
 	dummy := false
 	createdNewPeer := false
 	deviceConfig := true
@@ -122,13 +318,14 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 		// parse line
 
+		lineNumber++
 		line := scanner.Text()
 		if line == "" {
 			return nil
 		}
 		parts := strings.Split(line, "=")
 		if len(parts) != 2 {
-			return &IPCError{ipc.IpcErrorProtocol}
+			return ipcErrorf(ipc.IpcErrorProtocol, "%w", ErrMalformedLine)
 		}
 		key := parts[0]
 		value := parts[1]
@@ -138,12 +335,29 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 		if deviceConfig {
 
 			switch key {
+			case "uapi_version":
+				version, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to parse uapi_version:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: uapi_version: %v", ErrInvalidValue, err)
+				}
+				if version > UAPIVersion {
+					logError.Println("Unsupported UAPI version:", version)
+					return ipcErrorf(ipc.IpcErrorProtocol, "%w: uapi_version %d", ErrUnsupported, version)
+				}
+
+			case "require":
+				if !hasCapability(value) {
+					logError.Println("Unsupported capability required:", value)
+					return ipcErrorf(ipc.IpcErrorProtocol, "%w: capability %q", ErrUnsupported, value)
+				}
+
 			case "private_key":
 				var sk NoisePrivateKey
 				err := sk.FromMaybeZeroHex(value)
 				if err != nil {
 					logError.Println("Failed to set private_key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: private_key: %v", ErrInvalidKey, err)
 				}
 				logDebug.Println("UAPI: Updating private key")
 				device.SetPrivateKey(sk)
@@ -155,7 +369,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				port, err := strconv.ParseUint(value, 10, 16)
 				if err != nil {
 					logError.Println("Failed to parse listen_port:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: listen_port: %v", ErrInvalidValue, err)
 				}
 
 				// update port and rebind
@@ -168,7 +382,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				if err := device.BindUpdate(); err != nil {
 					logError.Println("Failed to set listen_port:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
+					return ipcErrorf(ipc.IpcErrorPortInUse, "%w: %v", ErrPortInUse, err)
 				}
 
 			case "fwmark":
@@ -185,15 +399,78 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				if err != nil {
 					logError.Println("Invalid fwmark", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: fwmark: %v", ErrInvalidValue, err)
 				}
 
 				logDebug.Println("UAPI: Updating fwmark")
 
 				if err := device.BindSetMark(uint32(fwmark)); err != nil {
 					logError.Println("Failed to update fwmark:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
+					return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
+				}
+
+			case "relay":
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set relay, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: relay: %q", ErrInvalidValue, value)
+				}
+				logDebug.Println("UAPI: Updating relay mode")
+				device.SetRelay(value == "true")
+
+			case "mss_clamp":
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set mss_clamp, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: mss_clamp: %q", ErrInvalidValue, value)
+				}
+				logDebug.Println("UAPI: Updating MSS clamping")
+				device.SetMSSClamping(value == "true")
+
+			case "replace_relay_rules":
+				if value != "true" {
+					logError.Println("Failed to set replace_relay_rules, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_relay_rules: %q", ErrInvalidValue, value)
+				}
+				logDebug.Println("UAPI: Removing all relay rules")
+				device.SetRelayRules(nil)
+
+			case "relay_rule":
+				rule, err := ParseRelayRule(value)
+				if err == nil {
+					err = device.SetRelayRules(append(device.RelayRules(), rule))
+				}
+				if err != nil {
+					logError.Println("Failed to add relay rule", value+":", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "relay_rule: %w", err)
+				}
+				logDebug.Println("UAPI: Adding relay rule", value)
+
+			case "replace_receive_allowlist":
+				if value != "true" {
+					logError.Println("Failed to set replace_receive_allowlist, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_receive_allowlist: %q", ErrInvalidValue, value)
+				}
+				logDebug.Println("UAPI: Removing all networks from the receive allowlist")
+				_, learn := device.ReceiveAllowlist()
+				device.SetReceiveAllowlist(nil, learn)
+
+			case "receive_allowlist":
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to add to receive allowlist:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
+				}
+				logDebug.Println("UAPI: Adding", network, "to the receive allowlist")
+				networks, learn := device.ReceiveAllowlist()
+				device.SetReceiveAllowlist(append(networks, *network), learn)
+
+			case "receive_allowlist_learn":
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set receive_allowlist_learn, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: receive_allowlist_learn: %q", ErrInvalidValue, value)
 				}
+				logDebug.Println("UAPI: Updating learning of the receive allowlist")
+				networks, _ := device.ReceiveAllowlist()
+				device.SetReceiveAllowlist(networks, value == "true")
 
 			case "public_key":
 				// switch to peer configuration
@@ -203,14 +480,14 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 			case "replace_peers":
 				if value != "true" {
 					logError.Println("Failed to set replace_peers, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_peers: %q", ErrInvalidValue, value)
 				}
 				logDebug.Println("UAPI: Removing all peers")
 				device.RemoveAllPeers()
 
 			default:
 				logError.Println("Invalid UAPI device key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				return ipcErrorf(ipc.IpcErrorInvalid, "%w: %q", ErrUnknownConfigKey, key)
 			}
 		}
 
@@ -225,7 +502,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				err := publicKey.FromHex(value)
 				if err != nil {
 					logError.Println("Failed to get peer by public key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: public_key: %v", ErrInvalidKey, err)
 				}
 
 				// ignore peer with public key of device
@@ -245,7 +522,10 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					peer, err = device.NewPeer(publicKey)
 					if err != nil {
 						logError.Println("Failed to create new peer:", err)
-						return &IPCError{ipc.IpcErrorInvalid}
+						if errors.Is(err, ErrTooManyPeers) {
+							return ipcErrorf(ipc.IpcErrorQuota, "failed to create peer: %w", err)
+						}
+						return ipcErrorf(ipc.IpcErrorInvalid, "failed to create peer: %w", err)
 					}
 					if peer == nil {
 						dummy = true
@@ -261,7 +541,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				if value != "true" {
 					logError.Println("Failed to set update only, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: update_only: %q", ErrInvalidValue, value)
 				}
 				if createdNewPeer && !dummy {
 					device.RemovePeer(peer.handshake.remoteStatic)
@@ -275,7 +555,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				if value != "true" {
 					logError.Println("Failed to set remove, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: remove: %q", ErrInvalidValue, value)
 				}
 				if !dummy {
 					logDebug.Println(peer, "- UAPI: Removing")
@@ -284,6 +564,19 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				peer = &Peer{}
 				dummy = true
 
+			case "expire_sessions":
+
+				// zero keypairs of currently selected peer and handshake again
+
+				if value != "true" {
+					logError.Println("Failed to expire sessions, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: expire_sessions: %q", ErrInvalidValue, value)
+				}
+				if !dummy {
+					logDebug.Println(peer, "- UAPI: Expiring sessions")
+					peer.ExpireSessions()
+				}
+
 			case "preshared_key":
 
 				// update PSK
@@ -296,7 +589,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				if err != nil {
 					logError.Println("Failed to set preshared key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: preshared_key: %v", ErrInvalidKey, err)
 				}
 
 			case "endpoint":
@@ -313,12 +606,37 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 						return err
 					}
 					peer.endpoint = endpoint
+					if !dummy {
+						peer.clearEndpointHost()
+						peer.tagEndpoint(endpoint)
+					}
 					return nil
 				}()
 
 				if err != nil {
-					logError.Println("Failed to set endpoint:", err, ":", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					logError.Println("Failed to set endpoint:", err, ":", device.redactEndpoint(value))
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidEndpoint, err)
+				}
+
+			case "endpoint_host":
+
+				// set endpoint to the addresses of a host name, racing them
+
+				logDebug.Println(peer, "- UAPI: Updating endpoint host")
+
+				ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+				candidates, err := ResolveEndpointCandidates(ctx, value)
+				cancel()
+				if err != nil {
+					logError.Println("Failed to resolve endpoint:", err, ":", device.redactEndpoint(value))
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidEndpoint, err)
+				}
+
+				if !dummy {
+					peer.Lock()
+					peer.setEndpointHost(value, candidates)
+					peer.Unlock()
+					peer.tagEndpoint(candidates[0])
 				}
 
 			case "persistent_keepalive_interval":
@@ -330,7 +648,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				secs, err := strconv.ParseUint(value, 10, 16)
 				if err != nil {
 					logError.Println("Failed to set persistent keepalive interval:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: persistent_keepalive_interval: %v", ErrInvalidValue, err)
 				}
 
 				old := peer.persistentKeepaliveInterval
@@ -341,20 +659,218 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				if old == 0 && secs != 0 {
 					if err != nil {
 						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{ipc.IpcErrorIO}
+						return ipcErrorf(ipc.IpcErrorIO, "failed to get tun device status: %w", err)
 					}
 					if device.isUp.Get() && !dummy {
 						peer.SendKeepalive()
 					}
 				}
 
+			case "expires_at":
+
+				// update expiry, seconds since the epoch or 0 for none
+
+				logDebug.Println(peer, "- UAPI: Updating expiry")
+
+				secs, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || secs < 0 {
+					logError.Println("Failed to set expiry, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: expires_at: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				var at time.Time
+				if secs != 0 {
+					at = time.Unix(secs, 0)
+				}
+				peer.SetExpiry(at)
+
+			case "ephemeral":
+
+				// update inactivity timeout in seconds, 0 for a permanent peer
+
+				logDebug.Println(peer, "- UAPI: Updating ephemeral timeout")
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to set ephemeral timeout, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: ephemeral: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetEphemeral(time.Duration(secs) * time.Second)
+
+			case "threshold_no_handshake", "threshold_rx_bytes", "threshold_tx_bytes":
+
+				// update a threshold on the statistics of the peer, 0 for none
+
+				logDebug.Println(peer, "- UAPI: Updating threshold", key)
+
+				bits := 64
+				if key == "threshold_no_handshake" {
+					bits = 32
+				}
+				limit, err := strconv.ParseUint(value, 10, bits)
+				if err != nil {
+					logError.Println("Failed to set threshold, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %s: %q", ErrInvalidValue, key, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				thresholds := peer.Thresholds()
+				switch key {
+				case "threshold_no_handshake":
+					thresholds.NoHandshake = time.Duration(limit) * time.Second
+				case "threshold_rx_bytes":
+					thresholds.RxBytes = limit
+				case "threshold_tx_bytes":
+					thresholds.TxBytes = limit
+				}
+				peer.SetThresholds(thresholds)
+
+			case "quota_tx_bytes", "quota_rx_bytes", "quota_period":
+
+				// update the data quota of the peer, 0 for no limit
+
+				logDebug.Println(peer, "- UAPI: Updating quota", key)
+
+				bits := 64
+				if key == "quota_period" {
+					bits = 32
+				}
+				limit, err := strconv.ParseUint(value, 10, bits)
+				if err != nil {
+					logError.Println("Failed to set quota, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %s: %q", ErrInvalidValue, key, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				quota := peer.Quota()
+				switch key {
+				case "quota_tx_bytes":
+					quota.TxBytes = limit
+				case "quota_rx_bytes":
+					quota.RxBytes = limit
+				case "quota_period":
+					quota.Period = time.Duration(limit) * time.Second
+				}
+				peer.SetQuota(quota)
+
+			case "quota_action":
+
+				// update what happens once the peer exceeds its quota
+
+				logDebug.Println(peer, "- UAPI: Updating quota action")
+
+				action, err := ParseQuotaAction(value)
+				if err != nil {
+					logError.Println("Failed to set quota action, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: quota_action: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				quota := peer.Quota()
+				quota.Action = action
+				peer.SetQuota(quota)
+
+			case "multi_login":
+
+				// update what happens once the key is in use on several machines
+
+				logDebug.Println(peer, "- UAPI: Updating multi-login policy")
+
+				policy, err := ParseMultiLoginPolicy(value)
+				if err != nil {
+					logError.Println("Failed to set multi-login policy:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w", err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetMultiLoginPolicy(policy)
+
+			case "disabled":
+
+				// suspend or resume the peer, keeping its configuration
+
+				logDebug.Println(peer, "- UAPI: Updating disabled")
+
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set disabled, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: disabled: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				if value == "true" {
+					peer.Disable()
+				} else {
+					peer.Enable()
+				}
+
+			case "responder_only":
+
+				// never initiate handshakes with the peer, or do so again
+
+				logDebug.Println(peer, "- UAPI: Updating responder only")
+
+				if value != "true" && value != "false" {
+					logError.Println("Failed to set responder only, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: responder_only: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetResponderOnly(value == "true")
+
+			case "obfuscation":
+
+				// disguise the datagrams sent to the peer, or stop doing so
+
+				logDebug.Println(peer, "- UAPI: Updating obfuscation")
+
+				name := value
+				if name == "none" {
+					name = ""
+				} else if _, err := LookupObfuscation(name); err != nil {
+					logError.Println("Failed to set obfuscation:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w", err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetObfuscation(name)
+
 			case "replace_allowed_ips":
 
 				logDebug.Println(peer, "- UAPI: Removing all allowedips")
 
 				if value != "true" {
 					logError.Println("Failed to replace allowedips, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_allowed_ips: %q", ErrInvalidValue, value)
 				}
 
 				if dummy {
@@ -370,7 +886,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				_, network, err := net.ParseCIDR(value)
 				if err != nil {
 					logError.Println("Failed to set allowed ip:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
 				}
 
 				if dummy {
@@ -378,18 +894,166 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				}
 
 				ones, _ := network.Mask.Size()
-				device.allowedips.Insert(network.IP, uint(ones), peer)
+				if limit := device.Limits().AllowedIPs; !device.allowedips.insertWithin(network.IP, uint(ones), peer, limit) {
+					logError.Println("Failed to add allowed ip, limit of", limit, "reached")
+					return ipcErrorf(ipc.IpcErrorQuota, "%w: limit of %d reached", ErrTooManyAllowedIP, limit)
+				}
+
+			case "replace_allowed_sources":
+
+				logDebug.Println(peer, "- UAPI: Removing all allowed sources")
+
+				if value != "true" {
+					logError.Println("Failed to replace allowed sources, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_allowed_sources: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearAllowedSources()
+
+			case "allowed_source":
+
+				logDebug.Println(peer, "- UAPI: Adding allowed source")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to set allowed source:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddAllowedSource(*network)
+
+			case "failover_priority":
+
+				// rank the peer among the backups for the same networks
+
+				logDebug.Println(peer, "- UAPI: Updating failover priority")
+
+				priority, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to set failover priority:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: failover_priority: %v", ErrInvalidValue, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetFailoverPriority(uint16(priority))
+
+			case "replace_backup_allowed_ips":
+
+				logDebug.Println(peer, "- UAPI: Removing all backup allowedips")
+
+				if value != "true" {
+					logError.Println("Failed to replace backup allowedips, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_backup_allowed_ips: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearBackupAllowedIPs()
+
+			case "backup_allowed_ip":
+
+				logDebug.Println(peer, "- UAPI: Adding backup allowedip")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to set backup allowed ip:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddBackupAllowedIP(*network)
+
+			case "balance_weight":
+
+				// share of the flows the peer takes among balanced peers
+
+				logDebug.Println(peer, "- UAPI: Updating balance weight")
+
+				weight, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to set balance weight:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: balance_weight: %v", ErrInvalidValue, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.SetBalanceWeight(uint16(weight))
+
+			case "replace_balanced_allowed_ips":
+
+				logDebug.Println(peer, "- UAPI: Removing all balanced allowedips")
+
+				if value != "true" {
+					logError.Println("Failed to replace balanced allowedips, invalid value:", value)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: replace_balanced_allowed_ips: %q", ErrInvalidValue, value)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearBalancedAllowedIPs()
+
+			case "balanced_allowed_ip":
+
+				logDebug.Println(peer, "- UAPI: Adding balanced allowedip")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to set balanced allowed ip:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddBalancedAllowedIP(*network)
+
+			case "allowed_ip_exclude":
+
+				logDebug.Println(peer, "- UAPI: Excluding from allowedips")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to exclude allowed ip:", err)
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: %v", ErrInvalidAllowedIP, err)
+				}
+
+				if dummy {
+					continue
+				}
+
+				device.allowedips.Exclude(peer, *network)
 
 			case "protocol_version":
 
 				if value != "1" {
 					logError.Println("Invalid protocol version:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
+					return ipcErrorf(ipc.IpcErrorInvalid, "%w: protocol_version: %q", ErrInvalidValue, value)
 				}
 
 			default:
 				logError.Println("Invalid UAPI peer key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+				return ipcErrorf(ipc.IpcErrorInvalid, "%w: %q", ErrUnknownConfigKey, key)
 			}
 		}
 	}
@@ -398,6 +1062,18 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 }
 
 func (device *Device) IpcHandle(socket net.Conn) {
+	device.ipcHandle(socket, false)
+}
+
+// IpcHandleMonitor serves the UAPI on a monitor socket, which permits
+// only the get and diagnostics operations and whose get operation leaves
+// out the private and preshared keys, so that monitoring agents need not
+// be allowed to configure the device.
+func (device *Device) IpcHandleMonitor(socket net.Conn) {
+	device.ipcHandle(socket, true)
+}
+
+func (device *Device) ipcHandle(socket net.Conn, monitor bool) {
 
 	// create buffered read/writer
 
@@ -416,32 +1092,44 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		return
 	}
 
-	// handle operation
+	// authorize and handle operation
 
 	var status *IPCError
 
-	switch op {
-	case "set=1\n":
-		err = device.IpcSetOperation(buffered.Reader)
-		if err != nil && !errors.As(err, &status) {
-			// should never happen
-			device.log.Error.Println("Invalid UAPI error:", err)
-			status = &IPCError{1}
-		}
-
-	case "get=1\n":
-		err = device.IpcGetOperation(buffered.Writer)
-		if err != nil && !errors.As(err, &status) {
-			// should never happen
-			device.log.Error.Println("Invalid UAPI error:", err)
-			status = &IPCError{1}
-		}
-
-	default:
+	operation, version, ok := parseIPCOperation(op)
+	if !ok {
 		device.log.Error.Println("Invalid UAPI operation:", op)
 		return
 	}
 
+	client := device.connClient(socket, monitor)
+	if err := device.AuthorizeIPC(client, operation); err != nil {
+		status = &IPCError{code: ipc.IpcErrorPermission, err: err}
+	} else {
+		switch operation {
+		case IPCSet:
+			err = device.tracedSet(context.Background(), buffered.Reader, client.String())
+			if err != nil && !errors.As(err, &status) {
+				// should never happen
+				device.log.Error.Println("Invalid UAPI error:", err)
+				status = &IPCError{code: 1, err: err}
+			}
+
+		case IPCGet:
+			err = device.tracedGet(context.Background(), buffered.Writer, !monitor, version)
+			if err != nil && !errors.As(err, &status) {
+				// should never happen
+				device.log.Error.Println("Invalid UAPI error:", err)
+				status = &IPCError{code: 1, err: err}
+			}
+
+		case IPCDiagnostics:
+			if _, err := device.Diagnostics().WriteTo(buffered.Writer); err != nil {
+				status = &IPCError{code: ipc.IpcErrorIO, err: err}
+			}
+		}
+	}
+
 	// write status
 
 	if status != nil {
@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+func TestIpcSetLineNumber(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	err := dev.IpcSet("replace_peers=true\nlisten_port=notaport\n")
+	var lineErr *IPCLineError
+	if !errors.As(err, &lineErr) {
+		t.Fatalf("expected IPCLineError, got %v", err)
+	}
+	if lineErr.Line != 2 {
+		t.Errorf("error reported on line %d, expected line 2", lineErr.Line)
+	}
+	var status *IPCError
+	if !errors.As(err, &status) || status.ErrorCode() != ipc.IpcErrorInvalid {
+		t.Errorf("unexpected IPC error %v", err)
+	}
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("expected ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestIpcSetMatchesOperation(t *testing.T) {
+	sk1, err := newPrivateKey()
+	assertNil(t, err)
+	sk2, err := newPrivateKey()
+	assertNil(t, err)
+	config := "private_key=" + sk1.ToHex() + "\n" +
+		"public_key=" + sk2.publicKey().ToHex() + "\n" +
+		"endpoint=127.0.0.1:51820\n" +
+		"persistent_keepalive_interval=25\n" +
+		"allowed_ip=10.0.0.0/24\n"
+
+	dev1 := NewDevice(newDummyTUN("dummy1"), NewLogger(LogLevelSilent, ""))
+	defer dev1.Close()
+	assertNil(t, dev1.IpcSet(config))
+	dev2 := NewDevice(newDummyTUN("dummy2"), NewLogger(LogLevelSilent, ""))
+	defer dev2.Close()
+	assertNil(t, dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(config))))
+
+	get1, err := dev1.IpcGet()
+	assertNil(t, err)
+	get2, err := dev2.IpcGet()
+	assertNil(t, err)
+	if get1 != get2 {
+		t.Errorf("IpcSet configured\n%s\nIpcSetOperation configured\n%s", get1, get2)
+	}
+	if !strings.Contains(get1, "allowed_ip=10.0.0.0/24\n") {
+		t.Errorf("IpcSet did not apply the configuration:\n%s", get1)
+	}
+}
+
+func TestIpcSetErrors(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer := "public_key=" + sk.publicKey().ToHex() + "\n"
+
+	tests := []struct {
+		config string
+		target error
+		code   int64
+	}{
+		{"private_key=zz\n", ErrInvalidKey, ipc.IpcErrorInvalid},
+		{"bogus=1\n", ErrUnknownConfigKey, ipc.IpcErrorInvalid},
+		{"no equals sign\n", ErrMalformedLine, ipc.IpcErrorProtocol},
+		{peer + "allowed_ip=10.0.0.0/99\n", ErrInvalidAllowedIP, ipc.IpcErrorInvalid},
+		{peer + "endpoint=nowhere\n", ErrInvalidEndpoint, ipc.IpcErrorInvalid},
+	}
+	for _, test := range tests {
+		err := dev.IpcSet(test.config)
+		if !errors.Is(err, test.target) {
+			t.Errorf("%q: expected %v, got %v", test.config, test.target, err)
+		}
+		var status *IPCError
+		if !errors.As(err, &status) || status.ErrorCode() != test.code {
+			t.Errorf("%q: unexpected errno in %v", test.config, err)
+		}
+	}
+
+	var unknown NoisePublicKey
+	if err := dev.SetPeerLogLevel(unknown, LogLevelDebug); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+}
+
+func TestIpcConfigRoundTrip(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	var psk NoiseSymmetricKey
+	psk[0] = 1
+	keepalive := uint16(25)
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/24")
+
+	err = dev.IpcSetConfig(&DeviceConfig{
+		ReplacePeers: true,
+		Peers: []PeerConfig{{
+			PublicKey:                   sk.publicKey(),
+			PresharedKey:                &psk,
+			Endpoint:                    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820},
+			PersistentKeepaliveInterval: &keepalive,
+			AllowedIPs:                  []net.IPNet{*allowed},
+		}},
+	})
+	assertNil(t, err)
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	if config.PrivateKey == nil || !config.PrivateKey.Equals(*dev.staticIdentity.privateKey) {
+		t.Error("private key did not round trip")
+	}
+	if len(config.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(config.Peers))
+	}
+	peer := config.Peers[0]
+	if !peer.PublicKey.Equals(sk.publicKey()) {
+		t.Error("public key did not round trip")
+	}
+	if peer.PresharedKey == nil || *peer.PresharedKey != psk {
+		t.Error("preshared key did not round trip")
+	}
+	if peer.Endpoint == nil || peer.Endpoint.String() != "127.0.0.1:51820" {
+		t.Errorf("endpoint did not round trip: %v", peer.Endpoint)
+	}
+	if peer.PersistentKeepaliveInterval == nil || *peer.PersistentKeepaliveInterval != keepalive {
+		t.Error("persistent keepalive interval did not round trip")
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0].String() != "10.0.0.0/24" {
+		t.Errorf("allowed ips did not round trip: %v", peer.AllowedIPs)
+	}
+}
+
+func TestIpcCapabilities(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	config, err := dev.IpcGetConfig()
+	assertNil(t, err)
+	if config.UAPIVersion != UAPIVersion {
+		t.Errorf("advertised version %d, want %d", config.UAPIVersion, UAPIVersion)
+	}
+	advertised := strings.Join(config.Capabilities, ",")
+	if !strings.Contains(advertised, "allowed_ip_exclude") {
+		t.Errorf("capabilities %q lack allowed_ip_exclude", advertised)
+	}
+
+	assertNil(t, dev.IpcSet("uapi_version=2\nrequire=allowed_ip_exclude\n"))
+	for _, config := range []string{"require=teleport\n", "uapi_version=99\n"} {
+		err := dev.IpcSet(config)
+		var status *IPCError
+		if !errors.Is(err, ErrUnsupported) || !errors.As(err, &status) || status.ErrorCode() != ipc.IpcErrorProtocol {
+			t.Errorf("%q: expected unsupported protocol error, got %v", config, err)
+		}
+	}
+}
+
+// ipcRequest performs the UAPI operation op on a connection served by
+// handle and returns the reply.
+func ipcRequest(handle func(net.Conn), op string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go handle(server)
+	go client.Write([]byte(op))
+	var reply strings.Builder
+	buffer := make([]byte, 4096)
+	for !strings.HasSuffix(reply.String(), "\n\n") {
+		n, err := client.Read(buffer)
+		if err != nil {
+			break
+		}
+		reply.Write(buffer[:n])
+	}
+	return reply.String()
+}
+
+func TestIpcHandleMonitor(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	peerKey, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev.IpcSet("public_key="+peerKey.publicKey().ToHex()+"\npreshared_key="+peerKey.ToHex()+"\n"))
+
+	reply := ipcRequest(dev.IpcHandleMonitor, "get=1\n\n")
+	if !strings.Contains(reply, "public_key="+peerKey.publicKey().ToHex()) || !strings.HasSuffix(reply, "errno=0\n\n") {
+		t.Errorf("monitor get replied %q", reply)
+	}
+	if strings.Contains(reply, "private_key=") || strings.Contains(reply, "preshared_key=") {
+		t.Errorf("monitor get disclosed keys: %q", reply)
+	}
+	if reply := ipcRequest(dev.IpcHandle, "get=1\n\n"); !strings.Contains(reply, "private_key=") {
+		t.Errorf("get lacks the private key: %q", reply)
+	}
+
+	reply = ipcRequest(dev.IpcHandleMonitor, "set=1\nlisten_port=4242\n\n")
+	if want := fmt.Sprintf("errno=%d\n\n", ipc.IpcErrorPermission); reply != want {
+		t.Errorf("monitor set replied %q, want %q", reply, want)
+	}
+	if dev.net.port == 4242 {
+		t.Error("monitor set changed the listen port")
+	}
+}
+
+func TestIpcGetVersions(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	peerKey, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev.IpcSet("relay=true\npublic_key="+peerKey.publicKey().ToHex()+"\nephemeral=60\nallowed_ip=10.0.0.1/32\n"))
+
+	// the reference protocol, as spoken by wg(8)
+
+	reference := map[string]bool{
+		"private_key": true, "listen_port": true, "fwmark": true,
+		"public_key": true, "preshared_key": true, "protocol_version": true, "endpoint": true,
+		"last_handshake_time_sec": true, "last_handshake_time_nsec": true,
+		"tx_bytes": true, "rx_bytes": true, "persistent_keepalive_interval": true, "allowed_ip": true,
+		"errno": true,
+	}
+	config, err := dev.IpcGet()
+	assertNil(t, err)
+	for _, reply := range []string{ipcRequest(dev.IpcHandle, "get=1\n\n"), config} {
+		for _, line := range strings.Split(strings.TrimSpace(reply), "\n") {
+			if key := strings.SplitN(line, "=", 2)[0]; !reference[key] {
+				t.Errorf("get=1 replied with key %q", key)
+			}
+		}
+	}
+
+	for op, version := range map[string]int{"get=2\n\n": 2, "get=99\n\n": UAPIVersion} {
+		reply := ipcRequest(dev.IpcHandle, op)
+		if !strings.HasPrefix(reply, fmt.Sprintf("uapi_version=%d\n", version)) {
+			t.Errorf("%q: version not negotiated in %q", op, reply)
+		}
+		if !strings.Contains(reply, "\nrelay=true\n") || !strings.Contains(reply, "\nephemeral=60\n") {
+			t.Errorf("%q: extensions missing from %q", op, reply)
+		}
+	}
+	if reply := ipcRequest(dev.IpcHandle, "get=0\n\n"); reply != "" {
+		t.Errorf("get=0 replied %q", reply)
+	}
+}
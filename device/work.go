@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync/atomic"
+
+/* Work in progress
+ *
+ * The device counts the work handed between its routines: received
+ * packets from when they are taken in until they are written or dropped,
+ * handshake messages and encrypted packets while queued or processed,
+ * and the nonce workers and MTU probes of peers while they run. Packets
+ * staged until a session exists do not count, as only a handshake or a
+ * timer moves them on, nor do routines waiting to be woken.
+ *
+ * Whoever hands work on counts it before and only stops counting its own
+ * afterwards, so the count never drops to zero while work remains. This
+ * lets a caller feeding the device all of its packets and timers, like a
+ * simulation on a virtual clock, tell when the device is idle.
+ */
+
+// Working reports whether the device is still processing the packets it
+// took in and the work they caused, see above.
+func (device *Device) Working() bool {
+	return atomic.LoadInt32(&device.work) != 0
+}
+
+func (device *Device) addWork() {
+	atomic.AddInt32(&device.work, 1)
+}
+
+func (device *Device) doneWork() {
+	atomic.AddInt32(&device.work, -1)
+}
+
+// A workWaiter is a routine which does not count as work while blocked
+// on events of some kinds. Whoever causes such an event counts the
+// routine again on its behalf, before its own work ends.
+type workWaiter struct {
+	kinds int32 // of the events waited for, zero while running, accessed atomically
+}
+
+const (
+	wakeOnPacket  = 1 << iota // a packet was queued to the nonce worker
+	wakeOnKeypair             // a keypair arrived for the nonce worker
+	wakeOnFlush               // the nonce queue is to be flushed
+	wakeOnProbe               // an MTU probe was acknowledged or expired
+)
+
+// wait stops counting the routine, which is about to block on events
+// of kinds, unless pending reports that one already happened.
+func (w *workWaiter) wait(device *Device, kinds int32, pending func() bool) {
+	atomic.StoreInt32(&w.kinds, kinds)
+	if pending() && atomic.CompareAndSwapInt32(&w.kinds, kinds, 0) {
+		return
+	}
+	device.doneWork()
+}
+
+// resume counts the routine again once it stopped blocking, unless an
+// event woke it and was counted for it already.
+func (w *workWaiter) resume(device *Device) {
+	if kinds := atomic.LoadInt32(&w.kinds); kinds != 0 && atomic.CompareAndSwapInt32(&w.kinds, kinds, 0) {
+		device.addWork()
+	}
+}
+
+// wake counts the routine again if it waits for an event of kind, which
+// the caller caused just before.
+func (w *workWaiter) wake(device *Device, kind int32) {
+	for {
+		kinds := atomic.LoadInt32(&w.kinds)
+		if kinds&kind == 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&w.kinds, kinds, 0) {
+			device.addWork()
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package healthz serves the health and readiness of a device over HTTP,
+// for the liveness and readiness probes of orchestrators like Kubernetes.
+package healthz
+
+import (
+	"net/http"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* Liveness and readiness probes
+ *
+ * /healthz answers 200 while the device is healthy, see device.Check,
+ * and /readyz while it is ready, see device.Ready, which takes the bind,
+ * the TUN device and recent handshakes into account. Otherwise they
+ * answer 503 with the reason. The handler may be served on its own or
+ * mounted into another HTTP server, such as one serving the UAPI.
+ */
+
+// Handler returns the handler serving /healthz and /readyz for dev.
+func Handler(dev *device.Device) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", probe(dev.Check))
+	mux.Handle("/readyz", probe(dev.Ready))
+	return mux
+}
+
+func probe(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,44 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package healthz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestHandler(t *testing.T) {
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), device.NewLogger(device.LogLevelSilent, ""))
+	handler := Handler(dev)
+	status := func(method, path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	dev.Down()
+	if code := status("GET", "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz of a device down = %d, want 200", code)
+	}
+	if code := status("GET", "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz of a device down = %d, want 503", code)
+	}
+	dev.Up()
+	if code := status("GET", "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz of a device up = %d, want 200", code)
+	}
+	if code := status("POST", "/readyz"); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /readyz = %d, want 405", code)
+	}
+	dev.Close()
+	if code := status("GET", "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz of a closed device = %d, want 503", code)
+	}
+}
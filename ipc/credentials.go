@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import "net"
+
+// Credentials identify the process at the other end of a UAPI
+// connection, as far as the platform reveals it. Unknown fields are -1,
+// and all of them are unknown unless Known is set.
+type Credentials struct {
+	PID   int
+	UID   int
+	GID   int
+	Known bool // reported by the kernel for the socket, see PeerCredentials
+}
+
+// UnknownCredentials are the credentials of a connection whose peer
+// cannot be identified.
+var UnknownCredentials = Credentials{PID: -1, UID: -1, GID: -1}
+
+// PeerCredentials returns the credentials of the process which connected
+// to a UAPI socket, UnknownCredentials along with an error if conn is not
+// a unix socket or the platform does not support peer credentials.
+func PeerCredentials(conn net.Conn) (Credentials, error) {
+	return peerCredentials(conn)
+}
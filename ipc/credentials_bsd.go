@@ -0,0 +1,65 @@
+// +build darwin freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// xucred is struct xucred of <sys/ucred.h>, which golang.org/x/sys/unix
+// does not provide in the version in use, read with LOCAL_PEERCRED.
+type xucred struct {
+	Version uint32
+	Uid     uint32
+	Ngroups int16
+	Groups  [16]uint32
+}
+
+const (
+	solLocal      = 0 // SOL_LOCAL
+	localPeercred = 1 // LOCAL_PEERCRED
+)
+
+func peerCredentials(conn net.Conn) (Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return UnknownCredentials, errors.New("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return UnknownCredentials, err
+	}
+	var xucred xucred
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(xucred))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, solLocal, localPeercred, uintptr(unsafe.Pointer(&xucred)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return UnknownCredentials, err
+	}
+
+	// the process ID is not part of the credentials, and the first group
+	// is the effective one
+
+	credentials := Credentials{PID: -1, UID: int(xucred.Uid), GID: -1, Known: true}
+	if xucred.Ngroups > 0 {
+		credentials.GID = int(xucred.Groups[0])
+	}
+	return credentials, nil
+}
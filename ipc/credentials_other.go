@@ -0,0 +1,17 @@
+// +build !linux,!darwin,!freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (Credentials, error) {
+	return UnknownCredentials, errors.New("peer credentials are not supported on this platform")
+}
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"net"
 	"os"
+	"path/filepath"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -54,6 +55,16 @@ func (l *UAPIListener) Addr() net.Addr {
 }
 
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
+	return listenSocket(sockPath(name), file)
+}
+
+// UAPIListenMonitor listens on the monitor socket of the interface opened
+// by UAPIOpenMonitor.
+func UAPIListenMonitor(name string, file *os.File) (net.Listener, error) {
+	return listenSocket(monitorPath(name), file)
+}
+
+func listenSocket(socketPath string, file *os.File) (net.Listener, error) {
 
 	// wrap file in listener
 
@@ -69,18 +80,16 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 	}
 
 	if unixListener, ok := listener.(*net.UnixListener); ok {
-		unixListener.SetUnlinkOnClose(true)
+		unixListener.SetUnlinkOnClose(file.Name() != activatedName)
 	}
 
-	socketPath := sockPath(name)
-
 	// watch for deletion of socket
 
 	uapi.kqueueFd, err = unix.Kqueue()
 	if err != nil {
 		return nil, err
 	}
-	uapi.keventFd, err = unix.Open(socketDirectory, unix.O_RDONLY, 0)
+	uapi.keventFd, err = unix.Open(filepath.Dir(socketPath), unix.O_RDONLY, 0)
 	if err != nil {
 		unix.Close(uapi.kqueueFd)
 		return nil, err
@@ -51,6 +51,16 @@ func (l *UAPIListener) Addr() net.Addr {
 }
 
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
+	return listenSocket(sockPath(name), file)
+}
+
+// UAPIListenMonitor listens on the monitor socket of the interface opened
+// by UAPIOpenMonitor.
+func UAPIListenMonitor(name string, file *os.File) (net.Listener, error) {
+	return listenSocket(monitorPath(name), file)
+}
+
+func listenSocket(socketPath string, file *os.File) (net.Listener, error) {
 
 	// wrap file in listener
 
@@ -60,7 +70,7 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 	}
 
 	if unixListener, ok := listener.(*net.UnixListener); ok {
-		unixListener.SetUnlinkOnClose(true)
+		unixListener.SetUnlinkOnClose(file.Name() != activatedName)
 	}
 
 	uapi := &UAPIListener{
@@ -71,8 +81,6 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 
 	// watch for deletion of socket
 
-	socketPath := sockPath(name)
-
 	uapi.inotifyFd, err = unix.InotifyInit()
 	if err != nil {
 		return nil, err
@@ -1,3 +1,4 @@
+//go:build linux || darwin || freebsd || openbsd
 // +build linux darwin freebsd openbsd
 
 /* SPDX-License-Identifier: MIT
@@ -12,15 +13,19 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 )
 
 const (
-	IpcErrorIO        = -int64(unix.EIO)
-	IpcErrorProtocol  = -int64(unix.EPROTO)
-	IpcErrorInvalid   = -int64(unix.EINVAL)
-	IpcErrorPortInUse = -int64(unix.EADDRINUSE)
+	IpcErrorIO         = -int64(unix.EIO)
+	IpcErrorProtocol   = -int64(unix.EPROTO)
+	IpcErrorInvalid    = -int64(unix.EINVAL)
+	IpcErrorPortInUse  = -int64(unix.EADDRINUSE)
+	IpcErrorPermission = -int64(unix.EPERM)
+	IpcErrorQuota      = -int64(unix.ENOSPC)
 )
 
 // socketDirectory is variable because it is modified by a linker
@@ -31,12 +36,42 @@ func sockPath(iface string) string {
 	return fmt.Sprintf("%s/%s.sock", socketDirectory, iface)
 }
 
+// monitorPath returns the path of the monitor socket of iface, which is
+// kept in a directory of its own, lest it be taken for an interface.
+func monitorPath(iface string) string {
+	return fmt.Sprintf("%s/monitor/%s.sock", socketDirectory, iface)
+}
+
 func UAPIOpen(name string) (*os.File, error) {
-	if err := os.MkdirAll(socketDirectory, 0755); err != nil {
+	return openSocket(sockPath(name))
+}
+
+// UAPIOpenMonitor opens the monitor socket of the interface, which only
+// serves the get and diagnostics operations, see device.IpcHandleMonitor.
+// Unlike the UAPI socket, it may be connected to by members of the group
+// gid as well.
+func UAPIOpenMonitor(name string, gid int) (*os.File, error) {
+	socketPath := monitorPath(name)
+	file, err := openSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chown(socketPath, -1, gid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func openSocket(socketPath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
 		return nil, err
 	}
 
-	socketPath := sockPath(name)
 	addr, err := net.ResolveUnixAddr("unix", socketPath)
 	if err != nil {
 		return nil, err
@@ -63,3 +98,35 @@ func UAPIOpen(name string) (*os.File, error) {
 	}
 	return listener.File()
 }
+
+// activatedName names the files of sockets passed by socket activation,
+// which UAPIListen leaves in place when the listener is closed, since
+// they belong to the service manager.
+const activatedName = "socket-activated"
+
+// UAPIActivated returns the UAPI socket passed by systemd socket activation,
+// see sd_listen_fds(3), or nil if the process was not socket activated.
+func UAPIActivated() (*os.File, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid != strconv.Itoa(os.Getpid()) || fds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	switch {
+	case n == 0:
+		return nil, nil
+	case n > 1:
+		return nil, fmt.Errorf("%d sockets passed by socket activation, expected one", n)
+	}
+
+	const listenFdsStart = 3
+	unix.CloseOnExec(listenFdsStart)
+	return os.NewFile(listenFdsStart, activatedName), nil
+}
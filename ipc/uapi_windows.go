@@ -15,10 +15,12 @@ import (
 
 // TODO: replace these with actual standard windows error numbers from the win package
 const (
-	IpcErrorIO        = -int64(5)
-	IpcErrorProtocol  = -int64(71)
-	IpcErrorInvalid   = -int64(22)
-	IpcErrorPortInUse = -int64(98)
+	IpcErrorIO         = -int64(5)
+	IpcErrorProtocol   = -int64(71)
+	IpcErrorInvalid    = -int64(22)
+	IpcErrorPortInUse  = -int64(98)
+	IpcErrorPermission = -int64(1)
+	IpcErrorQuota      = -int64(28)
 )
 
 type UAPIListener struct {
@@ -51,6 +53,10 @@ func (l *UAPIListener) Addr() net.Addr {
 
 var UAPISecurityDescriptor *windows.SECURITY_DESCRIPTOR
 
+// UAPIMonitorSecurityDescriptor secures the monitor pipes, which users
+// may read and write as well.
+var UAPIMonitorSecurityDescriptor *windows.SECURITY_DESCRIPTOR
+
 func init() {
 	var err error
 	/* SDDL_DEVOBJ_SYS_ALL from the WDK */
@@ -58,13 +64,28 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	UAPIMonitorSecurityDescriptor, err = windows.SecurityDescriptorFromString("O:SYD:P(A;;GA;;;SY)(A;;GRGW;;;BU)")
+	if err != nil {
+		panic(err)
+	}
 }
 
 func UAPIListen(name string) (net.Listener, error) {
+	return listenPipe(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`+name, UAPISecurityDescriptor)
+}
+
+// UAPIListenMonitor listens on the monitor pipe of the interface, which
+// only serves the get and diagnostics operations, see
+// device.IpcHandleMonitor.
+func UAPIListenMonitor(name string) (net.Listener, error) {
+	return listenPipe(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\Monitor\`+name, UAPIMonitorSecurityDescriptor)
+}
+
+func listenPipe(path string, securityDescriptor *windows.SECURITY_DESCRIPTOR) (net.Listener, error) {
 	config := winpipe.PipeConfig{
-		SecurityDescriptor: UAPISecurityDescriptor,
+		SecurityDescriptor: securityDescriptor,
 	}
-	listener, err := winpipe.ListenPipe(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`+name, &config)
+	listener, err := winpipe.ListenPipe(path, &config)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package keygen generates WireGuard keys, encoded in base64 like wg(8)
+// does, and searches for public keys starting with a vanity prefix.
+package keygen
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// KeySize is the size of private, public and preshared keys.
+const KeySize = 32
+
+var (
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrInvalidPrefix = errors.New("invalid vanity prefix")
+)
+
+// NewPrivateKey returns a random, clamped private key.
+func NewPrivateKey() (device.NoisePrivateKey, error) {
+	var sk device.NoisePrivateKey
+	if _, err := rand.Read(sk[:]); err != nil {
+		return sk, err
+	}
+	clamp(&sk)
+	return sk, nil
+}
+
+func clamp(sk *device.NoisePrivateKey) {
+	sk[0] &= 248
+	sk[31] = (sk[31] & 127) | 64
+}
+
+// NewPresharedKey returns a random preshared key.
+func NewPresharedKey() (device.NoiseSymmetricKey, error) {
+	var psk device.NoiseSymmetricKey
+	_, err := rand.Read(psk[:])
+	return psk, err
+}
+
+// PublicKey returns the public key of sk.
+func PublicKey(sk device.NoisePrivateKey) device.NoisePublicKey {
+	var pk device.NoisePublicKey
+	curve25519.ScalarBaseMult((*[KeySize]byte)(&pk), (*[KeySize]byte)(&sk))
+	return pk
+}
+
+// Encode returns key in base64.
+func Encode(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Decode parses a key in base64.
+func Decode(s string) ([KeySize]byte, error) {
+	var key [KeySize]byte
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return key, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(b) != KeySize {
+		return key, fmt.Errorf("%w: %d bytes", ErrInvalidKey, len(b))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+/* Vanity keys
+ *
+ * Public keys cannot be chosen, so a public key starting with a prefix
+ * is found by generating keys until one does. Every character of the
+ * prefix multiplies the expected number of attempts by 64, see
+ * VanityAttempts, each of them costing a scalar multiplication. The
+ * last of the 43 significant characters of a key in base64 carries only
+ * four bits, so that a prefix of all of them is further constrained.
+ */
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// checkPrefix reports whether public keys may start with prefix.
+func checkPrefix(prefix string) error {
+	if len(prefix) > 43 {
+		return fmt.Errorf("%w: %d characters exceed 43", ErrInvalidPrefix, len(prefix))
+	}
+	for i := 0; i < len(prefix); i++ {
+		value := strings.IndexByte(base64Alphabet, prefix[i])
+		if value < 0 {
+			return fmt.Errorf("%w: %q is not a base64 character", ErrInvalidPrefix, prefix[i])
+		}
+		if i == 42 && value&3 != 0 {
+			return fmt.Errorf("%w: no key ends in %q", ErrInvalidPrefix, prefix[i])
+		}
+	}
+	return nil
+}
+
+// VanityAttempts returns the number of keys expected to be generated
+// before finding a public key starting with prefix.
+func VanityAttempts(prefix string) float64 {
+	attempts := math.Pow(64, float64(len(prefix)))
+	if len(prefix) == 43 {
+		attempts /= 4
+	}
+	return attempts
+}
+
+// SearchVanity generates private keys until the public key of one
+// starts with prefix in base64, with workers goroutines, or one per CPU
+// if workers is not positive. It gives up with the error of ctx once
+// ctx is done.
+func SearchVanity(ctx context.Context, prefix string, workers int) (device.NoisePrivateKey, error) {
+	if err := checkPrefix(prefix); err != nil {
+		return device.NoisePrivateKey{}, err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var found device.NoisePrivateKey
+	var failed error
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			var encoded [44]byte
+			for ctx.Err() == nil {
+				sk, err := NewPrivateKey()
+				if err != nil {
+					once.Do(func() { failed = err })
+					cancel()
+					return
+				}
+				pk := PublicKey(sk)
+				base64.StdEncoding.Encode(encoded[:], pk[:])
+				if string(encoded[:len(prefix)]) == prefix {
+					once.Do(func() { found = sk })
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != nil {
+		return device.NoisePrivateKey{}, failed
+	}
+	if found.IsZero() {
+		return found, ctx.Err()
+	}
+	return found, nil
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package keygen
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestPublicKey(t *testing.T) {
+	// the example keys of wg(8)
+	sk, err := Decode("yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := PublicKey(device.NoisePrivateKey(sk))
+	if got, want := Encode(pk[:]), "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="; got != want {
+		t.Errorf("public key %s, want %s", got, want)
+	}
+
+	for _, s := range []string{"", "not base64", "AAAA"} {
+		if _, err := Decode(s); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("decoding %q: %v", s, err)
+		}
+	}
+}
+
+func TestNewPrivateKey(t *testing.T) {
+	sk, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk[0]&7 != 0 || sk[31]&128 != 0 || sk[31]&64 == 0 {
+		t.Errorf("private key %x not clamped", sk)
+	}
+	other, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk.Equals(other) {
+		t.Error("generated the same private key twice")
+	}
+}
+
+func TestSearchVanity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sk, err := SearchVanity(ctx, "wg", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := PublicKey(sk)
+	if encoded := Encode(pk[:]); !strings.HasPrefix(encoded, "wg") {
+		t.Errorf("public key %s lacks the prefix", encoded)
+	}
+
+	// a search that cannot end in time gives up
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := SearchVanity(ctx, "wireguardwireguard", 0); err != context.DeadlineExceeded {
+		t.Errorf("search of a long prefix: %v", err)
+	}
+
+	for _, prefix := range []string{"wg-", strings.Repeat("A", 44), strings.Repeat("A", 42) + "B"} {
+		if _, err := SearchVanity(context.Background(), prefix, 1); !errors.Is(err, ErrInvalidPrefix) {
+			t.Errorf("search of %q: %v", prefix, err)
+		}
+	}
+	if attempts := VanityAttempts("wg"); attempts != 4096 {
+		t.Errorf("expected %v attempts for two characters", attempts)
+	}
+}
@@ -0,0 +1,338 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* A minimal D-Bus client, just enough to call methods on the
+ * system bus with the few argument types systemd-resolved takes.
+ */
+
+const (
+	dbusSystemBusSocket = "/run/dbus/system_bus_socket"
+
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+type dbusCallError struct {
+	name    string
+	message string
+}
+
+func (err *dbusCallError) Error() string {
+	if err.message == "" {
+		return err.name
+	}
+	return err.name + ": " + err.message
+}
+
+// dbusEncoder marshals little endian D-Bus values. Alignment is
+// relative to the start of the buffer, which must be 8 byte aligned
+// within the message.
+type dbusEncoder struct {
+	b []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *dbusEncoder) byte(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	e.b = append(e.b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(e.b[len(e.b)-4:], v)
+}
+
+func (e *dbusEncoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *dbusEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+func (e *dbusEncoder) signature(s string) {
+	e.b = append(e.b, byte(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+// array marshals the elements added by elems, which are aligned to
+// elemAlign, as an array.
+func (e *dbusEncoder) array(elemAlign int, elems func()) {
+	e.uint32(0)
+	length := len(e.b) - 4
+	e.align(elemAlign)
+	start := len(e.b)
+	elems()
+	binary.LittleEndian.PutUint32(e.b[length:], uint32(len(e.b)-start))
+}
+
+func dbusMessage(serial uint32, destination, path, iface, member, signature string, body []byte) []byte {
+	e := &dbusEncoder{}
+	e.b = append(e.b, 'l', dbusMethodCall, 0, 1)
+	e.uint32(uint32(len(body)))
+	e.uint32(serial)
+	field := func(code byte, typ string, value string) {
+		e.align(8)
+		e.byte(code)
+		e.signature(typ)
+		if typ == "g" {
+			e.signature(value)
+		} else {
+			e.string(value)
+		}
+	}
+	e.array(8, func() {
+		field(dbusFieldPath, "o", path)
+		field(dbusFieldInterface, "s", iface)
+		field(dbusFieldMember, "s", member)
+		field(dbusFieldDestination, "s", destination)
+		if signature != "" {
+			field(dbusFieldSignature, "g", signature)
+		}
+	})
+	e.align(8)
+	return append(e.b, body...)
+}
+
+// dbusReply is the part of a received message the client cares about.
+type dbusReply struct {
+	typ         byte
+	order       binary.ByteOrder
+	replySerial uint32
+	errorName   string
+	signature   string
+	body        []byte
+}
+
+var errDBusMalformed = errors.New("malformed D-Bus message")
+
+// dbusDecoder unmarshals D-Bus values, aligned relative to the start of b.
+type dbusDecoder struct {
+	order binary.ByteOrder
+	b     []byte
+	off   int
+}
+
+func (d *dbusDecoder) align(n int) {
+	d.off = (d.off + n - 1) / n * n
+}
+
+func (d *dbusDecoder) uint32() (uint32, error) {
+	d.align(4)
+	if d.off+4 > len(d.b) {
+		return 0, errDBusMalformed
+	}
+	v := d.order.Uint32(d.b[d.off:])
+	d.off += 4
+	return v, nil
+}
+
+func (d *dbusDecoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil || d.off+int(n)+1 > len(d.b) {
+		return "", errDBusMalformed
+	}
+	s := string(d.b[d.off : d.off+int(n)])
+	d.off += int(n) + 1
+	return s, nil
+}
+
+func (d *dbusDecoder) signature() (string, error) {
+	if d.off >= len(d.b) {
+		return "", errDBusMalformed
+	}
+	n := int(d.b[d.off])
+	if d.off+n+2 > len(d.b) {
+		return "", errDBusMalformed
+	}
+	s := string(d.b[d.off+1 : d.off+1+n])
+	d.off += n + 2
+	return s, nil
+}
+
+func readDBusMessage(r io.Reader) (*dbusReply, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errDBusMalformed
+	}
+	bodyLength := order.Uint32(fixed[4:])
+	fieldsLength := order.Uint32(fixed[12:])
+	headerLength := (16 + int(fieldsLength) + 7) / 8 * 8
+	if fieldsLength > 1<<26 || bodyLength > 1<<27 {
+		return nil, errDBusMalformed
+	}
+
+	b := make([]byte, headerLength+int(bodyLength))
+	copy(b, fixed[:])
+	if _, err := io.ReadFull(r, b[16:]); err != nil {
+		return nil, err
+	}
+
+	reply := &dbusReply{typ: fixed[1], order: order, body: b[headerLength:]}
+	d := &dbusDecoder{order: order, b: b[:16+fieldsLength], off: 16}
+	for d.off < len(d.b) {
+		d.align(8)
+		if d.off >= len(d.b) {
+			break
+		}
+		code := d.b[d.off]
+		d.off++
+		typ, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "u":
+			v, err := d.uint32()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldReplySerial {
+				reply.replySerial = v
+			}
+		case "s", "o":
+			v, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldErrorName {
+				reply.errorName = v
+			}
+		case "g":
+			v, err := d.signature()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldSignature {
+				reply.signature = v
+			}
+		default:
+			return nil, errDBusMalformed
+		}
+	}
+	return reply, nil
+}
+
+type dbusConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	serial uint32
+}
+
+func dialSystemBus() (*dbusConn, error) {
+	path := dbusSystemBusSocket
+	if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); strings.HasPrefix(address, "unix:path=") {
+		path = strings.SplitN(strings.TrimPrefix(address, "unix:path="), ",", 2)[0]
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	bus := &dbusConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(conn, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := bus.reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(conn, "BEGIN\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := bus.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return bus, nil
+}
+
+func (bus *dbusConn) close() {
+	bus.conn.Close()
+}
+
+// call invokes a method and waits for its reply, skipping signals and
+// other messages meanwhile.
+func (bus *dbusConn) call(destination, path, iface, member, signature string, body []byte) error {
+	bus.serial++
+	msg := dbusMessage(bus.serial, destination, path, iface, member, signature, body)
+	if _, err := bus.conn.Write(msg); err != nil {
+		return err
+	}
+	for {
+		reply, err := readDBusMessage(bus.reader)
+		if err != nil {
+			return err
+		}
+		if reply.replySerial != bus.serial {
+			continue
+		}
+		switch reply.typ {
+		case dbusMethodReturn:
+			return nil
+		case dbusError:
+			callErr := &dbusCallError{name: reply.errorName}
+			if strings.HasPrefix(reply.signature, "s") {
+				d := &dbusDecoder{order: reply.order, b: reply.body}
+				callErr.message, _ = d.string()
+			}
+			return callErr
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDBusMessage(t *testing.T) {
+	e := &dbusEncoder{}
+	e.uint32(3)
+	e.array(8, func() {
+		e.align(8)
+		e.string("~.")
+		e.bool(true)
+	})
+	body := e.b
+	msg := dbusMessage(7, resolvedDestination, resolvedPath, resolvedInterface, "SetLinkDomains", "ia(sb)", body)
+	if len(msg)%8 != len(body)%8 {
+		t.Fatal("body of message not aligned")
+	}
+
+	// a call parses like any other message
+
+	reply, err := readDBusMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.typ != dbusMethodCall || reply.signature != "ia(sb)" || !bytes.Equal(reply.body, body) {
+		t.Errorf("unexpected message %+v", reply)
+	}
+
+	// an error reply, big endian
+	errorReply := []byte{
+		'B', dbusError, 1, 1,
+		0, 0, 0, 8, // body length
+		0, 0, 0, 9, // serial
+		0, 0, 0, 31, // header fields length
+		dbusFieldReplySerial, 1, 'u', 0, 0, 0, 0, 7,
+		dbusFieldErrorName, 1, 's', 0, 0, 0, 0, 6, 'x', '.', 'y', '.', 'Z', 'z', 0, 0,
+		dbusFieldSignature, 1, 'g', 0, 1, 's', 0,
+		0, // padding
+		0, 0, 0, 3, 'b', 'a', 'd', 0,
+	}
+	reply, err = readDBusMessage(bytes.NewReader(errorReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.typ != dbusError || reply.replySerial != 7 || reply.errorName != "x.y.Zz" || reply.signature != "s" {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	d := &dbusDecoder{order: reply.order, b: reply.body}
+	if message, _ := d.string(); message != "bad" {
+		t.Errorf("unexpected error message %q", message)
+	}
+}
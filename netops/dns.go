@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DNSConfig is the DNS configuration of an interface.
+type DNSConfig struct {
+	Servers []net.IP
+	Search  []string
+
+	// DefaultRoute is set if the interface carries a default route, so
+	// that all queries are meant to go to Servers.
+	DefaultRoute bool
+}
+
+// DNSHook applies the DNS configuration of an interface brought up by
+// Up and reverts it in Down.
+type DNSHook interface {
+	SetDNS(name string, dns DNSConfig) error
+	RevertDNS(name string) error
+}
+
+// ResolvConf is a DNSHook replacing the resolv.conf(5) file at Path,
+// /etc/resolv.conf if empty, and restoring its previous content.
+type ResolvConf struct {
+	Path string
+
+	mutex sync.Mutex
+	saved []byte
+	mode  os.FileMode
+}
+
+func (rc *ResolvConf) path() string {
+	if rc.Path == "" {
+		return "/etc/resolv.conf"
+	}
+	return rc.Path
+}
+
+func (rc *ResolvConf) SetDNS(name string, dns DNSConfig) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	path := rc.path()
+	if rc.saved == nil {
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		saved, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		rc.mode = 0644
+		if info != nil {
+			rc.mode = info.Mode().Perm()
+		}
+		rc.saved = append([]byte{}, saved...)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by wireguard-go for %s\n", name)
+	for _, server := range dns.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server.String())
+	}
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(dns.Search, " "))
+	}
+	return ioutil.WriteFile(path, b.Bytes(), rc.mode)
+}
+
+func (rc *ResolvConf) RevertDNS(name string) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.saved == nil {
+		return nil
+	}
+	if err := ioutil.WriteFile(rc.path(), rc.saved, rc.mode); err != nil {
+		return err
+	}
+	rc.saved = nil
+	return nil
+}
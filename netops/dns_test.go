@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resolv.conf")
+	original := "nameserver 192.0.2.53\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &ResolvConf{Path: path}
+	dns := DNSConfig{
+		Servers: []net.IP{net.ParseIP("10.0.0.53"), net.ParseIP("fd00::53")},
+		Search:  []string{"example.com", "example.net"},
+	}
+	if err := rc.SetDNS("wg0", dns); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.SetDNS("wg0", dns); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(path)
+	expected := "# Generated by wireguard-go for wg0\nnameserver 10.0.0.53\nnameserver fd00::53\nsearch example.com example.net\n"
+	if string(written) != expected {
+		t.Errorf("wrote:\n%s", written)
+	}
+
+	if err := rc.RevertDNS("wg0"); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := ioutil.ReadFile(path)
+	if string(restored) != original {
+		t.Errorf("restored:\n%s", restored)
+	}
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package netops configures the network stack for a WireGuard interface
+// the way wg-quick(8) does: it assigns the addresses of the interface,
+// brings it up and routes the allowed IPs of its peers through it.
+//
+// A default route among the allowed IPs is installed into a separate
+// routing table, selected by policy routing rules for all packets not
+// carrying the firewall mark of the device, so that the encrypted
+// packets themselves still leave through the original default route.
+package netops
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/config"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// DefaultTable is the routing table and firewall mark used for
+	// default routes when the device has no firewall mark of its own.
+	DefaultTable = 51820
+
+	mainTable = 254
+)
+
+var ErrUnsupported = errors.New("network configuration unsupported on this platform")
+
+type route struct {
+	network net.IPNet
+	table   uint32
+}
+
+// rule is a policy routing rule looking up table, either for packets
+// not carrying mark or, if suppressPrefixLength, suppressing default
+// routes of table.
+type rule struct {
+	family               int // 4 or 6
+	table                uint32
+	mark                 uint32
+	suppressPrefixLength bool
+}
+
+type plan struct {
+	addresses    []net.IPNet
+	mtu          int
+	routes       []route
+	rules        []rule
+	fwmark       uint32 // firewall mark the device must use, zero if none
+	defaultRoute bool
+}
+
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// parseTable returns the routing table named by table, false if it
+// is chosen automatically. Routing is disabled by "off".
+func parseTable(table string) (id uint32, auto bool, err error) {
+	switch strings.ToLower(table) {
+	case "", "auto":
+		return mainTable, true, nil
+	case "off":
+		return 0, false, nil
+	case "main":
+		return mainTable, false, nil
+	}
+	n, err := strconv.ParseUint(table, 10, 32)
+	if err != nil || n == 0 {
+		return 0, false, fmt.Errorf("table %q: %w", table, device.ErrInvalidValue)
+	}
+	return uint32(n), false, nil
+}
+
+// makePlan works out what Up configures for cfg. As with wg-quick,
+// routes are added most specific first.
+func makePlan(cfg *config.Config) (plan, error) {
+	p := plan{
+		addresses: cfg.Address,
+		mtu:       cfg.MTU,
+	}
+
+	table, auto, err := parseTable(cfg.Table)
+	if err != nil || table == 0 {
+		return p, err
+	}
+
+	var allowedIPs []net.IPNet
+	for _, peer := range cfg.Device.Peers {
+		allowedIPs = append(allowedIPs, peer.AllowedIPs...)
+	}
+	sort.SliceStable(allowedIPs, func(i, j int) bool {
+		a, _ := allowedIPs[i].Mask.Size()
+		b, _ := allowedIPs[j].Mask.Size()
+		return a > b
+	})
+
+	defaultFamilies := make(map[int]bool)
+	for _, network := range allowedIPs {
+		ones, _ := network.Mask.Size()
+		if ones != 0 || !auto {
+			p.routes = append(p.routes, route{network: network, table: table})
+			continue
+		}
+
+		if p.fwmark == 0 {
+			p.fwmark = DefaultTable
+			if cfg.Device.FirewallMark != nil && *cfg.Device.FirewallMark != 0 {
+				p.fwmark = *cfg.Device.FirewallMark
+			}
+		}
+		p.routes = append(p.routes, route{network: network, table: p.fwmark})
+		defaultFamilies[family(network.IP)] = true
+	}
+	p.defaultRoute = len(defaultFamilies) > 0
+
+	for _, f := range []int{4, 6} {
+		if defaultFamilies[f] {
+			p.rules = append(p.rules,
+				rule{family: f, table: p.fwmark, mark: p.fwmark},
+				rule{family: f, table: mainTable, suppressPrefixLength: true},
+			)
+		}
+	}
+	return p, nil
+}
+
+// Options are optional parameters of UpWithOptions.
+type Options struct {
+	// DNS, if not nil, is handed the DNS servers and search domains of
+	// the configuration, if there are any.
+	DNS DNSHook
+}
+
+// Interface is a network interface configured by Up.
+type Interface struct {
+	name   string
+	plan   plan
+	dns    DNSHook
+	dnsSet bool
+}
+
+// Up configures the interface called name for cfg: it assigns the
+// addresses, sets the MTU, brings the interface up and adds routes for
+// the allowed IPs of all peers unless cfg.Table is "off". If these
+// include a default route, cfg.Device.FirewallMark is set to the mark
+// the rules exempt, so cfg.Device must be applied to the device after
+// Up. On failure, Up undoes what it configured.
+func Up(name string, cfg *config.Config) (*Interface, error) {
+	return UpWithOptions(name, cfg, Options{})
+}
+
+// UpWithOptions is like Up, and then applies the DNS configuration
+// through options.DNS.
+func UpWithOptions(name string, cfg *config.Config, options Options) (*Interface, error) {
+	p, err := makePlan(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p.fwmark != 0 {
+		fwmark := p.fwmark
+		cfg.Device.FirewallMark = &fwmark
+	}
+	iface := &Interface{name: name, plan: p, dns: options.DNS}
+	if err := iface.up(); err != nil {
+		iface.down()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if iface.dns != nil && (len(cfg.DNS) > 0 || len(cfg.DNSSearch) > 0) {
+		dns := DNSConfig{
+			Servers:      cfg.DNS,
+			Search:       cfg.DNSSearch,
+			DefaultRoute: p.defaultRoute,
+		}
+		if err := iface.dns.SetDNS(name, dns); err != nil {
+			iface.dns.RevertDNS(name)
+			iface.down()
+			return nil, fmt.Errorf("%s: DNS: %w", name, err)
+		}
+		iface.dnsSet = true
+	}
+	return iface, nil
+}
+
+// Down reverts the DNS configuration and removes the configuration added
+// by Up. Routes and addresses disappear with the interface anyway, the
+// policy routing rules do not.
+func (iface *Interface) Down() error {
+	if iface.dnsSet {
+		if err := iface.dns.RevertDNS(iface.name); err != nil {
+			iface.down()
+			return fmt.Errorf("%s: DNS: %w", iface.name, err)
+		}
+		iface.dnsSet = false
+	}
+	if err := iface.down(); err != nil {
+		return fmt.Errorf("%s: %w", iface.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"io/ioutil"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Implementation of the network configuration for linux,
+ * through rtnetlink requests acknowledged one at a time.
+ */
+
+// fibRuleHdr is struct fib_rule_hdr of linux/fib_rules.h.
+type fibRuleHdr struct {
+	family uint8
+	dstLen uint8
+	srcLen uint8
+	tos    uint8
+	table  uint8
+	res1   uint8
+	res2   uint8
+	action uint8
+	flags  uint32
+}
+
+const (
+	fraFwmark               = 0xa
+	fraSuppressPrefixLength = 0xe
+	fraTable                = 0xf
+	frActToTable            = 0x1
+	fibRuleInvert           = 0x2
+
+	srcValidMarkPath = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+)
+
+type netlinkMessage struct {
+	typ  uint16
+	data []byte
+}
+
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	b := make([]byte, size)
+	copy(b, (*[1 << 16]byte)(p)[:size:size])
+	return b
+}
+
+func uint32Bytes(v uint32) []byte {
+	return structBytes(unsafe.Pointer(&v), unsafe.Sizeof(v))
+}
+
+func (msg *netlinkMessage) addAttr(typ uint16, data []byte) {
+	attr := unix.RtAttr{
+		Len:  uint16(unix.SizeofRtAttr + len(data)),
+		Type: typ,
+	}
+	msg.data = append(msg.data, structBytes(unsafe.Pointer(&attr), unix.SizeofRtAttr)...)
+	msg.data = append(msg.data, data...)
+	for len(msg.data)%unix.NLMSG_ALIGNTO != 0 {
+		msg.data = append(msg.data, 0)
+	}
+}
+
+func familyOf(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+type netlinkSocket struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlinkSocket() (*netlinkSocket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &netlinkSocket{fd: fd}, nil
+}
+
+func (sock *netlinkSocket) close() {
+	unix.Close(sock.fd)
+}
+
+// request sends msg and waits for the kernel to acknowledge it.
+func (sock *netlinkSocket) request(msg *netlinkMessage, flags uint16) error {
+	sock.seq++
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(msg.data)),
+		Type:  msg.typ,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK | flags,
+		Seq:   sock.seq,
+	}
+	b := append(structBytes(unsafe.Pointer(&hdr), unix.SizeofNlMsghdr), msg.data...)
+	if err := unix.Sendto(sock.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(sock.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != sock.seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < unix.SizeofNlMsgerr {
+				return unix.EINVAL
+			}
+			nlerr := (*unix.NlMsgerr)(unsafe.Pointer(&m.Data[0]))
+			if nlerr.Error != 0 {
+				return unix.Errno(-nlerr.Error)
+			}
+			return nil
+		}
+	}
+}
+
+func addressMessage(typ uint16, index int, address net.IPNet) *netlinkMessage {
+	fam, ip := familyOf(address.IP)
+	ones, _ := address.Mask.Size()
+	ifa := unix.IfAddrmsg{
+		Family:    fam,
+		Prefixlen: uint8(ones),
+		Index:     uint32(index),
+	}
+	msg := &netlinkMessage{typ: typ, data: structBytes(unsafe.Pointer(&ifa), unix.SizeofIfAddrmsg)}
+	msg.addAttr(unix.IFA_LOCAL, ip)
+	msg.addAttr(unix.IFA_ADDRESS, ip)
+	return msg
+}
+
+func linkMessage(index int, mtu int) *netlinkMessage {
+	ifi := unix.IfInfomsg{
+		Family: unix.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  unix.IFF_UP,
+		Change: unix.IFF_UP,
+	}
+	msg := &netlinkMessage{typ: unix.RTM_NEWLINK, data: structBytes(unsafe.Pointer(&ifi), unix.SizeofIfInfomsg)}
+	if mtu != 0 {
+		msg.addAttr(unix.IFLA_MTU, uint32Bytes(uint32(mtu)))
+	}
+	return msg
+}
+
+func routeMessage(typ uint16, index int, r route) *netlinkMessage {
+	fam, ip := familyOf(r.network.IP)
+	ones, _ := r.network.Mask.Size()
+	rtm := unix.RtMsg{
+		Family:   fam,
+		Dst_len:  uint8(ones),
+		Table:    unix.RT_TABLE_UNSPEC,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+	msg := &netlinkMessage{typ: typ, data: structBytes(unsafe.Pointer(&rtm), unix.SizeofRtMsg)}
+	if ones != 0 {
+		msg.addAttr(unix.RTA_DST, ip)
+	}
+	msg.addAttr(unix.RTA_OIF, uint32Bytes(uint32(index)))
+	msg.addAttr(unix.RTA_TABLE, uint32Bytes(r.table))
+	return msg
+}
+
+func ruleMessage(typ uint16, r rule) *netlinkMessage {
+	hdr := fibRuleHdr{
+		family: unix.AF_INET,
+		action: frActToTable,
+	}
+	if r.family == 6 {
+		hdr.family = unix.AF_INET6
+	}
+	if r.mark != 0 {
+		hdr.flags = fibRuleInvert
+	}
+	msg := &netlinkMessage{typ: typ, data: structBytes(unsafe.Pointer(&hdr), unsafe.Sizeof(hdr))}
+	msg.addAttr(fraTable, uint32Bytes(r.table))
+	if r.mark != 0 {
+		msg.addAttr(fraFwmark, uint32Bytes(r.mark))
+	}
+	if r.suppressPrefixLength {
+		msg.addAttr(fraSuppressPrefixLength, uint32Bytes(0))
+	}
+	return msg
+}
+
+func (iface *Interface) up() error {
+	link, err := net.InterfaceByName(iface.name)
+	if err != nil {
+		return err
+	}
+	sock, err := openNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer sock.close()
+
+	for _, address := range iface.plan.addresses {
+		err := sock.request(addressMessage(unix.RTM_NEWADDR, link.Index, address), unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+		if err != nil && err != unix.EEXIST {
+			return err
+		}
+	}
+	if err := sock.request(linkMessage(link.Index, iface.plan.mtu), 0); err != nil {
+		return err
+	}
+	for _, r := range iface.plan.routes {
+		err := sock.request(routeMessage(unix.RTM_NEWROUTE, link.Index, r), unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+		if err != nil && err != unix.EEXIST {
+			return err
+		}
+	}
+	for _, r := range iface.plan.rules {
+		if r.family == 4 && r.mark != 0 {
+			// replies to marked packets must pass the reverse path filter
+			if err := ioutil.WriteFile(srcValidMarkPath, []byte("1"), 0); err != nil {
+				return err
+			}
+		}
+		if err := sock.request(ruleMessage(unix.RTM_NEWRULE, r), unix.NLM_F_CREATE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iface *Interface) down() error {
+	sock, err := openNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer sock.close()
+
+	var firstErr error
+	check := func(err error) {
+		if err != nil && err != unix.ENOENT && err != unix.ESRCH && err != unix.EADDRNOTAVAIL && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, r := range iface.plan.rules {
+		check(sock.request(ruleMessage(unix.RTM_DELRULE, r), 0))
+	}
+
+	link, err := net.InterfaceByName(iface.name)
+	if err != nil {
+		return firstErr // routes and addresses are gone with the interface
+	}
+	for _, r := range iface.plan.routes {
+		check(sock.request(routeMessage(unix.RTM_DELROUTE, link.Index, r), 0))
+	}
+	for _, address := range iface.plan.addresses {
+		check(sock.request(addressMessage(unix.RTM_DELADDR, link.Index, address), 0))
+	}
+	return firstErr
+}
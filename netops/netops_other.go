@@ -0,0 +1,16 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+func (iface *Interface) up() error {
+	return ErrUnsupported
+}
+
+func (iface *Interface) down() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/config"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func parse(t *testing.T, table, allowedIPs string) *config.Config {
+	cfg, err := config.Parse(strings.NewReader(`[Interface]
+Address = 10.0.0.2/24
+Table = ` + table + `
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = ` + allowedIPs + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestPlanRoutes(t *testing.T) {
+	p, err := makePlan(parse(t, "auto", "10.0.0.0/24, 10.1.0.0/16, 10.0.0.5/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for _, r := range p.routes {
+		if r.table != mainTable {
+			t.Errorf("route %v in table %d", r.network, r.table)
+		}
+		routes = append(routes, r.network.String())
+	}
+	if got := strings.Join(routes, " "); got != "10.0.0.5/32 10.0.0.0/24 10.1.0.0/16" {
+		t.Errorf("routes = %s", got)
+	}
+	if p.fwmark != 0 || len(p.rules) != 0 {
+		t.Errorf("unexpected fwmark %d and rules %v", p.fwmark, p.rules)
+	}
+
+	p, err = makePlan(parse(t, "off", "10.0.0.0/24"))
+	if err != nil || len(p.routes) != 0 {
+		t.Errorf("routes added with table off: %v, %v", p.routes, err)
+	}
+
+	p, err = makePlan(parse(t, "1234", "0.0.0.0/0"))
+	if err != nil || len(p.routes) != 1 || p.routes[0].table != 1234 || len(p.rules) != 0 {
+		t.Errorf("default route not added to table 1234: %v, %v, %v", p.routes, p.rules, err)
+	}
+
+	if _, err := makePlan(parse(t, "nope", "0.0.0.0/0")); !errors.Is(err, device.ErrInvalidValue) {
+		t.Errorf("invalid table accepted: %v", err)
+	}
+}
+
+func TestPlanDefaultRoute(t *testing.T) {
+	cfg := parse(t, "", "0.0.0.0/0, ::/0, 192.168.0.0/16")
+	p, err := makePlan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.fwmark != DefaultTable {
+		t.Errorf("fwmark = %d", p.fwmark)
+	}
+	if len(p.routes) != 3 || p.routes[0].table != mainTable || p.routes[1].table != DefaultTable || p.routes[2].table != DefaultTable {
+		t.Errorf("routes = %v", p.routes)
+	}
+	if len(p.rules) != 4 {
+		t.Fatalf("rules = %v", p.rules)
+	}
+	for i, r := range p.rules {
+		wantFamily := 4
+		if i >= 2 {
+			wantFamily = 6
+		}
+		if r.family != wantFamily {
+			t.Errorf("rule %d for IPv%d", i, r.family)
+		}
+		if i%2 == 0 && (r.mark != DefaultTable || r.table != DefaultTable) {
+			t.Errorf("rule %d does not exempt the marked packets: %+v", i, r)
+		}
+		if i%2 == 1 && (!r.suppressPrefixLength || r.table != mainTable) {
+			t.Errorf("rule %d does not suppress the main default route: %+v", i, r)
+		}
+	}
+
+	fwmark := uint32(0x42)
+	cfg.Device.FirewallMark = &fwmark
+	if p, _ := makePlan(cfg); p.fwmark != fwmark || p.routes[1].table != fwmark {
+		t.Errorf("firewall mark of the device not used: %d", p.fwmark)
+	}
+}
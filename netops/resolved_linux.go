@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netops
+
+import (
+	"net"
+)
+
+const (
+	resolvedDestination = "org.freedesktop.resolve1"
+	resolvedPath        = "/org/freedesktop/resolve1"
+	resolvedInterface   = "org.freedesktop.resolve1.Manager"
+)
+
+// Resolved is a DNSHook configuring the link of the interface in
+// systemd-resolved(8) over D-Bus. With a default route, the link takes
+// all queries through the "~." routing domain.
+type Resolved struct{}
+
+func (Resolved) SetDNS(name string, dns DNSConfig) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	bus, err := dialSystemBus()
+	if err != nil {
+		return err
+	}
+	defer bus.close()
+	index := uint32(link.Index)
+
+	e := &dbusEncoder{}
+	e.uint32(index)
+	e.array(8, func() {
+		for _, server := range dns.Servers {
+			family, ip := familyOf(server)
+			e.align(8)
+			e.uint32(uint32(family))
+			e.array(1, func() {
+				e.b = append(e.b, ip...)
+			})
+		}
+	})
+	if err := bus.call(resolvedDestination, resolvedPath, resolvedInterface, "SetLinkDNS", "ia(iay)", e.b); err != nil {
+		return err
+	}
+
+	e = &dbusEncoder{}
+	e.uint32(index)
+	e.array(8, func() {
+		for _, domain := range dns.Search {
+			e.align(8)
+			e.string(domain)
+			e.bool(false)
+		}
+		if dns.DefaultRoute {
+			e.align(8)
+			e.string("~.")
+			e.bool(true)
+		}
+	})
+	if err := bus.call(resolvedDestination, resolvedPath, resolvedInterface, "SetLinkDomains", "ia(sb)", e.b); err != nil {
+		return err
+	}
+
+	if dns.DefaultRoute {
+		e = &dbusEncoder{}
+		e.uint32(index)
+		e.bool(true)
+		err := bus.call(resolvedDestination, resolvedPath, resolvedInterface, "SetLinkDefaultRoute", "ib", e.b)
+		if callErr, ok := err.(*dbusCallError); ok && callErr.name == "org.freedesktop.DBus.Error.UnknownMethod" {
+			err = nil // before systemd 240, the routing domain suffices
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (Resolved) RevertDNS(name string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil // resolved forgets the link with the interface
+	}
+	bus, err := dialSystemBus()
+	if err != nil {
+		return err
+	}
+	defer bus.close()
+
+	e := &dbusEncoder{}
+	e.uint32(uint32(link.Index))
+	return bus.call(resolvedDestination, resolvedPath, resolvedInterface, "RevertLink", "i", e.b)
+}
@@ -0,0 +1,11 @@
+module golang.zx2c4.com/wireguard/otel
+
+go 1.20
+
+require (
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/trace v1.21.0
+	golang.zx2c4.com/wireguard v0.0.0-00010101000000-000000000000
+)
+
+replace golang.zx2c4.com/wireguard => ../
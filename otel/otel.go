@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+/* OpenTelemetry tracing of a device
+ *
+ * The device traces its handshakes and configuration operations through
+ * device.Tracer, leaving the choice of a tracing library to its user.
+ * This separate module adapts OpenTelemetry, imported here as wgotel:
+ *
+ *   dev := device.NewDeviceWithOptions(tun, logger, device.DeviceOptions{
+ *           Tracer: wgotel.NewTracer(otel.GetTracerProvider()),
+ *   })
+ */
+
+// InstrumentationName names the tracer of the device.
+const InstrumentationName = "golang.zx2c4.com/wireguard"
+
+// NewTracer returns a device.Tracer starting the spans of the device with
+// a tracer of provider.
+func NewTracer(provider trace.TracerProvider) device.Tracer {
+	return tracer{provider.Tracer(InstrumentationName, trace.WithInstrumentationVersion(device.WireGuardGoVersion))}
+}
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (context.Context, device.Span) {
+	ctx, s := t.tracer.Start(ctx, name)
+	return ctx, span{s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	switch value := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, value))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, value))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, value))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+	}
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// DefaultGateway returns the IPv4 gateway of the default route.
+func DefaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseRoutes(file)
+}
+
+// parseRoutes finds the default gateway in the format of /proc/net/route,
+// where addresses are in host byte order.
+func parseRoutes(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		v := uint32(gateway)
+		ip := *(*[4]byte)(unsafe.Pointer(&v))
+		return net.IPv4(ip[0], ip[1], ip[2], ip[3]).To4(), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoGateway
+}
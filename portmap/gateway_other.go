@@ -0,0 +1,15 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package portmap
+
+import "net"
+
+// DefaultGateway returns the IPv4 gateway of the default route.
+func DefaultGateway() (net.IP, error) {
+	return nil, ErrUnsupported
+}
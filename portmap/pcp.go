@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/* PCP and NAT-PMP share the port of the gateway they are spoken to,
+ * and PCP servers answer NAT-PMP requests with a version error.
+ */
+
+var gatewayPort = 5351 // variable for tests
+
+const (
+	natpmpVersion     = 0
+	natpmpOpAddress   = 0
+	natpmpOpMapUDP    = 1
+	natpmpOpReply     = 128
+	natpmpSuccess     = 0
+	pcpVersion        = 2
+	pcpOpMap          = 1
+	pcpOpReply        = 0x80
+	pcpSuccess        = 0
+	pcpRequestSize    = 60
+	pcpResponseSize   = 60
+	natpmpMapSize     = 16
+	natpmpAddressSize = 12
+	protocolUDP       = 17
+)
+
+var errShortResponse = errors.New("short response")
+
+// exchange sends request to the gateway, retransmitting it with
+// exponential backoff, until parse accepts a response, returning true.
+func exchange(ctx context.Context, gateway net.IP, request []byte, parse func([]byte) (bool, error)) error {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: gatewayPort})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var buff [1100]byte
+	for delay := time.Millisecond * 250; ; delay *= 2 {
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(delay))
+		for {
+			n, err := conn.Read(buff[:])
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if done, err := parse(buff[:n]); done || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *Mapping) mapNATPMP(ctx context.Context, lifetime time.Duration) error {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:], m.InternalPort)
+	if lifetime > 0 {
+		binary.BigEndian.PutUint16(request[6:], m.ExternalPort)
+	}
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime/time.Second))
+
+	err := exchange(ctx, m.gateway, request, func(response []byte) (bool, error) {
+		if len(response) < 4 || response[1] != natpmpOpReply+natpmpOpMapUDP {
+			return false, nil
+		}
+		if result := binary.BigEndian.Uint16(response[2:]); result != natpmpSuccess {
+			return true, fmt.Errorf("NAT-PMP result code %d", result)
+		}
+		if len(response) < natpmpMapSize || binary.BigEndian.Uint16(response[8:]) != m.InternalPort {
+			return true, errShortResponse
+		}
+		m.ExternalPort = binary.BigEndian.Uint16(response[10:])
+		m.Lifetime = time.Duration(binary.BigEndian.Uint32(response[12:])) * time.Second
+		return true, nil
+	})
+	if err != nil || lifetime == 0 {
+		return err
+	}
+
+	// the mapping response lacks the external address, ask for it
+
+	return exchange(ctx, m.gateway, []byte{natpmpVersion, natpmpOpAddress}, func(response []byte) (bool, error) {
+		if len(response) < natpmpAddressSize || response[1] != natpmpOpReply+natpmpOpAddress {
+			return false, nil
+		}
+		if binary.BigEndian.Uint16(response[2:]) == natpmpSuccess {
+			m.ExternalIP = net.IP(append([]byte{}, response[8:12]...))
+		}
+		return true, nil
+	})
+}
+
+func (m *Mapping) mapPCP(ctx context.Context, lifetime time.Duration) error {
+	client, err := localAddress(m.gateway.String())
+	if err != nil {
+		return err
+	}
+	var zero [12]byte
+	if m.nonce == zero {
+		if _, err := rand.Read(m.nonce[:]); err != nil {
+			return err
+		}
+	}
+
+	request := make([]byte, pcpRequestSize)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:], uint32(lifetime/time.Second))
+	copy(request[8:24], client.To16())
+	copy(request[24:36], m.nonce[:])
+	request[36] = protocolUDP
+	binary.BigEndian.PutUint16(request[40:], m.InternalPort)
+	suggested := net.IPv4zero.To16()
+	if lifetime > 0 {
+		binary.BigEndian.PutUint16(request[42:], m.ExternalPort)
+		if m.ExternalIP != nil {
+			suggested = m.ExternalIP.To16()
+		}
+	}
+	copy(request[44:60], suggested)
+
+	return exchange(ctx, m.gateway, request, func(response []byte) (bool, error) {
+		if len(response) < 4 {
+			return false, nil
+		}
+		if response[0] != pcpVersion {
+			return true, fmt.Errorf("version %d spoken", response[0])
+		}
+		if response[1] != pcpOpReply+pcpOpMap {
+			return false, nil
+		}
+		if result := response[3]; result != pcpSuccess {
+			return true, fmt.Errorf("PCP result code %d", result)
+		}
+		if len(response) < pcpResponseSize || string(response[24:36]) != string(m.nonce[:]) {
+			return false, nil
+		}
+		m.Lifetime = time.Duration(binary.BigEndian.Uint32(response[4:])) * time.Second
+		m.ExternalPort = binary.BigEndian.Uint16(response[42:])
+		m.ExternalIP = net.IP(append([]byte{}, response[44:60]...))
+		if ip4 := m.ExternalIP.To4(); ip4 != nil {
+			m.ExternalIP = ip4
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package portmap requests UDP port mappings from the local gateway,
+// using PCP (RFC 6887), NAT-PMP (RFC 6886) or UPnP IGD, so that peers
+// behind a NAT can be reached from the outside.
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Protocol int
+
+const (
+	ProtocolPCP = Protocol(iota + 1)
+	ProtocolNATPMP
+	ProtocolUPnP
+)
+
+func (protocol Protocol) String() string {
+	switch protocol {
+	case ProtocolPCP:
+		return "PCP"
+	case ProtocolNATPMP:
+		return "NAT-PMP"
+	case ProtocolUPnP:
+		return "UPnP"
+	default:
+		return fmt.Sprintf("Protocol(UNKNOWN:%d)", int(protocol))
+	}
+}
+
+var (
+	ErrNoGateway   = errors.New("no gateway supporting port mapping found")
+	ErrUnsupported = errors.New("gateway discovery unsupported on this platform")
+)
+
+// A Mapping forwards a UDP port of the gateway to the local host.
+type Mapping struct {
+	Protocol     Protocol
+	ExternalIP   net.IP // nil if the gateway did not report it
+	ExternalPort uint16
+	InternalPort uint16
+	Lifetime     time.Duration // after which the mapping expires unless renewed
+
+	gateway     net.IP
+	nonce       [12]byte // PCP
+	controlURL  string   // UPnP
+	serviceType string   // UPnP
+}
+
+// External returns the external endpoint of m, empty if the external
+// address is unknown.
+func (m *Mapping) External() string {
+	if m.ExternalIP == nil || m.ExternalIP.IsUnspecified() {
+		return ""
+	}
+	return net.JoinHostPort(m.ExternalIP.String(), strconv.Itoa(int(m.ExternalPort)))
+}
+
+// Map requests a mapping of the UDP port internalPort for lifetime. PCP
+// and NAT-PMP are tried with gateway, if not nil, then UPnP IGD devices
+// on the LAN. A previous mapping of the same port is renewed through the
+// protocol which created it, keeping its external port if possible.
+func Map(ctx context.Context, gateway net.IP, internalPort uint16, lifetime time.Duration, previous *Mapping) (*Mapping, error) {
+	protocols := []Protocol{ProtocolPCP, ProtocolNATPMP, ProtocolUPnP}
+	if previous != nil && previous.InternalPort == internalPort {
+		protocols = append([]Protocol{previous.Protocol}, protocols...)
+	} else {
+		previous = nil
+	}
+
+	var errs []string
+	tried := make(map[Protocol]bool)
+	for _, protocol := range protocols {
+		if tried[protocol] || ctx.Err() != nil {
+			continue
+		}
+		tried[protocol] = true
+		if protocol != ProtocolUPnP && gateway == nil {
+			continue
+		}
+
+		m := &Mapping{Protocol: protocol, InternalPort: internalPort, gateway: gateway}
+		if previous != nil && previous.Protocol == protocol {
+			*m = *previous
+		}
+		attempt, cancel := context.WithTimeout(ctx, attemptTimeout)
+		var err error
+		switch protocol {
+		case ProtocolPCP:
+			err = m.mapPCP(attempt, lifetime)
+		case ProtocolNATPMP:
+			err = m.mapNATPMP(attempt, lifetime)
+		case ProtocolUPnP:
+			err = m.mapUPnP(attempt, lifetime)
+		}
+		cancel()
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", protocol, err))
+	}
+	if len(errs) == 0 {
+		return nil, ErrNoGateway
+	}
+	return nil, fmt.Errorf("%w (%s)", ErrNoGateway, strings.Join(errs, "; "))
+}
+
+// Unmap deletes the mapping m from the gateway.
+func Unmap(ctx context.Context, m *Mapping) error {
+	switch m.Protocol {
+	case ProtocolPCP:
+		return m.mapPCP(ctx, 0)
+	case ProtocolNATPMP:
+		return m.mapNATPMP(ctx, 0)
+	case ProtocolUPnP:
+		return m.unmapUPnP(ctx)
+	}
+	return nil
+}
+
+// attemptTimeout bounds the time spent on a single protocol, so that
+// a gateway which does not speak one moves on to the next.
+const attemptTimeout = time.Second * 2
+
+// localAddress returns the address the local host uses to reach host.
+func localAddress(host string) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// DefaultLifetime is the lifetime Mapper requests unless told otherwise.
+const DefaultLifetime = time.Hour * 2
+
+// Mapper keeps a mapping for a single port, renewing it on every call
+// of MapPort. It implements device.PortMapper.
+type Mapper struct {
+	Gateway  net.IP        // where PCP and NAT-PMP are spoken, the default gateway if nil
+	Lifetime time.Duration // requested lifetime, DefaultLifetime if zero
+
+	mutex   sync.Mutex
+	mapping *Mapping
+}
+
+// MapPort maps port, replacing the mapping of another port, and returns
+// the external endpoint and how long the mapping lasts.
+func (mapper *Mapper) MapPort(ctx context.Context, port uint16) (string, time.Duration, error) {
+	mapper.mutex.Lock()
+	defer mapper.mutex.Unlock()
+
+	if mapper.mapping != nil && mapper.mapping.InternalPort != port {
+		Unmap(ctx, mapper.mapping)
+		mapper.mapping = nil
+	}
+	gateway := mapper.Gateway
+	if gateway == nil {
+		gateway, _ = DefaultGateway()
+	}
+	lifetime := mapper.Lifetime
+	if lifetime == 0 {
+		lifetime = DefaultLifetime
+	}
+	m, err := Map(ctx, gateway, port, lifetime, mapper.mapping)
+	if err != nil {
+		mapper.mapping = nil
+		return "", 0, err
+	}
+	mapper.mapping = m
+	return m.External(), m.Lifetime, nil
+}
+
+// UnmapPort removes the current mapping, if any.
+func (mapper *Mapper) UnmapPort(ctx context.Context) error {
+	mapper.mutex.Lock()
+	defer mapper.mutex.Unlock()
+
+	if mapper.mapping == nil {
+		return nil
+	}
+	err := Unmap(ctx, mapper.mapping)
+	mapper.mapping = nil
+	return err
+}
+
+// Mapping returns the current mapping, nil if there is none.
+func (mapper *Mapper) Mapping() *Mapping {
+	mapper.mutex.Lock()
+	defer mapper.mutex.Unlock()
+	return mapper.mapping
+}
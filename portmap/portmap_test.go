@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// fakeGateway answers requests on the PCP and NAT-PMP port with reply.
+func fakeGateway(t *testing.T, reply func(request []byte) []byte) func() {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := gatewayPort
+	gatewayPort = conn.LocalAddr().(*net.UDPAddr).Port
+	go func() {
+		var buff [1100]byte
+		for {
+			n, from, err := conn.ReadFromUDP(buff[:])
+			if err != nil {
+				return
+			}
+			if response := reply(buff[:n]); response != nil {
+				conn.WriteToUDP(response, from)
+			}
+		}
+	}()
+	return func() {
+		conn.Close()
+		gatewayPort = previous
+	}
+}
+
+func natpmpReply(request []byte) []byte {
+	if request[0] != natpmpVersion {
+		return []byte{natpmpVersion, natpmpOpReply + request[1], 0, 1} // unsupported version
+	}
+	switch request[1] {
+	case natpmpOpAddress:
+		response := make([]byte, natpmpAddressSize)
+		response[1] = natpmpOpReply + natpmpOpAddress
+		copy(response[8:], externalIP)
+		return response
+	case natpmpOpMapUDP:
+		response := make([]byte, natpmpMapSize)
+		response[1] = natpmpOpReply + natpmpOpMapUDP
+		copy(response[8:10], request[4:6])
+		binary.BigEndian.PutUint16(response[10:], 40000)
+		copy(response[12:16], request[8:12])
+		return response
+	}
+	return nil
+}
+
+func TestMapNATPMP(t *testing.T) {
+	defer fakeGateway(t, natpmpReply)()
+
+	m, err := Map(context.Background(), net.IPv4(127, 0, 0, 1), 51820, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtocolNATPMP || m.External() != "203.0.113.7:40000" || m.Lifetime != time.Hour {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+	if err := Unmap(context.Background(), m); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMapPCP(t *testing.T) {
+	var mutex sync.Mutex
+	var nonces []string
+	defer fakeGateway(t, func(request []byte) []byte {
+		if len(request) != pcpRequestSize || request[0] != pcpVersion || request[1] != pcpOpMap {
+			return nil
+		}
+		mutex.Lock()
+		nonces = append(nonces, string(request[24:36]))
+		mutex.Unlock()
+		response := make([]byte, pcpResponseSize)
+		copy(response, request)
+		response[1] = pcpOpReply + pcpOpMap
+		binary.BigEndian.PutUint16(response[42:], 40001)
+		copy(response[44:], externalIP.To16())
+		return response
+	})()
+
+	m, err := Map(context.Background(), net.IPv4(127, 0, 0, 1), 51820, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtocolPCP || m.External() != "203.0.113.7:40001" || m.Lifetime != time.Hour {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+	if _, err := Map(context.Background(), net.IPv4(127, 0, 0, 1), 51820, time.Hour, m); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(nonces) != 2 || nonces[0] != nonces[1] {
+		t.Error("renewal did not reuse the nonce of the mapping")
+	}
+}
+
+func TestMapUPnP(t *testing.T) {
+	var mutex sync.Mutex
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/description.xml":
+			fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceList><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/control</controlURL>
+</service></serviceList></device></deviceList></device></deviceList>
+</device></root>`)
+		case "/control":
+			action := r.Header.Get("SOAPAction")
+			mutex.Lock()
+			actions = append(actions, action[strings.Index(action, "#")+1:len(action)-1])
+			mutex.Unlock()
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(action, "AddPortMapping") && !strings.Contains(string(body), "<NewInternalPort>51820</NewInternalPort>") {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssdp.Close()
+	previous := ssdpAddress
+	ssdpAddress = ssdp.LocalAddr().(*net.UDPAddr)
+	defer func() { ssdpAddress = previous }()
+	go func() {
+		var buff [1024]byte
+		n, from, err := ssdp.ReadFromUDP(buff[:])
+		if err != nil || !strings.Contains(string(buff[:n]), igdDeviceType) {
+			return
+		}
+		ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nLOCATION: "+server.URL+"/description.xml\r\n\r\n"), from)
+	}()
+
+	m, err := Map(context.Background(), nil, 51820, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtocolUPnP || m.External() != "203.0.113.7:51820" {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+	if err := Unmap(context.Background(), m); err != nil {
+		t.Error(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(actions, " ") != "AddPortMapping GetExternalIPAddress DeletePortMapping" {
+		t.Errorf("unexpected actions %v", actions)
+	}
+}
@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* UPnP IGD: the gateway is found by SSDP, its description names the
+ * control URL of its WAN connection service, which is called by SOAP.
+ */
+
+var ssdpAddress = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900} // variable for tests
+
+const (
+	igdDeviceType        = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	wanIPServicePrefix   = "urn:schemas-upnp-org:service:WANIPConnection:"
+	wanPPPServicePrefix  = "urn:schemas-upnp-org:service:WANPPPConnection:"
+	upnpMappingDescribed = "wireguard-go"
+)
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+func (device *upnpDevice) wanService() (upnpService, bool) {
+	for _, service := range device.Services {
+		if strings.HasPrefix(service.ServiceType, wanIPServicePrefix) || strings.HasPrefix(service.ServiceType, wanPPPServicePrefix) {
+			return service, true
+		}
+	}
+	for i := range device.Devices {
+		if service, ok := device.Devices[i].wanService(); ok {
+			return service, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// discoverIGD returns the location of the description of a gateway.
+func discoverIGD(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"ST: " + igdDeviceType + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), ssdpAddress); err != nil {
+		return "", err
+	}
+
+	var buff [2048]byte
+	for {
+		n, _, err := conn.ReadFromUDP(buff[:])
+		if err != nil {
+			return "", err
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buff[:n])), nil)
+		if err != nil {
+			continue
+		}
+		response.Body.Close()
+		if location := response.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+func (m *Mapping) findControlURL(ctx context.Context) error {
+	location, err := discoverIGD(ctx)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("description: %s", response.Status)
+	}
+
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&root); err != nil {
+		return err
+	}
+	service, ok := root.Device.wanService()
+	if !ok {
+		return errors.New("no WAN connection service")
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return err
+	}
+	m.controlURL = control.String()
+	m.serviceType = service.ServiceType
+	return nil
+}
+
+// soapCall invokes action on the WAN connection service of the gateway,
+// returning the body of the response.
+func (m *Mapping) soapCall(ctx context.Context, action string, args ...string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	request, err := http.NewRequest("POST", m.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, action))
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	reply, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		var fault struct {
+			Code string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		}
+		xml.Unmarshal(reply, &fault)
+		return nil, fmt.Errorf("%s: %s (UPnP error %s)", action, response.Status, fault.Code)
+	}
+	return reply, nil
+}
+
+func (m *Mapping) mapUPnP(ctx context.Context, lifetime time.Duration) error {
+	if m.controlURL == "" {
+		if err := m.findControlURL(ctx); err != nil {
+			return err
+		}
+	}
+	control, err := url.Parse(m.controlURL)
+	if err != nil {
+		return err
+	}
+	client, err := localAddress(control.Hostname())
+	if err != nil {
+		return err
+	}
+
+	externalPort := m.ExternalPort
+	if externalPort == 0 {
+		externalPort = m.InternalPort
+	}
+	_, err = m.soapCall(ctx, "AddPortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(int(externalPort)),
+		"NewProtocol", "UDP",
+		"NewInternalPort", strconv.Itoa(int(m.InternalPort)),
+		"NewInternalClient", client.String(),
+		"NewEnabled", "1",
+		"NewPortMappingDescription", upnpMappingDescribed,
+		"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)),
+	)
+	if err != nil {
+		return err
+	}
+	m.ExternalPort = externalPort
+	m.Lifetime = lifetime
+
+	reply, err := m.soapCall(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return nil // mapped all the same
+	}
+	var address struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if xml.Unmarshal(reply, &address) == nil {
+		m.ExternalIP = net.ParseIP(strings.TrimSpace(address.IP))
+	}
+	return nil
+}
+
+func (m *Mapping) unmapUPnP(ctx context.Context) error {
+	_, err := m.soapCall(ctx, "DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(int(m.ExternalPort)),
+		"NewProtocol", "UDP",
+	)
+	return err
+}
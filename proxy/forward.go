@@ -0,0 +1,260 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Port forwarding from the tunnel to services
+ *
+ * A Forwarder listens on addresses of the inner network of a tunnel,
+ * such as on the *netstack.Net of golang.zx2c4.com/wireguard/tun/netstack,
+ * and forwards the TCP connections and UDP datagrams of peers to target
+ * services, local or remote, which are thereby exposed to the peers
+ * without any firewall or routing setup of the operating system. UDP is
+ * forwarded per flow, the source address of a peer getting a socket of
+ * its own towards the target until the flow is idle for UDPTimeout.
+ */
+
+// Network listens on the addresses rules forward from.
+type Network interface {
+	Listen(network, address string) (net.Listener, error)
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+// ForwardRule forwards a port to a target.
+type ForwardRule struct {
+	Protocol string `json:"protocol"` // "tcp" or "udp"
+	Listen   string `json:"listen"`   // host:port on the tunnel, the host being empty for any address
+	Target   string `json:"target"`   // host:port connections and datagrams are forwarded to
+}
+
+func (rule ForwardRule) String() string {
+	return fmt.Sprintf("%s %s -> %s", rule.Protocol, rule.Listen, rule.Target)
+}
+
+// LoadForwardRules reads a JSON array of rules from r.
+func LoadForwardRules(r io.Reader) ([]ForwardRule, error) {
+	var rules []ForwardRule
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (rule ForwardRule) validate() error {
+	switch rule.Protocol {
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("forward rule %v: unknown protocol %q", rule, rule.Protocol)
+	}
+	if _, _, err := net.SplitHostPort(rule.Listen); err != nil {
+		return fmt.Errorf("forward rule %v: %v", rule, err)
+	}
+	if _, _, err := net.SplitHostPort(rule.Target); err != nil {
+		return fmt.Errorf("forward rule %v: %v", rule, err)
+	}
+	return nil
+}
+
+// A Forwarder forwards ports of a Network to targets.
+type Forwarder struct {
+	Network    Network
+	Dial       DialFunc                                 // nil for the dialer of the host
+	UDPTimeout time.Duration                            // after which idle UDP flows end, zero for DefaultUDPTimeout
+	Logf       func(format string, args ...interface{}) // nil to log nothing
+
+	mutex   sync.Mutex
+	closers []io.Closer
+	closed  bool
+}
+
+const DefaultUDPTimeout = 2 * time.Minute
+
+func (forwarder *Forwarder) logf(format string, args ...interface{}) {
+	if forwarder.Logf != nil {
+		forwarder.Logf(format, args...)
+	}
+}
+
+func (forwarder *Forwarder) dial(network, address string) (net.Conn, error) {
+	if forwarder.Dial != nil {
+		return forwarder.Dial(context.Background(), network, address)
+	}
+	var dialer net.Dialer
+	return dialer.Dial(network, address)
+}
+
+func (forwarder *Forwarder) track(closer io.Closer) bool {
+	forwarder.mutex.Lock()
+	defer forwarder.mutex.Unlock()
+	if forwarder.closed {
+		return false
+	}
+	forwarder.closers = append(forwarder.closers, closer)
+	return true
+}
+
+// Forward starts forwarding according to rule, until the forwarder is
+// closed.
+func (forwarder *Forwarder) Forward(rule ForwardRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	switch rule.Protocol {
+	case "tcp":
+		listener, err := forwarder.Network.Listen("tcp", rule.Listen)
+		if err != nil {
+			return err
+		}
+		if !forwarder.track(listener) {
+			listener.Close()
+			return ErrServerClosed
+		}
+		go forwarder.forwardTCP(listener, rule)
+	case "udp":
+		conn, err := forwarder.Network.ListenPacket("udp", rule.Listen)
+		if err != nil {
+			return err
+		}
+		if !forwarder.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go forwarder.forwardUDP(conn, rule)
+	}
+	return nil
+}
+
+// Close stops forwarding, leaving forwarded TCP connections to finish.
+func (forwarder *Forwarder) Close() error {
+	forwarder.mutex.Lock()
+	defer forwarder.mutex.Unlock()
+	forwarder.closed = true
+	var err error
+	for _, closer := range forwarder.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	forwarder.closers = nil
+	return err
+}
+
+func (forwarder *Forwarder) forwardTCP(listener net.Listener, rule ForwardRule) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go func() {
+			upstream, err := forwarder.dial("tcp", rule.Target)
+			if err != nil {
+				forwarder.logf("forward: %v: %v: %v", rule, client.RemoteAddr(), err)
+				client.Close()
+				return
+			}
+			splice(client, upstream)
+		}()
+	}
+}
+
+type udpFlow struct {
+	upstream net.Conn
+	lastSeen int64 // nano seconds since epoch, guarded by the flows lock
+}
+
+func (forwarder *Forwarder) forwardUDP(conn net.PacketConn, rule ForwardRule) {
+	timeout := forwarder.UDPTimeout
+	if timeout <= 0 {
+		timeout = DefaultUDPTimeout
+	}
+	var mutex sync.Mutex
+	flows := make(map[string]*udpFlow)
+	defer func() {
+		mutex.Lock()
+		for _, flow := range flows {
+			flow.upstream.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		size, client, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		mutex.Lock()
+		flow, ok := flows[client.String()]
+		if !ok {
+			upstream, err := forwarder.dial("udp", rule.Target)
+			if err != nil {
+				mutex.Unlock()
+				forwarder.logf("forward: %v: %v: %v", rule, client, err)
+				continue
+			}
+			flow = &udpFlow{upstream: upstream}
+			flows[client.String()] = flow
+			go forwarder.forwardUDPReplies(conn, client, flow, timeout, func(idle bool) bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if idle && time.Since(time.Unix(0, flow.lastSeen)) < timeout {
+					return false
+				}
+				delete(flows, client.String())
+				return true
+			})
+		}
+		flow.lastSeen = time.Now().UnixNano()
+		mutex.Unlock()
+
+		flow.upstream.Write(buffer[:size])
+	}
+}
+
+// forwardUDPReplies sends the replies to a flow back to its client
+// until it fails or is idle for timeout, as decided by expire.
+func (forwarder *Forwarder) forwardUDPReplies(conn net.PacketConn, client net.Addr, flow *udpFlow, timeout time.Duration, expire func(idle bool) bool) {
+	defer flow.upstream.Close()
+	buffer := make([]byte, 65535)
+	for {
+		flow.upstream.SetReadDeadline(time.Now().Add(timeout))
+		size, err := flow.upstream.Read(buffer)
+		if err == nil {
+			_, err = conn.WriteTo(buffer[:size], client)
+		}
+		if err == nil {
+			continue
+		}
+		netErr, ok := err.(net.Error)
+		if expire(ok && netErr.Timeout()) {
+			return
+		}
+	}
+}
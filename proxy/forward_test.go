@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostNetwork listens on the host, standing in for a tunnel, recording
+// the addresses it listens on.
+type hostNetwork struct {
+	addrs chan net.Addr
+}
+
+func (network hostNetwork) Listen(protocol, address string) (net.Listener, error) {
+	listener, err := net.Listen(protocol, address)
+	if err == nil {
+		network.addrs <- listener.Addr()
+	}
+	return listener, err
+}
+
+func (network hostNetwork) ListenPacket(protocol, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(protocol, address)
+	if err == nil {
+		network.addrs <- conn.LocalAddr()
+	}
+	return conn, err
+}
+
+func TestForwarder(t *testing.T) {
+	network := hostNetwork{make(chan net.Addr, 2)}
+	forwarder := &Forwarder{Network: network}
+	defer forwarder.Close()
+
+	// TCP
+
+	echo, closeEcho := echoServer(t)
+	defer closeEcho()
+	if err := forwarder.Forward(ForwardRule{Protocol: "tcp", Listen: "127.0.0.1:0", Target: echo}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", (<-network.addrs).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	echoed := make([]byte, 4)
+	if _, err := conn.Read(echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("TCP echoed %q, %v", echoed, err)
+	}
+
+	// UDP, replies going back to the flow they belong to
+
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			size, addr, err := udpEcho.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buffer[:size], addr)
+		}
+	}()
+	if err := forwarder.Forward(ForwardRule{Protocol: "udp", Listen: "127.0.0.1:0", Target: udpEcho.LocalAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := (<-network.addrs).String()
+	for _, message := range []string{"first", "second"} {
+		client, err := net.Dial("udp", forwarded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte(message))
+		reply := make([]byte, 64)
+		size, err := client.Read(reply)
+		if err != nil || string(reply[:size]) != message {
+			t.Errorf("UDP echoed %q, %v", reply[:size], err)
+		}
+	}
+
+	// closed forwarders forward nothing more
+
+	forwarder.Close()
+	if err := forwarder.Forward(ForwardRule{Protocol: "tcp", Listen: "127.0.0.1:0", Target: echo}); err != ErrServerClosed {
+		t.Errorf("Forward after Close returned %v", err)
+	}
+}
+
+func TestLoadForwardRules(t *testing.T) {
+	rules, err := LoadForwardRules(strings.NewReader(`[
+		{"protocol": "tcp", "listen": ":80", "target": "127.0.0.1:8080"},
+		{"protocol": "udp", "listen": "10.0.0.1:53", "target": "[::1]:5353"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0] != (ForwardRule{"tcp", ":80", "127.0.0.1:8080"}) || rules[1].Target != "[::1]:5353" {
+		t.Errorf("unexpected rules %v", rules)
+	}
+	for _, invalid := range []string{
+		`[{"protocol": "sctp", "listen": ":80", "target": "127.0.0.1:80"}]`,
+		`[{"protocol": "tcp", "listen": "80", "target": "127.0.0.1:80"}]`,
+		`[{"protocol": "tcp", "listen": ":80", "target": "127.0.0.1:80", "extra": 1}]`,
+	} {
+		if _, err := LoadForwardRules(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%s accepted", invalid)
+		}
+	}
+}
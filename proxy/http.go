@@ -0,0 +1,147 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/* An HTTP proxy, tunnelling CONNECT requests, which carry HTTPS and
+ * anything else, and forwarding requests for absolute http:// URLs.
+ */
+
+// hopHeaders are the headers of a single connection, not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// ServeHTTPProxy accepts HTTP proxy clients from listener until it
+// fails or the server is closed.
+func (server *Server) ServeHTTPProxy(listener net.Listener) error {
+	if !server.track(listener) {
+		return ErrServerClosed
+	}
+	httpServer := &http.Server{
+		Handler:  server,
+		ErrorLog: log.New(logWriter{server}, "", 0),
+	}
+	err := httpServer.Serve(listener)
+	if server.untrack(listener) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// ServeHTTP proxies an HTTP request, making the server an http.Handler
+// for use with other HTTP servers.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		server.connect(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	server.transportOnce.Do(func() {
+		server.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return server.dial(ctx, address)
+			},
+			MaxIdleConnsPerHost: 4,
+		}
+	})
+
+	outgoing := r.Clone(r.Context())
+	outgoing.RequestURI = ""
+	removeHopHeaders(outgoing.Header)
+	if r.ContentLength == 0 {
+		outgoing.Body = nil
+	}
+	response, err := server.transport.RoundTrip(outgoing)
+	if err != nil {
+		server.logf("http: %v: %s %s: %v", r.RemoteAddr, r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// connect tunnels the connection of a CONNECT request to its host.
+func (server *Server) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT unsupported", http.StatusInternalServerError)
+		return
+	}
+	upstream, err := server.dial(r.Context(), r.Host)
+	if err != nil {
+		server.logf("http: %v: CONNECT %s: %v", r.RemoteAddr, r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	if n := buffered.Reader.Buffered(); n > 0 {
+		data, _ := buffered.Reader.Peek(n)
+		if _, err := upstream.Write(data); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+	splice(client, upstream)
+}
+
+// logWriter passes the errors of the HTTP server on to Logf.
+type logWriter struct {
+	server *Server
+}
+
+func (writer logWriter) Write(p []byte) (int, error) {
+	writer.server.logf("http: %s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package proxy serves SOCKS5 (RFC 1928) and HTTP proxies whose
+// connections are opened by a dial function of the caller, such as
+// Dialer.DialContext of golang.zx2c4.com/wireguard/tun/netstack, which
+// carries them through an in-process tunnel. Applications pointed at
+// the proxy then use the tunnel without a TUN device or privileges.
+// The other way around, a Forwarder exposes services to the peers of
+// such a tunnel.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// DialFunc opens a connection to address on network, "tcp" for both
+// proxies.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// A Server proxies connections from clients through Dial.
+type Server struct {
+	Dial        DialFunc
+	DialTimeout time.Duration                            // zero for no timeout
+	Logf        func(format string, args ...interface{}) // nil to log nothing
+
+	mutex         sync.Mutex
+	listeners     map[net.Listener]struct{}
+	closed        bool
+	transportOnce sync.Once
+	transport     *http.Transport // forwarding plain HTTP requests
+}
+
+func (server *Server) logf(format string, args ...interface{}) {
+	if server.Logf != nil {
+		server.Logf(format, args...)
+	}
+}
+
+func (server *Server) dial(ctx context.Context, address string) (net.Conn, error) {
+	if server.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.DialTimeout)
+		defer cancel()
+	}
+	return server.Dial(ctx, "tcp", address)
+}
+
+// track adds listener to those closed along with the server, unless
+// the server is already closed.
+func (server *Server) track(listener net.Listener) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.closed {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[listener] = struct{}{}
+	return true
+}
+
+// untrack removes listener, reporting whether the server was closed.
+func (server *Server) untrack(listener net.Listener) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	delete(server.listeners, listener)
+	return server.closed
+}
+
+// serve accepts connections from listener, until it or the server is
+// closed, handling each on its own goroutine.
+func (server *Server) serve(listener net.Listener, handle func(net.Conn)) error {
+	if !server.track(listener) {
+		return ErrServerClosed
+	}
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if server.untrack(listener) {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go handle(client)
+	}
+}
+
+// Close stops the server from accepting connections, closing the
+// listeners it serves. Proxied connections are left to finish.
+func (server *Server) Close() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	var err error
+	for listener := range server.listeners {
+		if closeErr := listener.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// splice copies between client and upstream in both directions until
+// either side is done, then closes both.
+func splice(client, upstream net.Conn) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if conn, ok := dst.(closeWriter); ok {
+			conn.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(upstream, client)
+	go copyHalf(client, upstream)
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+}
@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newServer returns a server dialing on the loopback, recording the
+// addresses it dials, and a listener it serves with serve.
+func newServer(t *testing.T, serve func(*Server, net.Listener) error) (*Server, net.Listener, chan string) {
+	dialed := make(chan string, 10)
+	var dialer net.Dialer
+	server := &Server{
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(server, listener)
+	return server, listener, dialed
+}
+
+// echoServer returns the address of a TCP server echoing what it reads.
+func echoServer(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestSOCKS5(t *testing.T) {
+	echo, closeEcho := echoServer(t)
+	defer closeEcho()
+	server, listener, dialed := newServer(t, (*Server).ServeSOCKS5)
+	defer server.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// greeting, then a CONNECT request by host name, followed by data
+	// before the reply arrives
+
+	_, port, _ := net.SplitHostPort(echo)
+	portNumber, _ := net.LookupPort("tcp", port)
+	request := []byte{5, 1, 0, 5, 1, 0, 3, byte(len("localhost"))}
+	request = append(request, "localhost"...)
+	request = append(request, byte(portNumber>>8), byte(portNumber), 'p', 'i', 'n', 'g')
+	if _, err := client.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 2+10+4)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:2], []byte{5, 0}) || !bytes.Equal(reply[2:5], []byte{5, 0, 0}) {
+		t.Errorf("unexpected reply % x", reply[:12])
+	}
+	if string(reply[12:]) != "ping" {
+		t.Errorf("echoed %q, want ping", reply[12:])
+	}
+	if address := <-dialed; address != net.JoinHostPort("localhost", port) {
+		t.Errorf("dialed %s", address)
+	}
+}
+
+func TestSOCKS5Refused(t *testing.T) {
+	server, listener, _ := newServer(t, (*Server).ServeSOCKS5)
+	defer server.Close()
+
+	// a port nothing listens on, found by closing a listener
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksConnectionRefused {
+		t.Errorf("reply code %d, want %d", reply[3], socksConnectionRefused)
+	}
+
+	// unsupported commands are refused as such
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte{5, 1, 0, 5, 3, 0, 1, 127, 0, 0, 1, 0, 53})
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksCommandUnsupported {
+		t.Errorf("reply code %d, want %d", reply[3], socksCommandUnsupported)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("hop-by-hop header forwarded")
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+	server, listener, dialed := newServer(t, (*Server).ServeHTTPProxy)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("http://" + listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// plain requests are forwarded
+
+	request, _ := http.NewRequest("GET", origin.URL+"/world", nil)
+	request.Header.Set("Proxy-Connection", "keep-alive")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "hello /world" {
+		t.Errorf("body %q", body)
+	}
+	if address := <-dialed; address != strings.TrimPrefix(origin.URL, "http://") {
+		t.Errorf("dialed %s", address)
+	}
+
+	// CONNECT tunnels
+
+	echo, closeEcho := echoServer(t)
+	defer closeEcho()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err = http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %d", response.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("echoed %q, %v", echoed, err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	server := &Server{Dial: (&net.Dialer{}).DialContext}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- server.ServeSOCKS5(listener)
+	}()
+	for {
+		server.mutex.Lock()
+		serving := len(server.listeners) == 1
+		server.mutex.Unlock()
+		if serving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("ServeSOCKS5 returned %v", err)
+	}
+	if err := server.ServeHTTPProxy(listener); err != ErrServerClosed {
+		t.Errorf("ServeHTTPProxy after Close returned %v", err)
+	}
+}
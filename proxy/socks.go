@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/* A SOCKS5 server for the CONNECT command, without authentication,
+ * which is the subset of RFC 1928 browsers and curl speak. Clients name
+ * the destination by IP address or host name, the latter being resolved
+ * by the dial function, hence through the tunnel.
+ */
+
+const (
+	socksVersion = 5
+
+	socksMethodNone         = 0x00
+	socksMethodUnacceptable = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandUnsupported  = 0x07
+	socksAddrTypeUnsupported = 0x08
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// ServeSOCKS5 accepts SOCKS5 clients from listener until it fails or
+// the server is closed, proxying the connections they request.
+func (server *Server) ServeSOCKS5(listener net.Listener) error {
+	return server.serve(listener, server.handleSOCKS5)
+}
+
+func (server *Server) handleSOCKS5(client net.Conn) {
+	client.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(client)
+	address, err := socksNegotiate(reader, client)
+	if err != nil {
+		server.logf("socks5: %v: %v", client.RemoteAddr(), err)
+		client.Close()
+		return
+	}
+
+	upstream, err := server.dial(context.Background(), address)
+	if err != nil {
+		server.logf("socks5: %v: connect %s: %v", client.RemoteAddr(), address, err)
+		socksReply(client, socksReplyCode(err), nil)
+		client.Close()
+		return
+	}
+	if err := socksReply(client, socksSucceeded, upstream.LocalAddr()); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	// the client may not wait for the reply before sending data
+
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		if _, err := upstream.Write(data); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+	}
+	splice(client, upstream)
+}
+
+// socksNegotiate reads the greeting and request of a client, answering
+// the greeting, and returns the host:port address to connect to.
+func socksNegotiate(reader *bufio.Reader, client net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksMethodUnacceptable)
+	for _, m := range methods {
+		if m == socksMethodNone {
+			method = socksMethodNone
+		}
+	}
+	if _, err := client.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodUnacceptable {
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(reader, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(client, socksAddrTypeUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(reader, port[:]); err != nil {
+		return "", err
+	}
+	if request[1] != socksCommandConnect {
+		socksReply(client, socksCommandUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply answers a request with code and the address bound, which
+// is the unspecified IPv4 address if nil or not a TCP address.
+func socksReply(client net.Conn, code byte, bound net.Addr) error {
+	ip, port := net.IP(net.IPv4zero.To4()), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	reply := []byte{socksVersion, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, socksAddrIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socksAddrIPv6), ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+	_, err := client.Write(reply)
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
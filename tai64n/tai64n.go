@@ -8,6 +8,7 @@ package tai64n
 import (
 	"bytes"
 	"encoding/binary"
+	"sync"
 	"time"
 )
 
@@ -33,3 +34,59 @@ func Now() Timestamp {
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
+
+func (t Timestamp) time() time.Time {
+	secs := int64(binary.BigEndian.Uint64(t[:8]) - base)
+	nano := int64(binary.BigEndian.Uint32(t[8:]))
+	return time.Unix(secs, nano)
+}
+
+// Add returns t moved by d, at the whitened resolution of timestamps.
+func (t Timestamp) Add(d time.Duration) Timestamp {
+	return stamp(t.time().Add(d))
+}
+
+// A Clock hands out strictly increasing timestamps, even when the wall
+// clock moves backwards, e.g. on devices without a real time clock which
+// boot with a clock far in the past. Persisting Last and passing it to
+// Restore after a reboot keeps timestamps increasing across reboots.
+// The zero value is ready to use.
+type Clock struct {
+	mutex sync.Mutex
+	last  Timestamp
+}
+
+// Now returns the current time, or the smallest timestamp after the last
+// one handed out if the wall clock is behind it.
+func (c *Clock) Now() Timestamp {
+	return c.next(time.Now())
+}
+
+func (c *Clock) next(now time.Time) Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := stamp(now)
+	if !t.After(c.last) {
+		t = c.last.Add(time.Duration(whitenerMask) + 1)
+	}
+	c.last = t
+	return t
+}
+
+// Last returns the last timestamp handed out by c.
+func (c *Clock) Last() Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
+// Restore makes c hand out only timestamps after t. A value of Last which
+// may be stale, because it was saved a while before the clock stopped,
+// should be moved forward by the saving interval using Add.
+func (c *Clock) Restore(t Timestamp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.After(c.last) {
+		c.last = t
+	}
+}
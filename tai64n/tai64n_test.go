@@ -38,3 +38,37 @@ func TestMonotonic(t *testing.T) {
 		})
 	}
 }
+
+func TestClockSurvivesClockRegression(t *testing.T) {
+	var saved Clock
+	saved.next(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	last := saved.Last()
+
+	// a board without a real time clock reboots into 1970
+
+	var c Clock
+	c.Restore(last)
+	boot := time.Unix(0, 0)
+	prev := last
+	for i := 0; i < 100; i++ {
+		ts := c.next(boot.Add(time.Duration(i) * time.Millisecond))
+		if !ts.After(prev) {
+			t.Fatalf("timestamp %d did not increase: %x after %x", i, ts, prev)
+		}
+		prev = ts
+	}
+
+	// once the wall clock is set, it is used again
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	if ts := c.next(now); ts != stamp(now) {
+		t.Errorf("Now() = %x, want wall clock %x", ts, stamp(now))
+	}
+}
+
+func TestTimestampAdd(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	if got, want := stamp(start).Add(time.Minute), stamp(start.Add(time.Minute)); got != want {
+		t.Errorf("Add(time.Minute) = %x, want %x", got, want)
+	}
+}
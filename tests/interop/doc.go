@@ -0,0 +1,9 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package interop tests wireguard-go against other implementations of
+// WireGuard, end to end through network namespaces. The tests only run
+// on Linux and with the -interop flag.
+package interop
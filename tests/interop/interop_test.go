@@ -0,0 +1,311 @@
+// +build linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package interop
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Interoperability tests
+ *
+ * The tests connect two network namespaces by a veth pair. The first
+ * runs the implementation tested against, the kernel module or another
+ * wireguard-go, the second runs the wireguard-go under test; both are
+ * configured with the wg tool. They are skipped unless -interop is given
+ * and need root, ip(8), wg(8) and ping(8), e.g.
+ *
+ *   sudo go test ./tests/interop -interop -interop.peer=kernel
+ *
+ * The rekey test waits for the sessions to age and only runs with
+ * -interop.long as well.
+ */
+
+var (
+	enabled = flag.Bool("interop", false, "run the interoperability tests, which need root, ip and wg")
+	against = flag.String("interop.peer", "kernel", "implementation to test against: kernel or userspace")
+	program = flag.String("interop.program", "", "wireguard-go binary to test, built from the tree if empty")
+	long    = flag.Bool("interop.long", false, "also run the tests taking minutes")
+)
+
+const (
+	rekeyAfterTime = 120 * time.Second
+	ifname         = "wg0"
+)
+
+// namespace is a network namespace holding a WireGuard interface.
+type namespace struct {
+	name      string
+	address   string // of the veth end, the endpoint of the interface
+	tunnel    string // of the WireGuard interface
+	port      int
+	private   string
+	public    string
+	userspace *exec.Cmd // nil for the kernel module
+}
+
+// run runs the command in the namespace, failing the test on an error.
+func (ns *namespace) run(t *testing.T, stdin string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("ip", append([]string{"netns", "exec", ns.name}, args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s: %v\n%s", ns.name, strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// ping reports whether the tunnel address of peer answers from ns.
+func (ns *namespace) ping(peer *namespace) bool {
+	return exec.Command("ip", "netns", "exec", ns.name, "ping", "-c", "1", "-W", "1", peer.tunnel).Run() == nil
+}
+
+// show returns the value wg show reports for peer in field, such as
+// endpoints or latest-handshakes.
+func (ns *namespace) show(t *testing.T, peer *namespace, field string) string {
+	t.Helper()
+	for _, line := range strings.Split(ns.run(t, "", "wg", "show", ifname, field), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == peer.public {
+			return fields[1]
+		}
+	}
+	t.Fatalf("%s: no %s for peer %s", ns.name, field, peer.name)
+	return ""
+}
+
+func (ns *namespace) latestHandshake(t *testing.T, peer *namespace) time.Time {
+	t.Helper()
+	secs, err := strconv.ParseInt(ns.show(t, peer, "latest-handshakes"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// setPeer configures peer on the interface of ns.
+func (ns *namespace) setPeer(t *testing.T, peer *namespace) {
+	t.Helper()
+	ns.run(t, "", "wg", "set", ifname,
+		"listen-port", strconv.Itoa(ns.port),
+		"peer", peer.public,
+		"endpoint", fmt.Sprintf("%s:%d", peer.address, peer.port),
+		"allowed-ips", peer.tunnel+"/32")
+}
+
+// topology is a pair of namespaces connected by a veth pair, with
+// WireGuard interfaces peered with each other.
+type topology struct {
+	other  *namespace // runs the implementation tested against
+	tested *namespace // runs the wireguard-go under test
+	dir    string     // temporary files
+}
+
+func setup(t *testing.T) *topology {
+	if !*enabled {
+		t.Skip("interoperability tests disabled, see -interop")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("interoperability tests need root")
+	}
+	for _, tool := range []string{"ip", "wg", "ping"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(err)
+		}
+	}
+	if *against != "kernel" && *against != "userspace" {
+		t.Fatalf("-interop.peer=%s: want kernel or userspace", *against)
+	}
+
+	prefix := fmt.Sprintf("wg-interop-%d-", os.Getpid())
+	top := &topology{
+		other:  &namespace{name: prefix + "1", address: "10.200.0.1", tunnel: "192.168.241.1", port: 10000},
+		tested: &namespace{name: prefix + "2", address: "10.200.0.2", tunnel: "192.168.241.2", port: 20000},
+	}
+	var err error
+	top.dir, err = ioutil.TempDir("", "wg-interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := false
+	defer func() {
+		if !ready {
+			top.teardown()
+		}
+	}()
+	binary := top.wireguardGo(t)
+
+	for _, ns := range []*namespace{top.other, top.tested} {
+		if out, err := exec.Command("ip", "netns", "add", ns.name).CombinedOutput(); err != nil {
+			t.Fatalf("ip netns add: %v\n%s", err, out)
+		}
+		ns.run(t, "", "ip", "link", "set", "lo", "up")
+		ns.private = ns.run(t, "", "wg", "genkey")
+		ns.public = ns.run(t, ns.private+"\n", "wg", "pubkey")
+	}
+	top.other.run(t, "", "ip", "link", "add", "veth0", "type", "veth", "peer", "name", "veth1", "netns", top.tested.name)
+	for i, ns := range []*namespace{top.other, top.tested} {
+		veth := fmt.Sprintf("veth%d", i)
+		ns.run(t, "", "ip", "addr", "add", ns.address+"/24", "dev", veth)
+		ns.run(t, "", "ip", "link", "set", veth, "up")
+	}
+
+	if *against == "kernel" {
+		top.other.run(t, "", "ip", "link", "add", ifname, "type", "wireguard")
+	} else {
+		top.other.start(t, binary)
+	}
+	top.tested.start(t, binary)
+	top.other.configure(t, top.tested, top.dir)
+	top.tested.configure(t, top.other, top.dir)
+	ready = true
+	return top
+}
+
+// start runs binary in the foreground in ns, waiting for its interface.
+func (ns *namespace) start(t *testing.T, binary string) {
+	t.Helper()
+	ns.userspace = exec.Command("ip", "netns", "exec", ns.name, binary, "-f", ifname)
+	ns.userspace.Env = append(os.Environ(), "LOG_LEVEL=error")
+	ns.userspace.Stdout = os.Stderr
+	ns.userspace.Stderr = os.Stderr
+	if err := ns.userspace.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if exec.Command("ip", "-n", ns.name, "link", "show", ifname).Run() == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s did not create %s", ns.name, binary, ifname)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// configure sets the key and peer of the interface of ns and brings it up.
+func (ns *namespace) configure(t *testing.T, peer *namespace, dir string) {
+	t.Helper()
+	key := filepath.Join(dir, ns.name+".key")
+	if err := ioutil.WriteFile(key, []byte(ns.private+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ns.run(t, "", "wg", "set", ifname, "private-key", key)
+	ns.setPeer(t, peer)
+	ns.run(t, "", "ip", "addr", "add", ns.tunnel+"/24", "dev", ifname)
+	ns.run(t, "", "ip", "link", "set", ifname, "up")
+}
+
+func (top *topology) teardown() {
+	for _, ns := range []*namespace{top.other, top.tested} {
+		if ns.userspace != nil && ns.userspace.Process != nil {
+			ns.userspace.Process.Kill()
+			ns.userspace.Wait()
+		}
+		exec.Command("ip", "netns", "del", ns.name).Run()
+	}
+	os.RemoveAll(top.dir)
+}
+
+// wireguardGo returns the binary to test, building it from the tree
+// unless given by -interop.program.
+func (top *topology) wireguardGo(t *testing.T) string {
+	if *program != "" {
+		return *program
+	}
+	binary := filepath.Join(top.dir, "wireguard-go")
+	out, err := exec.Command("go", "build", "-o", binary, "golang.zx2c4.com/wireguard/cmd/wireguard-go").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building wireguard-go: %v\n%s", err, out)
+	}
+	return binary
+}
+
+// waitPing pings peer from ns until it answers.
+func waitPing(t *testing.T, ns, peer *namespace) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !ns.ping(peer); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: no answer from %s", ns.name, peer.tunnel)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	top := setup(t)
+	defer top.teardown()
+	waitPing(t, top.tested, top.other)
+	waitPing(t, top.other, top.tested)
+	if top.tested.latestHandshake(t, top.other).IsZero() || top.other.latestHandshake(t, top.tested).IsZero() {
+		t.Error("traffic flows without a handshake reported")
+	}
+}
+
+func TestRoaming(t *testing.T) {
+	top := setup(t)
+	defer top.teardown()
+	waitPing(t, top.tested, top.other)
+
+	// Each side moves to another port and sends first, the other side
+	// has to follow it to the new endpoint.
+	for _, step := range []struct{ roaming, following *namespace }{
+		{top.other, top.tested},
+		{top.tested, top.other},
+	} {
+		step.roaming.port++
+		step.roaming.run(t, "", "wg", "set", ifname, "listen-port", strconv.Itoa(step.roaming.port))
+		waitPing(t, step.roaming, step.following)
+		want := fmt.Sprintf("%s:%d", step.roaming.address, step.roaming.port)
+		if got := step.following.show(t, step.roaming, "endpoints"); got != want {
+			t.Errorf("%s: endpoint of the roaming peer = %s, want %s", step.following.name, got, want)
+		}
+		waitPing(t, step.following, step.roaming)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	if !*long {
+		t.Skip("rekey test takes minutes, see -interop.long")
+	}
+	top := setup(t)
+	defer top.teardown()
+	waitPing(t, top.tested, top.other)
+	first := top.tested.latestHandshake(t, top.other)
+
+	// Traffic in both directions keeps the session in use, so that it
+	// is renewed once it is older than RekeyAfterTime.
+	deadline := time.Now().Add(rekeyAfterTime + 30*time.Second)
+	for time.Now().Before(deadline) {
+		waitPing(t, top.tested, top.other)
+		waitPing(t, top.other, top.tested)
+		if top.tested.latestHandshake(t, top.other).After(first) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	renewed := top.tested.latestHandshake(t, top.other)
+	if !renewed.After(first) {
+		t.Fatalf("session of %v not renewed after %v", first, rekeyAfterTime)
+	}
+	if got := top.other.latestHandshake(t, top.tested); !got.After(first) {
+		t.Errorf("%s: latest handshake %v, want after %v", top.other.name, got, first)
+	}
+	waitPing(t, top.other, top.tested)
+}
@@ -0,0 +1,26 @@
+// +build linux darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CreateFromFD creates a TUN device from the file descriptor of an
+// already open TUN interface, such as one handed over by Android's
+// VpnService or by a privileged parent process, so that the caller
+// needs no privileges to create one. The device takes ownership of fd.
+func CreateFromFD(fd int, mtu int) (Device, error) {
+	err := unix.SetNonblock(fd, true)
+	if err != nil {
+		return nil, err
+	}
+	return CreateTUNFromFile(os.NewFile(uintptr(fd), ""), mtu)
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Command wireguard-proxy brings up a tunnel in-process, from a
+// wg-quick(8) style configuration file, and serves local SOCKS5 and
+// HTTP proxies whose connections are carried through it. Applications
+// pointed at the proxies use the tunnel without root or a TUN device.
+// Ports of the tunnel may be forwarded to services in turn, exposing
+// them to the peers.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/config"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/proxy"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	ExitSetupSuccess = 0
+	ExitSetupFailed  = 1
+)
+
+func main() {
+	configPath := flag.String("config", "", "wg-quick style configuration `file` of the tunnel")
+	socksAddress := flag.String("socks", "127.0.0.1:1080", "local `address` of the SOCKS5 proxy, empty for none")
+	httpAddress := flag.String("http", "", "local `address` of the HTTP proxy, empty for none")
+	forwardPath := flag.String("forward", "", "JSON `file` of ports of the tunnel to forward to services")
+	flag.Parse()
+	if *configPath == "" || flag.NArg() != 0 || (*socksAddress == "" && *httpAddress == "" && *forwardPath == "") {
+		flag.Usage()
+		os.Exit(ExitSetupFailed)
+	}
+
+	logLevel := device.LogLevelInfo
+	switch os.Getenv("LOG_LEVEL") {
+	case "debug":
+		logLevel = device.LogLevelDebug
+	case "error":
+		logLevel = device.LogLevelError
+	case "silent":
+		logLevel = device.LogLevelSilent
+	}
+	logger := device.NewLogger(logLevel, "(proxy) ")
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", *configPath, err)
+		os.Exit(ExitSetupFailed)
+	}
+	if len(cfg.Address) == 0 {
+		fmt.Fprintf(os.Stderr, "Configuration %s has no Address\n", *configPath)
+		os.Exit(ExitSetupFailed)
+	}
+	var rules []proxy.ForwardRule
+	if *forwardPath != "" {
+		file, err := os.Open(*forwardPath)
+		if err == nil {
+			rules, err = proxy.LoadForwardRules(file)
+			file.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load forward rules %s: %v\n", *forwardPath, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	// bring up the tunnel on a userspace network stack
+
+	addresses := make([]net.IP, len(cfg.Address))
+	for i, network := range cfg.Address {
+		addresses[i] = network.IP
+	}
+	mtu := device.DefaultMTU
+	if cfg.MTU != 0 {
+		mtu = cfg.MTU
+	}
+	tun, tnet, err := netstack.CreateNetTUN(addresses, mtu)
+	if err != nil {
+		logger.Error.Println("Failed to create netstack TUN:", err)
+		os.Exit(ExitSetupFailed)
+	}
+	tnet.SetDNSServers(cfg.DNS)
+
+	dev := device.NewDevice(tun, logger)
+	if err := dev.IpcSetConfig(&cfg.Device); err != nil {
+		logger.Error.Println("Failed to apply configuration:", err)
+		os.Exit(ExitSetupFailed)
+	}
+	dev.Up()
+	logger.Info.Println("Device started")
+
+	// serve the proxies
+
+	server := &proxy.Server{
+		Dial: (&netstack.Dialer{Net: tnet}).DialContext,
+		Logf: logger.Debug.Printf,
+	}
+	errs := make(chan error, 2)
+	serve := func(address string, serve func(net.Listener) error, name string) {
+		if address == "" {
+			return
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			logger.Error.Printf("Failed to listen for %s on %s: %v", name, address, err)
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Info.Printf("Serving %s on %s", name, listener.Addr())
+		go func() {
+			errs <- serve(listener)
+		}()
+	}
+	serve(*socksAddress, server.ServeSOCKS5, "SOCKS5")
+	serve(*httpAddress, server.ServeHTTPProxy, "HTTP proxy")
+
+	forwarder := &proxy.Forwarder{
+		Network: tnet,
+		Logf:    logger.Debug.Printf,
+	}
+	for _, rule := range rules {
+		if err := forwarder.Forward(rule); err != nil {
+			logger.Error.Printf("Failed to forward %v: %v", rule, err)
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Info.Println("Forwarding", rule)
+	}
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case <-term:
+	case err := <-errs:
+		logger.Error.Println("Proxy failed:", err)
+	case <-dev.Wait():
+	}
+
+	server.Close()
+	forwarder.Close()
+	dev.Close()
+	logger.Info.Println("Shutting down")
+}
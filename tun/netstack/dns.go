@@ -0,0 +1,268 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/* Name resolution through the tunnel
+ *
+ * Once DNS servers on the inner network are set, host names are looked
+ * up by forwarding queries to them through the tunnel, over UDP and
+ * over TCP for truncated answers, never consulting the resolver, hosts
+ * file or configuration of the system. Queries are asked of the servers
+ * in turn, for IPv4 addresses if the host has one and likewise for
+ * IPv6, until one of them answers.
+ */
+
+const (
+	dnsTimeout    = 5 * time.Second // for each query to a server
+	dnsUDPMessage = 1232            // largest answer over UDP advertised, as recommended by DNS flag day 2020
+)
+
+var errNoDNSServers = errors.New("no DNS servers")
+
+// SetDNSServers sets the DNS servers host names are looked up with,
+// which must be reachable through the tunnel.
+func (n *Net) SetDNSServers(servers []net.IP) {
+	n.dnsMutex.Lock()
+	defer n.dnsMutex.Unlock()
+	n.dnsServers = append([]net.IP(nil), servers...)
+}
+
+// DNSServers returns the servers set by SetDNSServers.
+func (n *Net) DNSServers() []net.IP {
+	n.dnsMutex.RLock()
+	defer n.dnsMutex.RUnlock()
+	return append([]net.IP(nil), n.dnsServers...)
+}
+
+func (n *Net) LookupHost(host string) ([]string, error) {
+	return n.LookupContextHost(context.Background(), host)
+}
+
+// LookupContextHost returns the addresses of host, as looked up with the
+// DNS servers of the tunnel.
+func (n *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	ips, err := n.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+func (n *Net) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	servers := n.DNSServers()
+	if len(servers) == 0 {
+		return nil, &net.DNSError{Err: errNoDNSServers.Error(), Name: host}
+	}
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	var types []dnsmessage.Type
+	if n.hasV4 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if n.hasV6 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+
+	var ips []net.IP
+	var lastErr error
+	notFound := false
+	for _, qtype := range types {
+		for _, server := range servers {
+			answer, err := n.exchange(ctx, server, name, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			found, err := parseAnswer(answer)
+			if err == errNotFound {
+				notFound = true
+				break
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ips = append(ips, found...)
+			break
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if notFound || lastErr == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	dnsErr := &net.DNSError{Err: lastErr.Error(), Name: host}
+	if netErr, ok := lastErr.(net.Error); ok && netErr.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+	return nil, dnsErr
+}
+
+var errNotFound = errors.New("no such host")
+
+// exchange asks server for the records of qtype for name, over UDP and
+// then over TCP if the answer was truncated.
+func (n *Net) exchange(ctx context.Context, server net.IP, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+	})
+	builder.EnableCompression()
+	var opt dnsmessage.ResourceHeader
+	err := builder.StartQuestions()
+	if err == nil {
+		err = builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+	}
+	if err == nil {
+		err = opt.SetEDNS0(dnsUDPMessage, dnsmessage.RCodeSuccess, false)
+	}
+	if err == nil {
+		err = builder.StartAdditionals()
+	}
+	if err == nil {
+		err = builder.OPTResource(opt, dnsmessage.OPTResource{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	// over UDP, retrying over TCP if truncated
+
+	conn, err := n.DialUDP(nil, &net.UDPAddr{IP: server, Port: 53})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, dnsUDPMessage)
+	for {
+		size, err := conn.Read(answer)
+		if err != nil {
+			return nil, err
+		}
+		var header dnsmessage.Header
+		var parser dnsmessage.Parser
+		if header, err = parser.Start(answer[:size]); err != nil || header.ID != binary.BigEndian.Uint16(id[:]) || !header.Response {
+			continue // not the answer to the query, keep waiting
+		}
+		if !header.Truncated {
+			return answer[:size], nil
+		}
+		break
+	}
+
+	tcp, err := n.DialContextTCP(ctx, &net.TCPAddr{IP: server, Port: 53})
+	if err != nil {
+		return nil, err
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(deadline)
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := tcp.Write(message); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(tcp, message[:2]); err != nil {
+		return nil, err
+	}
+	answer = make([]byte, binary.BigEndian.Uint16(message[:2]))
+	if _, err := io.ReadFull(tcp, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// parseAnswer returns the addresses in the answer section of answer,
+// following any CNAME records the server resolved along the way.
+func parseAnswer(answer []byte) ([]net.IP, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil {
+		return nil, err
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errNotFound
+	default:
+		return nil, errors.New("server failure: " + header.RCode.String())
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for {
+		resource, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch resource.Type {
+		case dnsmessage.TypeA:
+			a, err := parser.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
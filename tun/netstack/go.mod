@@ -0,0 +1,11 @@
+module golang.zx2c4.com/wireguard/tun/netstack
+
+go 1.16
+
+require (
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
+	golang.zx2c4.com/wireguard v0.0.0-00010101000000-000000000000
+	gvisor.dev/gvisor v0.0.0-20211020211948-f76a604701b6
+)
+
+replace golang.zx2c4.com/wireguard => ../..
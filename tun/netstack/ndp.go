@@ -0,0 +1,304 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+/* IPv6 router on the inner network
+ *
+ * With EnableIPv6Router, the stack acts as the IPv6 router of the
+ * clients behind the peers: it answers their router solicitations
+ * with advertisements of a /64 prefix they configure addresses from,
+ * SLAAC-style, along with the MTU of the tunnel and, optionally, its
+ * DNS servers, and answers neighbor solicitations for its own
+ * addresses. Solicitations of other addresses go unanswered, so that
+ * the duplicate address detection of clients succeeds.
+ *
+ * The tunnel carries neither multicast nor link-local traffic unless
+ * told to: the allowed IPs of the peers of the clients must hold their
+ * link-local addresses, and those of the clients must route ff02::/16
+ * and fe80::/10 to the device.
+ */
+
+const (
+	DefaultRouterLifetime    = 30 * time.Minute
+	DefaultValidLifetime     = 24 * time.Hour
+	DefaultPreferredLifetime = 4 * time.Hour
+)
+
+// RouterConfig is the configuration of the IPv6 router, see
+// Net.EnableIPv6Router.
+type RouterConfig struct {
+	Prefix            net.IPNet     // advertised to clients, a /64
+	LinkLocal         net.IP        // address advertisements are sent from, fe80::1 if nil
+	Lifetime          time.Duration // router lifetime, DefaultRouterLifetime if zero
+	ValidLifetime     time.Duration // of the addresses of clients, DefaultValidLifetime if zero
+	PreferredLifetime time.Duration // of the addresses of clients, DefaultPreferredLifetime if zero
+	AdvertiseDNS      bool          // advertise the IPv6 DNS servers, see Net.SetDNSServers
+}
+
+const (
+	ipv6HeaderLen        = 40
+	ipv6offsetPayload    = 4
+	icmpv6ProtocolNumber = 58
+	ndpHopLimit          = 255
+
+	icmpv6RouterSolicitation    = 133
+	icmpv6RouterAdvertisement   = 134
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+
+	ndpOptionPrefixInformation = 3
+	ndpOptionMTU               = 5
+	ndpOptionRDNSS             = 25
+)
+
+var (
+	ipv6AllNodes     = net.ParseIP("ff02::1")
+	defaultLinkLocal = net.ParseIP("fe80::1")
+	errNoIPv6Address = errors.New("no local IPv6 address")
+	errInvalidRouter = errors.New("invalid IPv6 router configuration")
+)
+
+// EnableIPv6Router makes the stack the IPv6 router of the clients of
+// the tunnel, replacing the configuration of a router already enabled.
+// The stack must have a local IPv6 address.
+func (n *Net) EnableIPv6Router(config RouterConfig) error {
+	if !n.hasV6 {
+		return errNoIPv6Address
+	}
+	if ones, bits := config.Prefix.Mask.Size(); ones != 64 || bits != 128 || config.Prefix.IP.To4() != nil {
+		return fmt.Errorf("%w: prefix %v is not an IPv6 /64", errInvalidRouter, &config.Prefix)
+	}
+	config.Prefix.IP = config.Prefix.IP.Mask(config.Prefix.Mask)
+	if config.LinkLocal == nil {
+		config.LinkLocal = defaultLinkLocal
+	}
+	if config.LinkLocal.To4() != nil || !config.LinkLocal.IsLinkLocalUnicast() {
+		return fmt.Errorf("%w: %v is not an IPv6 link-local address", errInvalidRouter, config.LinkLocal)
+	}
+	config.LinkLocal = config.LinkLocal.To16()
+	if config.Lifetime == 0 {
+		config.Lifetime = DefaultRouterLifetime
+	}
+	if config.ValidLifetime == 0 {
+		config.ValidLifetime = DefaultValidLifetime
+	}
+	if config.PreferredLifetime == 0 {
+		config.PreferredLifetime = DefaultPreferredLifetime
+	}
+
+	protocolAddress := tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(config.LinkLocal).WithPrefix(),
+	}
+	if err := n.stack.AddProtocolAddress(nicID, protocolAddress, stack.AddressProperties{}); err != nil {
+		if _, ok := err.(*tcpip.ErrDuplicateAddress); !ok {
+			return fmt.Errorf("AddProtocolAddress(%v): %v", config.LinkLocal, err)
+		}
+	}
+
+	n.routerMutex.Lock()
+	n.router = &config
+	n.routerMutex.Unlock()
+
+	// announce the router rather than waiting for clients to solicit
+
+	go (*netTun)(n).send(n.routerAdvertisement(&config, ipv6AllNodes))
+	return nil
+}
+
+// DisableIPv6Router stops the stack from acting as the IPv6 router,
+// advertising to the clients that it is no longer one.
+func (n *Net) DisableIPv6Router() {
+	n.routerMutex.Lock()
+	config := n.router
+	n.router = nil
+	n.routerMutex.Unlock()
+	if config == nil {
+		return
+	}
+	final := *config
+	final.Lifetime = 0
+	final.ValidLifetime = 0
+	final.PreferredLifetime = 0
+	(*netTun)(n).send(n.routerAdvertisement(&final, ipv6AllNodes))
+}
+
+// answerNDP answers packet, written to the TUN device, if it is a
+// router or neighbor solicitation the router handles, and reports
+// whether packet was consumed.
+func (tun *netTun) answerNDP(packet []byte) bool {
+	tun.routerMutex.RLock()
+	config := tun.router
+	tun.routerMutex.RUnlock()
+	if config == nil || len(packet) < ipv6HeaderLen+4 {
+		return false
+	}
+	if packet[6] != icmpv6ProtocolNumber || packet[7] != ndpHopLimit {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(packet[ipv6offsetPayload:]))
+	if ipv6HeaderLen+length > len(packet) || length < 4 {
+		return false
+	}
+	src := net.IP(packet[8:24])
+	dst := net.IP(packet[24:40])
+	message := packet[ipv6HeaderLen : ipv6HeaderLen+length]
+	if icmpv6Checksum(src, dst, message) != 0 {
+		return false
+	}
+
+	unspecified := src.Equal(net.IPv6unspecified)
+	switch message[0] {
+	case icmpv6RouterSolicitation:
+		to := src
+		if unspecified {
+			to = ipv6AllNodes
+		}
+		tun.send((*Net)(tun).routerAdvertisement(config, to))
+		return true
+
+	case icmpv6NeighborSolicitation:
+		if len(message) < 24 {
+			return false
+		}
+		target := net.IP(message[8:24])
+		if !target.Equal(config.LinkLocal) && tun.stack.CheckLocalAddress(nicID, ipv6.ProtocolNumber, tcpip.Address(target)) == 0 {
+			return true
+		}
+
+		// a solicitation from the unspecified address is a client
+		// detecting duplicates, tell all nodes the address is taken
+
+		const flagRouter, flagSolicited, flagOverride = 0x80, 0x40, 0x20
+		flags := byte(flagRouter | flagOverride)
+		to := src
+		if unspecified {
+			to = ipv6AllNodes
+		} else {
+			flags |= flagSolicited
+		}
+		advertisement := make([]byte, 24)
+		advertisement[0] = icmpv6NeighborAdvertisement
+		advertisement[4] = flags
+		copy(advertisement[8:], target)
+		tun.send(icmpv6Packet(target, to, advertisement))
+		return true
+	}
+	return false
+}
+
+// routerAdvertisement returns a router advertisement of config to dst.
+func (n *Net) routerAdvertisement(config *RouterConfig, dst net.IP) []byte {
+	seconds := func(d time.Duration) uint32 {
+		return uint32(d / time.Second)
+	}
+
+	message := make([]byte, 16, 16+8+32+8)
+	message[0] = icmpv6RouterAdvertisement
+	message[4] = 64 // hop limit of the clients
+	lifetime := seconds(config.Lifetime)
+	if lifetime > 0xffff {
+		lifetime = 0xffff
+	}
+	binary.BigEndian.PutUint16(message[6:], uint16(lifetime))
+
+	mtu := make([]byte, 8)
+	mtu[0], mtu[1] = ndpOptionMTU, 1
+	binary.BigEndian.PutUint32(mtu[4:], uint32(n.mtu))
+	message = append(message, mtu...)
+
+	const flagOnLink, flagAutonomous = 0x80, 0x40
+	prefix := make([]byte, 32)
+	prefix[0], prefix[1] = ndpOptionPrefixInformation, 4
+	prefix[2] = 64
+	prefix[3] = flagOnLink | flagAutonomous
+	binary.BigEndian.PutUint32(prefix[4:], seconds(config.ValidLifetime))
+	binary.BigEndian.PutUint32(prefix[8:], seconds(config.PreferredLifetime))
+	copy(prefix[16:], config.Prefix.IP.To16())
+	message = append(message, prefix...)
+
+	if config.AdvertiseDNS {
+		var servers []net.IP
+		for _, server := range n.DNSServers() {
+			if server.To4() == nil && server.To16() != nil {
+				servers = append(servers, server.To16())
+			}
+		}
+		if len(servers) > 0 {
+			rdnss := make([]byte, 8, 8+16*len(servers))
+			rdnss[0], rdnss[1] = ndpOptionRDNSS, byte(1+2*len(servers))
+			binary.BigEndian.PutUint32(rdnss[4:], lifetime)
+			for _, server := range servers {
+				rdnss = append(rdnss, server...)
+			}
+			message = append(message, rdnss...)
+		}
+	}
+
+	return icmpv6Packet(config.LinkLocal, dst, message)
+}
+
+// icmpv6Packet returns an IPv6 packet from src to dst carrying the
+// NDP message, setting its checksum.
+func icmpv6Packet(src, dst net.IP, message []byte) []byte {
+	packet := make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(message))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[ipv6offsetPayload:], uint16(len(message)))
+	packet[6] = icmpv6ProtocolNumber
+	packet[7] = ndpHopLimit
+	copy(packet[8:], src.To16())
+	copy(packet[24:], dst.To16())
+	packet = append(packet, message...)
+	message = packet[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(message[2:], 0)
+	binary.BigEndian.PutUint16(message[2:], icmpv6Checksum(src.To16(), dst.To16(), message))
+	return packet
+}
+
+// icmpv6Checksum returns the checksum of message from src to dst, zero
+// if the checksum it carries is valid.
+func icmpv6Checksum(src, dst net.IP, message []byte) uint16 {
+	pseudo := make([]byte, 40)
+	copy(pseudo, src)
+	copy(pseudo[16:], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(message)))
+	pseudo[39] = icmpv6ProtocolNumber
+
+	var acc uint32
+	for _, b := range [][]byte{pseudo, message} {
+		for i := 0; i+1 < len(b); i += 2 {
+			acc += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			acc += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return ^uint16(acc)
+}
+
+// send hands packet to the device, as if the stack had sent it.
+func (tun *netTun) send(packet []byte) {
+	select {
+	case tun.incoming <- buffer.NewViewFromBytes(packet).ToVectorisedView():
+	case <-tun.closed:
+	}
+}
@@ -0,0 +1,291 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+/* Sockets on the inner network of the tunnel
+ *
+ * The methods of Net mirror those of the net package, taking addresses
+ * of the inner network, so that applications carry their connections
+ * through the tunnel by swapping the functions they dial and listen
+ * with. Dialer and the TCP listener fit the interfaces of net/http and
+ * similar packages.
+ */
+
+var errNoSuitableAddress = errors.New("no local address of the same family")
+
+func fullAddr(ip net.IP, port int) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	var protocol tcpip.NetworkProtocolNumber
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, protocol = ip4, ipv4.ProtocolNumber
+	} else {
+		protocol = ipv6.ProtocolNumber
+	}
+	addr := tcpip.FullAddress{NIC: nicID, Port: uint16(port)}
+	if !ip.IsUnspecified() {
+		addr.Addr = tcpip.Address(ip)
+	}
+	return addr, protocol
+}
+
+func (n *Net) hasFamily(ip net.IP) bool {
+	if ip.To4() != nil {
+		return n.hasV4
+	}
+	return n.hasV6
+}
+
+// parseAddr parses the host:port address of network, where the host is
+// an IP address, or absent for the unspecified address of a family the
+// host has an address of.
+func (n *Net) parseAddr(network, address string) (net.IP, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", portString)
+	}
+	var ip net.IP
+	switch {
+	case host != "":
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid address %q", host)
+		}
+	case network == "tcp6" || network == "udp6" || !n.hasV4:
+		ip = net.IPv6zero
+	default:
+		ip = net.IPv4zero
+	}
+	switch network {
+	case "tcp4", "udp4":
+		if ip.To4() == nil {
+			return nil, 0, fmt.Errorf("address %q not IPv4", host)
+		}
+	case "tcp6", "udp6":
+		if ip.To4() != nil {
+			return nil, 0, fmt.Errorf("address %q not IPv6", host)
+		}
+	case "tcp", "udp":
+	default:
+		return nil, 0, net.UnknownNetworkError(network)
+	}
+	return ip, int(port), nil
+}
+
+func (n *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
+	if !n.hasFamily(addr.IP) {
+		return nil, errNoSuitableAddress
+	}
+	fa, protocol := fullAddr(addr.IP, addr.Port)
+	return gonet.DialContextTCP(ctx, n.stack, fa, protocol)
+}
+
+func (n *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
+	return n.DialContextTCP(context.Background(), addr)
+}
+
+// ListenTCP listens on addr, which is nil or has a nil IP for any
+// address of the host.
+func (n *Net) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
+	ip, port := net.IP(nil), 0
+	if addr != nil {
+		ip, port = addr.IP, addr.Port
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+		if !n.hasV4 {
+			ip = net.IPv6zero
+		}
+	}
+	fa, protocol := fullAddr(ip, port)
+	return gonet.ListenTCP(n.stack, fa, protocol)
+}
+
+// DialUDP returns a socket bound to laddr, or an ephemeral port if nil,
+// and connected to raddr, or unconnected if nil.
+func (n *Net) DialUDP(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	var lfa, rfa *tcpip.FullAddress
+	protocol := ipv4.ProtocolNumber
+	if !n.hasV4 {
+		protocol = ipv6.ProtocolNumber
+	}
+	if laddr != nil {
+		var addr tcpip.FullAddress
+		addr, protocol = fullAddr(laddr.IP, laddr.Port)
+		lfa = &addr
+	}
+	if raddr != nil {
+		if !n.hasFamily(raddr.IP) {
+			return nil, errNoSuitableAddress
+		}
+		var addr tcpip.FullAddress
+		addr, protocol = fullAddr(raddr.IP, raddr.Port)
+		rfa = &addr
+	}
+	return gonet.DialUDP(n.stack, lfa, rfa, protocol)
+}
+
+func (n *Net) ListenUDP(laddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	return n.DialUDP(laddr, nil)
+}
+
+// DialContext connects to address on network, "tcp", "tcp4", "tcp6",
+// "udp", "udp4" or "udp6", like net.Dialer.DialContext. Host names are
+// looked up with the DNS servers of the tunnel, trying each address.
+func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addresses, err := n.resolve(ctx, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var firstErr error
+	for _, address := range addresses {
+		conn, err := n.dialAddr(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// resolve returns the host:port addresses of address, looking its host
+// up unless an IP address.
+func (n *Net) resolve(ctx context.Context, address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+	hosts, err := n.LookupContextHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, len(hosts))
+	for i, host := range hosts {
+		addresses[i] = net.JoinHostPort(host, port)
+	}
+	return addresses, nil
+}
+
+func (n *Net) dialAddr(ctx context.Context, network, address string) (net.Conn, error) {
+	ip, port, err := n.parseAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := n.DialContextTCP(ctx, &net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	default:
+		conn, err := n.DialUDP(nil, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func (n *Net) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// Listen listens on address for network, "tcp", "tcp4" or "tcp6".
+func (n *Net) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	ip, port, err := n.parseAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	listener, err := n.ListenTCP(&net.TCPAddr{IP: ip, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ListenPacket listens on address for network, "udp", "udp4" or "udp6".
+func (n *Net) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	ip, port, err := n.parseAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	conn, err := n.ListenUDP(&net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dialer dials through the tunnel, with the fields of net.Dialer
+// which make sense there.
+type Dialer struct {
+	Net       *Net
+	Timeout   time.Duration // zero for no timeout other than that of the context
+	LocalAddr net.Addr      // *net.UDPAddr binding UDP sockets, ignored for TCP
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if laddr, ok := d.LocalAddr.(*net.UDPAddr); ok {
+		switch network {
+		case "udp", "udp4", "udp6":
+			addresses, err := d.Net.resolve(ctx, address)
+			if err != nil {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+			}
+			ip, port, err := d.Net.parseAddr(network, addresses[0])
+			if err != nil {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+			}
+			conn, err := d.Net.DialUDP(laddr, &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	return d.Net.DialContext(ctx, network, address)
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
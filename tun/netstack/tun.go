@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+/* A TUN device backed by a userspace network stack
+ *
+ * Packets the device decrypts are handed to a gVisor network stack
+ * rather than to the kernel, and packets the stack sends are read by
+ * the device. Together with a device, this carries the TCP and UDP
+ * connections of an application through the tunnel entirely
+ * in-process, requiring neither privileges nor a kernel TUN driver.
+ * The sockets of the tunnel are opened through Net.
+ */
+
+const nicID = 1
+
+type netTun struct {
+	stack      *stack.Stack
+	dispatcher stack.NetworkDispatcher
+	events     chan tun.Event
+	incoming   chan buffer.VectorisedView // packets sent by the stack, read by the device
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mtu        int
+	hasV4      bool
+	hasV6      bool
+	dnsMutex   sync.RWMutex
+	dnsServers []net.IP // see Net.SetDNSServers
+
+	routerMutex sync.RWMutex
+	router      *RouterConfig // nil unless enabled, see Net.EnableIPv6Router
+}
+
+// endpoint is the link endpoint the stack sends and receives through.
+type endpoint netTun
+
+// Net opens sockets on the inner network of the tunnel.
+type Net netTun
+
+// CreateNetTUN returns a TUN device for a device to use, and the inner
+// network of the tunnel, on which the host has localAddresses.
+func CreateNetTUN(localAddresses []net.IP, mtu int) (tun.Device, *Net, error) {
+	dev := &netTun{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+			HandleLocal:        true,
+		}),
+		events:   make(chan tun.Event, 10),
+		incoming: make(chan buffer.VectorisedView),
+		closed:   make(chan struct{}),
+		mtu:      mtu,
+	}
+	if err := dev.stack.CreateNIC(nicID, (*endpoint)(dev)); err != nil {
+		return nil, nil, fmt.Errorf("CreateNIC: %v", err)
+	}
+	for _, ip := range localAddresses {
+		protocolAddress := tcpip.ProtocolAddress{Protocol: ipv6.ProtocolNumber}
+		if ip4 := ip.To4(); ip4 != nil {
+			protocolAddress.Protocol = ipv4.ProtocolNumber
+			protocolAddress.AddressWithPrefix = tcpip.Address(ip4).WithPrefix()
+			dev.hasV4 = true
+		} else if ip16 := ip.To16(); ip16 != nil {
+			protocolAddress.AddressWithPrefix = tcpip.Address(ip16).WithPrefix()
+			dev.hasV6 = true
+		} else {
+			return nil, nil, fmt.Errorf("invalid local address %v", ip)
+		}
+		if err := dev.stack.AddProtocolAddress(nicID, protocolAddress, stack.AddressProperties{}); err != nil {
+			return nil, nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, err)
+		}
+	}
+	if dev.hasV4 {
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if dev.hasV6 {
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	dev.events <- tun.EventUp
+	return dev, (*Net)(dev), nil
+}
+
+/* Implementation of tun.Device
+ */
+
+func (tun *netTun) File() *os.File {
+	return nil
+}
+
+func (tun *netTun) Name() (string, error) {
+	return "go", nil
+}
+
+func (tun *netTun) MTU() (int, error) {
+	return tun.mtu, nil
+}
+
+func (tun *netTun) Events() chan tun.Event {
+	return tun.events
+}
+
+func (tun *netTun) Read(buff []byte, offset int) (int, error) {
+	select {
+	case view := <-tun.incoming:
+		return view.Read(buff[offset:])
+	case <-tun.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (tun *netTun) Write(buff []byte, offset int) (int, error) {
+	packet := buff[offset:]
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(packet).ToVectorisedView(),
+	})
+	switch packet[0] >> 4 {
+	case 4:
+		tun.dispatcher.DeliverNetworkPacket("", "", ipv4.ProtocolNumber, pkt)
+	case 6:
+		if tun.answerNDP(packet) {
+			return len(buff), nil
+		}
+		tun.dispatcher.DeliverNetworkPacket("", "", ipv6.ProtocolNumber, pkt)
+	}
+	return len(buff), nil
+}
+
+func (tun *netTun) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+	n, err := tun.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func (tun *netTun) WritePackets(buffs [][]byte, offset int) (int, error) {
+	for i, buff := range buffs {
+		if _, err := tun.Write(buff, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(buffs), nil
+}
+
+func (tun *netTun) BatchSize() int {
+	return 1
+}
+
+func (tun *netTun) Flush() error {
+	return nil
+}
+
+func (tun *netTun) Close() error {
+	tun.closeOnce.Do(func() {
+		tun.stack.RemoveNIC(nicID)
+		close(tun.closed)
+		close(tun.events)
+	})
+	return nil
+}
+
+/* Implementation of stack.LinkEndpoint
+ */
+
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+}
+
+func (e *endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+func (e *endpoint) MTU() uint32 {
+	return uint32(e.mtu)
+}
+
+func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityNone
+}
+
+func (*endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+func (*endpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+func (*endpoint) Wait() {}
+
+func (*endpoint) ARPHardwareType() header.ARPHardwareType {
+	return header.ARPHardwareNone
+}
+
+func (*endpoint) AddHeader(tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+}
+
+func (e *endpoint) WritePacket(_ stack.RouteInfo, _ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) tcpip.Error {
+	view := buffer.NewVectorisedView(pkt.Size(), pkt.Views())
+	select {
+	case e.incoming <- view:
+		return nil
+	case <-e.closed:
+		return &tcpip.ErrClosedForSend{}
+	}
+}
+
+func (e *endpoint) WritePackets(r stack.RouteInfo, pkts stack.PacketBufferList, protocol tcpip.NetworkProtocolNumber) (int, tcpip.Error) {
+	n := 0
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		if err := e.WritePacket(r, protocol, pkt); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (e *endpoint) WriteRawPacket(pkt *stack.PacketBuffer) tcpip.Error {
+	return e.WritePacket(stack.RouteInfo{}, 0, pkt)
+}
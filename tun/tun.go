@@ -18,12 +18,40 @@ const (
 )
 
 type Device interface {
-	File() *os.File                 // returns the file descriptor of the device
-	Read([]byte, int) (int, error)  // read a packet from the device (without any additional headers)
-	Write([]byte, int) (int, error) // writes a packet to the device (without any additional headers)
-	Flush() error                   // flush all previous writes to the device
-	MTU() (int, error)              // returns the MTU of the device
-	Name() (string, error)          // fetches and returns the current name
-	Events() chan Event             // returns a constant channel of events related to the device
-	Close() error                   // stops the device and closes the event channel
+	File() *os.File                                // returns the file descriptor of the device
+	Read([]byte, int) (int, error)                 // read a packet from the device (without any additional headers)
+	Write([]byte, int) (int, error)                // writes a packet to the device (without any additional headers)
+	ReadPackets([][]byte, []int, int) (int, error) // reads one or more packets, storing their sizes, and returns the number of packets read
+	WritePackets([][]byte, int) (int, error)       // writes each packet in turn and returns the number of packets written
+	BatchSize() int                                // returns the preferred number of packets passed to ReadPackets and WritePackets
+	Flush() error                                  // flush all previous writes to the device
+	MTU() (int, error)                             // returns the MTU of the device
+	Name() (string, error)                         // fetches and returns the current name
+	Events() chan Event                            // returns a constant channel of events related to the device
+	Close() error                                  // stops the device and closes the event channel
+}
+
+/* Helpers for platforms on which a packet can only be read or written
+ * with a single system call each, and so cannot do better than a batch of one.
+ */
+
+func readOnePacket(read func([]byte, int) (int, error), buffs [][]byte, sizes []int, offset int) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+	n, err := read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+func writeEachPacket(write func([]byte, int) (int, error), buffs [][]byte, offset int) (int, error) {
+	for i, buff := range buffs {
+		if _, err := write(buff, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(buffs), nil
 }
@@ -254,6 +254,18 @@ func (tun *NativeTun) Flush() error {
 	return nil
 }
 
+func (tun *NativeTun) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	return readOnePacket(tun.Read, buffs, sizes, offset)
+}
+
+func (tun *NativeTun) WritePackets(buffs [][]byte, offset int) (int, error) {
+	return writeEachPacket(tun.Write, buffs, offset)
+}
+
+func (tun *NativeTun) BatchSize() int {
+	return 1
+}
+
 func (tun *NativeTun) Close() error {
 	var err2 error
 	err1 := tun.tunFile.Close()
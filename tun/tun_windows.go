@@ -42,6 +42,7 @@ type NativeTun struct {
 	rate      rateJuggler
 	session   wintun.Session
 	readWait  windows.Handle
+	adopted   bool // adapter created by someone else, not deleted on close
 }
 
 var WintunPool *wintun.Pool
@@ -93,6 +94,20 @@ func CreateTUNWithRequestedGUID(ifname string, requestedGUID *windows.GUID, mtu
 		log.Println("Windows indicated a reboot is required.")
 	}
 
+	return createTUNFromAdapter(wt, mtu, false)
+}
+
+//
+// CreateFromHandle creates a TUN device from the handle of an existing Wintun
+// adapter, as returned by WintunCreateAdapter or WintunOpenAdapter, so that
+// the caller needs no privileges to create one. The adapter is left in place
+// when the device is closed.
+//
+func CreateFromHandle(handle uintptr, mtu int) (Device, error) {
+	return createTUNFromAdapter(wintun.AdapterFromHandle(handle), mtu, true)
+}
+
+func createTUNFromAdapter(wt *wintun.Adapter, mtu int, adopted bool) (Device, error) {
 	forcedMTU := 1420
 	if mtu > 0 {
 		forcedMTU = mtu
@@ -104,11 +119,15 @@ func CreateTUNWithRequestedGUID(ifname string, requestedGUID *windows.GUID, mtu
 		events:    make(chan Event, 10),
 		errors:    make(chan error, 1),
 		forcedMTU: forcedMTU,
+		adopted:   adopted,
 	}
 
+	var err error
 	tun.session, err = wt.StartSession(0x800000) // Ring capacity, 8 MiB
 	if err != nil {
-		tun.wt.Delete(false)
+		if !adopted {
+			tun.wt.Delete(false)
+		}
 		close(tun.events)
 		return nil, fmt.Errorf("Error starting session: %w", err)
 	}
@@ -132,7 +151,7 @@ func (tun *NativeTun) Close() error {
 	tun.close = true
 	tun.session.End()
 	var err error
-	if tun.wt != nil {
+	if tun.wt != nil && !tun.adopted {
 		_, err = tun.wt.Delete(false)
 	}
 	close(tun.events)
@@ -148,7 +167,7 @@ func (tun *NativeTun) ForceMTU(mtu int) {
 	tun.forcedMTU = mtu
 }
 
-// Note: Read() and Write() assume the caller comes only from a single thread; there's no locking.
+// Note: Read() and Write(), as well as their batched variants, assume the caller comes only from a single thread; there's no locking.
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
 retry:
@@ -187,6 +206,34 @@ retry:
 	}
 }
 
+// ReadPackets blocks until at least one packet is available, and then
+// drains whatever else is already waiting in the ring, without spinning.
+func (tun *NativeTun) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+	n, err := tun.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	for i := 1; i < len(buffs); i++ {
+		if tun.close {
+			return i, nil
+		}
+		packet, err := tun.session.ReceivePacket()
+		if err != nil {
+			return i, nil
+		}
+		packetSize := len(packet)
+		copy(buffs[i][offset:], packet)
+		tun.session.ReleaseReceivePacket(packet)
+		tun.rate.update(uint64(packetSize))
+		sizes[i] = packetSize
+	}
+	return len(buffs), nil
+}
+
 func (tun *NativeTun) Flush() error {
 	return nil
 }
@@ -214,6 +261,19 @@ func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
 	return 0, fmt.Errorf("Write failed: %w", err)
 }
 
+func (tun *NativeTun) WritePackets(buffs [][]byte, offset int) (int, error) {
+	for i, buff := range buffs {
+		if _, err := tun.Write(buff, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(buffs), nil
+}
+
+func (tun *NativeTun) BatchSize() int {
+	return 32
+}
+
 // LUID returns Windows interface instance ID.
 func (tun *NativeTun) LUID() uint64 {
 	return tun.wt.LUID()
@@ -124,8 +124,12 @@ func (t *chTun) Read(data []byte, offset int) (int, error) {
 // Write is called by the wireguard device to deliver a packet for routing.
 func (t *chTun) Write(data []byte, offset int) (int, error) {
 	if offset == -1 {
-		close(t.c.closed)
-		close(t.c.events)
+		select {
+		case <-t.c.closed:
+		default:
+			close(t.c.closed)
+			close(t.c.events)
+		}
 		return 0, io.EOF
 	}
 	msg := make([]byte, len(data)-offset)
@@ -138,8 +142,39 @@ func (t *chTun) Write(data []byte, offset int) (int, error) {
 	}
 }
 
+// ReadPackets blocks for the first packet and then takes any others already queued.
+func (t *chTun) ReadPackets(buffs [][]byte, sizes []int, offset int) (int, error) {
+	if len(buffs) == 0 {
+		return 0, nil
+	}
+	n, err := t.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	for i := 1; i < len(buffs); i++ {
+		select {
+		case msg := <-t.c.Outbound:
+			sizes[i] = copy(buffs[i][offset:], msg)
+		default:
+			return i, nil
+		}
+	}
+	return len(buffs), nil
+}
+
+func (t *chTun) WritePackets(buffs [][]byte, offset int) (int, error) {
+	for i, buff := range buffs {
+		if _, err := t.Write(buff, offset); err != nil {
+			return i, err
+		}
+	}
+	return len(buffs), nil
+}
+
 const DefaultMTU = 1420
 
+func (t *chTun) BatchSize() int         { return 16 }
 func (t *chTun) Flush() error           { return nil }
 func (t *chTun) MTU() (int, error)      { return DefaultMTU, nil }
 func (t *chTun) Name() (string, error)  { return "loopbackTun1", nil }
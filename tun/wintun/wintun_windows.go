@@ -97,6 +97,13 @@ func (pool *Pool) OpenAdapter(ifname string) (wintun *Adapter, err error) {
 	return
 }
 
+// AdapterFromHandle wraps the handle of an adapter created or opened elsewhere in the process, for
+// instance by a privileged component which loaded wintun.dll before dropping privileges. The handle
+// remains owned by the caller and is not freed along with the returned adapter.
+func AdapterFromHandle(handle uintptr) *Adapter {
+	return &Adapter{handle}
+}
+
 // CreateAdapter creates a Wintun adapter. ifname is the requested name of the adapter, while
 // requestedGUID is the GUID of the created network adapter, which then influences NLA generation
 // deterministically. If it is set to nil, the GUID is chosen by the system at random, and hence a